@@ -0,0 +1,279 @@
+// Package diameter implements the Diameter base protocol (RFC 6733): message
+// and AVP encoding, capabilities exchange, device watchdog and the peer state
+// machine over TCP.
+package diameter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// AVP flags
+const (
+	AVPFlagVendor    uint8 = 0x80
+	AVPFlagMandatory uint8 = 0x40
+	AVPFlagProtected uint8 = 0x20
+)
+
+// ntpEpochOffset is the number of seconds from 1900, the epoch of the Time
+// format, to 1970
+const ntpEpochOffset = 2208988800
+
+// avpHeaderLen is the AVP header length without and with a Vendor-Id
+const (
+	avpHeaderLen       = 8
+	avpVendorHeaderLen = 12
+)
+
+// AVP is a Diameter attribute-value pair
+type AVP struct {
+	Code     uint32
+	Flags    uint8
+	VendorID uint32
+	Data     []byte
+}
+
+// NewAVP creates an AVP with the given flags. The V flag is set when
+// vendorID is not zero.
+func NewAVP(code uint32, flags uint8, vendorID uint32, data []byte) *AVP {
+	if vendorID != 0 {
+		flags |= AVPFlagVendor
+	} else {
+		flags &^= AVPFlagVendor
+	}
+	return &AVP{Code: code, Flags: flags, VendorID: vendorID, Data: data}
+}
+
+// UTF8String creates a mandatory UTF8String (or OctetString) AVP
+func UTF8String(code, vendorID uint32, value string) *AVP {
+	return NewAVP(code, AVPFlagMandatory, vendorID, []byte(value))
+}
+
+// OctetString creates a mandatory OctetString AVP
+func OctetString(code, vendorID uint32, value []byte) *AVP {
+	return NewAVP(code, AVPFlagMandatory, vendorID, value)
+}
+
+// Unsigned32 creates a mandatory Unsigned32 (or Enumerated) AVP
+func Unsigned32(code, vendorID uint32, value uint32) *AVP {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return NewAVP(code, AVPFlagMandatory, vendorID, data)
+}
+
+// Integer32 creates a mandatory Integer32 AVP
+func Integer32(code, vendorID uint32, value int32) *AVP {
+	return Unsigned32(code, vendorID, uint32(value))
+}
+
+// Time creates a mandatory Time AVP, the seconds since 1900 of NTP
+// (RFC 6733 section 4.3.1)
+func Time(code, vendorID uint32, t time.Time) *AVP {
+	return Unsigned32(code, vendorID, uint32(t.Unix()+ntpEpochOffset))
+}
+
+// Unsigned64 creates a mandatory Unsigned64 AVP
+func Unsigned64(code, vendorID uint32, value uint64) *AVP {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return NewAVP(code, AVPFlagMandatory, vendorID, data)
+}
+
+// Address creates a mandatory Address AVP for an IPv4 or IPv6 address
+func Address(code, vendorID uint32, ip net.IP) *AVP {
+	var data []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		data = append([]byte{0, 1}, ip4...)
+	} else {
+		data = append([]byte{0, 2}, ip.To16()...)
+	}
+	return NewAVP(code, AVPFlagMandatory, vendorID, data)
+}
+
+// Grouped creates a mandatory Grouped AVP holding avps
+func Grouped(code, vendorID uint32, avps ...*AVP) *AVP {
+	var data []byte
+	for _, a := range avps {
+		data = a.appendTo(data)
+	}
+	return NewAVP(code, AVPFlagMandatory, vendorID, data)
+}
+
+// Mandatory reports whether the M flag is set
+func (a *AVP) Mandatory() bool {
+	return a.Flags&AVPFlagMandatory != 0
+}
+
+// String returns the data of a UTF8String, OctetString or DiameterIdentity AVP
+func (a *AVP) String() string {
+	return string(a.Data)
+}
+
+// Uint32 decodes an Unsigned32 or Enumerated AVP
+func (a *AVP) Uint32() (uint32, error) {
+	if len(a.Data) != 4 {
+		return 0, fmt.Errorf("AVP %d: invalid Unsigned32 length %d", a.Code, len(a.Data))
+	}
+	return binary.BigEndian.Uint32(a.Data), nil
+}
+
+// Int32 decodes an Integer32 AVP
+func (a *AVP) Int32() (int32, error) {
+	v, err := a.Uint32()
+	return int32(v), err
+}
+
+// Time decodes a Time AVP. Values with the most significant bit cleared
+// are past 2036, when the seconds since 1900 wrap (RFC 5905 section 6).
+func (a *AVP) Time() (time.Time, error) {
+	v, err := a.Uint32()
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds := int64(v)
+	if v&0x80000000 == 0 {
+		seconds += 1 << 32
+	}
+	return time.Unix(seconds-ntpEpochOffset, 0).UTC(), nil
+}
+
+// Uint64 decodes an Unsigned64 AVP
+func (a *AVP) Uint64() (uint64, error) {
+	if len(a.Data) != 8 {
+		return 0, fmt.Errorf("AVP %d: invalid Unsigned64 length %d", a.Code, len(a.Data))
+	}
+	return binary.BigEndian.Uint64(a.Data), nil
+}
+
+// Address decodes an Address AVP
+func (a *AVP) Address() (net.IP, error) {
+	if len(a.Data) < 2 {
+		return nil, fmt.Errorf("AVP %d: address too short", a.Code)
+	}
+	switch family := binary.BigEndian.Uint16(a.Data); {
+	case family == 1 && len(a.Data) == 6:
+		return net.IP(append([]byte(nil), a.Data[2:]...)), nil
+	case family == 2 && len(a.Data) == 18:
+		return net.IP(append([]byte(nil), a.Data[2:]...)), nil
+	default:
+		return nil, fmt.Errorf("AVP %d: unsupported address family %d", a.Code, family)
+	}
+}
+
+// Grouped decodes the AVPs of a Grouped AVP
+func (a *AVP) Grouped() ([]*AVP, error) {
+	avps, err := decodeAVPs(a.Data)
+	if err != nil {
+		return nil, fmt.Errorf("AVP %d: %w", a.Code, err)
+	}
+	return avps, nil
+}
+
+// headerLen returns the length of the AVP header
+func (a *AVP) headerLen() int {
+	if a.Flags&AVPFlagVendor != 0 {
+		return avpVendorHeaderLen
+	}
+	return avpHeaderLen
+}
+
+// appendTo appends the encoded AVP, padded to 32 bits, to b
+func (a *AVP) appendTo(b []byte) []byte {
+	length := a.headerLen() + len(a.Data)
+	b = binary.BigEndian.AppendUint32(b, a.Code)
+	b = append(b, a.Flags, byte(length>>16), byte(length>>8), byte(length))
+	if a.Flags&AVPFlagVendor != 0 {
+		b = binary.BigEndian.AppendUint32(b, a.VendorID)
+	}
+	b = append(b, a.Data...)
+	for i := length; i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// decodeAVPs decodes a sequence of padded AVPs
+func decodeAVPs(b []byte) ([]*AVP, error) {
+	var avps []*AVP
+	for len(b) > 0 {
+		if len(b) < avpHeaderLen {
+			return nil, fmt.Errorf("truncated AVP header")
+		}
+		a := &AVP{
+			Code:  binary.BigEndian.Uint32(b),
+			Flags: b[4],
+		}
+		length := int(b[5])<<16 | int(b[6])<<8 | int(b[7])
+		if length < a.headerLen() || length > len(b) {
+			return nil, fmt.Errorf("AVP %d: invalid length %d", a.Code, length)
+		}
+		if a.Flags&AVPFlagVendor != 0 {
+			a.VendorID = binary.BigEndian.Uint32(b[8:])
+		}
+		a.Data = append([]byte(nil), b[a.headerLen():length]...)
+		avps = append(avps, a)
+
+		padded := (length + 3) &^ 3
+		if padded > len(b) {
+			padded = len(b)
+		}
+		b = b[padded:]
+	}
+	return avps, nil
+}
+
+// FindAVP returns the first AVP in avps with the given code and vendor
+func FindAVP(avps []*AVP, code, vendorID uint32) *AVP {
+	for _, a := range avps {
+		if a.Code == code && a.VendorID == vendorID {
+			return a
+		}
+	}
+	return nil
+}
+
+// FindAVPs returns every AVP in avps with the given code and vendor
+func FindAVPs(avps []*AVP, code, vendorID uint32) []*AVP {
+	var found []*AVP
+	for _, a := range avps {
+		if a.Code == code && a.VendorID == vendorID {
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+// MissingAVPError reports a message without a required AVP. Servers answer
+// it with DIAMETER_MISSING_AVP.
+type MissingAVPError struct {
+	Name string
+}
+
+func (e *MissingAVPError) Error() string {
+	return fmt.Sprintf("missing %s AVP", e.Name)
+}
+
+// FindUint32 decodes an optional Unsigned32 or Enumerated AVP
+func FindUint32(avps []*AVP, code, vendorID uint32) (uint32, bool, error) {
+	a := FindAVP(avps, code, vendorID)
+	if a == nil {
+		return 0, false, nil
+	}
+	v, err := a.Uint32()
+	return v, true, err
+}
+
+// RequireUint32 decodes a required Unsigned32 or Enumerated AVP, failing
+// with a MissingAVPError naming it when it is absent
+func RequireUint32(avps []*AVP, code, vendorID uint32, name string) (uint32, error) {
+	v, ok, err := FindUint32(avps, code, vendorID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, &MissingAVPError{Name: name}
+	}
+	return v, nil
+}
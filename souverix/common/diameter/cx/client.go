@@ -0,0 +1,121 @@
+package cx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// Client sends Cx requests over a peer connection. The CSCFs send
+// UAR/SAR/MAR/LIR to the HSS; the HSS sends RTR/PPR to the S-CSCF.
+// Answers with a failure result are returned without an error; callers
+// check the answer's Result.
+type Client struct {
+	peer *diameter.Peer
+}
+
+// NewClient creates a Cx client on an open peer
+func NewClient(peer *diameter.Peer) *Client {
+	return &Client{peer: peer}
+}
+
+// Peer returns the underlying peer connection
+func (c *Client) Peer() *diameter.Peer {
+	return c.peer
+}
+
+// request sends a Cx request with the common session AVPs and returns the answer
+func (c *Client) request(ctx context.Context, command uint32, sessionID, destinationHost string, avps []*diameter.AVP) (*diameter.Message, error) {
+	if sessionID == "" {
+		sessionID = c.peer.NewSessionID()
+	}
+	m := c.peer.NewRequest(command, ApplicationID, sessionID,
+		vendorSpecificApplicationID(),
+		diameter.Unsigned32(diameter.AVPAuthSessionState, 0, diameter.NoStateMaintained),
+	)
+	if destinationHost != "" {
+		m.Add(diameter.UTF8String(diameter.AVPDestinationHost, 0, destinationHost))
+	}
+	m.Add(diameter.UTF8String(diameter.AVPDestinationRealm, 0, c.peer.RemoteRealm()))
+	m.Add(avps...)
+
+	answer, err := c.peer.Request(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if answer.CommandCode != command {
+		return nil, fmt.Errorf("unexpected answer command %d to request %d", answer.CommandCode, command)
+	}
+	return answer, nil
+}
+
+// UserAuthorization sends a UAR
+func (c *Client) UserAuthorization(ctx context.Context, req *UAR) (*UAA, error) {
+	answer, err := c.request(ctx, CommandUserAuthorization, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	return parseUAA(answer)
+}
+
+// ServerAssignment sends a SAR
+func (c *Client) ServerAssignment(ctx context.Context, req *SAR) (*SAA, error) {
+	answer, err := c.request(ctx, CommandServerAssignment, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	return parseSAA(answer)
+}
+
+// MultimediaAuth sends a MAR
+func (c *Client) MultimediaAuth(ctx context.Context, req *MAR) (*MAA, error) {
+	answer, err := c.request(ctx, CommandMultimediaAuth, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	return parseMAA(answer)
+}
+
+// LocationInfo sends a LIR
+func (c *Client) LocationInfo(ctx context.Context, req *LIR) (*LIA, error) {
+	answer, err := c.request(ctx, CommandLocationInfo, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	return parseLIA(answer)
+}
+
+// RegistrationTermination sends a RTR
+func (c *Client) RegistrationTermination(ctx context.Context, req *RTR) (*RTA, error) {
+	answer, err := c.request(ctx, CommandRegistrationTermination, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &RTA{Result: result}, nil
+}
+
+// PushProfile sends a PPR
+func (c *Client) PushProfile(ctx context.Context, req *PPR) (*PPA, error) {
+	answer, err := c.request(ctx, CommandPushProfile, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &PPA{Result: result}, nil
+}
+
+// vendorSpecificApplicationID identifies Cx in requests and answers
+func vendorSpecificApplicationID() *diameter.AVP {
+	return diameter.Grouped(diameter.AVPVendorSpecificApplicationID, 0,
+		diameter.Unsigned32(diameter.AVPVendorID, 0, Vendor3GPP),
+		diameter.Unsigned32(diameter.AVPAuthApplicationID, 0, ApplicationID),
+	)
+}
@@ -0,0 +1,131 @@
+// Package cx implements the 3GPP Cx/Dx Diameter application (TS 29.228 and
+// TS 29.229) between the CSCFs and the HSS.
+package cx
+
+import "github.com/dasmlab/souverix/common/diameter"
+
+const (
+	// ApplicationID is the Cx/Dx Diameter application id
+	ApplicationID uint32 = 16777216
+
+	// Vendor3GPP is the 3GPP vendor id used by Cx AVPs and experimental results
+	Vendor3GPP uint32 = 10415
+)
+
+// Application is the Cx application advertised in the capabilities exchange
+var Application = diameter.Application{ID: ApplicationID, VendorID: Vendor3GPP}
+
+// Cx command codes (TS 29.229 section 6.1)
+const (
+	CommandUserAuthorization       uint32 = 300
+	CommandServerAssignment        uint32 = 301
+	CommandLocationInfo            uint32 = 302
+	CommandMultimediaAuth          uint32 = 303
+	CommandRegistrationTermination uint32 = 304
+	CommandPushProfile             uint32 = 305
+)
+
+// Cx AVP codes (TS 29.229 section 6.3), vendor 10415
+const (
+	AVPVisitedNetworkIdentifier uint32 = 600
+	AVPPublicIdentity           uint32 = 601
+	AVPServerName               uint32 = 602
+	AVPServerCapabilities       uint32 = 603
+	AVPMandatoryCapability      uint32 = 604
+	AVPOptionalCapability       uint32 = 605
+	AVPUserData                 uint32 = 606
+	AVPSIPNumberAuthItems       uint32 = 607
+	AVPSIPAuthenticationScheme  uint32 = 608
+	AVPSIPAuthenticate          uint32 = 609
+	AVPSIPAuthorization         uint32 = 610
+	AVPSIPAuthenticationContext uint32 = 611
+	AVPSIPAuthDataItem          uint32 = 612
+	AVPSIPItemNumber            uint32 = 613
+	AVPServerAssignmentType     uint32 = 614
+	AVPDeregistrationReason     uint32 = 615
+	AVPReasonCode               uint32 = 616
+	AVPReasonInfo               uint32 = 617
+	AVPUserAuthorizationType    uint32 = 623
+	AVPUserDataAlreadyAvailable uint32 = 624
+	AVPConfidentialityKey       uint32 = 625
+	AVPIntegrityKey             uint32 = 626
+	AVPOriginatingRequest       uint32 = 633
+	AVPSIPDigestAuthenticate    uint32 = 635
+)
+
+// Digest AVP codes (RFC 4590) carried in SIP-Digest-Authenticate
+const (
+	AVPDigestRealm     uint32 = 104
+	AVPDigestQoP       uint32 = 110
+	AVPDigestAlgorithm uint32 = 111
+	AVPDigestHA1       uint32 = 121
+)
+
+// Experimental-Result-Code values (TS 29.229 section 6.2)
+const (
+	ResultFirstRegistration              uint32 = 2001
+	ResultSubsequentRegistration         uint32 = 2002
+	ResultUnregisteredService            uint32 = 2003
+	ResultServerNameNotStored            uint32 = 2004
+	ResultErrorUserUnknown               uint32 = 5001
+	ResultErrorIdentitiesDontMatch       uint32 = 5002
+	ResultErrorIdentityNotRegistered     uint32 = 5003
+	ResultErrorRoamingNotAllowed         uint32 = 5004
+	ResultErrorIdentityAlreadyRegistered uint32 = 5005
+	ResultErrorAuthSchemeNotSupported    uint32 = 5006
+	ResultErrorInAssignmentType          uint32 = 5007
+	ResultErrorTooMuchData               uint32 = 5008
+	ResultErrorNotSupportedUserData      uint32 = 5009
+)
+
+// Server-Assignment-Type values
+const (
+	AssignmentNoAssignment                         uint32 = 0
+	AssignmentRegistration                         uint32 = 1
+	AssignmentReRegistration                       uint32 = 2
+	AssignmentUnregisteredUser                     uint32 = 3
+	AssignmentTimeoutDeregistration                uint32 = 4
+	AssignmentUserDeregistration                   uint32 = 5
+	AssignmentTimeoutDeregistrationStoreServerName uint32 = 6
+	AssignmentUserDeregistrationStoreServerName    uint32 = 7
+	AssignmentAdministrativeDeregistration         uint32 = 8
+	AssignmentAuthenticationFailure                uint32 = 9
+	AssignmentAuthenticationTimeout                uint32 = 10
+	AssignmentDeregistrationTooMuchData            uint32 = 11
+)
+
+// User-Authorization-Type values
+const (
+	AuthorizationRegistration                uint32 = 0
+	AuthorizationDeRegistration              uint32 = 1
+	AuthorizationRegistrationAndCapabilities uint32 = 2
+)
+
+// User-Data-Already-Available values
+const (
+	UserDataNotAvailable     uint32 = 0
+	UserDataAlreadyAvailable uint32 = 1
+)
+
+// Reason-Code values for RTR
+const (
+	ReasonPermanentTermination uint32 = 0
+	ReasonNewServerAssigned    uint32 = 1
+	ReasonServerChange         uint32 = 2
+	ReasonRemoveSCSCF          uint32 = 3
+)
+
+// SIP-Authentication-Scheme values
+const (
+	SchemeAKAv1MD5  = "Digest-AKAv1-MD5"
+	SchemeSIPDigest = "SIP Digest"
+	SchemeUnknown   = "Unknown"
+)
+
+// Experimental returns a 3GPP Experimental-Result
+func Experimental(code uint32) diameter.Result {
+	return diameter.Result{Code: code, VendorID: Vendor3GPP}
+}
+
+// Success is the DIAMETER_SUCCESS result
+var Success = diameter.Result{Code: diameter.ResultSuccess}
@@ -0,0 +1,94 @@
+package cx
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// HSS answers the Cx requests sent by the CSCFs
+type HSS interface {
+	UserAuthorization(ctx context.Context, req *UAR) *UAA
+	ServerAssignment(ctx context.Context, req *SAR) *SAA
+	MultimediaAuth(ctx context.Context, req *MAR) *MAA
+	LocationInfo(ctx context.Context, req *LIR) *LIA
+}
+
+// SCSCF answers the Cx requests sent by the HSS
+type SCSCF interface {
+	RegistrationTermination(ctx context.Context, req *RTR) *RTA
+	PushProfile(ctx context.Context, req *PPR) *PPA
+}
+
+// Handler dispatches received Cx requests. Requests for a side that is not
+// set are rejected with DIAMETER_COMMAND_UNSUPPORTED.
+type Handler struct {
+	HSS   HSS
+	SCSCF SCSCF
+}
+
+// ServeDiameter implements diameter.Handler
+func (h *Handler) ServeDiameter(p *diameter.Peer, req *diameter.Message) *diameter.Message {
+	ctx := context.Background()
+
+	var result diameter.Result
+	var avps []*diameter.AVP
+	var err error
+
+	switch {
+	case req.CommandCode == CommandUserAuthorization && h.HSS != nil:
+		var r *UAR
+		if r, err = parseUAR(req); err == nil {
+			a := h.HSS.UserAuthorization(ctx, r)
+			result, avps = a.Result, a.avps()
+		}
+	case req.CommandCode == CommandServerAssignment && h.HSS != nil:
+		var r *SAR
+		if r, err = parseSAR(req); err == nil {
+			a := h.HSS.ServerAssignment(ctx, r)
+			result, avps = a.Result, a.avps()
+		}
+	case req.CommandCode == CommandMultimediaAuth && h.HSS != nil:
+		var r *MAR
+		if r, err = parseMAR(req); err == nil {
+			a := h.HSS.MultimediaAuth(ctx, r)
+			result, avps = a.Result, a.avps()
+		}
+	case req.CommandCode == CommandLocationInfo && h.HSS != nil:
+		var r *LIR
+		if r, err = parseLIR(req); err == nil {
+			a := h.HSS.LocationInfo(ctx, r)
+			result, avps = a.Result, a.avps()
+		}
+	case req.CommandCode == CommandRegistrationTermination && h.SCSCF != nil:
+		var r *RTR
+		if r, err = parseRTR(req); err == nil {
+			result = h.SCSCF.RegistrationTermination(ctx, r).Result
+		}
+	case req.CommandCode == CommandPushProfile && h.SCSCF != nil:
+		var r *PPR
+		if r, err = parsePPR(req); err == nil {
+			result = h.SCSCF.PushProfile(ctx, r).Result
+		}
+	default:
+		result = diameter.Result{Code: diameter.ResultCommandUnsupported}
+	}
+
+	if err != nil {
+		var missing *diameter.MissingAVPError
+		if errors.As(err, &missing) {
+			result = diameter.Result{Code: diameter.ResultMissingAVP}
+		} else {
+			result = diameter.Result{Code: diameter.ResultInvalidAVPValue}
+		}
+		avps = nil
+	}
+
+	answer := p.NewAnswer(req, result)
+	answer.Add(
+		vendorSpecificApplicationID(),
+		diameter.Unsigned32(diameter.AVPAuthSessionState, 0, diameter.NoStateMaintained),
+	)
+	return answer.Add(avps...)
+}
@@ -0,0 +1,181 @@
+package cx
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeHSS answers Cx requests with fixed answers and records the requests
+type fakeHSS struct {
+	uar *UAR
+	sar *SAR
+	mar *MAR
+	lir *LIR
+}
+
+func (f *fakeHSS) UserAuthorization(ctx context.Context, req *UAR) *UAA {
+	f.uar = req
+	return &UAA{Result: Experimental(ResultSubsequentRegistration), ServerName: "sip:scscf.ims.test"}
+}
+
+func (f *fakeHSS) ServerAssignment(ctx context.Context, req *SAR) *SAA {
+	f.sar = req
+	return &SAA{Result: Success, UserName: req.UserName, UserData: []byte("<IMSSubscription/>")}
+}
+
+func (f *fakeHSS) MultimediaAuth(ctx context.Context, req *MAR) *MAA {
+	f.mar = req
+	return &MAA{Result: Experimental(ResultErrorAuthSchemeNotSupported)}
+}
+
+func (f *fakeHSS) LocationInfo(ctx context.Context, req *LIR) *LIA {
+	f.lir = req
+	return &LIA{Result: Experimental(ResultErrorUserUnknown)}
+}
+
+// fakeSCSCF answers RTR and PPR
+type fakeSCSCF struct {
+	rtr *RTR
+	ppr *PPR
+}
+
+func (f *fakeSCSCF) RegistrationTermination(ctx context.Context, req *RTR) *RTA {
+	f.rtr = req
+	return &RTA{Result: Success}
+}
+
+func (f *fakeSCSCF) PushProfile(ctx context.Context, req *PPR) *PPA {
+	f.ppr = req
+	return &PPA{Result: Success}
+}
+
+func cxConfig(host string, handler diameter.Handler) *diameter.Config {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return &diameter.Config{
+		OriginHost:   host,
+		OriginRealm:  "ims.test",
+		VendorID:     Vendor3GPP,
+		Applications: []diameter.Application{Application},
+		Handler:      handler,
+		Log:          log,
+	}
+}
+
+// connectCx connects an S-CSCF to an HSS and returns a client on each side
+func connectCx(t *testing.T, hss HSS, scscf SCSCF) (fromSCSCF, fromHSS *Client) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := diameter.NewServer(cxConfig("hss.ims.test", &Handler{HSS: hss}))
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+
+	peer, err := diameter.Dial(context.Background(), "tcp", l.Addr().String(), cxConfig("scscf.ims.test", &Handler{SCSCF: scscf}))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Peer("scscf.ims.test") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("S-CSCF peer not registered on the server")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return NewClient(peer), NewClient(server.Peer("scscf.ims.test"))
+}
+
+func TestClient_HSSRequests(t *testing.T) {
+	hss := &fakeHSS{}
+	client, _ := connectCx(t, hss, &fakeSCSCF{})
+	ctx := context.Background()
+
+	uaa, err := client.UserAuthorization(ctx, &UAR{UserName: "alice@ims.test", PublicIdentity: "sip:alice@ims.test"})
+	if err != nil {
+		t.Fatalf("UserAuthorization() error = %v", err)
+	}
+	if uaa.Result != Experimental(ResultSubsequentRegistration) || uaa.ServerName != "sip:scscf.ims.test" {
+		t.Errorf("UAA = %+v", uaa)
+	}
+	if hss.uar == nil || hss.uar.UserName != "alice@ims.test" || hss.uar.SessionID == "" {
+		t.Errorf("HSS received UAR %+v", hss.uar)
+	}
+
+	saa, err := client.ServerAssignment(ctx, &SAR{
+		UserName:         "alice@ims.test",
+		PublicIdentities: []string{"sip:alice@ims.test"},
+		ServerName:       "sip:scscf.ims.test",
+		AssignmentType:   AssignmentRegistration,
+	})
+	if err != nil || saa.Result.Err() != nil || string(saa.UserData) != "<IMSSubscription/>" {
+		t.Errorf("ServerAssignment() = %+v, %v", saa, err)
+	}
+
+	maa, err := client.MultimediaAuth(ctx, &MAR{UserName: "alice@ims.test", PublicIdentity: "sip:alice@ims.test", NumberAuthItems: 1, AuthScheme: SchemeUnknown})
+	if err != nil || maa.Result != Experimental(ResultErrorAuthSchemeNotSupported) {
+		t.Errorf("MultimediaAuth() = %+v, %v", maa, err)
+	}
+
+	lia, err := client.LocationInfo(ctx, &LIR{PublicIdentity: "sip:nobody@ims.test"})
+	if err != nil || lia.Result != Experimental(ResultErrorUserUnknown) {
+		t.Errorf("LocationInfo() = %+v, %v", lia, err)
+	}
+}
+
+func TestClient_SCSCFRequests(t *testing.T) {
+	scscf := &fakeSCSCF{}
+	_, fromHSS := connectCx(t, &fakeHSS{}, scscf)
+	ctx := context.Background()
+
+	rta, err := fromHSS.RegistrationTermination(ctx, &RTR{
+		UserName:   "alice@ims.test",
+		ReasonCode: ReasonPermanentTermination,
+	})
+	if err != nil || rta.Result.Err() != nil {
+		t.Fatalf("RegistrationTermination() = %+v, %v", rta, err)
+	}
+	if scscf.rtr == nil || scscf.rtr.UserName != "alice@ims.test" {
+		t.Errorf("S-CSCF received RTR %+v", scscf.rtr)
+	}
+
+	ppa, err := fromHSS.PushProfile(ctx, &PPR{UserName: "alice@ims.test", UserData: []byte("<IMSSubscription/>")})
+	if err != nil || ppa.Result.Err() != nil {
+		t.Fatalf("PushProfile() = %+v, %v", ppa, err)
+	}
+	if scscf.ppr == nil || string(scscf.ppr.UserData) != "<IMSSubscription/>" {
+		t.Errorf("S-CSCF received PPR %+v", scscf.ppr)
+	}
+}
+
+func TestHandler_Rejections(t *testing.T) {
+	// The S-CSCF side does not answer HSS commands
+	fromSCSCF, fromHSS := connectCx(t, &fakeHSS{}, nil)
+	ctx := context.Background()
+
+	rta, err := fromHSS.RegistrationTermination(ctx, &RTR{UserName: "alice@ims.test"})
+	if err != nil {
+		t.Fatalf("RegistrationTermination() error = %v", err)
+	}
+	if rta.Result.Code != diameter.ResultCommandUnsupported {
+		t.Errorf("RTA Result = %+v, want DIAMETER_COMMAND_UNSUPPORTED", rta.Result)
+	}
+
+	// A UAR without Public-Identity is rejected with DIAMETER_MISSING_AVP
+	answer, err := fromSCSCF.request(ctx, CommandUserAuthorization, "", "", []*diameter.AVP{
+		diameter.UTF8String(diameter.AVPUserName, 0, "alice@ims.test"),
+	})
+	if err != nil {
+		t.Fatalf("request() error = %v", err)
+	}
+	if result, _ := answer.Result(); result.Code != diameter.ResultMissingAVP {
+		t.Errorf("Result = %+v, want DIAMETER_MISSING_AVP", result)
+	}
+}
@@ -0,0 +1,583 @@
+package cx
+
+import "github.com/dasmlab/souverix/common/diameter"
+
+// ServerCapabilities lists the capabilities an S-CSCF must or should
+// support, and optionally candidate S-CSCF names
+type ServerCapabilities struct {
+	Mandatory   []uint32
+	Optional    []uint32
+	ServerNames []string
+}
+
+// UAR is a User-Authorization-Request sent by the I-CSCF on REGISTER
+type UAR struct {
+	SessionID                string
+	DestinationHost          string
+	UserName                 string // IMPI
+	PublicIdentity           string // IMPU
+	VisitedNetworkIdentifier string
+	AuthorizationType        uint32
+}
+
+// UAA is a User-Authorization-Answer
+type UAA struct {
+	Result             diameter.Result
+	ServerName         string
+	ServerCapabilities *ServerCapabilities
+}
+
+// SAR is a Server-Assignment-Request sent by the S-CSCF
+type SAR struct {
+	SessionID                string
+	DestinationHost          string
+	UserName                 string
+	PublicIdentities         []string
+	ServerName               string
+	AssignmentType           uint32
+	UserDataAlreadyAvailable uint32
+}
+
+// SAA is a Server-Assignment-Answer. UserData holds the IMSSubscription XML.
+type SAA struct {
+	Result   diameter.Result
+	UserName string
+	UserData []byte
+}
+
+// MAR is a Multimedia-Auth-Request sent by the S-CSCF to fetch
+// authentication data
+type MAR struct {
+	SessionID       string
+	DestinationHost string
+	UserName        string
+	PublicIdentity  string
+	ServerName      string
+	NumberAuthItems uint32
+	AuthScheme      string
+	Authorization   []byte // Resynchronization data (RAND || AUTS) for AKA
+}
+
+// DigestAuthenticate is the SIP-Digest-Authenticate content for SIP Digest
+type DigestAuthenticate struct {
+	Realm     string
+	Algorithm string
+	QoP       string
+	HA1       string
+}
+
+// AuthItem is one SIP-Auth-Data-Item of a MAA
+type AuthItem struct {
+	ItemNumber         uint32
+	Scheme             string
+	Authenticate       []byte // RAND || AUTN for AKA
+	Authorization      []byte // XRES for AKA
+	ConfidentialityKey []byte
+	IntegrityKey       []byte
+	Digest             *DigestAuthenticate
+}
+
+// MAA is a Multimedia-Auth-Answer
+type MAA struct {
+	Result         diameter.Result
+	UserName       string
+	PublicIdentity string
+	AuthItems      []AuthItem
+}
+
+// LIR is a Location-Info-Request sent by the I-CSCF for terminating requests
+type LIR struct {
+	SessionID         string
+	DestinationHost   string
+	PublicIdentity    string
+	Originating       bool
+	AuthorizationType uint32
+}
+
+// LIA is a Location-Info-Answer
+type LIA struct {
+	Result             diameter.Result
+	ServerName         string
+	ServerCapabilities *ServerCapabilities
+}
+
+// RTR is a Registration-Termination-Request sent by the HSS to the S-CSCF
+type RTR struct {
+	SessionID        string
+	DestinationHost  string
+	UserName         string
+	PublicIdentities []string
+	ReasonCode       uint32
+	ReasonInfo       string
+}
+
+// RTA is a Registration-Termination-Answer
+type RTA struct {
+	Result diameter.Result
+}
+
+// PPR is a Push-Profile-Request sent by the HSS when subscriber data changes
+type PPR struct {
+	SessionID       string
+	DestinationHost string
+	UserName        string
+	UserData        []byte
+}
+
+// PPA is a Push-Profile-Answer
+type PPA struct {
+	Result diameter.Result
+}
+
+func str3GPP(code uint32, value string) *diameter.AVP {
+	return diameter.UTF8String(code, Vendor3GPP, value)
+}
+
+func uint3GPP(code uint32, value uint32) *diameter.AVP {
+	return diameter.Unsigned32(code, Vendor3GPP, value)
+}
+
+// findString returns the value of an AVP, or "" if absent
+func findString(avps []*diameter.AVP, code, vendorID uint32) string {
+	if a := diameter.FindAVP(avps, code, vendorID); a != nil {
+		return a.String()
+	}
+	return ""
+}
+
+// findBytes returns the data of an AVP, or nil if absent
+func findBytes(avps []*diameter.AVP, code, vendorID uint32) []byte {
+	if a := diameter.FindAVP(avps, code, vendorID); a != nil {
+		return a.Data
+	}
+	return nil
+}
+
+// requireString returns the value of a required AVP
+func requireString(avps []*diameter.AVP, code, vendorID uint32, name string) (string, error) {
+	a := diameter.FindAVP(avps, code, vendorID)
+	if a == nil {
+		return "", &diameter.MissingAVPError{Name: name}
+	}
+	return a.String(), nil
+}
+
+// findStrings returns the values of every AVP with the given code
+func findStrings(avps []*diameter.AVP, code, vendorID uint32) []string {
+	var values []string
+	for _, a := range diameter.FindAVPs(avps, code, vendorID) {
+		values = append(values, a.String())
+	}
+	return values
+}
+
+func (c *ServerCapabilities) avp() *diameter.AVP {
+	var avps []*diameter.AVP
+	for _, m := range c.Mandatory {
+		avps = append(avps, uint3GPP(AVPMandatoryCapability, m))
+	}
+	for _, o := range c.Optional {
+		avps = append(avps, uint3GPP(AVPOptionalCapability, o))
+	}
+	for _, name := range c.ServerNames {
+		avps = append(avps, str3GPP(AVPServerName, name))
+	}
+	return diameter.Grouped(AVPServerCapabilities, Vendor3GPP, avps...)
+}
+
+// parseServerCapabilities decodes an optional Server-Capabilities AVP
+func parseServerCapabilities(m *diameter.Message) (*ServerCapabilities, error) {
+	a := m.Find(AVPServerCapabilities, Vendor3GPP)
+	if a == nil {
+		return nil, nil
+	}
+	group, err := a.Grouped()
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &ServerCapabilities{ServerNames: findStrings(group, AVPServerName, Vendor3GPP)}
+	for _, c := range diameter.FindAVPs(group, AVPMandatoryCapability, Vendor3GPP) {
+		v, err := c.Uint32()
+		if err != nil {
+			return nil, err
+		}
+		caps.Mandatory = append(caps.Mandatory, v)
+	}
+	for _, c := range diameter.FindAVPs(group, AVPOptionalCapability, Vendor3GPP) {
+		v, err := c.Uint32()
+		if err != nil {
+			return nil, err
+		}
+		caps.Optional = append(caps.Optional, v)
+	}
+	return caps, nil
+}
+
+func (r *UAR) avps() []*diameter.AVP {
+	avps := []*diameter.AVP{
+		diameter.UTF8String(diameter.AVPUserName, 0, r.UserName),
+		str3GPP(AVPPublicIdentity, r.PublicIdentity),
+	}
+	if r.VisitedNetworkIdentifier != "" {
+		avps = append(avps, str3GPP(AVPVisitedNetworkIdentifier, r.VisitedNetworkIdentifier))
+	}
+	return append(avps, uint3GPP(AVPUserAuthorizationType, r.AuthorizationType))
+}
+
+func parseUAR(m *diameter.Message) (*UAR, error) {
+	r := &UAR{SessionID: m.SessionID()}
+	var err error
+	if r.UserName, err = requireString(m.AVPs, diameter.AVPUserName, 0, "User-Name"); err != nil {
+		return nil, err
+	}
+	if r.PublicIdentity, err = requireString(m.AVPs, AVPPublicIdentity, Vendor3GPP, "Public-Identity"); err != nil {
+		return nil, err
+	}
+	r.VisitedNetworkIdentifier = findString(m.AVPs, AVPVisitedNetworkIdentifier, Vendor3GPP)
+	if r.AuthorizationType, _, err = diameter.FindUint32(m.AVPs, AVPUserAuthorizationType, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (a *UAA) avps() []*diameter.AVP {
+	var avps []*diameter.AVP
+	if a.ServerName != "" {
+		avps = append(avps, str3GPP(AVPServerName, a.ServerName))
+	}
+	if a.ServerCapabilities != nil {
+		avps = append(avps, a.ServerCapabilities.avp())
+	}
+	return avps
+}
+
+func parseUAA(m *diameter.Message) (*UAA, error) {
+	result, err := m.Result()
+	if err != nil {
+		return nil, err
+	}
+	a := &UAA{Result: result, ServerName: findString(m.AVPs, AVPServerName, Vendor3GPP)}
+	if a.ServerCapabilities, err = parseServerCapabilities(m); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (r *SAR) avps() []*diameter.AVP {
+	var avps []*diameter.AVP
+	if r.UserName != "" {
+		avps = append(avps, diameter.UTF8String(diameter.AVPUserName, 0, r.UserName))
+	}
+	for _, impu := range r.PublicIdentities {
+		avps = append(avps, str3GPP(AVPPublicIdentity, impu))
+	}
+	return append(avps,
+		str3GPP(AVPServerName, r.ServerName),
+		uint3GPP(AVPServerAssignmentType, r.AssignmentType),
+		uint3GPP(AVPUserDataAlreadyAvailable, r.UserDataAlreadyAvailable),
+	)
+}
+
+func parseSAR(m *diameter.Message) (*SAR, error) {
+	r := &SAR{
+		SessionID:        m.SessionID(),
+		UserName:         findString(m.AVPs, diameter.AVPUserName, 0),
+		PublicIdentities: findStrings(m.AVPs, AVPPublicIdentity, Vendor3GPP),
+	}
+	var err error
+	if r.ServerName, err = requireString(m.AVPs, AVPServerName, Vendor3GPP, "Server-Name"); err != nil {
+		return nil, err
+	}
+	if r.AssignmentType, err = diameter.RequireUint32(m.AVPs, AVPServerAssignmentType, Vendor3GPP, "Server-Assignment-Type"); err != nil {
+		return nil, err
+	}
+	if r.UserDataAlreadyAvailable, err = diameter.RequireUint32(m.AVPs, AVPUserDataAlreadyAvailable, Vendor3GPP, "User-Data-Already-Available"); err != nil {
+		return nil, err
+	}
+	if r.UserName == "" && len(r.PublicIdentities) == 0 {
+		return nil, &diameter.MissingAVPError{Name: "User-Name or Public-Identity"}
+	}
+	return r, nil
+}
+
+func (a *SAA) avps() []*diameter.AVP {
+	var avps []*diameter.AVP
+	if a.UserName != "" {
+		avps = append(avps, diameter.UTF8String(diameter.AVPUserName, 0, a.UserName))
+	}
+	if len(a.UserData) > 0 {
+		avps = append(avps, diameter.OctetString(AVPUserData, Vendor3GPP, a.UserData))
+	}
+	return avps
+}
+
+func parseSAA(m *diameter.Message) (*SAA, error) {
+	result, err := m.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &SAA{
+		Result:   result,
+		UserName: findString(m.AVPs, diameter.AVPUserName, 0),
+		UserData: findBytes(m.AVPs, AVPUserData, Vendor3GPP),
+	}, nil
+}
+
+func (r *MAR) avps() []*diameter.AVP {
+	item := []*diameter.AVP{str3GPP(AVPSIPAuthenticationScheme, r.AuthScheme)}
+	if len(r.Authorization) > 0 {
+		item = append(item, diameter.OctetString(AVPSIPAuthorization, Vendor3GPP, r.Authorization))
+	}
+
+	avps := []*diameter.AVP{
+		diameter.UTF8String(diameter.AVPUserName, 0, r.UserName),
+		str3GPP(AVPPublicIdentity, r.PublicIdentity),
+	}
+	if r.ServerName != "" {
+		avps = append(avps, str3GPP(AVPServerName, r.ServerName))
+	}
+	return append(avps,
+		uint3GPP(AVPSIPNumberAuthItems, r.NumberAuthItems),
+		diameter.Grouped(AVPSIPAuthDataItem, Vendor3GPP, item...),
+	)
+}
+
+func parseMAR(m *diameter.Message) (*MAR, error) {
+	r := &MAR{
+		SessionID:  m.SessionID(),
+		ServerName: findString(m.AVPs, AVPServerName, Vendor3GPP),
+	}
+	var err error
+	if r.UserName, err = requireString(m.AVPs, diameter.AVPUserName, 0, "User-Name"); err != nil {
+		return nil, err
+	}
+	if r.PublicIdentity, err = requireString(m.AVPs, AVPPublicIdentity, Vendor3GPP, "Public-Identity"); err != nil {
+		return nil, err
+	}
+	if r.NumberAuthItems, err = diameter.RequireUint32(m.AVPs, AVPSIPNumberAuthItems, Vendor3GPP, "SIP-Number-Auth-Items"); err != nil {
+		return nil, err
+	}
+
+	item := m.Find(AVPSIPAuthDataItem, Vendor3GPP)
+	if item == nil {
+		return nil, &diameter.MissingAVPError{Name: "SIP-Auth-Data-Item"}
+	}
+	group, err := item.Grouped()
+	if err != nil {
+		return nil, err
+	}
+	r.AuthScheme = findString(group, AVPSIPAuthenticationScheme, Vendor3GPP)
+	r.Authorization = findBytes(group, AVPSIPAuthorization, Vendor3GPP)
+	return r, nil
+}
+
+func (item *AuthItem) avp() *diameter.AVP {
+	avps := []*diameter.AVP{
+		uint3GPP(AVPSIPItemNumber, item.ItemNumber),
+		str3GPP(AVPSIPAuthenticationScheme, item.Scheme),
+	}
+	if len(item.Authenticate) > 0 {
+		avps = append(avps, diameter.OctetString(AVPSIPAuthenticate, Vendor3GPP, item.Authenticate))
+	}
+	if len(item.Authorization) > 0 {
+		avps = append(avps, diameter.OctetString(AVPSIPAuthorization, Vendor3GPP, item.Authorization))
+	}
+	if len(item.ConfidentialityKey) > 0 {
+		avps = append(avps, diameter.OctetString(AVPConfidentialityKey, Vendor3GPP, item.ConfidentialityKey))
+	}
+	if len(item.IntegrityKey) > 0 {
+		avps = append(avps, diameter.OctetString(AVPIntegrityKey, Vendor3GPP, item.IntegrityKey))
+	}
+	if d := item.Digest; d != nil {
+		digest := []*diameter.AVP{
+			diameter.UTF8String(AVPDigestRealm, 0, d.Realm),
+			diameter.UTF8String(AVPDigestHA1, 0, d.HA1),
+		}
+		if d.Algorithm != "" {
+			digest = append(digest, diameter.UTF8String(AVPDigestAlgorithm, 0, d.Algorithm))
+		}
+		if d.QoP != "" {
+			digest = append(digest, diameter.UTF8String(AVPDigestQoP, 0, d.QoP))
+		}
+		avps = append(avps, diameter.Grouped(AVPSIPDigestAuthenticate, Vendor3GPP, digest...))
+	}
+	return diameter.Grouped(AVPSIPAuthDataItem, Vendor3GPP, avps...)
+}
+
+func parseAuthItem(a *diameter.AVP) (AuthItem, error) {
+	group, err := a.Grouped()
+	if err != nil {
+		return AuthItem{}, err
+	}
+	item := AuthItem{
+		Scheme:             findString(group, AVPSIPAuthenticationScheme, Vendor3GPP),
+		Authenticate:       findBytes(group, AVPSIPAuthenticate, Vendor3GPP),
+		Authorization:      findBytes(group, AVPSIPAuthorization, Vendor3GPP),
+		ConfidentialityKey: findBytes(group, AVPConfidentialityKey, Vendor3GPP),
+		IntegrityKey:       findBytes(group, AVPIntegrityKey, Vendor3GPP),
+	}
+	if item.ItemNumber, _, err = diameter.FindUint32(group, AVPSIPItemNumber, Vendor3GPP); err != nil {
+		return AuthItem{}, err
+	}
+	if d := diameter.FindAVP(group, AVPSIPDigestAuthenticate, Vendor3GPP); d != nil {
+		digest, err := d.Grouped()
+		if err != nil {
+			return AuthItem{}, err
+		}
+		item.Digest = &DigestAuthenticate{
+			Realm:     findString(digest, AVPDigestRealm, 0),
+			Algorithm: findString(digest, AVPDigestAlgorithm, 0),
+			QoP:       findString(digest, AVPDigestQoP, 0),
+			HA1:       findString(digest, AVPDigestHA1, 0),
+		}
+	}
+	return item, nil
+}
+
+func (a *MAA) avps() []*diameter.AVP {
+	var avps []*diameter.AVP
+	if a.UserName != "" {
+		avps = append(avps, diameter.UTF8String(diameter.AVPUserName, 0, a.UserName))
+	}
+	if a.PublicIdentity != "" {
+		avps = append(avps, str3GPP(AVPPublicIdentity, a.PublicIdentity))
+	}
+	if len(a.AuthItems) > 0 {
+		avps = append(avps, uint3GPP(AVPSIPNumberAuthItems, uint32(len(a.AuthItems))))
+	}
+	for i := range a.AuthItems {
+		avps = append(avps, a.AuthItems[i].avp())
+	}
+	return avps
+}
+
+func parseMAA(m *diameter.Message) (*MAA, error) {
+	result, err := m.Result()
+	if err != nil {
+		return nil, err
+	}
+	a := &MAA{
+		Result:         result,
+		UserName:       findString(m.AVPs, diameter.AVPUserName, 0),
+		PublicIdentity: findString(m.AVPs, AVPPublicIdentity, Vendor3GPP),
+	}
+	for _, avp := range m.FindAll(AVPSIPAuthDataItem, Vendor3GPP) {
+		item, err := parseAuthItem(avp)
+		if err != nil {
+			return nil, err
+		}
+		a.AuthItems = append(a.AuthItems, item)
+	}
+	return a, nil
+}
+
+func (r *LIR) avps() []*diameter.AVP {
+	var avps []*diameter.AVP
+	if r.Originating {
+		avps = append(avps, uint3GPP(AVPOriginatingRequest, 0))
+	}
+	avps = append(avps, str3GPP(AVPPublicIdentity, r.PublicIdentity))
+	if r.AuthorizationType == AuthorizationRegistrationAndCapabilities {
+		avps = append(avps, uint3GPP(AVPUserAuthorizationType, r.AuthorizationType))
+	}
+	return avps
+}
+
+func parseLIR(m *diameter.Message) (*LIR, error) {
+	r := &LIR{
+		SessionID:   m.SessionID(),
+		Originating: m.Find(AVPOriginatingRequest, Vendor3GPP) != nil,
+	}
+	var err error
+	if r.PublicIdentity, err = requireString(m.AVPs, AVPPublicIdentity, Vendor3GPP, "Public-Identity"); err != nil {
+		return nil, err
+	}
+	if r.AuthorizationType, _, err = diameter.FindUint32(m.AVPs, AVPUserAuthorizationType, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (a *LIA) avps() []*diameter.AVP {
+	var avps []*diameter.AVP
+	if a.ServerName != "" {
+		avps = append(avps, str3GPP(AVPServerName, a.ServerName))
+	}
+	if a.ServerCapabilities != nil {
+		avps = append(avps, a.ServerCapabilities.avp())
+	}
+	return avps
+}
+
+func parseLIA(m *diameter.Message) (*LIA, error) {
+	result, err := m.Result()
+	if err != nil {
+		return nil, err
+	}
+	a := &LIA{Result: result, ServerName: findString(m.AVPs, AVPServerName, Vendor3GPP)}
+	if a.ServerCapabilities, err = parseServerCapabilities(m); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (r *RTR) avps() []*diameter.AVP {
+	reason := []*diameter.AVP{uint3GPP(AVPReasonCode, r.ReasonCode)}
+	if r.ReasonInfo != "" {
+		reason = append(reason, str3GPP(AVPReasonInfo, r.ReasonInfo))
+	}
+	avps := []*diameter.AVP{
+		diameter.Grouped(AVPDeregistrationReason, Vendor3GPP, reason...),
+		diameter.UTF8String(diameter.AVPUserName, 0, r.UserName),
+	}
+	for _, impu := range r.PublicIdentities {
+		avps = append(avps, str3GPP(AVPPublicIdentity, impu))
+	}
+	return avps
+}
+
+func parseRTR(m *diameter.Message) (*RTR, error) {
+	r := &RTR{
+		SessionID:        m.SessionID(),
+		PublicIdentities: findStrings(m.AVPs, AVPPublicIdentity, Vendor3GPP),
+	}
+	var err error
+	if r.UserName, err = requireString(m.AVPs, diameter.AVPUserName, 0, "User-Name"); err != nil {
+		return nil, err
+	}
+
+	reason := m.Find(AVPDeregistrationReason, Vendor3GPP)
+	if reason == nil {
+		return nil, &diameter.MissingAVPError{Name: "Deregistration-Reason"}
+	}
+	group, err := reason.Grouped()
+	if err != nil {
+		return nil, err
+	}
+	if r.ReasonCode, err = diameter.RequireUint32(group, AVPReasonCode, Vendor3GPP, "Reason-Code"); err != nil {
+		return nil, err
+	}
+	r.ReasonInfo = findString(group, AVPReasonInfo, Vendor3GPP)
+	return r, nil
+}
+
+func (r *PPR) avps() []*diameter.AVP {
+	avps := []*diameter.AVP{diameter.UTF8String(diameter.AVPUserName, 0, r.UserName)}
+	if len(r.UserData) > 0 {
+		avps = append(avps, diameter.OctetString(AVPUserData, Vendor3GPP, r.UserData))
+	}
+	return avps
+}
+
+func parsePPR(m *diameter.Message) (*PPR, error) {
+	r := &PPR{
+		SessionID: m.SessionID(),
+		UserData:  findBytes(m.AVPs, AVPUserData, Vendor3GPP),
+	}
+	var err error
+	if r.UserName, err = requireString(m.AVPs, diameter.AVPUserName, 0, "User-Name"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
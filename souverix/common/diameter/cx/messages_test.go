@@ -0,0 +1,193 @@
+package cx
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// roundTrip encodes avps into a message and decodes it from the wire
+func roundTrip(t *testing.T, avps []*diameter.AVP) *diameter.Message {
+	t.Helper()
+	data, err := (&diameter.Message{CommandCode: 300, AppID: ApplicationID}).Add(avps...).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	m, err := diameter.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	return m
+}
+
+func withResult(result diameter.Result, avps []*diameter.AVP) []*diameter.AVP {
+	if result.VendorID != 0 {
+		return append([]*diameter.AVP{diameter.Grouped(diameter.AVPExperimentalResult, 0,
+			diameter.Unsigned32(diameter.AVPVendorID, 0, result.VendorID),
+			diameter.Unsigned32(diameter.AVPExperimentalResultCode, 0, result.Code),
+		)}, avps...)
+	}
+	return append([]*diameter.AVP{diameter.Unsigned32(diameter.AVPResultCode, 0, result.Code)}, avps...)
+}
+
+func TestRequests_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   interface{ avps() []*diameter.AVP }
+		parse func(*diameter.Message) (interface{}, error)
+	}{
+		{
+			name: "UAR",
+			req: &UAR{
+				UserName:                 "alice@ims.test",
+				PublicIdentity:           "sip:alice@ims.test",
+				VisitedNetworkIdentifier: "ims.test",
+				AuthorizationType:        AuthorizationRegistrationAndCapabilities,
+			},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseUAR(m) },
+		},
+		{
+			name: "SAR",
+			req: &SAR{
+				UserName:                 "alice@ims.test",
+				PublicIdentities:         []string{"sip:alice@ims.test", "tel:+15145550001"},
+				ServerName:               "sip:scscf.ims.test",
+				AssignmentType:           AssignmentRegistration,
+				UserDataAlreadyAvailable: UserDataAlreadyAvailable,
+			},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseSAR(m) },
+		},
+		{
+			name: "MAR",
+			req: &MAR{
+				UserName:        "alice@ims.test",
+				PublicIdentity:  "sip:alice@ims.test",
+				ServerName:      "sip:scscf.ims.test",
+				NumberAuthItems: 1,
+				AuthScheme:      SchemeAKAv1MD5,
+				Authorization:   []byte{1, 2, 3},
+			},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseMAR(m) },
+		},
+		{
+			name: "LIR",
+			req: &LIR{
+				PublicIdentity:    "sip:bob@ims.test",
+				Originating:       true,
+				AuthorizationType: AuthorizationRegistrationAndCapabilities,
+			},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseLIR(m) },
+		},
+		{
+			name: "RTR",
+			req: &RTR{
+				UserName:         "alice@ims.test",
+				PublicIdentities: []string{"sip:alice@ims.test"},
+				ReasonCode:       ReasonPermanentTermination,
+				ReasonInfo:       "subscription ended",
+			},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseRTR(m) },
+		},
+		{
+			name:  "PPR",
+			req:   &PPR{UserName: "alice@ims.test", UserData: []byte("<IMSSubscription/>")},
+			parse: func(m *diameter.Message) (interface{}, error) { return parsePPR(m) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(roundTrip(t, tt.req.avps()))
+			if err != nil {
+				t.Fatalf("parse error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.req) {
+				t.Errorf("parsed = %+v, want %+v", got, tt.req)
+			}
+		})
+	}
+}
+
+func TestAnswers_RoundTrip(t *testing.T) {
+	caps := &ServerCapabilities{Mandatory: []uint32{1}, Optional: []uint32{2, 3}, ServerNames: []string{"sip:scscf1.ims.test"}}
+
+	uaa := &UAA{Result: Experimental(ResultFirstRegistration), ServerCapabilities: caps}
+	gotUAA, err := parseUAA(roundTrip(t, withResult(uaa.Result, uaa.avps())))
+	if err != nil || !reflect.DeepEqual(gotUAA, uaa) {
+		t.Errorf("UAA = %+v, %v, want %+v", gotUAA, err, uaa)
+	}
+
+	saa := &SAA{Result: Success, UserName: "alice@ims.test", UserData: []byte("<IMSSubscription/>")}
+	gotSAA, err := parseSAA(roundTrip(t, withResult(saa.Result, saa.avps())))
+	if err != nil || !reflect.DeepEqual(gotSAA, saa) {
+		t.Errorf("SAA = %+v, %v, want %+v", gotSAA, err, saa)
+	}
+
+	maa := &MAA{
+		Result:         Success,
+		UserName:       "alice@ims.test",
+		PublicIdentity: "sip:alice@ims.test",
+		AuthItems: []AuthItem{
+			{ItemNumber: 1, Scheme: SchemeSIPDigest, Digest: &DigestAuthenticate{Realm: "ims.test", Algorithm: "MD5", QoP: "auth", HA1: "abcd"}},
+			{ItemNumber: 2, Scheme: SchemeAKAv1MD5, Authenticate: []byte{1}, Authorization: []byte{2}, ConfidentialityKey: []byte{3}, IntegrityKey: []byte{4}},
+		},
+	}
+	gotMAA, err := parseMAA(roundTrip(t, withResult(maa.Result, maa.avps())))
+	if err != nil || !reflect.DeepEqual(gotMAA, maa) {
+		t.Errorf("MAA = %+v, %v, want %+v", gotMAA, err, maa)
+	}
+
+	lia := &LIA{Result: Success, ServerName: "sip:scscf1.ims.test"}
+	gotLIA, err := parseLIA(roundTrip(t, withResult(lia.Result, lia.avps())))
+	if err != nil || !reflect.DeepEqual(gotLIA, lia) {
+		t.Errorf("LIA = %+v, %v, want %+v", gotLIA, err, lia)
+	}
+}
+
+func TestRequests_MissingAVP(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(*diameter.Message) error
+		avps  []*diameter.AVP
+	}{
+		{
+			name:  "UAR without Public-Identity",
+			parse: func(m *diameter.Message) error { _, err := parseUAR(m); return err },
+			avps:  []*diameter.AVP{diameter.UTF8String(diameter.AVPUserName, 0, "alice@ims.test")},
+		},
+		{
+			name:  "SAR without identities",
+			parse: func(m *diameter.Message) error { _, err := parseSAR(m); return err },
+			avps: []*diameter.AVP{
+				str3GPP(AVPServerName, "sip:scscf.ims.test"),
+				uint3GPP(AVPServerAssignmentType, AssignmentRegistration),
+				uint3GPP(AVPUserDataAlreadyAvailable, UserDataNotAvailable),
+			},
+		},
+		{
+			name:  "MAR without SIP-Auth-Data-Item",
+			parse: func(m *diameter.Message) error { _, err := parseMAR(m); return err },
+			avps: []*diameter.AVP{
+				diameter.UTF8String(diameter.AVPUserName, 0, "alice@ims.test"),
+				str3GPP(AVPPublicIdentity, "sip:alice@ims.test"),
+				uint3GPP(AVPSIPNumberAuthItems, 1),
+			},
+		},
+		{
+			name:  "RTR without Deregistration-Reason",
+			parse: func(m *diameter.Message) error { _, err := parseRTR(m); return err },
+			avps:  []*diameter.AVP{diameter.UTF8String(diameter.AVPUserName, 0, "alice@ims.test")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.parse(roundTrip(t, tt.avps))
+			if _, ok := err.(*diameter.MissingAVPError); !ok {
+				t.Errorf("parse error = %v, want MissingAVPError", err)
+			}
+		})
+	}
+}
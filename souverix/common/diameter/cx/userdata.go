@@ -0,0 +1,323 @@
+package cx
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// IMSSubscription is the Cx User-Data document (TS 29.228 Annex E)
+type IMSSubscription struct {
+	XMLName         xml.Name         `xml:"IMSSubscription"`
+	PrivateID       string           `xml:"PrivateID"`
+	ServiceProfiles []ServiceProfile `xml:"ServiceProfile"`
+}
+
+// ServiceProfile groups public identities sharing the same filter criteria
+type ServiceProfile struct {
+	PublicIdentities                 []PublicIdentity                  `xml:"PublicIdentity"`
+	CoreNetworkServicesAuthorization *CoreNetworkServicesAuthorization `xml:"CoreNetworkServicesAuthorization,omitempty"`
+	InitialFilterCriteria            []InitialFilterCriteria           `xml:"InitialFilterCriteria"`
+	Extension                        *ServiceProfileExtension          `xml:"Extension,omitempty"`
+}
+
+// ServiceProfileExtension references shared iFC sets provisioned on the
+// S-CSCF
+type ServiceProfileExtension struct {
+	SharedIFCSetIDs []int `xml:"SharedIFCSetID"`
+}
+
+// CoreNetworkServicesAuthorization is the media policy and the services
+// authorized for a service profile
+type CoreNetworkServicesAuthorization struct {
+	SubscribedMediaProfileID *int                                       `xml:"SubscribedMediaProfileId,omitempty"`
+	Extension                *CoreNetworkServicesAuthorizationExtension `xml:"Extension,omitempty"`
+}
+
+// CoreNetworkServicesAuthorizationExtension lists the authorized service
+// identifiers
+type CoreNetworkServicesAuthorizationExtension struct {
+	ServiceIDs []string `xml:"ListOfServiceIds>ServiceId"`
+}
+
+// PublicIdentity is a public user identity of the subscription
+type PublicIdentity struct {
+	BarringIndication bool                     `xml:"BarringIndication,omitempty"`
+	Identity          string                   `xml:"Identity"`
+	Extension         *PublicIdentityExtension `xml:"Extension,omitempty"`
+}
+
+// IdentityType values of PublicIdentityExtension
+const (
+	IdentityTypePublicUser     = 0
+	IdentityTypeDistinctPSI    = 1
+	IdentityTypeWildcardedPSI  = 2
+	IdentityTypeWildcardedIMPU = 3
+)
+
+// PublicIdentityExtension qualifies a public identity
+type PublicIdentityExtension struct {
+	IdentityType  *int                      `xml:"IdentityType,omitempty"`
+	WildcardedPSI string                    `xml:"WildcardedPSI,omitempty"`
+	Extension     *PublicIdentityExtension2 `xml:"Extension,omitempty"`
+}
+
+// PublicIdentityExtension2 carries the display name and alias group of a
+// public identity
+type PublicIdentityExtension2 struct {
+	DisplayName          string                    `xml:"DisplayName,omitempty"`
+	AliasIdentityGroupID string                    `xml:"AliasIdentityGroupID,omitempty"`
+	Extension            *PublicIdentityExtension3 `xml:"Extension,omitempty"`
+}
+
+// PublicIdentityExtension3 carries the expression of a wildcarded IMPU
+type PublicIdentityExtension3 struct {
+	WildcardedIMPU string `xml:"WildcardedIMPU,omitempty"`
+}
+
+// Type returns the identity type, IdentityTypePublicUser when absent
+func (p *PublicIdentity) Type() int {
+	if p.Extension == nil || p.Extension.IdentityType == nil {
+		return IdentityTypePublicUser
+	}
+	return *p.Extension.IdentityType
+}
+
+// InitialFilterCriteria triggers an application server
+type InitialFilterCriteria struct {
+	Priority             int               `xml:"Priority"`
+	TriggerPoint         *TriggerPoint     `xml:"TriggerPoint,omitempty"`
+	ApplicationServer    ApplicationServer `xml:"ApplicationServer"`
+	ProfilePartIndicator *int              `xml:"ProfilePartIndicator,omitempty"`
+}
+
+// ProfilePartIndicator values of InitialFilterCriteria
+const (
+	ProfilePartRegistered   = 0
+	ProfilePartUnregistered = 1
+)
+
+// TriggerPoint is a boolean expression of service point triggers, in
+// conjunctive normal form when ConditionTypeCNF is set
+type TriggerPoint struct {
+	ConditionTypeCNF bool  `xml:"ConditionTypeCNF"`
+	SPT              []SPT `xml:"SPT"`
+}
+
+// SPT is a service point trigger. Exactly one of RequestURI, Method,
+// SIPHeader, SessionCase and SessionDescription is set.
+type SPT struct {
+	ConditionNegated   bool                `xml:"ConditionNegated,omitempty"`
+	Group              []int               `xml:"Group"`
+	RequestURI         string              `xml:"RequestURI,omitempty"`
+	Method             string              `xml:"Method,omitempty"`
+	SIPHeader          *SIPHeader          `xml:"SIPHeader,omitempty"`
+	SessionCase        *int                `xml:"SessionCase,omitempty"`
+	SessionDescription *SessionDescription `xml:"SessionDescription,omitempty"`
+}
+
+// SIPHeader matches a header, by presence when Content is empty
+type SIPHeader struct {
+	Header  string `xml:"Header"`
+	Content string `xml:"Content,omitempty"`
+}
+
+// SessionDescription matches an SDP line, by presence when Content is empty
+type SessionDescription struct {
+	Line    string `xml:"Line"`
+	Content string `xml:"Content,omitempty"`
+}
+
+// SessionCase values of SPT
+const (
+	SessionCaseOriginating             = 0
+	SessionCaseTerminatingRegistered   = 1
+	SessionCaseTerminatingUnregistered = 2
+	SessionCaseOriginatingUnregistered = 3
+	SessionCaseOriginatingCDIV         = 4
+)
+
+// DefaultHandling values of ApplicationServer
+const (
+	SessionContinued  = 0
+	SessionTerminated = 1
+)
+
+// ApplicationServer is the AS addressed by a filter criteria
+type ApplicationServer struct {
+	ServerName      string `xml:"ServerName"`
+	DefaultHandling int    `xml:"DefaultHandling,omitempty"`
+	ServiceInfo     string `xml:"ServiceInfo,omitempty"`
+}
+
+// Marshal encodes the subscription as User-Data XML
+func (s *IMSSubscription) Marshal() ([]byte, error) {
+	data, err := xml.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// ParseIMSSubscription decodes User-Data XML
+func ParseIMSSubscription(data []byte) (*IMSSubscription, error) {
+	s := &IMSSubscription{}
+	if err := xml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid IMSSubscription: %w", err)
+	}
+	if s.PrivateID == "" {
+		return nil, fmt.Errorf("invalid IMSSubscription: missing PrivateID")
+	}
+	return s, nil
+}
+
+// Validate checks the subscription against the rules of the TS 29.228
+// User-Data schema that the XML decoder does not enforce
+func (s *IMSSubscription) Validate() error {
+	if s.PrivateID == "" {
+		return fmt.Errorf("invalid IMSSubscription: missing PrivateID")
+	}
+	if len(s.ServiceProfiles) == 0 {
+		return fmt.Errorf("invalid IMSSubscription %s: no ServiceProfile", s.PrivateID)
+	}
+
+	identities := make(map[string]bool)
+	for i, sp := range s.ServiceProfiles {
+		if err := sp.validate(identities); err != nil {
+			return fmt.Errorf("invalid IMSSubscription %s: ServiceProfile %d: %w", s.PrivateID, i, err)
+		}
+	}
+	return nil
+}
+
+// validate checks a service profile; identities collects the public
+// identities of the subscription to reject duplicates
+func (sp *ServiceProfile) validate(identities map[string]bool) error {
+	if len(sp.PublicIdentities) == 0 {
+		return fmt.Errorf("no PublicIdentity")
+	}
+	for _, id := range sp.PublicIdentities {
+		if !isIdentityURI(id.Identity) {
+			return fmt.Errorf("PublicIdentity %q is not a SIP or tel URI", id.Identity)
+		}
+		if identities[id.Identity] {
+			return fmt.Errorf("PublicIdentity %q listed twice", id.Identity)
+		}
+		identities[id.Identity] = true
+
+		wildcardPSI, wildcardIMPU := "", ""
+		if ext := id.Extension; ext != nil {
+			wildcardPSI = ext.WildcardedPSI
+			if ext.Extension != nil && ext.Extension.Extension != nil {
+				wildcardIMPU = ext.Extension.Extension.WildcardedIMPU
+			}
+		}
+		switch id.Type() {
+		case IdentityTypePublicUser, IdentityTypeDistinctPSI:
+		case IdentityTypeWildcardedPSI:
+			if wildcardPSI == "" {
+				return fmt.Errorf("PublicIdentity %q: wildcarded PSI without WildcardedPSI", id.Identity)
+			}
+		case IdentityTypeWildcardedIMPU:
+			if wildcardIMPU == "" {
+				return fmt.Errorf("PublicIdentity %q: wildcarded IMPU without WildcardedIMPU", id.Identity)
+			}
+		default:
+			return fmt.Errorf("PublicIdentity %q: unknown IdentityType %d", id.Identity, id.Type())
+		}
+	}
+
+	if cn := sp.CoreNetworkServicesAuthorization; cn != nil && cn.SubscribedMediaProfileID != nil && *cn.SubscribedMediaProfileID < 0 {
+		return fmt.Errorf("negative SubscribedMediaProfileId")
+	}
+	if sp.Extension != nil {
+		for _, id := range sp.Extension.SharedIFCSetIDs {
+			if id < 0 {
+				return fmt.Errorf("negative SharedIFCSetID")
+			}
+		}
+	}
+
+	priorities := make(map[int]bool)
+	for _, ifc := range sp.InitialFilterCriteria {
+		if ifc.Priority < 0 || priorities[ifc.Priority] {
+			return fmt.Errorf("InitialFilterCriteria priority %d is negative or not unique", ifc.Priority)
+		}
+		priorities[ifc.Priority] = true
+		if err := ifc.validate(); err != nil {
+			return fmt.Errorf("InitialFilterCriteria %d: %w", ifc.Priority, err)
+		}
+	}
+	return nil
+}
+
+// validate checks a filter criteria and its service point triggers
+func (ifc *InitialFilterCriteria) validate() error {
+	as := ifc.ApplicationServer
+	if !strings.HasPrefix(as.ServerName, "sip:") && !strings.HasPrefix(as.ServerName, "sips:") {
+		return fmt.Errorf("ServerName %q is not a SIP URI", as.ServerName)
+	}
+	if as.DefaultHandling != SessionContinued && as.DefaultHandling != SessionTerminated {
+		return fmt.Errorf("unknown DefaultHandling %d", as.DefaultHandling)
+	}
+	if p := ifc.ProfilePartIndicator; p != nil && *p != ProfilePartRegistered && *p != ProfilePartUnregistered {
+		return fmt.Errorf("unknown ProfilePartIndicator %d", *p)
+	}
+	if ifc.TriggerPoint == nil {
+		return nil
+	}
+
+	if len(ifc.TriggerPoint.SPT) == 0 {
+		return fmt.Errorf("TriggerPoint without SPT")
+	}
+	for i, spt := range ifc.TriggerPoint.SPT {
+		if len(spt.Group) == 0 {
+			return fmt.Errorf("SPT %d: no Group", i)
+		}
+		for _, g := range spt.Group {
+			if g < 0 {
+				return fmt.Errorf("SPT %d: negative Group", i)
+			}
+		}
+
+		conditions := 0
+		if spt.RequestURI != "" {
+			conditions++
+		}
+		if spt.Method != "" {
+			conditions++
+		}
+		if spt.SIPHeader != nil {
+			conditions++
+			if spt.SIPHeader.Header == "" {
+				return fmt.Errorf("SPT %d: SIPHeader without Header", i)
+			}
+		}
+		if spt.SessionCase != nil {
+			conditions++
+			if *spt.SessionCase < SessionCaseOriginating || *spt.SessionCase > SessionCaseOriginatingCDIV {
+				return fmt.Errorf("SPT %d: unknown SessionCase %d", i, *spt.SessionCase)
+			}
+		}
+		if spt.SessionDescription != nil {
+			conditions++
+			if spt.SessionDescription.Line == "" {
+				return fmt.Errorf("SPT %d: SessionDescription without Line", i)
+			}
+		}
+		if conditions != 1 {
+			return fmt.Errorf("SPT %d: %d conditions, want exactly one", i, conditions)
+		}
+	}
+	return nil
+}
+
+// isIdentityURI reports whether id is a SIP, SIPS or tel URI
+func isIdentityURI(id string) bool {
+	for _, scheme := range []string{"sip:", "sips:", "tel:"} {
+		if strings.HasPrefix(id, scheme) && len(id) > len(scheme) {
+			return true
+		}
+	}
+	return false
+}
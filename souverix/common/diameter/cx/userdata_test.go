@@ -0,0 +1,181 @@
+package cx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIMSSubscription_RoundTrip(t *testing.T) {
+	terminating, unregistered := SessionCaseTerminatingRegistered, ProfilePartUnregistered
+	wildcarded, mediaProfile := IdentityTypeWildcardedIMPU, 3
+	subscription := &IMSSubscription{
+		PrivateID: "alice@ims.test",
+		ServiceProfiles: []ServiceProfile{{
+			PublicIdentities: []PublicIdentity{
+				{Identity: "sip:alice@ims.test"},
+				{Identity: "tel:+15145550001", BarringIndication: true},
+				{
+					Identity: "sip:alice-!.*!@ims.test",
+					Extension: &PublicIdentityExtension{
+						IdentityType: &wildcarded,
+						Extension: &PublicIdentityExtension2{
+							DisplayName:          "Alice",
+							AliasIdentityGroupID: "1",
+							Extension:            &PublicIdentityExtension3{WildcardedIMPU: "sip:alice-.*@ims.test"},
+						},
+					},
+				},
+			},
+			CoreNetworkServicesAuthorization: &CoreNetworkServicesAuthorization{
+				SubscribedMediaProfileID: &mediaProfile,
+				Extension:                &CoreNetworkServicesAuthorizationExtension{ServiceIDs: []string{"mmtel"}},
+			},
+			Extension: &ServiceProfileExtension{SharedIFCSetIDs: []int{1, 7}},
+			InitialFilterCriteria: []InitialFilterCriteria{{
+				Priority: 10,
+				TriggerPoint: &TriggerPoint{
+					ConditionTypeCNF: true,
+					SPT:              []SPT{{Group: []int{0}, Method: "INVITE"}},
+				},
+				ApplicationServer: ApplicationServer{ServerName: "sip:as.ims.test", DefaultHandling: SessionTerminated},
+			}, {
+				Priority: 20,
+				TriggerPoint: &TriggerPoint{
+					SPT: []SPT{
+						{Group: []int{0}, SIPHeader: &SIPHeader{Header: "Accept-Contact", Content: "video"}},
+						{Group: []int{0, 1}, SessionCase: &terminating},
+						{Group: []int{1}, ConditionNegated: true, SessionDescription: &SessionDescription{Line: "m", Content: "^audio"}},
+					},
+				},
+				ApplicationServer:    ApplicationServer{ServerName: "sip:mmtel.ims.test", ServiceInfo: "mmtel"},
+				ProfilePartIndicator: &unregistered,
+			}},
+		}},
+	}
+
+	data, err := subscription.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if !strings.HasPrefix(string(data), "<?xml") {
+		t.Errorf("Marshal() output has no XML declaration")
+	}
+
+	got, err := ParseIMSSubscription(data)
+	if err != nil {
+		t.Fatalf("ParseIMSSubscription() error = %v", err)
+	}
+	got.XMLName = subscription.XMLName
+	if !reflect.DeepEqual(got, subscription) {
+		t.Errorf("ParseIMSSubscription() = %+v, want %+v", got, subscription)
+	}
+}
+
+func TestParseIMSSubscription_Spec(t *testing.T) {
+	// TS 29.228 encodes tBool values as 0/1
+	data := `<?xml version="1.0" encoding="UTF-8"?>
+<IMSSubscription>
+  <PrivateID>bob@ims.test</PrivateID>
+  <ServiceProfile>
+    <PublicIdentity><BarringIndication>1</BarringIndication><Identity>sip:bob@ims.test</Identity></PublicIdentity>
+    <InitialFilterCriteria>
+      <Priority>0</Priority>
+      <TriggerPoint><ConditionTypeCNF>0</ConditionTypeCNF><SPT><ConditionNegated>0</ConditionNegated><Group>0</Group><Method>MESSAGE</Method></SPT></TriggerPoint>
+      <ApplicationServer><ServerName>sip:sms.ims.test</ServerName><DefaultHandling>0</DefaultHandling></ApplicationServer>
+    </InitialFilterCriteria>
+  </ServiceProfile>
+</IMSSubscription>`
+
+	got, err := ParseIMSSubscription([]byte(data))
+	if err != nil {
+		t.Fatalf("ParseIMSSubscription() error = %v", err)
+	}
+	sp := got.ServiceProfiles[0]
+	if !sp.PublicIdentities[0].BarringIndication {
+		t.Error("BarringIndication 1 not parsed as barred")
+	}
+	if sp.InitialFilterCriteria[0].TriggerPoint.SPT[0].Method != "MESSAGE" {
+		t.Errorf("SPT = %+v", sp.InitialFilterCriteria[0].TriggerPoint.SPT[0])
+	}
+}
+
+func TestParseIMSSubscription_Invalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"not XML":           "IMSSubscription",
+		"missing PrivateID": "<IMSSubscription><ServiceProfile/></IMSSubscription>",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseIMSSubscription([]byte(data)); err == nil {
+				t.Error("ParseIMSSubscription() accepted invalid data")
+			}
+		})
+	}
+}
+
+func TestIMSSubscription_Validate(t *testing.T) {
+	valid := func() *IMSSubscription {
+		return &IMSSubscription{
+			PrivateID: "alice@ims.test",
+			ServiceProfiles: []ServiceProfile{{
+				PublicIdentities: []PublicIdentity{{Identity: "sip:alice@ims.test"}},
+				InitialFilterCriteria: []InitialFilterCriteria{{
+					Priority:          1,
+					TriggerPoint:      &TriggerPoint{SPT: []SPT{{Group: []int{0}, Method: "INVITE"}}},
+					ApplicationServer: ApplicationServer{ServerName: "sip:as.ims.test"},
+				}},
+			}},
+		}
+	}
+	bad, wildcardPSI := 9, IdentityTypeWildcardedPSI
+
+	tests := []struct {
+		name   string
+		modify func(s *IMSSubscription)
+	}{
+		{"valid", func(s *IMSSubscription) {}},
+		{"no service profile", func(s *IMSSubscription) { s.ServiceProfiles = nil }},
+		{"no public identity", func(s *IMSSubscription) { s.ServiceProfiles[0].PublicIdentities = nil }},
+		{"identity not a URI", func(s *IMSSubscription) { s.ServiceProfiles[0].PublicIdentities[0].Identity = "alice" }},
+		{"identity in two profiles", func(s *IMSSubscription) {
+			s.ServiceProfiles = append(s.ServiceProfiles, ServiceProfile{PublicIdentities: s.ServiceProfiles[0].PublicIdentities})
+		}},
+		{"wildcarded PSI without expression", func(s *IMSSubscription) {
+			s.ServiceProfiles[0].PublicIdentities[0].Extension = &PublicIdentityExtension{IdentityType: &wildcardPSI}
+		}},
+		{"duplicate priority", func(s *IMSSubscription) {
+			sp := &s.ServiceProfiles[0]
+			sp.InitialFilterCriteria = append(sp.InitialFilterCriteria, sp.InitialFilterCriteria[0])
+		}},
+		{"AS not a SIP URI", func(s *IMSSubscription) {
+			s.ServiceProfiles[0].InitialFilterCriteria[0].ApplicationServer.ServerName = "as.ims.test"
+		}},
+		{"unknown profile part", func(s *IMSSubscription) {
+			s.ServiceProfiles[0].InitialFilterCriteria[0].ProfilePartIndicator = &bad
+		}},
+		{"SPT without condition", func(s *IMSSubscription) {
+			s.ServiceProfiles[0].InitialFilterCriteria[0].TriggerPoint.SPT[0].Method = ""
+		}},
+		{"SPT with two conditions", func(s *IMSSubscription) {
+			s.ServiceProfiles[0].InitialFilterCriteria[0].TriggerPoint.SPT[0].RequestURI = "sip:bob@ims.test"
+		}},
+		{"unknown session case", func(s *IMSSubscription) {
+			spt := &s.ServiceProfiles[0].InitialFilterCriteria[0].TriggerPoint.SPT[0]
+			spt.Method, spt.SessionCase = "", &bad
+		}},
+		{"SPT without group", func(s *IMSSubscription) {
+			s.ServiceProfiles[0].InitialFilterCriteria[0].TriggerPoint.SPT[0].Group = nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := valid()
+			tt.modify(s)
+			err := s.Validate()
+			if (err == nil) != (tt.name == "valid") {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package diameter
+
+// Base protocol command codes (RFC 6733 section 3.1)
+const (
+	CommandCapabilitiesExchange uint32 = 257
+	CommandReAuth               uint32 = 258
+	CommandAccounting           uint32 = 271
+	CommandAbortSession         uint32 = 274
+	CommandSessionTermination   uint32 = 275
+	CommandDeviceWatchdog       uint32 = 280
+	CommandDisconnectPeer       uint32 = 282
+)
+
+// Base protocol AVP codes (RFC 6733 section 4.5)
+const (
+	AVPUserName                    uint32 = 1
+	AVPEventTimestamp              uint32 = 55
+	AVPAcctInterimInterval         uint32 = 85
+	AVPHostIPAddress               uint32 = 257
+	AVPAuthApplicationID           uint32 = 258
+	AVPAcctApplicationID           uint32 = 259
+	AVPVendorSpecificApplicationID uint32 = 260
+	AVPSessionID                   uint32 = 263
+	AVPOriginHost                  uint32 = 264
+	AVPSupportedVendorID           uint32 = 265
+	AVPVendorID                    uint32 = 266
+	AVPFirmwareRevision            uint32 = 267
+	AVPResultCode                  uint32 = 268
+	AVPProductName                 uint32 = 269
+	AVPDisconnectCause             uint32 = 273
+	AVPAuthSessionState            uint32 = 277
+	AVPReAuthRequestType           uint32 = 285
+	AVPAccountingRecordType        uint32 = 480
+	AVPAccountingRecordNumber      uint32 = 485
+	AVPTerminationCause            uint32 = 295
+	AVPOriginStateID               uint32 = 278
+	AVPFailedAVP                   uint32 = 279
+	AVPErrorMessage                uint32 = 281
+	AVPRouteRecord                 uint32 = 282
+	AVPDestinationRealm            uint32 = 283
+	AVPDestinationHost             uint32 = 293
+	AVPOriginRealm                 uint32 = 296
+	AVPExperimentalResult          uint32 = 297
+	AVPExperimentalResultCode      uint32 = 298
+)
+
+// Result-Code values (RFC 6733 section 7.1)
+const (
+	ResultSuccess                uint32 = 2001
+	ResultCommandUnsupported     uint32 = 3001
+	ResultUnableToDeliver        uint32 = 3002
+	ResultApplicationUnsupported uint32 = 3007
+	ResultInvalidAVPBits         uint32 = 3009
+	ResultAuthenticationRejected uint32 = 4001
+	ResultAVPUnsupported         uint32 = 5001
+	ResultUnknownSessionID       uint32 = 5002
+	ResultInvalidAVPValue        uint32 = 5004
+	ResultMissingAVP             uint32 = 5005
+	ResultNoCommonApplication    uint32 = 5010
+	ResultUnableToComply         uint32 = 5012
+	ResultInvalidMessageLength   uint32 = 5015
+)
+
+// Auth-Session-State values
+const (
+	StateMaintained   uint32 = 0
+	NoStateMaintained uint32 = 1
+)
+
+// Re-Auth-Request-Type values
+const (
+	ReAuthAuthorizeOnly         uint32 = 0
+	ReAuthAuthorizeAuthenticate uint32 = 1
+)
+
+// Termination-Cause values (RFC 6733 section 8.47)
+const (
+	TerminationLogout             uint32 = 1
+	TerminationServiceNotProvided uint32 = 2
+	TerminationBadAnswer          uint32 = 3
+	TerminationAdministrative     uint32 = 4
+	TerminationLinkBroken         uint32 = 5
+	TerminationAuthExpired        uint32 = 6
+	TerminationUserMoved          uint32 = 7
+	TerminationSessionTimeout     uint32 = 8
+)
+
+// Accounting-Record-Type values (RFC 6733 section 9.8.1)
+const (
+	RecordEvent   uint32 = 1
+	RecordStart   uint32 = 2
+	RecordInterim uint32 = 3
+	RecordStop    uint32 = 4
+)
+
+// Disconnect-Cause values
+const (
+	DisconnectRebooting            uint32 = 0
+	DisconnectBusy                 uint32 = 1
+	DisconnectDoNotWantToTalkToYou uint32 = 2
+)
+
+// ApplicationRelay is the application id advertised by relay agents
+const ApplicationRelay uint32 = 0xffffffff
@@ -0,0 +1,191 @@
+package diameter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Command flags
+const (
+	FlagRequest    uint8 = 0x80
+	FlagProxiable  uint8 = 0x40
+	FlagError      uint8 = 0x20
+	FlagRetransmit uint8 = 0x10
+)
+
+// headerLen is the length of the Diameter message header
+const headerLen = 20
+
+// maxMessageLen is the largest message length the 24 bit length field allows
+const maxMessageLen = 1<<24 - 1
+
+// Message is a Diameter request or answer
+type Message struct {
+	Flags       uint8
+	CommandCode uint32
+	AppID       uint32
+	HopByHop    uint32
+	EndToEnd    uint32
+	AVPs        []*AVP
+}
+
+// IsRequest reports whether the R flag is set
+func (m *Message) IsRequest() bool {
+	return m.Flags&FlagRequest != 0
+}
+
+// Add appends avps to the message
+func (m *Message) Add(avps ...*AVP) *Message {
+	m.AVPs = append(m.AVPs, avps...)
+	return m
+}
+
+// Find returns the first top-level AVP with the given code and vendor
+func (m *Message) Find(code, vendorID uint32) *AVP {
+	return FindAVP(m.AVPs, code, vendorID)
+}
+
+// FindAll returns every top-level AVP with the given code and vendor
+func (m *Message) FindAll(code, vendorID uint32) []*AVP {
+	return FindAVPs(m.AVPs, code, vendorID)
+}
+
+// SessionID returns the Session-Id AVP value, or "" if absent
+func (m *Message) SessionID() string {
+	if a := m.Find(AVPSessionID, 0); a != nil {
+		return a.String()
+	}
+	return ""
+}
+
+// OriginHost returns the Origin-Host AVP value, or "" if absent
+func (m *Message) OriginHost() string {
+	if a := m.Find(AVPOriginHost, 0); a != nil {
+		return a.String()
+	}
+	return ""
+}
+
+// Result returns the Result-Code or Experimental-Result of an answer
+func (m *Message) Result() (Result, error) {
+	if a := m.Find(AVPResultCode, 0); a != nil {
+		code, err := a.Uint32()
+		return Result{Code: code}, err
+	}
+	if a := m.Find(AVPExperimentalResult, 0); a != nil {
+		group, err := a.Grouped()
+		if err != nil {
+			return Result{}, err
+		}
+		result := Result{}
+		if v := FindAVP(group, AVPVendorID, 0); v != nil {
+			if result.VendorID, err = v.Uint32(); err != nil {
+				return Result{}, err
+			}
+		}
+		c := FindAVP(group, AVPExperimentalResultCode, 0)
+		if c == nil {
+			return Result{}, fmt.Errorf("Experimental-Result without Experimental-Result-Code")
+		}
+		result.Code, err = c.Uint32()
+		return result, err
+	}
+	return Result{}, fmt.Errorf("answer has no Result-Code")
+}
+
+// Encode serializes the message
+func (m *Message) Encode() ([]byte, error) {
+	b := make([]byte, headerLen, 256)
+	for _, a := range m.AVPs {
+		b = a.appendTo(b)
+	}
+	if len(b) > maxMessageLen {
+		return nil, fmt.Errorf("message length %d exceeds maximum", len(b))
+	}
+
+	b[0] = 1
+	b[1], b[2], b[3] = byte(len(b)>>16), byte(len(b)>>8), byte(len(b))
+	binary.BigEndian.PutUint32(b[4:], m.CommandCode&0xffffff)
+	b[4] = m.Flags
+	binary.BigEndian.PutUint32(b[8:], m.AppID)
+	binary.BigEndian.PutUint32(b[12:], m.HopByHop)
+	binary.BigEndian.PutUint32(b[16:], m.EndToEnd)
+	return b, nil
+}
+
+// ReadMessage reads one message from r
+func ReadMessage(r io.Reader) (*Message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 1 {
+		return nil, fmt.Errorf("unsupported Diameter version %d", header[0])
+	}
+	length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	if length < headerLen || length%4 != 0 {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	avps, err := decodeAVPs(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Flags:       header[4],
+		CommandCode: binary.BigEndian.Uint32(header[4:]) & 0xffffff,
+		AppID:       binary.BigEndian.Uint32(header[8:]),
+		HopByHop:    binary.BigEndian.Uint32(header[12:]),
+		EndToEnd:    binary.BigEndian.Uint32(header[16:]),
+		AVPs:        avps,
+	}, nil
+}
+
+// Result is a Diameter Result-Code, or an Experimental-Result-Code when
+// VendorID is not zero
+type Result struct {
+	Code     uint32
+	VendorID uint32
+}
+
+// Success reports whether the result is in the 2xxx success class
+func (r Result) Success() bool {
+	return r.Code >= 2000 && r.Code < 3000
+}
+
+// Err returns nil for a success result and a *ResultError otherwise
+func (r Result) Err() error {
+	if r.Success() {
+		return nil
+	}
+	return &ResultError{Result: r}
+}
+
+// avp encodes the result as a Result-Code or Experimental-Result AVP
+func (r Result) avp() *AVP {
+	if r.VendorID == 0 {
+		return Unsigned32(AVPResultCode, 0, r.Code)
+	}
+	return Grouped(AVPExperimentalResult, 0,
+		Unsigned32(AVPVendorID, 0, r.VendorID),
+		Unsigned32(AVPExperimentalResultCode, 0, r.Code),
+	)
+}
+
+// ResultError is returned when a peer answers with a non-success result
+type ResultError struct {
+	Result Result
+}
+
+func (e *ResultError) Error() string {
+	if e.Result.VendorID != 0 {
+		return fmt.Sprintf("diameter experimental result %d (vendor %d)", e.Result.Code, e.Result.VendorID)
+	}
+	return fmt.Sprintf("diameter result %d", e.Result.Code)
+}
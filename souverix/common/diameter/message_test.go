@@ -0,0 +1,243 @@
+package diameter
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAVP_Values(t *testing.T) {
+	tests := []struct {
+		name  string
+		avp   *AVP
+		check func(t *testing.T, a *AVP)
+	}{
+		{
+			name: "UTF8String",
+			avp:  UTF8String(AVPOriginHost, 0, "hss.ims.local"),
+			check: func(t *testing.T, a *AVP) {
+				if a.String() != "hss.ims.local" {
+					t.Errorf("String() = %q", a.String())
+				}
+			},
+		},
+		{
+			name: "Unsigned32",
+			avp:  Unsigned32(AVPResultCode, 0, ResultSuccess),
+			check: func(t *testing.T, a *AVP) {
+				if v, err := a.Uint32(); err != nil || v != ResultSuccess {
+					t.Errorf("Uint32() = %d, %v", v, err)
+				}
+			},
+		},
+		{
+			name: "Unsigned64",
+			avp:  Unsigned64(1000, 0, 1<<40),
+			check: func(t *testing.T, a *AVP) {
+				if v, err := a.Uint64(); err != nil || v != 1<<40 {
+					t.Errorf("Uint64() = %d, %v", v, err)
+				}
+			},
+		},
+		{
+			name: "Integer32",
+			avp:  Integer32(1000, 0, -403),
+			check: func(t *testing.T, a *AVP) {
+				if v, err := a.Int32(); err != nil || v != -403 {
+					t.Errorf("Int32() = %d, %v", v, err)
+				}
+			},
+		},
+		{
+			name: "Time",
+			avp:  Time(AVPEventTimestamp, 0, time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)),
+			check: func(t *testing.T, a *AVP) {
+				if v, err := a.Time(); err != nil || !v.Equal(time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)) {
+					t.Errorf("Time() = %v, %v", v, err)
+				}
+			},
+		},
+		{
+			name: "Time past 2036",
+			avp:  Time(AVPEventTimestamp, 0, time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)),
+			check: func(t *testing.T, a *AVP) {
+				if v, err := a.Time(); err != nil || v.Year() != 2040 {
+					t.Errorf("Time() = %v, %v", v, err)
+				}
+			},
+		},
+		{
+			name: "IPv4 Address",
+			avp:  Address(AVPHostIPAddress, 0, net.ParseIP("192.0.2.1")),
+			check: func(t *testing.T, a *AVP) {
+				if ip, err := a.Address(); err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+					t.Errorf("Address() = %v, %v", ip, err)
+				}
+			},
+		},
+		{
+			name: "IPv6 Address",
+			avp:  Address(AVPHostIPAddress, 0, net.ParseIP("2001:db8::1")),
+			check: func(t *testing.T, a *AVP) {
+				if ip, err := a.Address(); err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) {
+					t.Errorf("Address() = %v, %v", ip, err)
+				}
+			},
+		},
+		{
+			name: "vendor Grouped",
+			avp: Grouped(600, 10415,
+				UTF8String(601, 10415, "abc"),
+				Unsigned32(AVPVendorID, 0, 10415),
+			),
+			check: func(t *testing.T, a *AVP) {
+				if a.Flags&AVPFlagVendor == 0 || a.VendorID != 10415 {
+					t.Errorf("vendor flag/id not set: %#x %d", a.Flags, a.VendorID)
+				}
+				group, err := a.Grouped()
+				if err != nil || len(group) != 2 {
+					t.Fatalf("Grouped() = %v, %v", group, err)
+				}
+				if FindAVP(group, 601, 10415).String() != "abc" {
+					t.Errorf("grouped AVP value lost")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Round-trip through the wire encoding
+			avps, err := decodeAVPs(tt.avp.appendTo(nil))
+			if err != nil {
+				t.Fatalf("decodeAVPs() error = %v", err)
+			}
+			if len(avps) != 1 {
+				t.Fatalf("decodeAVPs() returned %d AVPs", len(avps))
+			}
+			tt.check(t, avps[0])
+		})
+	}
+}
+
+func TestAVP_Padding(t *testing.T) {
+	encoded := UTF8String(AVPOriginHost, 0, "abcde").appendTo(nil)
+	if len(encoded) != 16 {
+		t.Errorf("encoded length = %d, want 16", len(encoded))
+	}
+	if encoded[7] != 13 {
+		t.Errorf("AVP length field = %d, want 13", encoded[7])
+	}
+}
+
+func TestDecodeAVPs_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", []byte{0, 0, 1, 8, 0x40, 0}},
+		{"length beyond data", []byte{0, 0, 1, 8, 0x40, 0, 0, 32, 'a', 'b', 'c', 'd'}},
+		{"length below header", []byte{0, 0, 1, 8, 0x40, 0, 0, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeAVPs(tt.data); err == nil {
+				t.Error("decodeAVPs() accepted invalid data")
+			}
+		})
+	}
+}
+
+func TestMessage_EncodeDecode(t *testing.T) {
+	m := &Message{
+		Flags:       FlagRequest | FlagProxiable,
+		CommandCode: 300,
+		AppID:       16777216,
+		HopByHop:    0x01020304,
+		EndToEnd:    0x05060708,
+	}
+	m.Add(
+		UTF8String(AVPSessionID, 0, "scscf;1;2"),
+		UTF8String(AVPOriginHost, 0, "scscf.ims.local"),
+	)
+
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	got, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	if !got.IsRequest() || got.CommandCode != 300 || got.AppID != 16777216 ||
+		got.HopByHop != m.HopByHop || got.EndToEnd != m.EndToEnd {
+		t.Errorf("header = %+v, want %+v", got, m)
+	}
+	if got.SessionID() != "scscf;1;2" || got.OriginHost() != "scscf.ims.local" {
+		t.Errorf("AVPs = %q, %q", got.SessionID(), got.OriginHost())
+	}
+}
+
+func TestReadMessage_Invalid(t *testing.T) {
+	valid, _ := (&Message{CommandCode: 280}).Encode()
+
+	badVersion := append([]byte(nil), valid...)
+	badVersion[0] = 2
+	badLength := append([]byte(nil), valid...)
+	badLength[3] = 21
+
+	for name, data := range map[string][]byte{
+		"version":   badVersion,
+		"length":    badLength,
+		"truncated": valid[:10],
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadMessage(bytes.NewReader(data)); err == nil {
+				t.Error("ReadMessage() accepted an invalid message")
+			}
+		})
+	}
+}
+
+func TestMessage_Result(t *testing.T) {
+	tests := []struct {
+		name    string
+		avp     *AVP
+		want    Result
+		success bool
+	}{
+		{
+			name:    "Result-Code",
+			avp:     Unsigned32(AVPResultCode, 0, ResultSuccess),
+			want:    Result{Code: ResultSuccess},
+			success: true,
+		},
+		{
+			name:    "Experimental-Result",
+			avp:     Result{Code: 5001, VendorID: 10415}.avp(),
+			want:    Result{Code: 5001, VendorID: 10415},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := (&Message{}).Add(tt.avp)
+			got, err := m.Result()
+			if err != nil {
+				t.Fatalf("Result() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Result() = %+v, want %+v", got, tt.want)
+			}
+			if (got.Err() == nil) != tt.success {
+				t.Errorf("Err() = %v, success %v", got.Err(), tt.success)
+			}
+		})
+	}
+
+	if _, err := (&Message{}).Result(); err == nil {
+		t.Error("Result() succeeded without a result AVP")
+	}
+}
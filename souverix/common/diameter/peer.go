@@ -0,0 +1,699 @@
+package diameter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultWatchdogInterval is Tw from RFC 3539
+	defaultWatchdogInterval = 30 * time.Second
+
+	// defaultRequestTimeout bounds requests whose context has no deadline
+	defaultRequestTimeout = 10 * time.Second
+)
+
+var (
+	// ErrPeerClosed is returned for requests on a closed peer connection
+	ErrPeerClosed = errors.New("diameter peer closed")
+
+	// ErrPeerNotOpen is returned for application requests sent before the
+	// capabilities exchange completed or after disconnection began
+	ErrPeerNotOpen = errors.New("diameter peer not open")
+)
+
+// State is the state of a peer connection (RFC 6733 section 5.6)
+type State int
+
+const (
+	StateClosed State = iota
+	StateWaitCEA
+	StateWaitCER
+	StateOpen
+	StateClosing
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "Closed"
+	case StateWaitCEA:
+		return "Wait-I-CEA"
+	case StateWaitCER:
+		return "Wait-CER"
+	case StateOpen:
+		return "Open"
+	case StateClosing:
+		return "Closing"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Application identifies a Diameter application. VendorID is set for
+// vendor specific applications such as 3GPP Cx. Accounting applications,
+// such as the base accounting application of Rf, are advertised with
+// Acct-Application-Id.
+type Application struct {
+	ID         uint32
+	VendorID   uint32
+	Accounting bool
+}
+
+// Handler answers application requests received from a peer
+type Handler interface {
+	ServeDiameter(p *Peer, req *Message) *Message
+}
+
+// HandlerFunc adapts a function to Handler
+type HandlerFunc func(p *Peer, req *Message) *Message
+
+// ServeDiameter calls f(p, req)
+func (f HandlerFunc) ServeDiameter(p *Peer, req *Message) *Message {
+	return f(p, req)
+}
+
+// Config describes the local Diameter node
+type Config struct {
+	OriginHost      string
+	OriginRealm     string
+	HostIPAddresses []net.IP // Defaults to the local address of the connection
+	VendorID        uint32
+	ProductName     string
+	Applications    []Application
+
+	// WatchdogInterval is Tw; a DWR is sent after Tw without traffic and the
+	// connection is closed if it is not answered within Tw
+	WatchdogInterval time.Duration
+	RequestTimeout   time.Duration
+
+	// Handler answers application requests; without one they are rejected
+	// with DIAMETER_COMMAND_UNSUPPORTED
+	Handler Handler
+
+	Log *logrus.Logger
+}
+
+// withDefaults returns a copy of c with unset fields defaulted
+func (c *Config) withDefaults() *Config {
+	config := *c
+	if config.WatchdogInterval == 0 {
+		config.WatchdogInterval = defaultWatchdogInterval
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	if config.ProductName == "" {
+		config.ProductName = "souverix"
+	}
+	if config.Log == nil {
+		config.Log = logrus.New()
+	}
+	return &config
+}
+
+// Peer is a Diameter connection to a directly connected peer
+type Peer struct {
+	config *Config
+	conn   net.Conn
+	log    *logrus.Logger
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	state       State
+	pending     map[uint32]chan *Message
+	remoteHost  string
+	remoteRealm string
+	remoteApps  []Application
+	err         error
+
+	hopByHop  atomic.Uint32
+	endToEnd  atomic.Uint32
+	sessionID atomic.Uint64
+	lastRecv  atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeer(conn net.Conn, config *Config) *Peer {
+	config = config.withDefaults()
+	p := &Peer{
+		config:  config,
+		conn:    conn,
+		log:     config.Log,
+		pending: make(map[uint32]chan *Message),
+		done:    make(chan struct{}),
+	}
+	p.hopByHop.Store(rand.Uint32())
+	// RFC 6733 section 3: the high 12 bits of the End-to-End Identifier are
+	// the low bits of the current time, the low 20 bits are random
+	p.endToEnd.Store(uint32(time.Now().Unix())<<20 | rand.Uint32()&0xfffff)
+	p.sessionID.Store(uint64(time.Now().Unix()) << 32)
+	p.lastRecv.Store(time.Now().UnixNano())
+	return p
+}
+
+// Dial connects to a peer and performs the capabilities exchange. The
+// returned peer is Open.
+func Dial(ctx context.Context, network, address string, config *Config) (*Peer, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to diameter peer %s: %w", address, err)
+	}
+
+	p := newPeer(conn, config)
+	p.setState(StateWaitCEA)
+	if err := p.sendCER(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.open()
+	return p, nil
+}
+
+// Accept performs the responder side of the capabilities exchange on an
+// accepted connection. The returned peer is Open.
+func Accept(conn net.Conn, config *Config) (*Peer, error) {
+	p := newPeer(conn, config)
+	p.setState(StateWaitCER)
+	if err := p.receiveCER(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.open()
+	return p, nil
+}
+
+// sendCER sends a CER and waits for the CEA
+func (p *Peer) sendCER(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(p.config.RequestTimeout)
+	}
+	p.conn.SetDeadline(deadline)
+	defer p.conn.SetDeadline(time.Time{})
+
+	cer := p.NewRequest(CommandCapabilitiesExchange, 0, "", p.capabilitiesAVPs()...)
+	cer.Flags &^= FlagProxiable
+	cer.HopByHop = p.hopByHop.Add(1)
+	cer.EndToEnd = p.endToEnd.Add(1)
+	if err := p.write(cer); err != nil {
+		return err
+	}
+
+	cea, err := ReadMessage(p.conn)
+	if err != nil {
+		return fmt.Errorf("failed to read CEA: %w", err)
+	}
+	if cea.IsRequest() || cea.CommandCode != CommandCapabilitiesExchange || cea.HopByHop != cer.HopByHop {
+		return fmt.Errorf("expected CEA, got command %d", cea.CommandCode)
+	}
+	result, err := cea.Result()
+	if err != nil {
+		return fmt.Errorf("invalid CEA: %w", err)
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("capabilities exchange rejected: %w", err)
+	}
+	if err := p.setRemoteCapabilities(cea); err != nil {
+		return err
+	}
+	if len(p.CommonApplications()) == 0 {
+		return fmt.Errorf("no common application with %s", p.RemoteHost())
+	}
+	return nil
+}
+
+// receiveCER waits for a CER and answers it with a CEA
+func (p *Peer) receiveCER() error {
+	p.conn.SetDeadline(time.Now().Add(p.config.RequestTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	cer, err := ReadMessage(p.conn)
+	if err != nil {
+		return fmt.Errorf("failed to read CER: %w", err)
+	}
+	if !cer.IsRequest() || cer.CommandCode != CommandCapabilitiesExchange {
+		return fmt.Errorf("expected CER, got command %d", cer.CommandCode)
+	}
+	if err := p.setRemoteCapabilities(cer); err != nil {
+		p.write(p.NewAnswer(cer, Result{Code: ResultMissingAVP}))
+		return err
+	}
+
+	if len(p.CommonApplications()) == 0 {
+		p.write(p.NewAnswer(cer, Result{Code: ResultNoCommonApplication}).Add(p.capabilitiesAVPs()...))
+		return fmt.Errorf("no common application with %s", p.RemoteHost())
+	}
+	return p.write(p.NewAnswer(cer, Result{Code: ResultSuccess}).Add(p.capabilitiesAVPs()...))
+}
+
+// capabilitiesAVPs returns the CER/CEA AVPs describing the local node,
+// excluding Origin-Host and Origin-Realm
+func (p *Peer) capabilitiesAVPs() []*AVP {
+	var avps []*AVP
+	addresses := p.config.HostIPAddresses
+	if len(addresses) == 0 {
+		if addr, ok := p.conn.LocalAddr().(*net.TCPAddr); ok {
+			addresses = []net.IP{addr.IP}
+		}
+	}
+	for _, ip := range addresses {
+		avps = append(avps, Address(AVPHostIPAddress, 0, ip))
+	}
+	avps = append(avps,
+		Unsigned32(AVPVendorID, 0, p.config.VendorID),
+		NewAVP(AVPProductName, 0, 0, []byte(p.config.ProductName)),
+	)
+
+	vendors := map[uint32]bool{}
+	for _, app := range p.config.Applications {
+		if app.VendorID != 0 && !vendors[app.VendorID] {
+			vendors[app.VendorID] = true
+			avps = append(avps, Unsigned32(AVPSupportedVendorID, 0, app.VendorID))
+		}
+	}
+	for _, app := range p.config.Applications {
+		idCode := AVPAuthApplicationID
+		if app.Accounting {
+			idCode = AVPAcctApplicationID
+		}
+		if app.VendorID == 0 {
+			avps = append(avps, Unsigned32(idCode, 0, app.ID))
+			continue
+		}
+		avps = append(avps, Grouped(AVPVendorSpecificApplicationID, 0,
+			Unsigned32(AVPVendorID, 0, app.VendorID),
+			Unsigned32(idCode, 0, app.ID),
+		))
+	}
+	return avps
+}
+
+// setRemoteCapabilities records the identity and applications advertised in
+// a CER or CEA
+func (p *Peer) setRemoteCapabilities(m *Message) error {
+	host := m.Find(AVPOriginHost, 0)
+	realm := m.Find(AVPOriginRealm, 0)
+	if host == nil || realm == nil {
+		return fmt.Errorf("capabilities exchange without Origin-Host or Origin-Realm")
+	}
+
+	var apps []Application
+	for _, a := range m.FindAll(AVPAuthApplicationID, 0) {
+		if id, err := a.Uint32(); err == nil {
+			apps = append(apps, Application{ID: id})
+		}
+	}
+	for _, a := range m.FindAll(AVPAcctApplicationID, 0) {
+		if id, err := a.Uint32(); err == nil {
+			apps = append(apps, Application{ID: id, Accounting: true})
+		}
+	}
+	for _, a := range m.FindAll(AVPVendorSpecificApplicationID, 0) {
+		group, err := a.Grouped()
+		if err != nil {
+			return err
+		}
+		app := Application{}
+		if v := FindAVP(group, AVPVendorID, 0); v != nil {
+			app.VendorID, _ = v.Uint32()
+		}
+		if id := FindAVP(group, AVPAuthApplicationID, 0); id != nil {
+			app.ID, _ = id.Uint32()
+			apps = append(apps, app)
+		} else if id := FindAVP(group, AVPAcctApplicationID, 0); id != nil {
+			app.ID, _ = id.Uint32()
+			app.Accounting = true
+			apps = append(apps, app)
+		}
+	}
+
+	p.mu.Lock()
+	p.remoteHost = host.String()
+	p.remoteRealm = realm.String()
+	p.remoteApps = apps
+	p.mu.Unlock()
+	return nil
+}
+
+// CommonApplications returns the local applications the peer also supports
+func (p *Peer) CommonApplications() []Application {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var common []Application
+	for _, local := range p.config.Applications {
+		for _, remote := range p.remoteApps {
+			if remote.ID == local.ID || remote.ID == ApplicationRelay {
+				common = append(common, local)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// supportsApplication reports whether appID was negotiated with the peer
+func (p *Peer) supportsApplication(appID uint32) bool {
+	for _, app := range p.CommonApplications() {
+		if app.ID == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// open moves the peer to Open and starts the receive and watchdog loops
+func (p *Peer) open() {
+	p.setState(StateOpen)
+	p.log.WithFields(logrus.Fields{
+		"peer":  p.RemoteHost(),
+		"realm": p.RemoteRealm(),
+	}).Info("diameter peer open")
+
+	go p.readLoop()
+	go p.watchdog()
+}
+
+// readLoop dispatches received messages until the connection fails
+func (p *Peer) readLoop() {
+	for {
+		m, err := ReadMessage(p.conn)
+		if err != nil {
+			if p.State() == StateClosing {
+				err = ErrPeerClosed
+			}
+			p.closeWithError(err)
+			return
+		}
+		p.lastRecv.Store(time.Now().UnixNano())
+
+		if m.IsRequest() {
+			p.handleRequest(m)
+		} else {
+			p.handleAnswer(m)
+		}
+	}
+}
+
+// handleRequest answers base protocol requests and passes application
+// requests to the handler
+func (p *Peer) handleRequest(req *Message) {
+	switch req.CommandCode {
+	case CommandDeviceWatchdog:
+		p.write(p.NewAnswer(req, Result{Code: ResultSuccess}))
+		return
+	case CommandDisconnectPeer:
+		p.setState(StateClosing)
+		p.write(p.NewAnswer(req, Result{Code: ResultSuccess}))
+		p.closeWithError(ErrPeerClosed)
+		return
+	case CommandCapabilitiesExchange:
+		// Capabilities are only exchanged once per connection
+		p.write(p.NewAnswer(req, Result{Code: ResultUnableToComply}))
+		return
+	}
+
+	if !p.supportsApplication(req.AppID) {
+		p.write(p.NewAnswer(req, Result{Code: ResultApplicationUnsupported}))
+		return
+	}
+	if p.config.Handler == nil {
+		p.write(p.NewAnswer(req, Result{Code: ResultCommandUnsupported}))
+		return
+	}
+
+	go func() {
+		answer := p.config.Handler.ServeDiameter(p, req)
+		if answer == nil {
+			answer = p.NewAnswer(req, Result{Code: ResultUnableToComply})
+		}
+		answer.Flags &^= FlagRequest
+		answer.HopByHop = req.HopByHop
+		answer.EndToEnd = req.EndToEnd
+		p.write(answer)
+	}()
+}
+
+// handleAnswer delivers an answer to the request waiting for it
+func (p *Peer) handleAnswer(answer *Message) {
+	p.mu.Lock()
+	ch := p.pending[answer.HopByHop]
+	delete(p.pending, answer.HopByHop)
+	p.mu.Unlock()
+
+	if ch == nil {
+		p.log.WithFields(logrus.Fields{
+			"peer":    p.RemoteHost(),
+			"command": answer.CommandCode,
+		}).Debug("discarding unexpected diameter answer")
+		return
+	}
+	ch <- answer
+}
+
+// watchdog sends a DWR when the connection has been idle for Tw and closes
+// the connection if the DWR is not answered (RFC 3539)
+func (p *Peer) watchdog() {
+	interval := p.config.WatchdogInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(time.Unix(0, p.lastRecv.Load())) < interval {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		dwr := p.NewRequest(CommandDeviceWatchdog, 0, "")
+		dwr.Flags &^= FlagProxiable
+		_, err := p.request(ctx, dwr)
+		cancel()
+		if err != nil {
+			p.closeWithError(fmt.Errorf("device watchdog failed: %w", err))
+			return
+		}
+	}
+}
+
+// Request sends an application request and waits for its answer. Requests
+// without a context deadline time out after Config.RequestTimeout.
+func (p *Peer) Request(ctx context.Context, req *Message) (*Message, error) {
+	if state := p.State(); state != StateOpen {
+		if state == StateClosed {
+			return nil, p.Err()
+		}
+		return nil, ErrPeerNotOpen
+	}
+	return p.request(ctx, req)
+}
+
+// request sends req in any state and waits for its answer
+func (p *Peer) request(ctx context.Context, req *Message) (*Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.RequestTimeout)
+		defer cancel()
+	}
+
+	req.Flags |= FlagRequest
+	req.HopByHop = p.hopByHop.Add(1)
+	if req.EndToEnd == 0 {
+		req.EndToEnd = p.endToEnd.Add(1)
+	}
+
+	ch := make(chan *Message, 1)
+	p.mu.Lock()
+	p.pending[req.HopByHop] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, req.HopByHop)
+		p.mu.Unlock()
+	}()
+
+	if err := p.write(req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case answer := <-ch:
+		return answer, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, p.Err()
+	}
+}
+
+// write encodes and sends m
+func (p *Peer) write(m *Message) error {
+	data, err := m.Encode()
+	if err != nil {
+		return err
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.conn.SetWriteDeadline(time.Now().Add(p.config.RequestTimeout))
+	if _, err := p.conn.Write(data); err != nil {
+		p.closeWithError(err)
+		return fmt.Errorf("failed to send diameter message: %w", err)
+	}
+	return nil
+}
+
+// NewRequest creates a request from the local node. If sessionID is not
+// empty it is added as the first AVP, as required for session based
+// applications.
+func (p *Peer) NewRequest(commandCode, appID uint32, sessionID string, avps ...*AVP) *Message {
+	m := &Message{
+		Flags:       FlagRequest | FlagProxiable,
+		CommandCode: commandCode,
+		AppID:       appID,
+	}
+	if sessionID != "" {
+		m.Add(UTF8String(AVPSessionID, 0, sessionID))
+	}
+	m.Add(
+		UTF8String(AVPOriginHost, 0, p.config.OriginHost),
+		UTF8String(AVPOriginRealm, 0, p.config.OriginRealm),
+	)
+	return m.Add(avps...)
+}
+
+// NewAnswer creates an answer to req carrying result. Protocol errors
+// (3xxx) set the E flag.
+func (p *Peer) NewAnswer(req *Message, result Result) *Message {
+	m := &Message{
+		Flags:       req.Flags & FlagProxiable,
+		CommandCode: req.CommandCode,
+		AppID:       req.AppID,
+		HopByHop:    req.HopByHop,
+		EndToEnd:    req.EndToEnd,
+	}
+	if result.VendorID == 0 && result.Code >= 3000 && result.Code < 4000 {
+		m.Flags |= FlagError
+	}
+	if sessionID := req.SessionID(); sessionID != "" {
+		m.Add(UTF8String(AVPSessionID, 0, sessionID))
+	}
+	return m.Add(
+		result.avp(),
+		UTF8String(AVPOriginHost, 0, p.config.OriginHost),
+		UTF8String(AVPOriginRealm, 0, p.config.OriginRealm),
+	)
+}
+
+// NewSessionID returns a Session-Id unique to this node (RFC 6733 section 8.8)
+func (p *Peer) NewSessionID() string {
+	id := p.sessionID.Add(1)
+	return fmt.Sprintf("%s;%d;%d", p.config.OriginHost, id>>32, id&0xffffffff)
+}
+
+// Close disconnects gracefully with a DPR and closes the connection
+func (p *Peer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.state != StateOpen {
+		p.mu.Unlock()
+		p.closeWithError(ErrPeerClosed)
+		return nil
+	}
+	p.state = StateClosing
+	p.mu.Unlock()
+
+	dpr := p.NewRequest(CommandDisconnectPeer, 0, "", Unsigned32(AVPDisconnectCause, 0, DisconnectRebooting))
+	dpr.Flags &^= FlagProxiable
+	_, err := p.request(ctx, dpr)
+	p.closeWithError(ErrPeerClosed)
+	if errors.Is(err, ErrPeerClosed) {
+		return nil
+	}
+	return err
+}
+
+// closeWithError closes the connection and fails pending requests with err
+func (p *Peer) closeWithError(err error) {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.state = StateClosed
+		p.err = err
+		p.mu.Unlock()
+
+		p.conn.Close()
+		close(p.done)
+
+		if err != ErrPeerClosed {
+			p.log.WithError(err).WithField("peer", p.RemoteHost()).Warn("diameter peer connection lost")
+		} else {
+			p.log.WithField("peer", p.RemoteHost()).Info("diameter peer closed")
+		}
+	})
+}
+
+func (p *Peer) setState(state State) {
+	p.mu.Lock()
+	p.state = state
+	p.mu.Unlock()
+}
+
+// State returns the current peer state
+func (p *Peer) State() State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// Err returns the reason the peer closed, or nil while it is connected
+func (p *Peer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Done is closed when the peer connection closes
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// RemoteHost returns the Origin-Host advertised by the peer
+func (p *Peer) RemoteHost() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remoteHost
+}
+
+// RemoteRealm returns the Origin-Realm advertised by the peer
+func (p *Peer) RemoteRealm() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remoteRealm
+}
+
+// LocalHost returns the local Origin-Host
+func (p *Peer) LocalHost() string {
+	return p.config.OriginHost
+}
+
+// LocalRealm returns the local Origin-Realm
+func (p *Peer) LocalRealm() string {
+	return p.config.OriginRealm
+}
@@ -0,0 +1,276 @@
+package diameter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testAppID uint32 = 16777216
+
+func testConfig(host string, handler Handler) *Config {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return &Config{
+		OriginHost:   host,
+		OriginRealm:  "ims.test",
+		VendorID:     10415,
+		Applications: []Application{{ID: testAppID, VendorID: 10415}},
+		Handler:      handler,
+		Log:          log,
+	}
+}
+
+// startServer serves config on a loopback listener
+func startServer(t *testing.T, config *Config) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := NewServer(config)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+	return server, l.Addr().String()
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func echoHandler() Handler {
+	return HandlerFunc(func(p *Peer, req *Message) *Message {
+		answer := p.NewAnswer(req, Result{Code: ResultSuccess})
+		if a := req.Find(AVPUserName, 0); a != nil {
+			answer.Add(a)
+		}
+		return answer
+	})
+}
+
+func TestDial_CapabilitiesExchange(t *testing.T) {
+	server, addr := startServer(t, testConfig("hss.ims.test", echoHandler()))
+
+	client, err := Dial(context.Background(), "tcp", addr, testConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close(context.Background())
+
+	if client.State() != StateOpen {
+		t.Errorf("State() = %s, want Open", client.State())
+	}
+	if client.RemoteHost() != "hss.ims.test" || client.RemoteRealm() != "ims.test" {
+		t.Errorf("remote identity = %s/%s", client.RemoteHost(), client.RemoteRealm())
+	}
+	if apps := client.CommonApplications(); len(apps) != 1 || apps[0].ID != testAppID {
+		t.Errorf("CommonApplications() = %v", apps)
+	}
+	waitFor(t, "server peer", func() bool { return server.Peer("scscf.ims.test") != nil })
+}
+
+func TestDial_NoCommonApplication(t *testing.T) {
+	_, addr := startServer(t, testConfig("hss.ims.test", echoHandler()))
+
+	config := testConfig("scscf.ims.test", nil)
+	config.Applications = []Application{{ID: 4}}
+	if _, err := Dial(context.Background(), "tcp", addr, config); err == nil {
+		t.Error("Dial() succeeded without a common application")
+	}
+}
+
+func TestDial_AccountingApplication(t *testing.T) {
+	accounting := []Application{{ID: 3, Accounting: true}, {ID: testAppID, VendorID: 10415, Accounting: true}}
+	config := testConfig("cdf.ims.test", echoHandler())
+	config.Applications = accounting
+	_, addr := startServer(t, config)
+
+	config = testConfig("scscf.ims.test", nil)
+	config.Applications = accounting
+	client, err := Dial(context.Background(), "tcp", addr, config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close(context.Background())
+	if apps := client.CommonApplications(); len(apps) != 2 {
+		t.Errorf("CommonApplications() = %v", apps)
+	}
+
+	answer, err := client.Request(context.Background(), client.NewRequest(CommandAccounting, 3, client.NewSessionID()))
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if result, _ := answer.Result(); !result.Success() {
+		t.Errorf("accounting request result = %+v", result)
+	}
+}
+
+func TestPeer_Request(t *testing.T) {
+	_, addr := startServer(t, testConfig("hss.ims.test", echoHandler()))
+	client, err := Dial(context.Background(), "tcp", addr, testConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close(context.Background())
+
+	sessionID := client.NewSessionID()
+	req := client.NewRequest(300, testAppID, sessionID, UTF8String(AVPUserName, 0, "alice@ims.test"))
+	answer, err := client.Request(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+
+	if answer.IsRequest() || answer.HopByHop != req.HopByHop || answer.EndToEnd != req.EndToEnd {
+		t.Errorf("answer header = %+v, request %+v", answer, req)
+	}
+	if answer.SessionID() != sessionID {
+		t.Errorf("answer Session-Id = %q, want %q", answer.SessionID(), sessionID)
+	}
+	if answer.OriginHost() != "hss.ims.test" {
+		t.Errorf("answer Origin-Host = %q", answer.OriginHost())
+	}
+	if a := answer.Find(AVPUserName, 0); a == nil || a.String() != "alice@ims.test" {
+		t.Errorf("answer User-Name = %v", a)
+	}
+}
+
+func TestPeer_RejectedRequests(t *testing.T) {
+	_, addr := startServer(t, testConfig("hss.ims.test", nil))
+	client, err := Dial(context.Background(), "tcp", addr, testConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close(context.Background())
+
+	tests := []struct {
+		name  string
+		appID uint32
+		want  uint32
+	}{
+		{"no handler", testAppID, ResultCommandUnsupported},
+		{"application not negotiated", 4, ResultApplicationUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, err := client.Request(context.Background(), client.NewRequest(300, tt.appID, client.NewSessionID()))
+			if err != nil {
+				t.Fatalf("Request() error = %v", err)
+			}
+			result, _ := answer.Result()
+			if result.Code != tt.want {
+				t.Errorf("Result-Code = %d, want %d", result.Code, tt.want)
+			}
+			if answer.Flags&FlagError == 0 {
+				t.Error("protocol error answer without E flag")
+			}
+		})
+	}
+}
+
+func TestPeer_Watchdog(t *testing.T) {
+	serverConfig := testConfig("hss.ims.test", echoHandler())
+	serverConfig.WatchdogInterval = 20 * time.Millisecond
+	_, addr := startServer(t, serverConfig)
+
+	config := testConfig("scscf.ims.test", nil)
+	config.WatchdogInterval = 20 * time.Millisecond
+	client, err := Dial(context.Background(), "tcp", addr, config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close(context.Background())
+
+	// Idle for several Tw; answered DWRs keep the connection open
+	time.Sleep(150 * time.Millisecond)
+	if client.State() != StateOpen {
+		t.Errorf("State() = %s after idle period, want Open (err %v)", client.State(), client.Err())
+	}
+}
+
+func TestPeer_WatchdogFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// The peer answers the CER and then stops reading
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		silent := newPeer(conn, testConfig("hss.ims.test", nil))
+		silent.receiveCER()
+		time.Sleep(time.Second)
+	}()
+
+	config := testConfig("scscf.ims.test", nil)
+	config.WatchdogInterval = 20 * time.Millisecond
+	client, err := Dial(context.Background(), "tcp", l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	select {
+	case <-client.Done():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("peer stayed open without DWA")
+	}
+	if client.Err() == nil || errors.Is(client.Err(), ErrPeerClosed) {
+		t.Errorf("Err() = %v, want a watchdog failure", client.Err())
+	}
+}
+
+func TestPeer_Close(t *testing.T) {
+	server, addr := startServer(t, testConfig("hss.ims.test", echoHandler()))
+	client, err := Dial(context.Background(), "tcp", addr, testConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	waitFor(t, "server peer", func() bool { return server.Peer("scscf.ims.test") != nil })
+
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if client.State() != StateClosed {
+		t.Errorf("State() = %s, want Closed", client.State())
+	}
+	if _, err := client.Request(context.Background(), client.NewRequest(300, testAppID, "s")); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("Request() after Close error = %v, want ErrPeerClosed", err)
+	}
+	waitFor(t, "server peer removal", func() bool { return server.Peer("scscf.ims.test") == nil })
+}
+
+func TestServer_Close(t *testing.T) {
+	server, addr := startServer(t, testConfig("hss.ims.test", echoHandler()))
+	client, err := Dial(context.Background(), "tcp", addr, testConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	waitFor(t, "server peer", func() bool { return len(server.Peers()) == 1 })
+
+	server.Close(context.Background())
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client stayed open after server Close")
+	}
+	if !errors.Is(client.Err(), ErrPeerClosed) {
+		t.Errorf("client Err() = %v, want ErrPeerClosed after DPR", client.Err())
+	}
+}
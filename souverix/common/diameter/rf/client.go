@@ -0,0 +1,73 @@
+package rf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// Client sends ACRs to the CDF over a peer connection. Answers with a
+// failure result are returned without an error; callers check the
+// answer's Result.
+type Client struct {
+	peer *diameter.Peer
+}
+
+// NewClient creates an Rf client on an open peer
+func NewClient(peer *diameter.Peer) *Client {
+	return &Client{peer: peer}
+}
+
+// Peer returns the underlying peer connection
+func (c *Client) Peer() *diameter.Peer {
+	return c.peer
+}
+
+// NewSessionID returns a new accounting Session-Id, shared by the records
+// of a session
+func (c *Client) NewSessionID() string {
+	return c.peer.NewSessionID()
+}
+
+// Accounting sends an ACR. A new Session-Id is used when req.SessionID is
+// empty; it is returned in the answer.
+func (c *Client) Accounting(ctx context.Context, req *ACR) (*ACA, error) {
+	sessionID := req.SessionID
+	if sessionID == "" {
+		sessionID = c.peer.NewSessionID()
+	}
+	m := c.peer.NewRequest(diameter.CommandAccounting, ApplicationID, sessionID)
+	if req.DestinationHost != "" {
+		m.Add(diameter.UTF8String(diameter.AVPDestinationHost, 0, req.DestinationHost))
+	}
+	m.Add(diameter.UTF8String(diameter.AVPDestinationRealm, 0, c.peer.RemoteRealm()))
+	m.Add(diameter.Unsigned32(diameter.AVPAcctApplicationID, 0, ApplicationID))
+	m.Add(req.avps()...)
+
+	answer, err := c.peer.Request(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if answer.CommandCode != diameter.CommandAccounting {
+		return nil, fmt.Errorf("unexpected answer command %d to ACR", answer.CommandCode)
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	aca := &ACA{SessionID: answer.SessionID(), Result: result}
+	if aca.RecordType, _, err = diameter.FindUint32(answer.AVPs, diameter.AVPAccountingRecordType, 0); err != nil {
+		return nil, err
+	}
+	if aca.RecordNumber, _, err = diameter.FindUint32(answer.AVPs, diameter.AVPAccountingRecordNumber, 0); err != nil {
+		return nil, err
+	}
+	interval, _, err := diameter.FindUint32(answer.AVPs, diameter.AVPAcctInterimInterval, 0)
+	if err != nil {
+		return nil, err
+	}
+	aca.InterimInterval = time.Duration(interval) * time.Second
+	return aca, nil
+}
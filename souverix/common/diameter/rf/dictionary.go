@@ -0,0 +1,69 @@
+// Package rf implements the 3GPP Rf offline charging interface (TS 32.299)
+// between a charging trigger function, such as a CSCF, and the charging
+// data function. Rf is the base accounting application of Diameter carrying
+// the IMS charging AVPs, which the Ro online charging interface reuses.
+package rf
+
+import "github.com/dasmlab/souverix/common/diameter"
+
+const (
+	// ApplicationID is the Diameter base accounting application id
+	ApplicationID uint32 = 3
+
+	// Vendor3GPP is the 3GPP vendor id used by the charging AVPs
+	Vendor3GPP uint32 = 10415
+)
+
+// Application is the Rf application advertised in the capabilities exchange
+var Application = diameter.Application{ID: ApplicationID, Accounting: true}
+
+// ServiceContextIMS is the Service-Context-Id of IMS charging (TS 32.260)
+const ServiceContextIMS = "32260@3gpp.org"
+
+// AVPServiceContextID is the Service-Context-Id AVP of Diameter credit
+// control (RFC 4006), also sent in ACRs
+const AVPServiceContextID uint32 = 461
+
+// IMS charging AVP codes (TS 32.299 section 7.2), vendor 10415
+const (
+	AVPEventType               uint32 = 823
+	AVPSIPMethod               uint32 = 824
+	AVPRoleOfNode              uint32 = 829
+	AVPUserSessionID           uint32 = 830
+	AVPCallingPartyAddress     uint32 = 831
+	AVPCalledPartyAddress      uint32 = 832
+	AVPTimeStamps              uint32 = 833
+	AVPSIPRequestTimestamp     uint32 = 834
+	AVPSIPResponseTimestamp    uint32 = 835
+	AVPInterOperatorIdentifier uint32 = 838
+	AVPOriginatingIOI          uint32 = 839
+	AVPTerminatingIOI          uint32 = 840
+	AVPIMSChargingIdentifier   uint32 = 841
+	AVPCauseCode               uint32 = 861
+	AVPNodeFunctionality       uint32 = 862
+	AVPServiceInformation      uint32 = 873
+	AVPIMSInformation          uint32 = 876
+)
+
+// Role-Of-Node values
+const (
+	RoleOriginating uint32 = 0
+	RoleTerminating uint32 = 1
+	RoleForwarding  uint32 = 2
+)
+
+// Node-Functionality values
+const (
+	NodeSCSCF uint32 = 0
+	NodePCSCF uint32 = 1
+	NodeICSCF uint32 = 2
+	NodeMRFC  uint32 = 3
+	NodeMGCF  uint32 = 4
+	NodeBGCF  uint32 = 5
+	NodeAS    uint32 = 6
+	NodeIBCF  uint32 = 7
+	NodeECSCF uint32 = 11
+)
+
+// Success is the DIAMETER_SUCCESS result
+var Success = diameter.Result{Code: diameter.ResultSuccess}
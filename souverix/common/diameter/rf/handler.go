@@ -0,0 +1,47 @@
+package rf
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// CDF answers the ACRs sent by charging trigger functions
+type CDF interface {
+	Accounting(ctx context.Context, req *ACR) *ACA
+}
+
+// Handler dispatches received Rf requests to a CDF
+type Handler struct {
+	CDF CDF
+}
+
+// ServeDiameter implements diameter.Handler
+func (h *Handler) ServeDiameter(p *diameter.Peer, req *diameter.Message) *diameter.Message {
+	if req.CommandCode != diameter.CommandAccounting || h.CDF == nil {
+		return p.NewAnswer(req, diameter.Result{Code: diameter.ResultCommandUnsupported})
+	}
+
+	acr, err := parseACR(req)
+	if err != nil {
+		var missing *diameter.MissingAVPError
+		if errors.As(err, &missing) {
+			return p.NewAnswer(req, diameter.Result{Code: diameter.ResultMissingAVP})
+		}
+		return p.NewAnswer(req, diameter.Result{Code: diameter.ResultInvalidAVPValue})
+	}
+
+	aca := h.CDF.Accounting(context.Background(), acr)
+	answer := p.NewAnswer(req, aca.Result)
+	answer.Add(
+		diameter.Unsigned32(diameter.AVPAccountingRecordType, 0, acr.RecordType),
+		diameter.Unsigned32(diameter.AVPAccountingRecordNumber, 0, acr.RecordNumber),
+		diameter.Unsigned32(diameter.AVPAcctApplicationID, 0, ApplicationID),
+	)
+	if aca.InterimInterval > 0 {
+		answer.Add(diameter.Unsigned32(diameter.AVPAcctInterimInterval, 0, uint32(aca.InterimInterval/time.Second)))
+	}
+	return answer
+}
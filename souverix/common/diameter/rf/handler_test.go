@@ -0,0 +1,100 @@
+package rf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeCDF records the ACRs it receives
+type fakeCDF struct {
+	acrs []*ACR
+}
+
+func (f *fakeCDF) Accounting(ctx context.Context, req *ACR) *ACA {
+	f.acrs = append(f.acrs, req)
+	return &ACA{Result: Success, InterimInterval: 5 * time.Minute}
+}
+
+func rfConfig(host string, handler diameter.Handler) *diameter.Config {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return &diameter.Config{
+		OriginHost:   host,
+		OriginRealm:  "ims.test",
+		VendorID:     Vendor3GPP,
+		Applications: []diameter.Application{Application},
+		Handler:      handler,
+		Log:          log,
+	}
+}
+
+// connectRf connects a CTF to a CDF and returns the client of the CTF
+func connectRf(t *testing.T, cdf CDF) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := diameter.NewServer(rfConfig("cdf.ims.test", &Handler{CDF: cdf}))
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+
+	peer, err := diameter.Dial(context.Background(), "tcp", l.Addr().String(), rfConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { peer.Close(context.Background()) })
+	return NewClient(peer)
+}
+
+func TestClient_Accounting(t *testing.T) {
+	cdf := &fakeCDF{}
+	client := connectRf(t, cdf)
+	ctx := context.Background()
+
+	sessionID := client.NewSessionID()
+	for i, recordType := range []uint32{diameter.RecordStart, diameter.RecordInterim, diameter.RecordStop} {
+		aca, err := client.Accounting(ctx, &ACR{
+			SessionID:    sessionID,
+			RecordType:   recordType,
+			RecordNumber: uint32(i),
+			IMS:          &IMSInformation{NodeFunctionality: NodeSCSCF, SIPMethod: "INVITE", ICID: "ab12"},
+		})
+		if err != nil {
+			t.Fatalf("Accounting() error = %v", err)
+		}
+		if aca.Result != Success || aca.SessionID != sessionID || aca.RecordType != recordType ||
+			aca.RecordNumber != uint32(i) || aca.InterimInterval != 5*time.Minute {
+			t.Errorf("ACA = %+v", aca)
+		}
+	}
+	if len(cdf.acrs) != 3 || cdf.acrs[2].SessionID != sessionID || cdf.acrs[2].IMS.ICID != "ab12" {
+		t.Errorf("CDF received %+v", cdf.acrs)
+	}
+}
+
+func TestHandler_Rejections(t *testing.T) {
+	client := connectRf(t, nil)
+	aca, err := client.Accounting(context.Background(), &ACR{RecordType: diameter.RecordEvent})
+	if err != nil {
+		t.Fatalf("Accounting() error = %v", err)
+	}
+	if aca.Result.Code != diameter.ResultCommandUnsupported {
+		t.Errorf("Result = %+v, want DIAMETER_COMMAND_UNSUPPORTED", aca.Result)
+	}
+
+	client = connectRf(t, &fakeCDF{})
+	aca, err = client.Accounting(context.Background(), &ACR{RecordType: diameter.RecordEvent, IMS: &IMSInformation{}})
+	if err != nil || aca.Result.Code != diameter.ResultSuccess {
+		t.Errorf("Accounting() = %+v, %v", aca, err)
+	}
+	aca, err = client.Accounting(context.Background(), &ACR{RecordType: 9})
+	if err != nil || aca.Result.Code != diameter.ResultInvalidAVPValue {
+		t.Errorf("Accounting() with an unknown record type = %+v, %v", aca, err)
+	}
+}
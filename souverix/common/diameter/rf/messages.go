@@ -0,0 +1,212 @@
+package rf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// IMSInformation is the IMS-Information of the Service-Information of
+// charging requests (TS 32.299 section 7.2.77). Empty values are left out.
+type IMSInformation struct {
+	NodeFunctionality uint32
+	RoleOfNode        uint32
+	SIPMethod         string
+	UserSessionID     string // Call-ID of the session
+	CallingParty      string
+	CalledParty       string
+	RequestTime       time.Time // SIP request that triggered the record
+	ResponseTime      time.Time // Final response to the request
+	ICID              string    // icid-value of the P-Charging-Vector
+	OrigIOI           string
+	TermIOI           string
+
+	// CauseCode is 0 for the normal end of a session, or the SIP status
+	// code of a failed request
+	CauseCode int32
+}
+
+// AVP encodes i as a Service-Information AVP
+func (i *IMSInformation) AVP() *diameter.AVP {
+	avps := []*diameter.AVP{
+		diameter.Unsigned32(AVPRoleOfNode, Vendor3GPP, i.RoleOfNode),
+		diameter.Unsigned32(AVPNodeFunctionality, Vendor3GPP, i.NodeFunctionality),
+	}
+	if i.SIPMethod != "" {
+		avps = append(avps, diameter.Grouped(AVPEventType, Vendor3GPP,
+			diameter.UTF8String(AVPSIPMethod, Vendor3GPP, i.SIPMethod),
+		))
+	}
+	avps = appendString(avps, AVPUserSessionID, i.UserSessionID)
+	avps = appendString(avps, AVPCallingPartyAddress, i.CallingParty)
+	avps = appendString(avps, AVPCalledPartyAddress, i.CalledParty)
+	var timestamps []*diameter.AVP
+	if !i.RequestTime.IsZero() {
+		timestamps = append(timestamps, diameter.Time(AVPSIPRequestTimestamp, Vendor3GPP, i.RequestTime))
+	}
+	if !i.ResponseTime.IsZero() {
+		timestamps = append(timestamps, diameter.Time(AVPSIPResponseTimestamp, Vendor3GPP, i.ResponseTime))
+	}
+	if len(timestamps) > 0 {
+		avps = append(avps, diameter.Grouped(AVPTimeStamps, Vendor3GPP, timestamps...))
+	}
+	if i.OrigIOI != "" || i.TermIOI != "" {
+		var ioi []*diameter.AVP
+		ioi = appendString(ioi, AVPOriginatingIOI, i.OrigIOI)
+		ioi = appendString(ioi, AVPTerminatingIOI, i.TermIOI)
+		avps = append(avps, diameter.Grouped(AVPInterOperatorIdentifier, Vendor3GPP, ioi...))
+	}
+	avps = appendString(avps, AVPIMSChargingIdentifier, i.ICID)
+	avps = append(avps, diameter.Integer32(AVPCauseCode, Vendor3GPP, i.CauseCode))
+	return diameter.Grouped(AVPServiceInformation, Vendor3GPP, diameter.Grouped(AVPIMSInformation, Vendor3GPP, avps...))
+}
+
+// ParseServiceInformation decodes the IMS-Information of the
+// Service-Information in avps; it returns nil when there is none
+func ParseServiceInformation(avps []*diameter.AVP) (*IMSInformation, error) {
+	service := diameter.FindAVP(avps, AVPServiceInformation, Vendor3GPP)
+	if service == nil {
+		return nil, nil
+	}
+	group, err := service.Grouped()
+	if err != nil {
+		return nil, err
+	}
+	ims := diameter.FindAVP(group, AVPIMSInformation, Vendor3GPP)
+	if ims == nil {
+		return nil, nil
+	}
+	if group, err = ims.Grouped(); err != nil {
+		return nil, err
+	}
+
+	i := &IMSInformation{}
+	if i.NodeFunctionality, err = diameter.RequireUint32(group, AVPNodeFunctionality, Vendor3GPP, "Node-Functionality"); err != nil {
+		return nil, err
+	}
+	if i.RoleOfNode, _, err = diameter.FindUint32(group, AVPRoleOfNode, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	if a := diameter.FindAVP(group, AVPEventType, Vendor3GPP); a != nil {
+		event, err := a.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		i.SIPMethod = findString(event, AVPSIPMethod)
+	}
+	i.UserSessionID = findString(group, AVPUserSessionID)
+	i.CallingParty = findString(group, AVPCallingPartyAddress)
+	i.CalledParty = findString(group, AVPCalledPartyAddress)
+	if a := diameter.FindAVP(group, AVPTimeStamps, Vendor3GPP); a != nil {
+		timestamps, err := a.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		if i.RequestTime, err = findTime(timestamps, AVPSIPRequestTimestamp); err != nil {
+			return nil, err
+		}
+		if i.ResponseTime, err = findTime(timestamps, AVPSIPResponseTimestamp); err != nil {
+			return nil, err
+		}
+	}
+	if a := diameter.FindAVP(group, AVPInterOperatorIdentifier, Vendor3GPP); a != nil {
+		ioi, err := a.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		i.OrigIOI = findString(ioi, AVPOriginatingIOI)
+		i.TermIOI = findString(ioi, AVPTerminatingIOI)
+	}
+	i.ICID = findString(group, AVPIMSChargingIdentifier)
+	if a := diameter.FindAVP(group, AVPCauseCode, Vendor3GPP); a != nil {
+		if i.CauseCode, err = a.Int32(); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// ACR is an Accounting-Request sent by the CTF to the CDF. The records of a
+// session, Start, Interim and Stop, share its Session-Id and are numbered
+// from 0; an Event record stands alone.
+type ACR struct {
+	SessionID       string
+	DestinationHost string
+	RecordType      uint32
+	RecordNumber    uint32
+	EventTimestamp  time.Time
+	IMS             *IMSInformation
+}
+
+// ACA is an Accounting-Answer. InterimInterval, when not zero, is how often
+// the CDF wants Interim records of the session.
+type ACA struct {
+	SessionID       string
+	Result          diameter.Result
+	RecordType      uint32
+	RecordNumber    uint32
+	InterimInterval time.Duration
+}
+
+// appendString appends a 3GPP UTF8String AVP unless value is empty
+func appendString(avps []*diameter.AVP, code uint32, value string) []*diameter.AVP {
+	if value == "" {
+		return avps
+	}
+	return append(avps, diameter.UTF8String(code, Vendor3GPP, value))
+}
+
+// findString returns the value of an optional 3GPP string AVP
+func findString(avps []*diameter.AVP, code uint32) string {
+	if a := diameter.FindAVP(avps, code, Vendor3GPP); a != nil {
+		return a.String()
+	}
+	return ""
+}
+
+// findTime decodes an optional 3GPP Time AVP
+func findTime(avps []*diameter.AVP, code uint32) (time.Time, error) {
+	if a := diameter.FindAVP(avps, code, Vendor3GPP); a != nil {
+		return a.Time()
+	}
+	return time.Time{}, nil
+}
+
+func (r *ACR) avps() []*diameter.AVP {
+	avps := []*diameter.AVP{
+		diameter.Unsigned32(diameter.AVPAccountingRecordType, 0, r.RecordType),
+		diameter.Unsigned32(diameter.AVPAccountingRecordNumber, 0, r.RecordNumber),
+	}
+	if !r.EventTimestamp.IsZero() {
+		avps = append(avps, diameter.Time(diameter.AVPEventTimestamp, 0, r.EventTimestamp))
+	}
+	avps = append(avps, diameter.UTF8String(AVPServiceContextID, 0, ServiceContextIMS))
+	if r.IMS != nil {
+		avps = append(avps, r.IMS.AVP())
+	}
+	return avps
+}
+
+func parseACR(m *diameter.Message) (*ACR, error) {
+	r := &ACR{SessionID: m.SessionID()}
+	var err error
+	if r.RecordType, err = diameter.RequireUint32(m.AVPs, diameter.AVPAccountingRecordType, 0, "Accounting-Record-Type"); err != nil {
+		return nil, err
+	}
+	if r.RecordType < diameter.RecordEvent || r.RecordType > diameter.RecordStop {
+		return nil, fmt.Errorf("invalid Accounting-Record-Type %d", r.RecordType)
+	}
+	if r.RecordNumber, err = diameter.RequireUint32(m.AVPs, diameter.AVPAccountingRecordNumber, 0, "Accounting-Record-Number"); err != nil {
+		return nil, err
+	}
+	if a := m.Find(diameter.AVPEventTimestamp, 0); a != nil {
+		if r.EventTimestamp, err = a.Time(); err != nil {
+			return nil, err
+		}
+	}
+	if r.IMS, err = ParseServiceInformation(m.AVPs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
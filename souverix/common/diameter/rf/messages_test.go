@@ -0,0 +1,110 @@
+package rf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// roundTrip encodes avps into a message and decodes it from the wire
+func roundTrip(t *testing.T, avps []*diameter.AVP) *diameter.Message {
+	t.Helper()
+	data, err := (&diameter.Message{CommandCode: diameter.CommandAccounting, AppID: ApplicationID}).Add(avps...).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	m, err := diameter.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	return m
+}
+
+func TestACR_RoundTrip(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		acr  *ACR
+	}{
+		{
+			name: "start",
+			acr: &ACR{
+				RecordType:     diameter.RecordStart,
+				EventTimestamp: start,
+				IMS: &IMSInformation{
+					NodeFunctionality: NodePCSCF,
+					RoleOfNode:        RoleOriginating,
+					SIPMethod:         "INVITE",
+					UserSessionID:     "call-1@10.0.0.2",
+					CallingParty:      "sip:alice@ims.test",
+					CalledParty:       "tel:+15145550002",
+					RequestTime:       start.Add(-5 * time.Second),
+					ResponseTime:      start,
+					ICID:              "ab12cd34",
+					OrigIOI:           "ims.test",
+					TermIOI:           "other.test",
+				},
+			},
+		},
+		{
+			name: "failed event",
+			acr: &ACR{
+				RecordType:   diameter.RecordEvent,
+				RecordNumber: 0,
+				IMS:          &IMSInformation{NodeFunctionality: NodeSCSCF, RoleOfNode: RoleTerminating, SIPMethod: "INVITE", CauseCode: 486},
+			},
+		},
+		{
+			name: "stop without service information",
+			acr:  &ACR{RecordType: diameter.RecordStop, RecordNumber: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseACR(roundTrip(t, tt.acr.avps()))
+			if err != nil {
+				t.Fatalf("parseACR() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.acr) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.acr)
+			}
+		})
+	}
+}
+
+func TestParseACR_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		avps []*diameter.AVP
+	}{
+		{
+			name: "without record number",
+			avps: []*diameter.AVP{diameter.Unsigned32(diameter.AVPAccountingRecordType, 0, diameter.RecordEvent)},
+		},
+		{
+			name: "unknown record type",
+			avps: []*diameter.AVP{
+				diameter.Unsigned32(diameter.AVPAccountingRecordType, 0, 7),
+				diameter.Unsigned32(diameter.AVPAccountingRecordNumber, 0, 0),
+			},
+		},
+		{
+			name: "IMS information without node functionality",
+			avps: []*diameter.AVP{
+				diameter.Unsigned32(diameter.AVPAccountingRecordType, 0, diameter.RecordEvent),
+				diameter.Unsigned32(diameter.AVPAccountingRecordNumber, 0, 0),
+				diameter.Grouped(AVPServiceInformation, Vendor3GPP, diameter.Grouped(AVPIMSInformation, Vendor3GPP)),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseACR(roundTrip(t, tt.avps)); err == nil {
+				t.Error("parseACR() accepted the request")
+			}
+		})
+	}
+}
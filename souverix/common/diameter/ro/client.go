@@ -0,0 +1,51 @@
+package ro
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// Client sends CCRs to the OCS over a peer connection. Answers with a
+// failure result are returned without an error; callers check the
+// answer's Result.
+type Client struct {
+	peer *diameter.Peer
+}
+
+// NewClient creates an Ro client on an open peer
+func NewClient(peer *diameter.Peer) *Client {
+	return &Client{peer: peer}
+}
+
+// Peer returns the underlying peer connection
+func (c *Client) Peer() *diameter.Peer {
+	return c.peer
+}
+
+// CreditControl sends a CCR. A new session is created when req.SessionID
+// is empty; its id is returned in the answer.
+func (c *Client) CreditControl(ctx context.Context, req *CCR) (*CCA, error) {
+	sessionID := req.SessionID
+	if sessionID == "" {
+		sessionID = c.peer.NewSessionID()
+	}
+	m := c.peer.NewRequest(CommandCreditControl, ApplicationID, sessionID,
+		diameter.Unsigned32(diameter.AVPAuthApplicationID, 0, ApplicationID),
+	)
+	if req.DestinationHost != "" {
+		m.Add(diameter.UTF8String(diameter.AVPDestinationHost, 0, req.DestinationHost))
+	}
+	m.Add(diameter.UTF8String(diameter.AVPDestinationRealm, 0, c.peer.RemoteRealm()))
+	m.Add(req.avps()...)
+
+	answer, err := c.peer.Request(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if answer.CommandCode != CommandCreditControl {
+		return nil, fmt.Errorf("unexpected answer command %d to CCR", answer.CommandCode)
+	}
+	return parseCCA(answer)
+}
@@ -0,0 +1,69 @@
+// Package ro implements the 3GPP Ro online charging interface (TS 32.299)
+// between a charging trigger function and the online charging system. Ro
+// is the Diameter credit-control application (RFC 4006) carrying the IMS
+// charging AVPs of Rf.
+package ro
+
+import "github.com/dasmlab/souverix/common/diameter"
+
+// ApplicationID is the Diameter credit-control application id
+const ApplicationID uint32 = 4
+
+// Application is the Ro application advertised in the capabilities exchange
+var Application = diameter.Application{ID: ApplicationID}
+
+// CommandCreditControl is the Credit-Control command (RFC 4006 section 3.1)
+const CommandCreditControl uint32 = 272
+
+// Credit-control AVP codes (RFC 4006 section 8)
+const (
+	AVPCCRequestNumber               uint32 = 415
+	AVPCCRequestType                 uint32 = 416
+	AVPCCTime                        uint32 = 420
+	AVPFinalUnitIndication           uint32 = 430
+	AVPGrantedServiceUnit            uint32 = 431
+	AVPRequestedServiceUnit          uint32 = 437
+	AVPSubscriptionID                uint32 = 443
+	AVPSubscriptionIDData            uint32 = 444
+	AVPUsedServiceUnit               uint32 = 446
+	AVPValidityTime                  uint32 = 448
+	AVPFinalUnitAction               uint32 = 449
+	AVPSubscriptionIDType            uint32 = 450
+	AVPMultipleServicesIndicator     uint32 = 455
+	AVPMultipleServicesCreditControl uint32 = 456
+)
+
+// CC-Request-Type values
+const (
+	RequestInitial     uint32 = 1
+	RequestUpdate      uint32 = 2
+	RequestTermination uint32 = 3
+	RequestEvent       uint32 = 4
+)
+
+// Final-Unit-Action values
+const (
+	FinalUnitTerminate      uint32 = 0
+	FinalUnitRedirect       uint32 = 1
+	FinalUnitRestrictAccess uint32 = 2
+)
+
+// Subscription-Id-Type values
+const (
+	SubscriptionE164   uint32 = 0
+	SubscriptionIMSI   uint32 = 1
+	SubscriptionSIPURI uint32 = 2
+	SubscriptionNAI    uint32 = 3
+)
+
+// Credit-control Result-Code values (RFC 4006 section 9)
+const (
+	ResultEndUserServiceDenied       uint32 = 4010
+	ResultCreditControlNotApplicable uint32 = 4011
+	ResultCreditLimitReached         uint32 = 4012
+	ResultUserUnknown                uint32 = 5030
+	ResultRatingFailed               uint32 = 5031
+)
+
+// Success is the DIAMETER_SUCCESS result
+var Success = diameter.Result{Code: diameter.ResultSuccess}
@@ -0,0 +1,44 @@
+package ro
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// OCS answers the CCRs sent by charging trigger functions
+type OCS interface {
+	CreditControl(ctx context.Context, req *CCR) *CCA
+}
+
+// Handler dispatches received Ro requests to an OCS
+type Handler struct {
+	OCS OCS
+}
+
+// ServeDiameter implements diameter.Handler
+func (h *Handler) ServeDiameter(p *diameter.Peer, req *diameter.Message) *diameter.Message {
+	if req.CommandCode != CommandCreditControl || h.OCS == nil {
+		return p.NewAnswer(req, diameter.Result{Code: diameter.ResultCommandUnsupported})
+	}
+
+	ccr, err := parseCCR(req)
+	if err != nil {
+		var missing *diameter.MissingAVPError
+		if errors.As(err, &missing) {
+			return p.NewAnswer(req, diameter.Result{Code: diameter.ResultMissingAVP})
+		}
+		return p.NewAnswer(req, diameter.Result{Code: diameter.ResultInvalidAVPValue})
+	}
+
+	cca := h.OCS.CreditControl(context.Background(), ccr)
+	answer := p.NewAnswer(req, cca.Result)
+	answer.Add(
+		diameter.Unsigned32(diameter.AVPAuthApplicationID, 0, ApplicationID),
+		diameter.Unsigned32(AVPCCRequestType, 0, ccr.RequestType),
+		diameter.Unsigned32(AVPCCRequestNumber, 0, ccr.RequestNumber),
+	)
+	answer.Add(cca.avps()...)
+	return answer
+}
@@ -0,0 +1,109 @@
+package ro
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeOCS grants a minute per request until the balance of a minute and a
+// half runs out
+type fakeOCS struct {
+	balance time.Duration
+	ccrs    []*CCR
+}
+
+func (f *fakeOCS) CreditControl(ctx context.Context, req *CCR) *CCA {
+	f.ccrs = append(f.ccrs, req)
+	f.balance -= req.UsedTime
+	if !req.RequestQuota {
+		return &CCA{Result: Success}
+	}
+	if f.balance <= 0 {
+		return &CCA{Result: diameter.Result{Code: ResultCreditLimitReached}}
+	}
+	if f.balance <= time.Minute {
+		return &CCA{Result: Success, GrantedTime: f.balance, FinalUnit: true}
+	}
+	return &CCA{Result: Success, GrantedTime: time.Minute}
+}
+
+func roConfig(host string, handler diameter.Handler) *diameter.Config {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return &diameter.Config{
+		OriginHost:   host,
+		OriginRealm:  "ims.test",
+		Applications: []diameter.Application{Application},
+		Handler:      handler,
+		Log:          log,
+	}
+}
+
+// connectRo connects a CTF to an OCS and returns the client of the CTF
+func connectRo(t *testing.T, ocs OCS) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := diameter.NewServer(roConfig("ocs.ims.test", &Handler{OCS: ocs}))
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+
+	peer, err := diameter.Dial(context.Background(), "tcp", l.Addr().String(), roConfig("scscf.ims.test", nil))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { peer.Close(context.Background()) })
+	return NewClient(peer)
+}
+
+func TestClient_CreditControl(t *testing.T) {
+	ocs := &fakeOCS{balance: 90 * time.Second}
+	client := connectRo(t, ocs)
+	ctx := context.Background()
+
+	cca, err := client.CreditControl(ctx, &CCR{RequestType: RequestInitial, Subscriber: "sip:alice@ims.test", RequestQuota: true})
+	if err != nil {
+		t.Fatalf("CreditControl() error = %v", err)
+	}
+	if cca.Result != Success || cca.SessionID == "" || cca.RequestType != RequestInitial || cca.GrantedTime != time.Minute || cca.FinalUnit {
+		t.Errorf("CCA-I = %+v", cca)
+	}
+	sessionID := cca.SessionID
+
+	cca, err = client.CreditControl(ctx, &CCR{SessionID: sessionID, RequestType: RequestUpdate, RequestNumber: 1, RequestQuota: true, UsedTime: time.Minute})
+	if err != nil || cca.SessionID != sessionID || cca.RequestNumber != 1 || cca.GrantedTime != 30*time.Second || !cca.FinalUnit {
+		t.Errorf("CCA-U = %+v, %v", cca, err)
+	}
+	cca, err = client.CreditControl(ctx, &CCR{SessionID: sessionID, RequestType: RequestUpdate, RequestNumber: 2, RequestQuota: true, UsedTime: 30 * time.Second})
+	if err != nil || cca.Result.Code != ResultCreditLimitReached || cca.GrantedTime != 0 {
+		t.Errorf("CCA-U without credit = %+v, %v", cca, err)
+	}
+	cca, err = client.CreditControl(ctx, &CCR{SessionID: sessionID, RequestType: RequestTermination, RequestNumber: 3, TerminationCause: diameter.TerminationLogout})
+	if err != nil || cca.Result != Success {
+		t.Errorf("CCA-T = %+v, %v", cca, err)
+	}
+	if len(ocs.ccrs) != 4 || ocs.ccrs[0].Subscriber != "sip:alice@ims.test" || ocs.ccrs[3].TerminationCause != diameter.TerminationLogout {
+		t.Errorf("OCS received %+v", ocs.ccrs)
+	}
+}
+
+func TestHandler_Rejections(t *testing.T) {
+	client := connectRo(t, nil)
+	cca, err := client.CreditControl(context.Background(), &CCR{RequestType: RequestEvent})
+	if err != nil || cca.Result.Code != diameter.ResultCommandUnsupported {
+		t.Errorf("CreditControl() without OCS = %+v, %v", cca, err)
+	}
+
+	client = connectRo(t, &fakeOCS{})
+	cca, err = client.CreditControl(context.Background(), &CCR{RequestType: 0})
+	if err != nil || cca.Result.Code != diameter.ResultInvalidAVPValue {
+		t.Errorf("CreditControl() with an unknown request type = %+v, %v", cca, err)
+	}
+}
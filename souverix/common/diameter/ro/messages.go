@@ -0,0 +1,234 @@
+package ro
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rf"
+)
+
+// CCR is a Credit-Control-Request sent by the CTF to the OCS. Time is the
+// only unit: the CTF requests call time at the start of a session and each
+// time its grant is used up, and reports the time used.
+type CCR struct {
+	SessionID        string
+	DestinationHost  string
+	RequestType      uint32
+	RequestNumber    uint32
+	Subscriber       string // SIP or tel URI of the served user
+	EventTimestamp   time.Time
+	RequestQuota     bool          // Ask for a new grant
+	UsedTime         time.Duration // Time used since the last report
+	TerminationCause uint32        // Set on CCR-T
+	IMS              *rf.IMSInformation
+}
+
+// CCA is a Credit-Control-Answer. A zero GrantedTime with a success result
+// grants no quota; FinalUnit tells the CTF to end the session once the
+// granted time is used.
+type CCA struct {
+	SessionID     string
+	Result        diameter.Result
+	RequestType   uint32
+	RequestNumber uint32
+	GrantedTime   time.Duration
+	ValidityTime  time.Duration
+	FinalUnit     bool
+}
+
+// findSeconds decodes an optional Unsigned32 AVP holding seconds
+func findSeconds(avps []*diameter.AVP, code uint32) (time.Duration, error) {
+	v, _, err := diameter.FindUint32(avps, code, 0)
+	return time.Duration(v) * time.Second, err
+}
+
+// subscriptionIDAVP encodes the identity of a subscriber: the digits of a
+// tel URI as E.164, any other URI as a SIP URI
+func subscriptionIDAVP(uri string) *diameter.AVP {
+	idType, data := SubscriptionSIPURI, uri
+	if strings.HasPrefix(strings.ToLower(uri), "tel:") {
+		number, _, _ := strings.Cut(uri[len("tel:"):], ";")
+		idType, data = SubscriptionE164, strings.TrimPrefix(number, "+")
+	}
+	return diameter.Grouped(AVPSubscriptionID, 0,
+		diameter.Unsigned32(AVPSubscriptionIDType, 0, idType),
+		diameter.UTF8String(AVPSubscriptionIDData, 0, data),
+	)
+}
+
+// parseSubscriptionID decodes the first Subscription-Id as a URI
+func parseSubscriptionID(avps []*diameter.AVP) (string, error) {
+	a := diameter.FindAVP(avps, AVPSubscriptionID, 0)
+	if a == nil {
+		return "", nil
+	}
+	group, err := a.Grouped()
+	if err != nil {
+		return "", err
+	}
+	idType, err := diameter.RequireUint32(group, AVPSubscriptionIDType, 0, "Subscription-Id-Type")
+	if err != nil {
+		return "", err
+	}
+	data := diameter.FindAVP(group, AVPSubscriptionIDData, 0)
+	if data == nil {
+		return "", &diameter.MissingAVPError{Name: "Subscription-Id-Data"}
+	}
+	if idType == SubscriptionE164 {
+		return "tel:+" + data.String(), nil
+	}
+	return data.String(), nil
+}
+
+// serviceUnit encodes a service unit holding time, which may be empty
+func serviceUnit(code uint32, t time.Duration) *diameter.AVP {
+	if t <= 0 {
+		return diameter.Grouped(code, 0)
+	}
+	return diameter.Grouped(code, 0, diameter.Unsigned32(AVPCCTime, 0, uint32(t/time.Second)))
+}
+
+func (r *CCR) avps() []*diameter.AVP {
+	avps := []*diameter.AVP{
+		diameter.UTF8String(rf.AVPServiceContextID, 0, rf.ServiceContextIMS),
+		diameter.Unsigned32(AVPCCRequestType, 0, r.RequestType),
+		diameter.Unsigned32(AVPCCRequestNumber, 0, r.RequestNumber),
+	}
+	if !r.EventTimestamp.IsZero() {
+		avps = append(avps, diameter.Time(diameter.AVPEventTimestamp, 0, r.EventTimestamp))
+	}
+	if r.Subscriber != "" {
+		avps = append(avps, subscriptionIDAVP(r.Subscriber))
+	}
+	if r.RequestType == RequestTermination {
+		avps = append(avps, diameter.Unsigned32(diameter.AVPTerminationCause, 0, r.TerminationCause))
+	}
+
+	var mscc []*diameter.AVP
+	if r.RequestQuota {
+		mscc = append(mscc, serviceUnit(AVPRequestedServiceUnit, 0))
+	}
+	if r.RequestType == RequestUpdate || r.RequestType == RequestTermination {
+		mscc = append(mscc, serviceUnit(AVPUsedServiceUnit, r.UsedTime))
+	}
+	if len(mscc) > 0 {
+		avps = append(avps,
+			diameter.Unsigned32(AVPMultipleServicesIndicator, 0, 1),
+			diameter.Grouped(AVPMultipleServicesCreditControl, 0, mscc...),
+		)
+	}
+	if r.IMS != nil {
+		avps = append(avps, r.IMS.AVP())
+	}
+	return avps
+}
+
+func parseCCR(m *diameter.Message) (*CCR, error) {
+	r := &CCR{SessionID: m.SessionID()}
+	var err error
+	if r.RequestType, err = diameter.RequireUint32(m.AVPs, AVPCCRequestType, 0, "CC-Request-Type"); err != nil {
+		return nil, err
+	}
+	if r.RequestType < RequestInitial || r.RequestType > RequestEvent {
+		return nil, fmt.Errorf("invalid CC-Request-Type %d", r.RequestType)
+	}
+	if r.RequestNumber, err = diameter.RequireUint32(m.AVPs, AVPCCRequestNumber, 0, "CC-Request-Number"); err != nil {
+		return nil, err
+	}
+	if a := m.Find(diameter.AVPEventTimestamp, 0); a != nil {
+		if r.EventTimestamp, err = a.Time(); err != nil {
+			return nil, err
+		}
+	}
+	if r.Subscriber, err = parseSubscriptionID(m.AVPs); err != nil {
+		return nil, err
+	}
+	if r.TerminationCause, _, err = diameter.FindUint32(m.AVPs, diameter.AVPTerminationCause, 0); err != nil {
+		return nil, err
+	}
+	if a := m.Find(AVPMultipleServicesCreditControl, 0); a != nil {
+		mscc, err := a.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		r.RequestQuota = diameter.FindAVP(mscc, AVPRequestedServiceUnit, 0) != nil
+		if used := diameter.FindAVP(mscc, AVPUsedServiceUnit, 0); used != nil {
+			units, err := used.Grouped()
+			if err != nil {
+				return nil, err
+			}
+			if r.UsedTime, err = findSeconds(units, AVPCCTime); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r.IMS, err = rf.ParseServiceInformation(m.AVPs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// avps encodes the grant of the answer
+func (a *CCA) avps() []*diameter.AVP {
+	if a.GrantedTime <= 0 && !a.FinalUnit {
+		return nil
+	}
+	mscc := []*diameter.AVP{serviceUnit(AVPGrantedServiceUnit, a.GrantedTime)}
+	if a.ValidityTime > 0 {
+		mscc = append(mscc, diameter.Unsigned32(AVPValidityTime, 0, uint32(a.ValidityTime/time.Second)))
+	}
+	if a.FinalUnit {
+		mscc = append(mscc, diameter.Grouped(AVPFinalUnitIndication, 0,
+			diameter.Unsigned32(AVPFinalUnitAction, 0, FinalUnitTerminate),
+		))
+	}
+	return []*diameter.AVP{diameter.Grouped(AVPMultipleServicesCreditControl, 0, mscc...)}
+}
+
+func parseCCA(m *diameter.Message) (*CCA, error) {
+	result, err := m.Result()
+	if err != nil {
+		return nil, err
+	}
+	a := &CCA{SessionID: m.SessionID(), Result: result}
+	if a.RequestType, _, err = diameter.FindUint32(m.AVPs, AVPCCRequestType, 0); err != nil {
+		return nil, err
+	}
+	if a.RequestNumber, _, err = diameter.FindUint32(m.AVPs, AVPCCRequestNumber, 0); err != nil {
+		return nil, err
+	}
+	msccAVP := m.Find(AVPMultipleServicesCreditControl, 0)
+	if msccAVP == nil {
+		return a, nil
+	}
+	mscc, err := msccAVP.Grouped()
+	if err != nil {
+		return nil, err
+	}
+	if granted := diameter.FindAVP(mscc, AVPGrantedServiceUnit, 0); granted != nil {
+		units, err := granted.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		if a.GrantedTime, err = findSeconds(units, AVPCCTime); err != nil {
+			return nil, err
+		}
+	}
+	if a.ValidityTime, err = findSeconds(mscc, AVPValidityTime); err != nil {
+		return nil, err
+	}
+	if fui := diameter.FindAVP(mscc, AVPFinalUnitIndication, 0); fui != nil {
+		group, err := fui.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		action, err := diameter.RequireUint32(group, AVPFinalUnitAction, 0, "Final-Unit-Action")
+		if err != nil {
+			return nil, err
+		}
+		a.FinalUnit = action == FinalUnitTerminate
+	}
+	return a, nil
+}
@@ -0,0 +1,119 @@
+package ro
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rf"
+)
+
+// roundTrip encodes avps into a message and decodes it from the wire
+func roundTrip(t *testing.T, avps []*diameter.AVP) *diameter.Message {
+	t.Helper()
+	data, err := (&diameter.Message{CommandCode: CommandCreditControl, AppID: ApplicationID}).Add(avps...).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	m, err := diameter.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	return m
+}
+
+func TestCCR_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		ccr  *CCR
+	}{
+		{
+			name: "initial",
+			ccr: &CCR{
+				RequestType:    RequestInitial,
+				Subscriber:     "sip:alice@ims.test",
+				EventTimestamp: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+				RequestQuota:   true,
+				IMS:            &rf.IMSInformation{NodeFunctionality: rf.NodeSCSCF, SIPMethod: "INVITE", ICID: "ab12"},
+			},
+		},
+		{
+			name: "update",
+			ccr:  &CCR{RequestType: RequestUpdate, RequestNumber: 1, Subscriber: "tel:+15145550001", RequestQuota: true, UsedTime: 60 * time.Second},
+		},
+		{
+			name: "termination",
+			ccr:  &CCR{RequestType: RequestTermination, RequestNumber: 2, UsedTime: 12 * time.Second, TerminationCause: diameter.TerminationLogout},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCCR(roundTrip(t, tt.ccr.avps()))
+			if err != nil {
+				t.Fatalf("parseCCR() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.ccr) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.ccr)
+			}
+		})
+	}
+}
+
+func TestCCA_RoundTrip(t *testing.T) {
+	tests := []*CCA{
+		{Result: Success, GrantedTime: 60 * time.Second, ValidityTime: 120 * time.Second},
+		{Result: Success, GrantedTime: 30 * time.Second, FinalUnit: true},
+		{Result: diameter.Result{Code: ResultCreditLimitReached}},
+	}
+	for _, want := range tests {
+		m := roundTrip(t, append([]*diameter.AVP{
+			diameter.Unsigned32(diameter.AVPResultCode, 0, want.Result.Code),
+			diameter.Unsigned32(AVPCCRequestType, 0, RequestUpdate),
+			diameter.Unsigned32(AVPCCRequestNumber, 0, 1),
+		}, want.avps()...))
+		got, err := parseCCA(m)
+		if err != nil {
+			t.Fatalf("parseCCA() error = %v", err)
+		}
+		want.RequestType, want.RequestNumber = RequestUpdate, 1
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestParseCCR_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		avps []*diameter.AVP
+	}{
+		{
+			name: "without request number",
+			avps: []*diameter.AVP{diameter.Unsigned32(AVPCCRequestType, 0, RequestInitial)},
+		},
+		{
+			name: "unknown request type",
+			avps: []*diameter.AVP{
+				diameter.Unsigned32(AVPCCRequestType, 0, 9),
+				diameter.Unsigned32(AVPCCRequestNumber, 0, 0),
+			},
+		},
+		{
+			name: "subscription id without data",
+			avps: []*diameter.AVP{
+				diameter.Unsigned32(AVPCCRequestType, 0, RequestInitial),
+				diameter.Unsigned32(AVPCCRequestNumber, 0, 0),
+				diameter.Grouped(AVPSubscriptionID, 0, diameter.Unsigned32(AVPSubscriptionIDType, 0, SubscriptionE164)),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCCR(roundTrip(t, tt.avps)); err == nil {
+				t.Error("parseCCR() accepted the request")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package rx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// Client sends Rx requests over a peer connection. The AF sends AAR/STR to
+// the PCRF; the PCRF sends ASR/RAR to the AF. Answers with a failure result
+// are returned without an error; callers check the answer's Result.
+type Client struct {
+	peer *diameter.Peer
+}
+
+// NewClient creates an Rx client on an open peer
+func NewClient(peer *diameter.Peer) *Client {
+	return &Client{peer: peer}
+}
+
+// Peer returns the underlying peer connection
+func (c *Client) Peer() *diameter.Peer {
+	return c.peer
+}
+
+// request sends an Rx request with the common session AVPs and returns the answer
+func (c *Client) request(ctx context.Context, command uint32, sessionID, destinationHost string, avps []*diameter.AVP) (*diameter.Message, error) {
+	if sessionID == "" {
+		sessionID = c.peer.NewSessionID()
+	}
+	m := c.peer.NewRequest(command, ApplicationID, sessionID,
+		diameter.Unsigned32(diameter.AVPAuthApplicationID, 0, ApplicationID),
+	)
+	if destinationHost != "" {
+		m.Add(diameter.UTF8String(diameter.AVPDestinationHost, 0, destinationHost))
+	}
+	m.Add(diameter.UTF8String(diameter.AVPDestinationRealm, 0, c.peer.RemoteRealm()))
+	m.Add(avps...)
+
+	answer, err := c.peer.Request(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if answer.CommandCode != command {
+		return nil, fmt.Errorf("unexpected answer command %d to request %d", answer.CommandCode, command)
+	}
+	return answer, nil
+}
+
+// AA sends an AAR. A new session is created when req.SessionID is empty;
+// its id is returned in the answer.
+func (c *Client) AA(ctx context.Context, req *AAR) (*AAA, error) {
+	answer, err := c.request(ctx, CommandAA, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &AAA{SessionID: answer.SessionID(), Result: result}, nil
+}
+
+// SessionTermination sends a STR
+func (c *Client) SessionTermination(ctx context.Context, req *STR) (*STA, error) {
+	answer, err := c.request(ctx, diameter.CommandSessionTermination, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &STA{Result: result}, nil
+}
+
+// AbortSession sends an ASR
+func (c *Client) AbortSession(ctx context.Context, req *ASR) (*ASA, error) {
+	answer, err := c.request(ctx, diameter.CommandAbortSession, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &ASA{Result: result}, nil
+}
+
+// ReAuth sends a RAR
+func (c *Client) ReAuth(ctx context.Context, req *RAR) (*RAA, error) {
+	answer, err := c.request(ctx, diameter.CommandReAuth, req.SessionID, req.DestinationHost, req.avps())
+	if err != nil {
+		return nil, err
+	}
+	result, err := answer.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &RAA{Result: result}, nil
+}
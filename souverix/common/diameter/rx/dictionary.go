@@ -0,0 +1,133 @@
+// Package rx implements the 3GPP Rx Diameter application (TS 29.214)
+// between the P-CSCF, acting as application function, and the PCRF.
+package rx
+
+import "github.com/dasmlab/souverix/common/diameter"
+
+const (
+	// ApplicationID is the Rx Diameter application id
+	ApplicationID uint32 = 16777236
+
+	// Vendor3GPP is the 3GPP vendor id used by Rx AVPs and experimental results
+	Vendor3GPP uint32 = 10415
+)
+
+// Application is the Rx application advertised in the capabilities exchange
+var Application = diameter.Application{ID: ApplicationID, VendorID: Vendor3GPP}
+
+// CommandAA is the AA command of NASREQ (RFC 7155) reused by Rx. Rx also
+// uses the base protocol Session-Termination, Abort-Session and Re-Auth
+// commands.
+const CommandAA uint32 = 265
+
+// Base protocol and NASREQ AVP codes used by Rx
+const (
+	AVPFramedIPAddress    uint32 = 8
+	AVPFramedIPv6Prefix   uint32 = 97
+	AVPSubscriptionID     uint32 = 443
+	AVPSubscriptionIDData uint32 = 444
+	AVPSubscriptionIDType uint32 = 450
+)
+
+// Rx AVP codes (TS 29.214 section 5.3), vendor 10415
+const (
+	AVPAbortCause                uint32 = 500
+	AVPAFApplicationIdentifier   uint32 = 504
+	AVPAFChargingIdentifier      uint32 = 505
+	AVPFlowDescription           uint32 = 507
+	AVPFlowNumber                uint32 = 509
+	AVPFlowStatus                uint32 = 511
+	AVPFlowUsage                 uint32 = 512
+	AVPSpecificAction            uint32 = 513
+	AVPMaxRequestedBandwidthDL   uint32 = 515
+	AVPMaxRequestedBandwidthUL   uint32 = 516
+	AVPMediaComponentDescription uint32 = 517
+	AVPMediaComponentNumber      uint32 = 518
+	AVPMediaSubComponent         uint32 = 519
+	AVPMediaType                 uint32 = 520
+	AVPCodecData                 uint32 = 524
+	AVPServiceURN                uint32 = 525
+	AVPRxRequestType             uint32 = 533
+)
+
+// Experimental-Result-Code values (TS 29.214 section 5.5)
+const (
+	ResultInvalidServiceInformation        uint32 = 5061
+	ResultFilterRestrictions               uint32 = 5062
+	ResultRequestedServiceNotAuthorized    uint32 = 5063
+	ResultDuplicatedAFSession              uint32 = 5064
+	ResultIPCANSessionNotAvailable         uint32 = 5065
+	ResultUnauthorizedNonEmergencySession  uint32 = 5066
+	ResultUnauthorizedSponsoredDataConnect uint32 = 5067
+	ResultTemporaryNetworkFailure          uint32 = 5068
+)
+
+// Media-Type values
+const (
+	MediaAudio       uint32 = 0
+	MediaVideo       uint32 = 1
+	MediaData        uint32 = 2
+	MediaApplication uint32 = 3
+	MediaControl     uint32 = 4
+	MediaText        uint32 = 5
+	MediaMessage     uint32 = 6
+	MediaOther       uint32 = 0xffffffff
+)
+
+// Flow-Status values
+const (
+	FlowEnabledUplink   uint32 = 0
+	FlowEnabledDownlink uint32 = 1
+	FlowEnabled         uint32 = 2
+	FlowDisabled        uint32 = 3
+	FlowRemoved         uint32 = 4
+)
+
+// Flow-Usage values
+const (
+	UsageNoInformation uint32 = 0
+	UsageRTCP          uint32 = 1
+	UsageAFSignalling  uint32 = 2
+)
+
+// Specific-Action values
+const (
+	ActionChargingCorrelationExchange         uint32 = 1
+	ActionIndicationOfLossOfBearer            uint32 = 2
+	ActionIndicationOfRecoveryOfBearer        uint32 = 3
+	ActionIndicationOfReleaseOfBearer         uint32 = 4
+	ActionIndicationOfIPCANChange             uint32 = 6
+	ActionIndicationOfOutOfCredit             uint32 = 7
+	ActionIndicationOfSuccessfulResources     uint32 = 8
+	ActionIndicationOfFailedResourcesAllocate uint32 = 9
+)
+
+// Abort-Cause values
+const (
+	AbortBearerReleased              uint32 = 0
+	AbortInsufficientServerResources uint32 = 1
+	AbortInsufficientBearerResources uint32 = 2
+)
+
+// Rx-Request-Type values
+const (
+	RequestInitial uint32 = 0
+	RequestUpdate  uint32 = 1
+)
+
+// Subscription-Id-Type values
+const (
+	SubscriptionE164    uint32 = 0
+	SubscriptionIMSI    uint32 = 1
+	SubscriptionSIPURI  uint32 = 2
+	SubscriptionNAI     uint32 = 3
+	SubscriptionPrivate uint32 = 4
+)
+
+// Experimental returns a 3GPP Experimental-Result
+func Experimental(code uint32) diameter.Result {
+	return diameter.Result{Code: code, VendorID: Vendor3GPP}
+}
+
+// Success is the DIAMETER_SUCCESS result
+var Success = diameter.Result{Code: diameter.ResultSuccess}
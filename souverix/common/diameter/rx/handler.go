@@ -0,0 +1,75 @@
+package rx
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// PCRF answers the Rx requests sent by the AF
+type PCRF interface {
+	AA(ctx context.Context, req *AAR) *AAA
+	SessionTermination(ctx context.Context, req *STR) *STA
+}
+
+// AF answers the Rx requests sent by the PCRF
+type AF interface {
+	AbortSession(ctx context.Context, req *ASR) *ASA
+	ReAuth(ctx context.Context, req *RAR) *RAA
+}
+
+// Handler dispatches received Rx requests. Requests for a side that is not
+// set are rejected with DIAMETER_COMMAND_UNSUPPORTED.
+type Handler struct {
+	PCRF PCRF
+	AF   AF
+}
+
+// ServeDiameter implements diameter.Handler
+func (h *Handler) ServeDiameter(p *diameter.Peer, req *diameter.Message) *diameter.Message {
+	ctx := context.Background()
+
+	var result diameter.Result
+	var err error
+
+	switch {
+	case req.CommandCode == CommandAA && h.PCRF != nil:
+		var r *AAR
+		if r, err = parseAAR(req); err == nil {
+			result = h.PCRF.AA(ctx, r).Result
+		}
+	case req.CommandCode == diameter.CommandSessionTermination && h.PCRF != nil:
+		var r *STR
+		if r, err = parseSTR(req); err == nil {
+			result = h.PCRF.SessionTermination(ctx, r).Result
+		}
+	case req.CommandCode == diameter.CommandAbortSession && h.AF != nil:
+		var r *ASR
+		if r, err = parseASR(req); err == nil {
+			result = h.AF.AbortSession(ctx, r).Result
+		}
+	case req.CommandCode == diameter.CommandReAuth && h.AF != nil:
+		var r *RAR
+		if r, err = parseRAR(req); err == nil {
+			result = h.AF.ReAuth(ctx, r).Result
+		}
+	default:
+		result = diameter.Result{Code: diameter.ResultCommandUnsupported}
+	}
+
+	if err != nil {
+		var missing *diameter.MissingAVPError
+		if errors.As(err, &missing) {
+			result = diameter.Result{Code: diameter.ResultMissingAVP}
+		} else {
+			result = diameter.Result{Code: diameter.ResultInvalidAVPValue}
+		}
+	}
+
+	answer := p.NewAnswer(req, result)
+	if req.CommandCode == CommandAA {
+		answer.Add(diameter.Unsigned32(diameter.AVPAuthApplicationID, 0, ApplicationID))
+	}
+	return answer
+}
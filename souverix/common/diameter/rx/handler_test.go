@@ -0,0 +1,166 @@
+package rx
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/sirupsen/logrus"
+)
+
+// fakePCRF authorizes sessions for the UE it knows and records the requests
+type fakePCRF struct {
+	aar *AAR
+	str *STR
+}
+
+func (f *fakePCRF) AA(ctx context.Context, req *AAR) *AAA {
+	f.aar = req
+	if req.RequestType == RequestInitial && !req.UEAddress.Equal(net.ParseIP("10.0.0.2")) {
+		return &AAA{Result: Experimental(ResultIPCANSessionNotAvailable)}
+	}
+	return &AAA{Result: Success}
+}
+
+func (f *fakePCRF) SessionTermination(ctx context.Context, req *STR) *STA {
+	f.str = req
+	return &STA{Result: Success}
+}
+
+// fakeAF answers ASR and RAR
+type fakeAF struct {
+	asr *ASR
+	rar *RAR
+}
+
+func (f *fakeAF) AbortSession(ctx context.Context, req *ASR) *ASA {
+	f.asr = req
+	return &ASA{Result: Success}
+}
+
+func (f *fakeAF) ReAuth(ctx context.Context, req *RAR) *RAA {
+	f.rar = req
+	return &RAA{Result: Success}
+}
+
+func rxConfig(host string, handler diameter.Handler) *diameter.Config {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return &diameter.Config{
+		OriginHost:   host,
+		OriginRealm:  "ims.test",
+		VendorID:     Vendor3GPP,
+		Applications: []diameter.Application{Application},
+		Handler:      handler,
+		Log:          log,
+	}
+}
+
+// connectRx connects a P-CSCF to a PCRF and returns a client on each side
+func connectRx(t *testing.T, pcrf PCRF, af AF) (fromAF, fromPCRF *Client) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := diameter.NewServer(rxConfig("pcrf.ims.test", &Handler{PCRF: pcrf}))
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+
+	peer, err := diameter.Dial(context.Background(), "tcp", l.Addr().String(), rxConfig("pcscf.ims.test", &Handler{AF: af}))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Peer("pcscf.ims.test") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("P-CSCF peer not registered on the server")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return NewClient(peer), NewClient(server.Peer("pcscf.ims.test"))
+}
+
+func TestClient_AFRequests(t *testing.T) {
+	pcrf := &fakePCRF{}
+	client, _ := connectRx(t, pcrf, &fakeAF{})
+	ctx := context.Background()
+
+	aaa, err := client.AA(ctx, &AAR{
+		UEAddress:       net.ParseIP("10.0.0.2"),
+		AFApplicationID: "IMS Services",
+		MediaComponents: []MediaComponent{{Number: 1, MediaType: MediaAudio, FlowStatus: FlowEnabled}},
+	})
+	if err != nil || aaa.Result != Success || aaa.SessionID == "" {
+		t.Fatalf("AA() = %+v, %v", aaa, err)
+	}
+	if pcrf.aar == nil || pcrf.aar.SessionID != aaa.SessionID || len(pcrf.aar.MediaComponents) != 1 {
+		t.Errorf("PCRF received AAR %+v", pcrf.aar)
+	}
+
+	// The session is updated and terminated with the id of the first AAR
+	aaa, err = client.AA(ctx, &AAR{SessionID: aaa.SessionID, RequestType: RequestUpdate})
+	if err != nil || aaa.Result != Success || pcrf.aar.SessionID != aaa.SessionID {
+		t.Errorf("AA() update = %+v, %v", aaa, err)
+	}
+	sta, err := client.SessionTermination(ctx, &STR{SessionID: aaa.SessionID, TerminationCause: diameter.TerminationLogout})
+	if err != nil || sta.Result != Success {
+		t.Fatalf("SessionTermination() = %+v, %v", sta, err)
+	}
+	if pcrf.str == nil || pcrf.str.SessionID != aaa.SessionID || pcrf.str.TerminationCause != diameter.TerminationLogout {
+		t.Errorf("PCRF received STR %+v", pcrf.str)
+	}
+
+	aaa, err = client.AA(ctx, &AAR{UEAddress: net.ParseIP("10.9.9.9")})
+	if err != nil || aaa.Result != Experimental(ResultIPCANSessionNotAvailable) {
+		t.Errorf("AA() for an unknown UE = %+v, %v", aaa, err)
+	}
+}
+
+func TestClient_PCRFRequests(t *testing.T) {
+	af := &fakeAF{}
+	_, fromPCRF := connectRx(t, &fakePCRF{}, af)
+	ctx := context.Background()
+
+	asa, err := fromPCRF.AbortSession(ctx, &ASR{SessionID: "pcscf.ims.test;1;1", AbortCause: AbortBearerReleased})
+	if err != nil || asa.Result != Success {
+		t.Fatalf("AbortSession() = %+v, %v", asa, err)
+	}
+	if af.asr == nil || af.asr.SessionID != "pcscf.ims.test;1;1" || af.asr.AbortCause != AbortBearerReleased {
+		t.Errorf("AF received ASR %+v", af.asr)
+	}
+
+	raa, err := fromPCRF.ReAuth(ctx, &RAR{SessionID: "pcscf.ims.test;1;1", SpecificActions: []uint32{ActionIndicationOfLossOfBearer}})
+	if err != nil || raa.Result != Success {
+		t.Fatalf("ReAuth() = %+v, %v", raa, err)
+	}
+	if af.rar == nil || len(af.rar.SpecificActions) != 1 || af.rar.SpecificActions[0] != ActionIndicationOfLossOfBearer {
+		t.Errorf("AF received RAR %+v", af.rar)
+	}
+}
+
+func TestHandler_Rejections(t *testing.T) {
+	// The AF side does not answer PCRF commands
+	fromAF, fromPCRF := connectRx(t, &fakePCRF{}, nil)
+	ctx := context.Background()
+
+	asa, err := fromPCRF.AbortSession(ctx, &ASR{SessionID: "pcscf.ims.test;1;1"})
+	if err != nil {
+		t.Fatalf("AbortSession() error = %v", err)
+	}
+	if asa.Result.Code != diameter.ResultCommandUnsupported {
+		t.Errorf("ASA Result = %+v, want DIAMETER_COMMAND_UNSUPPORTED", asa.Result)
+	}
+
+	// An initial AAR without the UE address is rejected with DIAMETER_MISSING_AVP
+	aaa, err := fromAF.AA(ctx, &AAR{RequestType: RequestInitial})
+	if err != nil {
+		t.Fatalf("AA() error = %v", err)
+	}
+	if aaa.Result.Code != diameter.ResultMissingAVP {
+		t.Errorf("Result = %+v, want DIAMETER_MISSING_AVP", aaa.Result)
+	}
+}
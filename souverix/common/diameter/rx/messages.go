@@ -0,0 +1,338 @@
+package rx
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// MediaSubComponent is one IP flow of a media component, such as the RTP
+// or the RTCP flow of an audio stream
+type MediaSubComponent struct {
+	FlowNumber uint32
+
+	// FlowDescriptions are IPFilterRules (RFC 6733 section 4.3): "permit out"
+	// for the downlink and "permit in" for the uplink direction
+	FlowDescriptions []string
+	FlowUsage        uint32
+}
+
+// MediaComponent describes one media line of the session (TS 29.214
+// section 5.3.19). Bandwidths are in bits per second; zero leaves them out.
+type MediaComponent struct {
+	Number                  uint32
+	MediaType               uint32
+	FlowStatus              uint32
+	MaxRequestedBandwidthUL uint32
+	MaxRequestedBandwidthDL uint32
+	CodecData               []string
+	SubComponents           []MediaSubComponent
+}
+
+// AAR is an AA-Request sent by the AF to create or modify the policy of a
+// session. The session is bound to the IP-CAN session of UEAddress.
+type AAR struct {
+	SessionID       string
+	DestinationHost string
+	RequestType     uint32
+	AFApplicationID string
+	MediaComponents []MediaComponent
+	UEAddress       net.IP
+	SubscriptionID  string // SIP URI of the served user
+	ServiceURN      string // Set for emergency sessions
+	SpecificActions []uint32
+}
+
+// AAA is an AA-Answer. SessionID is that of the answered request, which
+// the AF reuses to update and terminate the session.
+type AAA struct {
+	SessionID string
+	Result    diameter.Result
+}
+
+// STR is a Session-Termination-Request sent by the AF when the session ends
+type STR struct {
+	SessionID        string
+	DestinationHost  string
+	TerminationCause uint32
+}
+
+// STA is a Session-Termination-Answer
+type STA struct {
+	Result diameter.Result
+}
+
+// ASR is an Abort-Session-Request sent by the PCRF when the session can no
+// longer be served, for example after the loss of the bearer
+type ASR struct {
+	SessionID       string
+	DestinationHost string
+	AbortCause      uint32
+}
+
+// ASA is an Abort-Session-Answer
+type ASA struct {
+	Result diameter.Result
+}
+
+// RAR is a Re-Auth-Request sent by the PCRF to report the events the AF
+// subscribed to with Specific-Action
+type RAR struct {
+	SessionID       string
+	DestinationHost string
+	SpecificActions []uint32
+	AbortCause      uint32
+	HasAbortCause   bool
+}
+
+// RAA is a Re-Auth-Answer
+type RAA struct {
+	Result diameter.Result
+}
+
+func uint3GPP(code uint32, value uint32) *diameter.AVP {
+	return diameter.Unsigned32(code, Vendor3GPP, value)
+}
+
+// findUint32s decodes every Unsigned32 or Enumerated AVP with the given code
+func findUint32s(avps []*diameter.AVP, code, vendorID uint32) ([]uint32, error) {
+	var values []uint32
+	for _, a := range diameter.FindAVPs(avps, code, vendorID) {
+		v, err := a.Uint32()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// findStrings returns the values of every AVP with the given code
+func findStrings(avps []*diameter.AVP, code, vendorID uint32) []string {
+	var values []string
+	for _, a := range diameter.FindAVPs(avps, code, vendorID) {
+		values = append(values, a.String())
+	}
+	return values
+}
+
+// ueAddressAVP encodes the UE address as Framed-IP-Address, or for IPv6 as
+// the /64 Framed-IPv6-Prefix the UE address belongs to
+func ueAddressAVP(ip net.IP) *diameter.AVP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return diameter.OctetString(AVPFramedIPAddress, 0, ip4)
+	}
+	prefix := append([]byte{0, 64}, ip.To16()[:8]...)
+	return diameter.OctetString(AVPFramedIPv6Prefix, 0, prefix)
+}
+
+// parseUEAddress decodes Framed-IP-Address or Framed-IPv6-Prefix; the
+// prefix is returned as the address of its first host
+func parseUEAddress(avps []*diameter.AVP) (net.IP, error) {
+	if a := diameter.FindAVP(avps, AVPFramedIPAddress, 0); a != nil {
+		if len(a.Data) != net.IPv4len {
+			return nil, fmt.Errorf("invalid Framed-IP-Address length %d", len(a.Data))
+		}
+		return net.IP(append([]byte(nil), a.Data...)), nil
+	}
+	if a := diameter.FindAVP(avps, AVPFramedIPv6Prefix, 0); a != nil {
+		if len(a.Data) < 2 || int(a.Data[1]) > 128 || len(a.Data)-2 < (int(a.Data[1])+7)/8 {
+			return nil, fmt.Errorf("invalid Framed-IPv6-Prefix")
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, a.Data[2:])
+		return ip, nil
+	}
+	return nil, nil
+}
+
+func (c *MediaComponent) avp() *diameter.AVP {
+	avps := []*diameter.AVP{
+		uint3GPP(AVPMediaComponentNumber, c.Number),
+		uint3GPP(AVPMediaType, c.MediaType),
+		uint3GPP(AVPFlowStatus, c.FlowStatus),
+	}
+	if c.MaxRequestedBandwidthUL > 0 {
+		avps = append(avps, uint3GPP(AVPMaxRequestedBandwidthUL, c.MaxRequestedBandwidthUL))
+	}
+	if c.MaxRequestedBandwidthDL > 0 {
+		avps = append(avps, uint3GPP(AVPMaxRequestedBandwidthDL, c.MaxRequestedBandwidthDL))
+	}
+	for _, codec := range c.CodecData {
+		avps = append(avps, diameter.OctetString(AVPCodecData, Vendor3GPP, []byte(codec)))
+	}
+	for _, sub := range c.SubComponents {
+		flow := []*diameter.AVP{uint3GPP(AVPFlowNumber, sub.FlowNumber)}
+		for _, description := range sub.FlowDescriptions {
+			flow = append(flow, diameter.OctetString(AVPFlowDescription, Vendor3GPP, []byte(description)))
+		}
+		flow = append(flow, uint3GPP(AVPFlowUsage, sub.FlowUsage))
+		avps = append(avps, diameter.Grouped(AVPMediaSubComponent, Vendor3GPP, flow...))
+	}
+	return diameter.Grouped(AVPMediaComponentDescription, Vendor3GPP, avps...)
+}
+
+func parseMediaComponent(a *diameter.AVP) (MediaComponent, error) {
+	var c MediaComponent
+	group, err := a.Grouped()
+	if err != nil {
+		return c, err
+	}
+	if c.Number, err = diameter.RequireUint32(group, AVPMediaComponentNumber, Vendor3GPP, "Media-Component-Number"); err != nil {
+		return c, err
+	}
+	if c.MediaType, _, err = diameter.FindUint32(group, AVPMediaType, Vendor3GPP); err != nil {
+		return c, err
+	}
+	var ok bool
+	if c.FlowStatus, ok, err = diameter.FindUint32(group, AVPFlowStatus, Vendor3GPP); err != nil {
+		return c, err
+	} else if !ok {
+		c.FlowStatus = FlowEnabled
+	}
+	if c.MaxRequestedBandwidthUL, _, err = diameter.FindUint32(group, AVPMaxRequestedBandwidthUL, Vendor3GPP); err != nil {
+		return c, err
+	}
+	if c.MaxRequestedBandwidthDL, _, err = diameter.FindUint32(group, AVPMaxRequestedBandwidthDL, Vendor3GPP); err != nil {
+		return c, err
+	}
+	c.CodecData = findStrings(group, AVPCodecData, Vendor3GPP)
+
+	for _, s := range diameter.FindAVPs(group, AVPMediaSubComponent, Vendor3GPP) {
+		flow, err := s.Grouped()
+		if err != nil {
+			return c, err
+		}
+		var sub MediaSubComponent
+		if sub.FlowNumber, err = diameter.RequireUint32(flow, AVPFlowNumber, Vendor3GPP, "Flow-Number"); err != nil {
+			return c, err
+		}
+		sub.FlowDescriptions = findStrings(flow, AVPFlowDescription, Vendor3GPP)
+		if sub.FlowUsage, _, err = diameter.FindUint32(flow, AVPFlowUsage, Vendor3GPP); err != nil {
+			return c, err
+		}
+		c.SubComponents = append(c.SubComponents, sub)
+	}
+	return c, nil
+}
+
+func (r *AAR) avps() []*diameter.AVP {
+	avps := []*diameter.AVP{uint3GPP(AVPRxRequestType, r.RequestType)}
+	if r.AFApplicationID != "" {
+		avps = append(avps, diameter.OctetString(AVPAFApplicationIdentifier, Vendor3GPP, []byte(r.AFApplicationID)))
+	}
+	for i := range r.MediaComponents {
+		avps = append(avps, r.MediaComponents[i].avp())
+	}
+	if r.ServiceURN != "" {
+		avps = append(avps, diameter.OctetString(AVPServiceURN, Vendor3GPP, []byte(r.ServiceURN)))
+	}
+	if r.SubscriptionID != "" {
+		avps = append(avps, diameter.Grouped(AVPSubscriptionID, 0,
+			diameter.Unsigned32(AVPSubscriptionIDType, 0, SubscriptionSIPURI),
+			diameter.UTF8String(AVPSubscriptionIDData, 0, r.SubscriptionID),
+		))
+	}
+	for _, action := range r.SpecificActions {
+		avps = append(avps, uint3GPP(AVPSpecificAction, action))
+	}
+	if r.UEAddress != nil {
+		avps = append(avps, ueAddressAVP(r.UEAddress))
+	}
+	return avps
+}
+
+func parseAAR(m *diameter.Message) (*AAR, error) {
+	r := &AAR{SessionID: m.SessionID()}
+	var err error
+	if r.RequestType, _, err = diameter.FindUint32(m.AVPs, AVPRxRequestType, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	if a := m.Find(AVPAFApplicationIdentifier, Vendor3GPP); a != nil {
+		r.AFApplicationID = a.String()
+	}
+	for _, a := range m.FindAll(AVPMediaComponentDescription, Vendor3GPP) {
+		c, err := parseMediaComponent(a)
+		if err != nil {
+			return nil, err
+		}
+		r.MediaComponents = append(r.MediaComponents, c)
+	}
+	if a := m.Find(AVPServiceURN, Vendor3GPP); a != nil {
+		r.ServiceURN = a.String()
+	}
+	for _, a := range m.FindAll(AVPSubscriptionID, 0) {
+		group, err := a.Grouped()
+		if err != nil {
+			return nil, err
+		}
+		if t, _, err := diameter.FindUint32(group, AVPSubscriptionIDType, 0); err == nil && t == SubscriptionSIPURI {
+			if data := diameter.FindAVP(group, AVPSubscriptionIDData, 0); data != nil {
+				r.SubscriptionID = data.String()
+			}
+		}
+	}
+	if r.SpecificActions, err = findUint32s(m.AVPs, AVPSpecificAction, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	if r.UEAddress, err = parseUEAddress(m.AVPs); err != nil {
+		return nil, err
+	}
+	if r.RequestType == RequestInitial && r.UEAddress == nil {
+		return nil, &diameter.MissingAVPError{Name: "Framed-IP-Address"}
+	}
+	return r, nil
+}
+
+func (r *STR) avps() []*diameter.AVP {
+	return []*diameter.AVP{diameter.Unsigned32(diameter.AVPTerminationCause, 0, r.TerminationCause)}
+}
+
+func parseSTR(m *diameter.Message) (*STR, error) {
+	r := &STR{SessionID: m.SessionID()}
+	var err error
+	if r.TerminationCause, err = diameter.RequireUint32(m.AVPs, diameter.AVPTerminationCause, 0, "Termination-Cause"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ASR) avps() []*diameter.AVP {
+	return []*diameter.AVP{uint3GPP(AVPAbortCause, r.AbortCause)}
+}
+
+func parseASR(m *diameter.Message) (*ASR, error) {
+	r := &ASR{SessionID: m.SessionID()}
+	var err error
+	if r.AbortCause, err = diameter.RequireUint32(m.AVPs, AVPAbortCause, Vendor3GPP, "Abort-Cause"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RAR) avps() []*diameter.AVP {
+	avps := []*diameter.AVP{diameter.Unsigned32(diameter.AVPReAuthRequestType, 0, diameter.ReAuthAuthorizeOnly)}
+	for _, action := range r.SpecificActions {
+		avps = append(avps, uint3GPP(AVPSpecificAction, action))
+	}
+	if r.HasAbortCause {
+		avps = append(avps, uint3GPP(AVPAbortCause, r.AbortCause))
+	}
+	return avps
+}
+
+func parseRAR(m *diameter.Message) (*RAR, error) {
+	r := &RAR{SessionID: m.SessionID()}
+	var err error
+	if r.SpecificActions, err = findUint32s(m.AVPs, AVPSpecificAction, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	if len(r.SpecificActions) == 0 {
+		return nil, &diameter.MissingAVPError{Name: "Specific-Action"}
+	}
+	if r.AbortCause, r.HasAbortCause, err = diameter.FindUint32(m.AVPs, AVPAbortCause, Vendor3GPP); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
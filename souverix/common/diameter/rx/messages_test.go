@@ -0,0 +1,120 @@
+package rx
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/dasmlab/souverix/common/diameter"
+)
+
+// roundTrip encodes avps into a message and decodes it from the wire
+func roundTrip(t *testing.T, avps []*diameter.AVP) *diameter.Message {
+	t.Helper()
+	data, err := (&diameter.Message{CommandCode: CommandAA, AppID: ApplicationID}).Add(avps...).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	m, err := diameter.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	return m
+}
+
+func TestRequests_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   interface{ avps() []*diameter.AVP }
+		parse func(*diameter.Message) (interface{}, error)
+	}{
+		{
+			name: "AAR",
+			req: &AAR{
+				RequestType:     RequestInitial,
+				AFApplicationID: "IMS Services",
+				MediaComponents: []MediaComponent{{
+					Number:                  1,
+					MediaType:               MediaAudio,
+					FlowStatus:              FlowEnabled,
+					MaxRequestedBandwidthUL: 64000,
+					MaxRequestedBandwidthDL: 64000,
+					CodecData:               []string{"uplink\noffer\nm=audio 49170 RTP/AVP 96\na=rtpmap:96 AMR-WB/16000"},
+					SubComponents: []MediaSubComponent{
+						{FlowNumber: 1, FlowDescriptions: []string{
+							"permit out 17 from 198.51.100.1 50000 to 10.0.0.2 49170",
+							"permit in 17 from 10.0.0.2 49170 to 198.51.100.1 50000",
+						}},
+						{FlowNumber: 2, FlowUsage: UsageRTCP, FlowDescriptions: []string{
+							"permit out 17 from 198.51.100.1 50001 to 10.0.0.2 49171",
+							"permit in 17 from 10.0.0.2 49171 to 198.51.100.1 50001",
+						}},
+					},
+				}},
+				UEAddress:       net.ParseIP("10.0.0.2").To4(),
+				SubscriptionID:  "sip:alice@ims.test",
+				ServiceURN:      "sos",
+				SpecificActions: []uint32{ActionIndicationOfLossOfBearer, ActionIndicationOfReleaseOfBearer},
+			},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseAAR(m) },
+		},
+		{
+			name:  "AAR IPv6",
+			req:   &AAR{RequestType: RequestInitial, UEAddress: net.ParseIP("2001:db8:1:2::")},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseAAR(m) },
+		},
+		{
+			name:  "STR",
+			req:   &STR{TerminationCause: diameter.TerminationServiceNotProvided},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseSTR(m) },
+		},
+		{
+			name:  "ASR",
+			req:   &ASR{AbortCause: AbortInsufficientBearerResources},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseASR(m) },
+		},
+		{
+			name:  "RAR",
+			req:   &RAR{SpecificActions: []uint32{ActionIndicationOfReleaseOfBearer}, AbortCause: AbortBearerReleased, HasAbortCause: true},
+			parse: func(m *diameter.Message) (interface{}, error) { return parseRAR(m) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(roundTrip(t, tt.req.avps()))
+			if err != nil {
+				t.Fatalf("parse error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.req) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.req)
+			}
+		})
+	}
+}
+
+func TestParseAAR_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		avps []*diameter.AVP
+	}{
+		{
+			name: "bad Framed-IP-Address",
+			avps: []*diameter.AVP{diameter.OctetString(AVPFramedIPAddress, 0, []byte{10, 0, 0})},
+		},
+		{
+			name: "media component without number",
+			avps: []*diameter.AVP{
+				diameter.OctetString(AVPFramedIPAddress, 0, []byte{10, 0, 0, 2}),
+				diameter.Grouped(AVPMediaComponentDescription, Vendor3GPP, uint3GPP(AVPMediaType, MediaAudio)),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseAAR(roundTrip(t, tt.avps)); err == nil {
+				t.Error("parseAAR() accepted the request")
+			}
+		})
+	}
+}
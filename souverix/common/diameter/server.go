@@ -0,0 +1,147 @@
+package diameter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrServerClosed is returned by Server.Serve after Close
+var ErrServerClosed = errors.New("diameter server closed")
+
+// Server accepts peer connections and tracks open peers by Origin-Host
+type Server struct {
+	config *Config
+	log    *logrus.Logger
+
+	mu        sync.Mutex
+	peers     map[string]*Peer
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+// NewServer creates a server; accepted peers use config
+func NewServer(config *Config) *Server {
+	config = config.withDefaults()
+	return &Server{
+		config:    config,
+		log:       config.Log,
+		peers:     make(map[string]*Peer),
+		listeners: make(map[net.Listener]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves peers
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	s.log.Infof("diameter server listening on %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.accept(conn)
+	}
+}
+
+// accept runs the capabilities exchange and registers the peer
+func (s *Server) accept(conn net.Conn) {
+	p, err := Accept(conn, s.config)
+	if err != nil {
+		s.log.WithError(err).WithField("remote", conn.RemoteAddr().String()).Warn("diameter capabilities exchange failed")
+		return
+	}
+
+	host := p.RemoteHost()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		p.closeWithError(ErrServerClosed)
+		return
+	}
+	// A reconnecting peer replaces its previous connection
+	previous := s.peers[host]
+	s.peers[host] = p
+	s.mu.Unlock()
+	if previous != nil {
+		previous.closeWithError(ErrPeerClosed)
+	}
+
+	<-p.Done()
+	s.mu.Lock()
+	if s.peers[host] == p {
+		delete(s.peers, host)
+	}
+	s.mu.Unlock()
+}
+
+// Peer returns the open peer with the given Origin-Host, or nil
+func (s *Server) Peer(host string) *Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[host]
+}
+
+// Peers returns the open peers
+func (s *Server) Peers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Close stops the listeners and disconnects every peer with a DPR
+func (s *Server) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			p.Close(ctx)
+		}(p)
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,165 @@
+package enum
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Cache limits
+const (
+	// defaultCacheSize is the number of names a Cache keeps by default
+	defaultCacheSize = 10000
+
+	// expireInterval is how often Run removes the expired entries
+	expireInterval = time.Minute
+)
+
+// cacheEntry is the cached answer for a domain name
+type cacheEntry struct {
+	records []NAPTR // nil for a cached ErrNotFound
+	expires time.Time
+}
+
+// Cache is a Resolver keeping the answers of another for the TTL of their
+// records, bounded by a maximum. Names without records are cached for the
+// negative TTL; lookup failures are not cached. The number of names kept
+// is bounded too.
+type Cache struct {
+	resolver    Resolver
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	size        int
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry // key: domain name
+}
+
+// NewCache creates a cache of the answers of resolver
+func NewCache(resolver Resolver, maxTTL, negativeTTL time.Duration) *Cache {
+	return &Cache{
+		resolver:    resolver,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		size:        defaultCacheSize,
+		now:         time.Now,
+		entries:     make(map[string]*cacheEntry),
+	}
+}
+
+// SetSize sets the number of names the cache keeps
+func (c *Cache) SetSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+}
+
+// LookupNAPTR implements Resolver
+func (c *Cache) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	if ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		if entry.records == nil {
+			return nil, ErrNotFound
+		}
+		return append([]NAPTR(nil), entry.records...), nil
+	}
+	c.mu.Unlock()
+
+	records, err := c.resolver.LookupNAPTR(ctx, name)
+	var ttl time.Duration
+	switch {
+	case errors.Is(err, ErrNotFound):
+		records, ttl = nil, c.negativeTTL
+	case err != nil:
+		return nil, err
+	default:
+		ttl = c.maxTTL
+		for _, rec := range records {
+			if rec.TTL < ttl {
+				ttl = rec.TTL
+			}
+		}
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		c.store(name, &cacheEntry{records: append([]NAPTR(nil), records...), expires: now.Add(ttl)}, now)
+		c.mu.Unlock()
+	}
+	if records == nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// store caches entry under name; c.mu is held. A full cache drops its
+// expired entries, then those closest to expiry.
+func (c *Cache) store(name string, entry *cacheEntry, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= c.size {
+		c.expire(now)
+		for len(c.entries) >= c.size {
+			delete(c.entries, c.soonest())
+		}
+	}
+	c.entries[name] = entry
+}
+
+// soonest returns the name whose entry expires first; c.mu is held
+func (c *Cache) soonest() string {
+	var soonest string
+	var expires time.Time
+	for name, entry := range c.entries {
+		if soonest == "" || entry.expires.Before(expires) {
+			soonest, expires = name, entry.expires
+		}
+	}
+	return soonest
+}
+
+// Expire removes the expired entries
+func (c *Cache) Expire() {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+}
+
+// expire removes the entries expired at now; c.mu is held
+func (c *Cache) expire(now time.Time) {
+	for name, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// Run calls Expire every minute until ctx is done
+func (c *Cache) Run(ctx context.Context) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Expire()
+		}
+	}
+}
+
+// Len returns the number of cached names
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
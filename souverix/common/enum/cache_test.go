@@ -0,0 +1,123 @@
+package enum
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCache_LookupNAPTR(t *testing.T) {
+	ctx := context.Background()
+	r := NewFakeResolver()
+	r.AddSIP("15550001", DefaultSuffix, "sip:alice@ims.example.com")
+	c := NewCache(r, time.Hour, 30*time.Second)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	name := Domain("15550001", DefaultSuffix)
+	for i := 0; i < 3; i++ {
+		if records, err := c.LookupNAPTR(ctx, name); err != nil || len(records) != 1 {
+			t.Fatalf("LookupNAPTR() = %v, %v", records, err)
+		}
+	}
+	if r.Queries() != 1 {
+		t.Errorf("queries = %d, want 1", r.Queries())
+	}
+
+	// Records are kept for their TTL
+	now = now.Add(fakeTTL)
+	c.LookupNAPTR(ctx, name)
+	if r.Queries() != 2 {
+		t.Errorf("queries after the TTL = %d, want 2", r.Queries())
+	}
+
+	// Names without records are cached for the negative TTL
+	unknown := Domain("15559999", DefaultSuffix)
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupNAPTR(ctx, unknown); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("LookupNAPTR() of an unknown name error = %v", err)
+		}
+	}
+	if r.Queries() != 3 {
+		t.Errorf("queries after negative caching = %d, want 3", r.Queries())
+	}
+	now = now.Add(30 * time.Second)
+	c.LookupNAPTR(ctx, unknown)
+	if r.Queries() != 4 {
+		t.Errorf("queries after the negative TTL = %d, want 4", r.Queries())
+	}
+
+	// Failures are not cached
+	r.SetError(errors.New("server failure"))
+	other := Domain("15550002", DefaultSuffix)
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupNAPTR(ctx, other); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("LookupNAPTR() with a failing resolver error = %v", err)
+		}
+	}
+	if r.Queries() != 6 {
+		t.Errorf("queries after failures = %d, want 6", r.Queries())
+	}
+}
+
+func TestCache_MaxTTL(t *testing.T) {
+	ctx := context.Background()
+	r := NewFakeResolver()
+	r.AddSIP("15550001", DefaultSuffix, "sip:alice@ims.example.com")
+	c := NewCache(r, time.Minute, 0)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	name := Domain("15550001", DefaultSuffix)
+	c.LookupNAPTR(ctx, name)
+	now = now.Add(time.Minute)
+	c.LookupNAPTR(ctx, name)
+	if r.Queries() != 2 {
+		t.Errorf("queries = %d, want 2", r.Queries())
+	}
+
+	// Without a negative TTL, unknown names are not cached
+	c.LookupNAPTR(ctx, "unknown.e164.arpa")
+	if c.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", c.Len())
+	}
+	now = now.Add(time.Minute)
+	c.Expire()
+	if c.Len() != 0 {
+		t.Errorf("Len() after Expire() = %d, want 0", c.Len())
+	}
+}
+
+func TestCache_Size(t *testing.T) {
+	ctx := context.Background()
+	r := NewFakeResolver()
+	for _, number := range []string{"15550001", "15550002", "15550003"} {
+		r.AddSIP(number, DefaultSuffix, "sip:+"+number+"@ims.example.com")
+	}
+	c := NewCache(r, time.Hour, 0)
+	c.SetSize(2)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	first, second, third := Domain("15550001", DefaultSuffix), Domain("15550002", DefaultSuffix), Domain("15550003", DefaultSuffix)
+	c.LookupNAPTR(ctx, first)
+	now = now.Add(time.Second)
+	c.LookupNAPTR(ctx, second)
+	c.LookupNAPTR(ctx, third)
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", c.Len())
+	}
+
+	// The entry closest to expiry was dropped
+	queries := r.Queries()
+	c.LookupNAPTR(ctx, second)
+	c.LookupNAPTR(ctx, third)
+	if r.Queries() != queries {
+		t.Errorf("queries = %d, want %d: the newest entries were dropped", r.Queries(), queries)
+	}
+	c.LookupNAPTR(ctx, first)
+	if r.Queries() != queries+1 {
+		t.Errorf("queries = %d, want %d: the oldest entry was kept", r.Queries(), queries+1)
+	}
+}
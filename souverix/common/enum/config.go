@@ -0,0 +1,101 @@
+package enum
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default cache TTLs of Setup
+const (
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 5 * time.Minute
+)
+
+// Config configures the ENUM and number portability lookups of a node
+type Config struct {
+	// ENUM enables the NAPTR queries, to Servers or to the nameservers of
+	// /etc/resolv.conf when empty
+	ENUM    bool
+	Servers []string
+	Suffix  string // DefaultSuffix when empty
+
+	// PortabilityDB is the path of the portability database, none when
+	// empty
+	PortabilityDB string
+
+	HomeDomains []string
+	PeerDomains []string
+
+	// Bounds of the cached ENUM answers, defaulted when zero
+	CacheMaxTTL      time.Duration
+	CacheNegativeTTL time.Duration
+	CacheSize        int
+}
+
+// ConfigFromEnv reads the configuration of a node from ENUM_ENABLED,
+// ENUM_SERVERS, ENUM_SUFFIX, ENUM_PORTABILITY_DB, ENUM_HOME_DOMAINS,
+// ENUM_PEER_DOMAINS and ENUM_CACHE_SIZE; lists are comma separated
+func ConfigFromEnv() Config {
+	enabled, _ := strconv.ParseBool(os.Getenv("ENUM_ENABLED"))
+	size, _ := strconv.Atoi(os.Getenv("ENUM_CACHE_SIZE"))
+	return Config{
+		ENUM:          enabled,
+		Servers:       envList("ENUM_SERVERS"),
+		Suffix:        os.Getenv("ENUM_SUFFIX"),
+		PortabilityDB: os.Getenv("ENUM_PORTABILITY_DB"),
+		HomeDomains:   envList("ENUM_HOME_DOMAINS"),
+		PeerDomains:   envList("ENUM_PEER_DOMAINS"),
+		CacheSize:     size,
+	}
+}
+
+// envList returns the comma-separated values of an environment variable
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Setup creates the translator configured in cfg, caching its ENUM answers
+// and expiring them until ctx is done. It returns nil when cfg enables
+// neither ENUM nor portability.
+func Setup(ctx context.Context, cfg Config) (*Translator, error) {
+	opts := Options{Suffix: cfg.Suffix, HomeDomains: cfg.HomeDomains, PeerDomains: cfg.PeerDomains}
+	if cfg.PortabilityDB != "" {
+		db, err := LoadPortabilityDB(cfg.PortabilityDB)
+		if err != nil {
+			return nil, err
+		}
+		opts.Portability = db
+	}
+	if cfg.ENUM {
+		resolver, err := NewDNSResolver(cfg.Servers...)
+		if err != nil {
+			return nil, err
+		}
+		maxTTL, negativeTTL := cfg.CacheMaxTTL, cfg.CacheNegativeTTL
+		if maxTTL == 0 {
+			maxTTL = defaultMaxTTL
+		}
+		if negativeTTL == 0 {
+			negativeTTL = defaultNegativeTTL
+		}
+		cache := NewCache(resolver, maxTTL, negativeTTL)
+		if cfg.CacheSize > 0 {
+			cache.SetSize(cfg.CacheSize)
+		}
+		go cache.Run(ctx)
+		opts.Resolver = cache
+	}
+	if opts.Resolver == nil && opts.Portability == nil {
+		return nil, nil
+	}
+	return NewTranslator(opts), nil
+}
@@ -0,0 +1,45 @@
+package enum
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if tr, err := Setup(ctx, Config{}); tr != nil || err != nil {
+		t.Errorf("Setup() without lookups = %v, %v, want nil", tr, err)
+	}
+	if _, err := Setup(ctx, Config{PortabilityDB: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("Setup() with a missing portability database succeeded")
+	}
+
+	path := filepath.Join(t.TempDir(), "np.txt")
+	if err := os.WriteFile(path, []byte("15552*,15559200,peer.example.net\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Setup(ctx, Config{ENUM: true, Servers: []string{"127.0.0.1:1"}, PortabilityDB: path, PeerDomains: []string{"peer.example.net"}})
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if _, ok := tr.resolver.(*Cache); !ok {
+		t.Errorf("resolver = %T, want *Cache", tr.resolver)
+	}
+	if route, err := tr.Translate(ctx, "tel:+15552000"); err != nil || route.Destination != DestinationPeer {
+		t.Errorf("Translate() of a ported number = %+v, %v", route, err)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("ENUM_ENABLED", "true")
+	t.Setenv("ENUM_SERVERS", "192.0.2.1, 192.0.2.2:5353")
+	t.Setenv("ENUM_PEER_DOMAINS", "")
+	cfg := ConfigFromEnv()
+	if !cfg.ENUM || len(cfg.Servers) != 2 || cfg.Servers[1] != "192.0.2.2:5353" || cfg.PeerDomains != nil {
+		t.Errorf("ConfigFromEnv() = %+v", cfg)
+	}
+}
@@ -0,0 +1,332 @@
+package enum
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS wire constants (RFC 1035)
+const (
+	typeNAPTR   uint16 = 35
+	classIN     uint16 = 1
+	flagRD      uint16 = 0x0100
+	flagTC      uint16 = 0x0200
+	flagQR      uint16 = 0x8000
+	rcodeNX     uint16 = 3
+	headerLen          = 12
+	maxUDPSize         = 4096
+	maxPointers        = 32
+)
+
+// defaultDNSTimeout bounds a query to one server
+const defaultDNSTimeout = 2 * time.Second
+
+// DNSResolver queries the NAPTR records of ENUM domains from DNS servers,
+// over UDP with a retry over TCP when the answer is truncated. Servers
+// are tried in order until one answers.
+type DNSResolver struct {
+	servers []string
+	timeout time.Duration
+}
+
+// NewDNSResolver creates a resolver querying servers, given as host or
+// host:port. Without servers, the nameservers of /etc/resolv.conf are used.
+func NewDNSResolver(servers ...string) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		var err error
+		if servers, err = systemServers("/etc/resolv.conf"); err != nil {
+			return nil, err
+		}
+	}
+	r := &DNSResolver{timeout: defaultDNSTimeout}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r, nil
+}
+
+// SetTimeout sets the timeout of a query to one server
+func (r *DNSResolver) SetTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// systemServers returns the nameservers of a resolv.conf file
+func systemServers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("no DNS servers: %w", err)
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS servers in %s", path)
+	}
+	return servers, scanner.Err()
+}
+
+// LookupNAPTR implements Resolver
+func (r *DNSResolver) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	var lastErr error
+	for _, server := range r.servers {
+		records, err := r.query(ctx, server, name)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return records, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("NAPTR lookup of %s failed: %w", name, lastErr)
+}
+
+// query sends the NAPTR query of name to server
+func (r *DNSResolver) query(ctx context.Context, server, name string) ([]NAPTR, error) {
+	id, query, err := newQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Answers to other queries are ignored
+		if n < headerLen || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[2:])&flagTC != 0 {
+			return r.queryTCP(ctx, server, id, query)
+		}
+		return parseResponse(buf[:n])
+	}
+}
+
+// queryTCP sends query to server over TCP, after a truncated UDP answer
+func (r *DNSResolver) queryTCP(ctx context.Context, server string, id uint16, query []byte) ([]NAPTR, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if len(response) < headerLen || binary.BigEndian.Uint16(response) != id {
+		return nil, fmt.Errorf("unexpected DNS answer over TCP")
+	}
+	return parseResponse(response)
+}
+
+// newQuery encodes a recursive NAPTR query of name with a random id
+func newQuery(name string) (uint16, []byte, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return 0, nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := make([]byte, headerLen, headerLen+len(name)+6)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], flagRD)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+	msg, err := appendName(msg, name)
+	if err != nil {
+		return 0, nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, typeNAPTR)
+	msg = binary.BigEndian.AppendUint16(msg, classIN)
+	return id, msg, nil
+}
+
+// appendName appends the uncompressed wire encoding of a domain name
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// parseResponse decodes the NAPTR records of the answer section of a DNS
+// response
+func parseResponse(msg []byte) ([]NAPTR, error) {
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagQR == 0 {
+		return nil, fmt.Errorf("DNS message is not a response")
+	}
+	switch rcode := flags & 0x000f; rcode {
+	case 0:
+	case rcodeNX:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("DNS server answered with rcode %d", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	offset := headerLen
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if _, offset, err = readName(msg, offset); err != nil {
+			return nil, err
+		}
+		offset += 4 // QTYPE, QCLASS
+	}
+
+	var records []NAPTR
+	for i := 0; i < ancount; i++ {
+		if _, offset, err = readName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, errTruncatedDNS
+		}
+		rrType := binary.BigEndian.Uint16(msg[offset:])
+		ttl := binary.BigEndian.Uint32(msg[offset+4:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, errTruncatedDNS
+		}
+		if rrType == typeNAPTR {
+			rec, err := parseNAPTR(msg, offset, offset+length)
+			if err != nil {
+				return nil, err
+			}
+			rec.TTL = time.Duration(ttl) * time.Second
+			records = append(records, rec)
+		}
+		offset += length
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return records, nil
+}
+
+var errTruncatedDNS = errors.New("truncated DNS message")
+
+// parseNAPTR decodes the RDATA of a NAPTR record in msg[offset:end]
+func parseNAPTR(msg []byte, offset, end int) (NAPTR, error) {
+	var rec NAPTR
+	if offset+4 > end {
+		return rec, errTruncatedDNS
+	}
+	rec.Order = binary.BigEndian.Uint16(msg[offset:])
+	rec.Preference = binary.BigEndian.Uint16(msg[offset+2:])
+	offset += 4
+	fields := []*string{&rec.Flags, &rec.Services, &rec.Regexp}
+	for _, field := range fields {
+		if offset >= end || offset+1+int(msg[offset]) > end {
+			return rec, errTruncatedDNS
+		}
+		length := int(msg[offset])
+		*field = string(msg[offset+1 : offset+1+length])
+		offset += 1 + length
+	}
+	replacement, _, err := readName(msg, offset)
+	if err != nil {
+		return rec, err
+	}
+	rec.Replacement = replacement
+	return rec, nil
+}
+
+// readName decodes the domain name at offset in msg, following compression
+// pointers, and returns the offset past it
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for pointers := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errTruncatedDNS
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			if len(labels) == 0 {
+				return ".", next, nil
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, errTruncatedDNS
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, fmt.Errorf("DNS name compression loop")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errTruncatedDNS
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
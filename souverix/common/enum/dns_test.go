@@ -0,0 +1,202 @@
+package enum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsServer answers NAPTR queries over UDP and TCP on the same port
+type dnsServer struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	records map[string][]NAPTR
+	// truncate sets TC on the UDP answers
+	truncate atomic.Bool
+}
+
+func newDNSServer(t *testing.T, records map[string][]NAPTR) *dnsServer {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Skipf("no TCP listener on the UDP port: %v", err)
+	}
+	s := &dnsServer{udp: udp, tcp: tcp, records: records}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *dnsServer) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.udp.WriteTo(s.answer(buf[:n], s.truncate.Load()), from)
+	}
+}
+
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err == nil {
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err == nil {
+				answer := s.answer(query, false)
+				conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+				conn.Write(answer)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// answer encodes the response to query, with a compression pointer to the
+// question name in each record
+func (s *dnsServer) answer(query []byte, truncate bool) []byte {
+	name, end, _ := readName(query, headerLen)
+	question := query[headerLen : end+4]
+	records, found := s.records[name]
+
+	msg := make([]byte, headerLen)
+	copy(msg, query[:2])
+	flags := flagQR | flagRD
+	switch {
+	case truncate:
+		flags |= flagTC
+	case !found:
+		flags |= rcodeNX
+	}
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg = append(msg, question...)
+	if truncate || !found {
+		return msg
+	}
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	for _, rec := range records {
+		msg = binary.BigEndian.AppendUint16(msg, 0xc000|headerLen)
+		msg = binary.BigEndian.AppendUint16(msg, typeNAPTR)
+		msg = binary.BigEndian.AppendUint16(msg, classIN)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(rec.TTL/time.Second))
+		rdata := binary.BigEndian.AppendUint16(nil, rec.Order)
+		rdata = binary.BigEndian.AppendUint16(rdata, rec.Preference)
+		for _, field := range []string{rec.Flags, rec.Services, rec.Regexp} {
+			rdata = append(rdata, byte(len(field)))
+			rdata = append(rdata, field...)
+		}
+		rdata, _ = appendName(rdata, rec.Replacement)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestDNSResolver_LookupNAPTR(t *testing.T) {
+	name := Domain("441632960083", DefaultSuffix)
+	want := NAPTR{
+		Order:       100,
+		Preference:  10,
+		Flags:       "u",
+		Services:    "E2U+sip",
+		Regexp:      "!^.*$!sip:+441632960083@ims.example.com;user=phone!",
+		Replacement: ".",
+		TTL:         300 * time.Second,
+	}
+	server := newDNSServer(t, map[string][]NAPTR{name: {want}})
+	r, err := NewDNSResolver(server.addr())
+	if err != nil {
+		t.Fatalf("NewDNSResolver() error = %v", err)
+	}
+	r.SetTimeout(time.Second)
+	ctx := context.Background()
+
+	for _, truncate := range []bool{false, true} {
+		server.truncate.Store(truncate)
+		records, err := r.LookupNAPTR(ctx, name)
+		if err != nil {
+			t.Fatalf("LookupNAPTR(truncate=%v) error = %v", truncate, err)
+		}
+		if len(records) != 1 || records[0] != want {
+			t.Errorf("LookupNAPTR(truncate=%v) = %+v, want %+v", truncate, records, want)
+		}
+	}
+	server.truncate.Store(false)
+
+	if _, err := r.LookupNAPTR(ctx, Domain("15550000", DefaultSuffix)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupNAPTR() of an unknown name error = %v, want ErrNotFound", err)
+	}
+	uri, err := Lookup(ctx, r, "441632960083", DefaultSuffix)
+	if err != nil || uri != "sip:+441632960083@ims.example.com;user=phone" {
+		t.Errorf("Lookup() = %s, %v", uri, err)
+	}
+}
+
+func TestDNSResolver_Failover(t *testing.T) {
+	name := Domain("15550001", DefaultSuffix)
+	server := newDNSServer(t, map[string][]NAPTR{name: {{Order: 1, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:a@example.com!"}}})
+
+	// Nothing answers on the first server
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer dead.Close()
+
+	r, err := NewDNSResolver(dead.LocalAddr().String(), server.addr())
+	if err != nil {
+		t.Fatalf("NewDNSResolver() error = %v", err)
+	}
+	r.SetTimeout(100 * time.Millisecond)
+	if records, err := r.LookupNAPTR(context.Background(), name); err != nil || len(records) != 1 {
+		t.Errorf("LookupNAPTR() = %v, %v", records, err)
+	}
+}
+
+func TestNewDNSResolver_DefaultPort(t *testing.T) {
+	r, err := NewDNSResolver("192.0.2.1", "[2001:db8::1]", "192.0.2.2:5353")
+	if err != nil {
+		t.Fatalf("NewDNSResolver() error = %v", err)
+	}
+	want := []string{"192.0.2.1:53", "[2001:db8::1]:53", "192.0.2.2:5353"}
+	for i, server := range r.servers {
+		if server != want[i] {
+			t.Errorf("servers[%d] = %s, want %s", i, server, want[i])
+		}
+	}
+}
+
+func TestParseResponse_Invalid(t *testing.T) {
+	// A compression pointer to itself
+	msg := []byte{0, 1, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0, 0xc0, headerLen}
+	if _, err := parseResponse(msg); err == nil {
+		t.Error("parseResponse() of a compression loop succeeded")
+	}
+	if _, err := parseResponse(msg[:headerLen+1]); err == nil {
+		t.Error("parseResponse() of a truncated message succeeded")
+	}
+}
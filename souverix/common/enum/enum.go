@@ -0,0 +1,216 @@
+// Package enum maps E.164 telephone numbers to SIP URIs: ENUM NAPTR
+// resolution (RFC 6116, RFC 3403) through a pluggable resolver with a TTL
+// cache, and a local number portability database. The CSCFs and the BGCF
+// use it to route tel URIs of on-net and peer network numbers over SIP
+// instead of breaking out to the PSTN.
+package enum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultSuffix is the domain of the public ENUM tree
+const DefaultSuffix = "e164.arpa"
+
+// maxNonTerminal bounds the chain of non-terminal NAPTR records followed
+const maxNonTerminal = 5
+
+// ErrNotFound is returned when a number has no ENUM records
+var ErrNotFound = errors.New("no ENUM records")
+
+// NAPTR is a NAPTR resource record (RFC 3403 section 4.1)
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+	TTL         time.Duration
+}
+
+// Resolver looks up the NAPTR records of a domain name. It returns
+// ErrNotFound when the name has none.
+type Resolver interface {
+	LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error)
+}
+
+// Domain returns the ENUM domain name of the E.164 number digits under
+// suffix: the digits reversed, separated by dots (RFC 6116 section 2.4)
+func Domain(digits, suffix string) string {
+	labels := make([]string, 0, len(digits)+1)
+	for i := len(digits) - 1; i >= 0; i-- {
+		labels = append(labels, digits[i:i+1])
+	}
+	labels = append(labels, strings.Trim(suffix, "."))
+	return strings.Join(labels, ".")
+}
+
+// Number returns the digits of the global E.164 number of a tel URI, or of
+// a SIP URI with user=phone; ok is false for other URIs and local numbers
+func Number(uri string) (digits string, ok bool) {
+	uri = strings.TrimSpace(uri)
+	if start := strings.Index(uri, "<"); start >= 0 {
+		if end := strings.Index(uri[start:], ">"); end > 0 {
+			uri = uri[start+1 : start+end]
+		}
+	}
+	scheme, rest, found := strings.Cut(uri, ":")
+	if !found {
+		return "", false
+	}
+	var number string
+	switch strings.ToLower(scheme) {
+	case "tel":
+		number, _, _ = strings.Cut(rest, ";")
+	case "sip", "sips":
+		user, params, hasHost := strings.Cut(rest, "@")
+		if !hasHost || !strings.Contains(strings.ToLower(params), "user=phone") {
+			return "", false
+		}
+		number, _, _ = strings.Cut(user, ";")
+	default:
+		return "", false
+	}
+	if !strings.HasPrefix(number, "+") {
+		return "", false
+	}
+
+	// Visual separators are not part of the number (RFC 3966 section 5.1.1)
+	var b strings.Builder
+	for _, c := range number[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", false
+		}
+	}
+	if b.Len() == 0 || b.Len() > 15 {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// TelURI returns the tel URI of the E.164 number digits
+func TelURI(digits string) string {
+	return "tel:+" + digits
+}
+
+// Lookup resolves the number digits under suffix to the URI of its
+// preferred E2U+sip record, following non-terminal records. It returns
+// ErrNotFound when the number has no SIP URI.
+func Lookup(ctx context.Context, r Resolver, digits, suffix string) (string, error) {
+	name := Domain(digits, suffix)
+	for i := 0; i < maxNonTerminal; i++ {
+		records, err := r.LookupNAPTR(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		sortRecords(records)
+
+		next := ""
+		for _, rec := range records {
+			flags := strings.ToLower(rec.Flags)
+			switch {
+			case flags == "u" && isSIPService(rec.Services):
+				uri, err := Apply(rec.Regexp, "+"+digits)
+				if err != nil {
+					continue
+				}
+				return uri, nil
+			case flags == "" && next == "" && rec.Replacement != "" && rec.Replacement != ".":
+				// A non-terminal record points to another domain (RFC
+				// 6116 section 3.4.1), tried when no terminal one applies
+				next = strings.TrimSuffix(rec.Replacement, ".")
+			}
+		}
+		if next == "" {
+			return "", ErrNotFound
+		}
+		name = next
+	}
+	return "", fmt.Errorf("too many non-terminal NAPTR records for %s", Domain(digits, suffix))
+}
+
+// sortRecords orders NAPTR records by Order then Preference
+func sortRecords(records []NAPTR) {
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Order != records[j].Order {
+			return records[i].Order < records[j].Order
+		}
+		return records[i].Preference < records[j].Preference
+	})
+}
+
+// isSIPService reports whether a NAPTR services field is an E2U service
+// with the sip type (RFC 3764)
+func isSIPService(services string) bool {
+	parts := strings.Split(strings.ToLower(services), "+")
+	if len(parts) < 2 || parts[0] != "e2u" {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if enumType, _, _ := strings.Cut(part, ":"); enumType == "sip" {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply applies the substitution expression of a NAPTR record,
+// delim-ere-delim-repl-delim-flags, to the application unique string aus
+// (RFC 3402 section 3.2)
+func Apply(expr, aus string) (string, error) {
+	if len(expr) < 4 {
+		return "", fmt.Errorf("invalid NAPTR regexp %q", expr)
+	}
+	delim := expr[:1]
+	parts := strings.Split(expr[1:], delim)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid NAPTR regexp %q", expr)
+	}
+	pattern, repl, flags := parts[0], parts[1], parts[2]
+	if flags == "i" {
+		pattern = "(?i)" + pattern
+	} else if flags != "" {
+		return "", fmt.Errorf("invalid NAPTR regexp flags %q", flags)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid NAPTR regexp %q: %w", expr, err)
+	}
+	match := re.FindStringSubmatchIndex(aus)
+	if match == nil {
+		return "", fmt.Errorf("NAPTR regexp %q does not match %s", expr, aus)
+	}
+
+	// As with sed, the match is replaced. Backreferences are \1 to \9; a
+	// backslash escapes any other character.
+	var b strings.Builder
+	b.WriteString(aus[:match[0]])
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		if c != '\\' || i+1 == len(repl) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if n := int(repl[i] - '0'); repl[i] >= '1' && repl[i] <= '9' {
+			if 2*n+1 < len(match) && match[2*n] >= 0 {
+				b.WriteString(aus[match[2*n]:match[2*n+1]])
+			}
+			continue
+		}
+		b.WriteByte(repl[i])
+	}
+	b.WriteString(aus[match[1]:])
+	return b.String(), nil
+}
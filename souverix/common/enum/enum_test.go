@@ -0,0 +1,110 @@
+package enum
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDomain(t *testing.T) {
+	if got := Domain("441632960083", DefaultSuffix); got != "3.8.0.0.6.9.2.3.6.1.4.4.e164.arpa" {
+		t.Errorf("Domain() = %s", got)
+	}
+	if got := Domain("12", "e164.example.net."); got != "2.1.e164.example.net" {
+		t.Errorf("Domain() = %s", got)
+	}
+}
+
+func TestNumber(t *testing.T) {
+	tests := []struct {
+		uri    string
+		digits string
+		ok     bool
+	}{
+		{"tel:+441632960083", "441632960083", true},
+		{"tel:+1-202-555-0100;phone-context=example.com", "12025550100", true},
+		{"<tel:+33(1)23456789>", "33123456789", true},
+		{"sip:+15551234567@ims.example.com;user=phone", "15551234567", true},
+		{"sip:+15551234567;npdi@ims.example.com;user=phone", "15551234567", true},
+		{"sip:+15551234567@ims.example.com", "", false},
+		{"sip:alice@ims.example.com;user=phone", "", false},
+		{"tel:5550100;phone-context=+1202", "", false},
+		{"tel:+1234567890123456", "", false},
+		{"tel:+", "", false},
+		{"mailto:alice@example.com", "", false},
+	}
+	for _, tt := range tests {
+		digits, ok := Number(tt.uri)
+		if digits != tt.digits || ok != tt.ok {
+			t.Errorf("Number(%q) = %q, %v, want %q, %v", tt.uri, digits, ok, tt.digits, tt.ok)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		expr    string
+		aus     string
+		want    string
+		wantErr bool
+	}{
+		{"!^.*$!sip:info@example.com!", "+441632960083", "sip:info@example.com", false},
+		{"!^\\+(.*)$!sip:+\\1@ims.example.com;user=phone!", "+441632960083", "sip:+441632960083@ims.example.com;user=phone", false},
+		{"/^\\+44(.*)$/sip:0\\1@uk.example.com/", "+441632960083", "sip:01632960083@uk.example.com", false},
+		{"!^\\+1!sip:x!y@example.com!", "+1555", "", true},
+		{"!^A(.*)$!sip:\\1@example.com!i", "a12", "sip:12@example.com", false},
+		{"!^\\+9(.*)$!sip:\\1@example.com!", "+441632960083", "", true},
+		{"!^.*$!sip:x@example.com!g", "+1", "", true},
+		{"!^.*$", "+1", "", true},
+	}
+	for _, tt := range tests {
+		got, err := Apply(tt.expr, tt.aus)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Apply(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("Apply(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx := context.Background()
+	r := NewFakeResolver()
+	r.Add(Domain("15550001", DefaultSuffix),
+		NAPTR{Order: 100, Preference: 20, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:second@example.com!"},
+		NAPTR{Order: 100, Preference: 10, Flags: "u", Services: "E2U+email:mailto", Regexp: "!^.*$!mailto:a@example.com!"},
+		NAPTR{Order: 90, Preference: 50, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:first@example.com!"},
+	)
+	// Delegated to another domain through a non-terminal record
+	r.Add(Domain("15550002", DefaultSuffix),
+		NAPTR{Order: 100, Preference: 10, Replacement: "ported.example.net."})
+	r.Add("ported.example.net",
+		NAPTR{Order: 100, Preference: 10, Flags: "u", Services: "E2U+sip", Regexp: "!^\\+(.*)$!sip:+\\1@peer.example.net;user=phone!"})
+	// A loop of non-terminal records
+	r.Add("loop.example.net", NAPTR{Order: 1, Preference: 1, Replacement: "loop.example.net"})
+	r.Add(Domain("15550003", DefaultSuffix), NAPTR{Order: 1, Preference: 1, Replacement: "loop.example.net"})
+	r.Add(Domain("15550004", DefaultSuffix),
+		NAPTR{Order: 100, Preference: 10, Flags: "u", Services: "E2U+email:mailto", Regexp: "!^.*$!mailto:a@example.com!"})
+
+	tests := []struct {
+		digits  string
+		want    string
+		wantErr error
+	}{
+		{"15550001", "sip:first@example.com", nil},
+		{"15550002", "sip:+15550002@peer.example.net;user=phone", nil},
+		{"15550004", "", ErrNotFound},
+		{"15559999", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		got, err := Lookup(ctx, r, tt.digits, DefaultSuffix)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("Lookup(%s) = %s, %v, want %s, %v", tt.digits, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := Lookup(ctx, r, "15550003", DefaultSuffix); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup() with a loop error = %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package enum
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeTTL is the TTL of the records AddSIP adds
+const fakeTTL = 5 * time.Minute
+
+// FakeResolver is an in-memory Resolver for tests: it answers the records
+// added for each name, and ErrNotFound for the others
+type FakeResolver struct {
+	mu      sync.Mutex
+	records map[string][]NAPTR
+	err     error
+	queries int
+}
+
+// NewFakeResolver creates an empty fake resolver
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{records: make(map[string][]NAPTR)}
+}
+
+// Add adds records to name
+func (f *FakeResolver) Add(name string, records ...NAPTR) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	f.records[name] = append(f.records[name], records...)
+}
+
+// AddSIP adds a terminal E2U+sip record mapping the number digits under
+// suffix to uri
+func (f *FakeResolver) AddSIP(digits, suffix, uri string) {
+	f.Add(Domain(digits, suffix), NAPTR{
+		Order:      100,
+		Preference: 10,
+		Flags:      "u",
+		Services:   "E2U+sip",
+		Regexp:     "!^.*$!" + uri + "!",
+		TTL:        fakeTTL,
+	})
+}
+
+// SetError makes every lookup fail with err, or succeed again when nil
+func (f *FakeResolver) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Queries returns the number of lookups made
+func (f *FakeResolver) Queries() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries
+}
+
+// LookupNAPTR implements Resolver
+func (f *FakeResolver) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries++
+	if f.err != nil {
+		return nil, f.err
+	}
+	records := f.records[strings.ToLower(strings.TrimSuffix(name, "."))]
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return append([]NAPTR(nil), records...), nil
+}
@@ -0,0 +1,135 @@
+package enum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Porting is the portability data of a number: the routing number of the
+// network serving it (RFC 4694) and the domain of that network, if known
+type Porting struct {
+	RoutingNumber string
+	Network       string
+}
+
+// PortabilityDB is a local number portability database. Entries are full
+// E.164 numbers, or number blocks given as a prefix followed by "*"; the
+// longest match applies.
+type PortabilityDB struct {
+	mu      sync.RWMutex
+	numbers map[string]Porting
+	blocks  map[string]Porting // key: prefix
+	longest int                // Length of the longest prefix
+}
+
+// NewPortabilityDB creates an empty portability database
+func NewPortabilityDB() *PortabilityDB {
+	return &PortabilityDB{
+		numbers: make(map[string]Porting),
+		blocks:  make(map[string]Porting),
+	}
+}
+
+// LoadPortabilityDB reads a portability database from a file
+func LoadPortabilityDB(path string) (*PortabilityDB, error) {
+	db := NewPortabilityDB()
+	if err := db.Reload(path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload replaces the entries of db with those of a file. On error the
+// current entries are kept.
+func (db *PortabilityDB) Reload(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open portability database: %w", err)
+	}
+	defer file.Close()
+
+	loaded := NewPortabilityDB()
+	if err := loaded.read(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.numbers, db.blocks, db.longest = loaded.numbers, loaded.blocks, loaded.longest
+	return nil
+}
+
+// read adds the entries of a portability file: one per line, the number,
+// its routing number and optionally the domain of its network, separated
+// by commas. Blank lines and lines starting with "#" are ignored.
+func (db *PortabilityDB) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("line %d: want number,routing number[,network]", line)
+		}
+		p := Porting{RoutingNumber: strings.TrimSpace(fields[1])}
+		if len(fields) == 3 {
+			p.Network = strings.ToLower(strings.TrimSpace(fields[2]))
+		}
+		if err := db.Add(strings.TrimSpace(fields[0]), p); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Add sets the portability data of a number, or of a block of numbers
+// given as a prefix followed by "*". A leading "+" is ignored.
+func (db *PortabilityDB) Add(number string, p Porting) error {
+	number = strings.TrimPrefix(number, "+")
+	prefix, block := strings.CutSuffix(number, "*")
+	if prefix == "" || strings.Trim(prefix, "0123456789") != "" {
+		return fmt.Errorf("invalid number %q", number)
+	}
+	if p.RoutingNumber == "" && p.Network == "" {
+		return fmt.Errorf("no routing number or network for %s", number)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !block {
+		db.numbers[prefix] = p
+		return nil
+	}
+	db.blocks[prefix] = p
+	if len(prefix) > db.longest {
+		db.longest = len(prefix)
+	}
+	return nil
+}
+
+// Lookup returns the portability data of the number digits
+func (db *PortabilityDB) Lookup(digits string) (Porting, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if p, ok := db.numbers[digits]; ok {
+		return p, true
+	}
+	for n := min(len(digits), db.longest); n > 0; n-- {
+		if p, ok := db.blocks[digits[:n]]; ok {
+			return p, true
+		}
+	}
+	return Porting{}, false
+}
+
+// Len returns the number of entries
+func (db *PortabilityDB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.numbers) + len(db.blocks)
+}
@@ -0,0 +1,95 @@
+package enum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPortabilityDB_Lookup(t *testing.T) {
+	db := NewPortabilityDB()
+	entries := []struct {
+		number string
+		p      Porting
+	}{
+		{"+1555*", Porting{RoutingNumber: "15559000000"}},
+		{"155512*", Porting{RoutingNumber: "15559120000", Network: "peer.example.net"}},
+		{"15551234567", Porting{Network: "ims.example.com"}},
+	}
+	for _, e := range entries {
+		if err := db.Add(e.number, e.p); err != nil {
+			t.Fatalf("Add(%s) error = %v", e.number, err)
+		}
+	}
+
+	tests := []struct {
+		digits string
+		want   Porting
+		found  bool
+	}{
+		{"15551234567", Porting{Network: "ims.example.com"}, true},
+		{"15551234568", Porting{RoutingNumber: "15559120000", Network: "peer.example.net"}, true},
+		{"15550000000", Porting{RoutingNumber: "15559000000"}, true},
+		{"15560000000", Porting{}, false},
+		{"1", Porting{}, false},
+	}
+	for _, tt := range tests {
+		got, found := db.Lookup(tt.digits)
+		if got != tt.want || found != tt.found {
+			t.Errorf("Lookup(%s) = %+v, %v, want %+v, %v", tt.digits, got, found, tt.want, tt.found)
+		}
+	}
+
+	for _, number := range []string{"", "*", "+1-555", "1555x*"} {
+		if err := db.Add(number, Porting{RoutingNumber: "1"}); err == nil {
+			t.Errorf("Add(%q) succeeded", number)
+		}
+	}
+	if err := db.Add("1555", Porting{}); err == nil {
+		t.Error("Add() without a routing number or network succeeded")
+	}
+}
+
+func TestPortabilityDB_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "portability.csv")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# number,routing number,network\n\n+15551234567,15559120000,Peer.Example.NET\n1666*, 16669000000\n")
+	db, err := LoadPortabilityDB(path)
+	if err != nil {
+		t.Fatalf("LoadPortabilityDB() error = %v", err)
+	}
+	if db.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", db.Len())
+	}
+	if p, _ := db.Lookup("15551234567"); p.Network != "peer.example.net" || p.RoutingNumber != "15559120000" {
+		t.Errorf("Lookup() = %+v", p)
+	}
+	if p, _ := db.Lookup("16661234567"); p.RoutingNumber != "16669000000" {
+		t.Errorf("Lookup() of a block = %+v", p)
+	}
+
+	// An invalid file keeps the current entries
+	write("15551234567\n")
+	if err := db.Reload(path); err == nil {
+		t.Error("Reload() of an invalid file succeeded")
+	}
+	if db.Len() != 2 {
+		t.Errorf("Len() after a failed reload = %d, want 2", db.Len())
+	}
+
+	write("+17775550100,17779000000\n")
+	if err := db.Reload(path); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, found := db.Lookup("15551234567"); found || db.Len() != 1 {
+		t.Errorf("Reload() kept old entries, Len() = %d", db.Len())
+	}
+
+	if _, err := LoadPortabilityDB(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("LoadPortabilityDB() of a missing file succeeded")
+	}
+}
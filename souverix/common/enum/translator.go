@@ -0,0 +1,187 @@
+package enum
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Destination is where a number is served
+type Destination int
+
+const (
+	// DestinationPSTN is a number reached through PSTN breakout
+	DestinationPSTN Destination = iota
+	// DestinationOnNet is a number of a subscriber of the home network
+	DestinationOnNet
+	// DestinationPeer is a number of a peer IMS network, reached over SIP
+	DestinationPeer
+)
+
+// String returns the name of d
+func (d Destination) String() string {
+	switch d {
+	case DestinationOnNet:
+		return "on-net"
+	case DestinationPeer:
+		return "peer"
+	default:
+		return "pstn"
+	}
+}
+
+// Route is the translation of a number
+type Route struct {
+	Destination Destination
+	Number      string // E.164 digits
+
+	// URI is the SIP URI of on-net and peer numbers, and for the PSTN the
+	// tel URI with the routing number and npdi parameters of RFC 4694
+	URI           string
+	RoutingNumber string
+	Network       string // Domain of the serving network, when known
+}
+
+// Options configures a Translator. Either of Resolver and Portability may
+// be nil to skip ENUM or number portability.
+type Options struct {
+	Resolver    Resolver
+	Suffix      string // ENUM suffix, DefaultSuffix when empty
+	Portability *PortabilityDB
+
+	// HomeDomains are the domains of the home network and PeerDomains
+	// those of the peer networks reached over SIP. ENUM results in other
+	// domains are broken out to the PSTN.
+	HomeDomains []string
+	PeerDomains []string
+}
+
+// Translator maps the tel URIs of requests to SIP URIs for on-net and peer
+// network numbers, before any PSTN breakout. The local portability
+// database is consulted first, then ENUM.
+type Translator struct {
+	resolver    Resolver
+	suffix      string
+	portability *PortabilityDB
+	home        map[string]bool
+	peers       map[string]bool
+}
+
+// NewTranslator creates the translator configured in opts
+func NewTranslator(opts Options) *Translator {
+	t := &Translator{
+		resolver:    opts.Resolver,
+		suffix:      opts.Suffix,
+		portability: opts.Portability,
+		home:        domainSet(opts.HomeDomains),
+		peers:       domainSet(opts.PeerDomains),
+	}
+	if t.suffix == "" {
+		t.suffix = DefaultSuffix
+	}
+	return t
+}
+
+// domainSet returns the set of the lower-cased domains
+func domainSet(domains []string) map[string]bool {
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			set[domain] = true
+		}
+	}
+	return set
+}
+
+// Translate returns the route of the number of a tel URI, or of a SIP URI
+// with user=phone. It returns nil for other URIs. Numbers without ENUM or
+// portability data are routed to the PSTN; lookup failures are returned,
+// for the caller to break out or reject the request.
+func (t *Translator) Translate(ctx context.Context, uri string) (*Route, error) {
+	digits, ok := Number(uri)
+	if !ok {
+		return nil, nil
+	}
+
+	if t.portability != nil {
+		if p, ported := t.portability.Lookup(digits); ported {
+			route := t.networkRoute(digits, p.Network)
+			route.RoutingNumber = p.RoutingNumber
+			if route.Destination == DestinationPSTN {
+				route.URI = t.pstnURI(digits, p.RoutingNumber)
+			}
+			return route, nil
+		}
+	}
+
+	if t.resolver != nil {
+		sipURI, err := Lookup(ctx, t.resolver, digits, t.suffix)
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return nil, err
+		default:
+			if host := uriHost(sipURI); host != "" {
+				switch {
+				case t.home[host]:
+					return &Route{Destination: DestinationOnNet, Number: digits, URI: sipURI, Network: host}, nil
+				case t.peers[host]:
+					return &Route{Destination: DestinationPeer, Number: digits, URI: sipURI, Network: host}, nil
+				}
+			}
+		}
+	}
+	return &Route{Destination: DestinationPSTN, Number: digits, URI: t.pstnURI(digits, "")}, nil
+}
+
+// networkRoute returns the route of a number served by network
+func (t *Translator) networkRoute(digits, network string) *Route {
+	route := &Route{Destination: DestinationPSTN, Number: digits, Network: network}
+	switch {
+	case network == "":
+		return route
+	case t.home[network]:
+		route.Destination = DestinationOnNet
+	case t.peers[network]:
+		route.Destination = DestinationPeer
+	default:
+		return route
+	}
+	route.URI = "sip:+" + digits + "@" + network + ";user=phone"
+	return route
+}
+
+// pstnURI returns the tel URI of a number broken out to the PSTN. With a
+// portability database, npdi tells the next hops the dip was done (RFC
+// 4694 section 4).
+func (t *Translator) pstnURI(digits, routingNumber string) string {
+	uri := TelURI(digits)
+	if routingNumber != "" {
+		uri += ";rn=+" + strings.TrimPrefix(routingNumber, "+")
+	}
+	if t.portability != nil {
+		uri += ";npdi"
+	}
+	return uri
+}
+
+// uriHost returns the lower-cased host of a SIP URI, "" for other URIs
+func uriHost(uri string) string {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok || (!strings.EqualFold(scheme, "sip") && !strings.EqualFold(scheme, "sips")) {
+		return ""
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	if i := strings.IndexAny(rest, ";?>"); i >= 0 {
+		rest = rest[:i]
+	}
+	if strings.HasPrefix(rest, "[") {
+		if end := strings.Index(rest, "]"); end > 0 {
+			return strings.ToLower(rest[1:end])
+		}
+	}
+	host, _, _ := strings.Cut(rest, ":")
+	return strings.ToLower(host)
+}
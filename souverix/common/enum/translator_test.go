@@ -0,0 +1,84 @@
+package enum
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTranslator_Translate(t *testing.T) {
+	r := NewFakeResolver()
+	r.AddSIP("15550001", DefaultSuffix, "sip:alice@IMS.example.com")
+	r.AddSIP("15550002", DefaultSuffix, "sip:+15550002@peer.example.net;user=phone")
+	r.AddSIP("15550003", DefaultSuffix, "sip:+15550003@unknown.example.org;user=phone")
+	r.Add(Domain("15550004", DefaultSuffix), NAPTR{Order: 1, Flags: "u", Services: "E2U+email:mailto", Regexp: "!^.*$!mailto:a@example.com!"})
+
+	db := NewPortabilityDB()
+	db.Add("15551000", Porting{RoutingNumber: "15559000", Network: "ims.example.com"})
+	db.Add("15552*", Porting{RoutingNumber: "15559200", Network: "peer.example.net"})
+	db.Add("15553000", Porting{RoutingNumber: "+15559300"})
+	// Ported numbers are not looked up in ENUM
+	r.AddSIP("15551000", DefaultSuffix, "sip:stale@peer.example.net")
+
+	tr := NewTranslator(Options{
+		Resolver:    r,
+		Portability: db,
+		HomeDomains: []string{"ims.example.com"},
+		PeerDomains: []string{"peer.example.net"},
+	})
+
+	tests := []struct {
+		uri  string
+		want *Route
+	}{
+		{"tel:+1-555-0001", &Route{Destination: DestinationOnNet, Number: "15550001", URI: "sip:alice@IMS.example.com", Network: "ims.example.com"}},
+		{"sip:+15550002@ims.example.com;user=phone", &Route{Destination: DestinationPeer, Number: "15550002", URI: "sip:+15550002@peer.example.net;user=phone", Network: "peer.example.net"}},
+		{"tel:+15550003", &Route{Destination: DestinationPSTN, Number: "15550003", URI: "tel:+15550003;npdi"}},
+		{"tel:+15550004", &Route{Destination: DestinationPSTN, Number: "15550004", URI: "tel:+15550004;npdi"}},
+		{"tel:+15559999", &Route{Destination: DestinationPSTN, Number: "15559999", URI: "tel:+15559999;npdi"}},
+		{"tel:+15551000", &Route{Destination: DestinationOnNet, Number: "15551000", URI: "sip:+15551000@ims.example.com;user=phone", RoutingNumber: "15559000", Network: "ims.example.com"}},
+		{"tel:+15552123", &Route{Destination: DestinationPeer, Number: "15552123", URI: "sip:+15552123@peer.example.net;user=phone", RoutingNumber: "15559200", Network: "peer.example.net"}},
+		{"tel:+15553000", &Route{Destination: DestinationPSTN, Number: "15553000", URI: "tel:+15553000;rn=+15559300;npdi", RoutingNumber: "+15559300"}},
+		{"sip:alice@ims.example.com", nil},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		got, err := tr.Translate(ctx, tt.uri)
+		if err != nil {
+			t.Errorf("Translate(%s) error = %v", tt.uri, err)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("Translate(%s) = %+v, want %+v", tt.uri, got, tt.want)
+		}
+	}
+
+	r.SetError(errors.New("server failure"))
+	if _, err := tr.Translate(ctx, "tel:+15550001"); err == nil {
+		t.Error("Translate() with a failing resolver succeeded")
+	}
+	// Portability does not depend on DNS
+	if route, err := tr.Translate(ctx, "tel:+15552000"); err != nil || route.Destination != DestinationPeer {
+		t.Errorf("Translate() of a ported number = %+v, %v", route, err)
+	}
+}
+
+func TestTranslator_NoPeers(t *testing.T) {
+	r := NewFakeResolver()
+	r.AddSIP("15550003", "e164.example.net", "sip:+15550003@unknown.example.org;user=phone")
+	tr := NewTranslator(Options{Resolver: r, Suffix: "e164.example.net", HomeDomains: []string{"ims.example.com"}})
+
+	// Without peer domains, ENUM results outside the home network are
+	// broken out
+	route, err := tr.Translate(context.Background(), "tel:+15550003")
+	if err != nil {
+		t.Fatalf("Translate() error = %v", err)
+	}
+	if route.Destination != DestinationPSTN || route.Network != "" {
+		t.Errorf("Translate() = %+v, want a PSTN route", route)
+	}
+	// Without a portability database, PSTN numbers get no npdi
+	if route.URI != "tel:+15550003" {
+		t.Errorf("Translate() URI = %s, want tel:+15550003", route.URI)
+	}
+}
@@ -0,0 +1,161 @@
+package h248
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// TDMTermination returns the termination ID of the circuit of a CIC
+func TDMTermination(cic uint16) string {
+	return "TDM/" + strconv.Itoa(int(cic))
+}
+
+// Bearer is the media of a call through a media gateway: a context
+// joining the TDM termination of its circuit and an RTP termination
+type Bearer struct {
+	ContextID uint32
+	TDM       string
+	RTP       string
+
+	// LocalSDP is the session description of the RTP termination, for the
+	// SIP side of the call
+	LocalSDP string
+}
+
+// NotifyFunc is called for the events a media gateway notifies
+type NotifyFunc func(contextID uint32, termination string, events []string)
+
+// Controller is the media gateway controller side of the bearers of calls,
+// used by the MGCF to seize and release media gateway resources
+type Controller struct {
+	peer *Peer
+	mgw  string
+
+	mu     sync.Mutex
+	notify NotifyFunc
+}
+
+// NewController creates a controller identified by mid, controlling the
+// media gateway at address mgw from conn. Only the requests of the media
+// gateway are answered.
+func NewController(conn net.PacketConn, mid, mgw string) *Controller {
+	c := &Controller{mgw: mgw}
+	// An address that does not resolve leaves no one to answer, and the
+	// requests to the gateway fail too
+	sources, _ := resolveSources([]string{mgw})
+	c.peer = newPeer(conn, mid, c, sources, true)
+	return c
+}
+
+// SetNotifyHandler sets the function called for the events notified by
+// the media gateway
+func (c *Controller) SetNotifyHandler(notify NotifyFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = notify
+}
+
+// Close closes the controller
+func (c *Controller) Close() error {
+	return c.peer.Close()
+}
+
+// Setup creates the bearer of a call on the circuit of cic. The RTP
+// termination gets the remote session description, if already known,
+// and only sends media: the early media of the PSTN, until Connect.
+func (c *Controller) Setup(ctx context.Context, cic uint16, remoteSDP string) (*Bearer, error) {
+	reply, err := c.peer.Request(ctx, c.mgw, Action{
+		ContextID: ContextChoose,
+		Commands: []Command{
+			{
+				Type:          CommandAdd,
+				TerminationID: TDMTermination(cic),
+				Streams:       []Stream{{ID: 1, Mode: ModeSendReceive}},
+			},
+			{
+				Type:          CommandAdd,
+				TerminationID: TerminationChoose,
+				Streams:       []Stream{{ID: 1, Mode: ModeSendOnly, Remote: remoteSDP}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up bearer for CIC %d: %w", cic, err)
+	}
+	if len(reply.Actions) != 1 || len(reply.Actions[0].Commands) != 2 {
+		return nil, fmt.Errorf("cannot set up bearer for CIC %d: unexpected reply", cic)
+	}
+	action := reply.Actions[0]
+	b := &Bearer{
+		ContextID: action.ContextID,
+		TDM:       action.Commands[0].TerminationID,
+		RTP:       action.Commands[1].TerminationID,
+	}
+	if streams := action.Commands[1].Streams; len(streams) > 0 {
+		b.LocalSDP = streams[0].Local
+	}
+	return b, nil
+}
+
+// Modify sets the mode of the RTP termination of a bearer and, when not
+// empty, its remote session description
+func (c *Controller) Modify(ctx context.Context, b *Bearer, mode, remoteSDP string) error {
+	_, err := c.peer.Request(ctx, c.mgw, Action{
+		ContextID: b.ContextID,
+		Commands: []Command{{
+			Type:          CommandModify,
+			TerminationID: b.RTP,
+			Streams:       []Stream{{ID: 1, Mode: mode, Remote: remoteSDP}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot modify bearer %d: %w", b.ContextID, err)
+	}
+	return nil
+}
+
+// Connect through-connects a bearer in both directions, when the call is
+// answered
+func (c *Controller) Connect(ctx context.Context, b *Bearer, remoteSDP string) error {
+	return c.Modify(ctx, b, ModeSendReceive, remoteSDP)
+}
+
+// Release subtracts the terminations of a bearer, deleting its context
+func (c *Controller) Release(ctx context.Context, b *Bearer) error {
+	_, err := c.peer.Request(ctx, c.mgw, Action{
+		ContextID: b.ContextID,
+		Commands:  []Command{{Type: CommandSubtract, TerminationID: TerminationAll}},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot release bearer %d: %w", b.ContextID, err)
+	}
+	return nil
+}
+
+// ServeH248 implements Handler, answering the Notify requests of the media
+// gateway
+func (c *Controller) ServeH248(p *Peer, mid string, req *Transaction) *Transaction {
+	reply := &Transaction{}
+	for _, action := range req.Actions {
+		replied := Action{ContextID: action.ContextID}
+		for _, cmd := range action.Commands {
+			result := Command{Type: cmd.Type, TerminationID: cmd.TerminationID}
+			if cmd.Type != CommandNotify {
+				result.Error = Errorf(ErrorNotImplemented, "%s not supported by the controller", cmd.Type)
+			} else {
+				c.mu.Lock()
+				notify := c.notify
+				c.mu.Unlock()
+				if notify != nil {
+					notify(action.ContextID, cmd.TerminationID, cmd.Events)
+				}
+			}
+			replied.Commands = append(replied.Commands, result)
+		}
+		reply.Actions = append(reply.Actions, replied)
+	}
+	return reply
+}
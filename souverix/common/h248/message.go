@@ -0,0 +1,161 @@
+// Package h248 implements the H.248.1 (Megaco) gateway control protocol
+// between the MGCF and its media gateways (Mn interface, 3GPP TS 29.232):
+// the text encoding of transactions with the Add, Modify, Subtract and
+// Notify commands, a UDP transport, and the controller side of the TDM to
+// RTP bearers of calls.
+package h248
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Version is the protocol version of the messages sent
+const Version = 1
+
+// DefaultPort is the port of text encoded H.248 over UDP
+const DefaultPort = 2944
+
+// Special context IDs (H.248.1 section 6.1.1)
+const (
+	ContextNull   uint32 = 0
+	ContextChoose uint32 = 0xfffffffe
+	ContextAll    uint32 = 0xffffffff
+)
+
+// Special termination IDs (H.248.1 section 6.2)
+const (
+	TerminationChoose = "$"
+	TerminationAll    = "*"
+	TerminationRoot   = "ROOT"
+)
+
+// Stream modes of LocalControl descriptors (H.248.1 section 7.1.7)
+const (
+	ModeSendOnly    = "SendOnly"
+	ModeReceiveOnly = "ReceiveOnly"
+	ModeSendReceive = "SendReceive"
+	ModeInactive    = "Inactive"
+	ModeLoopBack    = "LoopBack"
+)
+
+// Error codes (H.248.8)
+const (
+	ErrorBadRequest           = 400
+	ErrorSyntax               = 401
+	ErrorUnknownContext       = 411
+	ErrorUnknownTermination   = 430
+	ErrorNoMatch              = 431
+	ErrorTerminationInUse     = 433
+	ErrorInternal             = 500
+	ErrorNotImplemented       = 501
+	ErrorInsufficientResource = 510
+)
+
+// CommandType is an H.248 command
+type CommandType int
+
+const (
+	CommandAdd CommandType = iota
+	CommandModify
+	CommandSubtract
+	CommandNotify
+)
+
+// commandNames are the long and short names of the commands
+var commandNames = [...][2]string{
+	CommandAdd:      {"Add", "A"},
+	CommandModify:   {"Modify", "MF"},
+	CommandSubtract: {"Subtract", "S"},
+	CommandNotify:   {"Notify", "N"},
+}
+
+// String returns the name of t
+func (t CommandType) String() string {
+	if int(t) < len(commandNames) {
+		return commandNames[t][0]
+	}
+	return fmt.Sprintf("Command(%d)", int(t))
+}
+
+// Error is an H.248 error descriptor
+type Error struct {
+	Code int
+	Text string
+}
+
+// Error implements error
+func (e *Error) Error() string {
+	if e.Text == "" {
+		return "H.248 error " + strconv.Itoa(e.Code)
+	}
+	return fmt.Sprintf("H.248 error %d: %s", e.Code, e.Text)
+}
+
+// Errorf returns an error descriptor
+func Errorf(code int, format string, args ...any) *Error {
+	return &Error{Code: code, Text: fmt.Sprintf(format, args...)}
+}
+
+// Stream is a stream of a Media descriptor: its mode, and the local and
+// remote session descriptions of RTP terminations
+type Stream struct {
+	ID     int
+	Mode   string
+	Local  string // SDP
+	Remote string // SDP
+}
+
+// Command is a command of a request, or its reply
+type Command struct {
+	Type          CommandType
+	TerminationID string
+	Streams       []Stream
+
+	// Events requested on Add and Modify, observed on Notify
+	RequestID uint32
+	Events    []string
+
+	// Error of the command in a reply
+	Error *Error
+}
+
+// Action is the commands of a transaction on a context
+type Action struct {
+	ContextID uint32
+	Commands  []Command
+}
+
+// Transaction is a transaction request, or its reply
+type Transaction struct {
+	ID      uint32
+	Reply   bool
+	Actions []Action
+
+	// Error of the whole transaction in a reply
+	Error *Error
+}
+
+// Err returns the error of a reply: the transaction error, or the error of
+// its first failed command
+func (t *Transaction) Err() error {
+	if t.Error != nil {
+		return t.Error
+	}
+	for _, action := range t.Actions {
+		for _, cmd := range action.Commands {
+			if cmd.Error != nil {
+				return cmd.Error
+			}
+		}
+	}
+	return nil
+}
+
+// Message is an H.248 message: the transactions of one sender, identified
+// by its message ID (MID)
+type Message struct {
+	Version      int
+	MID          string
+	Transactions []*Transaction
+}
@@ -0,0 +1,308 @@
+package h248
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRetransmit is the interval between retransmissions of an
+	// unanswered request over UDP
+	defaultRetransmit = 500 * time.Millisecond
+
+	// defaultRequestTimeout bounds requests whose context has no deadline
+	defaultRequestTimeout = 5 * time.Second
+
+	// replyLifetime is how long replies are kept to answer retransmitted
+	// requests, the LONG-TIMER of H.248.1 section D.1.1
+	replyLifetime = 30 * time.Second
+
+	maxMessageSize = 65507
+)
+
+// ErrPeerClosed is returned for requests on a closed peer
+var ErrPeerClosed = errors.New("h248 peer closed")
+
+// Handler answers the transaction requests received by a peer
+type Handler interface {
+	ServeH248(p *Peer, mid string, req *Transaction) *Transaction
+}
+
+// HandlerFunc adapts a function to Handler
+type HandlerFunc func(p *Peer, mid string, req *Transaction) *Transaction
+
+// ServeH248 calls f(p, mid, req)
+func (f HandlerFunc) ServeH248(p *Peer, mid string, req *Transaction) *Transaction {
+	return f(p, mid, req)
+}
+
+// pendingRequest is a request waiting for its reply from the address it
+// was sent to
+type pendingRequest struct {
+	to      *net.UDPAddr
+	replies chan *Transaction
+}
+
+// sentReply is a reply kept for retransmitted requests; message is nil
+// while the request is being handled
+type sentReply struct {
+	message []byte
+	expires time.Time
+}
+
+// Peer sends and answers H.248 transactions over UDP. A media gateway
+// controller and a media gateway are both peers, each sending requests
+// (Add, Modify and Subtract one way, Notify the other) and answering those
+// of the other.
+type Peer struct {
+	conn       net.PacketConn
+	mid        string
+	handler    Handler
+	retransmit time.Duration
+
+	// sources are the addresses requests are accepted from, when
+	// restricted
+	sources    []*net.UDPAddr
+	restricted bool
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]*pendingRequest
+	replies map[string]*sentReply // key: sender address and transaction ID
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPeer creates a peer on conn, identified by mid in the messages it
+// sends. Requests from any address are answered by handler, or rejected
+// when nil.
+func NewPeer(conn net.PacketConn, mid string, handler Handler) *Peer {
+	return newPeer(conn, mid, handler, nil, false)
+}
+
+// NewPeerFrom creates a peer like NewPeer that only answers the requests
+// sent from sources, UDP addresses; those of other addresses are dropped
+func NewPeerFrom(conn net.PacketConn, mid string, handler Handler, sources ...string) (*Peer, error) {
+	addrs, err := resolveSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	return newPeer(conn, mid, handler, addrs, true), nil
+}
+
+// newPeer creates a peer, answering only the requests of sources when
+// restricted
+func newPeer(conn net.PacketConn, mid string, handler Handler, sources []*net.UDPAddr, restricted bool) *Peer {
+	p := &Peer{
+		conn:       conn,
+		mid:        mid,
+		handler:    handler,
+		retransmit: defaultRetransmit,
+		sources:    sources,
+		restricted: restricted,
+		pending:    make(map[uint32]*pendingRequest),
+		replies:    make(map[string]*sentReply),
+		done:       make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+// resolveSources resolves the UDP addresses of sources
+func resolveSources(sources []string) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, source := range sources {
+		addr, err := net.ResolveUDPAddr("udp", source)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Listen creates a peer on a UDP address
+func Listen(address, mid string, handler Handler) (*Peer, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewPeer(conn, mid, handler), nil
+}
+
+// Addr returns the local address of the peer
+func (p *Peer) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+// MID returns the message ID of the peer
+func (p *Peer) MID() string {
+	return p.mid
+}
+
+// Close closes the peer. Pending requests fail with ErrPeerClosed.
+func (p *Peer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		err = p.conn.Close()
+	})
+	return err
+}
+
+// Request sends a transaction request to the peer at address and returns
+// its reply. The error of a failed reply is returned with it.
+func (p *Peer) Request(ctx context.Context, address string, actions ...Action) (*Transaction, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+
+	replies := make(chan *Transaction, 1)
+	p.mu.Lock()
+	p.nextID++
+	if p.nextID == 0 {
+		p.nextID = 1
+	}
+	id := p.nextID
+	p.pending[id] = &pendingRequest{to: addr, replies: replies}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	data, err := (&Message{MID: p.mid, Transactions: []*Transaction{{ID: id, Actions: actions}}}).Encode()
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(p.retransmit)
+	defer ticker.Stop()
+	for {
+		if _, err := p.conn.WriteTo(data, addr); err != nil {
+			return nil, err
+		}
+		select {
+		case reply := <-replies:
+			return reply, reply.Err()
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.done:
+			return nil, ErrPeerClosed
+		}
+	}
+}
+
+// readLoop receives messages until the peer is closed
+func (p *Peer) readLoop() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			p.Close()
+			return
+		}
+		m, err := Decode(buf[:n])
+		if err != nil {
+			// Undecodable messages have no transaction to answer
+			continue
+		}
+		for _, t := range m.Transactions {
+			if t.Reply {
+				p.handleReply(from, t)
+			} else {
+				p.handleRequest(from, m.MID, t)
+			}
+		}
+	}
+}
+
+// handleReply passes a reply to its pending request. Replies from another
+// address than the request was sent to are dropped.
+func (p *Peer) handleReply(from net.Addr, t *Transaction) {
+	p.mu.Lock()
+	req := p.pending[t.ID]
+	p.mu.Unlock()
+	if req == nil || !sameAddr(req.to, from) {
+		return
+	}
+	select {
+	case req.replies <- t:
+	default:
+	}
+}
+
+// handleRequest answers a request, once: retransmissions get the same
+// reply, or none while the request is being handled. Requests from
+// addresses the peer does not accept are dropped.
+func (p *Peer) handleRequest(from net.Addr, mid string, req *Transaction) {
+	if p.restricted && !p.accepts(from) {
+		return
+	}
+	key := from.String() + "/" + strconv.FormatUint(uint64(req.ID), 10)
+	now := time.Now()
+	p.mu.Lock()
+	for k, sent := range p.replies {
+		if sent.message != nil && now.After(sent.expires) {
+			delete(p.replies, k)
+		}
+	}
+	sent := p.replies[key]
+	if sent == nil {
+		p.replies[key] = &sentReply{}
+	}
+	p.mu.Unlock()
+	if sent != nil {
+		if sent.message != nil {
+			p.conn.WriteTo(sent.message, from)
+		}
+		return
+	}
+
+	go func() {
+		var reply *Transaction
+		if p.handler != nil {
+			reply = p.handler.ServeH248(p, mid, req)
+		}
+		if reply == nil {
+			reply = &Transaction{Error: Errorf(ErrorNotImplemented, "no handler")}
+		}
+		reply.ID, reply.Reply = req.ID, true
+		data, err := (&Message{MID: p.mid, Transactions: []*Transaction{reply}}).Encode()
+		if err != nil {
+			data, _ = (&Message{MID: p.mid, Transactions: []*Transaction{{ID: req.ID, Reply: true, Error: Errorf(ErrorInternal, "%v", err)}}}).Encode()
+		}
+		p.mu.Lock()
+		p.replies[key] = &sentReply{message: data, expires: time.Now().Add(replyLifetime)}
+		p.mu.Unlock()
+		p.conn.WriteTo(data, from)
+	}()
+}
+
+// accepts reports whether requests from addr are answered
+func (p *Peer) accepts(addr net.Addr) bool {
+	for _, source := range p.sources {
+		if sameAddr(source, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddr reports whether addr is the UDP address a
+func sameAddr(a *net.UDPAddr, addr net.Addr) bool {
+	b, ok := addr.(*net.UDPAddr)
+	return ok && a.Port == b.Port && a.IP.Equal(b.IP)
+}
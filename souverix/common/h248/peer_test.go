@@ -0,0 +1,362 @@
+package h248
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listen creates a peer on a loopback address, closed with the test
+func listen(t *testing.T, mid string, handler Handler) *Peer {
+	t.Helper()
+	p, err := Listen("127.0.0.1:0", mid, handler)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// echoHandler answers requests with their commands, counting them
+func echoHandler(calls *int32) Handler {
+	return HandlerFunc(func(p *Peer, mid string, req *Transaction) *Transaction {
+		atomic.AddInt32(calls, 1)
+		reply := &Transaction{}
+		for _, action := range req.Actions {
+			replied := Action{ContextID: action.ContextID}
+			for _, cmd := range action.Commands {
+				replied.Commands = append(replied.Commands, Command{Type: cmd.Type, TerminationID: cmd.TerminationID})
+			}
+			reply.Actions = append(reply.Actions, replied)
+		}
+		return reply
+	})
+}
+
+func TestPeer_Request(t *testing.T) {
+	var calls int32
+	mgw := listen(t, "mgw", echoHandler(&calls))
+	mgc := listen(t, "mgc", nil)
+
+	reply, err := mgc.Request(context.Background(), mgw.Addr().String(), Action{
+		ContextID: 4,
+		Commands:  []Command{{Type: CommandModify, TerminationID: "RTP/1"}},
+	})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if !reply.Reply || len(reply.Actions) != 1 || reply.Actions[0].ContextID != 4 {
+		t.Fatalf("Request() = %+v", reply)
+	}
+	if cmds := reply.Actions[0].Commands; len(cmds) != 1 || cmds[0].Type != CommandModify || cmds[0].TerminationID != "RTP/1" {
+		t.Errorf("reply commands = %+v", cmds)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestPeer_RequestError(t *testing.T) {
+	mgw := listen(t, "mgw", HandlerFunc(func(p *Peer, mid string, req *Transaction) *Transaction {
+		return &Transaction{Actions: []Action{{ContextID: 1, Commands: []Command{{
+			Type:          CommandAdd,
+			TerminationID: "TDM/1",
+			Error:         Errorf(ErrorTerminationInUse, "busy"),
+		}}}}}
+	}))
+	mgc := listen(t, "mgc", nil)
+
+	reply, err := mgc.Request(context.Background(), mgw.Addr().String(), Action{
+		ContextID: ContextChoose,
+		Commands:  []Command{{Type: CommandAdd, TerminationID: "TDM/1"}},
+	})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != ErrorTerminationInUse {
+		t.Errorf("Request() error = %v, want error 433", err)
+	}
+	if reply == nil {
+		t.Error("Request() reply = nil, want the failed reply")
+	}
+}
+
+func TestPeer_NoHandler(t *testing.T) {
+	mgw := listen(t, "mgw", nil)
+	mgc := listen(t, "mgc", nil)
+
+	_, err := mgc.Request(context.Background(), mgw.Addr().String(), Action{
+		ContextID: 1,
+		Commands:  []Command{{Type: CommandModify, TerminationID: "RTP/1"}},
+	})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != ErrorNotImplemented {
+		t.Errorf("Request() error = %v, want error 501", err)
+	}
+}
+
+// lossyConn drops the first writes of a connection
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	drop int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drop > 0 {
+		c.drop--
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestPeer_Retransmission(t *testing.T) {
+	var calls int32
+	// The first reply of the gateway is lost: the controller retransmits
+	// its request, answered from the reply cache
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	mgw := NewPeer(&lossyConn{PacketConn: conn, drop: 1}, "mgw", echoHandler(&calls))
+	defer mgw.Close()
+	mgc := listen(t, "mgc", nil)
+	mgc.retransmit = 20 * time.Millisecond
+
+	reply, err := mgc.Request(context.Background(), mgw.Addr().String(), Action{
+		ContextID: 2,
+		Commands:  []Command{{Type: CommandSubtract, TerminationID: TerminationAll}},
+	})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if len(reply.Actions) != 1 || reply.Actions[0].ContextID != 2 {
+		t.Errorf("Request() = %+v", reply)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("handler called %d times, want 1 for a retransmitted request", calls)
+	}
+}
+
+func TestPeer_Timeout(t *testing.T) {
+	// Nothing answers on a closed socket
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	mgc := listen(t, "mgc", nil)
+	mgc.retransmit = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = mgc.Request(ctx, address, Action{ContextID: 1, Commands: []Command{{Type: CommandModify, TerminationID: "RTP/1"}}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request() error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestPeer_Closed(t *testing.T) {
+	mgc := listen(t, "mgc", nil)
+	mgc.Close()
+	_, err := mgc.Request(context.Background(), "127.0.0.1:9", Action{ContextID: 1, Commands: []Command{{Type: CommandModify, TerminationID: "RTP/1"}}})
+	if err == nil {
+		t.Error("Request() error = nil on a closed peer")
+	}
+}
+
+func TestPeer_Sources(t *testing.T) {
+	var calls int32
+	mgc := listen(t, "mgc", nil)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	mgw, err := NewPeerFrom(conn, "mgw", echoHandler(&calls), mgc.Addr().String())
+	if err != nil {
+		t.Fatalf("NewPeerFrom() error = %v", err)
+	}
+	defer mgw.Close()
+	action := Action{ContextID: 1, Commands: []Command{{Type: CommandModify, TerminationID: "RTP/1"}}}
+
+	if _, err := mgc.Request(context.Background(), mgw.Addr().String(), action); err != nil {
+		t.Fatalf("Request() from the MGC error = %v", err)
+	}
+
+	// Requests of other addresses are dropped
+	other := listen(t, "other", nil)
+	other.retransmit = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := other.Request(ctx, mgw.Addr().String(), action); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request() from another address error = %v, want deadline exceeded", err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+
+	if _, err := NewPeerFrom(conn, "mgw", nil, "not an address"); err == nil {
+		t.Error("NewPeerFrom() accepted an invalid source")
+	}
+}
+
+func TestPeer_ReplySource(t *testing.T) {
+	mgw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer mgw.Close()
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer spoofer.Close()
+	mgc := listen(t, "mgc", nil)
+
+	result := make(chan *Transaction, 1)
+	go func() {
+		reply, _ := mgc.Request(context.Background(), mgw.LocalAddr().String(), Action{ContextID: 1, Commands: []Command{{Type: CommandModify, TerminationID: "RTP/1"}}})
+		result <- reply
+	}()
+	buf := make([]byte, maxMessageSize)
+	n, from, err := mgw.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	req, err := Decode(buf[:n])
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	id := req.Transactions[0].ID
+
+	// A reply from another address does not answer the request
+	spoofed, _ := (&Message{MID: "spoofer", Transactions: []*Transaction{{ID: id, Reply: true, Actions: []Action{{ContextID: 66}}}}}).Encode()
+	spoofer.WriteTo(spoofed, from)
+	select {
+	case reply := <-result:
+		t.Fatalf("Request() = %+v, answered by another address", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reply, _ := (&Message{MID: "mgw", Transactions: []*Transaction{{ID: id, Reply: true, Actions: []Action{{ContextID: 1}}}}}).Encode()
+	mgw.WriteTo(reply, from)
+	select {
+	case reply := <-result:
+		if reply == nil || len(reply.Actions) != 1 || reply.Actions[0].ContextID != 1 {
+			t.Errorf("Request() = %+v, want the reply of the gateway", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply of the gateway not received")
+	}
+}
+
+func TestController(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*Transaction
+	)
+	mgw := listen(t, "mgw", HandlerFunc(func(p *Peer, mid string, req *Transaction) *Transaction {
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		action := req.Actions[0]
+		if action.ContextID == ContextChoose {
+			return &Transaction{Actions: []Action{{ContextID: 9, Commands: []Command{
+				{Type: CommandAdd, TerminationID: action.Commands[0].TerminationID},
+				{Type: CommandAdd, TerminationID: "RTP/5", Streams: []Stream{{ID: 1, Local: testSDP}}},
+			}}}}
+		}
+		return &Transaction{Actions: []Action{{ContextID: action.ContextID, Commands: []Command{{
+			Type:          action.Commands[0].Type,
+			TerminationID: action.Commands[0].TerminationID,
+		}}}}}
+	}))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	c := NewController(conn, "mgc", mgw.Addr().String())
+	defer c.Close()
+
+	ctx := context.Background()
+	b, err := c.Setup(ctx, 12, "")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	want := Bearer{ContextID: 9, TDM: "TDM/12", RTP: "RTP/5", LocalSDP: testSDP}
+	if *b != want {
+		t.Errorf("Setup() = %+v, want %+v", *b, want)
+	}
+	if err := c.Connect(ctx, b, testSDP); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if err := c.Release(ctx, b); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 3 {
+		t.Fatalf("gateway got %d requests, want 3", len(requests))
+	}
+	if s := requests[0].Actions[0].Commands[1].Streams; len(s) != 1 || s[0].Mode != ModeSendOnly {
+		t.Errorf("Setup RTP streams = %+v, want SendOnly", s)
+	}
+	connect := requests[1].Actions[0]
+	if connect.ContextID != 9 || connect.Commands[0].Type != CommandModify || connect.Commands[0].TerminationID != "RTP/5" {
+		t.Errorf("Connect action = %+v", connect)
+	} else if s := connect.Commands[0].Streams; len(s) != 1 || s[0].Mode != ModeSendReceive || s[0].Remote != testSDP {
+		t.Errorf("Connect streams = %+v", s)
+	}
+	release := requests[2].Actions[0]
+	if release.ContextID != 9 || release.Commands[0].Type != CommandSubtract || release.Commands[0].TerminationID != TerminationAll {
+		t.Errorf("Release action = %+v", release)
+	}
+}
+
+func TestController_Notify(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	mgw := listen(t, "mgw", nil)
+	c := NewController(conn, "mgc", mgw.Addr().String())
+	defer c.Close()
+	notified := make(chan []string, 1)
+	c.SetNotifyHandler(func(contextID uint32, termination string, events []string) {
+		if contextID == 3 && termination == "TDM/1" {
+			notified <- events
+		}
+	})
+
+	_, err = mgw.Request(context.Background(), conn.LocalAddr().String(), Action{
+		ContextID: 3,
+		Commands:  []Command{{Type: CommandNotify, TerminationID: "TDM/1", RequestID: 1, Events: []string{"al/on"}}},
+	})
+	if err != nil {
+		t.Fatalf("Notify request error = %v", err)
+	}
+	select {
+	case events := <-notified:
+		if len(events) != 1 || events[0] != "al/on" {
+			t.Errorf("notified events = %v", events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notify handler not called")
+	}
+
+	// Other commands are not for the controller
+	_, err = mgw.Request(context.Background(), conn.LocalAddr().String(), Action{
+		ContextID: 3,
+		Commands:  []Command{{Type: CommandAdd, TerminationID: "TDM/1"}},
+	})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != ErrorNotImplemented {
+		t.Errorf("Add to controller error = %v, want error 501", err)
+	}
+}
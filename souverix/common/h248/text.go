@@ -0,0 +1,617 @@
+package h248
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Encode returns the text encoding of the message (H.248.1 annex B), with
+// the long names of tokens
+func (m *Message) Encode() ([]byte, error) {
+	var b bytes.Buffer
+	version := m.Version
+	if version == 0 {
+		version = Version
+	}
+	fmt.Fprintf(&b, "MEGACO/%d %s\n", version, m.MID)
+	for i, t := range m.Transactions {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		keyword := "Transaction"
+		if t.Reply {
+			keyword = "Reply"
+		}
+		fmt.Fprintf(&b, "%s = %d {", keyword, t.ID)
+		if t.Error != nil {
+			b.WriteString("\n\t")
+			writeError(&b, t.Error)
+		}
+		for j, action := range t.Actions {
+			if j > 0 || t.Error != nil {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "\n\tContext = %s {", contextString(action.ContextID))
+			for k, cmd := range action.Commands {
+				if k > 0 {
+					b.WriteString(",")
+				}
+				if err := writeCommand(&b, &cmd); err != nil {
+					return nil, err
+				}
+			}
+			b.WriteString("\n\t}")
+		}
+		b.WriteString("\n}\n")
+	}
+	return b.Bytes(), nil
+}
+
+// contextString returns the text of a context ID
+func contextString(id uint32) string {
+	switch id {
+	case ContextNull:
+		return "-"
+	case ContextChoose:
+		return "$"
+	case ContextAll:
+		return "*"
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// writeCommand writes a command with its descriptors
+func writeCommand(b *bytes.Buffer, cmd *Command) error {
+	if int(cmd.Type) >= len(commandNames) {
+		return fmt.Errorf("invalid H.248 command %d", cmd.Type)
+	}
+	if cmd.TerminationID == "" || strings.ContainsAny(cmd.TerminationID, " \t\r\n{},=\"") {
+		return fmt.Errorf("invalid termination ID %q", cmd.TerminationID)
+	}
+	fmt.Fprintf(b, "\n\t\t%s = %s", cmd.Type, cmd.TerminationID)
+
+	var descriptors []string
+	if cmd.Error != nil {
+		var e bytes.Buffer
+		writeError(&e, cmd.Error)
+		descriptors = append(descriptors, e.String())
+	}
+	if len(cmd.Streams) > 0 {
+		var media bytes.Buffer
+		media.WriteString("Media {")
+		for i, s := range cmd.Streams {
+			if i > 0 {
+				media.WriteString(",")
+			}
+			if err := writeStream(&media, &s); err != nil {
+				return err
+			}
+		}
+		media.WriteString("\n\t\t\t}")
+		descriptors = append(descriptors, media.String())
+	}
+	if len(cmd.Events) > 0 || cmd.RequestID != 0 {
+		keyword := "Events"
+		if cmd.Type == CommandNotify {
+			keyword = "ObservedEvents"
+		}
+		descriptors = append(descriptors, fmt.Sprintf("%s = %d { %s }", keyword, cmd.RequestID, strings.Join(cmd.Events, ", ")))
+	}
+	if len(descriptors) == 0 {
+		return nil
+	}
+	b.WriteString(" {")
+	for i, d := range descriptors {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n\t\t\t")
+		b.WriteString(d)
+	}
+	b.WriteString("\n\t\t}")
+	return nil
+}
+
+// writeStream writes a stream of a Media descriptor. Session descriptions
+// are written as is, one line each.
+func writeStream(b *bytes.Buffer, s *Stream) error {
+	fmt.Fprintf(b, "\n\t\t\t\tStream = %d {", s.ID)
+	var parms []string
+	if s.Mode != "" {
+		parms = append(parms, "LocalControl { Mode = "+s.Mode+" }")
+	}
+	for _, sdp := range []struct{ name, value string }{{"Local", s.Local}, {"Remote", s.Remote}} {
+		if sdp.value == "" {
+			continue
+		}
+		if strings.ContainsAny(sdp.value, "{}") {
+			return fmt.Errorf("invalid %s session description", sdp.name)
+		}
+		lines := strings.Split(strings.TrimRight(sdp.value, "\r\n"), "\n")
+		for i := range lines {
+			lines[i] = strings.TrimRight(lines[i], "\r")
+		}
+		parms = append(parms, sdp.name+" {\n"+strings.Join(lines, "\n")+"\n\t\t\t\t\t}")
+	}
+	for i, p := range parms {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n\t\t\t\t\t")
+		b.WriteString(p)
+	}
+	b.WriteString("\n\t\t\t\t}")
+	return nil
+}
+
+// writeError writes an error descriptor
+func writeError(b *bytes.Buffer, e *Error) {
+	fmt.Fprintf(b, "Error = %d { \"%s\" }", e.Code, strings.ReplaceAll(e.Text, `"`, "'"))
+}
+
+// parser decodes the text encoding of a message
+type parser struct {
+	data []byte
+	pos  int
+}
+
+// Decode decodes the text encoding of a message, with the long or short
+// names of tokens
+func Decode(data []byte) (*Message, error) {
+	p := &parser{data: data}
+	m, err := p.message()
+	if err != nil {
+		return nil, Errorf(ErrorSyntax, "%v at offset %d", err, p.pos)
+	}
+	return m, nil
+}
+
+// skip skips whitespace and comments, which run from ";" to the end of the
+// line
+func (p *parser) skip() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.pos++
+		case c == ';':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next character, 0 at the end
+func (p *parser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.data) {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// expect consumes the character c
+func (p *parser) expect(c byte) error {
+	if p.peek() != c {
+		return fmt.Errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// accept consumes the character c if it is next
+func (p *parser) accept(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// word returns the next token up to a delimiter
+func (p *parser) word() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n{},=\";", rune(p.data[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", fmt.Errorf("expected a token")
+	}
+	return string(p.data[start:p.pos]), nil
+}
+
+// keyword returns the long name of the next token, one of names given as
+// pairs of long and short names
+func (p *parser) keyword(names ...string) (string, error) {
+	w, err := p.word()
+	if err != nil {
+		return "", err
+	}
+	for i, name := range names {
+		if strings.EqualFold(w, name) {
+			return names[i-i%2], nil
+		}
+	}
+	return "", fmt.Errorf("unexpected token %q", w)
+}
+
+// number returns the next token as an unsigned integer
+func (p *parser) number() (uint32, error) {
+	w, err := p.word()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(w, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", w)
+	}
+	return uint32(n), nil
+}
+
+// assign consumes "=" and returns the value token
+func (p *parser) assign() (string, error) {
+	if err := p.expect('='); err != nil {
+		return "", err
+	}
+	return p.word()
+}
+
+// quoted returns the next quoted string
+func (p *parser) quoted() (string, error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	end := bytes.IndexByte(p.data[p.pos:], '"')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := string(p.data[p.pos : p.pos+end])
+	p.pos += end + 1
+	return s, nil
+}
+
+// raw returns the octet string of a Local or Remote descriptor, after its
+// "{", consuming the closing "}". Lines are trimmed and end with CRLF, as
+// in SDP.
+func (p *parser) raw() (string, error) {
+	end := bytes.IndexByte(p.data[p.pos:], '}')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated descriptor")
+	}
+	text := string(p.data[p.pos : p.pos+end])
+	p.pos += end + 1
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			b.WriteString(line)
+			b.WriteString("\r\n")
+		}
+	}
+	return b.String(), nil
+}
+
+// message decodes a message header and its transactions
+func (p *parser) message() (*Message, error) {
+	header, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	name, version, ok := strings.Cut(header, "/")
+	if !ok || (!strings.EqualFold(name, "MEGACO") && name != "!") {
+		return nil, fmt.Errorf("not an H.248 message")
+	}
+	m := &Message{}
+	if m.Version, err = strconv.Atoi(version); err != nil || m.Version < 1 {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+	if m.MID, err = p.word(); err != nil {
+		return nil, err
+	}
+	for p.peek() != 0 {
+		t, err := p.transaction()
+		if err != nil {
+			return nil, err
+		}
+		m.Transactions = append(m.Transactions, t)
+	}
+	if len(m.Transactions) == 0 {
+		return nil, fmt.Errorf("no transaction")
+	}
+	return m, nil
+}
+
+// transaction decodes a transaction request or reply
+func (p *parser) transaction() (*Transaction, error) {
+	keyword, err := p.keyword("Transaction", "T", "Reply", "P")
+	if err != nil {
+		return nil, err
+	}
+	t := &Transaction{Reply: keyword == "Reply"}
+	if err := p.expect('='); err != nil {
+		return nil, err
+	}
+	if t.ID, err = p.number(); err != nil {
+		return nil, err
+	}
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	for !p.accept('}') {
+		if len(t.Actions) > 0 || t.Error != nil {
+			if err := p.expect(','); err != nil {
+				return nil, err
+			}
+		}
+		keyword, err := p.keyword("Context", "C", "Error", "ER")
+		if err != nil {
+			return nil, err
+		}
+		if keyword == "Error" {
+			if t.Error, err = p.errorDescriptor(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		action, err := p.action()
+		if err != nil {
+			return nil, err
+		}
+		t.Actions = append(t.Actions, action)
+	}
+	return t, nil
+}
+
+// action decodes a context and its commands, after "Context"
+func (p *parser) action() (Action, error) {
+	var action Action
+	id, err := p.assign()
+	if err != nil {
+		return action, err
+	}
+	switch id {
+	case "-":
+		action.ContextID = ContextNull
+	case "$":
+		action.ContextID = ContextChoose
+	case "*":
+		action.ContextID = ContextAll
+	default:
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil || n == 0 || uint32(n) >= ContextChoose {
+			return action, fmt.Errorf("invalid context ID %q", id)
+		}
+		action.ContextID = uint32(n)
+	}
+	if err := p.expect('{'); err != nil {
+		return action, err
+	}
+	for !p.accept('}') {
+		if len(action.Commands) > 0 {
+			if err := p.expect(','); err != nil {
+				return action, err
+			}
+		}
+		cmd, err := p.command()
+		if err != nil {
+			return action, err
+		}
+		action.Commands = append(action.Commands, cmd)
+	}
+	return action, nil
+}
+
+// command decodes a command and its descriptors
+func (p *parser) command() (Command, error) {
+	var cmd Command
+	w, err := p.word()
+	if err != nil {
+		return cmd, err
+	}
+	found := false
+	for t, names := range commandNames {
+		if strings.EqualFold(w, names[0]) || strings.EqualFold(w, names[1]) {
+			cmd.Type, found = CommandType(t), true
+		}
+	}
+	if !found {
+		return cmd, fmt.Errorf("unsupported command %q", w)
+	}
+	if cmd.TerminationID, err = p.assign(); err != nil {
+		return cmd, err
+	}
+	if !p.accept('{') {
+		return cmd, nil
+	}
+	for first := true; !p.accept('}'); first = false {
+		if !first {
+			if err := p.expect(','); err != nil {
+				return cmd, err
+			}
+		}
+		keyword, err := p.keyword("Media", "M", "Events", "E", "ObservedEvents", "OE", "Error", "ER")
+		if err != nil {
+			return cmd, err
+		}
+		switch keyword {
+		case "Media":
+			if cmd.Streams, err = p.media(); err != nil {
+				return cmd, err
+			}
+		case "Events", "ObservedEvents":
+			if cmd.RequestID, cmd.Events, err = p.events(); err != nil {
+				return cmd, err
+			}
+		case "Error":
+			if cmd.Error, err = p.errorDescriptor(); err != nil {
+				return cmd, err
+			}
+		}
+	}
+	return cmd, nil
+}
+
+// media decodes a Media descriptor, after "Media". Stream parameters
+// outside of a Stream descriptor are those of stream 1.
+func (p *parser) media() ([]Stream, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var streams []Stream
+	single := Stream{ID: 1}
+	hasSingle := false
+	for first := true; !p.accept('}'); first = false {
+		if !first {
+			if err := p.expect(','); err != nil {
+				return nil, err
+			}
+		}
+		keyword, err := p.keyword("Stream", "ST", "LocalControl", "O", "Local", "L", "Remote", "R")
+		if err != nil {
+			return nil, err
+		}
+		if keyword != "Stream" {
+			hasSingle = true
+			if err := p.streamParm(keyword, &single); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		id, err := p.assign()
+		if err != nil {
+			return nil, err
+		}
+		s := Stream{}
+		if s.ID, err = strconv.Atoi(id); err != nil {
+			return nil, fmt.Errorf("invalid stream ID %q", id)
+		}
+		if err := p.expect('{'); err != nil {
+			return nil, err
+		}
+		for first := true; !p.accept('}'); first = false {
+			if !first {
+				if err := p.expect(','); err != nil {
+					return nil, err
+				}
+			}
+			keyword, err := p.keyword("LocalControl", "O", "Local", "L", "Remote", "R")
+			if err != nil {
+				return nil, err
+			}
+			if err := p.streamParm(keyword, &s); err != nil {
+				return nil, err
+			}
+		}
+		streams = append(streams, s)
+	}
+	if hasSingle {
+		streams = append([]Stream{single}, streams...)
+	}
+	return streams, nil
+}
+
+// streamParm decodes a LocalControl, Local or Remote descriptor into s
+func (p *parser) streamParm(keyword string, s *Stream) error {
+	if err := p.expect('{'); err != nil {
+		return err
+	}
+	var err error
+	switch keyword {
+	case "Local":
+		s.Local, err = p.raw()
+		return err
+	case "Remote":
+		s.Remote, err = p.raw()
+		return err
+	}
+	// LocalControl: the mode, other properties are ignored
+	for first := true; !p.accept('}'); first = false {
+		if !first {
+			if err := p.expect(','); err != nil {
+				return err
+			}
+		}
+		name, err := p.word()
+		if err != nil {
+			return err
+		}
+		value, err := p.assign()
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(name, "Mode") || strings.EqualFold(name, "MO") {
+			s.Mode = modeName(value)
+		}
+	}
+	return nil
+}
+
+// modeName returns the long name of a stream mode
+func modeName(mode string) string {
+	for _, names := range [][2]string{
+		{ModeSendOnly, "SO"},
+		{ModeReceiveOnly, "RC"},
+		{ModeSendReceive, "SR"},
+		{ModeInactive, "IN"},
+		{ModeLoopBack, "LB"},
+	} {
+		if strings.EqualFold(mode, names[0]) || strings.EqualFold(mode, names[1]) {
+			return names[0]
+		}
+	}
+	return mode
+}
+
+// events decodes the request ID and event names of an Events or
+// ObservedEvents descriptor
+func (p *parser) events() (uint32, []string, error) {
+	if err := p.expect('='); err != nil {
+		return 0, nil, err
+	}
+	id, err := p.number()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := p.expect('{'); err != nil {
+		return 0, nil, err
+	}
+	var events []string
+	for !p.accept('}') {
+		if len(events) > 0 {
+			if err := p.expect(','); err != nil {
+				return 0, nil, err
+			}
+		}
+		event, err := p.word()
+		if err != nil {
+			return 0, nil, err
+		}
+		events = append(events, event)
+	}
+	return id, events, nil
+}
+
+// errorDescriptor decodes an error descriptor, after "Error"
+func (p *parser) errorDescriptor() (*Error, error) {
+	code, err := p.assign()
+	if err != nil {
+		return nil, err
+	}
+	e := &Error{}
+	if e.Code, err = strconv.Atoi(code); err != nil {
+		return nil, fmt.Errorf("invalid error code %q", code)
+	}
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	if p.peek() == '"' {
+		if e.Text, err = p.quoted(); err != nil {
+			return nil, err
+		}
+	}
+	return e, p.expect('}')
+}
@@ -0,0 +1,184 @@
+package h248
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSDP = "v=0\r\nc=IN IP4 192.0.2.1\r\nm=audio 4000 RTP/AVP 0\r\n"
+
+func TestMessage_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{
+			name: "setup request",
+			msg: &Message{Version: 1, MID: "[192.0.2.10]:2944", Transactions: []*Transaction{{
+				ID: 7,
+				Actions: []Action{{
+					ContextID: ContextChoose,
+					Commands: []Command{
+						{Type: CommandAdd, TerminationID: "TDM/12", Streams: []Stream{{ID: 1, Mode: ModeSendReceive}}},
+						{Type: CommandAdd, TerminationID: TerminationChoose, Streams: []Stream{{ID: 1, Mode: ModeSendOnly, Remote: testSDP}}},
+					},
+				}},
+			}}},
+		},
+		{
+			name: "reply with local descriptor",
+			msg: &Message{Version: 1, MID: "mgw1", Transactions: []*Transaction{{
+				ID:    7,
+				Reply: true,
+				Actions: []Action{{
+					ContextID: 3,
+					Commands: []Command{
+						{Type: CommandAdd, TerminationID: "TDM/12"},
+						{Type: CommandAdd, TerminationID: "RTP/1", Streams: []Stream{{ID: 1, Local: testSDP}}},
+					},
+				}},
+			}}},
+		},
+		{
+			name: "subtract all and notify",
+			msg: &Message{Version: 1, MID: "mgw1", Transactions: []*Transaction{
+				{ID: 1, Actions: []Action{{ContextID: 3, Commands: []Command{{Type: CommandSubtract, TerminationID: TerminationAll}}}}},
+				{ID: 2, Actions: []Action{{ContextID: ContextNull, Commands: []Command{{Type: CommandNotify, TerminationID: "TDM/1", RequestID: 5, Events: []string{"al/of", "al/on"}}}}}},
+			}},
+		},
+		{
+			name: "errors",
+			msg: &Message{Version: 1, MID: "mgw1", Transactions: []*Transaction{
+				{ID: 3, Reply: true, Error: &Error{Code: ErrorUnknownContext, Text: "unknown context 9"}},
+				{ID: 4, Reply: true, Actions: []Action{{ContextID: 2, Commands: []Command{{
+					Type:          CommandAdd,
+					TerminationID: "TDM/1",
+					Error:         &Error{Code: ErrorTerminationInUse, Text: "TDM/1 is in context 1"},
+				}}}}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.Encode()
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode() error = %v\n%s", err, data)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("Decode(Encode()) = %+v, want %+v\n%s", got, tt.msg, data)
+			}
+		})
+	}
+}
+
+func TestDecode_ShortForms(t *testing.T) {
+	data := `!/1 [192.0.2.1]:2944 ; MGC
+T=10{C=${A=TDM/3{M{O{MO=SR}}},A=${M{ST=1{O{MO=SO},R{
+v=0
+c=IN IP4 192.0.2.5
+m=audio 5000 RTP/AVP 8
+}}}}}}`
+	m, err := Decode([]byte(data))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if m.Version != 1 || m.MID != "[192.0.2.1]:2944" || len(m.Transactions) != 1 {
+		t.Fatalf("Decode() = %+v", m)
+	}
+	tr := m.Transactions[0]
+	if tr.ID != 10 || tr.Reply || len(tr.Actions) != 1 || tr.Actions[0].ContextID != ContextChoose {
+		t.Fatalf("transaction = %+v", tr)
+	}
+	cmds := tr.Actions[0].Commands
+	if len(cmds) != 2 {
+		t.Fatalf("commands = %+v", cmds)
+	}
+	if cmds[0].Type != CommandAdd || cmds[0].TerminationID != "TDM/3" || len(cmds[0].Streams) != 1 {
+		t.Errorf("commands[0] = %+v", cmds[0])
+	} else if s := cmds[0].Streams[0]; s.ID != 1 || s.Mode != ModeSendReceive {
+		t.Errorf("commands[0] stream = %+v, want stream 1 SendReceive", s)
+	}
+	if cmds[1].TerminationID != TerminationChoose || len(cmds[1].Streams) != 1 {
+		t.Fatalf("commands[1] = %+v", cmds[1])
+	}
+	want := "v=0\r\nc=IN IP4 192.0.2.5\r\nm=audio 5000 RTP/AVP 8\r\n"
+	if s := cmds[1].Streams[0]; s.Mode != ModeSendOnly || s.Remote != want {
+		t.Errorf("commands[1] stream = %+v, want SendOnly with remote %q", s, want)
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"no header", "Transaction = 1 { }"},
+		{"bad version", "MEGACO/x mid\nTransaction = 1 { }"},
+		{"unknown transaction", "MEGACO/1 mid\nPending = 1 { }"},
+		{"unknown command", "MEGACO/1 mid\nTransaction = 1 { Context = 1 { Move = TDM/1 } }"},
+		{"bad context", "MEGACO/1 mid\nTransaction = 1 { Context = x { Add = TDM/1 } }"},
+		{"unterminated", "MEGACO/1 mid\nTransaction = 1 { Context = 1 { Add = TDM/1 "},
+		{"trailing data", "MEGACO/1 mid\nTransaction = 1 { Context = 1 { Add = TDM/1 } } }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode([]byte(tt.data))
+			var e *Error
+			if !errors.As(err, &e) || e.Code != ErrorSyntax {
+				t.Errorf("Decode() error = %v, want syntax error", err)
+			}
+		})
+	}
+}
+
+func TestEncode_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+	}{
+		{"no termination", Command{Type: CommandAdd}},
+		{"termination with space", Command{Type: CommandAdd, TerminationID: "TDM 1"}},
+		{"unknown command", Command{Type: CommandType(42), TerminationID: "TDM/1"}},
+		{"brace in SDP", Command{Type: CommandModify, TerminationID: "RTP/1", Streams: []Stream{{ID: 1, Remote: "v=0 }"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{MID: "mgc", Transactions: []*Transaction{{ID: 1, Actions: []Action{{ContextID: 1, Commands: []Command{tt.cmd}}}}}}
+			if _, err := m.Encode(); err == nil {
+				t.Error("Encode() error = nil")
+			}
+		})
+	}
+}
+
+func TestEncode_DefaultVersion(t *testing.T) {
+	data, err := (&Message{MID: "mgc"}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if !strings.HasPrefix(string(data), "MEGACO/1 mgc") {
+		t.Errorf("Encode() = %q", data)
+	}
+}
+
+func TestTransaction_Err(t *testing.T) {
+	ok := &Transaction{Actions: []Action{{Commands: []Command{{Type: CommandAdd, TerminationID: "TDM/1"}}}}}
+	if err := ok.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+	failed := &Transaction{Actions: []Action{{Commands: []Command{
+		{Type: CommandAdd, TerminationID: "TDM/1"},
+		{Type: CommandAdd, TerminationID: "$", Error: Errorf(ErrorInsufficientResource, "no port")},
+	}}}}
+	var e *Error
+	if err := failed.Err(); !errors.As(err, &e) || e.Code != ErrorInsufficientResource {
+		t.Errorf("Err() = %v, want error 510", err)
+	}
+}
@@ -1,7 +1,17 @@
 package hss
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/cx"
 )
 
 // ServiceProfile represents a subscriber's service profile from HSS
@@ -15,66 +25,315 @@ type ServiceProfile struct {
 	ServingSCSCF   string
 }
 
-// InitialFilterCriteria defines service trigger conditions
+// InitialFilterCriteria defines service trigger conditions. Trigger is the
+// first method of the trigger point; Matches evaluates all of it.
 type InitialFilterCriteria struct {
 	Priority    int
 	Trigger     string
 	ApplicationServer string
+	TriggerPoint *cx.TriggerPoint
+	ProfilePartIndicator *int
+	
+	patterns map[string]*regexp.Regexp // Compiled when the profile is loaded
 }
 
-// HSSClient simulates HSS interactions via Cx interface
+// Cx is the Diameter Cx interface towards the HSS; *cx.Client implements it
+type Cx interface {
+	UserAuthorization(ctx context.Context, req *cx.UAR) (*cx.UAA, error)
+	ServerAssignment(ctx context.Context, req *cx.SAR) (*cx.SAA, error)
+	MultimediaAuth(ctx context.Context, req *cx.MAR) (*cx.MAA, error)
+	LocationInfo(ctx context.Context, req *cx.LIR) (*cx.LIA, error)
+}
+
+// HSSClient queries the HSS over the Cx interface. Service profiles
+// downloaded with SAR are cached; the HSS keeps them current with PPR and
+// removes them with RTR.
 type HSSClient struct {
-	profiles map[string]*ServiceProfile
+	cx         Cx
+	serverName string // SIP URI of the S-CSCF using this client
+	
+	mu       sync.Mutex
+	profiles map[string]*ServiceProfile // By IMPI
 }
 
-// NewHSSClient creates a new HSS client
-func NewHSSClient() *HSSClient {
-	client := &HSSClient{
-		profiles: make(map[string]*ServiceProfile),
-	}
-	
-	// Initialize with a basic VoLTE profile
-	client.profiles["sip:user@example.com"] = &ServiceProfile{
-		IMPI: "user@example.com",
-		IMPU: "sip:user@example.com",
-		SCSCFCapabilities: []string{"volte", "ims"},
-		IFC: []InitialFilterCriteria{
-			{
-				Priority: 10,
-				Trigger:  "INVITE",
-				ApplicationServer: "",
-			},
-		},
-		Barring: false,
-		Registered: true,
-		ServingSCSCF: "scscf.example.com",
-	}
-	
-	return client
+// NewHSSClient creates a client on a Cx interface. serverName is the S-CSCF
+// name sent in SAR and MAR.
+func NewHSSClient(c Cx, serverName string) *HSSClient {
+	return &HSSClient{
+		cx:         c,
+		serverName: serverName,
+		profiles:   make(map[string]*ServiceProfile),
+	}
 }
 
-// GetSCSCFAssignment returns S-CSCF assignment for a user (UAR/UAA)
+// DialHSSClient connects to the HSS at address and returns a client that
+// also answers RTR and PPR from the HSS
+func DialHSSClient(ctx context.Context, address string, config diameter.Config, serverName string) (*HSSClient, error) {
+	client := NewHSSClient(nil, serverName)
+	config.Applications = append(config.Applications, cx.Application)
+	config.Handler = &cx.Handler{SCSCF: client}
+	
+	peer, err := diameter.Dial(ctx, "tcp", address, &config)
+	if err != nil {
+		return nil, err
+	}
+	client.cx = cx.NewClient(peer)
+	return client, nil
+}
+
+// GetSCSCFAssignment returns S-CSCF assignment for a user (UAR/UAA). When no
+// S-CSCF is assigned the first candidate from the server capabilities is
+// returned. Capabilities are the decimal mandatory and optional capability
+// values.
 func (h *HSSClient) GetSCSCFAssignment(impi string) (string, []string, error) {
-	profile, exists := h.profiles[impi]
-	if !exists {
-		return "", nil, fmt.Errorf("user not found: %s", impi)
+	impi, impu := identities(impi)
+	uaa, err := h.cx.UserAuthorization(context.Background(), &cx.UAR{
+		UserName:          impi,
+		PublicIdentity:    impu,
+		AuthorizationType: cx.AuthorizationRegistration,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("UAR failed: %w", err)
+	}
+	if err := uaa.Result.Err(); err != nil {
+		return "", nil, fmt.Errorf("user authorization rejected for %s: %w", impi, err)
 	}
 	
-	return profile.ServingSCSCF, profile.SCSCFCapabilities, nil
+	var capabilities []string
+	scscf := uaa.ServerName
+	if caps := uaa.ServerCapabilities; caps != nil {
+		for _, c := range append(caps.Mandatory, caps.Optional...) {
+			capabilities = append(capabilities, strconv.FormatUint(uint64(c), 10))
+		}
+		if scscf == "" && len(caps.ServerNames) > 0 {
+			scscf = caps.ServerNames[0]
+		}
+	}
+	if scscf == "" {
+		return "", nil, fmt.Errorf("no S-CSCF available for %s", impi)
+	}
+	
+	return scscf, capabilities, nil
 }
 
-// GetServiceProfile returns service profile for a user (SAR/SAA)
+// GetServiceProfile returns service profile for a user (SAR/SAA). Users not
+// registered at this S-CSCF are assigned for unregistered services.
 func (h *HSSClient) GetServiceProfile(impi string) (*ServiceProfile, error) {
+	impi, impu := identities(impi)
+	
+	h.mu.Lock()
 	profile, exists := h.profiles[impi]
-	if !exists {
-		return nil, fmt.Errorf("user not found: %s", impi)
+	h.mu.Unlock()
+	if exists {
+		return profile, nil
+	}
+	
+	ctx := context.Background()
+	req := &cx.SAR{
+		UserName:         impi,
+		PublicIdentities: []string{impu},
+		ServerName:       h.serverName,
+		AssignmentType:   cx.AssignmentNoAssignment,
+	}
+	saa, err := h.cx.ServerAssignment(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("SAR failed: %w", err)
+	}
+	
+	registered := true
+	if saa.Result == cx.Experimental(cx.ResultErrorIdentityNotRegistered) {
+		registered = false
+		req.AssignmentType = cx.AssignmentUnregisteredUser
+		if saa, err = h.cx.ServerAssignment(ctx, req); err != nil {
+			return nil, fmt.Errorf("SAR failed: %w", err)
+		}
+	}
+	if err := saa.Result.Err(); err != nil {
+		return nil, fmt.Errorf("server assignment rejected for %s: %w", impi, err)
+	}
+	
+	profile, err = parseServiceProfile(saa.UserData, impu)
+	if err != nil {
+		return nil, err
+	}
+	profile.Registered = registered
+	profile.ServingSCSCF = h.serverName
+	
+	if registered {
+		h.mu.Lock()
+		h.profiles[impi] = profile
+		h.mu.Unlock()
 	}
 	
 	return profile, nil
 }
 
-// GetAuthVectors returns IMS AKA authentication vectors (MAR/MAA)
+// GetAuthVectors returns authentication data for a user (MAR/MAA): the
+// SIP-Authenticate value (RAND || AUTN) for IMS AKA, or the HA1 for SIP Digest
 func (h *HSSClient) GetAuthVectors(impi string) ([]byte, error) {
-	// Simplified - in real implementation, generate AKA vectors
-	return []byte("AKA_VECTOR"), nil
+	impi, impu := identities(impi)
+	maa, err := h.cx.MultimediaAuth(context.Background(), &cx.MAR{
+		UserName:        impi,
+		PublicIdentity:  impu,
+		ServerName:      h.serverName,
+		NumberAuthItems: 1,
+		AuthScheme:      cx.SchemeUnknown,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MAR failed: %w", err)
+	}
+	if err := maa.Result.Err(); err != nil {
+		return nil, fmt.Errorf("authentication data rejected for %s: %w", impi, err)
+	}
+	if len(maa.AuthItems) == 0 {
+		return nil, fmt.Errorf("no authentication data for %s", impi)
+	}
+	
+	item := maa.AuthItems[0]
+	if item.Digest != nil {
+		return []byte(item.Digest.HA1), nil
+	}
+	return item.Authenticate, nil
+}
+
+// AKAVector is an IMS AKA challenge and the keys agreed with the UE
+type AKAVector struct {
+	RAND []byte
+	AUTN []byte
+	XRES []byte
+	CK   []byte
+	IK   []byte
+}
+
+// GetAKAVector requests one IMS AKA vector for a user (MAR/MAA). resync
+// carries RAND || AUTS after the UE reported a synchronisation failure.
+func (h *HSSClient) GetAKAVector(impi string, resync []byte) (*AKAVector, error) {
+	impi, impu := identities(impi)
+	maa, err := h.cx.MultimediaAuth(context.Background(), &cx.MAR{
+		UserName:        impi,
+		PublicIdentity:  impu,
+		ServerName:      h.serverName,
+		NumberAuthItems: 1,
+		AuthScheme:      cx.SchemeAKAv1MD5,
+		Authorization:   resync,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MAR failed: %w", err)
+	}
+	if err := maa.Result.Err(); err != nil {
+		return nil, fmt.Errorf("authentication data rejected for %s: %w", impi, err)
+	}
+	if len(maa.AuthItems) == 0 {
+		return nil, fmt.Errorf("no authentication data for %s", impi)
+	}
+	
+	item := maa.AuthItems[0]
+	if len(item.Authenticate) != 32 {
+		return nil, fmt.Errorf("invalid SIP-Authenticate length %d for %s", len(item.Authenticate), impi)
+	}
+	return &AKAVector{
+		RAND: item.Authenticate[:16],
+		AUTN: item.Authenticate[16:],
+		XRES: item.Authorization,
+		CK:   item.ConfidentialityKey,
+		IK:   item.IntegrityKey,
+	}, nil
+}
+
+// RegistrationTermination drops cached profiles on a RTR from the HSS
+func (h *HSSClient) RegistrationTermination(ctx context.Context, req *cx.RTR) *cx.RTA {
+	h.mu.Lock()
+	delete(h.profiles, req.UserName)
+	h.mu.Unlock()
+	
+	return &cx.RTA{Result: cx.Success}
+}
+
+// PushProfile replaces a cached profile on a PPR from the HSS
+func (h *HSSClient) PushProfile(ctx context.Context, req *cx.PPR) *cx.PPA {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	
+	current, exists := h.profiles[req.UserName]
+	if !exists {
+		return &cx.PPA{Result: cx.Experimental(cx.ResultErrorUserUnknown)}
+	}
+	if len(req.UserData) == 0 {
+		return &cx.PPA{Result: cx.Success}
+	}
+	
+	profile, err := parseServiceProfile(req.UserData, current.IMPU)
+	if err != nil {
+		return &cx.PPA{Result: cx.Experimental(cx.ResultErrorNotSupportedUserData)}
+	}
+	profile.Registered = current.Registered
+	profile.ServingSCSCF = current.ServingSCSCF
+	h.profiles[req.UserName] = profile
+	
+	return &cx.PPA{Result: cx.Success}
+}
+
+// parseServiceProfile converts User-Data into the service profile of impu
+func parseServiceProfile(userData []byte, impu string) (*ServiceProfile, error) {
+	if len(userData) == 0 {
+		return nil, errors.New("HSS returned no user data")
+	}
+	subscription, err := cx.ParseIMSSubscription(userData)
+	if err != nil {
+		return nil, err
+	}
+	
+	profile := &ServiceProfile{
+		IMPI: subscription.PrivateID,
+		IMPU: impu,
+	}
+	for _, sp := range subscription.ServiceProfiles {
+		found := false
+		for _, id := range sp.PublicIdentities {
+			if id.Identity == impu {
+				found = true
+				profile.Barring = id.BarringIndication
+			}
+		}
+		if !found && len(subscription.ServiceProfiles) > 1 {
+			continue
+		}
+		
+		for _, ifc := range sp.InitialFilterCriteria {
+			trigger := ""
+			if ifc.TriggerPoint != nil {
+				for _, spt := range ifc.TriggerPoint.SPT {
+					if spt.Method != "" {
+						trigger = spt.Method
+						break
+					}
+				}
+			}
+			criteria := InitialFilterCriteria{
+				Priority:          ifc.Priority,
+				Trigger:           trigger,
+				ApplicationServer: ifc.ApplicationServer.ServerName,
+				TriggerPoint:      ifc.TriggerPoint,
+				ProfilePartIndicator: ifc.ProfilePartIndicator,
+			}
+			criteria.compilePatterns()
+			profile.IFC = append(profile.IFC, criteria)
+		}
+	}
+	sort.SliceStable(profile.IFC, func(i, j int) bool {
+		return profile.IFC[i].Priority < profile.IFC[j].Priority
+	})
+	
+	return profile, nil
+}
+
+// identities derives the private and public identity from a user identity:
+// a SIP or tel URI is the public identity, anything else the private one
+func identities(id string) (impi, impu string) {
+	for _, scheme := range []string{"sip:", "sips:", "tel:"} {
+		if strings.HasPrefix(id, scheme) {
+			return strings.TrimPrefix(id, scheme), id
+		}
+	}
+	return id, "sip:" + id
 }
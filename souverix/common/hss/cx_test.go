@@ -0,0 +1,236 @@
+package hss
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// fakeCx answers Cx requests for one subscriber
+type fakeCx struct {
+	registered bool
+	sars       []*cx.SAR
+	mars       []*cx.MAR
+	uaa        *cx.UAA
+}
+
+func (f *fakeCx) UserAuthorization(ctx context.Context, req *cx.UAR) (*cx.UAA, error) {
+	if f.uaa != nil {
+		return f.uaa, nil
+	}
+	return &cx.UAA{
+		Result:             cx.Experimental(cx.ResultFirstRegistration),
+		ServerCapabilities: &cx.ServerCapabilities{Mandatory: []uint32{1}, ServerNames: []string{"sip:scscf1.ims.test"}},
+	}, nil
+}
+
+func (f *fakeCx) ServerAssignment(ctx context.Context, req *cx.SAR) (*cx.SAA, error) {
+	f.sars = append(f.sars, req)
+	if req.AssignmentType == cx.AssignmentNoAssignment && !f.registered {
+		return &cx.SAA{Result: cx.Experimental(cx.ResultErrorIdentityNotRegistered)}, nil
+	}
+	return &cx.SAA{Result: cx.Success, UserData: testUserData("INVITE")}, nil
+}
+
+func (f *fakeCx) MultimediaAuth(ctx context.Context, req *cx.MAR) (*cx.MAA, error) {
+	f.mars = append(f.mars, req)
+	if req.AuthScheme == cx.SchemeAKAv1MD5 {
+		return &cx.MAA{
+			Result: cx.Success,
+			AuthItems: []cx.AuthItem{{
+				Scheme:             cx.SchemeAKAv1MD5,
+				Authenticate:       append(bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)...),
+				Authorization:      bytes.Repeat([]byte{3}, 8),
+				ConfidentialityKey: bytes.Repeat([]byte{4}, 16),
+				IntegrityKey:       bytes.Repeat([]byte{5}, 16),
+			}},
+		}, nil
+	}
+	return &cx.MAA{
+		Result: cx.Success,
+		AuthItems: []cx.AuthItem{{
+			Scheme: cx.SchemeSIPDigest,
+			Digest: &cx.DigestAuthenticate{Realm: "ims.test", HA1: "0123456789abcdef"},
+		}},
+	}, nil
+}
+
+func (f *fakeCx) LocationInfo(ctx context.Context, req *cx.LIR) (*cx.LIA, error) {
+	return &cx.LIA{Result: cx.Success, ServerName: "sip:scscf1.ims.test"}, nil
+}
+
+func testUserData(method string) []byte {
+	data, _ := (&cx.IMSSubscription{
+		PrivateID: "alice@ims.test",
+		ServiceProfiles: []cx.ServiceProfile{{
+			PublicIdentities: []cx.PublicIdentity{{Identity: "sip:alice@ims.test"}},
+			InitialFilterCriteria: []cx.InitialFilterCriteria{{
+				Priority:          10,
+				TriggerPoint:      &cx.TriggerPoint{SPT: []cx.SPT{{Method: method}}},
+				ApplicationServer: cx.ApplicationServer{ServerName: "sip:as.ims.test"},
+			}},
+		}},
+	}).Marshal()
+	return data
+}
+
+func TestHSSClient_GetSCSCFAssignment(t *testing.T) {
+	tests := []struct {
+		name    string
+		uaa     *cx.UAA
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "first registration picks a candidate",
+			want: "sip:scscf1.ims.test",
+		},
+		{
+			name: "subsequent registration returns the assigned S-CSCF",
+			uaa:  &cx.UAA{Result: cx.Experimental(cx.ResultSubsequentRegistration), ServerName: "sip:scscf2.ims.test"},
+			want: "sip:scscf2.ims.test",
+		},
+		{
+			name:    "unknown user",
+			uaa:     &cx.UAA{Result: cx.Experimental(cx.ResultErrorUserUnknown)},
+			wantErr: true,
+		},
+		{
+			name:    "no candidate",
+			uaa:     &cx.UAA{Result: cx.Experimental(cx.ResultFirstRegistration)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewHSSClient(&fakeCx{uaa: tt.uaa}, "sip:scscf1.ims.test")
+			scscf, _, err := client.GetSCSCFAssignment("sip:alice@ims.test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetSCSCFAssignment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if scscf != tt.want {
+				t.Errorf("GetSCSCFAssignment() = %q, want %q", scscf, tt.want)
+			}
+		})
+	}
+}
+
+func TestHSSClient_GetServiceProfile(t *testing.T) {
+	t.Run("registered user", func(t *testing.T) {
+		fake := &fakeCx{registered: true}
+		client := NewHSSClient(fake, "sip:scscf1.ims.test")
+
+		profile, err := client.GetServiceProfile("sip:alice@ims.test")
+		if err != nil {
+			t.Fatalf("GetServiceProfile() error = %v", err)
+		}
+		if profile.IMPI != "alice@ims.test" || !profile.Registered || len(profile.IFC) != 1 || profile.IFC[0].Trigger != "INVITE" {
+			t.Errorf("GetServiceProfile() = %+v", profile)
+		}
+
+		// The profile is cached after the first download
+		client.GetServiceProfile("sip:alice@ims.test")
+		if len(fake.sars) != 1 {
+			t.Errorf("%d SARs sent, want 1", len(fake.sars))
+		}
+	})
+
+	t.Run("unregistered user", func(t *testing.T) {
+		fake := &fakeCx{}
+		client := NewHSSClient(fake, "sip:scscf1.ims.test")
+
+		profile, err := client.GetServiceProfile("sip:alice@ims.test")
+		if err != nil {
+			t.Fatalf("GetServiceProfile() error = %v", err)
+		}
+		if profile.Registered {
+			t.Error("unregistered user reported as registered")
+		}
+		if len(fake.sars) != 2 || fake.sars[1].AssignmentType != cx.AssignmentUnregisteredUser {
+			t.Errorf("SARs = %+v, want NO_ASSIGNMENT then UNREGISTERED_USER", fake.sars)
+		}
+	})
+}
+
+func TestHSSClient_GetAuthVectors(t *testing.T) {
+	client := NewHSSClient(&fakeCx{}, "sip:scscf1.ims.test")
+	data, err := client.GetAuthVectors("alice@ims.test")
+	if err != nil {
+		t.Fatalf("GetAuthVectors() error = %v", err)
+	}
+	if string(data) != "0123456789abcdef" {
+		t.Errorf("GetAuthVectors() = %q, want the digest HA1", data)
+	}
+}
+
+func TestHSSClient_GetAKAVector(t *testing.T) {
+	fake := &fakeCx{}
+	client := NewHSSClient(fake, "sip:scscf1.ims.test")
+	resync := bytes.Repeat([]byte{9}, 30)
+
+	v, err := client.GetAKAVector("alice@ims.test", resync)
+	if err != nil {
+		t.Fatalf("GetAKAVector() error = %v", err)
+	}
+	if !bytes.Equal(v.RAND, bytes.Repeat([]byte{1}, 16)) || !bytes.Equal(v.AUTN, bytes.Repeat([]byte{2}, 16)) {
+		t.Errorf("RAND/AUTN = %x/%x", v.RAND, v.AUTN)
+	}
+	if len(v.XRES) != 8 || len(v.CK) != 16 || len(v.IK) != 16 {
+		t.Errorf("vector = %+v", v)
+	}
+	if mar := fake.mars[0]; mar.AuthScheme != cx.SchemeAKAv1MD5 || !bytes.Equal(mar.Authorization, resync) {
+		t.Errorf("MAR = %+v", mar)
+	}
+}
+
+func TestHSSClient_HSSInitiated(t *testing.T) {
+	client := NewHSSClient(&fakeCx{registered: true}, "sip:scscf1.ims.test")
+	ctx := context.Background()
+
+	if ppa := client.PushProfile(ctx, &cx.PPR{UserName: "alice@ims.test"}); ppa.Result != cx.Experimental(cx.ResultErrorUserUnknown) {
+		t.Errorf("PPR for an uncached user Result = %+v", ppa.Result)
+	}
+
+	client.GetServiceProfile("sip:alice@ims.test")
+	ppa := client.PushProfile(ctx, &cx.PPR{UserName: "alice@ims.test", UserData: testUserData("MESSAGE")})
+	if ppa.Result.Err() != nil {
+		t.Fatalf("PushProfile() Result = %+v", ppa.Result)
+	}
+	profile, _ := client.GetServiceProfile("sip:alice@ims.test")
+	if profile.IFC[0].Trigger != "MESSAGE" || !profile.Registered {
+		t.Errorf("profile after PPR = %+v", profile)
+	}
+
+	if rta := client.RegistrationTermination(ctx, &cx.RTR{UserName: "alice@ims.test"}); rta.Result != cx.Success {
+		t.Errorf("RegistrationTermination() Result = %+v", rta.Result)
+	}
+	client.mu.Lock()
+	_, cached := client.profiles["alice@ims.test"]
+	client.mu.Unlock()
+	if cached {
+		t.Error("profile still cached after RTR")
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	tests := []struct {
+		id, impi, impu string
+	}{
+		{"sip:alice@ims.test", "alice@ims.test", "sip:alice@ims.test"},
+		{"tel:+15145550001", "+15145550001", "tel:+15145550001"},
+		{"alice@ims.test", "alice@ims.test", "sip:alice@ims.test"},
+	}
+	for _, tt := range tests {
+		impi, impu := identities(tt.id)
+		if impi != tt.impi || impu != tt.impu {
+			t.Errorf("identities(%q) = %q, %q, want %q, %q", tt.id, impi, impu, tt.impi, tt.impu)
+		}
+	}
+}
+
+var _ Cx = (*cx.Client)(nil)
+var _ diameter.Handler = (*cx.Handler)(nil)
@@ -0,0 +1,139 @@
+package hss
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/dasmlab/souverix/common/sip"
+)
+
+// compilePatterns compiles the regular expressions of the trigger point
+// once, when the service profile is loaded. An invalid expression is kept
+// as nil and matches nothing.
+func (f *InitialFilterCriteria) compilePatterns() {
+	f.patterns = make(map[string]*regexp.Regexp)
+	if f.TriggerPoint == nil {
+		return
+	}
+	for _, spt := range f.TriggerPoint.SPT {
+		patterns := []string{spt.RequestURI}
+		if spt.SIPHeader != nil {
+			patterns = append(patterns, spt.SIPHeader.Content)
+		}
+		if spt.SessionDescription != nil {
+			patterns = append(patterns, spt.SessionDescription.Content)
+		}
+		for _, pattern := range patterns {
+			if _, seen := f.patterns[pattern]; pattern == "" || seen {
+				continue
+			}
+			f.patterns[pattern], _ = regexp.Compile(pattern)
+		}
+	}
+}
+
+// Matches reports whether the criteria apply to msg for a served user in
+// sessionCase, one of the cx.SessionCase values (TS 29.228 annex B).
+// Service point triggers sharing a group form a clause: in conjunctive
+// normal form the clauses are ORs joined by AND, otherwise ANDs joined by
+// OR. Criteria without a trigger point always match.
+func (f *InitialFilterCriteria) Matches(msg *sip.Message, sessionCase int, registered bool) bool {
+	if f.ProfilePartIndicator != nil {
+		if (*f.ProfilePartIndicator == cx.ProfilePartRegistered) != registered {
+			return false
+		}
+	}
+	tp := f.TriggerPoint
+	if tp == nil || len(tp.SPT) == 0 {
+		return true
+	}
+
+	clauses := make(map[int]bool)
+	var order []int
+	for _, spt := range tp.SPT {
+		result := f.sptMatches(spt, msg, sessionCase)
+		for _, group := range spt.Group {
+			current, seen := clauses[group]
+			switch {
+			case !seen:
+				order = append(order, group)
+				clauses[group] = result
+			case tp.ConditionTypeCNF:
+				clauses[group] = current || result
+			default:
+				clauses[group] = current && result
+			}
+		}
+	}
+
+	for _, group := range order {
+		if tp.ConditionTypeCNF && !clauses[group] {
+			return false
+		}
+		if !tp.ConditionTypeCNF && clauses[group] {
+			return true
+		}
+	}
+	return tp.ConditionTypeCNF
+}
+
+// sptMatches evaluates a single service point trigger
+func (f *InitialFilterCriteria) sptMatches(spt cx.SPT, msg *sip.Message, sessionCase int) bool {
+	var result bool
+	switch {
+	case spt.Method != "":
+		result = strings.EqualFold(msg.Method, spt.Method)
+	case spt.RequestURI != "":
+		result = f.match(spt.RequestURI, msg.URI)
+	case spt.SIPHeader != nil:
+		value, present := headerValue(msg, spt.SIPHeader.Header)
+		result = present && (spt.SIPHeader.Content == "" || f.match(spt.SIPHeader.Content, value))
+	case spt.SessionCase != nil:
+		result = *spt.SessionCase == sessionCase
+	case spt.SessionDescription != nil:
+		for _, line := range strings.Split(msg.Body, "\n") {
+			kind, value, ok := strings.Cut(strings.TrimRight(line, "\r"), "=")
+			if !ok || kind != spt.SessionDescription.Line {
+				continue
+			}
+			if spt.SessionDescription.Content == "" || f.match(spt.SessionDescription.Content, value) {
+				result = true
+			}
+		}
+	}
+	if spt.ConditionNegated {
+		return !result
+	}
+	return result
+}
+
+// match reports whether value matches the compiled pattern
+func (f *InitialFilterCriteria) match(pattern, value string) bool {
+	re := f.patterns[pattern]
+	return re != nil && re.MatchString(value)
+}
+
+// headerValue returns a header of msg, whatever its case
+func headerValue(msg *sip.Message, name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case "from":
+		return msg.From, msg.From != ""
+	case "to":
+		return msg.To, msg.To != ""
+	case "call-id":
+		return msg.CallID, msg.CallID != ""
+	case "cseq":
+		return msg.CSeq, msg.CSeq != ""
+	case "contact":
+		return msg.Contact, msg.Contact != ""
+	case "route":
+		return strings.Join(msg.Route, ","), len(msg.Route) > 0
+	}
+	for k, v := range msg.Headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
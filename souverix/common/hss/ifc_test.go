@@ -0,0 +1,82 @@
+package hss
+
+import (
+	"testing"
+
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/dasmlab/souverix/common/sip"
+)
+
+func TestInitialFilterCriteria_Matches(t *testing.T) {
+	invite := sip.NewINVITE("sip:alice@ims.test", "sip:bob@ims.test", "call-1")
+	invite.Headers["Accept-Contact"] = "*;+g.3gpp.icsi-ref=\"urn%3Aurn-7%3A3gpp-service.ims.icsi.mmtel\""
+	invite.Body = "v=0\r\nm=audio 4000 RTP/AVP 0\r\n"
+
+	originating, terminating := cx.SessionCaseOriginating, cx.SessionCaseTerminatingRegistered
+	unregistered := cx.ProfilePartUnregistered
+	method := func(m string, group int) cx.SPT {
+		return cx.SPT{Method: m, Group: []int{group}}
+	}
+
+	tests := []struct {
+		name string
+		ifc  InitialFilterCriteria
+		want bool
+	}{
+		{name: "no trigger point", want: true},
+		{name: "method", ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{SPT: []cx.SPT{method("INVITE", 0)}}}, want: true},
+		{name: "other method", ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{SPT: []cx.SPT{method("MESSAGE", 0)}}}, want: false},
+		{
+			name: "CNF: (INVITE or MESSAGE) and originating",
+			ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{ConditionTypeCNF: true, SPT: []cx.SPT{
+				method("INVITE", 0), method("MESSAGE", 0), {SessionCase: &originating, Group: []int{1}},
+			}}},
+			want: true,
+		},
+		{
+			name: "CNF: INVITE and terminating",
+			ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{ConditionTypeCNF: true, SPT: []cx.SPT{
+				method("INVITE", 0), {SessionCase: &terminating, Group: []int{1}},
+			}}},
+			want: false,
+		},
+		{
+			name: "DNF: INVITE and audio",
+			ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{SPT: []cx.SPT{
+				method("INVITE", 0), {SessionDescription: &cx.SessionDescription{Line: "m", Content: "^audio"}, Group: []int{0}},
+			}}},
+			want: true,
+		},
+		{
+			name: "header content",
+			ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{SPT: []cx.SPT{
+				{SIPHeader: &cx.SIPHeader{Header: "accept-contact", Content: "mmtel"}, Group: []int{0}},
+			}}},
+			want: true,
+		},
+		{
+			name: "negated request URI",
+			ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{SPT: []cx.SPT{
+				{RequestURI: "^sip:bob@", ConditionNegated: true, Group: []int{0}},
+			}}},
+			want: false,
+		},
+		{
+			name: "invalid expression",
+			ifc: InitialFilterCriteria{TriggerPoint: &cx.TriggerPoint{SPT: []cx.SPT{
+				{RequestURI: "(", Group: []int{0}},
+			}}},
+			want: false,
+		},
+		{name: "unregistered profile part", ifc: InitialFilterCriteria{ProfilePartIndicator: &unregistered}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ifc.compilePatterns()
+			if got := tt.ifc.Matches(invite, cx.SessionCaseOriginating, true); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
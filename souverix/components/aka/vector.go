@@ -0,0 +1,125 @@
+package aka
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// sqnMask keeps sequence numbers to 48 bits
+	sqnMask = 1<<48 - 1
+
+	// indBits is the length of the IND part of SQN = SEQ || IND
+	// (TS 33.102 Annex C.3.2)
+	indBits = 5
+
+	// AUTSLen is the length of AUTS = SQN_MS xor AK* || MAC-S
+	AUTSLen = 14
+)
+
+// ErrInvalidAUTS is returned when the MAC-S of a resynchronisation token
+// does not verify
+var ErrInvalidAUTS = errors.New("aka: AUTS MAC-S verification failed")
+
+// Vector is an IMS AKA authentication vector (TS 33.102 section 6.3.2)
+type Vector struct {
+	RAND []byte
+	AUTN []byte
+	XRES []byte
+	CK   []byte
+	IK   []byte
+}
+
+// SIPAuthenticate returns RAND || AUTN, the nonce sent to the UE
+// (TS 29.229 section 6.3.10)
+func (v *Vector) SIPAuthenticate() []byte {
+	return append(append([]byte(nil), v.RAND...), v.AUTN...)
+}
+
+// GenerateVector creates a vector for sequence number sqn. A random RAND is
+// used when rnd is nil.
+func GenerateVector(m *Milenage, sqn uint64, amf, rnd []byte) (*Vector, error) {
+	if rnd == nil {
+		rnd = make([]byte, 16)
+		if _, err := rand.Read(rnd); err != nil {
+			return nil, err
+		}
+	}
+
+	sqnBytes := encodeSQN(sqn)
+	mac, _, err := m.F1(rnd, sqnBytes, amf)
+	if err != nil {
+		return nil, err
+	}
+	xres, ck, ik, ak, err := m.F2345(rnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// AUTN = SQN xor AK || AMF || MAC-A
+	autn := make([]byte, 0, 16)
+	for i := range sqnBytes {
+		autn = append(autn, sqnBytes[i]^ak[i])
+	}
+	autn = append(autn, amf...)
+	autn = append(autn, mac...)
+
+	return &Vector{RAND: rnd, AUTN: autn, XRES: xres, CK: ck, IK: ik}, nil
+}
+
+// NextSQN returns the sequence number following sqn: SEQ is incremented and
+// IND cycles through the array of 2^5 entries kept by the USIM
+func NextSQN(sqn uint64) uint64 {
+	seq := sqn>>indBits + 1
+	ind := (sqn + 1) & (1<<indBits - 1)
+	return (seq<<indBits | ind) & sqnMask
+}
+
+// Resynchronize recovers SQN_MS from the AUTS sent by the UE with the RAND
+// of the rejected challenge (TS 33.102 section 6.3.5)
+func Resynchronize(m *Milenage, rnd, auts []byte) (uint64, error) {
+	if len(rnd) != 16 {
+		return 0, fmt.Errorf("aka: RAND must be 16 bytes, got %d", len(rnd))
+	}
+	if len(auts) != AUTSLen {
+		return 0, fmt.Errorf("aka: AUTS must be %d bytes, got %d", AUTSLen, len(auts))
+	}
+
+	akStar, err := m.F5Star(rnd)
+	if err != nil {
+		return 0, err
+	}
+	sqnMS := make([]byte, 6)
+	for i := range sqnMS {
+		sqnMS[i] = auts[i] ^ akStar[i]
+	}
+
+	// MAC-S is computed with a zero AMF (TS 33.102 section 6.3.3)
+	_, macS, err := m.F1(rnd, sqnMS, []byte{0, 0})
+	if err != nil {
+		return 0, err
+	}
+	if !hmac.Equal(macS, auts[6:]) {
+		return 0, ErrInvalidAUTS
+	}
+	return decodeSQN(sqnMS), nil
+}
+
+// encodeSQN returns the 48-bit big-endian encoding of sqn
+func encodeSQN(sqn uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, sqn&sqnMask)
+	return b[2:]
+}
+
+// decodeSQN decodes a 48-bit big-endian sequence number
+func decodeSQN(b []byte) uint64 {
+	var sqn uint64
+	for _, c := range b {
+		sqn = sqn<<8 | uint64(c)
+	}
+	return sqn
+}
@@ -0,0 +1,110 @@
+package aka
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// testMilenage returns the Milenage instance of test set 1
+func testMilenage(t *testing.T) *Milenage {
+	t.Helper()
+	m, err := NewMilenage(unhex(t, "465b5ce8b199b49faa5f0a2ee238a6bc"), unhex(t, "cd63cb71954a9f4e48a5994e37a02baf"))
+	if err != nil {
+		t.Fatalf("NewMilenage() error = %v", err)
+	}
+	return m
+}
+
+// buildAUTS computes the AUTS a USIM holding sqnMS would send
+func buildAUTS(t *testing.T, m *Milenage, rnd []byte, sqnMS uint64) []byte {
+	t.Helper()
+	akStar, err := m.F5Star(rnd)
+	if err != nil {
+		t.Fatalf("F5Star() error = %v", err)
+	}
+	_, macS, err := m.F1(rnd, encodeSQN(sqnMS), []byte{0, 0})
+	if err != nil {
+		t.Fatalf("F1() error = %v", err)
+	}
+	auts := encodeSQN(sqnMS)
+	for i := range auts {
+		auts[i] ^= akStar[i]
+	}
+	return append(auts, macS...)
+}
+
+func TestGenerateVector(t *testing.T) {
+	m := testMilenage(t)
+	rnd := unhex(t, "23553cbe9637a89d218ae64dae47bf35")
+
+	v, err := GenerateVector(m, 0xff9bb4d0b607, unhex(t, "b9b9"), rnd)
+	if err != nil {
+		t.Fatalf("GenerateVector() error = %v", err)
+	}
+
+	// AUTN = SQN xor AK || AMF || MAC-A with the test set 1 values
+	sqnXorAK := make([]byte, 6)
+	for i, b := range unhex(t, "ff9bb4d0b607") {
+		sqnXorAK[i] = b ^ unhex(t, "aa689c648370")[i]
+	}
+	wantAUTN := append(append(sqnXorAK, unhex(t, "b9b9")...), unhex(t, "4a9ffac354dfafb3")...)
+	if !bytes.Equal(v.AUTN, wantAUTN) {
+		t.Errorf("AUTN = %x, want %x", v.AUTN, wantAUTN)
+	}
+	if !bytes.Equal(v.XRES, unhex(t, "a54211d5e3ba50bf")) {
+		t.Errorf("XRES = %x", v.XRES)
+	}
+	if !bytes.Equal(v.CK, unhex(t, "b40ba9a3c58b2a05bbf0d987b21bf8cb")) || !bytes.Equal(v.IK, unhex(t, "f769bcd751044604127672711c6d3441")) {
+		t.Errorf("CK/IK = %x/%x", v.CK, v.IK)
+	}
+	if got := v.SIPAuthenticate(); !bytes.Equal(got, append(rnd, wantAUTN...)) {
+		t.Errorf("SIPAuthenticate() = %x", got)
+	}
+
+	random, err := GenerateVector(m, 1, unhex(t, "8000"), nil)
+	if err != nil || len(random.RAND) != 16 || bytes.Equal(random.RAND, make([]byte, 16)) {
+		t.Errorf("GenerateVector() with random RAND = %+v, %v", random, err)
+	}
+}
+
+func TestNextSQN(t *testing.T) {
+	tests := []struct {
+		name string
+		sqn  uint64
+		want uint64
+	}{
+		{"zero", 0, 1<<indBits | 1},
+		{"IND wraps", 1<<indBits | 31, 2 << indBits},
+		{"48-bit wrap", sqnMask, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NextSQN(tt.sqn); got != tt.want {
+				t.Errorf("NextSQN(%#x) = %#x, want %#x", tt.sqn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResynchronize(t *testing.T) {
+	m := testMilenage(t)
+	rnd := unhex(t, "23553cbe9637a89d218ae64dae47bf35")
+	auts := buildAUTS(t, m, rnd, 0x000000004242)
+
+	sqnMS, err := Resynchronize(m, rnd, auts)
+	if err != nil {
+		t.Fatalf("Resynchronize() error = %v", err)
+	}
+	if sqnMS != 0x4242 {
+		t.Errorf("SQN_MS = %#x, want 0x4242", sqnMS)
+	}
+
+	auts[len(auts)-1] ^= 0xff
+	if _, err := Resynchronize(m, rnd, auts); !errors.Is(err, ErrInvalidAUTS) {
+		t.Errorf("Resynchronize() with corrupt MAC-S error = %v", err)
+	}
+	if _, err := Resynchronize(m, rnd, auts[:10]); err == nil {
+		t.Error("Resynchronize() accepted a short AUTS")
+	}
+}
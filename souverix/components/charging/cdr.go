@@ -0,0 +1,225 @@
+package charging
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CDR file formats
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// csvHeader is the first row of CSV CDR files; docs/CHARGING.md describes
+// the columns
+var csvHeader = []string{
+	"record_type", "record_number", "node", "node_address", "role", "method",
+	"call_id", "calling_party", "called_party", "icid", "orig_ioi", "term_ioi",
+	"request_time", "response_time", "record_time", "duration", "cause_code",
+}
+
+// FileWriter writes charging records as local CDRs, one file per day named
+// cdr-YYYYMMDD.csv or cdr-YYYYMMDD.json, for a billing system to collect
+type FileWriter struct {
+	dir    string
+	format string
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+// NewFileWriter creates a writer of CDR files in dir, in format FormatCSV
+// or FormatJSON
+func NewFileWriter(dir, format string) (*FileWriter, error) {
+	if format != FormatCSV && format != FormatJSON {
+		return nil, fmt.Errorf("unknown CDR format %q", format)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("cannot create CDR directory: %w", err)
+	}
+	return &FileWriter{dir: dir, format: format, now: time.Now}, nil
+}
+
+// Write implements Writer
+func (w *FileWriter) Write(ctx context.Context, r *Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.open(); err != nil {
+		return err
+	}
+	if w.format == FormatJSON {
+		line, err := json.Marshal(jsonCDR(r))
+		if err != nil {
+			return err
+		}
+		_, err = w.file.Write(append(line, '\n'))
+		return err
+	}
+	cw := csv.NewWriter(w.file)
+	if err := cw.Write(csvRow(r)); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// open opens the file of the current day; a new CSV file starts with the
+// header row. w.mu is held.
+func (w *FileWriter) open() error {
+	day := w.now().UTC().Format("20060102")
+	if w.file != nil && w.day == day {
+		return nil
+	}
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+
+	path := filepath.Join(w.dir, "cdr-"+day+"."+w.format)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("cannot open CDR file: %w", err)
+	}
+	if w.format == FormatCSV {
+		info, err := file.Stat()
+		if err == nil && info.Size() == 0 {
+			cw := csv.NewWriter(file)
+			cw.Write(csvHeader)
+			cw.Flush()
+			err = cw.Error()
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("cannot write CDR file: %w", err)
+		}
+	}
+	w.file = file
+	w.day = day
+	return nil
+}
+
+// Close closes the current file
+func (w *FileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// csvRow encodes r as a CSV row
+func csvRow(r *Record) []string {
+	return []string{
+		string(r.Type),
+		strconv.Itoa(r.Number),
+		string(r.Node),
+		r.NodeAddress,
+		role(r),
+		r.Method,
+		r.CallID,
+		r.CallingParty,
+		r.CalledParty,
+		r.ICID,
+		r.OrigIOI,
+		r.TermIOI,
+		formatTime(r.RequestTime),
+		formatTime(r.ResponseTime),
+		formatTime(r.Time),
+		strconv.Itoa(int(r.Duration / time.Second)),
+		strconv.Itoa(r.CauseCode),
+	}
+}
+
+// cdr is the JSON encoding of a record, named after the fields of the IMS
+// CDRs of TS 32.298 section 5.2.3
+type cdr struct {
+	RecordType               string    `json:"recordType"`
+	RoleOfNode               string    `json:"role-of-Node"`
+	NodeFunctionality        string    `json:"nodeFunctionality"`
+	NodeAddress              string    `json:"nodeAddress,omitempty"`
+	SessionID                string    `json:"session-Id"`
+	ListOfCallingPartyAddr   []string  `json:"list-Of-Calling-Party-Address,omitempty"`
+	CalledPartyAddress       string    `json:"called-Party-Address,omitempty"`
+	SIPMethod                string    `json:"sIP-Method,omitempty"`
+	ServiceRequestTimeStamp  string    `json:"serviceRequestTimeStamp,omitempty"`
+	ServiceDeliveryStartTime string    `json:"serviceDeliveryStartTimeStamp,omitempty"`
+	ServiceDeliveryEndTime   string    `json:"serviceDeliveryEndTimeStamp,omitempty"`
+	RecordOpeningTime        string    `json:"recordOpeningTime,omitempty"`
+	RecordClosureTime        string    `json:"recordClosureTime"`
+	Duration                 int       `json:"duration"`
+	InterOperatorIdentifiers *jsonIOIs `json:"interOperatorIdentifiers,omitempty"`
+	LocalRecordSequenceNum   int       `json:"localRecordSequenceNumber"`
+	CauseForRecordClosing    int       `json:"causeForRecordClosing"`
+	IMSChargingIdentifier    string    `json:"iMS-Charging-Identifier,omitempty"`
+}
+
+// jsonIOIs is the InterOperatorIdentifiers of a JSON CDR
+type jsonIOIs struct {
+	OriginatingIOI string `json:"originatingIOI,omitempty"`
+	TerminatingIOI string `json:"terminatingIOI,omitempty"`
+}
+
+// jsonCDR encodes r as a JSON CDR
+func jsonCDR(r *Record) *cdr {
+	c := &cdr{
+		RecordType:              string(r.Type),
+		RoleOfNode:              role(r),
+		NodeFunctionality:       string(r.Node),
+		NodeAddress:             r.NodeAddress,
+		SessionID:               r.CallID,
+		CalledPartyAddress:      r.CalledParty,
+		SIPMethod:               r.Method,
+		ServiceRequestTimeStamp: formatTime(r.RequestTime),
+		RecordClosureTime:       formatTime(r.Time),
+		Duration:                int(r.Duration / time.Second),
+		LocalRecordSequenceNum:  r.Number,
+		CauseForRecordClosing:   r.CauseCode,
+		IMSChargingIdentifier:   r.ICID,
+	}
+	if r.CallingParty != "" {
+		c.ListOfCallingPartyAddr = []string{r.CallingParty}
+	}
+	if r.OrigIOI != "" || r.TermIOI != "" {
+		c.InterOperatorIdentifiers = &jsonIOIs{OriginatingIOI: r.OrigIOI, TerminatingIOI: r.TermIOI}
+	}
+	if r.Type != RecordEvent {
+		c.ServiceDeliveryStartTime = formatTime(r.ResponseTime)
+		c.RecordOpeningTime = formatTime(r.ResponseTime)
+	}
+	if r.Type == RecordStop {
+		c.ServiceDeliveryEndTime = formatTime(r.Time)
+	}
+	return c
+}
+
+// role returns the role of node of r
+func role(r *Record) string {
+	if r.Originating {
+		return "originating"
+	}
+	return "terminating"
+}
+
+// formatTime formats a time of a CDR, empty when unset
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,123 @@
+package charging
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRecord() *Record {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &Record{
+		Type:         RecordStop,
+		Number:       2,
+		Node:         NodeSCSCF,
+		NodeAddress:  "scscf.ims.test",
+		Originating:  true,
+		Method:       "INVITE",
+		CallID:       "call1",
+		CallingParty: "sip:alice@ims.test",
+		CalledParty:  "tel:+15551234",
+		ICID:         "icid1",
+		OrigIOI:      "ims.test",
+		RequestTime:  start,
+		ResponseTime: start.Add(2 * time.Second),
+		Time:         start.Add(92 * time.Second),
+		Duration:     90 * time.Second,
+	}
+}
+
+func TestFileWriter_CSV(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewFileWriter(dir, FormatCSV)
+	if err != nil {
+		t.Fatalf("NewFileWriter() error = %v", err)
+	}
+	day := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return day }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := w.Write(ctx, testRecord()); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	// The next day has its own file
+	day = day.Add(2 * time.Hour)
+	if err := w.Write(ctx, testRecord()); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "cdr-20260301.csv"))
+	if err != nil {
+		t.Fatalf("cannot open CDR file: %v", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(csvHeader, ",") {
+		t.Fatalf("rows = %v", rows)
+	}
+	want := "STOP,2,S-CSCF,scscf.ims.test,originating,INVITE,call1,sip:alice@ims.test,tel:+15551234,icid1,ims.test,," +
+		"2026-03-01T12:00:00Z,2026-03-01T12:00:02Z,2026-03-01T12:01:32Z,90,0"
+	if got := strings.Join(rows[1], ","); got != want {
+		t.Errorf("row = %s\nwant  %s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cdr-20260302.csv")); err != nil {
+		t.Errorf("no CDR file for the next day: %v", err)
+	}
+}
+
+func TestFileWriter_JSON(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewFileWriter(dir, FormatJSON)
+	if err != nil {
+		t.Fatalf("NewFileWriter() error = %v", err)
+	}
+	w.now = func() time.Time { return time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC) }
+	if err := w.Write(context.Background(), testRecord()); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	w.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "cdr-20260301.json"))
+	if err != nil {
+		t.Fatalf("cannot read CDR file: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	want := map[string]any{
+		"recordType":                    "STOP",
+		"role-of-Node":                  "originating",
+		"session-Id":                    "call1",
+		"iMS-Charging-Identifier":       "icid1",
+		"serviceDeliveryStartTimeStamp": "2026-03-01T12:00:02Z",
+		"serviceDeliveryEndTimeStamp":   "2026-03-01T12:01:32Z",
+		"duration":                      float64(90),
+		"localRecordSequenceNumber":     float64(2),
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+	if ioi, _ := got["interOperatorIdentifiers"].(map[string]any); ioi["originatingIOI"] != "ims.test" {
+		t.Errorf("interOperatorIdentifiers = %v", got["interOperatorIdentifiers"])
+	}
+
+	if _, err := NewFileWriter(dir, "xml"); err == nil {
+		t.Error("NewFileWriter() accepted an unknown format")
+	}
+}
@@ -0,0 +1,588 @@
+// Package charging implements the charging trigger function of the IMS
+// nodes (TS 32.260): offline charging records, sent to a CDF over Rf or
+// written to local CDR files, and online charging over Ro, which grants
+// call time and ends the calls whose credit runs out.
+package charging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rf"
+	"github.com/dasmlab/souverix/common/diameter/ro"
+	"github.com/sirupsen/logrus"
+)
+
+// Charger timing
+const (
+	// tickInterval is how often Run checks interim records and quotas
+	tickInterval = time.Second
+
+	// earlySessionTimeout drops a session whose INVITE got no final
+	// response, as Timer C of RFC 3261 would cancel it
+	earlySessionTimeout = 3 * time.Minute
+
+	// quotaThreshold is how long before its grant runs out a session asks
+	// for more, so that the call is not cut while the CCR-U is in flight
+	quotaThreshold = 5 * time.Second
+
+	// maxParallelRenewals bounds the CCR-Us Expire has in flight
+	maxParallelRenewals = 64
+)
+
+// ErrNoCredit is returned when the OCS grants no call time to a session, as
+// opposed to failing to answer
+var ErrNoCredit = errors.New("no credit granted by the OCS")
+
+// Node is the IMS function a Charger reports for
+type Node string
+
+// Nodes with charging functions
+const (
+	NodePCSCF Node = "P-CSCF"
+	NodeICSCF Node = "I-CSCF"
+	NodeSCSCF Node = "S-CSCF"
+	NodeBGCF  Node = "BGCF"
+	NodeMGCF  Node = "MGCF"
+	NodeIBCF  Node = "IBCF"
+)
+
+// RecordType is the type of a charging record
+type RecordType string
+
+// Record types: a session has a Start record when answered, Interim records
+// while it lasts and a Stop record when it ends. Failed sessions and
+// standalone requests have an Event record.
+const (
+	RecordStart   RecordType = "START"
+	RecordInterim RecordType = "INTERIM"
+	RecordStop    RecordType = "STOP"
+	RecordEvent   RecordType = "EVENT"
+)
+
+// Record is a charging record, the content of an ACR (TS 32.299 section
+// 6.1.2) and of a local CDR
+type Record struct {
+	Type         RecordType
+	Number       int // Sequence of the record in its session, from 0
+	Node         Node
+	NodeAddress  string
+	Originating  bool // Role of the node for the served user
+	Method       string
+	CallID       string
+	CallingParty string
+	CalledParty  string
+	ICID         string
+	OrigIOI      string
+	TermIOI      string
+	RequestTime  time.Time     // Request that opened the session
+	ResponseTime time.Time     // Final response to the request
+	Time         time.Time     // When the record was closed
+	Duration     time.Duration // Of the session until Time
+
+	// CauseCode is 0 for a successful session or request, or the SIP status
+	// code it failed with
+	CauseCode int
+}
+
+// Writer stores or sends charging records
+type Writer interface {
+	Write(ctx context.Context, r *Record) error
+}
+
+// OCS sends the CCRs of the CTF to the online charging system; *ro.Client
+// implements it
+type OCS interface {
+	CreditControl(ctx context.Context, req *ro.CCR) (*ro.CCA, error)
+}
+
+// session is a charged INVITE session
+type session struct {
+	// mu serializes the credit-control requests of the session
+	mu sync.Mutex
+
+	record      Record // Template of the records of the session
+	subscriber  string // Served user, charged online
+	created     time.Time
+	established bool
+	answered    time.Time
+	lastRecord  time.Time
+	number      int
+
+	// Online charging; the credit-control session is open when ccSession
+	// is set
+	ccSession  string
+	ccNumber   uint32
+	granted    time.Duration
+	validity   time.Duration // Of the grant, 0 for unlimited
+	grantStart time.Time
+	finalUnit  bool
+
+	// reserveErr is why the quota of the INVITE was refused
+	reserveErr error
+}
+
+// event is a standalone request waiting for its final response
+type event struct {
+	record  Record
+	created time.Time
+}
+
+// Charger is the charging trigger function of an IMS node. The node passes
+// it the requests and responses of its served users: it writes their
+// offline charging records, and with an OCS reserves call time before a
+// session is set up and ends it when the credit runs out.
+type Charger struct {
+	node     Node
+	address  string
+	interval time.Duration
+	writer   Writer // nil without offline charging
+	ocs      OCS    // nil without online charging
+	log      *logrus.Logger
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu         sync.Mutex
+	sessions   map[string]*session // key: Call-ID
+	events     map[string]*event   // key: Call-ID and CSeq
+	terminated func(callID string)
+}
+
+// NewCharger creates the CTF of node at address. Either writer or ocs may
+// be nil to disable offline or online charging; interval is the interval
+// of the Interim records, 0 for none.
+func NewCharger(node Node, address string, interval time.Duration, writer Writer, ocs OCS, log *logrus.Logger) *Charger {
+	return &Charger{
+		node:     node,
+		address:  address,
+		interval: interval,
+		writer:   writer,
+		ocs:      ocs,
+		log:      log,
+		now:      time.Now,
+		sessions: make(map[string]*session),
+		events:   make(map[string]*event),
+	}
+}
+
+// New creates the CTF of node configured in cfg, connecting to its CDF and
+// OCS. It returns nil when cfg enables no charging.
+func New(ctx context.Context, cfg *config.ChargingConfig, node Node, log *logrus.Logger) (*Charger, error) {
+	var writer Writer
+	switch cfg.OfflineBackend {
+	case "":
+	case "rf":
+		if cfg.CDFAddr == "" {
+			return nil, fmt.Errorf("no CDF address configured")
+		}
+		peer, err := dial(ctx, cfg, cfg.CDFAddr, rf.Application, log)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to the CDF: %w", err)
+		}
+		writer = NewRfWriter(rf.NewClient(peer))
+	case FormatCSV, FormatJSON:
+		w, err := NewFileWriter(cfg.CDRDir, cfg.OfflineBackend)
+		if err != nil {
+			return nil, err
+		}
+		writer = w
+	default:
+		return nil, fmt.Errorf("unknown offline charging backend %q", cfg.OfflineBackend)
+	}
+
+	var ocs OCS
+	if cfg.OCSAddr != "" {
+		peer, err := dial(ctx, cfg, cfg.OCSAddr, ro.Application, log)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to the OCS: %w", err)
+		}
+		ocs = ro.NewClient(peer)
+	}
+
+	if writer == nil && ocs == nil {
+		return nil, nil
+	}
+	return NewCharger(node, cfg.DiameterHost, cfg.InterimInterval, writer, ocs, log), nil
+}
+
+// dial connects to the charging peer at addr for app
+func dial(ctx context.Context, cfg *config.ChargingConfig, addr string, app diameter.Application, log *logrus.Logger) (*diameter.Peer, error) {
+	return diameter.Dial(ctx, "tcp", addr, &diameter.Config{
+		OriginHost:   cfg.DiameterHost,
+		OriginRealm:  cfg.DiameterRealm,
+		VendorID:     rf.Vendor3GPP,
+		Applications: []diameter.Application{app},
+		Log:          log,
+	})
+}
+
+// SetTerminateHandler sets the function called with the Call-ID of a
+// session whose credit ran out, for the node to end it. The session is no
+// longer charged when it is called.
+func (c *Charger) SetTerminateHandler(terminated func(callID string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.terminated = terminated
+}
+
+// Request processes a request of a served user. originating tells whether
+// the node serves the caller. It returns an error, wrapping ErrNoCredit when
+// the OCS refuses it, for an INVITE that gets no call time: the node
+// rejects it.
+func (c *Charger) Request(ctx context.Context, msg *sip.Message, originating bool) error {
+	callID := msg.GetHeader("Call-ID")
+	inDialog := hasTag(msg.GetHeader("To"))
+
+	switch msg.Method {
+	case sip.MethodINVITE:
+		if inDialog {
+			return nil
+		}
+		// The session is inserted before its quota is reserved, so that a
+		// retransmission waits for the reservation instead of making another
+		c.mu.Lock()
+		if s := c.sessions[callID]; s != nil {
+			c.mu.Unlock()
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.reserveErr
+		}
+		s := &session{record: c.newRecord(msg, originating), created: c.now()}
+		s.subscriber = s.record.CalledParty
+		if originating {
+			s.subscriber = s.record.CallingParty
+		}
+		s.mu.Lock()
+		c.sessions[callID] = s
+		c.mu.Unlock()
+
+		if c.ocs != nil {
+			s.reserveErr = c.reserve(ctx, s)
+		}
+		err := s.reserveErr
+		s.mu.Unlock()
+		if err != nil {
+			c.mu.Lock()
+			if c.sessions[callID] == s {
+				delete(c.sessions, callID)
+			}
+			c.mu.Unlock()
+			return err
+		}
+	case sip.MethodBYE:
+		c.mu.Lock()
+		s := c.sessions[callID]
+		delete(c.sessions, callID)
+		c.mu.Unlock()
+		if s != nil {
+			c.end(ctx, s, 0)
+		}
+	case sip.MethodACK, sip.MethodCANCEL, sip.MethodPRACK, sip.MethodUPDATE, sip.MethodINFO:
+	default:
+		if inDialog || c.writer == nil {
+			return nil
+		}
+		c.mu.Lock()
+		c.events[eventKey(msg)] = &event{record: c.newRecord(msg, originating), created: c.now()}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Response processes a response to a request of a served user
+func (c *Charger) Response(ctx context.Context, msg *sip.Message) {
+	if msg.StatusCode < 200 {
+		return
+	}
+	callID := msg.GetHeader("Call-ID")
+	_, method, _ := strings.Cut(strings.TrimSpace(msg.GetHeader("CSeq")), " ")
+	method = strings.ToUpper(strings.TrimSpace(method))
+	now := c.now()
+
+	if method != sip.MethodINVITE {
+		c.mu.Lock()
+		e := c.events[eventKey(msg)]
+		delete(c.events, eventKey(msg))
+		c.mu.Unlock()
+		if e == nil {
+			return
+		}
+		r := e.record
+		r.Type = RecordEvent
+		r.ResponseTime = now
+		r.Time = now
+		mergeChargingVector(&r, msg)
+		if msg.StatusCode >= 300 {
+			r.CauseCode = msg.StatusCode
+		}
+		c.write(ctx, &r)
+		return
+	}
+
+	c.mu.Lock()
+	s := c.sessions[callID]
+	if s == nil || s.established {
+		c.mu.Unlock()
+		return
+	}
+	if msg.StatusCode >= 300 {
+		delete(c.sessions, callID)
+		c.mu.Unlock()
+		c.failed(ctx, s, msg)
+		return
+	}
+	s.established = true
+	s.answered = now
+	s.lastRecord = now
+	mergeChargingVector(&s.record, msg)
+	r := s.record
+	r.Type = RecordStart
+	r.ResponseTime = now
+	r.Time = now
+	s.record.ResponseTime = now
+	s.number++
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	s.grantStart = now
+	s.mu.Unlock()
+	c.write(ctx, &r)
+}
+
+// failed reports a session whose INVITE failed: an Event record with the
+// status code, and the release of its reserved credit
+func (c *Charger) failed(ctx context.Context, s *session, msg *sip.Message) {
+	now := c.now()
+	r := s.record
+	r.Type = RecordEvent
+	r.ResponseTime = now
+	r.Time = now
+	r.CauseCode = msg.StatusCode
+	mergeChargingVector(&r, msg)
+	c.write(ctx, &r)
+	if c.ocs != nil {
+		c.release(ctx, s, diameter.TerminationLogout)
+	}
+}
+
+// end closes a session removed from c.sessions: its Stop record, and the
+// report of the time used to the OCS
+func (c *Charger) end(ctx context.Context, s *session, cause int) {
+	now := c.now()
+	c.mu.Lock()
+	established := s.established
+	answered := s.answered
+	r := s.record
+	r.Number = s.number
+	c.mu.Unlock()
+
+	if established {
+		r.Type = RecordStop
+		r.Time = now
+		r.Duration = now.Sub(answered)
+		r.CauseCode = cause
+		c.write(ctx, &r)
+	}
+	if c.ocs != nil {
+		c.release(ctx, s, diameter.TerminationLogout)
+	}
+}
+
+// Expire writes the Interim records that are due, renews the quota of the
+// sessions whose grant is about to run out, ends those whose credit ran out and
+// drops the sessions and requests that got no final response in time
+func (c *Charger) Expire(ctx context.Context) {
+	now := c.now()
+	var interim []*Record
+	var sessions, expired []*session
+
+	c.mu.Lock()
+	for callID, s := range c.sessions {
+		switch {
+		case !s.established && now.Sub(s.created) > earlySessionTimeout:
+			delete(c.sessions, callID)
+			expired = append(expired, s)
+		case s.established:
+			sessions = append(sessions, s)
+			if c.interval > 0 && now.Sub(s.lastRecord) >= c.interval {
+				r := s.record
+				r.Type = RecordInterim
+				r.Number = s.number
+				r.Time = now
+				r.Duration = now.Sub(s.answered)
+				s.number++
+				s.lastRecord = now
+				interim = append(interim, &r)
+			}
+		}
+	}
+	for key, e := range c.events {
+		if now.Sub(e.created) > earlySessionTimeout {
+			delete(c.events, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, r := range interim {
+		c.write(ctx, r)
+	}
+	for _, s := range expired {
+		if c.ocs != nil {
+			c.release(ctx, s, diameter.TerminationSessionTimeout)
+		}
+	}
+	if c.ocs == nil {
+		return
+	}
+	// The sessions are renewed in parallel, so that a slow OCS answer does
+	// not hold up the grants of the others
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxParallelRenewals)
+	for _, s := range sessions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(s *session) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if !c.renew(ctx, s, now) {
+				c.creditExhausted(ctx, s)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// creditExhausted ends a session the OCS grants no more time to
+func (c *Charger) creditExhausted(ctx context.Context, s *session) {
+	callID := s.record.CallID
+	c.mu.Lock()
+	if c.sessions[callID] != s {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.sessions, callID)
+	terminated := c.terminated
+	c.mu.Unlock()
+
+	c.log.WithFields(logrus.Fields{"call-id": callID, "subscriber": s.subscriber}).Info("credit exhausted, ending session")
+	c.end(ctx, s, 0)
+	if terminated != nil {
+		terminated(callID)
+	}
+}
+
+// Run calls Expire every second until ctx is done
+func (c *Charger) Run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Expire(ctx)
+		}
+	}
+}
+
+// Sessions returns the number of sessions being charged
+func (c *Charger) Sessions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+// write passes a record to the writer; failures are only logged, the
+// session goes on
+func (c *Charger) write(ctx context.Context, r *Record) {
+	if c.writer == nil {
+		return
+	}
+	if err := c.writer.Write(ctx, r); err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{"call-id": r.CallID, "type": r.Type}).Warn("cannot write charging record")
+	}
+}
+
+// newRecord starts the record of a request of a served user
+func (c *Charger) newRecord(msg *sip.Message, originating bool) Record {
+	r := Record{
+		Node:         c.node,
+		NodeAddress:  c.address,
+		Originating:  originating,
+		Method:       msg.Method,
+		CallID:       msg.GetHeader("Call-ID"),
+		CallingParty: headerURI(msg.GetHeader("P-Asserted-Identity")),
+		CalledParty:  msg.URI,
+		RequestTime:  c.now(),
+	}
+	if r.CallingParty == "" {
+		r.CallingParty = headerURI(msg.GetHeader("From"))
+	}
+	if !originating {
+		// The Request-URI is the contact of the served user
+		if r.CalledParty = headerURI(msg.GetHeader("P-Called-Party-ID")); r.CalledParty == "" {
+			r.CalledParty = headerURI(msg.GetHeader("To"))
+		}
+	}
+	mergeChargingVector(&r, msg)
+	return r
+}
+
+// mergeChargingVector copies the identifiers of the P-Charging-Vector of
+// msg into r
+func mergeChargingVector(r *Record, msg *sip.Message) {
+	v := sip.GetChargingVector(msg)
+	if v == nil {
+		return
+	}
+	if r.ICID == "" {
+		r.ICID = v.ICID
+	}
+	if v.OrigIOI != "" {
+		r.OrigIOI = v.OrigIOI
+	}
+	if v.TermIOI != "" {
+		r.TermIOI = v.TermIOI
+	}
+}
+
+// eventKey identifies a standalone request and its responses
+func eventKey(msg *sip.Message) string {
+	return msg.GetHeader("Call-ID") + " " + strings.TrimSpace(msg.GetHeader("CSeq"))
+}
+
+// headerURI returns the URI of a name-addr or addr-spec header value
+func headerURI(value string) string {
+	if start := strings.Index(value, "<"); start >= 0 {
+		if end := strings.Index(value[start:], ">"); end > 0 {
+			return strings.TrimSpace(value[start+1 : start+end])
+		}
+	}
+	uri, _, _ := strings.Cut(value, ";")
+	return strings.TrimSpace(uri)
+}
+
+// hasTag reports whether a From or To header value has a tag parameter
+func hasTag(value string) bool {
+	if end := strings.LastIndex(value, ">"); end >= 0 {
+		value = value[end+1:]
+	}
+	for _, param := range strings.Split(value, ";") {
+		name, _, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(name, "tag") {
+			return true
+		}
+	}
+	return false
+}
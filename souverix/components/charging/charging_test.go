@@ -0,0 +1,195 @@
+package charging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return log
+}
+
+// clock is a settable time source for Chargers
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+// newTestCharger creates a P-CSCF Charger writing to a stub, on a clock
+func newTestCharger(ocs OCS) (*Charger, *Stub, *clock) {
+	stub := NewStub(time.Minute)
+	clk := &clock{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	c := NewCharger(NodePCSCF, "pcscf.ims.test", 5*time.Minute, stub, ocs, testLogger())
+	c.now = clk.now
+	return c, stub, clk
+}
+
+func newRequest(method, callID, cseq string) *sip.Message {
+	msg := &sip.Message{
+		Method:  method,
+		URI:     "sip:bob@ims.test",
+		Version: "SIP/2.0",
+		Headers: make(map[string][]string),
+	}
+	msg.SetHeader("From", "<sip:alice@ims.test>;tag=a1")
+	msg.SetHeader("To", "<sip:bob@ims.test>")
+	msg.SetHeader("Call-ID", callID)
+	msg.SetHeader("CSeq", cseq+" "+method)
+	msg.SetHeader("P-Asserted-Identity", "<sip:alice@ims.test>")
+	msg.SetHeader("P-Charging-Vector", "icid-value=icid1;orig-ioi=ims.test")
+	return msg
+}
+
+func newResponse(req *sip.Message, code int) *sip.Message {
+	msg := &sip.Message{
+		Version:    "SIP/2.0",
+		StatusCode: code,
+		Headers:    make(map[string][]string),
+	}
+	msg.SetHeader("Call-ID", req.GetHeader("Call-ID"))
+	msg.SetHeader("CSeq", req.GetHeader("CSeq"))
+	msg.SetHeader("P-Charging-Vector", "icid-value=icid1;orig-ioi=ims.test;term-ioi=other.test")
+	return msg
+}
+
+func TestCharger_Session(t *testing.T) {
+	c, stub, clk := newTestCharger(nil)
+	ctx := context.Background()
+
+	invite := newRequest(sip.MethodINVITE, "call1", "1")
+	if err := c.Request(ctx, invite, true); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	c.Response(ctx, newResponse(invite, sip.StatusRinging))
+	clk.t = clk.t.Add(2 * time.Second)
+	c.Response(ctx, newResponse(invite, sip.StatusOK))
+	// A re-INVITE does not open another session
+	reinvite := newRequest(sip.MethodINVITE, "call1", "2")
+	reinvite.SetHeader("To", "<sip:bob@ims.test>;tag=b1")
+	c.Request(ctx, reinvite, true)
+	c.Response(ctx, newResponse(reinvite, sip.StatusOK))
+
+	clk.t = clk.t.Add(4 * time.Minute)
+	c.Expire(ctx)
+	clk.t = clk.t.Add(time.Minute)
+	c.Expire(ctx)
+	clk.t = clk.t.Add(30 * time.Second)
+	bye := newRequest(sip.MethodBYE, "call1", "3")
+	bye.SetHeader("To", "<sip:bob@ims.test>;tag=b1")
+	c.Request(ctx, bye, true)
+	c.Response(ctx, newResponse(bye, sip.StatusOK))
+
+	records := stub.Records()
+	if len(records) != 3 {
+		t.Fatalf("records = %d, want 3", len(records))
+	}
+	want := []struct {
+		Type     RecordType
+		Duration time.Duration
+	}{
+		{RecordStart, 0},
+		{RecordInterim, 5 * time.Minute},
+		{RecordStop, 5*time.Minute + 30*time.Second},
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Type != w.Type || r.Number != i || r.Duration != w.Duration {
+			t.Errorf("record %d = %s #%d %v, want %s #%d %v", i, r.Type, r.Number, r.Duration, w.Type, i, w.Duration)
+		}
+		if r.ICID != "icid1" || r.OrigIOI != "ims.test" || r.TermIOI != "other.test" {
+			t.Errorf("record %d identifiers = %q %q %q", i, r.ICID, r.OrigIOI, r.TermIOI)
+		}
+		if !r.Originating || r.CallingParty != "sip:alice@ims.test" || r.CalledParty != "sip:bob@ims.test" || r.Method != sip.MethodINVITE {
+			t.Errorf("record %d = %+v", i, r)
+		}
+		if r.ResponseTime.Sub(r.RequestTime) != 2*time.Second {
+			t.Errorf("record %d setup time = %v", i, r.ResponseTime.Sub(r.RequestTime))
+		}
+	}
+	if c.Sessions() != 0 {
+		t.Errorf("Sessions() = %d after BYE", c.Sessions())
+	}
+}
+
+func TestCharger_FailedSession(t *testing.T) {
+	c, stub, _ := newTestCharger(nil)
+	ctx := context.Background()
+
+	invite := newRequest(sip.MethodINVITE, "call1", "1")
+	c.Request(ctx, invite, false)
+	c.Response(ctx, newResponse(invite, sip.StatusBusyHere))
+
+	records := stub.Records()
+	if len(records) != 1 {
+		t.Fatalf("records = %d, want 1", len(records))
+	}
+	if r := records[0]; r.Type != RecordEvent || r.CauseCode != sip.StatusBusyHere || r.Originating {
+		t.Errorf("record = %+v", r)
+	}
+	if c.Sessions() != 0 {
+		t.Errorf("Sessions() = %d after failure", c.Sessions())
+	}
+}
+
+func TestCharger_Event(t *testing.T) {
+	c, stub, _ := newTestCharger(nil)
+	ctx := context.Background()
+
+	message := newRequest("MESSAGE", "msg1", "1")
+	c.Request(ctx, message, true)
+	c.Response(ctx, newResponse(message, sip.StatusAccepted))
+	// Requests within a dialog are part of their session
+	info := newRequest(sip.MethodNOTIFY, "sub1", "2")
+	info.SetHeader("To", "<sip:bob@ims.test>;tag=b1")
+	c.Request(ctx, info, true)
+	c.Response(ctx, newResponse(info, sip.StatusOK))
+
+	records := stub.Records()
+	if len(records) != 1 {
+		t.Fatalf("records = %d, want 1", len(records))
+	}
+	if r := records[0]; r.Type != RecordEvent || r.Method != "MESSAGE" || r.CauseCode != 0 || r.CallID != "msg1" {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestCharger_UnansweredSession(t *testing.T) {
+	c, stub, clk := newTestCharger(nil)
+	ctx := context.Background()
+
+	c.Request(ctx, newRequest(sip.MethodINVITE, "call1", "1"), true)
+	clk.t = clk.t.Add(earlySessionTimeout + time.Second)
+	c.Expire(ctx)
+	if c.Sessions() != 0 {
+		t.Errorf("Sessions() = %d after timeout", c.Sessions())
+	}
+	if len(stub.Records()) != 0 {
+		t.Errorf("records = %+v", stub.Records())
+	}
+}
+
+func TestHeaderURI(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`"Alice" <sip:alice@ims.test>;tag=1`, "sip:alice@ims.test"},
+		{"sip:bob@ims.test;tag=2", "sip:bob@ims.test"},
+		{"<tel:+15551234>", "tel:+15551234"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := headerURI(tt.value); got != tt.want {
+			t.Errorf("headerURI(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
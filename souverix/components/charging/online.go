@@ -0,0 +1,154 @@
+package charging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/ro"
+	"github.com/sirupsen/logrus"
+)
+
+// reserve opens the credit-control session of s with a CCR-I requesting
+// call time (TS 32.299 section 6.3.3). It fails, wrapping ErrNoCredit, when
+// the OCS grants none. s.mu is held.
+func (c *Charger) reserve(ctx context.Context, s *session) error {
+	cca, err := c.ocs.CreditControl(ctx, &ro.CCR{
+		RequestType:    ro.RequestInitial,
+		Subscriber:     s.subscriber,
+		EventTimestamp: c.now(),
+		RequestQuota:   true,
+		IMS:            imsInformation(&s.record),
+	})
+	if err != nil {
+		return fmt.Errorf("CCR failed: %w", err)
+	}
+	if !cca.Result.Success() {
+		if creditDenied(cca) {
+			return fmt.Errorf("%w: %v", ErrNoCredit, cca.Result.Err())
+		}
+		return fmt.Errorf("CCR rejected: %w", cca.Result.Err())
+	}
+
+	s.ccSession = cca.SessionID
+	s.ccNumber = 1
+	if cca.GrantedTime <= 0 {
+		c.terminate(ctx, s, diameter.TerminationServiceNotProvided)
+		return ErrNoCredit
+	}
+	s.granted = cca.GrantedTime
+	s.validity = cca.ValidityTime
+	s.finalUnit = cca.FinalUnit
+	return nil
+}
+
+// renew requests more call time with a CCR-U when the grant of s is about
+// to run out or its validity time ended. It reports whether the session
+// may go on: false when it used a final unit or a grant the OCS did not
+// renew.
+func (c *Charger) renew(ctx context.Context, s *session, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ccSession == "" || s.grantStart.IsZero() {
+		return true
+	}
+	used := now.Sub(s.grantStart)
+	exhausted := used >= s.granted
+	if s.finalUnit || (!exhausted && now.Before(s.renewAt())) {
+		return !exhausted
+	}
+
+	cca, err := c.ocs.CreditControl(ctx, &ro.CCR{
+		SessionID:      s.ccSession,
+		RequestType:    ro.RequestUpdate,
+		RequestNumber:  s.ccNumber,
+		Subscriber:     s.subscriber,
+		EventTimestamp: now,
+		RequestQuota:   true,
+		UsedTime:       used,
+		IMS:            imsInformation(&s.record),
+	})
+	s.ccNumber++
+	log := c.log.WithFields(logrus.Fields{"call-id": s.record.CallID, "subscriber": s.subscriber})
+	switch {
+	case err != nil:
+		// Retried on the next tick while the grant lasts
+		log.WithError(err).Warn("CCR-U failed")
+		return !exhausted
+	case !cca.Result.Success() || cca.GrantedTime <= 0:
+		if !cca.Result.Success() {
+			log.WithError(cca.Result.Err()).Info("CCR-U rejected")
+		}
+		// The time used is reported: the rest of the grant is the last
+		s.grantStart = now
+		s.granted -= used
+		s.finalUnit = true
+		return s.granted > 0
+	}
+	s.grantStart = now
+	s.granted = cca.GrantedTime
+	s.validity = cca.ValidityTime
+	s.finalUnit = cca.FinalUnit
+	return true
+}
+
+// renewAt is when s asks for more time: quotaThreshold before its grant
+// runs out, at most halfway through it, or when its validity time ends
+func (s *session) renewAt() time.Time {
+	at := s.grantStart.Add(s.granted - min(quotaThreshold, s.granted/2))
+	if s.validity > 0 {
+		if end := s.grantStart.Add(s.validity); end.Before(at) {
+			at = end
+		}
+	}
+	return at
+}
+
+// release closes the credit-control session of s with a CCR-T reporting
+// the time used since the last grant
+func (c *Charger) release(ctx context.Context, s *session, cause uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.terminate(ctx, s, cause)
+}
+
+// terminate sends the CCR-T of s; s.mu is held
+func (c *Charger) terminate(ctx context.Context, s *session, cause uint32) {
+	if s.ccSession == "" {
+		return
+	}
+	now := c.now()
+	var used time.Duration
+	if !s.grantStart.IsZero() {
+		used = now.Sub(s.grantStart)
+	}
+	req := &ro.CCR{
+		SessionID:        s.ccSession,
+		RequestType:      ro.RequestTermination,
+		RequestNumber:    s.ccNumber,
+		Subscriber:       s.subscriber,
+		EventTimestamp:   now,
+		UsedTime:         used,
+		TerminationCause: cause,
+		IMS:              imsInformation(&s.record),
+	}
+	s.ccSession = ""
+
+	cca, err := c.ocs.CreditControl(ctx, req)
+	if err == nil {
+		err = cca.Result.Err()
+	}
+	if err != nil {
+		c.log.WithError(err).WithField("call-id", s.record.CallID).Warn("CCR-T failed")
+	}
+}
+
+// creditDenied reports whether the OCS refused a CCR for lack of credit
+func creditDenied(cca *ro.CCA) bool {
+	if cca.Result.VendorID != 0 {
+		return false
+	}
+	return cca.Result.Code == ro.ResultCreditLimitReached || cca.Result.Code == ro.ResultEndUserServiceDenied
+}
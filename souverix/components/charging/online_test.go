@@ -0,0 +1,270 @@
+package charging
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rf"
+	"github.com/dasmlab/souverix/common/diameter/ro"
+)
+
+// connectStub serves stub over Diameter and returns a peer of the CTF
+// supporting app
+func connectStub(t *testing.T, stub *Stub, app diameter.Application) *diameter.Peer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := diameter.NewServer(&diameter.Config{
+		OriginHost:   "ocs.ims.test",
+		OriginRealm:  "ims.test",
+		VendorID:     rf.Vendor3GPP,
+		Applications: []diameter.Application{rf.Application, ro.Application},
+		Handler:      stub.Handler(),
+		Log:          testLogger(),
+	})
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+
+	peer, err := diameter.Dial(context.Background(), "tcp", l.Addr().String(), &diameter.Config{
+		OriginHost:   "pcscf.ims.test",
+		OriginRealm:  "ims.test",
+		VendorID:     rf.Vendor3GPP,
+		Applications: []diameter.Application{app},
+		Log:          testLogger(),
+	})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { peer.Close(context.Background()) })
+	return peer
+}
+
+func TestCharger_Online(t *testing.T) {
+	ocs := NewStub(time.Minute)
+	ocs.SetBalance("sip:alice@ims.test", 90*time.Second)
+	c, stub, clk := newTestCharger(ro.NewClient(connectStub(t, ocs, ro.Application)))
+	var mu sync.Mutex
+	var terminated []string
+	c.SetTerminateHandler(func(callID string) {
+		mu.Lock()
+		terminated = append(terminated, callID)
+		mu.Unlock()
+	})
+	ctx := context.Background()
+
+	invite := newRequest(sip.MethodINVITE, "call1", "1")
+	if err := c.Request(ctx, invite, true); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	c.Response(ctx, newResponse(invite, sip.StatusOK))
+
+	// The first minute is used: the last 30 seconds are the final unit
+	clk.t = clk.t.Add(30 * time.Second)
+	c.Expire(ctx)
+	clk.t = clk.t.Add(30 * time.Second)
+	c.Expire(ctx)
+	if c.Sessions() != 1 {
+		t.Fatalf("Sessions() = %d after the first grant", c.Sessions())
+	}
+	clk.t = clk.t.Add(30 * time.Second)
+	c.Expire(ctx)
+
+	mu.Lock()
+	if len(terminated) != 1 || terminated[0] != "call1" {
+		t.Errorf("terminated = %v", terminated)
+	}
+	mu.Unlock()
+	if balance, _ := ocs.Balance("sip:alice@ims.test"); balance != 0 {
+		t.Errorf("balance = %v, want 0", balance)
+	}
+	var types []uint32
+	for _, ccr := range ocs.CCRs() {
+		types = append(types, ccr.RequestType)
+	}
+	if len(types) != 3 || types[0] != ro.RequestInitial || types[1] != ro.RequestUpdate || types[2] != ro.RequestTermination {
+		t.Errorf("CCR types = %v", types)
+	}
+	records := stub.Records()
+	if len(records) != 2 || records[1].Type != RecordStop || records[1].Duration != 90*time.Second {
+		t.Errorf("records = %+v", records)
+	}
+
+	// Without credit the next call is rejected
+	err := c.Request(ctx, newRequest(sip.MethodINVITE, "call2", "1"), true)
+	if !errors.Is(err, ErrNoCredit) {
+		t.Errorf("Request() without credit error = %v, want ErrNoCredit", err)
+	}
+	if c.Sessions() != 0 {
+		t.Errorf("Sessions() = %d", c.Sessions())
+	}
+}
+
+func TestCharger_OnlineFailedSession(t *testing.T) {
+	ocs := NewStub(time.Minute)
+	c, _, _ := newTestCharger(ro.NewClient(connectStub(t, ocs, ro.Application)))
+	ctx := context.Background()
+
+	invite := newRequest(sip.MethodINVITE, "call1", "1")
+	if err := c.Request(ctx, invite, true); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	c.Response(ctx, newResponse(invite, sip.StatusBusyHere))
+
+	ccrs := ocs.CCRs()
+	if len(ccrs) != 2 || ccrs[1].RequestType != ro.RequestTermination || ccrs[1].UsedTime != 0 {
+		t.Errorf("CCRs = %+v", ccrs)
+	}
+}
+
+func TestRfWriter(t *testing.T) {
+	cdf := NewStub(time.Minute)
+	c, _, clk := newTestCharger(nil)
+	c.writer = NewRfWriter(rf.NewClient(connectStub(t, cdf, rf.Application)))
+	ctx := context.Background()
+
+	invite := newRequest(sip.MethodINVITE, "call1", "1")
+	c.Request(ctx, invite, true)
+	c.Response(ctx, newResponse(invite, sip.StatusOK))
+	clk.t = clk.t.Add(5 * time.Minute)
+	c.Expire(ctx)
+	c.Request(ctx, newRequest(sip.MethodBYE, "call1", "2"), true)
+
+	acrs := cdf.ACRs()
+	if len(acrs) != 3 {
+		t.Fatalf("ACRs = %d, want 3", len(acrs))
+	}
+	for i, recordType := range []uint32{diameter.RecordStart, diameter.RecordInterim, diameter.RecordStop} {
+		acr := acrs[i]
+		if acr.RecordType != recordType || acr.RecordNumber != uint32(i) || acr.SessionID != acrs[0].SessionID {
+			t.Errorf("ACR %d = %+v", i, acr)
+		}
+		if acr.IMS == nil || acr.IMS.ICID != "icid1" || acr.IMS.NodeFunctionality != rf.NodePCSCF || acr.IMS.RoleOfNode != rf.RoleOriginating {
+			t.Errorf("ACR %d IMS-Information = %+v", i, acr.IMS)
+		}
+	}
+}
+
+// ocsFunc is an OCS answering with a function
+type ocsFunc func(ctx context.Context, req *ro.CCR) (*ro.CCA, error)
+
+func (f ocsFunc) CreditControl(ctx context.Context, req *ro.CCR) (*ro.CCA, error) {
+	return f(ctx, req)
+}
+
+func TestCharger_OnlineRenewsBeforeExhaustion(t *testing.T) {
+	tests := []struct {
+		name     string
+		validity time.Duration
+		renewAt  time.Duration // After the answer
+	}{
+		{name: "quota threshold", renewAt: time.Minute - quotaThreshold},
+		{name: "validity time", validity: 20 * time.Second, renewAt: 20 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ccrs []*ro.CCR
+			ocs := ocsFunc(func(ctx context.Context, req *ro.CCR) (*ro.CCA, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				ccrs = append(ccrs, req)
+				return &ro.CCA{SessionID: "cc1", Result: ro.Success, GrantedTime: time.Minute, ValidityTime: tt.validity}, nil
+			})
+			c, _, clk := newTestCharger(ocs)
+			ctx := context.Background()
+			invite := newRequest(sip.MethodINVITE, "call1", "1")
+			if err := c.Request(ctx, invite, true); err != nil {
+				t.Fatalf("Request() error = %v", err)
+			}
+			c.Response(ctx, newResponse(invite, sip.StatusOK))
+			answered := clk.t
+
+			clk.t = answered.Add(tt.renewAt - time.Second)
+			c.Expire(ctx)
+			mu.Lock()
+			if len(ccrs) != 1 {
+				t.Errorf("%d CCRs before the renewal, want 1", len(ccrs))
+			}
+			mu.Unlock()
+
+			clk.t = answered.Add(tt.renewAt)
+			c.Expire(ctx)
+			mu.Lock()
+			if len(ccrs) != 2 || ccrs[1].RequestType != ro.RequestUpdate || ccrs[1].UsedTime != tt.renewAt {
+				t.Errorf("CCRs = %+v, want a CCR-U reporting %v", ccrs, tt.renewAt)
+			}
+			mu.Unlock()
+			if c.Sessions() != 1 {
+				t.Errorf("Sessions() = %d after the renewal", c.Sessions())
+			}
+		})
+	}
+}
+
+func TestCharger_OnlineRetransmittedINVITE(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  diameter.Result
+		wantErr error
+	}{
+		{name: "granted", result: ro.Success},
+		{name: "denied", result: diameter.Result{Code: ro.ResultCreditLimitReached}, wantErr: ErrNoCredit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ccrs int
+			received, answer := make(chan struct{}), make(chan struct{})
+			ocs := ocsFunc(func(ctx context.Context, req *ro.CCR) (*ro.CCA, error) {
+				mu.Lock()
+				ccrs++
+				mu.Unlock()
+				if req.RequestType == ro.RequestInitial {
+					close(received)
+					<-answer
+				}
+				return &ro.CCA{SessionID: "cc1", Result: tt.result, GrantedTime: time.Minute}, nil
+			})
+			c, _, _ := newTestCharger(ocs)
+			ctx := context.Background()
+
+			errs := make(chan error, 2)
+			go func() { errs <- c.Request(ctx, newRequest(sip.MethodINVITE, "call1", "1"), true) }()
+			<-received
+			// The retransmission waits for the reservation of the first
+			go func() { errs <- c.Request(ctx, newRequest(sip.MethodINVITE, "call1", "1"), true) }()
+			select {
+			case err := <-errs:
+				t.Fatalf("Request() returned %v before the CCA", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(answer)
+			for i := 0; i < 2; i++ {
+				if err := <-errs; !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+					t.Errorf("Request() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+
+			mu.Lock()
+			if ccrs != 1 {
+				t.Errorf("%d CCRs, want 1", ccrs)
+			}
+			mu.Unlock()
+			wantSessions := 1
+			if tt.wantErr != nil {
+				wantSessions = 0
+			}
+			if c.Sessions() != wantSessions {
+				t.Errorf("Sessions() = %d, want %d", c.Sessions(), wantSessions)
+			}
+		})
+	}
+}
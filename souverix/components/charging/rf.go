@@ -0,0 +1,120 @@
+package charging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rf"
+)
+
+// CDF sends the ACRs of the CTF to the charging data function; *rf.Client
+// implements it
+type CDF interface {
+	Accounting(ctx context.Context, req *rf.ACR) (*rf.ACA, error)
+}
+
+// RfWriter sends charging records to a CDF over Rf (TS 32.299 section
+// 6.1). The records of a session share the accounting session the CDF
+// answers its Start record with.
+type RfWriter struct {
+	cdf CDF
+
+	mu       sync.Mutex
+	sessions map[string]string // key: Call-ID, value: Rf Session-Id
+}
+
+// NewRfWriter creates a writer sending records to cdf
+func NewRfWriter(cdf CDF) *RfWriter {
+	return &RfWriter{
+		cdf:      cdf,
+		sessions: make(map[string]string),
+	}
+}
+
+// Write implements Writer
+func (w *RfWriter) Write(ctx context.Context, r *Record) error {
+	req := &rf.ACR{
+		RecordType:     rfRecordType(r.Type),
+		RecordNumber:   uint32(r.Number),
+		EventTimestamp: r.Time,
+		IMS:            imsInformation(r),
+	}
+	if r.Type == RecordInterim || r.Type == RecordStop {
+		w.mu.Lock()
+		req.SessionID = w.sessions[r.CallID]
+		if r.Type == RecordStop {
+			delete(w.sessions, r.CallID)
+		}
+		w.mu.Unlock()
+	}
+
+	aca, err := w.cdf.Accounting(ctx, req)
+	if err != nil {
+		return fmt.Errorf("ACR failed: %w", err)
+	}
+	if err := aca.Result.Err(); err != nil {
+		return fmt.Errorf("ACR rejected: %w", err)
+	}
+	if r.Type == RecordStart {
+		w.mu.Lock()
+		w.sessions[r.CallID] = aca.SessionID
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+// rfRecordType maps a record type to Accounting-Record-Type
+func rfRecordType(t RecordType) uint32 {
+	switch t {
+	case RecordStart:
+		return diameter.RecordStart
+	case RecordInterim:
+		return diameter.RecordInterim
+	case RecordStop:
+		return diameter.RecordStop
+	default:
+		return diameter.RecordEvent
+	}
+}
+
+// imsInformation encodes the IMS-Information of r
+func imsInformation(r *Record) *rf.IMSInformation {
+	info := &rf.IMSInformation{
+		NodeFunctionality: nodeFunctionality(r.Node),
+		RoleOfNode:        rf.RoleTerminating,
+		SIPMethod:         r.Method,
+		UserSessionID:     r.CallID,
+		CallingParty:      r.CallingParty,
+		CalledParty:       r.CalledParty,
+		RequestTime:       r.RequestTime,
+		ResponseTime:      r.ResponseTime,
+		ICID:              r.ICID,
+		OrigIOI:           r.OrigIOI,
+		TermIOI:           r.TermIOI,
+		CauseCode:         int32(r.CauseCode),
+	}
+	if r.Originating {
+		info.RoleOfNode = rf.RoleOriginating
+	}
+	return info
+}
+
+// nodeFunctionality maps a node to Node-Functionality
+func nodeFunctionality(node Node) uint32 {
+	switch node {
+	case NodePCSCF:
+		return rf.NodePCSCF
+	case NodeICSCF:
+		return rf.NodeICSCF
+	case NodeBGCF:
+		return rf.NodeBGCF
+	case NodeMGCF:
+		return rf.NodeMGCF
+	case NodeIBCF:
+		return rf.NodeIBCF
+	default:
+		return rf.NodeSCSCF
+	}
+}
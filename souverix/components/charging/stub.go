@@ -0,0 +1,127 @@
+package charging
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rf"
+	"github.com/dasmlab/souverix/common/diameter/ro"
+)
+
+// Stub is a local charging system for tests and labs: a CDF and an OCS
+// keeping what they receive in memory. Subscribers have unlimited credit
+// unless given a balance, which the time they use is taken from.
+type Stub struct {
+	grant time.Duration
+
+	mu       sync.Mutex
+	balances map[string]time.Duration // key: subscriber URI
+	acrs     []*rf.ACR
+	ccrs     []*ro.CCR
+	records  []*Record
+}
+
+// NewStub creates a stub OCS granting call time in units of grant
+func NewStub(grant time.Duration) *Stub {
+	return &Stub{
+		grant:    grant,
+		balances: make(map[string]time.Duration),
+	}
+}
+
+// Handler returns the Diameter handler serving the Rf and Ro requests of
+// peers with the stub
+func (s *Stub) Handler() diameter.Handler {
+	rfHandler := &rf.Handler{CDF: s}
+	roHandler := &ro.Handler{OCS: s}
+	return diameter.HandlerFunc(func(p *diameter.Peer, req *diameter.Message) *diameter.Message {
+		if req.AppID == rf.ApplicationID {
+			return rfHandler.ServeDiameter(p, req)
+		}
+		return roHandler.ServeDiameter(p, req)
+	})
+}
+
+// SetBalance sets the call time left to subscriber
+func (s *Stub) SetBalance(subscriber string, balance time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.balances[subscriber] = balance
+}
+
+// Balance returns the call time left to subscriber; ok is false when its
+// credit is unlimited
+func (s *Stub) Balance(subscriber string) (balance time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balance, ok = s.balances[subscriber]
+	return balance, ok
+}
+
+// Accounting implements rf.CDF
+func (s *Stub) Accounting(ctx context.Context, req *rf.ACR) *rf.ACA {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acrs = append(s.acrs, req)
+	return &rf.ACA{Result: rf.Success}
+}
+
+// CreditControl implements ro.OCS: the time used is taken from the balance
+// of the subscriber, and a grant is at most what is left of it
+func (s *Stub) CreditControl(ctx context.Context, req *ro.CCR) *ro.CCA {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ccrs = append(s.ccrs, req)
+
+	balance, limited := s.balances[req.Subscriber]
+	if limited {
+		balance -= req.UsedTime
+		if balance < 0 {
+			balance = 0
+		}
+		s.balances[req.Subscriber] = balance
+	}
+	if !req.RequestQuota {
+		return &ro.CCA{Result: ro.Success}
+	}
+	switch {
+	case !limited || balance > s.grant:
+		return &ro.CCA{Result: ro.Success, GrantedTime: s.grant}
+	case balance <= 0:
+		return &ro.CCA{Result: diameter.Result{Code: ro.ResultCreditLimitReached}}
+	default:
+		return &ro.CCA{Result: ro.Success, GrantedTime: balance, FinalUnit: true}
+	}
+}
+
+// Write implements Writer
+func (s *Stub) Write(ctx context.Context, r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := *r
+	s.records = append(s.records, &record)
+	return nil
+}
+
+// ACRs returns the ACRs received
+func (s *Stub) ACRs() []*rf.ACR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*rf.ACR(nil), s.acrs...)
+}
+
+// CCRs returns the CCRs received
+func (s *Stub) CCRs() []*ro.CCR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ro.CCR(nil), s.ccrs...)
+}
+
+// Records returns the records written
+func (s *Stub) Records() []*Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Record(nil), s.records...)
+}
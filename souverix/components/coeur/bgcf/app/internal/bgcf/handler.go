@@ -1,49 +1,292 @@
 package bgcf
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 	
+	"github.com/dasmlab/ims/internal/bgcf/routing"
+	"github.com/dasmlab/souverix/common/enum"
 	"github.com/dasmlab/souverix/common/sip"
 )
 
+// bgcfVia is the Via this BGCF adds to the INVITEs it forwards
+const bgcfVia = "SIP/2.0/UDP bgcf.example.com"
+
+// breakoutTimeout is how long a call is kept without a final response, as
+// Timer C of RFC 3261 would cancel it
+const breakoutTimeout = 3 * time.Minute
+
 // Handler handles SIP messages in BGCF
 type Handler struct {
-	mgcfPool []string
-	logger   *log.Logger
+	mgcfPool   []string
+	router     *routing.Router
+	translator *enum.Translator
+	logger     *log.Logger
+	
+	mu    sync.Mutex
+	calls map[string]*call // key: Call-ID
 }
 
-// NewHandler creates a new BGCF handler
+// call is a breakout in progress: the INVITE as received, kept to retry it
+// on the next route, the routes of the number and the Via branch of the
+// attempt waiting for its final response
+type call struct {
+	invite   *sip.Message
+	plan     *routing.Plan
+	branch   string // "" once the final response of the attempt was handled
+	deadline time.Time
+}
+
+// NewHandler creates a new BGCF handler. Until a routing table is set,
+// calls break out through the local MGCF pool.
 func NewHandler(logger *log.Logger) *Handler {
-	return &Handler{
+	h := &Handler{
 		mgcfPool: []string{"mgcf1.example.com", "mgcf2.example.com"},
 		logger:   logger,
+		calls:    make(map[string]*call),
+	}
+	var routes []*routing.Route
+	for _, mgcf := range h.mgcfPool {
+		routes = append(routes, &routing.Route{Kind: routing.KindMGCF, Next: mgcf, Weight: 1})
 	}
+	h.router = routing.NewRouter(routing.NewTable(routes...))
+	return h
+}
+
+// SetRouter sets the router selecting the breakout of numbers
+func (h *Handler) SetRouter(router *routing.Router) {
+	h.router = router
+}
+
+// SetTranslator enables ENUM and number portability lookups before
+// breakout
+func (h *Handler) SetTranslator(translator *enum.Translator) {
+	h.translator = translator
 }
 
-// HandleINVITE processes an INVITE request for PSTN breakout
+// HandleINVITE processes an INVITE request for PSTN breakout. A
+// retransmission of an INVITE being broken out is absorbed: nil is
+// returned.
 func (h *Handler) HandleINVITE(msg *sip.Message) (*sip.Message, string, error) {
 	h.logger.Printf("BGCF: Received INVITE for PSTN breakout from %s to %s", msg.From, msg.To)
 	
-	// Determine breakout network (local vs remote)
-	// For now, always use local breakout
-	localBreakout := true
+	h.mu.Lock()
+	c := h.calls[msg.CallID]
+	retransmission := c != nil && c.invite.CSeq == msg.CSeq && topBranch(c.invite.Headers["Via"]) == topBranch(msg.Headers["Via"])
+	h.mu.Unlock()
+	if retransmission {
+		return nil, "", nil
+	}
 	
-	if localBreakout {
-		// Select MGCF from local pool
-		mgcf := h.mgcfPool[0]
-		h.logger.Printf("BGCF: Local breakout selected, routing to MGCF: %s", mgcf)
-		
-		// Forward to MGCF (Mj interface)
-		return msg, mgcf, nil
+	// Numbers ported to a peer IMS network are reached over SIP, not the PSTN
+	if h.translator != nil {
+		route, err := h.translator.Translate(context.Background(), msg.URI)
+		switch {
+		case err != nil:
+			h.logger.Printf("BGCF: ENUM lookup of %s failed, breaking out: %v", msg.URI, err)
+		case route != nil && route.Destination != enum.DestinationPSTN:
+			h.logger.Printf("BGCF: +%s is served by %s, routing over SIP", route.Number, route.Network)
+			msg.URI = route.URI
+			return msg, route.Network, nil
+		case route != nil:
+			msg.URI = route.URI
+		}
 	}
 	
-	// Remote breakout would forward to remote BGCF (Mk interface)
-	return nil, "", fmt.Errorf("remote breakout not implemented yet")
+	// Determine breakout network (local vs remote) from the routing table
+	digits, ok := enum.Number(msg.URI)
+	if !ok {
+		digits, ok = enum.Number(msg.To)
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("no E.164 number to break out: %s", msg.URI)
+	}
+	plan, err := h.router.Plan(digits)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot break out +%s: %w", digits, err)
+	}
+	c = &call{invite: msg, plan: plan, deadline: time.Now().Add(breakoutTimeout)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(time.Now())
+	invite, next, err := h.attempt(c)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot break out +%s: %w", digits, err)
+	}
+	if old := h.calls[msg.CallID]; old != nil {
+		old.plan.Release()
+	}
+	h.calls[msg.CallID] = c
+	return invite, next, nil
+}
+
+// attempt sends c on its next route: it returns a copy of the INVITE with
+// a Via of a new branch, and its next hop. h.mu is held.
+func (h *Handler) attempt(c *call) (*sip.Message, string, error) {
+	route, err := c.plan.Next()
+	if err != nil {
+		c.branch = ""
+		return nil, "", err
+	}
+	if route.Kind == routing.KindBGCF {
+		// Forward to the BGCF of the breakout network (Mk interface)
+		h.logger.Printf("BGCF: Remote breakout selected, routing to BGCF: %s", route.Next)
+	} else {
+		// Forward to MGCF (Mj interface)
+		h.logger.Printf("BGCF: Local breakout selected, routing to MGCF: %s", route.Next)
+	}
+
+	c.branch = newBranch()
+	invite := *c.invite
+	invite.Headers = make(map[string]string, len(c.invite.Headers)+1)
+	for name, value := range c.invite.Headers {
+		invite.Headers[name] = value
+	}
+	via := bgcfVia + ";branch=" + c.branch
+	if upstream := c.invite.Headers["Via"]; upstream != "" {
+		via += ", " + upstream
+	}
+	invite.Headers["Via"] = via
+	return &invite, route.Next, nil
+}
+
+// expire forgets the calls left without a final response past their
+// deadline; h.mu is held
+func (h *Handler) expire(now time.Time) {
+	for callID, c := range h.calls {
+		if now.After(c.deadline) {
+			c.plan.Release()
+			delete(h.calls, callID)
+		}
+	}
 }
 
-// HandleResponse processes a SIP response
-func (h *Handler) HandleResponse(msg *sip.Message) (*sip.Message, error) {
+// HandleResponse processes a SIP response. The final response of the
+// current attempt of a call is handled once: a server error to an INVITE
+// is retried on the next route, the INVITE returned with its next hop;
+// any other releases the route of the call. Responses to be forwarded
+// upstream are returned without the Via of this BGCF and with no next hop.
+// Responses of earlier attempts and retransmitted final responses are
+// absorbed: nil is returned.
+func (h *Handler) HandleResponse(msg *sip.Message) (*sip.Message, string, error) {
 	h.logger.Printf("BGCF: Received %s response for Call-ID: %s", msg.Method, msg.CallID)
+	
+	status, err := strconv.Atoi(msg.Method)
+	if err != nil || !strings.HasSuffix(msg.CSeq, "INVITE") {
+		return msg, "", nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.calls[msg.CallID]
+	if c == nil {
+		// Retransmissions of a 2xx are forwarded after the call was released
+		stripVia(msg)
+		return msg, "", nil
+	}
+	if c.branch == "" || topBranch(msg.Headers["Via"]) != c.branch {
+		h.logger.Printf("BGCF: Absorbed %s response of an earlier attempt for Call-ID: %s", msg.Method, msg.CallID)
+		return nil, "", nil
+	}
+	stripVia(msg)
+	if status < 200 {
+		return msg, "", nil
+	}
+	c.branch = ""
+	if routing.Failover(status) {
+		if invite, next, err := h.failover(c); err == nil {
+			return invite, next, nil
+		}
+	}
+	// An answered call needs no slot past its setup: the BGCF is not on the
+	// path of its BYE
+	h.endCall(msg.CallID)
+	return msg, "", nil
+}
+
+// HandleTimeout handles an INVITE returned by HandleINVITE or
+// HandleResponse that its next hop left unanswered: it is retried on the
+// next route of the call. A timeout of an attempt already answered is
+// ignored.
+func (h *Handler) HandleTimeout(invite *sip.Message) (*sip.Message, string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.calls[invite.CallID]
+	if c == nil || c.branch == "" || topBranch(invite.Headers["Via"]) != c.branch {
+		return nil, "", fmt.Errorf("no pending breakout for Call-ID: %s", invite.CallID)
+	}
+	next, hop, err := h.failover(c)
+	if err != nil {
+		h.endCall(invite.CallID)
+		return nil, "", err
+	}
+	return next, hop, nil
+}
+
+// failover moves a call to its next route; h.mu is held
+func (h *Handler) failover(c *call) (*sip.Message, string, error) {
+	failed := c.plan.Current()
+	invite, next, err := h.attempt(c)
+	if err != nil {
+		h.logger.Printf("BGCF: No route left for Call-ID: %s", c.invite.CallID)
+		return nil, "", err
+	}
+	if failed != nil {
+		h.logger.Printf("BGCF: %s failed for Call-ID: %s, failing over to %s", failed.Next, c.invite.CallID, next)
+	}
+	return invite, next, nil
+}
+
+// HandleBYE releases the route of a call still being set up
+func (h *Handler) HandleBYE(msg *sip.Message) (*sip.Message, error) {
+	h.logger.Printf("BGCF: Received BYE for Call-ID: %s", msg.CallID)
+	h.mu.Lock()
+	h.endCall(msg.CallID)
+	h.mu.Unlock()
 	return msg, nil
 }
+
+// endCall releases the route of a call and forgets it; h.mu is held
+func (h *Handler) endCall(callID string) {
+	if c := h.calls[callID]; c != nil {
+		c.plan.Release()
+		delete(h.calls, callID)
+	}
+}
+
+// newBranch returns a new RFC 3261 Via branch
+func newBranch() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "z9hG4bK" + hex.EncodeToString(b)
+}
+
+// topBranch returns the branch parameter of the topmost Via
+func topBranch(via string) string {
+	top, _, _ := strings.Cut(via, ",")
+	for _, param := range strings.Split(top, ";")[1:] {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(param), "branch="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// stripVia removes the Via of this BGCF from the top of a response
+func stripVia(msg *sip.Message) {
+	via := msg.Headers["Via"]
+	if !strings.HasPrefix(via, bgcfVia+";") {
+		return
+	}
+	if _, rest, ok := strings.Cut(via, ","); ok {
+		msg.Headers["Via"] = strings.TrimSpace(rest)
+	} else {
+		delete(msg.Headers, "Via")
+	}
+}
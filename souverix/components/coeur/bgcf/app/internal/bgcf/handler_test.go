@@ -0,0 +1,170 @@
+package bgcf
+
+import (
+	"io"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/bgcf/routing"
+	"github.com/dasmlab/souverix/common/sip"
+)
+
+const upstreamVia = "SIP/2.0/UDP scscf.example.com;branch=z9hG4bKup1"
+
+// newTestHandler returns a handler breaking out through mgcf1, mgcf2 and a
+// remote BGCF, in that order, each with room for one call
+func newTestHandler() (*Handler, *routing.Router) {
+	h := NewHandler(log.New(io.Discard, "", 0))
+	router := routing.NewRouter(routing.NewTable(
+		&routing.Route{Next: "mgcf1.example.com", Cost: 1, Weight: 1, Capacity: 1},
+		&routing.Route{Next: "mgcf2.example.com", Cost: 2, Weight: 1, Capacity: 1},
+		&routing.Route{Kind: routing.KindBGCF, Next: "bgcf.carrier.example.net", Cost: 3, Weight: 1, Capacity: 1},
+	))
+	h.SetRouter(router)
+	return h, router
+}
+
+func newTestINVITE(callID string) *sip.Message {
+	msg := sip.NewINVITE("sip:alice@ims.example.com", "tel:+12025550100", callID)
+	msg.Headers["Via"] = upstreamVia
+	return msg
+}
+
+// newTestResponse returns a response of status to an INVITE sent by the
+// handler
+func newTestResponse(invite *sip.Message, status string) *sip.Message {
+	return &sip.Message{
+		Method:  status,
+		Version: "SIP/2.0",
+		Headers: map[string]string{"Via": invite.Headers["Via"]},
+		CallID:  invite.CallID,
+		CSeq:    invite.CSeq,
+	}
+}
+
+func TestHandler_Failover(t *testing.T) {
+	h, router := newTestHandler()
+
+	first, next, err := h.HandleINVITE(newTestINVITE("call1"))
+	if err != nil || next != "mgcf1.example.com" {
+		t.Fatalf("HandleINVITE() = %s, %v, want mgcf1.example.com", next, err)
+	}
+	if topBranch(first.Headers["Via"]) == "" || first.Headers["Via"] == upstreamVia {
+		t.Fatalf("Via = %q, want a Via of the BGCF on top", first.Headers["Via"])
+	}
+	// A retransmission of the INVITE is absorbed
+	if msg, _, err := h.HandleINVITE(newTestINVITE("call1")); msg != nil || err != nil {
+		t.Errorf("HandleINVITE() of a retransmission = %v, %v, want nil", msg, err)
+	}
+
+	// A provisional response is forwarded without the Via of the BGCF
+	if msg, next, _ := h.HandleResponse(newTestResponse(first, "100")); msg == nil || next != "" || msg.Headers["Via"] != upstreamVia {
+		t.Errorf("HandleResponse(100) = %+v, %q, want it forwarded upstream", msg, next)
+	}
+
+	// A server error fails over to the next route on a new branch
+	second, next, err := h.HandleResponse(newTestResponse(first, "503"))
+	if err != nil || next != "mgcf2.example.com" || second.Method != "INVITE" {
+		t.Fatalf("HandleResponse(503) = %v, %s, %v, want the INVITE to mgcf2.example.com", second, next, err)
+	}
+	if topBranch(second.Headers["Via"]) == topBranch(first.Headers["Via"]) {
+		t.Error("failover reused the branch of the first attempt")
+	}
+	if router.Active("mgcf1.example.com") != 0 || router.Active("mgcf2.example.com") != 1 {
+		t.Errorf("Active() = %d, %d, want 0, 1", router.Active("mgcf1.example.com"), router.Active("mgcf2.example.com"))
+	}
+
+	// The final response of the first attempt is handled once
+	if msg, next, _ := h.HandleResponse(newTestResponse(first, "503")); msg != nil || next != "" {
+		t.Errorf("HandleResponse() of a retransmitted 503 = %v, %q, want it absorbed", msg, next)
+	}
+	if _, _, err := h.HandleTimeout(first); err == nil {
+		t.Error("HandleTimeout() of the first attempt failed over the second")
+	}
+
+	// The answer is forwarded upstream and releases the route
+	answer, next, err := h.HandleResponse(newTestResponse(second, "200"))
+	if err != nil || next != "" || answer.Method != "200" || answer.Headers["Via"] != upstreamVia {
+		t.Errorf("HandleResponse(200) = %+v, %q, %v", answer, next, err)
+	}
+	if router.Active("mgcf2.example.com") != 0 {
+		t.Errorf("Active(mgcf2.example.com) = %d after the answer, want 0", router.Active("mgcf2.example.com"))
+	}
+	// A retransmitted 2xx is still forwarded
+	if msg, _, _ := h.HandleResponse(newTestResponse(second, "200")); msg == nil || msg.Headers["Via"] != upstreamVia {
+		t.Errorf("HandleResponse() of a retransmitted 200 = %+v, want it forwarded", msg)
+	}
+}
+
+func TestHandler_FailoverExhausted(t *testing.T) {
+	h, router := newTestHandler()
+
+	invite, _, err := h.HandleINVITE(newTestINVITE("call1"))
+	if err != nil {
+		t.Fatalf("HandleINVITE() error = %v", err)
+	}
+	var hops []string
+	for {
+		next, hop, err := h.HandleTimeout(invite)
+		if err != nil {
+			break
+		}
+		hops = append(hops, hop)
+		invite = next
+	}
+	if len(hops) != 2 || hops[0] != "mgcf2.example.com" || hops[1] != "bgcf.carrier.example.net" {
+		t.Errorf("failed over to %v", hops)
+	}
+	for _, next := range []string{"mgcf1.example.com", "mgcf2.example.com", "bgcf.carrier.example.net"} {
+		if router.Active(next) != 0 {
+			t.Errorf("Active(%s) = %d, want 0", next, router.Active(next))
+		}
+	}
+
+	// A final error without a route left is forwarded upstream
+	invite, _, _ = h.HandleINVITE(newTestINVITE("call2"))
+	invite, _, _ = h.HandleResponse(newTestResponse(invite, "503"))
+	invite, _, _ = h.HandleTimeout(invite)
+	msg, next, err := h.HandleResponse(newTestResponse(invite, "503"))
+	if err != nil || next != "" || msg == nil || msg.Method != "503" {
+		t.Errorf("HandleResponse() of the last route = %+v, %q, %v, want the 503 forwarded", msg, next, err)
+	}
+}
+
+func TestHandler_ResponseAndTimeoutRace(t *testing.T) {
+	h, router := newTestHandler()
+
+	invite, _, err := h.HandleINVITE(newTestINVITE("call1"))
+	if err != nil {
+		t.Fatalf("HandleINVITE() error = %v", err)
+	}
+	// Only one of the 503 and the timeout of the attempt fails it over
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failovers int
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(timeout bool) {
+			defer wg.Done()
+			var next string
+			if timeout {
+				_, next, _ = h.HandleTimeout(invite)
+			} else {
+				_, next, _ = h.HandleResponse(newTestResponse(invite, "503"))
+			}
+			if next != "" {
+				mu.Lock()
+				failovers++
+				mu.Unlock()
+			}
+		}(i == 0)
+	}
+	wg.Wait()
+	if failovers != 1 {
+		t.Errorf("%d failovers, want 1", failovers)
+	}
+	if router.Active("mgcf2.example.com") != 1 || router.Active("bgcf.carrier.example.net") != 0 {
+		t.Errorf("Active() = %d, %d, want 1, 0", router.Active("mgcf2.example.com"), router.Active("bgcf.carrier.example.net"))
+	}
+}
@@ -0,0 +1,185 @@
+package routing
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNoRoute is returned when no route is left for a number
+var ErrNoRoute = errors.New("no breakout route")
+
+// Router selects the breakout routes of calls from a reloadable table,
+// counting the calls through each next hop against its capacity
+type Router struct {
+	mu     sync.Mutex
+	table  *Table
+	active map[string]int // key: next hop
+
+	// now and rand are replaced in tests
+	now  func() time.Time
+	rand func(n int) int
+}
+
+// NewRouter creates a router on table
+func NewRouter(table *Table) *Router {
+	if table == nil {
+		table = NewTable()
+	}
+	return &Router{
+		table:  table,
+		active: make(map[string]int),
+		now:    time.Now,
+		rand:   rand.Intn,
+	}
+}
+
+// SetTable replaces the routing table. Calls in progress keep their routes
+// and count against the capacity of their next hop until released.
+func (r *Router) SetTable(table *Table) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.table = table
+}
+
+// Reload replaces the routing table with a file. On error the current
+// table is kept.
+func (r *Router) Reload(path string) error {
+	table, err := LoadTable(path)
+	if err != nil {
+		return err
+	}
+	r.SetTable(table)
+	return nil
+}
+
+// Active returns the number of calls through a next hop
+func (r *Router) Active(next string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active[next]
+}
+
+// Plan returns the ordered routes of a call to the number digits:
+// cheapest first, routes of the same cost in a random order weighted by
+// their weight (as SRV records, RFC 2782)
+func (r *Router) Plan(digits string) (*Plan, error) {
+	r.mu.Lock()
+	routes := r.table.Lookup(digits, r.now())
+	r.mu.Unlock()
+	if len(routes) == 0 {
+		return nil, ErrNoRoute
+	}
+
+	sorted := append([]*Route(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Cost < sorted[j].Cost })
+	ordered := make([]*Route, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && sorted[end].Cost == sorted[start].Cost {
+			end++
+		}
+		ordered = append(ordered, r.weighted(sorted[start:end])...)
+		start = end
+	}
+	return &Plan{router: r, routes: ordered}, nil
+}
+
+// weighted orders routes of the same cost by repeated weighted random
+// draws. Routes of weight 0 come last, in table order.
+func (r *Router) weighted(routes []*Route) []*Route {
+	var pool, zero []*Route
+	total := 0
+	for _, route := range routes {
+		if route.Weight == 0 {
+			zero = append(zero, route)
+			continue
+		}
+		pool = append(pool, route)
+		total += route.Weight
+	}
+
+	ordered := make([]*Route, 0, len(routes))
+	for len(pool) > 0 {
+		n := r.rand(total)
+		i := 0
+		for ; n >= pool[i].Weight; i++ {
+			n -= pool[i].Weight
+		}
+		ordered = append(ordered, pool[i])
+		total -= pool[i].Weight
+		pool = append(pool[:i], pool[i+1:]...)
+	}
+	return append(ordered, zero...)
+}
+
+// acquire takes a call slot on the next hop of route, if it has capacity
+func (r *Router) acquire(route *Route) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if route.Capacity > 0 && r.active[route.Next] >= route.Capacity {
+		return false
+	}
+	r.active[route.Next]++
+	return true
+}
+
+// release returns the call slot of route
+func (r *Router) release(route *Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active[route.Next] <= 1 {
+		delete(r.active, route.Next)
+		return
+	}
+	r.active[route.Next]--
+}
+
+// Plan is the ordered routes of a call, tried in turn until one succeeds
+type Plan struct {
+	router  *Router
+	routes  []*Route
+	next    int
+	current *Route
+}
+
+// Next releases the current route and returns the next one with capacity,
+// or ErrNoRoute when all were tried
+func (p *Plan) Next() (*Route, error) {
+	p.Release()
+	for p.next < len(p.routes) {
+		route := p.routes[p.next]
+		p.next++
+		if p.router.acquire(route) {
+			p.current = route
+			return route, nil
+		}
+	}
+	return nil, ErrNoRoute
+}
+
+// Current returns the route being tried, nil before Next and after Release
+func (p *Plan) Current() *Route {
+	return p.current
+}
+
+// Routes returns the routes of the plan, in order
+func (p *Plan) Routes() []*Route {
+	return p.routes
+}
+
+// Release releases the call slot of the current route, when the call ends
+func (p *Plan) Release() {
+	if p.current != nil {
+		p.router.release(p.current)
+		p.current = nil
+	}
+}
+
+// Failover reports whether a final response status to an INVITE should be
+// retried on the next route: server errors and timeouts
+func Failover(status int) bool {
+	return status == 408 || (status >= 500 && status < 600)
+}
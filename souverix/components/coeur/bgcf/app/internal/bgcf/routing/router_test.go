@@ -0,0 +1,174 @@
+package routing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRouter(t *testing.T, table string) *Router {
+	t.Helper()
+	tbl, err := ReadTable(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("ReadTable() error = %v", err)
+	}
+	r := NewRouter(tbl)
+	r.now = func() time.Time { return at(12, 0) }
+	r.rand = func(n int) int { return 0 }
+	return r
+}
+
+func nextHops(routes []*Route) string {
+	var hops []string
+	for _, route := range routes {
+		hops = append(hops, route.Next)
+	}
+	return strings.Join(hops, " ")
+}
+
+func TestRouter_Plan(t *testing.T) {
+	r := testRouter(t, testTable)
+
+	plan, err := r.Plan("12025550100")
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if got := nextHops(plan.Routes()); got != "mgcf1.example.com mgcf2.example.com bgcf.carrier.example.net" {
+		t.Errorf("Routes() = %s", got)
+	}
+
+	// Draws past the weight of mgcf1 pick mgcf2 first
+	r.rand = func(n int) int { return n - 1 }
+	plan, _ = r.Plan("12025550100")
+	if got := nextHops(plan.Routes()); got != "mgcf2.example.com mgcf1.example.com bgcf.carrier.example.net" {
+		t.Errorf("Routes() = %s", got)
+	}
+
+	if _, err := NewRouter(nil).Plan("1"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Plan() with no routes error = %v, want ErrNoRoute", err)
+	}
+}
+
+func TestRouter_WeightDistribution(t *testing.T) {
+	r := testRouter(t, testTable)
+	draws := 0
+	r.rand = func(n int) int {
+		draws++
+		return draws % n
+	}
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		plan, _ := r.Plan("12025550100")
+		first[plan.Routes()[0].Next]++
+	}
+	if first["mgcf1.example.com"] < 600 || first["mgcf1.example.com"] > 800 {
+		t.Errorf("mgcf1 first %d times out of 1000, want about 700", first["mgcf1.example.com"])
+	}
+}
+
+func TestPlan_Failover(t *testing.T) {
+	r := testRouter(t, testTable)
+	plan, err := r.Plan("12025550100")
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	var tried []string
+	for {
+		route, err := plan.Next()
+		if errors.Is(err, ErrNoRoute) {
+			break
+		}
+		tried = append(tried, route.Next)
+		if r.Active(route.Next) != 1 {
+			t.Errorf("Active(%s) = %d, want 1", route.Next, r.Active(route.Next))
+		}
+	}
+	if got := strings.Join(tried, " "); got != "mgcf1.example.com mgcf2.example.com bgcf.carrier.example.net" {
+		t.Errorf("tried %s", got)
+	}
+	for _, next := range tried {
+		if r.Active(next) != 0 {
+			t.Errorf("Active(%s) = %d after the plan, want 0", next, r.Active(next))
+		}
+	}
+}
+
+func TestPlan_Capacity(t *testing.T) {
+	r := testRouter(t, "1555,mgcf,mgcf3.example.com,5,1,2\n1555,bgcf,bgcf.carrier.example.net,10\n")
+
+	var plans []*Plan
+	for i := 0; i < 3; i++ {
+		plan, _ := r.Plan("15551234567")
+		route, err := plan.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		want := "mgcf3.example.com"
+		if i == 2 {
+			want = "bgcf.carrier.example.net"
+		}
+		if route.Next != want {
+			t.Errorf("call %d routed to %s, want %s", i, route.Next, want)
+		}
+		plans = append(plans, plan)
+	}
+
+	// A released call frees capacity
+	plans[0].Release()
+	if r.Active("mgcf3.example.com") != 1 {
+		t.Errorf("Active() = %d, want 1", r.Active("mgcf3.example.com"))
+	}
+	plan, _ := r.Plan("15551234567")
+	if route, _ := plan.Next(); route.Next != "mgcf3.example.com" {
+		t.Errorf("routed to %s after release, want mgcf3.example.com", route.Next)
+	}
+}
+
+func TestRouter_Reload(t *testing.T) {
+	r := testRouter(t, testTable)
+	plan, _ := r.Plan("12025550100")
+	plan.Next()
+
+	path := filepath.Join(t.TempDir(), "routes.csv")
+	if err := os.WriteFile(path, []byte("1,mgcf,mgcf9.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(path); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	next, _ := r.Plan("12025550100")
+	if got := nextHops(next.Routes()); got != "mgcf9.example.com" {
+		t.Errorf("Routes() after reload = %s", got)
+	}
+
+	// Calls in progress keep their slot until released
+	if r.Active("mgcf1.example.com") != 1 {
+		t.Errorf("Active() after reload = %d, want 1", r.Active("mgcf1.example.com"))
+	}
+	plan.Release()
+	if r.Active("mgcf1.example.com") != 0 {
+		t.Errorf("Active() after release = %d, want 0", r.Active("mgcf1.example.com"))
+	}
+
+	if err := os.WriteFile(path, []byte("1,mgcf\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(path); err == nil {
+		t.Error("Reload() of an invalid table succeeded")
+	}
+	if next, _ := r.Plan("12025550100"); nextHops(next.Routes()) != "mgcf9.example.com" {
+		t.Error("a failed reload replaced the table")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	for status, want := range map[int]bool{408: true, 500: true, 503: true, 486: false, 404: false, 603: false, 200: false} {
+		if got := Failover(status); got != want {
+			t.Errorf("Failover(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
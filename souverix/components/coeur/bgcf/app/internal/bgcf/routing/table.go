@@ -0,0 +1,236 @@
+// Package routing selects the breakout of E.164 numbers at the BGCF: a
+// local MGCF over Mj, or the BGCF of another network over Mk. Routes are
+// matched on the longest prefix of the number, ordered by cost then by
+// weight, and limited by time of day and capacity.
+package routing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the kind of next hop of a route
+type Kind int
+
+const (
+	// KindMGCF is a local breakout through an MGCF (Mj)
+	KindMGCF Kind = iota
+	// KindBGCF is a remote breakout through the BGCF of another network (Mk)
+	KindBGCF
+)
+
+// String returns the name of k
+func (k Kind) String() string {
+	if k == KindBGCF {
+		return "bgcf"
+	}
+	return "mgcf"
+}
+
+// parseKind parses the kind of a route
+func parseKind(s string) (Kind, error) {
+	switch strings.ToLower(s) {
+	case "mgcf", "local":
+		return KindMGCF, nil
+	case "bgcf", "remote":
+		return KindBGCF, nil
+	}
+	return 0, fmt.Errorf("invalid route kind %q", s)
+}
+
+// Window is a daily time window, from Start to End after midnight. A
+// window ending before it starts spans midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a time window given as HH:MM-HH:MM
+func ParseWindow(s string) (*Window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window %q", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	return &Window{Start: start, End: end}, nil
+}
+
+// parseClock parses a time of day given as HH:MM, 24:00 being the end of
+// the day
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		if strings.TrimSpace(s) == "24:00" {
+			return 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether the time of day of t is in the window
+func (w *Window) Contains(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return clock >= w.Start && clock < w.End
+	}
+	return clock >= w.Start || clock < w.End
+}
+
+// Route is a breakout route for the numbers starting with Prefix
+type Route struct {
+	Prefix string // E.164 digits, "" for every number
+	Kind   Kind
+	Next   string // Address of the MGCF or remote BGCF
+
+	// Cost orders the routes of a prefix, cheapest first. Weight spreads the
+	// calls over the routes of the same cost.
+	Cost   int
+	Weight int
+
+	// Window limits the route to a time of day; nil is always open
+	Window *Window
+
+	// Capacity is the maximum number of calls through Next, 0 for no limit
+	Capacity int
+}
+
+// Table maps number prefixes to their routes
+type Table struct {
+	routes  map[string][]*Route // key: prefix
+	longest int                 // Length of the longest prefix
+}
+
+// NewTable creates a table of routes
+func NewTable(routes ...*Route) *Table {
+	t := &Table{routes: make(map[string][]*Route)}
+	for _, route := range routes {
+		t.routes[route.Prefix] = append(t.routes[route.Prefix], route)
+		if len(route.Prefix) > t.longest {
+			t.longest = len(route.Prefix)
+		}
+	}
+	return t
+}
+
+// LoadTable reads a table of routes from a file
+func LoadTable(path string) (*Table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open routing table: %w", err)
+	}
+	defer file.Close()
+	t, err := ReadTable(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ReadTable reads a table of routes: one per line, with the fields
+//
+//	prefix,kind,next hop[,cost[,weight[,capacity[,HH:MM-HH:MM]]]]
+//
+// separated by commas. The prefix "*" matches every number; kind is mgcf
+// or bgcf. Blank lines and lines starting with "#" are ignored.
+func ReadTable(r io.Reader) (*Table, error) {
+	var routes []*Route
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		route, err := parseRoute(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewTable(routes...), nil
+}
+
+// parseRoute parses a line of a routing table
+func parseRoute(text string) (*Route, error) {
+	fields := strings.Split(text, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 3 || len(fields) > 7 {
+		return nil, fmt.Errorf("want prefix,kind,next hop[,cost[,weight[,capacity[,window]]]]")
+	}
+
+	route := &Route{Prefix: strings.TrimPrefix(fields[0], "+"), Next: fields[2], Weight: 1}
+	if route.Prefix == "*" {
+		route.Prefix = ""
+	} else if route.Prefix == "" || strings.Trim(route.Prefix, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid prefix %q", fields[0])
+	}
+	kind, err := parseKind(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	route.Kind = kind
+	if route.Next == "" {
+		return nil, fmt.Errorf("no next hop")
+	}
+
+	numbers := []*int{&route.Cost, &route.Weight, &route.Capacity}
+	for i, n := range numbers {
+		if len(fields) <= 3+i || fields[3+i] == "" {
+			continue
+		}
+		v, err := strconv.Atoi(fields[3+i])
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid number %q", fields[3+i])
+		}
+		*n = v
+	}
+	if len(fields) == 7 && fields[6] != "" {
+		if route.Window, err = ParseWindow(fields[6]); err != nil {
+			return nil, err
+		}
+	}
+	return route, nil
+}
+
+// Lookup returns the routes of the longest prefix of digits with a route
+// open at now, in table order
+func (t *Table) Lookup(digits string, now time.Time) []*Route {
+	for n := min(len(digits), t.longest); n >= 0; n-- {
+		var open []*Route
+		for _, route := range t.routes[digits[:n]] {
+			if route.Window == nil || route.Window.Contains(now) {
+				open = append(open, route)
+			}
+		}
+		if len(open) > 0 {
+			return open
+		}
+	}
+	return nil
+}
+
+// Len returns the number of routes
+func (t *Table) Len() int {
+	n := 0
+	for _, routes := range t.routes {
+		n += len(routes)
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTable = `# prefix,kind,next hop,cost,weight,capacity,window
+*,bgcf,bgcf.transit.example.net,50
+1,mgcf,mgcf1.example.com,10,70,100
+1,mgcf,mgcf2.example.com,10,30,100
+1,bgcf,bgcf.carrier.example.net,20
++1555,mgcf,mgcf3.example.com,5,1,2,08:00-18:00
+44,bgcf,bgcf.uk.example.net,5,1,,22:00-06:00
+`
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 1, 1, hour, minute, 0, 0, time.UTC)
+}
+
+func TestReadTable(t *testing.T) {
+	table, err := ReadTable(strings.NewReader(testTable))
+	if err != nil {
+		t.Fatalf("ReadTable() error = %v", err)
+	}
+	if table.Len() != 6 {
+		t.Errorf("Len() = %d, want 6", table.Len())
+	}
+
+	route := table.Lookup("15551234567", at(12, 0))[0]
+	want := Route{Prefix: "1555", Kind: KindMGCF, Next: "mgcf3.example.com", Cost: 5, Weight: 1, Capacity: 2}
+	if route.Window == nil || route.Window.Start != 8*time.Hour || route.Window.End != 18*time.Hour {
+		t.Errorf("Window = %+v", route.Window)
+	}
+	route.Window = nil
+	if *route != want {
+		t.Errorf("route = %+v, want %+v", *route, want)
+	}
+
+	invalid := []string{
+		"1",
+		"1,mgcf",
+		"x1,mgcf,mgcf1.example.com",
+		",mgcf,mgcf1.example.com",
+		"1,sgw,mgcf1.example.com",
+		"1,mgcf,",
+		"1,mgcf,mgcf1.example.com,-1",
+		"1,mgcf,mgcf1.example.com,1,x",
+		"1,mgcf,mgcf1.example.com,1,1,1,8-18",
+		"1,mgcf,mgcf1.example.com,1,1,1,08:00-18:00,extra",
+	}
+	for _, line := range invalid {
+		if _, err := ReadTable(strings.NewReader(line)); err == nil {
+			t.Errorf("ReadTable(%q) succeeded", line)
+		}
+	}
+}
+
+func TestTable_Lookup(t *testing.T) {
+	table, err := ReadTable(strings.NewReader(testTable))
+	if err != nil {
+		t.Fatalf("ReadTable() error = %v", err)
+	}
+	tests := []struct {
+		digits string
+		now    time.Time
+		want   []string
+	}{
+		{"15551234567", at(12, 0), []string{"mgcf3.example.com"}},
+		// Outside the window of 1555, the routes of 1 apply
+		{"15551234567", at(19, 0), []string{"mgcf1.example.com", "mgcf2.example.com", "bgcf.carrier.example.net"}},
+		{"12025550100", at(12, 0), []string{"mgcf1.example.com", "mgcf2.example.com", "bgcf.carrier.example.net"}},
+		{"442071234567", at(23, 30), []string{"bgcf.uk.example.net"}},
+		{"442071234567", at(5, 59), []string{"bgcf.uk.example.net"}},
+		{"442071234567", at(6, 0), []string{"bgcf.transit.example.net"}},
+		{"33123456789", at(12, 0), []string{"bgcf.transit.example.net"}},
+	}
+	for _, tt := range tests {
+		routes := table.Lookup(tt.digits, tt.now)
+		var got []string
+		for _, route := range routes {
+			got = append(got, route.Next)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("Lookup(%s, %s) = %v, want %v", tt.digits, tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+
+	if routes := NewTable().Lookup("1", at(0, 0)); routes != nil {
+		t.Errorf("Lookup() in an empty table = %v", routes)
+	}
+}
+
+func TestWindow_Contains(t *testing.T) {
+	tests := []struct {
+		window string
+		now    time.Time
+		want   bool
+	}{
+		{"08:00-18:00", at(8, 0), true},
+		{"08:00-18:00", at(17, 59), true},
+		{"08:00-18:00", at(18, 0), false},
+		{"22:00-06:00", at(0, 0), true},
+		{"22:00-06:00", at(12, 0), false},
+		{"00:00-24:00", at(23, 59), true},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.window)
+		if err != nil {
+			t.Fatalf("ParseWindow(%s) error = %v", tt.window, err)
+		}
+		if got := w.Contains(tt.now); got != tt.want {
+			t.Errorf("%s Contains(%s) = %v, want %v", tt.window, tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestLoadTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.csv")
+	if err := os.WriteFile(path, []byte(testTable), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadTable(path)
+	if err != nil {
+		t.Fatalf("LoadTable() error = %v", err)
+	}
+	if table.Len() != 6 {
+		t.Errorf("Len() = %d, want 6", table.Len())
+	}
+	if _, err := LoadTable(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("LoadTable() of a missing file succeeded")
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/dasmlab/ims/internal/bgcf"
 	"github.com/dasmlab/souverix/common/diagnostics"
+	"github.com/dasmlab/souverix/common/enum"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -59,6 +62,20 @@ func main() {
 	r1.Use(gin.LoggerWithWriter(logger.Writer()))
 	r1.Use(gin.Recovery())
 
+	// Set up SIP handling: numbers ported to peer IMS networks are found
+	// with ENUM and the number portability database before breakout
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	handler := bgcf.NewHandler(log.New(logger.Writer(), "", 0))
+	translator, err := enum.Setup(ctx, enum.ConfigFromEnv())
+	if err != nil {
+		logger.WithError(err).Fatal("failed to set up ENUM")
+	}
+	if translator != nil {
+		handler.SetTranslator(translator)
+		logger.Info("ENUM and number portability lookups enabled")
+	}
+
 	// Initialize metrics router (r2) - Prometheus metrics, out of band
 	r2 := gin.New()
 	r2.Use(gin.LoggerWithWriter(logger.Writer()))
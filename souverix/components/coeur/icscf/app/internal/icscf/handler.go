@@ -1,26 +1,35 @@
 package icscf
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"time"
 	
-	"github.com/dasmlab/souverix/common/hss"
 	"github.com/dasmlab/souverix/common/sip"
 )
 
+// selectTimeout bounds the Cx queries of an S-CSCF selection
+const selectTimeout = 5 * time.Second
+
+// SCSCFSelector chooses the S-CSCF a request is forwarded to from the HSS
+// assignment and the configured S-CSCF pool, normally the I-CSCF
+// component's *icscf.Selector
+type SCSCFSelector interface {
+	SelectForRequest(ctx context.Context, impu string) (string, error)
+}
+
 // Handler handles SIP messages in I-CSCF
 type Handler struct {
-	hssClient *hss.HSSClient
-	scscfPool []string
-	logger    *log.Logger
+	selector SCSCFSelector
+	logger   *log.Logger
 }
 
 // NewHandler creates a new I-CSCF handler
-func NewHandler(hssClient *hss.HSSClient, logger *log.Logger) *Handler {
+func NewHandler(selector SCSCFSelector, logger *log.Logger) *Handler {
 	return &Handler{
-		hssClient: hssClient,
-		scscfPool: []string{"scscf1.example.com", "scscf2.example.com"},
-		logger:    logger,
+		selector: selector,
+		logger:   logger,
 	}
 }
 
@@ -28,18 +37,16 @@ func NewHandler(hssClient *hss.HSSClient, logger *log.Logger) *Handler {
 func (h *Handler) HandleINVITE(msg *sip.Message) (*sip.Message, string, error) {
 	h.logger.Printf("I-CSCF: Received INVITE from %s to %s", msg.From, msg.To)
 	
-	// Extract user identity from From header
-	impi := h.extractIMPI(msg.From)
-	
-	// Query HSS for S-CSCF assignment (UAR/UAA)
-	scscf, capabilities, err := h.hssClient.GetSCSCFAssignment(impi)
+	// The served user of a terminating request is the Request-URI
+	// (TS 24.229 section 5.3.2.1)
+	ctx, cancel := context.WithTimeout(context.Background(), selectTimeout)
+	defer cancel()
+	scscf, err := h.selector.SelectForRequest(ctx, msg.URI)
 	if err != nil {
-		h.logger.Printf("I-CSCF: HSS query failed, using default S-CSCF")
-		scscf = h.scscfPool[0] // Fallback to first S-CSCF
+		h.logger.Printf("I-CSCF: No S-CSCF for %s: %v", msg.URI, err)
+		return nil, "", fmt.Errorf("S-CSCF selection failed: %w", err)
 	}
 	
-	h.logger.Printf("I-CSCF: HSS assigned S-CSCF: %s (capabilities: %v)", scscf, capabilities)
-	
 	// Forward to selected S-CSCF (Mw interface)
 	h.logger.Printf("I-CSCF: Forwarding INVITE to S-CSCF at %s", scscf)
 	
@@ -53,11 +60,3 @@ func (h *Handler) HandleResponse(msg *sip.Message) (*sip.Message, error) {
 	// Forward response back (topology hiding)
 	return msg, nil
 }
-
-func (h *Handler) extractIMPI(from string) string {
-	// Simplified extraction - in real implementation, parse SIP URI properly
-	if from == "" {
-		return "sip:user@example.com"
-	}
-	return from
-}
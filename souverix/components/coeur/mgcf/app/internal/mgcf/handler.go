@@ -1,62 +1,418 @@
 package mgcf
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
-	
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dasmlab/ims/internal/mgcf/interwork"
+	"github.com/dasmlab/ims/internal/mgcf/isup"
+	"github.com/dasmlab/souverix/common/h248"
 	"github.com/dasmlab/souverix/common/sip"
 )
 
+// Trunk sends ISUP messages to the PSTN (Nc interface)
+type Trunk interface {
+	Send(msg *isup.Message) error
+}
+
 // Handler handles SIP messages in MGCF
 type Handler struct {
-	logger *log.Logger
+	trunk     Trunk
+	numbering interwork.Numbering
+	variant   *isup.Variant // SIP-I/SIP-T encapsulation, nil for plain SIP
+	gateway   *h248.Controller
+	logger    *log.Logger
+
+	mu       sync.Mutex
+	calls    map[string]*call // key: Call-ID
+	circuits map[uint16]*call // key: CIC
+	nextCIC  uint16
+}
+
+// call is a call interworked on a circuit, with the INVITE of its SIP side
+// and its bearer through the MGW
+type call struct {
+	callID string
+	invite *sip.Message
+	isup   *interwork.Call
+	bearer *h248.Bearer
 }
 
-// NewHandler creates a new MGCF handler
-func NewHandler(logger *log.Logger) *Handler {
+// NewHandler creates a new MGCF handler sending ISUP to trunk. Numbers of
+// countryCode are national on the PSTN side.
+func NewHandler(trunk Trunk, countryCode string, logger *log.Logger) *Handler {
 	return &Handler{
-		logger: logger,
+		trunk:     trunk,
+		numbering: interwork.Numbering{CountryCode: countryCode},
+		logger:    logger,
+		calls:     make(map[string]*call),
+		circuits:  make(map[uint16]*call),
 	}
 }
 
-// HandleINVITE processes an INVITE request for PSTN interworking
+// SetEncapsulation carries the ISUP messages in the SIP bodies, as SIP-I
+// or SIP-T
+func (h *Handler) SetEncapsulation(variant isup.Variant) {
+	h.variant = &variant
+}
+
+// SetGateway controls the MGW terminating the circuits through gateway
+// (Mn interface): each call gets a bearer joining its circuit to RTP
+func (h *Handler) SetGateway(gateway *h248.Controller) {
+	h.gateway = gateway
+}
+
+// HandleINVITE processes an INVITE request for PSTN interworking and
+// returns the response to send: 100 Trying once the IAM is sent, the
+// further responses following the backward ISUP messages. An INVITE of a
+// known Call-ID is a retransmission or a re-INVITE of the call.
 func (h *Handler) HandleINVITE(msg *sip.Message) (*sip.Message, error) {
 	h.logger.Printf("MGCF: Received INVITE for PSTN interworking from %s to %s", msg.From, msg.To)
-	
+
+	h.mu.Lock()
+	c := h.calls[msg.CallID]
+	h.mu.Unlock()
+	if c != nil {
+		// A call to the PSTN was set up by an INVITE of the same CSeq; on a
+		// call from the PSTN the MGCF sent the initial INVITE
+		if c.isup.Direction == interwork.Outgoing && msg.CSeq == c.invite.CSeq {
+			return h.response(msg, 100, ""), nil
+		}
+		return h.reinvite(c, msg), nil
+	}
+
+	inv := interwork.Invite{
+		To:         msg.URI,
+		From:       msg.Headers["P-Asserted-Identity"],
+		Restricted: strings.Contains(strings.ToLower(msg.Headers["Privacy"]), "id"),
+	}
+	if inv.From == "" {
+		inv.From = msg.From
+	}
+	if contentType := msg.Headers["Content-Type"]; strings.HasPrefix(strings.ToLower(contentType), "multipart/") {
+		if _, iam, err := isup.DecodeBody(contentType, []byte(msg.Body)); err == nil {
+			inv.ISUP = iam
+		} else {
+			h.logger.Printf("MGCF: Ignoring invalid SIP-I body: %v", err)
+		}
+	}
+
+	h.mu.Lock()
+	if h.calls[msg.CallID] != nil {
+		// A retransmission raced this INVITE and took the call
+		h.mu.Unlock()
+		return h.response(msg, 100, ""), nil
+	}
+	cic, err := h.allocateCIC()
+	if err != nil {
+		h.mu.Unlock()
+		return h.response(msg, 503, ""), nil
+	}
+	c = &call{callID: msg.CallID, invite: msg, isup: interwork.NewCall(cic, interwork.Outgoing, h.numbering)}
+	h.calls[msg.CallID] = c
+	h.circuits[cic] = c
+	h.mu.Unlock()
+
+	// Seize the bearer before the circuit, for the backward early media
+	if h.gateway != nil {
+		bearer, err := h.gateway.Setup(context.Background(), cic, msg.Body)
+		if err != nil {
+			h.endCall(c)
+			h.logger.Printf("MGCF: Cannot set up bearer on CIC %d: %v", cic, err)
+			return h.response(msg, 503, ""), nil
+		}
+		c.bearer = bearer
+	}
+
 	// Convert SIP INVITE to ISUP IAM
-	h.logger.Printf("MGCF: Converting SIP INVITE to ISUP IAM")
-	
-	// Control MGW via H.248 (Mg interface)
-	h.logger.Printf("MGCF: Sending H.248 Add command to MGW")
-	
+	iam, err := c.isup.Invite(inv)
+	if err != nil {
+		h.endCall(c)
+		h.logger.Printf("MGCF: Cannot convert INVITE to IAM: %v", err)
+		return h.response(msg, 484, ""), nil
+	}
+
 	// Send ISUP IAM to PSTN (Nc interface)
-	h.logger.Printf("MGCF: Sending ISUP IAM to PSTN")
-	
-	// For now, simulate PSTN response
-	// In real implementation, wait for ISUP ACM/ANM
+	h.logger.Printf("MGCF: Sending ISUP IAM to PSTN on CIC %d", cic)
+	if err := h.trunk.Send(iam); err != nil {
+		h.endCall(c)
+		return h.response(msg, 503, ""), nil
+	}
+
+	// The further responses follow the backward ISUP messages
+	return h.response(msg, 100, ""), nil
+}
+
+// reinvite answers a re-INVITE of an answered call, moving its bearer to
+// the new session description. Before answer it is refused: the INVITE of
+// the call is still pending.
+func (h *Handler) reinvite(c *call, msg *sip.Message) *sip.Message {
+	if c.isup.State() != interwork.StateAnswered {
+		return h.response(msg, 491, "")
+	}
+	resp := h.response(msg, 200, "")
+	if c.bearer != nil && msg.Body != "" {
+		if err := h.gateway.Modify(context.Background(), c.bearer, h248.ModeSendReceive, msg.Body); err != nil {
+			h.logger.Printf("MGCF: Cannot modify bearer on CIC %d: %v", c.isup.CIC, err)
+			return h.response(msg, 488, "")
+		}
+	}
+	h.setSDP(resp, c)
+	return resp
+}
+
+// allocateCIC returns a free circuit. h.mu must be held.
+func (h *Handler) allocateCIC() (uint16, error) {
+	for i := 0; i < 0x0fff; i++ {
+		h.nextCIC = h.nextCIC%0x0fff + 1
+		if h.circuits[h.nextCIC] == nil {
+			return h.nextCIC, nil
+		}
+	}
+	return 0, fmt.Errorf("no free circuit")
+}
+
+// HandleISUP processes an ISUP message from the PSTN and returns the SIP
+// message it maps to, nil when none
+func (h *Handler) HandleISUP(msg *isup.Message) (*sip.Message, error) {
+	h.logger.Printf("MGCF: Received ISUP %s on CIC %d", msg.Type, msg.CIC)
+
+	h.mu.Lock()
+	c := h.circuits[msg.CIC]
+	if c == nil && msg.Type == isup.TypeIAM {
+		c = &call{callID: newCallID(msg.CIC), isup: interwork.NewCall(msg.CIC, interwork.Incoming, h.numbering)}
+		h.circuits[msg.CIC] = c
+		h.calls[c.callID] = c
+	}
+	h.mu.Unlock()
+	if c == nil {
+		return nil, fmt.Errorf("no call on CIC %d", msg.CIC)
+	}
+
+	action, err := c.isup.Receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	if action.Reply != nil {
+		if err := h.trunk.Send(action.Reply); err != nil {
+			h.logger.Printf("MGCF: Cannot send ISUP %s: %v", action.Reply.Type, err)
+		}
+	}
+	if c.isup.State() == interwork.StateReleased {
+		h.endCall(c)
+	}
+
+	switch {
+	case action.Invite != nil:
+		if h.gateway != nil {
+			bearer, err := h.gateway.Setup(context.Background(), msg.CIC, "")
+			if err != nil {
+				// The circuit cannot be connected: refuse the call
+				h.logger.Printf("MGCF: Cannot set up bearer on CIC %d: %v", msg.CIC, err)
+				rel, _ := c.isup.Release(isup.CauseResourceUnavailable)
+				if rel != nil {
+					return nil, h.trunk.Send(rel)
+				}
+				return nil, nil
+			}
+			c.bearer = bearer
+		}
+
+		// Convert ISUP IAM to SIP INVITE
+		h.logger.Printf("MGCF: Converting ISUP IAM to SIP INVITE for %s", action.Invite.To)
+		invite := sip.NewINVITE(action.Invite.From, action.Invite.To, c.callID)
+		invite.Headers["P-Asserted-Identity"] = action.Invite.From
+		if action.Invite.Restricted {
+			invite.Headers["Privacy"] = "id"
+		}
+		h.setSDP(invite, c)
+		h.encapsulate(invite, msg)
+		c.invite = invite
+		return invite, nil
+	case action.Status != 0:
+		h.logger.Printf("MGCF: Converting ISUP %s to SIP %d", msg.Type, action.Status)
+		resp := h.response(c.invite, action.Status, action.Reason)
+		if action.EarlyMedia {
+			// The MGW through-connects the backward media path before answer
+			resp.Headers["P-Early-Media"] = "sendrecv"
+		}
+		if action.Status == 200 && c.bearer != nil {
+			if err := h.gateway.Connect(context.Background(), c.bearer, ""); err != nil {
+				h.logger.Printf("MGCF: Cannot connect bearer on CIC %d: %v", msg.CIC, err)
+			}
+		}
+		if action.Status < 300 {
+			h.setSDP(resp, c)
+		}
+		h.encapsulate(resp, msg)
+		return resp, nil
+	case action.Bye:
+		return h.request(c, "BYE", action.Reason), nil
+	case action.Cancel:
+		return h.request(c, "CANCEL", action.Reason), nil
+	}
 	return nil, nil
 }
 
-// HandlePSTNResponse simulates PSTN response (ISUP ACM/ANM)
-func (h *Handler) HandlePSTNResponse(callID string, responseType string) (*sip.Message, error) {
-	h.logger.Printf("MGCF: Received PSTN response: %s for Call-ID: %s", responseType, callID)
-	
-	switch responseType {
-	case "ACM":
-		// Convert ISUP ACM to SIP 180 Ringing
-		h.logger.Printf("MGCF: Converting ISUP ACM to SIP 180 Ringing")
-		return &sip.Message{
-			Method: "180",
-			CallID: callID,
-		}, nil
-	case "ANM":
-		// Convert ISUP ANM to SIP 200 OK
-		h.logger.Printf("MGCF: Converting ISUP ANM to SIP 200 OK")
-		return &sip.Message{
-			Method: "200",
-			CallID: callID,
-		}, nil
-	default:
-		return nil, fmt.Errorf("unknown PSTN response type: %s", responseType)
+// HandleResponse processes a SIP response to the INVITE of a call from the
+// PSTN, sending the backward ISUP messages it maps to
+func (h *Handler) HandleResponse(msg *sip.Message) error {
+	h.logger.Printf("MGCF: Received %s response for Call-ID: %s", msg.Method, msg.CallID)
+
+	status, err := strconv.Atoi(msg.Method)
+	if err != nil {
+		return fmt.Errorf("not a SIP response: %s", msg.Method)
+	}
+	h.mu.Lock()
+	c := h.calls[msg.CallID]
+	h.mu.Unlock()
+	if c == nil || c.isup.Direction != interwork.Incoming {
+		return nil
+	}
+	msgs, err := c.isup.Response(status, msg.Body != "")
+	if err != nil {
+		return err
+	}
+	if c.bearer != nil && msg.Body != "" && status < 300 {
+		// The answer of the callee is the remote side of the bearer; early
+		// media are only received from it
+		mode := h248.ModeReceiveOnly
+		if status >= 200 {
+			mode = h248.ModeSendReceive
+		}
+		if err := h.gateway.Modify(context.Background(), c.bearer, mode, msg.Body); err != nil {
+			h.logger.Printf("MGCF: Cannot modify bearer on CIC %d: %v", c.isup.CIC, err)
+		}
+	}
+	for _, m := range msgs {
+		h.logger.Printf("MGCF: Converting SIP %d to ISUP %s", status, m.Type)
+		if err := h.trunk.Send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleBYE processes a BYE or CANCEL of the SIP side, releasing the
+// circuit
+func (h *Handler) HandleBYE(msg *sip.Message) (*sip.Message, error) {
+	h.logger.Printf("MGCF: Received %s for Call-ID: %s", msg.Method, msg.CallID)
+
+	h.mu.Lock()
+	c := h.calls[msg.CallID]
+	h.mu.Unlock()
+	if c == nil {
+		return h.response(msg, 481, ""), nil
+	}
+	rel, err := c.isup.Release(isup.CauseNormalClearing)
+	if err != nil {
+		return nil, err
+	}
+	if rel != nil {
+		h.logger.Printf("MGCF: Sending ISUP REL on CIC %d", rel.CIC)
+		if err := h.trunk.Send(rel); err != nil {
+			return nil, err
+		}
+	}
+	return h.response(msg, 200, ""), nil
+}
+
+// encapsulate adds the ISUP message a SIP message maps from to its body,
+// when SIP-I or SIP-T is used
+func (h *Handler) encapsulate(msg *sip.Message, m *isup.Message) {
+	if h.variant == nil {
+		return
+	}
+	contentType, body, err := isup.EncodeBody(msg.Body, m, *h.variant)
+	if err != nil {
+		h.logger.Printf("MGCF: Cannot encapsulate ISUP %s: %v", m.Type, err)
+		return
 	}
+	msg.Headers["Content-Type"] = contentType
+	msg.Body = string(body)
+}
+
+// setSDP sets the session description of the bearer of a call as the body
+// of msg, when it has none
+func (h *Handler) setSDP(msg *sip.Message, c *call) {
+	if c.bearer == nil || msg.Body != "" || c.bearer.LocalSDP == "" {
+		return
+	}
+	msg.Headers["Content-Type"] = isup.MediaTypeSDP
+	msg.Body = c.bearer.LocalSDP
+}
+
+// response creates a response to a request, with a Reason header for
+// releases
+func (h *Handler) response(req *sip.Message, status int, reason string) *sip.Message {
+	resp := &sip.Message{
+		Method:  strconv.Itoa(status),
+		Version: "SIP/2.0",
+		Headers: make(map[string]string),
+		From:    req.From,
+		To:      req.To,
+		CallID:  req.CallID,
+		CSeq:    req.CSeq,
+		Route:   req.RecordRoute,
+	}
+	if reason != "" {
+		resp.Headers["Reason"] = reason
+	}
+	return resp
+}
+
+// request creates a BYE or CANCEL in the dialog of a call
+func (h *Handler) request(c *call, method, reason string) *sip.Message {
+	req := &sip.Message{
+		Method:  method,
+		URI:     c.invite.URI,
+		Version: "SIP/2.0",
+		Headers: map[string]string{"Reason": reason},
+		From:    c.invite.From,
+		To:      c.invite.To,
+		CallID:  c.callID,
+		CSeq:    "2 " + method,
+		Route:   c.invite.Route,
+	}
+	// On a call to the PSTN the MGCF is the callee
+	if c.isup.Direction == interwork.Outgoing {
+		req.URI, req.From, req.To = c.invite.Contact, c.invite.To, c.invite.From
+		req.Route = c.invite.RecordRoute
+	}
+	// A CANCEL has the sequence number of the INVITE (RFC 3261 9.1)
+	if n, _, ok := strings.Cut(c.invite.CSeq, " "); ok && method == "CANCEL" {
+		req.CSeq = n + " CANCEL"
+	}
+	return req
+}
+
+// endCall frees the circuit of a released call and its bearer
+func (h *Handler) endCall(c *call) {
+	h.mu.Lock()
+	delete(h.calls, c.callID)
+	if h.circuits[c.isup.CIC] == c {
+		delete(h.circuits, c.isup.CIC)
+	}
+	bearer := c.bearer
+	c.bearer = nil
+	h.mu.Unlock()
+
+	if bearer != nil {
+		if err := h.gateway.Release(context.Background(), bearer); err != nil {
+			h.logger.Printf("MGCF: Cannot release bearer on CIC %d: %v", c.isup.CIC, err)
+		}
+	}
+}
+
+// newCallID returns the Call-ID of a call from the PSTN
+func newCallID(cic uint16) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("mgcf-%d-%s", cic, hex.EncodeToString(b))
 }
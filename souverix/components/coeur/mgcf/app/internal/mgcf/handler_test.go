@@ -0,0 +1,209 @@
+package mgcf
+
+import (
+	"io"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/mgcf/isup"
+	"github.com/dasmlab/souverix/common/sip"
+)
+
+// fakeTrunk records the ISUP messages sent to the PSTN
+type fakeTrunk struct {
+	mu   sync.Mutex
+	sent []*isup.Message
+}
+
+func (t *fakeTrunk) Send(msg *isup.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+// types returns the types of the messages sent and forgets them
+func (t *fakeTrunk) types() []isup.MessageType {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var types []isup.MessageType
+	for _, m := range t.sent {
+		types = append(types, m.Type)
+	}
+	t.sent = nil
+	return types
+}
+
+func newTestHandler() (*Handler, *fakeTrunk) {
+	trunk := &fakeTrunk{}
+	return NewHandler(trunk, "1", log.New(io.Discard, "", 0)), trunk
+}
+
+// inUse returns the number of calls and circuits in use
+func (h *Handler) inUse() (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.calls), len(h.circuits)
+}
+
+func sameTypes(got []isup.MessageType, want ...isup.MessageType) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// outgoingCall sets up a call to the PSTN and returns its INVITE and CIC
+func outgoingCall(t *testing.T, h *Handler, trunk *fakeTrunk) (*sip.Message, uint16) {
+	t.Helper()
+	invite := sip.NewINVITE("sip:+15551234567@ims.example.com;user=phone", "tel:+12025550100", "call1")
+	invite.Contact = "<sip:alice@192.0.2.1>"
+	resp, err := h.HandleINVITE(invite)
+	if err != nil || resp == nil || resp.Method != "100" {
+		t.Fatalf("HandleINVITE() = %+v, %v, want 100 Trying", resp, err)
+	}
+	trunk.mu.Lock()
+	defer trunk.mu.Unlock()
+	if len(trunk.sent) != 1 || trunk.sent[0].Type != isup.TypeIAM {
+		t.Fatalf("sent %+v, want an IAM", trunk.sent)
+	}
+	cic := trunk.sent[0].CIC
+	trunk.sent = nil
+	return invite, cic
+}
+
+func TestHandler_CallToPSTN(t *testing.T) {
+	h, trunk := newTestHandler()
+	invite, cic := outgoingCall(t, h, trunk)
+
+	// A retransmission gets 100 Trying again but no second circuit
+	retransmission := *invite
+	if resp, err := h.HandleINVITE(&retransmission); err != nil || resp.Method != "100" {
+		t.Errorf("HandleINVITE() of a retransmission = %+v, %v", resp, err)
+	}
+	if types := trunk.types(); len(types) != 0 {
+		t.Errorf("retransmission sent %v", types)
+	}
+	if calls, circuits := h.inUse(); calls != 1 || circuits != 1 {
+		t.Errorf("%d calls on %d circuits, want 1 on 1", calls, circuits)
+	}
+
+	acm := &isup.Message{Type: isup.TypeACM, CIC: cic}
+	acm.SetCalledStatus(isup.CalledStatusSubscriberFree)
+	for _, step := range []struct {
+		msg    *isup.Message
+		status string
+	}{
+		{acm, "180"},
+		{&isup.Message{Type: isup.TypeANM, CIC: cic}, "200"},
+	} {
+		resp, err := h.HandleISUP(step.msg)
+		if err != nil || resp == nil || resp.Method != step.status || resp.CallID != "call1" {
+			t.Fatalf("HandleISUP(%s) = %+v, %v, want %s", step.msg.Type, resp, err, step.status)
+		}
+	}
+
+	// A re-INVITE inside the dialog is answered without a new IAM
+	reinvite := *invite
+	reinvite.CSeq = "2 INVITE"
+	if resp, err := h.HandleINVITE(&reinvite); err != nil || resp.Method != "200" {
+		t.Errorf("HandleINVITE() of a re-INVITE = %+v, %v, want 200", resp, err)
+	}
+	if types := trunk.types(); len(types) != 0 {
+		t.Errorf("re-INVITE sent %v", types)
+	}
+
+	bye := &sip.Message{Method: "BYE", Headers: map[string]string{}, CallID: "call1", CSeq: "3 BYE"}
+	if resp, err := h.HandleBYE(bye); err != nil || resp.Method != "200" {
+		t.Fatalf("HandleBYE() = %+v, %v", resp, err)
+	}
+	if types := trunk.types(); !sameTypes(types, isup.TypeREL) {
+		t.Errorf("BYE sent %v, want REL", types)
+	}
+	if _, err := h.HandleISUP(&isup.Message{Type: isup.TypeRLC, CIC: cic}); err != nil {
+		t.Errorf("HandleISUP(RLC) error = %v", err)
+	}
+	if calls, circuits := h.inUse(); calls != 0 || circuits != 0 {
+		t.Errorf("%d calls on %d circuits after release, want none", calls, circuits)
+	}
+}
+
+func TestHandler_CallFromPSTN(t *testing.T) {
+	h, trunk := newTestHandler()
+
+	iam := &isup.Message{
+		Type:    isup.TypeIAM,
+		CIC:     42,
+		Called:  &isup.Number{Nature: isup.NatureNational, Digits: "5551234567"},
+		Calling: &isup.Number{Nature: isup.NatureNational, Digits: "2025550100"},
+	}
+	invite, err := h.HandleISUP(iam)
+	if err != nil || invite == nil || invite.Method != "INVITE" || invite.URI != "tel:+15551234567" {
+		t.Fatalf("HandleISUP(IAM) = %+v, %v", invite, err)
+	}
+
+	for _, step := range []struct {
+		status string
+		want   []isup.MessageType
+	}{
+		{"180", []isup.MessageType{isup.TypeACM}},
+		{"200", []isup.MessageType{isup.TypeANM}},
+	} {
+		resp := &sip.Message{Method: step.status, Headers: map[string]string{}, CallID: invite.CallID, CSeq: invite.CSeq}
+		if err := h.HandleResponse(resp); err != nil {
+			t.Fatalf("HandleResponse(%s) error = %v", step.status, err)
+		}
+		if types := trunk.types(); !sameTypes(types, step.want...) {
+			t.Errorf("HandleResponse(%s) sent %v, want %v", step.status, types, step.want)
+		}
+	}
+
+	// The PSTN hangs up
+	rel := &isup.Message{Type: isup.TypeREL, CIC: 42, Cause: &isup.Cause{Value: isup.CauseNormalClearing}}
+	bye, err := h.HandleISUP(rel)
+	if err != nil || bye == nil || bye.Method != "BYE" || bye.CallID != invite.CallID {
+		t.Fatalf("HandleISUP(REL) = %+v, %v, want a BYE", bye, err)
+	}
+	if types := trunk.types(); !sameTypes(types, isup.TypeRLC) {
+		t.Errorf("REL sent %v, want RLC", types)
+	}
+	if calls, circuits := h.inUse(); calls != 0 || circuits != 0 {
+		t.Errorf("%d calls on %d circuits after release, want none", calls, circuits)
+	}
+}
+
+func TestHandler_ReleaseGlare(t *testing.T) {
+	h, trunk := newTestHandler()
+	_, cic := outgoingCall(t, h, trunk)
+	if _, err := h.HandleISUP(&isup.Message{Type: isup.TypeANM, CIC: cic}); err != nil {
+		t.Fatalf("HandleISUP(ANM) error = %v", err)
+	}
+
+	// Both sides release at once: each REL is answered by an RLC, and the
+	// SIP side gets no BYE for a call it ended
+	bye := &sip.Message{Method: "BYE", Headers: map[string]string{}, CallID: "call1", CSeq: "2 BYE"}
+	if _, err := h.HandleBYE(bye); err != nil {
+		t.Fatalf("HandleBYE() error = %v", err)
+	}
+	rel := &isup.Message{Type: isup.TypeREL, CIC: cic, Cause: &isup.Cause{Value: isup.CauseNormalClearing}}
+	resp, err := h.HandleISUP(rel)
+	if err != nil || resp != nil {
+		t.Errorf("HandleISUP(REL) in glare = %+v, %v, want no SIP message", resp, err)
+	}
+	if types := trunk.types(); !sameTypes(types, isup.TypeREL, isup.TypeRLC) {
+		t.Errorf("sent %v, want REL then RLC", types)
+	}
+	if calls, circuits := h.inUse(); calls != 0 || circuits != 0 {
+		t.Errorf("%d calls on %d circuits after glare, want none", calls, circuits)
+	}
+	// The RLC of the PSTN to the REL of the MGCF finds the circuit free
+	if resp, _ := h.HandleISUP(&isup.Message{Type: isup.TypeRLC, CIC: cic}); resp != nil {
+		t.Errorf("HandleISUP(RLC) after glare = %+v", resp)
+	}
+}
@@ -0,0 +1,294 @@
+// Package interwork maps the signalling of a call between SIP and ISUP at
+// the MGCF (3GPP TS 29.163): a SIP INVITE to an IAM and the backward ISUP
+// messages to SIP responses for calls to the PSTN, an IAM to an INVITE and
+// the SIP responses to backward ISUP messages for calls from the PSTN.
+package interwork
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dasmlab/ims/internal/mgcf/isup"
+)
+
+// ErrUnexpected is returned for messages not expected in the state of a
+// call
+var ErrUnexpected = errors.New("unexpected message in call state")
+
+// Direction is the direction of a call across the MGCF
+type Direction int
+
+const (
+	// Outgoing is a call from SIP to the PSTN: the MGCF sends the IAM
+	Outgoing Direction = iota
+	// Incoming is a call from the PSTN to SIP: the MGCF receives the IAM
+	Incoming
+)
+
+// State is the state of a call
+type State int
+
+const (
+	StateIdle      State = iota
+	StateSetup           // IAM exchanged, waiting for the ACM
+	StateAlerting        // ACM exchanged, waiting for the answer
+	StateAnswered        // ANM exchanged
+	StateReleasing       // REL sent, waiting for the RLC
+	StateReleased
+)
+
+// String returns the name of s
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateSetup:
+		return "setup"
+	case StateAlerting:
+		return "alerting"
+	case StateAnswered:
+		return "answered"
+	case StateReleasing:
+		return "releasing"
+	}
+	return "released"
+}
+
+// Invite is the SIP side of a call setup
+type Invite struct {
+	To         string // Request-URI
+	From       string // Asserted identity of the caller
+	Restricted bool   // Privacy: id
+
+	// ISUP is the IAM of a SIP-I or SIP-T body
+	ISUP *isup.Message
+}
+
+// Action is what the MGCF does on the SIP side for an ISUP message
+type Action struct {
+	// Invite starts a call from the PSTN
+	Invite *Invite
+
+	// Status is the response to the INVITE of a call to the PSTN. Early
+	// media is available on the media path before answer.
+	Status     int
+	EarlyMedia bool
+
+	// Bye ends an answered call; Cancel ends a call from the PSTN before
+	// answer
+	Bye    bool
+	Cancel bool
+
+	// Reason is the Reason header of a release (RFC 3326)
+	Reason string
+
+	// Reply is the ISUP message to send back to the PSTN
+	Reply *isup.Message
+}
+
+// Call is the interworking state of a call on a circuit. Its methods may
+// be called concurrently: the SIP and ISUP sides of a call are served by
+// different goroutines.
+type Call struct {
+	CIC       uint16
+	Direction Direction
+
+	numbering Numbering
+
+	mu    sync.Mutex
+	state State
+}
+
+// NewCall creates an idle call on a circuit
+func NewCall(cic uint16, direction Direction, numbering Numbering) *Call {
+	return &Call{CIC: cic, Direction: direction, numbering: numbering}
+}
+
+// State returns the state of the call
+func (c *Call) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Invite maps the INVITE of a call to the PSTN to its IAM. The IAM of a
+// SIP-I body is kept, with the called party number of the Request-URI.
+func (c *Call) Invite(inv Invite) (*isup.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Direction != Outgoing || c.state != StateIdle {
+		return nil, fmt.Errorf("%w: INVITE in %s state", ErrUnexpected, c.state)
+	}
+	called, err := c.numbering.Called(inv.To)
+	if err != nil {
+		return nil, err
+	}
+
+	iam := &isup.Message{
+		Type:               isup.TypeIAM,
+		CallingCategory:    isup.CategoryOrdinary,
+		TransmissionMedium: isup.Medium3_1kHz,
+	}
+	if inv.ISUP != nil && inv.ISUP.Type == isup.TypeIAM {
+		tunnelled := *inv.ISUP
+		iam = &tunnelled
+	}
+	iam.CIC = c.CIC
+	iam.Called = called
+	if calling := c.numbering.Calling(inv.From, inv.Restricted); calling != nil {
+		iam.Calling = calling
+	}
+	c.state = StateSetup
+	return iam, nil
+}
+
+// Response maps a SIP response to the INVITE of a call from the PSTN to
+// the ISUP messages to send
+func (c *Call) Response(status int, earlyMedia bool) ([]*isup.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Direction != Incoming || (c.state != StateSetup && c.state != StateAlerting) {
+		return nil, fmt.Errorf("%w: %d response in %s state", ErrUnexpected, status, c.state)
+	}
+	switch {
+	case status == 180:
+		if c.state == StateSetup {
+			c.state = StateAlerting
+			return []*isup.Message{c.acm(isup.CalledStatusSubscriberFree, earlyMedia)}, nil
+		}
+		return []*isup.Message{{Type: isup.TypeCPG, CIC: c.CIC, Event: isup.EventAlerting, InBand: earlyMedia}}, nil
+	case status == 183:
+		if c.state == StateSetup {
+			c.state = StateAlerting
+			return []*isup.Message{c.acm(isup.CalledStatusNoIndication, earlyMedia)}, nil
+		}
+		event := uint8(isup.EventProgress)
+		if earlyMedia {
+			event = isup.EventInBand
+		}
+		return []*isup.Message{{Type: isup.TypeCPG, CIC: c.CIC, Event: event, InBand: earlyMedia}}, nil
+	case status < 200:
+		return nil, nil
+	case status < 300:
+		var msgs []*isup.Message
+		if c.state == StateSetup {
+			msgs = append(msgs, c.acm(isup.CalledStatusNoIndication, false))
+		}
+		c.state = StateAnswered
+		return append(msgs, &isup.Message{Type: isup.TypeANM, CIC: c.CIC}), nil
+	default:
+		c.state = StateReleasing
+		return []*isup.Message{c.rel(isup.CauseOf(status))}, nil
+	}
+}
+
+// acm returns the ACM of a call from the PSTN
+func (c *Call) acm(calledStatus int, inBand bool) *isup.Message {
+	acm := &isup.Message{Type: isup.TypeACM, CIC: c.CIC, InBand: inBand}
+	acm.SetCalledStatus(calledStatus)
+	return acm
+}
+
+// rel returns the REL of the call
+func (c *Call) rel(cause uint8) *isup.Message {
+	return &isup.Message{
+		Type:  isup.TypeREL,
+		CIC:   c.CIC,
+		Cause: &isup.Cause{Location: isup.LocationPrivateLocal, Value: cause},
+	}
+}
+
+// Release maps a BYE or CANCEL of the SIP side to the REL of the call,
+// nil when the call is already being released
+func (c *Call) Release(cause uint8) (*isup.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case StateIdle:
+		return nil, fmt.Errorf("%w: release in %s state", ErrUnexpected, c.state)
+	case StateReleasing, StateReleased:
+		return nil, nil
+	}
+	c.state = StateReleasing
+	return c.rel(cause), nil
+}
+
+// Receive maps an ISUP message of the PSTN to the action of the SIP side
+func (c *Call) Receive(m *isup.Message) (*Action, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch m.Type {
+	case isup.TypeIAM:
+		if c.Direction != Incoming || c.state != StateIdle {
+			break
+		}
+		c.state = StateSetup
+		return &Action{Invite: &Invite{
+			To:         c.numbering.URI(m.Called),
+			From:       c.numbering.URI(m.Calling),
+			Restricted: m.Calling != nil && m.Calling.Presentation == isup.PresentationRestricted,
+			ISUP:       m,
+		}}, nil
+
+	case isup.TypeACM:
+		if c.Direction != Outgoing || c.state != StateSetup {
+			break
+		}
+		c.state = StateAlerting
+		if !m.InBand && m.CalledStatus() == isup.CalledStatusSubscriberFree {
+			return &Action{Status: 180}, nil
+		}
+		return &Action{Status: 183, EarlyMedia: m.InBand}, nil
+
+	case isup.TypeCPG:
+		if c.Direction != Outgoing || (c.state != StateSetup && c.state != StateAlerting) {
+			break
+		}
+		c.state = StateAlerting
+		switch m.EventType() {
+		case isup.EventAlerting:
+			return &Action{Status: 180, EarlyMedia: m.InBand}, nil
+		case isup.EventProgress, isup.EventInBand:
+			return &Action{Status: 183, EarlyMedia: m.InBand || m.EventType() == isup.EventInBand}, nil
+		}
+		return &Action{}, nil
+
+	case isup.TypeANM:
+		if c.Direction != Outgoing || (c.state != StateSetup && c.state != StateAlerting) {
+			break
+		}
+		c.state = StateAnswered
+		return &Action{Status: 200}, nil
+
+	case isup.TypeREL:
+		if c.state == StateIdle || c.state == StateReleased {
+			break
+		}
+		action := &Action{Reply: &isup.Message{Type: isup.TypeRLC, CIC: c.CIC}}
+		cause := m.Cause
+		if cause == nil {
+			cause = &isup.Cause{Value: isup.CauseNormalUnspecified}
+		}
+		switch {
+		case c.state == StateReleasing:
+			// Both sides released the call at once
+		case c.state == StateAnswered:
+			action.Bye, action.Reason = true, cause.Reason()
+		case c.Direction == Outgoing:
+			action.Status, action.Reason = isup.Status(cause.Value), cause.Reason()
+		default:
+			action.Cancel, action.Reason = true, cause.Reason()
+		}
+		c.state = StateReleased
+		return action, nil
+
+	case isup.TypeRLC:
+		if c.state != StateReleasing {
+			break
+		}
+		c.state = StateReleased
+		return &Action{}, nil
+	}
+	return nil, fmt.Errorf("%w: %s in %s state", ErrUnexpected, m.Type, c.state)
+}
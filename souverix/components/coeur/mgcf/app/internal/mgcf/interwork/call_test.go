@@ -0,0 +1,205 @@
+package interwork
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/mgcf/isup"
+)
+
+var testNumbering = Numbering{CountryCode: "1"}
+
+// pstn passes a message through the wire encoding, as the PSTN side would
+// receive or send it
+func pstn(t *testing.T, m *isup.Message) *isup.Message {
+	t.Helper()
+	b, err := m.Encode()
+	if err != nil {
+		t.Fatalf("%s Encode() error = %v", m.Type, err)
+	}
+	decoded, err := isup.Decode(b)
+	if err != nil {
+		t.Fatalf("%s Decode() error = %v", m.Type, err)
+	}
+	return decoded
+}
+
+func TestCall_Outgoing(t *testing.T) {
+	c := NewCall(17, Outgoing, testNumbering)
+	iam, err := c.Invite(Invite{To: "tel:+12025550100", From: "sip:+15551234567@ims.example.com;user=phone", Restricted: true})
+	if err != nil {
+		t.Fatalf("Invite() error = %v", err)
+	}
+	iam = pstn(t, iam)
+	if iam.Type != isup.TypeIAM || iam.CIC != 17 {
+		t.Errorf("IAM = %+v", iam)
+	}
+	if iam.Called.Nature != isup.NatureNational || iam.Called.Digits != "2025550100" {
+		t.Errorf("called party = %+v", iam.Called)
+	}
+	if iam.Calling.Digits != "5551234567" || iam.Calling.Presentation != isup.PresentationRestricted {
+		t.Errorf("calling party = %+v", iam.Calling)
+	}
+
+	acm := &isup.Message{Type: isup.TypeACM, CIC: 17}
+	acm.SetCalledStatus(isup.CalledStatusSubscriberFree)
+	steps := []struct {
+		msg    *isup.Message
+		status int
+		early  bool
+		state  State
+	}{
+		{acm, 180, false, StateAlerting},
+		{&isup.Message{Type: isup.TypeCPG, CIC: 17, Event: isup.EventInBand}, 183, true, StateAlerting},
+		{&isup.Message{Type: isup.TypeANM, CIC: 17}, 200, false, StateAnswered},
+	}
+	for _, step := range steps {
+		action, err := c.Receive(pstn(t, step.msg))
+		if err != nil {
+			t.Fatalf("Receive(%s) error = %v", step.msg.Type, err)
+		}
+		if action.Status != step.status || action.EarlyMedia != step.early || c.State() != step.state {
+			t.Errorf("Receive(%s) = %+v in %s, want %d early=%v in %s", step.msg.Type, action, c.State(), step.status, step.early, step.state)
+		}
+	}
+
+	// BYE from the SIP side
+	rel, err := c.Release(isup.CauseNormalClearing)
+	if err != nil || rel.Type != isup.TypeREL || rel.Cause.Value != isup.CauseNormalClearing {
+		t.Fatalf("Release() = %+v, %v", rel, err)
+	}
+	if again, _ := c.Release(isup.CauseNormalClearing); again != nil {
+		t.Error("Release() twice sent a second REL")
+	}
+	if _, err := c.Receive(pstn(t, &isup.Message{Type: isup.TypeRLC, CIC: 17})); err != nil || c.State() != StateReleased {
+		t.Errorf("Receive(RLC) error = %v in %s", err, c.State())
+	}
+}
+
+func TestCall_OutgoingEarlyMedia(t *testing.T) {
+	c := NewCall(1, Outgoing, testNumbering)
+	c.Invite(Invite{To: "tel:+442071234567"})
+
+	// ACM with in-band information: announcements or ring back tone from
+	// the PSTN
+	action, err := c.Receive(&isup.Message{Type: isup.TypeACM, CIC: 1, InBand: true})
+	if err != nil {
+		t.Fatalf("Receive(ACM) error = %v", err)
+	}
+	if action.Status != 183 || !action.EarlyMedia {
+		t.Errorf("Receive(ACM) = %+v, want 183 with early media", action)
+	}
+}
+
+func TestCall_OutgoingRejected(t *testing.T) {
+	tests := []struct {
+		cause  uint8
+		status int
+	}{
+		{isup.CauseUserBusy, 486},
+		{isup.CauseUnallocatedNumber, 404},
+		{isup.CauseNoCircuit, 503},
+	}
+	for _, tt := range tests {
+		c := NewCall(2, Outgoing, testNumbering)
+		c.Invite(Invite{To: "tel:+12025550100"})
+		action, err := c.Receive(pstn(t, &isup.Message{Type: isup.TypeREL, CIC: 2, Cause: &isup.Cause{Location: isup.LocationPublicRemote, Value: tt.cause}}))
+		if err != nil {
+			t.Fatalf("Receive(REL) error = %v", err)
+		}
+		if action.Status != tt.status || action.Bye || action.Reply == nil || action.Reply.Type != isup.TypeRLC {
+			t.Errorf("Receive(REL cause %d) = %+v, want %d and RLC", tt.cause, action, tt.status)
+		}
+		if want := (&isup.Cause{Value: tt.cause}).Reason(); action.Reason != want {
+			t.Errorf("Reason = %s", action.Reason)
+		}
+	}
+}
+
+func TestCall_Incoming(t *testing.T) {
+	c := NewCall(30, Incoming, testNumbering)
+	iam := &isup.Message{
+		Type:    isup.TypeIAM,
+		CIC:     30,
+		Called:  &isup.Number{Nature: isup.NatureNational, Plan: isup.PlanISDN, Digits: "5551234567"},
+		Calling: &isup.Number{Nature: isup.NatureInternational, Plan: isup.PlanISDN, Digits: "441632960083"},
+	}
+	action, err := c.Receive(pstn(t, iam))
+	if err != nil {
+		t.Fatalf("Receive(IAM) error = %v", err)
+	}
+	if action.Invite == nil || action.Invite.To != "tel:+15551234567" || action.Invite.From != "tel:+441632960083" {
+		t.Fatalf("Receive(IAM) = %+v", action.Invite)
+	}
+
+	msgs, err := c.Response(183, true)
+	if err != nil || len(msgs) != 1 || msgs[0].Type != isup.TypeACM || !msgs[0].InBand || msgs[0].CalledStatus() != isup.CalledStatusNoIndication {
+		t.Fatalf("Response(183) = %+v, %v", msgs, err)
+	}
+	msgs, _ = c.Response(180, false)
+	if len(msgs) != 1 || msgs[0].Type != isup.TypeCPG || msgs[0].EventType() != isup.EventAlerting {
+		t.Errorf("Response(180) after ACM = %+v, want CPG alerting", msgs)
+	}
+	msgs, _ = c.Response(200, false)
+	if len(msgs) != 1 || msgs[0].Type != isup.TypeANM || c.State() != StateAnswered {
+		t.Errorf("Response(200) = %+v", msgs)
+	}
+
+	// REL from the PSTN ends the SIP dialog
+	action, err = c.Receive(pstn(t, &isup.Message{Type: isup.TypeREL, CIC: 30, Cause: &isup.Cause{Value: isup.CauseNormalClearing}}))
+	if err != nil || !action.Bye || action.Reply.Type != isup.TypeRLC {
+		t.Errorf("Receive(REL) = %+v, %v", action, err)
+	}
+}
+
+func TestCall_IncomingRejected(t *testing.T) {
+	c := NewCall(31, Incoming, testNumbering)
+	c.Receive(&isup.Message{Type: isup.TypeIAM, CIC: 31, Called: &isup.Number{Nature: isup.NatureNational, Digits: "5551234567"}})
+
+	msgs, _ := c.Response(486, false)
+	if len(msgs) != 1 || msgs[0].Type != isup.TypeREL || msgs[0].Cause.Value != isup.CauseUserBusy {
+		t.Fatalf("Response(486) = %+v", msgs)
+	}
+	// Release collision: the PSTN released too
+	action, err := c.Receive(&isup.Message{Type: isup.TypeREL, CIC: 31, Cause: &isup.Cause{Value: isup.CauseNormalClearing}})
+	if err != nil || action.Bye || action.Cancel || action.Reply == nil {
+		t.Errorf("Receive(REL) while releasing = %+v, %v", action, err)
+	}
+
+	// A 200 without a provisional response needs an ACM first
+	c = NewCall(32, Incoming, testNumbering)
+	c.Receive(&isup.Message{Type: isup.TypeIAM, CIC: 32, Called: &isup.Number{Nature: isup.NatureNational, Digits: "5551234567"}})
+	msgs, _ = c.Response(200, false)
+	if len(msgs) != 2 || msgs[0].Type != isup.TypeACM || msgs[1].Type != isup.TypeANM {
+		t.Errorf("Response(200) before ACM = %+v, want ACM and ANM", msgs)
+	}
+
+	// The caller hangs up before answer
+	c = NewCall(33, Incoming, testNumbering)
+	c.Receive(&isup.Message{Type: isup.TypeIAM, CIC: 33, Called: &isup.Number{Nature: isup.NatureNational, Digits: "5551234567"}})
+	action, _ = c.Receive(&isup.Message{Type: isup.TypeREL, CIC: 33, Cause: &isup.Cause{Value: isup.CauseNormalClearing}})
+	if !action.Cancel {
+		t.Errorf("Receive(REL) before answer = %+v, want CANCEL", action)
+	}
+}
+
+func TestCall_Unexpected(t *testing.T) {
+	c := NewCall(40, Outgoing, testNumbering)
+	unexpected := []*isup.Message{
+		{Type: isup.TypeACM},
+		{Type: isup.TypeANM},
+		{Type: isup.TypeRLC},
+		{Type: isup.TypeIAM, Called: &isup.Number{Digits: "1"}},
+	}
+	for _, m := range unexpected {
+		if _, err := c.Receive(m); !errors.Is(err, ErrUnexpected) {
+			t.Errorf("Receive(%s) when idle error = %v, want ErrUnexpected", m.Type, err)
+		}
+	}
+	if _, err := c.Response(180, false); !errors.Is(err, ErrUnexpected) {
+		t.Errorf("Response() on an outgoing call error = %v", err)
+	}
+	if _, err := c.Invite(Invite{To: "sip:bob@ims.example.com"}); err == nil {
+		t.Error("Invite() without a number succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+package interwork
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dasmlab/ims/internal/mgcf/isup"
+	"github.com/dasmlab/souverix/common/enum"
+)
+
+// Numbering translates between the E.164 numbers of tel URIs and ISUP
+// numbers with their nature of address (TS 29.163 section 7.2.3): numbers
+// of the home country are national, the others international.
+type Numbering struct {
+	CountryCode string // Without "+"
+}
+
+// Called returns the called party number of a Request-URI
+func (n Numbering) Called(uri string) (*isup.Number, error) {
+	digits, ok := enum.Number(uri)
+	if !ok {
+		return nil, fmt.Errorf("no E.164 number in %s", uri)
+	}
+	num := &isup.Number{Plan: isup.PlanISDN}
+	num.Nature, num.Digits = n.nature(digits)
+	return num, nil
+}
+
+// Calling returns the calling party number of an asserted identity, nil
+// when it is not a number. A restricted identity (Privacy: id) is not
+// presented to the called party.
+func (n Numbering) Calling(uri string, restricted bool) *isup.Number {
+	digits, ok := enum.Number(uri)
+	if !ok {
+		return nil
+	}
+	num := &isup.Number{Plan: isup.PlanISDN, Screening: isup.ScreeningNetwork}
+	num.Nature, num.Digits = n.nature(digits)
+	if restricted {
+		num.Presentation = isup.PresentationRestricted
+	}
+	return num
+}
+
+// nature returns the nature of address and the digits of an E.164 number
+func (n Numbering) nature(digits string) (uint8, string) {
+	if n.CountryCode != "" && strings.HasPrefix(digits, n.CountryCode) {
+		return isup.NatureNational, digits[len(n.CountryCode):]
+	}
+	return isup.NatureInternational, digits
+}
+
+// URI returns the tel URI of an ISUP number, "" when it has no digits.
+// Subscriber numbers and numbers of unknown nature are taken as national
+// numbers.
+func (n Numbering) URI(num *isup.Number) string {
+	if num == nil {
+		return ""
+	}
+	digits := strings.TrimSuffix(strings.ToUpper(num.Digits), "F")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return ""
+	}
+	if num.Nature == isup.NatureInternational {
+		return enum.TelURI(digits)
+	}
+	return enum.TelURI(n.CountryCode + digits)
+}
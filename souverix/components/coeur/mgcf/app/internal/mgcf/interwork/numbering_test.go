@@ -0,0 +1,43 @@
+package interwork
+
+import (
+	"testing"
+
+	"github.com/dasmlab/ims/internal/mgcf/isup"
+)
+
+func TestNumbering(t *testing.T) {
+	n := Numbering{CountryCode: "33"}
+	tests := []struct {
+		uri    string
+		nature uint8
+		digits string
+	}{
+		{"tel:+33123456789", isup.NatureNational, "123456789"},
+		{"tel:+44-20-7123-4567", isup.NatureInternational, "442071234567"},
+		{"sip:+33612345678@ims.example.fr;user=phone", isup.NatureNational, "612345678"},
+	}
+	for _, tt := range tests {
+		num, err := n.Called(tt.uri)
+		if err != nil {
+			t.Fatalf("Called(%s) error = %v", tt.uri, err)
+		}
+		if num.Nature != tt.nature || num.Digits != tt.digits || num.Plan != isup.PlanISDN {
+			t.Errorf("Called(%s) = %+v", tt.uri, num)
+		}
+		// And back
+		if uri := n.URI(num); uri == "" || uri[:5] != "tel:+" {
+			t.Errorf("URI(%+v) = %s", num, uri)
+		}
+	}
+
+	if calling := n.Calling("sip:alice@ims.example.fr", false); calling != nil {
+		t.Errorf("Calling() of a SIP URI = %+v", calling)
+	}
+	if uri := n.URI(&isup.Number{Nature: isup.NatureSubscriber, Digits: "123456789F"}); uri != "tel:+33123456789" {
+		t.Errorf("URI() = %s", uri)
+	}
+	if uri := n.URI(&isup.Number{Nature: isup.NatureInternational, Digits: "12B"}); uri != "" {
+		t.Errorf("URI() with a code 11 signal = %s", uri)
+	}
+}
@@ -0,0 +1,113 @@
+package isup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// MIME types of the bodies of SIP-I and SIP-T messages (RFC 3204)
+const (
+	MediaTypeISUP = "application/isup"
+	MediaTypeSDP  = "application/sdp"
+	ContentType   = "application/ISUP;version=itu-t92+;base=itu-t92+"
+)
+
+// Variant selects how a body carries ISUP: SIP-I (ITU-T Q.1912.5)
+// requires the receiver to process it, SIP-T (RFC 3372) lets a receiver
+// without ISUP support ignore it
+type Variant int
+
+const (
+	SIPI Variant = iota
+	SIPT
+)
+
+// handling returns the handling parameter of the Content-Disposition of the
+// ISUP part
+func (v Variant) handling() string {
+	if v == SIPT {
+		return "optional"
+	}
+	return "required"
+}
+
+// EncodeBody returns the content type and the multipart/mixed body
+// carrying an SDP session description, if any, and an ISUP message
+func EncodeBody(sdp string, m *Message, variant Variant) (string, []byte, error) {
+	encoded, err := m.Encode()
+	if err != nil {
+		return "", nil, err
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if sdp != "" {
+		part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {MediaTypeSDP}})
+		if err != nil {
+			return "", nil, err
+		}
+		io.WriteString(part, sdp)
+	}
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {ContentType},
+		"Content-Disposition": {"signal;handling=" + variant.handling()},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	part.Write(encoded)
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()}), buf.Bytes(), nil
+}
+
+// DecodeBody returns the SDP session description and the ISUP message of a
+// SIP body: multipart/mixed, SDP or ISUP alone. Either is empty or nil
+// when absent.
+func DecodeBody(contentType string, body []byte) (string, *Message, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	switch mediaType {
+	case MediaTypeSDP:
+		return string(body), nil, nil
+	case MediaTypeISUP:
+		m, err := Decode(body)
+		return "", m, err
+	case "multipart/mixed":
+	default:
+		return "", nil, fmt.Errorf("unsupported body type %s", mediaType)
+	}
+
+	var sdp string
+	var msg *Message
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return sdp, msg, nil
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return "", nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch strings.ToLower(partType) {
+		case MediaTypeSDP:
+			sdp = string(content)
+		case MediaTypeISUP:
+			if msg, err = Decode(content); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+}
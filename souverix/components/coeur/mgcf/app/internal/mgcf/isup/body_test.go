@@ -0,0 +1,64 @@
+package isup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSDP = "v=0\r\no=- 1 1 IN IP4 192.0.2.10\r\ns=-\r\nc=IN IP4 192.0.2.10\r\nt=0 0\r\nm=audio 49170 RTP/AVP 0\r\n"
+
+func TestBody_RoundTrip(t *testing.T) {
+	iam := &Message{
+		Type:            TypeIAM,
+		CIC:             42,
+		CallingCategory: CategoryOrdinary,
+		Called:          &Number{Nature: NatureNational, Plan: PlanISDN, Digits: "2025550100"},
+	}
+	for _, variant := range []Variant{SIPI, SIPT} {
+		contentType, body, err := EncodeBody(testSDP, iam, variant)
+		if err != nil {
+			t.Fatalf("EncodeBody() error = %v", err)
+		}
+		if !strings.HasPrefix(contentType, "multipart/mixed;") {
+			t.Errorf("content type = %s", contentType)
+		}
+		if want := "signal;handling=" + variant.handling(); !strings.Contains(string(body), want) {
+			t.Errorf("body has no Content-Disposition %s", want)
+		}
+		sdp, decoded, err := DecodeBody(contentType, body)
+		if err != nil {
+			t.Fatalf("DecodeBody() error = %v", err)
+		}
+		if sdp != testSDP || !reflect.DeepEqual(decoded, iam) {
+			t.Errorf("DecodeBody() = %q, %+v", sdp, decoded)
+		}
+	}
+
+	// Without SDP, only the ISUP part
+	contentType, body, err := EncodeBody("", &Message{Type: TypeANM, CIC: 1}, SIPI)
+	if err != nil {
+		t.Fatalf("EncodeBody() error = %v", err)
+	}
+	sdp, decoded, err := DecodeBody(contentType, body)
+	if err != nil || sdp != "" || decoded.Type != TypeANM {
+		t.Errorf("DecodeBody() = %q, %+v, %v", sdp, decoded, err)
+	}
+}
+
+func TestDecodeBody_SinglePart(t *testing.T) {
+	sdp, m, err := DecodeBody("application/sdp", []byte(testSDP))
+	if err != nil || sdp != testSDP || m != nil {
+		t.Errorf("DecodeBody(sdp) = %q, %v, %v", sdp, m, err)
+	}
+	rlc, _ := (&Message{Type: TypeRLC, CIC: 3}).Encode()
+	if _, m, err := DecodeBody(ContentType, rlc); err != nil || m.Type != TypeRLC {
+		t.Errorf("DecodeBody(isup) = %v, %v", m, err)
+	}
+	if _, _, err := DecodeBody("text/plain", nil); err == nil {
+		t.Error("DecodeBody(text/plain) succeeded")
+	}
+	if _, _, err := DecodeBody("multipart/mixed;boundary=x", []byte("garbage")); err == nil {
+		t.Error("DecodeBody() of an invalid multipart body succeeded")
+	}
+}
@@ -0,0 +1,198 @@
+package isup
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Cause values (ITU-T Q.850)
+const (
+	CauseUnallocatedNumber       = 1
+	CauseNoRouteToNetwork        = 2
+	CauseNoRouteToDestination    = 3
+	CauseNormalClearing          = 16
+	CauseUserBusy                = 17
+	CauseNoUserResponding        = 18
+	CauseNoAnswer                = 19
+	CauseSubscriberAbsent        = 20
+	CauseCallRejected            = 21
+	CauseNumberChanged           = 22
+	CauseRedirection             = 23
+	CauseExchangeRouting         = 25
+	CauseNonSelectedUser         = 26
+	CauseDestinationOutOfOrder   = 27
+	CauseAddressIncomplete       = 28
+	CauseFacilityRejected        = 29
+	CauseNormalUnspecified       = 31
+	CauseNoCircuit               = 34
+	CauseNetworkOutOfOrder       = 38
+	CauseTemporaryFailure        = 41
+	CauseCongestion              = 42
+	CauseResourceUnavailable     = 47
+	CauseIncomingBarredCUG       = 55
+	CauseBearerNotAuthorized     = 57
+	CauseBearerNotAvailable      = 58
+	CauseServiceUnavailable      = 63
+	CauseBearerNotImplemented    = 65
+	CauseRestrictedDigital       = 70
+	CauseServiceNotImplemented   = 79
+	CauseNotMemberCUG            = 87
+	CauseIncompatibleDestination = 88
+	CauseRecoveryOnTimer         = 102
+	CauseProtocolError           = 111
+	CauseInterworking            = 127
+)
+
+// Cause locations (Q.850 2.2.3)
+const (
+	LocationUser            = 0
+	LocationPrivateLocal    = 1
+	LocationPublicLocal     = 2
+	LocationTransit         = 3
+	LocationPublicRemote    = 4
+	LocationPrivateRemote   = 5
+	LocationInternational   = 7
+	LocationBeyondInterwork = 10
+)
+
+// Cause is the cause indicators of a release
+type Cause struct {
+	Location   uint8
+	Value      uint8
+	Diagnostic []byte
+}
+
+// encode returns the parameter value of c, with the ITU-T coding standard
+func (c *Cause) encode() []byte {
+	b := []byte{0x80 | c.Location&0x0f, 0x80 | c.Value&0x7f}
+	return append(b, c.Diagnostic...)
+}
+
+// decodeCause decodes the parameter value of cause indicators
+func decodeCause(b []byte) (*Cause, error) {
+	if len(b) < 2 {
+		return nil, ErrMalformed
+	}
+	c := &Cause{Location: b[0] & 0x0f}
+	offset := 1
+	// Octet 1a, the recommendation, follows when the extension bit is 0
+	if b[0]&0x80 == 0 {
+		offset++
+	}
+	if offset >= len(b) {
+		return nil, ErrMalformed
+	}
+	c.Value = b[offset] & 0x7f
+	if offset+1 < len(b) {
+		c.Diagnostic = append([]byte(nil), b[offset+1:]...)
+	}
+	return c, nil
+}
+
+// Reason returns the Reason header value of c (RFC 3326)
+func (c *Cause) Reason() string {
+	return "Q.850;cause=" + strconv.Itoa(int(c.Value))
+}
+
+// String returns the value and location of c
+func (c *Cause) String() string {
+	return fmt.Sprintf("cause %d (location %d)", c.Value, c.Location)
+}
+
+// causeStatus maps ISUP causes to the status of the SIP final response
+// (TS 29.163 table 12, RFC 3398 section 8.2.6.1)
+var causeStatus = map[uint8]int{
+	CauseUnallocatedNumber:       404,
+	CauseNoRouteToNetwork:        404,
+	CauseNoRouteToDestination:    404,
+	CauseUserBusy:                486,
+	CauseNoUserResponding:        480,
+	CauseNoAnswer:                480,
+	CauseSubscriberAbsent:        480,
+	CauseCallRejected:            403,
+	CauseNumberChanged:           410,
+	CauseRedirection:             410,
+	CauseExchangeRouting:         483,
+	CauseNonSelectedUser:         404,
+	CauseDestinationOutOfOrder:   502,
+	CauseAddressIncomplete:       484,
+	CauseFacilityRejected:        501,
+	CauseNormalUnspecified:       480,
+	CauseNoCircuit:               503,
+	CauseNetworkOutOfOrder:       503,
+	CauseTemporaryFailure:        503,
+	CauseCongestion:              503,
+	CauseResourceUnavailable:     503,
+	CauseIncomingBarredCUG:       403,
+	CauseBearerNotAuthorized:     403,
+	CauseBearerNotAvailable:      503,
+	CauseBearerNotImplemented:    488,
+	CauseRestrictedDigital:       488,
+	CauseServiceNotImplemented:   501,
+	CauseNotMemberCUG:            403,
+	CauseIncompatibleDestination: 503,
+	CauseRecoveryOnTimer:         504,
+	CauseProtocolError:           500,
+	CauseInterworking:            500,
+}
+
+// Status returns the status of the SIP final response for an ISUP cause.
+// Causes without a mapping are mapped by class: normal events to 480, the
+// others to 500.
+func Status(cause uint8) int {
+	if status, ok := causeStatus[cause]; ok {
+		return status
+	}
+	if cause < 32 {
+		return 480
+	}
+	return 500
+}
+
+// statusCause maps SIP final response statuses to ISUP causes (TS 29.163
+// table 9, RFC 3398 section 8.2.6.2)
+var statusCause = map[int]uint8{
+	400: CauseInterworking,
+	401: CauseCallRejected,
+	402: CauseCallRejected,
+	403: CauseCallRejected,
+	404: CauseUnallocatedNumber,
+	405: CauseServiceUnavailable,
+	406: CauseServiceNotImplemented,
+	407: CauseCallRejected,
+	408: CauseRecoveryOnTimer,
+	410: CauseNumberChanged,
+	414: CauseInterworking,
+	415: CauseServiceNotImplemented,
+	416: CauseInterworking,
+	420: CauseInterworking,
+	421: CauseInterworking,
+	480: CauseNoUserResponding,
+	481: CauseInterworking,
+	482: CauseExchangeRouting,
+	483: CauseExchangeRouting,
+	484: CauseAddressIncomplete,
+	485: CauseUnallocatedNumber,
+	486: CauseUserBusy,
+	487: CauseInterworking,
+	488: CauseBearerNotImplemented,
+	500: CauseTemporaryFailure,
+	501: CauseServiceNotImplemented,
+	502: CauseNetworkOutOfOrder,
+	503: CauseTemporaryFailure,
+	504: CauseRecoveryOnTimer,
+	505: CauseInterworking,
+	513: CauseInterworking,
+	600: CauseUserBusy,
+	603: CauseCallRejected,
+	604: CauseUnallocatedNumber,
+	606: CauseBearerNotAvailable,
+}
+
+// CauseOf returns the ISUP cause of a SIP final response status
+func CauseOf(status int) uint8 {
+	if cause, ok := statusCause[status]; ok {
+		return cause
+	}
+	return CauseInterworking
+}
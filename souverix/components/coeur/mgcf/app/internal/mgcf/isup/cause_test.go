@@ -0,0 +1,45 @@
+package isup
+
+import "testing"
+
+func TestStatus(t *testing.T) {
+	tests := map[uint8]int{
+		CauseUnallocatedNumber:    404,
+		CauseUserBusy:             486,
+		CauseNoAnswer:             480,
+		CauseCallRejected:         403,
+		CauseAddressIncomplete:    484,
+		CauseNoCircuit:            503,
+		CauseRecoveryOnTimer:      504,
+		CauseBearerNotImplemented: 488,
+		CauseNormalUnspecified:    480,
+		30:                        480,
+		100:                       500,
+	}
+	for cause, want := range tests {
+		if got := Status(cause); got != want {
+			t.Errorf("Status(%d) = %d, want %d", cause, got, want)
+		}
+	}
+}
+
+func TestCauseOf(t *testing.T) {
+	tests := map[int]uint8{
+		404: CauseUnallocatedNumber,
+		486: CauseUserBusy,
+		480: CauseNoUserResponding,
+		484: CauseAddressIncomplete,
+		503: CauseTemporaryFailure,
+		600: CauseUserBusy,
+		603: CauseCallRejected,
+		499: CauseInterworking,
+	}
+	for status, want := range tests {
+		if got := CauseOf(status); got != want {
+			t.Errorf("CauseOf(%d) = %d, want %d", status, got, want)
+		}
+	}
+	if reason := (&Cause{Value: CauseUserBusy}).Reason(); reason != "Q.850;cause=17" {
+		t.Errorf("Reason() = %s", reason)
+	}
+}
@@ -0,0 +1,354 @@
+// Package isup encodes and decodes the ISDN User Part messages (ITU-T
+// Q.763) the MGCF exchanges with the PSTN for basic calls, maps them to
+// SIP (3GPP TS 29.163) and carries them in SIP-I/SIP-T bodies.
+package isup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MessageType is the code of an ISUP message (Q.763 table 4)
+type MessageType uint8
+
+// Message types of a basic call
+const (
+	TypeIAM MessageType = 0x01 // Initial address
+	TypeACM MessageType = 0x06 // Address complete
+	TypeANM MessageType = 0x09 // Answer
+	TypeREL MessageType = 0x0c // Release
+	TypeRLC MessageType = 0x10 // Release complete
+	TypeCPG MessageType = 0x2c // Call progress
+)
+
+// String returns the acronym of t
+func (t MessageType) String() string {
+	switch t {
+	case TypeIAM:
+		return "IAM"
+	case TypeACM:
+		return "ACM"
+	case TypeANM:
+		return "ANM"
+	case TypeREL:
+		return "REL"
+	case TypeRLC:
+		return "RLC"
+	case TypeCPG:
+		return "CPG"
+	}
+	return fmt.Sprintf("0x%02x", uint8(t))
+}
+
+// Parameter codes (Q.763 table 5)
+const (
+	paramEnd              = 0x00
+	paramCallingParty     = 0x0a
+	paramBackwardCall     = 0x11
+	paramCause            = 0x12
+	paramOptionalBackward = 0x29
+)
+
+const (
+	maxParameterLength     = 255
+	maxCIC                 = 0x0fff
+	optionalBackwardInBand = 0x01
+	eventMask              = 0x7f // Without the event presentation restricted bit
+)
+
+// Called party's status in the backward call indicators (Q.763 3.5)
+const (
+	CalledStatusNoIndication   = 0
+	CalledStatusSubscriberFree = 1
+	CalledStatusConnectFree    = 2
+)
+
+// Events of a CPG (Q.763 3.21)
+const (
+	EventAlerting = 1
+	EventProgress = 2
+	EventInBand   = 3
+)
+
+// Calling party's categories (Q.763 3.11)
+const (
+	CategoryOrdinary = 0x0a
+	CategoryPayphone = 0x0f
+)
+
+// Transmission medium requirements (Q.763 3.54)
+const (
+	MediumSpeech  = 0x00
+	Medium64kbits = 0x02
+	Medium3_1kHz  = 0x03
+)
+
+// ErrMalformed is returned for messages that cannot be decoded
+var ErrMalformed = errors.New("malformed ISUP message")
+
+// Parameter is an optional parameter the codec does not interpret, kept to
+// pass it through
+type Parameter struct {
+	Code  uint8
+	Value []byte
+}
+
+// Message is an ISUP message of a basic call. Only the fields of its type
+// are encoded.
+type Message struct {
+	Type MessageType
+	CIC  uint16 // Circuit identification code, 12 bits
+
+	// IAM
+	NatureOfConnection uint8
+	ForwardCall        uint16 // Forward call indicators, first octet in the low byte
+	CallingCategory    uint8
+	TransmissionMedium uint8
+	Called             *Number
+	Calling            *Number
+
+	// ACM, CPG and ANM
+	BackwardCall uint16 // Backward call indicators, first octet in the low byte
+	InBand       bool   // In-band information available (optional backward call indicators)
+	Event        uint8  // CPG event
+
+	// REL and RLC
+	Cause *Cause
+
+	Optional []Parameter
+}
+
+// CalledStatus returns the called party's status of the backward call
+// indicators
+func (m *Message) CalledStatus() int {
+	return int(m.BackwardCall>>2) & 0x03
+}
+
+// EventType returns the event of a CPG, without its presentation bit
+func (m *Message) EventType() int {
+	return int(m.Event & eventMask)
+}
+
+// SetCalledStatus sets the called party's status of the backward call
+// indicators
+func (m *Message) SetCalledStatus(status int) {
+	m.BackwardCall = m.BackwardCall&^0x000c | uint16(status&0x03)<<2
+}
+
+// Encode returns the wire encoding of the message, without the routing
+// label
+func (m *Message) Encode() ([]byte, error) {
+	if m.CIC > maxCIC {
+		return nil, fmt.Errorf("CIC %d out of range", m.CIC)
+	}
+	b := []byte{byte(m.CIC), byte(m.CIC >> 8), byte(m.Type)}
+
+	var fixed []byte
+	var variable [][]byte
+	var optional []Parameter
+	switch m.Type {
+	case TypeIAM:
+		if m.Called == nil {
+			return nil, fmt.Errorf("IAM without called party number")
+		}
+		called, err := m.Called.encode(true)
+		if err != nil {
+			return nil, err
+		}
+		fixed = []byte{m.NatureOfConnection, byte(m.ForwardCall), byte(m.ForwardCall >> 8), m.CallingCategory, m.TransmissionMedium}
+		variable = [][]byte{called}
+		if m.Calling != nil {
+			calling, err := m.Calling.encode(false)
+			if err != nil {
+				return nil, err
+			}
+			optional = append(optional, Parameter{Code: paramCallingParty, Value: calling})
+		}
+	case TypeACM:
+		fixed = []byte{byte(m.BackwardCall), byte(m.BackwardCall >> 8)}
+		optional = m.appendInBand(optional)
+	case TypeCPG:
+		fixed = []byte{m.Event}
+		if m.BackwardCall != 0 {
+			optional = append(optional, Parameter{Code: paramBackwardCall, Value: []byte{byte(m.BackwardCall), byte(m.BackwardCall >> 8)}})
+		}
+		optional = m.appendInBand(optional)
+	case TypeANM:
+		if m.BackwardCall != 0 {
+			optional = append(optional, Parameter{Code: paramBackwardCall, Value: []byte{byte(m.BackwardCall), byte(m.BackwardCall >> 8)}})
+		}
+	case TypeREL:
+		if m.Cause == nil {
+			return nil, fmt.Errorf("REL without cause")
+		}
+		variable = [][]byte{m.Cause.encode()}
+	case TypeRLC:
+		if m.Cause != nil {
+			optional = append(optional, Parameter{Code: paramCause, Value: m.Cause.encode()})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ISUP message type %s", m.Type)
+	}
+	optional = append(optional, m.Optional...)
+
+	b = append(b, fixed...)
+
+	// One pointer per mandatory variable parameter, then the pointer to
+	// the optional part; each counts from its own octet
+	pointers := len(b)
+	b = append(b, make([]byte, len(variable)+1)...)
+	for i, value := range variable {
+		if len(value) > maxParameterLength {
+			return nil, fmt.Errorf("ISUP parameter too long")
+		}
+		b[pointers+i] = byte(len(b) - (pointers + i))
+		b = append(b, byte(len(value)))
+		b = append(b, value...)
+	}
+	if len(optional) > 0 {
+		last := pointers + len(variable)
+		b[last] = byte(len(b) - last)
+		for _, p := range optional {
+			if len(p.Value) > maxParameterLength {
+				return nil, fmt.Errorf("ISUP parameter 0x%02x too long", p.Code)
+			}
+			b = append(b, p.Code, byte(len(p.Value)))
+			b = append(b, p.Value...)
+		}
+		b = append(b, paramEnd)
+	}
+	return b, nil
+}
+
+// appendInBand appends the optional backward call indicators when in-band
+// information is available
+func (m *Message) appendInBand(optional []Parameter) []Parameter {
+	if !m.InBand {
+		return optional
+	}
+	return append(optional, Parameter{Code: paramOptionalBackward, Value: []byte{optionalBackwardInBand}})
+}
+
+// layout returns the length of the mandatory fixed part and the number of
+// mandatory variable parameters of a message type
+func layout(t MessageType) (fixed, variable int, err error) {
+	switch t {
+	case TypeIAM:
+		return 5, 1, nil
+	case TypeACM:
+		return 2, 0, nil
+	case TypeCPG:
+		return 1, 0, nil
+	case TypeANM, TypeRLC:
+		return 0, 0, nil
+	case TypeREL:
+		return 0, 1, nil
+	}
+	return 0, 0, fmt.Errorf("unsupported ISUP message type %s", t)
+}
+
+// Decode decodes an ISUP message, without the routing label
+func Decode(b []byte) (*Message, error) {
+	if len(b) < 3 {
+		return nil, ErrMalformed
+	}
+	m := &Message{
+		CIC:  uint16(b[0]) | uint16(b[1]&0x0f)<<8,
+		Type: MessageType(b[2]),
+	}
+	fixedLen, variableCount, err := layout(m.Type)
+	if err != nil {
+		return nil, err
+	}
+	offset := 3
+	if len(b) < offset+fixedLen+variableCount+1 {
+		return nil, ErrMalformed
+	}
+	fixed := b[offset : offset+fixedLen]
+	offset += fixedLen
+
+	variable := make([][]byte, variableCount)
+	for i := range variable {
+		if variable[i], err = pointed(b, offset+i); err != nil {
+			return nil, err
+		}
+	}
+	optionalPointer := offset + variableCount
+	var optional []Parameter
+	if b[optionalPointer] != 0 {
+		if optional, err = decodeOptional(b, optionalPointer+int(b[optionalPointer])); err != nil {
+			return nil, err
+		}
+	}
+
+	switch m.Type {
+	case TypeIAM:
+		m.NatureOfConnection = fixed[0]
+		m.ForwardCall = uint16(fixed[1]) | uint16(fixed[2])<<8
+		m.CallingCategory = fixed[3]
+		m.TransmissionMedium = fixed[4]
+		if m.Called, err = decodeNumber(variable[0], true); err != nil {
+			return nil, err
+		}
+	case TypeACM:
+		m.BackwardCall = uint16(fixed[0]) | uint16(fixed[1])<<8
+	case TypeCPG:
+		m.Event = fixed[0]
+	case TypeREL:
+		if m.Cause, err = decodeCause(variable[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range optional {
+		switch {
+		case p.Code == paramCallingParty && m.Type == TypeIAM:
+			if m.Calling, err = decodeNumber(p.Value, false); err != nil {
+				return nil, err
+			}
+		case p.Code == paramBackwardCall && (m.Type == TypeCPG || m.Type == TypeANM) && len(p.Value) == 2:
+			m.BackwardCall = uint16(p.Value[0]) | uint16(p.Value[1])<<8
+		case p.Code == paramOptionalBackward && (m.Type == TypeACM || m.Type == TypeCPG) && len(p.Value) == 1:
+			m.InBand = p.Value[0]&optionalBackwardInBand != 0
+		case p.Code == paramCause && m.Type == TypeRLC:
+			if m.Cause, err = decodeCause(p.Value); err != nil {
+				return nil, err
+			}
+		default:
+			m.Optional = append(m.Optional, p)
+		}
+	}
+	return m, nil
+}
+
+// pointed returns the parameter the pointer at offset points to
+func pointed(b []byte, offset int) ([]byte, error) {
+	if b[offset] == 0 {
+		return nil, ErrMalformed
+	}
+	start := offset + int(b[offset])
+	if start >= len(b) || start+1+int(b[start]) > len(b) {
+		return nil, ErrMalformed
+	}
+	return b[start+1 : start+1+int(b[start])], nil
+}
+
+// decodeOptional decodes the optional part starting at offset
+func decodeOptional(b []byte, offset int) ([]Parameter, error) {
+	var params []Parameter
+	for {
+		if offset >= len(b) {
+			return nil, ErrMalformed
+		}
+		code := b[offset]
+		if code == paramEnd {
+			return params, nil
+		}
+		if offset+2 > len(b) || offset+2+int(b[offset+1]) > len(b) {
+			return nil, ErrMalformed
+		}
+		length := int(b[offset+1])
+		params = append(params, Parameter{Code: code, Value: append([]byte(nil), b[offset+2:offset+2+length]...)})
+		offset += 2 + length
+	}
+}
@@ -0,0 +1,129 @@
+package isup
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMessage_EncodeIAM(t *testing.T) {
+	iam := &Message{
+		Type:               TypeIAM,
+		CIC:                0x123,
+		ForwardCall:        0x0160,
+		CallingCategory:    CategoryOrdinary,
+		TransmissionMedium: Medium3_1kHz,
+		Called:             &Number{Nature: NatureNational, Plan: PlanISDN, Digits: "1234567"},
+	}
+	got, err := iam.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	want := []byte{
+		0x23, 0x01, // CIC
+		0x01,       // IAM
+		0x00,       // Nature of connection indicators
+		0x60, 0x01, // Forward call indicators
+		0x0a,                   // Calling party's category
+		0x03,                   // Transmission medium requirement
+		0x02,                   // Pointer to the called party number
+		0x00,                   // No optional part
+		0x06, 0x83, 0x10, 0x21, // Called party number: odd, national, ISDN
+		0x43, 0x65, 0x07,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Encode() = % x, want % x", got, want)
+	}
+}
+
+func TestMessage_RoundTrip(t *testing.T) {
+	acm := &Message{Type: TypeACM, CIC: 7, InBand: true}
+	acm.SetCalledStatus(CalledStatusSubscriberFree)
+
+	messages := []*Message{
+		{
+			Type:               TypeIAM,
+			CIC:                4095,
+			NatureOfConnection: 0x01,
+			ForwardCall:        0x2001,
+			CallingCategory:    CategoryPayphone,
+			TransmissionMedium: MediumSpeech,
+			Called:             &Number{Nature: NatureInternational, Plan: PlanISDN, Internal: true, Digits: "441632960083F"},
+			Calling:            &Number{Nature: NatureNational, Plan: PlanISDN, Presentation: PresentationRestricted, Screening: ScreeningNetwork, Digits: "2025550100"},
+			Optional:           []Parameter{{Code: 0x1d, Value: []byte{0x80, 0x90, 0xa3}}},
+		},
+		acm,
+		{Type: TypeACM, CIC: 8},
+		{Type: TypeCPG, CIC: 9, Event: EventProgress, BackwardCall: 0x0014, InBand: true},
+		{Type: TypeANM, CIC: 10},
+		{Type: TypeANM, CIC: 10, BackwardCall: 0x0016},
+		{Type: TypeREL, CIC: 11, Cause: &Cause{Location: LocationPublicRemote, Value: CauseUserBusy}},
+		{Type: TypeREL, CIC: 11, Cause: &Cause{Location: LocationUser, Value: CauseNoCircuit, Diagnostic: []byte{0x01}}},
+		{Type: TypeRLC, CIC: 12},
+		{Type: TypeRLC, CIC: 12, Cause: &Cause{Value: CauseNormalClearing}},
+	}
+	for _, m := range messages {
+		encoded, err := m.Encode()
+		if err != nil {
+			t.Fatalf("%s Encode() error = %v", m.Type, err)
+		}
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("%s Decode() error = %v", m.Type, err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("%s round trip = %+v, want %+v", m.Type, decoded, m)
+		}
+	}
+	if acm.CalledStatus() != CalledStatusSubscriberFree {
+		t.Errorf("CalledStatus() = %d", acm.CalledStatus())
+	}
+}
+
+func TestMessage_EncodeErrors(t *testing.T) {
+	invalid := []*Message{
+		{Type: TypeIAM},
+		{Type: TypeIAM, Called: &Number{Digits: "12x"}},
+		{Type: TypeREL},
+		{Type: TypeANM, CIC: 0x1000},
+		{Type: 0x2f},
+	}
+	for _, m := range invalid {
+		if _, err := m.Encode(); err == nil {
+			t.Errorf("Encode(%+v) succeeded", m)
+		}
+	}
+}
+
+func TestDecode_Malformed(t *testing.T) {
+	rel, _ := (&Message{Type: TypeREL, Cause: &Cause{Value: CauseNormalClearing}}).Encode()
+	invalid := [][]byte{
+		nil,
+		{0x01, 0x00},
+		{0x01, 0x00, byte(TypeANM)},       // No optional pointer
+		{0x01, 0x00, byte(TypeANM), 0x01}, // Optional part past the end
+		{0x01, 0x00, byte(TypeANM), 0x01, 0x11, 0x05, 0x00},
+		{0x01, 0x00, byte(TypeREL), 0x00, 0x00},
+		rel[:len(rel)-1],
+	}
+	for _, b := range invalid {
+		if _, err := Decode(b); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Decode(% x) error = %v, want ErrMalformed", b, err)
+		}
+	}
+	if _, err := Decode([]byte{0x01, 0x00, 0x2f, 0x00}); err == nil {
+		t.Error("Decode() of an unsupported type succeeded")
+	}
+}
+
+func TestDecodeCause_Recommendation(t *testing.T) {
+	// Extension bit 0 in octet 1: octet 1a precedes the cause value
+	c, err := decodeCause([]byte{0x02, 0x80, 0x91})
+	if err != nil {
+		t.Fatalf("decodeCause() error = %v", err)
+	}
+	if c.Location != LocationPublicLocal || c.Value != CauseUserBusy {
+		t.Errorf("decodeCause() = %+v", c)
+	}
+}
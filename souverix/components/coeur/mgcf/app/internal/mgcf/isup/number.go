@@ -0,0 +1,116 @@
+package isup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Nature of address indicators (Q.763 3.9)
+const (
+	NatureSubscriber    = 1
+	NatureUnknown       = 2
+	NatureNational      = 3
+	NatureInternational = 4
+)
+
+// Numbering plan indicators
+const (
+	PlanISDN = 1 // E.164
+)
+
+// Address presentation restricted indicators of calling party numbers
+// (Q.763 3.10)
+const (
+	PresentationAllowed      = 0
+	PresentationRestricted   = 1
+	PresentationNotAvailable = 2
+)
+
+// Screening indicators of calling party numbers
+const (
+	ScreeningUserVerified = 1
+	ScreeningNetwork      = 3
+)
+
+// Number is a called or calling party number. Digits are the address
+// signals as hexadecimal digits: 0-9, B and C for codes 11 and 12, F for
+// the end of pulsing signal (ST).
+type Number struct {
+	Nature uint8
+	Plan   uint8
+
+	// Internal is the INN indicator of called party numbers (routing to an
+	// internal network number not allowed), and the NI indicator of calling
+	// party numbers (number incomplete)
+	Internal bool
+
+	// Calling party numbers only
+	Presentation uint8
+	Screening    uint8
+
+	Digits string
+}
+
+// encode returns the parameter value of n
+func (n *Number) encode(called bool) ([]byte, error) {
+	digits := strings.ToUpper(n.Digits)
+	if strings.Trim(digits, "0123456789ABCDEF") != "" {
+		return nil, fmt.Errorf("invalid ISUP address signals %q", n.Digits)
+	}
+	b := make([]byte, 2, 2+(len(digits)+1)/2)
+	b[0] = n.Nature & 0x7f
+	if len(digits)%2 == 1 {
+		b[0] |= 0x80
+	}
+	b[1] = (n.Plan & 0x07) << 4
+	if n.Internal {
+		b[1] |= 0x80
+	}
+	if !called {
+		b[1] |= (n.Presentation&0x03)<<2 | n.Screening&0x03
+	}
+	for i := 0; i < len(digits); i += 2 {
+		signal := nibble(digits[i])
+		if i+1 < len(digits) {
+			signal |= nibble(digits[i+1]) << 4
+		}
+		b = append(b, signal)
+	}
+	return b, nil
+}
+
+// nibble returns the value of a hexadecimal digit
+func nibble(c byte) byte {
+	if c >= 'A' {
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// decodeNumber decodes the parameter value of a called or calling party
+// number
+func decodeNumber(b []byte, called bool) (*Number, error) {
+	if len(b) < 2 {
+		return nil, ErrMalformed
+	}
+	n := &Number{
+		Nature:   b[0] & 0x7f,
+		Plan:     (b[1] >> 4) & 0x07,
+		Internal: b[1]&0x80 != 0,
+	}
+	if !called {
+		n.Presentation = (b[1] >> 2) & 0x03
+		n.Screening = b[1] & 0x03
+	}
+	const hex = "0123456789ABCDEF"
+	digits := make([]byte, 0, 2*(len(b)-2))
+	for _, signal := range b[2:] {
+		digits = append(digits, hex[signal&0x0f], hex[signal>>4])
+	}
+	// The filler of an odd number of signals is not a signal
+	if b[0]&0x80 != 0 && len(digits) > 0 {
+		digits = digits[:len(digits)-1]
+	}
+	n.Digits = string(digits)
+	return n, nil
+}
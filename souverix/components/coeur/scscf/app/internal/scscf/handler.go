@@ -1,19 +1,44 @@
 package scscf
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 	
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/dasmlab/souverix/common/enum"
 	"github.com/dasmlab/souverix/common/hss"
 	"github.com/dasmlab/souverix/common/sip"
 )
 
+// scscfURI is the SIP URI this S-CSCF puts in Record-Route and in the
+// Route back from application servers
+const scscfURI = "sip:scscf.example.com"
+
+// iscTimeout is how long an application server may hold a request before
+// its original dialog identifier is forgotten
+const iscTimeout = 32 * time.Second
+
+// iscSession is a request sent to an application server over ISC
+type iscSession struct {
+	next     int // Index of the first iFC not yet evaluated
+	deadline time.Time
+}
+
 // Handler handles SIP messages in S-CSCF
 type Handler struct {
 	hssClient  *hss.HSSClient
 	bgcfAddress string
+	translator *enum.Translator
 	logger     *log.Logger
+	
+	mu       sync.Mutex
+	sessions map[string]iscSession // By original dialog identifier
 }
 
 // NewHandler creates a new S-CSCF handler
@@ -22,9 +47,15 @@ func NewHandler(hssClient *hss.HSSClient, bgcfAddress string, logger *log.Logger
 		hssClient:  hssClient,
 		bgcfAddress: bgcfAddress,
 		logger:     logger,
+		sessions:   make(map[string]iscSession),
 	}
 }
 
+// SetTranslator enables ENUM and number portability lookups of tel URIs
+func (h *Handler) SetTranslator(translator *enum.Translator) {
+	h.translator = translator
+}
+
 // HandleINVITE processes an INVITE request
 func (h *Handler) HandleINVITE(msg *sip.Message) (*sip.Message, string, error) {
 	h.logger.Printf("S-CSCF: Received INVITE from %s to %s", msg.From, msg.To)
@@ -40,26 +71,34 @@ func (h *Handler) HandleINVITE(msg *sip.Message) (*sip.Message, string, error) {
 	
 	h.logger.Printf("S-CSCF: Service profile loaded for %s (registered: %v)", impi, profile.Registered)
 	
-	// Apply Initial Filter Criteria (iFC)
-	h.logger.Printf("S-CSCF: Applying iFC (count: %d)", len(profile.IFC))
-	for _, ifc := range profile.IFC {
-		if ifc.Trigger == "INVITE" && ifc.ApplicationServer != "" {
-			h.logger.Printf("S-CSCF: Triggering AS: %s", ifc.ApplicationServer)
-			// In real implementation, forward to AS via ISC interface
-		}
-	}
-	
 	// Check for call barring
 	if profile.Barring {
 		return nil, "", fmt.Errorf("call barred for user: %s", impi)
 	}
 	
-	// Insert Record-Route to anchor dialog
-	msg.AddRecordRoute("<sip:scscf.example.com;lr>")
+	// A request coming back from an application server resumes iFC
+	// evaluation after the criteria that sent it there
+	next, resumed := h.resumeISC(msg, len(profile.IFC))
+	if !resumed {
+		// Insert Record-Route to anchor dialog
+		msg.AddRecordRoute("<" + scscfURI + ";lr>")
+	}
+	
+	// Apply Initial Filter Criteria (iFC)
+	h.logger.Printf("S-CSCF: Applying iFC (count: %d)", len(profile.IFC)-next)
+	if as, ok := h.applyIFC(msg, profile, next); ok {
+		h.logger.Printf("S-CSCF: Triggering AS: %s", as)
+		return msg, as, nil
+	}
 	
 	// Determine routing
 	destination := msg.To
 	if msg.IsTelURI() {
+		// On-net and peer network numbers stay on SIP
+		if next, ok := h.translateTelURI(msg); ok {
+			return msg, next, nil
+		}
+		
 		// PSTN breakout required - route to BGCF
 		h.logger.Printf("S-CSCF: PSTN destination detected, routing to BGCF")
 		return msg, h.bgcfAddress, nil
@@ -78,6 +117,107 @@ func (h *Handler) HandleResponse(msg *sip.Message) (*sip.Message, error) {
 	return msg, nil
 }
 
+// translateTelURI looks up the number of a tel URI in ENUM and the number
+// portability database. The Request-URI of on-net and peer network numbers
+// is rewritten to their SIP URI and the next hop returned; PSTN numbers get
+// the routing number, and lookup failures fall back to the BGCF.
+func (h *Handler) translateTelURI(msg *sip.Message) (string, bool) {
+	if h.translator == nil {
+		return "", false
+	}
+	target := msg.URI
+	if !strings.HasPrefix(target, "tel:") {
+		target = msg.To
+	}
+	route, err := h.translator.Translate(context.Background(), target)
+	if err != nil {
+		h.logger.Printf("S-CSCF: ENUM lookup of %s failed: %v", target, err)
+		return "", false
+	}
+	if route == nil {
+		return "", false
+	}
+	msg.URI = route.URI
+	switch route.Destination {
+	case enum.DestinationOnNet:
+		h.logger.Printf("S-CSCF: +%s is on-net, routing to: %s", route.Number, route.URI)
+		return route.URI, true
+	case enum.DestinationPeer:
+		h.logger.Printf("S-CSCF: +%s is served by %s, routing to peer network", route.Number, route.Network)
+		return route.Network, true
+	}
+	return "", false
+}
+
+// applyIFC evaluates the iFCs of profile from index next against msg and
+// routes msg to the application server of the first match, with a Route
+// back to this S-CSCF carrying an original dialog identifier
+func (h *Handler) applyIFC(msg *sip.Message, profile *hss.ServiceProfile, next int) (string, bool) {
+	sessionCase := cx.SessionCaseOriginating
+	if !profile.Registered {
+		sessionCase = cx.SessionCaseOriginatingUnregistered
+	}
+	
+	for i := next; i < len(profile.IFC); i++ {
+		ifc := &profile.IFC[i]
+		if ifc.ApplicationServer == "" || !ifc.Matches(msg, sessionCase, profile.Registered) {
+			continue
+		}
+		
+		odi := newODI()
+		now := time.Now()
+		h.mu.Lock()
+		for id, session := range h.sessions {
+			if now.After(session.deadline) {
+				delete(h.sessions, id)
+			}
+		}
+		h.sessions[odi] = iscSession{next: i + 1, deadline: now.Add(iscTimeout)}
+		h.mu.Unlock()
+		
+		back := fmt.Sprintf("<%s;lr;odi=%s;orig>", scscfURI, odi)
+		msg.Route = append([]string{"<" + ifc.ApplicationServer + ";lr>", back}, msg.Route...)
+		return ifc.ApplicationServer, true
+	}
+	return "", false
+}
+
+// resumeISC removes the topmost Route of a request an application server
+// sent back and returns the index of the next iFC to evaluate. A request
+// with an unknown original dialog identifier skips iFC evaluation.
+func (h *Handler) resumeISC(msg *sip.Message, count int) (int, bool) {
+	if len(msg.Route) == 0 || !strings.HasPrefix(strings.Trim(msg.Route[0], "<>"), scscfURI+";") {
+		return 0, false
+	}
+	odi := ""
+	for _, param := range strings.Split(strings.Trim(msg.Route[0], "<>"), ";") {
+		if value, ok := strings.CutPrefix(param, "odi="); ok {
+			odi = value
+		}
+	}
+	if odi == "" {
+		return 0, false
+	}
+	msg.Route = msg.Route[1:]
+	
+	h.mu.Lock()
+	session, ok := h.sessions[odi]
+	delete(h.sessions, odi)
+	h.mu.Unlock()
+	if !ok {
+		h.logger.Printf("S-CSCF: Unknown ODI %s, skipping iFC", odi)
+		return count, true
+	}
+	return session.next, true
+}
+
+// newODI returns a random original dialog identifier
+func newODI() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (h *Handler) extractIMPI(from string) string {
 	if from == "" {
 		return "sip:user@example.com"
@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/dasmlab/ims/internal/scscf"
 	"github.com/dasmlab/souverix/common/diagnostics"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/enum"
+	"github.com/dasmlab/souverix/common/hss"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -59,6 +64,48 @@ func main() {
 	r1.Use(gin.LoggerWithWriter(logger.Writer()))
 	r1.Use(gin.Recovery())
 
+	// Set up SIP handling once the HSS is reachable. Tel URIs are looked
+	// up in ENUM and the number portability database: on-net and peer
+	// network numbers stay on SIP, the others break out through the BGCF.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	translator, err := enum.Setup(ctx, enum.ConfigFromEnv())
+	if err != nil {
+		logger.WithError(err).Fatal("failed to set up ENUM")
+	}
+	if hssAddr := os.Getenv("HSS_ADDR"); hssAddr != "" {
+		serverName := os.Getenv("SCSCF_SERVER_NAME")
+		if serverName == "" {
+			serverName = "sip:scscf1.ims.local"
+		}
+		bgcfAddr := os.Getenv("BGCF_ADDR")
+		if bgcfAddr == "" {
+			bgcfAddr = "bgcf.ims.local"
+		}
+		diameterConfig := diameter.Config{
+			OriginHost:  os.Getenv("SCSCF_DIAMETER_HOST"),
+			OriginRealm: os.Getenv("SCSCF_DIAMETER_REALM"),
+			Log:         logger,
+		}
+		if diameterConfig.OriginHost == "" {
+			diameterConfig.OriginHost = "scscf1.ims.local"
+		}
+		if diameterConfig.OriginRealm == "" {
+			diameterConfig.OriginRealm = "ims.local"
+		}
+		hssClient, err := hss.DialHSSClient(ctx, hssAddr, diameterConfig, serverName)
+		if err != nil {
+			logger.WithError(err).Fatal("failed to connect to the HSS")
+		}
+		handler := scscf.NewHandler(hssClient, bgcfAddr, log.New(logger.Writer(), "", 0))
+		if translator != nil {
+			handler.SetTranslator(translator)
+			logger.Info("ENUM and number portability lookups enabled")
+		}
+	} else if translator != nil {
+		logger.Warn("ENUM configured without HSS_ADDR, SIP handling is disabled")
+	}
+
 	// Initialize metrics router (r2) - Prometheus metrics, out of band
 	r2 := gin.New()
 	r2.Use(gin.LoggerWithWriter(logger.Writer()))
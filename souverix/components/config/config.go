@@ -1,8 +1,10 @@
 package config
 
 import (
+	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -50,6 +52,21 @@ type IMSConfig struct {
 	// HSS configuration
 	HSS HSSConfig
 
+	// Trust domain of asserted identities
+	TrustDomain TrustDomainConfig
+
+	// P-CSCF configuration
+	PCSCF PCSCFConfig
+
+	// I-CSCF configuration
+	ICSCF ICSCFConfig
+
+	// S-CSCF configuration
+	SCSCF SCSCFConfig
+
+	// Offline and online charging configuration
+	Charging ChargingConfig
+
 	// SBC/IBCF configuration
 	SBC SBCConfig
 
@@ -62,8 +79,96 @@ type IMSConfig struct {
 
 // HSSConfig holds HSS configuration
 type HSSConfig struct {
-	Backend string // "memory", "postgres", "redis"
-	DSN     string // Connection string for persistent backends
+	Backend string // "memory", "postgres", "sqlite", "redis"
+	DSN     string // Connection string: postgres DSN, sqlite path or redis:// URL
+
+	// Diameter Cx interface towards the CSCFs
+	DiameterAddr  string   // TCP listen address
+	DiameterHost  string   // Origin-Host of the HSS
+	DiameterRealm string   // Origin-Realm of the HSS
+	SCSCFNames    []string // S-CSCFs offered in Server-Capabilities
+
+	// Bearer tokens accepted by the subscriber provisioning API
+	ProvisioningTokens []string
+
+	// Hex encoded AES-256 key that encrypts AKA K and OPc at rest. AKA
+	// credentials cannot be provisioned without it.
+	CredentialKEK string
+}
+
+// TrustDomainConfig defines the trust domain of RFC 3325 (Spec(T)): the nodes
+// whose P-Asserted-Identity, P-Charging-Vector and P-Access-Network-Info are
+// believed. An empty domain trusts no node, so these headers are removed
+// from every request.
+type TrustDomainConfig struct {
+	Networks []string // CIDRs, IP addresses or host names of trusted nodes
+}
+
+// PCSCFConfig holds P-CSCF security agreement configuration
+type PCSCFConfig struct {
+	Address              string        // IP address the UEs reach the P-CSCF on
+	ProtectedPortC       int           // Protected client port (port-c) of the P-CSCF
+	ProtectedPortS       int           // Protected server port (port-s) of the P-CSCF
+	IPsecBackend         string        // "xfrm" or "fake"
+	IntegrityAlgorithms  []string      // ipsec-3gpp alg values, in order of preference
+	EncryptionAlgorithms []string      // ipsec-3gpp ealg values, in order of preference
+	RequireSecAgree      bool          // Reject UEs that do not negotiate a security agreement
+	TemporarySALifetime  time.Duration // Lifetime of SAs set up by a 401 challenge
+
+	// Policy control of the media bearers
+	PolicyBackend   string // "rx" (PCRF), "n5" (PCF) or "" to reserve no bearers
+	AFApplicationID string // AF-Application-Identifier sent to policy control
+	PCRFAddr        string // TCP address of the PCRF Diameter peer
+	DiameterHost    string // Origin-Host of the P-CSCF on Rx
+	DiameterRealm   string // Origin-Realm of the P-CSCF on Rx
+	PCFURL          string // apiRoot of the PCF Npcf_PolicyAuthorization service
+	PolicyNotifyURL string // URL the PCF sends its notifications to
+
+	// OAuth2 bearer tokens the PCF presents with its notifications. None
+	// configured rejects every notification.
+	PolicyNotifyTokens []string
+}
+
+// ICSCFConfig holds I-CSCF S-CSCF selection configuration
+type ICSCFConfig struct {
+	SCSCFPool  []SCSCFEntry  // S-CSCFs the I-CSCF selects from
+	RetryAfter time.Duration // How long an unreachable S-CSCF is left out of selection
+}
+
+// SCSCFEntry describes an S-CSCF of the I-CSCF pool
+type SCSCFEntry struct {
+	Name         string   // SIP URI, as in Server-Name
+	Weight       int      // Relative share of new assignments, 1 if unset
+	Capabilities []uint32 // Server-Capabilities values the S-CSCF supports
+}
+
+// SCSCFConfig holds S-CSCF registrar configuration
+type SCSCFConfig struct {
+	ServerName     string        // SIP URI of this S-CSCF, sent in SAR and Service-Route
+	Realm          string        // Digest realm, defaults to the IMS domain
+	NonceTTL       time.Duration // Lifetime of an authentication challenge
+	MinExpires     int           // Shortest registration accepted, in seconds
+	MaxExpires     int           // Longest registration granted, in seconds
+	DefaultExpires int           // Registration interval when the UE requests none
+	ISCTimeout     time.Duration // How long an application server may hold a request
+}
+
+// ChargingConfig holds the offline (Rf) and online (Ro) charging
+// configuration of the CSCFs
+type ChargingConfig struct {
+	IOI string // Inter-operator identifier of this network, defaults to the IMS domain
+
+	// Offline charging
+	OfflineBackend  string        // "rf" (CDF), "csv" or "json" (local CDR files), or "" for none
+	CDFAddr         string        // TCP address of the CDF Diameter peer
+	CDRDir          string        // Directory of the local CDR files
+	InterimInterval time.Duration // Interval of the Interim records of a session, 0 for none
+
+	// Online charging
+	OCSAddr string // TCP address of the OCS Diameter peer, "" for no online charging
+
+	DiameterHost  string // Origin-Host towards the CDF and the OCS
+	DiameterRealm string // Origin-Realm towards the CDF and the OCS
 }
 
 // SBCConfig holds Session Border Controller configuration
@@ -84,6 +189,24 @@ type SBCConfig struct {
 	// STIR/SHAKEN
 	EnableSTIR      bool
 	STIRAttestation string // "A", "B", "C" or "auto"
+	STIRTransitPolicy string // "keep", "resign" or "div" for INVITEs that already carry an Identity
+	RCDAllowedHosts []string // Hosts Rich Call Data content is fetched from, "*.example.com" for subdomains
+
+	// Interconnect peers / trunks, used for attestation and origid
+	Peers []PeerProfile
+
+	// Session timers (RFC 4028): the session interval of calls, 1800s by
+	// default (the PIXIT session timer), 0 to not enforce them. Enforcing
+	// them needs the SBC to send requests of its own (SBC.SetRequestSender).
+	SessionInterval time.Duration
+}
+
+// PeerProfile describes an interconnect peer or trunk the SBC receives calls from
+type PeerProfile struct {
+	ID       string   // Trunk or peer identifier
+	Networks []string // CIDRs or IP addresses the peer sends from
+	Trusted  bool     // Calls from untrusted peers are gateway (C) attested
+	OrigID   string   // Fixed origid for the trunk, derived from ID if empty
 }
 
 // ZeroTrustConfig holds Zero Trust Architecture configuration
@@ -101,6 +224,27 @@ type ZeroTrustConfig struct {
 
 	// ACME (Let's Encrypt, etc.)
 	ACME ACMEConfig
+
+	// STIR/SHAKEN signing key backend
+	STIRKey STIRKeyConfig
+}
+
+// STIRKeyConfig selects where the STIR/SHAKEN signing key is held
+type STIRKeyConfig struct {
+	Source string // "file", "pkcs11", "vault"; empty uses the ACME key path
+	Path   string // PEM key file for "file", defaults to ACME.KeyPath
+
+	// PKCS#11 (HSM)
+	PKCS11Module     string // Path to the PKCS#11 module (e.g. libsofthsm2.so)
+	PKCS11TokenLabel string
+	PKCS11PIN        string
+	PKCS11KeyLabel   string
+
+	// Vault transit
+	VaultAddress      string
+	VaultToken        string
+	VaultTransitMount string
+	VaultKeyName      string
 }
 
 // InternalCAConfig holds internal CA configuration
@@ -126,6 +270,15 @@ type ACMEConfig struct {
 	Domain     string
 	CertPath   string
 	KeyPath    string
+
+	// STI certificate issuance (RFC 9447/9448 tkauth-01)
+	DirectoryURL   string        // ACME directory; empty uses a self-signed development cert
+	AccountKeyPath string        // ACME account key, generated if missing
+	SPC            string        // Service Provider Code for the TNAuthList identifier
+	SPCTokenURL    string        // STI-PA token API used to obtain SPC tokens
+	SPCToken       string        // Pre-issued SPC token (used if SPCTokenURL is empty)
+	SPCTokenFile   string        // File holding a pre-issued SPC token
+	RenewBefore    time.Duration // Renew this long before expiry; 0 renews at 2/3 of lifetime
 }
 
 // LIConfig holds Lawful Intercept configuration
@@ -168,6 +321,56 @@ func Load() *Config {
 			HSS: HSSConfig{
 				Backend: getEnv("HSS_BACKEND", "memory"),
 				DSN:     getEnv("HSS_DSN", ""),
+				DiameterAddr:       getEnv("HSS_DIAMETER_ADDR", ":3868"),
+				DiameterHost:       getEnv("HSS_DIAMETER_HOST", "hss.ims.local"),
+				DiameterRealm:      getEnv("HSS_DIAMETER_REALM", "ims.local"),
+				SCSCFNames:         getEnvList("HSS_SCSCF_NAMES", []string{"scscf1.ims.local", "scscf2.ims.local"}),
+				ProvisioningTokens: getEnvList("HSS_PROVISIONING_TOKENS", nil),
+				CredentialKEK:      getEnv("HSS_CREDENTIAL_KEK", ""),
+			},
+			TrustDomain: TrustDomainConfig{
+				Networks: getEnvList("TRUST_DOMAIN_NETWORKS", nil),
+			},
+			PCSCF: PCSCFConfig{
+				Address:              getEnv("PCSCF_ADDRESS", ""),
+				ProtectedPortC:       getEnvInt("PCSCF_PROTECTED_PORT_C", 5100),
+				ProtectedPortS:       getEnvInt("PCSCF_PROTECTED_PORT_S", 5101),
+				IPsecBackend:         getEnv("PCSCF_IPSEC_BACKEND", "xfrm"),
+				IntegrityAlgorithms:  getEnvList("PCSCF_INTEGRITY_ALGORITHMS", []string{"hmac-sha-1-96", "hmac-md5-96"}),
+				EncryptionAlgorithms: getEnvList("PCSCF_ENCRYPTION_ALGORITHMS", []string{"aes-cbc", "des-ede3-cbc", "null"}),
+				RequireSecAgree:      getEnvBool("PCSCF_REQUIRE_SEC_AGREE", true),
+				TemporarySALifetime:  getEnvDuration("PCSCF_TEMPORARY_SA_LIFETIME", 240*time.Second),
+				PolicyBackend:        getEnv("PCSCF_POLICY_BACKEND", ""),
+				AFApplicationID:      getEnv("PCSCF_AF_APPLICATION_ID", "IMS Services"),
+				PCRFAddr:             getEnv("PCSCF_PCRF_ADDR", ""),
+				DiameterHost:         getEnv("PCSCF_DIAMETER_HOST", "pcscf.ims.local"),
+				DiameterRealm:        getEnv("PCSCF_DIAMETER_REALM", "ims.local"),
+				PCFURL:               getEnv("PCSCF_PCF_URL", ""),
+				PolicyNotifyURL:      getEnv("PCSCF_POLICY_NOTIFY_URL", ""),
+				PolicyNotifyTokens:   getEnvList("PCSCF_POLICY_NOTIFY_TOKENS", nil),
+			},
+			ICSCF: ICSCFConfig{
+				SCSCFPool:  getEnvSCSCFPool("ICSCF_SCSCF_POOL", []SCSCFEntry{{Name: "sip:scscf1.ims.local", Weight: 1}, {Name: "sip:scscf2.ims.local", Weight: 1}}),
+				RetryAfter: getEnvDuration("ICSCF_SCSCF_RETRY_AFTER", 30*time.Second),
+			},
+			SCSCF: SCSCFConfig{
+				ServerName:     getEnv("SCSCF_SERVER_NAME", "sip:scscf1.ims.local"),
+				Realm:          getEnv("SCSCF_REALM", ""),
+				NonceTTL:       getEnvDuration("SCSCF_NONCE_TTL", 30*time.Second),
+				MinExpires:     getEnvInt("SCSCF_MIN_EXPIRES", 60),
+				MaxExpires:     getEnvInt("SCSCF_MAX_EXPIRES", 600000),
+				DefaultExpires: getEnvInt("SCSCF_DEFAULT_EXPIRES", 600000),
+				ISCTimeout:     getEnvDuration("SCSCF_ISC_TIMEOUT", 32*time.Second),
+			},
+			Charging: ChargingConfig{
+				IOI:             getEnv("CHARGING_IOI", ""),
+				OfflineBackend:  getEnv("CHARGING_OFFLINE_BACKEND", ""),
+				CDFAddr:         getEnv("CHARGING_CDF_ADDR", ""),
+				CDRDir:          getEnv("CHARGING_CDR_DIR", "/var/lib/ims/cdr"),
+				InterimInterval: getEnvDuration("CHARGING_INTERIM_INTERVAL", 5*time.Minute),
+				OCSAddr:         getEnv("CHARGING_OCS_ADDR", ""),
+				DiameterHost:    getEnv("CHARGING_DIAMETER_HOST", "ctf.ims.local"),
+				DiameterRealm:   getEnv("CHARGING_DIAMETER_REALM", "ims.local"),
 			},
 			SBC: SBCConfig{
 				TopologyHiding:  getEnvBool("SBC_TOPOLOGY_HIDING", true),
@@ -179,6 +382,10 @@ func Load() *Config {
 				RateLimitWindow:  getEnvDuration("SBC_RATE_LIMIT_WINDOW", 60*time.Second),
 				EnableSTIR:       getEnvBool("SBC_ENABLE_STIR", false),
 				STIRAttestation:  getEnv("SBC_STIR_ATTESTATION", "auto"),
+				STIRTransitPolicy: getEnv("SBC_STIR_TRANSIT_POLICY", "keep"),
+				RCDAllowedHosts:  getEnvList("SBC_RCD_ALLOWED_HOSTS", nil),
+				Peers:            getEnvPeerProfiles("SBC_PEER_PROFILES"),
+				SessionInterval:  getEnvDuration("SBC_SESSION_INTERVAL", 1800*time.Second),
 			},
 			LI: LIConfig{
 				Enabled:          getEnvBool("LI_ENABLED", false),
@@ -216,12 +423,42 @@ func Load() *Config {
 				Domain:   getEnv("ZTA_ACME_DOMAIN", ""),
 				CertPath: getEnv("ZTA_ACME_CERT_PATH", "/etc/ims/certs/tls.crt"),
 				KeyPath:  getEnv("ZTA_ACME_KEY_PATH", "/etc/ims/certs/tls.key"),
+
+				DirectoryURL:   getEnv("ZTA_ACME_DIRECTORY_URL", ""),
+				AccountKeyPath: getEnv("ZTA_ACME_ACCOUNT_KEY_PATH", ""),
+				SPC:            getEnv("ZTA_ACME_SPC", ""),
+				SPCTokenURL:    getEnv("ZTA_ACME_SPC_TOKEN_URL", ""),
+				SPCToken:       getEnv("ZTA_ACME_SPC_TOKEN", ""),
+				SPCTokenFile:   getEnv("ZTA_ACME_SPC_TOKEN_FILE", ""),
+				RenewBefore:    getEnvDuration("ZTA_ACME_RENEW_BEFORE", 0),
+			},
+			STIRKey: STIRKeyConfig{
+				Source:            getEnv("ZTA_STIR_KEY_SOURCE", ""),
+				Path:              getEnv("ZTA_STIR_KEY_PATH", ""),
+				PKCS11Module:      getEnv("ZTA_STIR_PKCS11_MODULE", ""),
+				PKCS11TokenLabel:  getEnv("ZTA_STIR_PKCS11_TOKEN_LABEL", ""),
+				PKCS11PIN:         getEnv("ZTA_STIR_PKCS11_PIN", ""),
+				PKCS11KeyLabel:    getEnv("ZTA_STIR_PKCS11_KEY_LABEL", "stir-shaken"),
+				VaultAddress:      getEnv("ZTA_STIR_VAULT_ADDR", ""),
+				VaultToken:        getEnv("ZTA_STIR_VAULT_TOKEN", ""),
+				VaultTransitMount: getEnv("ZTA_STIR_VAULT_TRANSIT_MOUNT", "transit"),
+				VaultKeyName:      getEnv("ZTA_STIR_VAULT_KEY", "stir-shaken"),
 			},
 		},
 		LogLevel: getEnv("LOG_LEVEL", "info"),
 		Version:  getEnv("VERSION", "dev"),
 	}
 
+	// The PIXIT file named by PIXIT_FILE overrides the environment
+	if path := os.Getenv("PIXIT_FILE"); path != "" {
+		pixit, err := LoadPIXIT(path)
+		if err != nil {
+			log.Printf("PIXIT file %s not applied: %v", path, err)
+		} else {
+			cfg.ApplyPIXIT(pixit)
+		}
+	}
+
 	return cfg
 }
 
@@ -251,6 +488,91 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvList parses a comma separated list
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvPeerProfiles parses peer profiles in the form
+// "ID=cidr|cidr:trusted,ID=cidr:external". IPv6 networks may be written
+// as is or bracketed, e.g. "ID=[2001:db8::]/32:trusted".
+func getEnvPeerProfiles(key string) []PeerProfile {
+	var peers []PeerProfile
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		id, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || id == "" {
+			continue
+		}
+		// The trust suffix follows the last colon, which may also be
+		// part of an IPv6 network
+		trust := ""
+		if i := strings.LastIndex(rest, ":"); i >= 0 {
+			switch suffix := rest[i+1:]; suffix {
+			case "trusted", "untrusted", "external":
+				rest, trust = rest[:i], suffix
+			}
+		}
+		var networks []string
+		for _, network := range strings.Split(rest, "|") {
+			if strings.HasPrefix(network, "[") {
+				addr, prefix, _ := strings.Cut(network[1:], "]")
+				network = addr + prefix
+			}
+			networks = append(networks, network)
+		}
+		peers = append(peers, PeerProfile{
+			ID:       id,
+			Networks: networks,
+			Trusted:  trust == "trusted",
+		})
+	}
+	return peers
+}
+
+// getEnvSCSCFPool parses S-CSCF pool entries in the form
+// "sip:scscf1.ims.local;weight=2;caps=1|2,sip:scscf2.ims.local"
+func getEnvSCSCFPool(key string, defaultValue []SCSCFEntry) []SCSCFEntry {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var pool []SCSCFEntry
+	for _, item := range strings.Split(value, ",") {
+		params := strings.Split(strings.TrimSpace(item), ";")
+		if params[0] == "" {
+			continue
+		}
+		entry := SCSCFEntry{Name: params[0], Weight: 1}
+		for _, param := range params[1:] {
+			name, val, _ := strings.Cut(param, "=")
+			switch name {
+			case "weight":
+				if w, err := strconv.Atoi(val); err == nil && w > 0 {
+					entry.Weight = w
+				}
+			case "caps":
+				for _, c := range strings.Split(val, "|") {
+					if n, err := strconv.ParseUint(c, 10, 32); err == nil {
+						entry.Capabilities = append(entry.Capabilities, uint32(n))
+					}
+				}
+			}
+		}
+		pool = append(pool, entry)
+	}
+	return pool
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := time.ParseDuration(value); err == nil {
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoad_SessionInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want time.Duration
+	}{
+		{"PIXIT session timer by default", "", 1800 * time.Second},
+		{"configured", "900s", 900 * time.Second},
+		{"disabled", "0s", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PIXIT_FILE", "")
+			t.Setenv("SBC_SESSION_INTERVAL", tt.env)
+			if got := Load().IMS.SBC.SessionInterval; got != tt.want {
+				t.Errorf("SessionInterval = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PIXITSettings are the settings of a PIXIT file (Protocol Implementation
+// eXtra Information for Testing) that drive runtime behaviour
+type PIXITSettings struct {
+	AttestationPolicy  string // "auto", "A", "B" or "C"
+	SigningKeySource   string // "HSM", "File" or "Vault"
+	ReSignTransitCalls bool
+	SessionTimer       time.Duration // RFC 4028 session interval, 0 to keep the configured one
+}
+
+// pixitFile is the layout of the runtime settings in a PIXIT file
+type pixitFile struct {
+	STIR struct {
+		AttestationPolicy  string `yaml:"attestation_policy"`
+		SigningKeySource   string `yaml:"signing_key_source"`
+		ReSignTransitCalls bool   `yaml:"re_sign_transit_calls"`
+	} `yaml:"stir"`
+	Timers struct {
+		SessionTimer time.Duration `yaml:"session_timer"`
+	} `yaml:"timers"`
+}
+
+// LoadPIXIT reads the runtime settings of the PIXIT file at path
+func LoadPIXIT(path string) (PIXITSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PIXITSettings{}, fmt.Errorf("read PIXIT file: %w", err)
+	}
+	var f pixitFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return PIXITSettings{}, fmt.Errorf("parse PIXIT file: %w", err)
+	}
+	return PIXITSettings{
+		AttestationPolicy:  f.STIR.AttestationPolicy,
+		SigningKeySource:   f.STIR.SigningKeySource,
+		ReSignTransitCalls: f.STIR.ReSignTransitCalls,
+		SessionTimer:       f.Timers.SessionTimer,
+	}, nil
+}
+
+// ApplyPIXIT applies PIXIT settings to c, overriding the environment
+func (c *Config) ApplyPIXIT(p PIXITSettings) {
+	// STIR/SHAKEN
+	if p.AttestationPolicy != "" {
+		c.IMS.SBC.STIRAttestation = p.AttestationPolicy
+	}
+	switch p.SigningKeySource {
+	case "HSM":
+		c.ZeroTrust.STIRKey.Source = "pkcs11"
+	case "File":
+		c.ZeroTrust.STIRKey.Source = "file"
+	case "Vault":
+		c.ZeroTrust.STIRKey.Source = "vault"
+	}
+	if p.ReSignTransitCalls {
+		c.IMS.SBC.STIRTransitPolicy = "resign"
+	} else if c.IMS.SBC.STIRTransitPolicy == "resign" {
+		c.IMS.SBC.STIRTransitPolicy = "keep"
+	}
+
+	// Session timers
+	if p.SessionTimer > 0 {
+		c.IMS.SBC.SessionInterval = p.SessionTimer
+	}
+}
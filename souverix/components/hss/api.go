@@ -0,0 +1,943 @@
+package hss
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dasmlab/ims/internal/aka"
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Page sizes of GET /subscribers
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// SubscriberResource is the provisioning API view of a subscriber.
+// Registered and SCSCFName are read-only.
+type SubscriberResource struct {
+	IMPI                     string
+	IMPU                     string
+	ServiceProfile           ims.ServiceProfile
+	AdditionalProfiles       []ims.ServiceProfile          `json:",omitempty"`
+	ImplicitRegistrationSets []ims.ImplicitRegistrationSet `json:",omitempty"`
+	SCSCFCapabilities        ims.SCSCFCapabilities
+	Credentials              *CredentialsResource `json:",omitempty"`
+	Registered               bool
+	SCSCFName                string `json:",omitempty"`
+}
+
+// CredentialsResource holds the authentication credentials of a
+// subscriber. Password, K, OP and OPc are write-only: a Digest password is
+// stored as HA1 only, and an AKA OP is stored as the derived OPc.
+type CredentialsResource struct {
+	Scheme    string // "Digest" or "AKA"
+	Username  string `json:",omitempty"`
+	Realm     string `json:",omitempty"`
+	Algorithm string `json:",omitempty"` // Digest HA1 algorithm: "MD5" (default) or "SHA-256"
+	Password  string `json:",omitempty"`
+	K         string `json:",omitempty"`
+	OP        string `json:",omitempty"`
+	OPc       string `json:",omitempty"`
+	AMF       string `json:",omitempty"`
+}
+
+// subscriberPage is a page of GET /subscribers
+type subscriberPage struct {
+	Subscribers []*SubscriberResource
+	Next        string `json:",omitempty"` // IMPI to pass as "after" for the next page
+}
+
+// bulkResult is the outcome of POST /bulk/subscribers
+type bulkResult struct {
+	Created int
+	Updated int
+}
+
+// ProvisioningAPI is the authenticated REST API used to provision
+// subscribers in the HSSStore. Every write to an existing subscriber must
+// carry the ETag of the version it modifies in If-Match; the store checks
+// it in the same transaction as the write.
+type ProvisioningAPI struct {
+	store  store.HSSStore
+	tokens []string
+	sealer *credentialSealer
+	log    *logrus.Logger
+}
+
+// NewProvisioningAPI creates the provisioning API of the HSS configured in
+// cfg. Requests are rejected when cfg lists no provisioning tokens, and
+// AKA credentials when it has no valid credential KEK.
+func NewProvisioningAPI(cfg *config.HSSConfig, hssStore store.HSSStore, log *logrus.Logger) *ProvisioningAPI {
+	sealer, err := newCredentialSealer(cfg.CredentialKEK)
+	if err != nil {
+		log.WithError(err).Error("Invalid credential KEK, AKA credentials cannot be provisioned")
+	}
+	return &ProvisioningAPI{
+		store:  hssStore,
+		tokens: cfg.ProvisioningTokens,
+		sealer: sealer,
+		log:    log,
+	}
+}
+
+// RegisterRoutes registers the API under /provisioning/v1
+func (a *ProvisioningAPI) RegisterRoutes(r gin.IRouter) {
+	api := r.Group("/provisioning/v1")
+	api.Use(a.authenticate())
+
+	api.GET("/subscribers", a.listSubscribers)
+	api.POST("/subscribers", a.createSubscriber)
+	api.GET("/subscribers/:impi", a.getSubscriber)
+	api.PUT("/subscribers/:impi", a.updateSubscriber)
+	api.DELETE("/subscribers/:impi", a.deleteSubscriber)
+
+	api.GET("/subscribers/:impi/identities", a.getIdentities)
+	api.PUT("/subscribers/:impi/identities/:impu", a.putIdentity)
+	api.DELETE("/subscribers/:impi/identities/:impu", a.deleteIdentity)
+
+	api.GET("/subscribers/:impi/implicit-sets", a.getImplicitSets)
+	api.PUT("/subscribers/:impi/implicit-sets/:id", a.putImplicitSet)
+	api.DELETE("/subscribers/:impi/implicit-sets/:id", a.deleteImplicitSet)
+
+	api.GET("/subscribers/:impi/credentials", a.getCredentials)
+	api.PUT("/subscribers/:impi/credentials", a.putCredentials)
+
+	api.GET("/subscribers/:impi/ifcs", a.getFilterCriteria)
+	api.PUT("/subscribers/:impi/ifcs", a.putFilterCriteria)
+
+	api.GET("/bulk/subscribers", a.exportSubscribers)
+	api.POST("/bulk/subscribers", a.importSubscribers)
+}
+
+// authenticate checks the bearer token of the request
+func (a *ProvisioningAPI) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok {
+			ok = false
+			for _, t := range a.tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer realm="hss-provisioning"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing bearer token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// listSubscribers returns subscribers ordered by IMPI, limit per page,
+// starting after the IMPI given in "after"
+func (a *ProvisioningAPI) listSubscribers(c *gin.Context) {
+	limit := defaultPageSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+
+	// One extra subscriber tells whether there is a next page
+	subscribers, err := a.store.ListSubscribersPage(c.Query("after"), limit+1)
+	if err != nil {
+		a.storeError(c, err)
+		return
+	}
+	page := subscriberPage{Subscribers: []*SubscriberResource{}}
+	if len(subscribers) > limit {
+		subscribers = subscribers[:limit]
+		page.Next = subscribers[limit-1].IMPI
+	}
+	for _, sub := range subscribers {
+		page.Subscribers = append(page.Subscribers, subscriberResource(sub))
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// createSubscriber creates a subscriber that does not exist yet
+func (a *ProvisioningAPI) createSubscriber(c *gin.Context) {
+	var resource SubscriberResource
+	if err := c.ShouldBindJSON(&resource); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sub, err := a.newSubscriber(&resource, nil)
+	if err != nil {
+		a.invalid(c, err)
+		return
+	}
+
+	err = a.store.UpsertSubscribers([]*ims.Subscriber{sub}, func(stored, update *ims.Subscriber) error {
+		if stored != nil {
+			return errConflict("subscriber already exists")
+		}
+		return nil
+	})
+	var conflict errConflict
+	if errors.As(err, &conflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		a.storeError(c, err)
+		return
+	}
+	sub.Version = 1
+
+	a.log.WithField("impi", sub.IMPI).Info("subscriber provisioned")
+	c.Header("Location", c.Request.URL.Path+"/"+sub.IMPI)
+	a.respond(c, http.StatusCreated, sub, subscriberResource(sub))
+}
+
+// getSubscriber returns a subscriber with its ETag
+func (a *ProvisioningAPI) getSubscriber(c *gin.Context) {
+	sub, ok := a.lookup(c)
+	if !ok {
+		return
+	}
+	a.respond(c, http.StatusOK, sub, subscriberResource(sub))
+}
+
+// updateSubscriber replaces the provisioned data of a subscriber.
+// Credentials are kept when the body carries none.
+func (a *ProvisioningAPI) updateSubscriber(c *gin.Context) {
+	var resource SubscriberResource
+	if err := c.ShouldBindJSON(&resource); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if resource.IMPI != "" && resource.IMPI != c.Param("impi") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "IMPI does not match the resource"})
+		return
+	}
+	resource.IMPI = c.Param("impi")
+
+	a.modify(c, func(old *ims.Subscriber) (*ims.Subscriber, error) {
+		return a.newSubscriber(&resource, old)
+	}, func(sub *ims.Subscriber) any { return subscriberResource(sub) })
+}
+
+// deleteSubscriber removes a subscriber
+func (a *ProvisioningAPI) deleteSubscriber(c *gin.Context) {
+	sub, ok := a.lookup(c)
+	if !ok || !a.checkETag(c, sub) {
+		return
+	}
+	if err := a.store.DeleteSubscriber(sub.IMPI); err != nil {
+		a.storeError(c, err)
+		return
+	}
+	a.log.WithField("impi", sub.IMPI).Info("subscriber deprovisioned")
+	c.Status(http.StatusNoContent)
+}
+
+// identityResource is a public identity with its attributes
+type identityResource struct {
+	Identity string
+	ims.PublicIdentityAttributes
+}
+
+// getIdentities lists the public identities of every service profile
+func (a *ProvisioningAPI) getIdentities(c *gin.Context) {
+	sub, ok := a.lookup(c)
+	if !ok {
+		return
+	}
+	a.respond(c, http.StatusOK, sub, identities(sub))
+}
+
+// putIdentity adds a public identity to the first service profile, or
+// updates the attributes of an identity of any profile
+func (a *ProvisioningAPI) putIdentity(c *gin.Context) {
+	var attrs ims.PublicIdentityAttributes
+	if err := c.ShouldBindJSON(&attrs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	impu := c.Param("impu")
+
+	a.modify(c, func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		profile := profileOf(sub, impu)
+		if profile == nil {
+			profile = &sub.ServiceProfile
+			profile.PublicIdentities = append(profile.PublicIdentities, impu)
+		}
+		profile.IdentityAttributes = copyAttributes(profile.IdentityAttributes)
+		if attrs == (ims.PublicIdentityAttributes{}) {
+			delete(profile.IdentityAttributes, impu)
+		} else {
+			profile.IdentityAttributes[impu] = attrs
+		}
+		return sub, validateSubscriber(sub)
+	}, func(sub *ims.Subscriber) any { return identities(sub) })
+}
+
+// deleteIdentity removes a public identity other than the primary IMPU
+func (a *ProvisioningAPI) deleteIdentity(c *gin.Context) {
+	impu := c.Param("impu")
+	a.modify(c, func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		if impu == sub.IMPU {
+			return nil, errConflict("the primary IMPU cannot be removed")
+		}
+		profile := profileOf(sub, impu)
+		if profile == nil {
+			return nil, store.ErrNotFound
+		}
+		profile.PublicIdentities = without(profile.PublicIdentities, impu)
+		profile.IdentityAttributes = copyAttributes(profile.IdentityAttributes)
+		delete(profile.IdentityAttributes, impu)
+
+		sets := sub.ImplicitRegistrationSets[:0:0]
+		for _, set := range sub.ImplicitRegistrationSets {
+			if set.IMPUs = without(set.IMPUs, impu); len(set.IMPUs) > 0 {
+				sets = append(sets, set)
+			}
+		}
+		sub.ImplicitRegistrationSets = sets
+		return sub, validateSubscriber(sub)
+	}, func(sub *ims.Subscriber) any { return identities(sub) })
+}
+
+// getImplicitSets lists the implicit registration sets of a subscriber
+func (a *ProvisioningAPI) getImplicitSets(c *gin.Context) {
+	sub, ok := a.lookup(c)
+	if !ok {
+		return
+	}
+	a.respond(c, http.StatusOK, sub, implicitSets(sub))
+}
+
+// putImplicitSet creates or replaces an implicit registration set
+func (a *ProvisioningAPI) putImplicitSet(c *gin.Context) {
+	var set ims.ImplicitRegistrationSet
+	if err := c.ShouldBindJSON(&set); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	set.ID = c.Param("id")
+
+	a.modify(c, func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		sets := make([]ims.ImplicitRegistrationSet, 0, len(sub.ImplicitRegistrationSets)+1)
+		replaced := false
+		for _, s := range sub.ImplicitRegistrationSets {
+			if s.ID == set.ID {
+				s, replaced = set, true
+			}
+			sets = append(sets, s)
+		}
+		if !replaced {
+			sets = append(sets, set)
+		}
+		sub.ImplicitRegistrationSets = sets
+		return sub, validateSubscriber(sub)
+	}, func(sub *ims.Subscriber) any { return implicitSets(sub) })
+}
+
+// deleteImplicitSet removes an implicit registration set
+func (a *ProvisioningAPI) deleteImplicitSet(c *gin.Context) {
+	id := c.Param("id")
+	a.modify(c, func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		sets := sub.ImplicitRegistrationSets[:0:0]
+		for _, s := range sub.ImplicitRegistrationSets {
+			if s.ID != id {
+				sets = append(sets, s)
+			}
+		}
+		if len(sets) == len(sub.ImplicitRegistrationSets) {
+			return nil, store.ErrNotFound
+		}
+		sub.ImplicitRegistrationSets = sets
+		return sub, nil
+	}, func(sub *ims.Subscriber) any { return implicitSets(sub) })
+}
+
+// getCredentials returns the credentials of a subscriber without secrets
+func (a *ProvisioningAPI) getCredentials(c *gin.Context) {
+	sub, ok := a.lookup(c)
+	if !ok {
+		return
+	}
+	a.respond(c, http.StatusOK, sub, credentialsResource(&sub.AuthData))
+}
+
+// putCredentials replaces the credentials of a subscriber
+func (a *ProvisioningAPI) putCredentials(c *gin.Context) {
+	var creds CredentialsResource
+	if err := c.ShouldBindJSON(&creds); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.modify(c, func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		authData, err := a.hashCredentials(&creds, sub.IMPI, &sub.AuthData)
+		if err != nil {
+			return nil, err
+		}
+		sub.AuthData = *authData
+		return sub, nil
+	}, func(sub *ims.Subscriber) any { return credentialsResource(&sub.AuthData) })
+}
+
+// getFilterCriteria returns the iFCs of the first service profile
+func (a *ProvisioningAPI) getFilterCriteria(c *gin.Context) {
+	sub, ok := a.lookup(c)
+	if !ok {
+		return
+	}
+	a.respond(c, http.StatusOK, sub, filterCriteria(sub))
+}
+
+// putFilterCriteria replaces the iFCs of the first service profile
+func (a *ProvisioningAPI) putFilterCriteria(c *gin.Context) {
+	var criteria []ims.FilterCriteria
+	if err := c.ShouldBindJSON(&criteria); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.modify(c, func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		sub.ServiceProfile.InitialFilterCriteria = criteria
+		return sub, validateSubscriber(sub)
+	}, func(sub *ims.Subscriber) any { return filterCriteria(sub) })
+}
+
+// exportSubscribers returns every subscriber as an IMSSubscriptions
+// document
+func (a *ProvisioningAPI) exportSubscribers(c *gin.Context) {
+	c.Header("Content-Type", "application/xml; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := ExportSubscriptions(a.store, c.Writer); err != nil {
+		a.log.WithError(err).Error("subscriber export failed")
+	}
+}
+
+// importSubscribers creates or updates subscribers in bulk, from an
+// IMSSubscription(s) XML document or a JSON array of subscribers. The whole
+// batch is validated, public identities included, before it is written in
+// one transaction. Updating existing subscribers needs If-Match: "*" or
+// the ETags of all of them.
+func (a *ProvisioningAPI) importSubscribers(c *gin.Context) {
+	match := c.GetHeader("If-Match")
+	check := func(stored, update *ims.Subscriber) error {
+		if stored == nil || match == "*" {
+			return nil
+		}
+		if match == "" {
+			return errPrecondition{required: true, impi: stored.IMPI}
+		}
+		etag := subscriberETag(stored)
+		for _, m := range strings.Split(match, ",") {
+			if strings.TrimSpace(m) == etag {
+				return nil
+			}
+		}
+		return errPrecondition{impi: stored.IMPI}
+	}
+
+	if ct := c.ContentType(); ct == "application/xml" || ct == "text/xml" {
+		result, err := ImportSubscriptions(a.store, c.Request.Body, check)
+		if err != nil {
+			a.importError(c, err)
+			return
+		}
+		a.log.WithFields(logrus.Fields{"created": result.Created, "updated": result.Updated}).Info("bulk provisioning applied")
+		c.JSON(http.StatusOK, bulkResult{Created: result.Created, Updated: result.Updated})
+		return
+	}
+
+	var resources []*SubscriberResource
+	if err := c.ShouldBindJSON(&resources); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate every subscriber first. Public identities are checked by
+	// the store against the whole batch and the other subscribers before
+	// anything is written.
+	subscribers := make([]*ims.Subscriber, 0, len(resources))
+	byIMPI := make(map[string]*SubscriberResource)
+	for _, resource := range resources {
+		if byIMPI[resource.IMPI] != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("subscriber %s listed twice", resource.IMPI)})
+			return
+		}
+		byIMPI[resource.IMPI] = resource
+
+		sub, err := a.newSubscriber(resource, nil)
+		if err != nil {
+			a.invalid(c, fmt.Errorf("subscriber %s: %w", resource.IMPI, err))
+			return
+		}
+		subscribers = append(subscribers, sub)
+	}
+
+	// Registration state and unchanged credentials come from the stored
+	// subscribers, read in the write transaction
+	existing := make(map[string]bool)
+	err := a.store.UpsertSubscribers(subscribers, func(stored, update *ims.Subscriber) error {
+		if err := check(stored, update); err != nil {
+			return err
+		}
+		existing[update.IMPI] = stored != nil
+		sub, err := a.newSubscriber(byIMPI[update.IMPI], stored)
+		if err != nil {
+			return err
+		}
+		*update = *sub
+		return nil
+	})
+	if err != nil {
+		a.importError(c, err)
+		return
+	}
+	result := bulkResult{}
+	for _, sub := range subscribers {
+		if existing[sub.IMPI] {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+	}
+	a.log.WithFields(logrus.Fields{"created": result.Created, "updated": result.Updated}).Info("bulk provisioning applied")
+	c.JSON(http.StatusOK, result)
+}
+
+// modify applies change to a copy of the subscriber named in the path and
+// stores the result, checking If-Match in the same store transaction, then
+// responds with view of the stored subscriber. Fields change leaves alone
+// keep their stored value even when they were written concurrently.
+func (a *ProvisioningAPI) modify(c *gin.Context, change func(*ims.Subscriber) (*ims.Subscriber, error), view func(*ims.Subscriber) any) {
+	match := c.GetHeader("If-Match")
+	if match == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match is required"})
+		return
+	}
+
+	var current string
+	var invalid bool
+	sub, err := a.store.UpdateSubscriber(c.Param("impi"), func(stored *ims.Subscriber) (*ims.Subscriber, error) {
+		if current = subscriberETag(stored); match != "*" && match != current {
+			return nil, errPrecondition{impi: stored.IMPI}
+		}
+		sub, err := change(cloneSubscriber(stored))
+		invalid = err != nil
+		return sub, err
+	})
+	var precondition errPrecondition
+	switch {
+	case errors.As(err, &precondition):
+		c.Header("ETag", current)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "subscriber was modified"})
+		return
+	case err != nil && invalid:
+		a.invalid(c, err)
+		return
+	case err != nil:
+		a.storeError(c, err)
+		return
+	}
+
+	a.log.WithField("impi", sub.IMPI).Info("subscriber updated")
+	a.respond(c, http.StatusOK, sub, view(sub))
+}
+
+// lookup loads the subscriber named in the path, responding 404 when it
+// does not exist
+func (a *ProvisioningAPI) lookup(c *gin.Context) (*ims.Subscriber, bool) {
+	sub, err := a.store.GetSubscriber(c.Param("impi"))
+	if err != nil {
+		a.storeError(c, err)
+		return nil, false
+	}
+	return sub, true
+}
+
+// checkETag enforces optimistic concurrency: writes must name the current
+// version of the subscriber in If-Match
+func (a *ProvisioningAPI) checkETag(c *gin.Context, sub *ims.Subscriber) bool {
+	match := c.GetHeader("If-Match")
+	if match == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match is required"})
+		return false
+	}
+	if match != "*" && match != subscriberETag(sub) {
+		c.Header("ETag", subscriberETag(sub))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "subscriber was modified"})
+		return false
+	}
+	return true
+}
+
+// respond writes body with the ETag of sub
+func (a *ProvisioningAPI) respond(c *gin.Context, status int, sub *ims.Subscriber, body any) {
+	c.Header("ETag", subscriberETag(sub))
+	c.JSON(status, body)
+}
+
+// storeError maps a store error to a response
+func (a *ProvisioningAPI) storeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, store.ErrIMPUConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		a.log.WithError(err).Error("provisioning store operation failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "store operation failed"})
+	}
+}
+
+// invalid maps an error in the data of a request to a response
+func (a *ProvisioningAPI) invalid(c *gin.Context, err error) {
+	var conflict errConflict
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.As(err, &conflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoKEK):
+		a.log.WithError(err).Error("AKA credentials refused")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// importError maps a bulk import error to a response
+func (a *ProvisioningAPI) importError(c *gin.Context, err error) {
+	var precondition errPrecondition
+	switch {
+	case errors.As(err, &precondition) && precondition.required:
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": err.Error()})
+	case errors.As(err, &precondition):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case errors.Is(err, store.ErrIMPUConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		a.invalid(c, err)
+	}
+}
+
+// errConflict is a change that contradicts the current subscriber
+type errConflict string
+
+func (e errConflict) Error() string { return string(e) }
+
+// errPrecondition is a write to a subscriber whose ETag If-Match does not
+// name, or that it leaves out altogether
+type errPrecondition struct {
+	required bool
+	impi     string
+}
+
+func (e errPrecondition) Error() string {
+	if e.required {
+		return "If-Match is required to update subscriber " + e.impi
+	}
+	return "subscriber " + e.impi + " was modified"
+}
+
+// subscriberETag is a strong validator of sub: the version the store
+// advances on every write, registration and AKA sequence number changes
+// included, tied to the IMPI
+func subscriberETag(sub *ims.Subscriber) string {
+	sum := sha256.Sum256([]byte(sub.IMPI))
+	return `"` + strconv.FormatUint(sub.Version, 10) + "-" + hex.EncodeToString(sum[:4]) + `"`
+}
+
+// newSubscriber builds the subscriber described by resource. Registration
+// state, and the credentials when resource carries none, come from old.
+func (a *ProvisioningAPI) newSubscriber(resource *SubscriberResource, old *ims.Subscriber) (*ims.Subscriber, error) {
+	sub := &ims.Subscriber{
+		IMPI:                     resource.IMPI,
+		IMPU:                     resource.IMPU,
+		ServiceProfile:           resource.ServiceProfile,
+		AdditionalProfiles:       resource.AdditionalProfiles,
+		ImplicitRegistrationSets: resource.ImplicitRegistrationSets,
+		SCSCFCapabilities:        resource.SCSCFCapabilities,
+	}
+	if sub.IMPU != "" && !containsString(sub.ServiceProfile.PublicIdentities, sub.IMPU) {
+		sub.ServiceProfile.PublicIdentities = append([]string{sub.IMPU}, sub.ServiceProfile.PublicIdentities...)
+	}
+
+	var previous *ims.AuthData
+	if old != nil {
+		sub.Registered = old.Registered
+		sub.Contact = old.Contact
+		sub.SCSCFName = old.SCSCFName
+		sub.AuthData = old.AuthData
+		previous = &old.AuthData
+	}
+	if resource.Credentials != nil {
+		authData, err := a.hashCredentials(resource.Credentials, sub.IMPI, previous)
+		if err != nil {
+			return nil, err
+		}
+		sub.AuthData = *authData
+	}
+	return sub, validateSubscriber(sub)
+}
+
+// validateSubscriber checks identities, implicit registration sets and the
+// User-Data schema rules of sub
+func validateSubscriber(sub *ims.Subscriber) error {
+	if sub.IMPI == "" || sub.IMPU == "" {
+		return errors.New("IMPI and IMPU are required")
+	}
+	if err := EncodeSubscription(sub).Validate(); err != nil {
+		return err
+	}
+
+	owned := make(map[string]bool)
+	for _, profile := range append([]ims.ServiceProfile{sub.ServiceProfile}, sub.AdditionalProfiles...) {
+		for _, impu := range profile.PublicIdentities {
+			owned[impu] = true
+			if wildcard := profile.IdentityAttributes[impu].Wildcard; wildcard != "" {
+				if _, err := WildcardRegexp(wildcard); err != nil {
+					return fmt.Errorf("public identity %s: %w", impu, err)
+				}
+			}
+		}
+	}
+	inSet := make(map[string]string)
+	ids := make(map[string]bool)
+	for _, set := range sub.ImplicitRegistrationSets {
+		if set.ID == "" || ids[set.ID] {
+			return fmt.Errorf("implicit registration set ID %q is empty or not unique", set.ID)
+		}
+		ids[set.ID] = true
+		if len(set.IMPUs) == 0 {
+			return fmt.Errorf("implicit registration set %s is empty", set.ID)
+		}
+		for _, impu := range set.IMPUs {
+			if !owned[impu] {
+				return fmt.Errorf("implicit registration set %s: %s is not a public identity of the subscriber", set.ID, impu)
+			}
+			if other, ok := inSet[impu]; ok {
+				return fmt.Errorf("%s is in implicit registration sets %s and %s", impu, other, set.ID)
+			}
+			inSet[impu] = set.ID
+		}
+	}
+	return nil
+}
+
+// hashCredentials converts written credentials to the stored AuthData:
+// the Digest password becomes HA1 and the AKA OP becomes OPc, and K and
+// OPc are sealed with the credential KEK. The AKA sequence number of
+// previous is kept.
+func (a *ProvisioningAPI) hashCredentials(creds *CredentialsResource, impi string, previous *ims.AuthData) (*ims.AuthData, error) {
+	switch strings.ToUpper(creds.Scheme) {
+	case "DIGEST":
+		if creds.Password == "" {
+			return nil, errors.New("Digest credentials need a password")
+		}
+		username, realm := creds.Username, creds.Realm
+		if username == "" {
+			username = impi
+		}
+		if realm == "" {
+			realm = domainOf(impi)
+		}
+		var newHash func() hash.Hash
+		switch strings.ToUpper(creds.Algorithm) {
+		case "", "MD5":
+			newHash = md5.New
+		case "SHA-256":
+			newHash = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported Digest algorithm %q", creds.Algorithm)
+		}
+		h := newHash()
+		h.Write([]byte(username + ":" + realm + ":" + creds.Password))
+		return &ims.AuthData{AuthScheme: "Digest", Username: username, Realm: realm, HA1: hex.EncodeToString(h.Sum(nil))}, nil
+
+	case "AKA":
+		k, err := hexKey("K", creds.K, 16)
+		if err != nil {
+			return nil, err
+		}
+		opc := creds.OPc
+		switch {
+		case opc != "" && creds.OP != "":
+			return nil, errors.New("give either OP or OPc")
+		case opc != "":
+			if _, err := hexKey("OPc", opc, 16); err != nil {
+				return nil, err
+			}
+		default:
+			op, err := hexKey("OP", creds.OP, 16)
+			if err != nil {
+				return nil, err
+			}
+			derived, err := aka.ComputeOPc(k, op)
+			if err != nil {
+				return nil, err
+			}
+			opc = hex.EncodeToString(derived)
+		}
+		amf := creds.AMF
+		if amf == "" {
+			amf = "8000"
+		}
+		if _, err := hexKey("AMF", amf, 2); err != nil {
+			return nil, err
+		}
+
+		sealedK, err := a.sealer.seal(impi, "K", strings.ToLower(creds.K))
+		if err != nil {
+			return nil, err
+		}
+		sealedOPc, err := a.sealer.seal(impi, "OPc", strings.ToLower(opc))
+		if err != nil {
+			return nil, err
+		}
+		authData := &ims.AuthData{AuthScheme: "AKA", Username: creds.Username, Realm: creds.Realm, K: sealedK, OPc: sealedOPc, AMF: amf}
+		if previous != nil && previous.AuthScheme == "AKA" {
+			authData.SQN = previous.SQN
+		}
+		return authData, nil
+	}
+	return nil, fmt.Errorf("unsupported authentication scheme %q", creds.Scheme)
+}
+
+// hexKey decodes a hex encoded key of the given length in bytes
+func hexKey(name, value string, size int) ([]byte, error) {
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("%s must be %d hex digits", name, size*2)
+	}
+	return key, nil
+}
+
+// subscriberResource is the API view of sub, without secrets
+func subscriberResource(sub *ims.Subscriber) *SubscriberResource {
+	return &SubscriberResource{
+		IMPI:                     sub.IMPI,
+		IMPU:                     sub.IMPU,
+		ServiceProfile:           sub.ServiceProfile,
+		AdditionalProfiles:       sub.AdditionalProfiles,
+		ImplicitRegistrationSets: sub.ImplicitRegistrationSets,
+		SCSCFCapabilities:        sub.SCSCFCapabilities,
+		Credentials:              credentialsResource(&sub.AuthData),
+		Registered:               sub.Registered,
+		SCSCFName:                sub.SCSCFName,
+	}
+}
+
+// credentialsResource describes stored credentials without their secrets
+func credentialsResource(authData *ims.AuthData) *CredentialsResource {
+	if authData.AuthScheme == "" {
+		return nil
+	}
+	creds := &CredentialsResource{Scheme: authData.AuthScheme, Username: authData.Username, Realm: authData.Realm}
+	switch {
+	case authData.AuthScheme == "AKA":
+		creds.AMF = authData.AMF
+	case len(authData.HA1) == sha256.Size*2:
+		creds.Algorithm = "SHA-256"
+	default:
+		creds.Algorithm = "MD5"
+	}
+	return creds
+}
+
+// identities lists the public identities of every profile of sub
+func identities(sub *ims.Subscriber) []identityResource {
+	list := []identityResource{}
+	for _, profile := range append([]ims.ServiceProfile{sub.ServiceProfile}, sub.AdditionalProfiles...) {
+		for _, impu := range profile.PublicIdentities {
+			list = append(list, identityResource{Identity: impu, PublicIdentityAttributes: profile.IdentityAttributes[impu]})
+		}
+	}
+	return list
+}
+
+// implicitSets returns the implicit registration sets of sub, never nil
+func implicitSets(sub *ims.Subscriber) []ims.ImplicitRegistrationSet {
+	if sub.ImplicitRegistrationSets == nil {
+		return []ims.ImplicitRegistrationSet{}
+	}
+	return sub.ImplicitRegistrationSets
+}
+
+// filterCriteria returns the iFCs of the first profile of sub, never nil
+func filterCriteria(sub *ims.Subscriber) []ims.FilterCriteria {
+	if sub.ServiceProfile.InitialFilterCriteria == nil {
+		return []ims.FilterCriteria{}
+	}
+	return sub.ServiceProfile.InitialFilterCriteria
+}
+
+// profileOf returns the service profile of sub holding impu
+func profileOf(sub *ims.Subscriber, impu string) *ims.ServiceProfile {
+	if containsString(sub.ServiceProfile.PublicIdentities, impu) {
+		return &sub.ServiceProfile
+	}
+	for i := range sub.AdditionalProfiles {
+		if containsString(sub.AdditionalProfiles[i].PublicIdentities, impu) {
+			return &sub.AdditionalProfiles[i]
+		}
+	}
+	return nil
+}
+
+// cloneSubscriber copies the slices and maps of sub that the API modifies
+func cloneSubscriber(sub *ims.Subscriber) *ims.Subscriber {
+	out := *sub
+	out.ServiceProfile.PublicIdentities = append([]string(nil), sub.ServiceProfile.PublicIdentities...)
+	out.AdditionalProfiles = append([]ims.ServiceProfile(nil), sub.AdditionalProfiles...)
+	for i := range out.AdditionalProfiles {
+		out.AdditionalProfiles[i].PublicIdentities = append([]string(nil), out.AdditionalProfiles[i].PublicIdentities...)
+	}
+	out.ImplicitRegistrationSets = append([]ims.ImplicitRegistrationSet(nil), sub.ImplicitRegistrationSets...)
+	return &out
+}
+
+// copyAttributes returns a writable copy of an identity attribute map
+func copyAttributes(attrs map[string]ims.PublicIdentityAttributes) map[string]ims.PublicIdentityAttributes {
+	out := make(map[string]ims.PublicIdentityAttributes, len(attrs)+1)
+	for k, v := range attrs {
+		out[k] = v
+	}
+	return out
+}
+
+// without returns list without value
+func without(list []string, value string) []string {
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != value {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// containsString reports whether list holds value
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package hss
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/gin-gonic/gin"
+)
+
+const testToken = "provisioning-secret"
+
+// testKEK is the credential key encryption key of the tests
+const testKEK = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// newTestAPI serves the provisioning API from a memory store seeded with
+// alice
+func newTestAPI(t *testing.T) (*gin.Engine, store.HSSStore) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	hssStore, err := store.NewMemHSSStore(testLogger())
+	if err != nil {
+		t.Fatalf("NewMemHSSStore() error = %v", err)
+	}
+	router := gin.New()
+	cfg := &config.HSSConfig{ProvisioningTokens: []string{testToken}, CredentialKEK: testKEK}
+	NewProvisioningAPI(cfg, hssStore, testLogger()).RegisterRoutes(router)
+	return router, hssStore
+}
+
+// call performs an authenticated request with optional If-Match
+func call(router http.Handler, method, path, ifMatch string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if s, ok := body.(string); ok {
+		reader = bytes.NewReader([]byte(s))
+	} else {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, "/provisioning/v1"+path, reader)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestProvisioningAPI_Authentication(t *testing.T) {
+	router, _ := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"basic scheme", "Basic " + testToken, http.StatusUnauthorized},
+		{"valid token", "Bearer " + testToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/provisioning/v1/subscribers", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisioningAPI_SubscriberLifecycle(t *testing.T) {
+	router, hssStore := newTestAPI(t)
+
+	dave := SubscriberResource{
+		IMPI: "dave@ims.local",
+		IMPU: "sip:dave@ims.local",
+		Credentials: &CredentialsResource{
+			Scheme:   "Digest",
+			Password: "secret",
+		},
+	}
+	w := call(router, http.MethodPost, "/subscribers", "", dave)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("POST response leaks the password: %s", w.Body)
+	}
+	etag := w.Header().Get("ETag")
+
+	// The password is stored as HA1 only
+	sub, err := hssStore.GetSubscriber("dave@ims.local")
+	if err != nil {
+		t.Fatalf("GetSubscriber() error = %v", err)
+	}
+	sum := md5.Sum([]byte("dave@ims.local:ims.local:secret"))
+	if sub.AuthData.Password != "" || sub.AuthData.HA1 != hex.EncodeToString(sum[:]) {
+		t.Errorf("stored AuthData = %+v", sub.AuthData)
+	}
+
+	if w := call(router, http.MethodPost, "/subscribers", "", dave); w.Code != http.StatusConflict {
+		t.Errorf("second POST status = %d, want 409", w.Code)
+	}
+
+	// Writes need the current ETag
+	dave.Credentials = nil
+	dave.ServiceProfile.PublicIdentities = []string{"sip:dave@ims.local", "tel:+15145550004"}
+	if w := call(router, http.MethodPut, "/subscribers/dave@ims.local", "", dave); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("PUT without If-Match status = %d, want 428", w.Code)
+	}
+	if w := call(router, http.MethodPut, "/subscribers/dave@ims.local", `"stale"`, dave); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale If-Match status = %d, want 412", w.Code)
+	}
+	w = call(router, http.MethodPut, "/subscribers/dave@ims.local", etag, dave)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("PUT status = %d, ETag %s: %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+	etag = w.Header().Get("ETag")
+	if sub, _ := hssStore.GetSubscriber("dave@ims.local"); sub.AuthData.HA1 == "" {
+		t.Errorf("PUT without credentials dropped them: %+v", sub.AuthData)
+	}
+
+	// Registration changes the ETag, and writes keep it
+	_, err = hssStore.UpdateSubscriber("dave@ims.local", func(sub *ims.Subscriber) (*ims.Subscriber, error) {
+		sub.Registered = true
+		sub.SCSCFName = "sip:scscf.ims.local"
+		return sub, nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateSubscriber() error = %v", err)
+	}
+	set := map[string]any{"IMPUs": []string{"sip:dave@ims.local", "tel:+15145550004"}}
+	w = call(router, http.MethodPut, "/subscribers/dave@ims.local/implicit-sets/irs1", etag, set)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") == etag {
+		t.Fatalf("PUT after registration status = %d, ETag %s, want 412 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+	etag = w.Header().Get("ETag")
+	if w := call(router, http.MethodGet, "/subscribers/dave@ims.local", "", nil); w.Header().Get("ETag") != etag {
+		t.Errorf("GET ETag = %s, want %s", w.Header().Get("ETag"), etag)
+	}
+
+	// Implicit registration set
+	w = call(router, http.MethodPut, "/subscribers/dave@ims.local/implicit-sets/irs1", etag, set)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT implicit set status = %d: %s", w.Code, w.Body)
+	}
+	etag = w.Header().Get("ETag")
+	if sub, _ := hssStore.GetSubscriber("dave@ims.local"); !sub.Registered || sub.SCSCFName == "" {
+		t.Errorf("PUT implicit set dropped the registration: %+v", sub)
+	}
+	unknown := map[string]any{"IMPUs": []string{"sip:alice@ims.local"}}
+	if w := call(router, http.MethodPut, "/subscribers/dave@ims.local/implicit-sets/irs2", etag, unknown); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT implicit set with a foreign IMPU status = %d, want 400", w.Code)
+	}
+
+	// Identities
+	if w := call(router, http.MethodDelete, "/subscribers/dave@ims.local/identities/sip:dave@ims.local", etag, nil); w.Code != http.StatusConflict {
+		t.Errorf("DELETE primary identity status = %d, want 409", w.Code)
+	}
+	w = call(router, http.MethodDelete, "/subscribers/dave@ims.local/identities/tel:+15145550004", etag, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE identity status = %d: %s", w.Code, w.Body)
+	}
+	etag = w.Header().Get("ETag")
+	sub, _ = hssStore.GetSubscriber("dave@ims.local")
+	if len(sub.ServiceProfile.PublicIdentities) != 1 || len(sub.ImplicitRegistrationSets[0].IMPUs) != 1 {
+		t.Errorf("after DELETE identity: %+v, %+v", sub.ServiceProfile.PublicIdentities, sub.ImplicitRegistrationSets)
+	}
+	if _, err := hssStore.GetSubscriberByIMPU("tel:+15145550004"); err == nil {
+		t.Errorf("deleted identity still resolves")
+	}
+
+	// iFCs are validated against the User-Data schema
+	bad := `[{"Priority": 1, "ApplicationServer": {"ServerName": "vm"}}]`
+	if w := call(router, http.MethodPut, "/subscribers/dave@ims.local/ifcs", etag, bad); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT invalid iFC status = %d, want 400", w.Code)
+	}
+	good := `[{"Priority": 1, "ApplicationServer": {"ServerName": "sip:vm.ims.local", "DefaultHandling": "SESSION_CONTINUED"}}]`
+	w = call(router, http.MethodPut, "/subscribers/dave@ims.local/ifcs", etag, good)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT iFC status = %d: %s", w.Code, w.Body)
+	}
+	etag = w.Header().Get("ETag")
+
+	if w := call(router, http.MethodDelete, "/subscribers/dave@ims.local", etag, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d: %s", w.Code, w.Body)
+	}
+	if w := call(router, http.MethodGet, "/subscribers/dave@ims.local", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE status = %d, want 404", w.Code)
+	}
+}
+
+func TestProvisioningAPI_Credentials(t *testing.T) {
+	router, hssStore := newTestAPI(t)
+	etag := call(router, http.MethodGet, "/subscribers/alice@ims.local", "", nil).Header().Get("ETag")
+
+	tests := []struct {
+		name  string
+		creds CredentialsResource
+		want  int
+	}{
+		{"unknown scheme", CredentialsResource{Scheme: "Basic"}, http.StatusBadRequest},
+		{"digest without password", CredentialsResource{Scheme: "Digest"}, http.StatusBadRequest},
+		{"short K", CredentialsResource{Scheme: "AKA", K: "0011", OP: "cdc202d5123e20f62b6d676ac72cb318"}, http.StatusBadRequest},
+		{"OP and OPc", CredentialsResource{Scheme: "AKA", K: "465b5ce8b199b49faa5f0a2ee238a6bc", OP: "cdc202d5123e20f62b6d676ac72cb318", OPc: "cd63cb71954a9f4e48a5994e37a02baf"}, http.StatusBadRequest},
+		{"AKA with OP", CredentialsResource{Scheme: "AKA", K: "465b5ce8b199b49faa5f0a2ee238a6bc", OP: "cdc202d5123e20f62b6d676ac72cb318"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call(router, http.MethodPut, "/subscribers/alice@ims.local/credentials", etag, tt.creds)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				etag = w.Header().Get("ETag")
+			}
+		})
+	}
+
+	// OPc is derived from OP (TS 35.208 test set 1); OP itself is not
+	// kept, and K and OPc are sealed with the KEK
+	sub, _ := hssStore.GetSubscriber("alice@ims.local")
+	sealer, _ := newCredentialSealer(testKEK)
+	k, err := sealer.open(sub.IMPI, "K", sub.AuthData.K)
+	if err != nil || k != "465b5ce8b199b49faa5f0a2ee238a6bc" || sub.AuthData.K == k {
+		t.Errorf("stored K = %s, opens to %s, %v", sub.AuthData.K, k, err)
+	}
+	opc, err := sealer.open(sub.IMPI, "OPc", sub.AuthData.OPc)
+	if err != nil || opc != "cd63cb71954a9f4e48a5994e37a02baf" || sub.AuthData.AMF != "8000" {
+		t.Errorf("stored AuthData = %+v, OPc opens to %s, %v", sub.AuthData, opc, err)
+	}
+
+	w := call(router, http.MethodGet, "/subscribers/alice@ims.local/credentials", "", nil)
+	var creds CredentialsResource
+	if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+		t.Fatalf("GET credentials: %v", err)
+	}
+	if creds != (CredentialsResource{Scheme: "AKA", AMF: "8000"}) {
+		t.Errorf("GET credentials = %+v, want secrets redacted", creds)
+	}
+
+	// Without a KEK, AKA keys are refused rather than stored in clear
+	router = gin.New()
+	NewProvisioningAPI(&config.HSSConfig{ProvisioningTokens: []string{testToken}}, hssStore, testLogger()).RegisterRoutes(router)
+	etag = call(router, http.MethodGet, "/subscribers/alice@ims.local", "", nil).Header().Get("ETag")
+	aka := CredentialsResource{Scheme: "AKA", K: "465b5ce8b199b49faa5f0a2ee238a6bc", OPc: "cd63cb71954a9f4e48a5994e37a02baf"}
+	if w := call(router, http.MethodPut, "/subscribers/alice@ims.local/credentials", etag, aka); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("AKA credentials without a KEK status = %d, want 503", w.Code)
+	}
+}
+
+func TestProvisioningAPI_PaginationAndBulk(t *testing.T) {
+	router, _ := newTestAPI(t)
+
+	batch := []SubscriberResource{
+		{IMPI: "erin@ims.local", IMPU: "sip:erin@ims.local"},
+		{IMPI: "dave@ims.local", IMPU: "sip:dave@ims.local"},
+		{IMPI: "alice@ims.local", IMPU: "sip:alice@ims.local"},
+	}
+	// Updating alice needs her ETag, and a refused batch writes nothing
+	if w := call(router, http.MethodPost, "/bulk/subscribers", "", batch); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("bulk POST without If-Match status = %d, want 428", w.Code)
+	}
+	if w := call(router, http.MethodPost, "/bulk/subscribers", `"stale"`, batch); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("bulk POST with a stale If-Match status = %d, want 412", w.Code)
+	}
+	if w := call(router, http.MethodGet, "/subscribers/erin@ims.local", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("refused bulk POST created erin: status %d", w.Code)
+	}
+	etag := call(router, http.MethodGet, "/subscribers/alice@ims.local", "", nil).Header().Get("ETag")
+	w := call(router, http.MethodPost, "/bulk/subscribers", `"other", `+etag, batch)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Created":2,"Updated":1`) {
+		t.Fatalf("bulk POST status = %d: %s", w.Code, w.Body)
+	}
+
+	// So does an identity another subscriber owns
+	taken := []SubscriberResource{
+		{IMPI: "frank@ims.local", IMPU: "sip:frank@ims.local"},
+		{IMPI: "gina@ims.local", IMPU: "sip:gina@ims.local", ServiceProfile: ims.ServiceProfile{PublicIdentities: []string{"sip:erin@ims.local"}}},
+	}
+	if w := call(router, http.MethodPost, "/bulk/subscribers", "", taken); w.Code != http.StatusConflict {
+		t.Errorf("bulk POST with a taken identity status = %d, want 409", w.Code)
+	}
+	if w := call(router, http.MethodGet, "/subscribers/frank@ims.local", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("conflicting bulk POST created frank: status %d", w.Code)
+	}
+
+	// An invalid entry rejects the whole batch
+	invalid := []SubscriberResource{
+		{IMPI: "frank@ims.local", IMPU: "sip:frank@ims.local"},
+		{IMPI: "gina@ims.local", IMPU: "gina"},
+	}
+	if w := call(router, http.MethodPost, "/bulk/subscribers", "", invalid); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid bulk POST status = %d, want 400", w.Code)
+	}
+
+	var impis []string
+	after := ""
+	for pages := 0; pages < 5; pages++ {
+		w := call(router, http.MethodGet, "/subscribers?limit=2&after="+after, "", nil)
+		var page subscriberPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("GET page: %v", err)
+		}
+		for _, sub := range page.Subscribers {
+			impis = append(impis, sub.IMPI)
+		}
+		if after = page.Next; after == "" {
+			break
+		}
+	}
+	if got := strings.Join(impis, ","); got != "alice@ims.local,dave@ims.local,erin@ims.local" {
+		t.Errorf("paged IMPIs = %s", got)
+	}
+	if w := call(router, http.MethodGet, "/subscribers?limit=0", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0 status = %d, want 400", w.Code)
+	}
+
+	// The XML export imports back unchanged
+	w = call(router, http.MethodGet, "/bulk/subscribers", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<PrivateID>erin@ims.local</PrivateID>") {
+		t.Fatalf("bulk GET status = %d: %s", w.Code, w.Body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/provisioning/v1/bulk/subscribers", bytes.NewReader(w.Body.Bytes()))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("If-Match", "*")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Created":0,"Updated":3`) {
+		t.Errorf("bulk XML POST status = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,83 @@
+package hss
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks an AKA key encrypted with the credential KEK
+const sealedPrefix = "kek1:"
+
+// errNoKEK refuses AKA keys when no credential KEK is configured
+var errNoKEK = errors.New("no credential KEK is configured for AKA keys")
+
+// credentialSealer encrypts the AKA K and OPc of subscribers at rest with
+// AES-256-GCM under the configured key encryption key. The IMPI and the
+// field name are authenticated with each value, so a sealed key cannot be
+// moved to another subscriber or field.
+type credentialSealer struct {
+	aead cipher.AEAD
+}
+
+// newCredentialSealer creates the sealer of the hex encoded AES-256 kek.
+// An empty kek gives a nil sealer, which seals nothing and opens only
+// plaintext keys.
+func newCredentialSealer(kek string) (*credentialSealer, error) {
+	if kek == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(kek)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("credential KEK must be 64 hex digits")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialSealer{aead: aead}, nil
+}
+
+// seal encrypts the field value of the subscriber impi
+func (s *credentialSealer) seal(impi, field, value string) (string, error) {
+	if s == nil {
+		return "", errNoKEK
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), []byte(impi+"\x00"+field))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed by seal. Values stored before sealing was
+// introduced are returned as they are.
+func (s *credentialSealer) open(impi, field, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, nil
+	}
+	if s == nil {
+		return "", fmt.Errorf("%s is sealed: %w", field, errNoKEK)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("%s is not a sealed value", field)
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(impi+"\x00"+field))
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", field, err)
+	}
+	return string(plain), nil
+}
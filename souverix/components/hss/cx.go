@@ -0,0 +1,519 @@
+// Package hss serves the HSS side of the Diameter Cx interface from an
+// HSSStore.
+package hss
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dasmlab/ims/internal/aka"
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/sirupsen/logrus"
+)
+
+// CxService answers UAR, SAR, MAR and LIR from the CSCFs and sends RTR and
+// PPR to the S-CSCF serving a subscriber
+type CxService struct {
+	store      store.HSSStore
+	server     *diameter.Server
+	scscfNames []string
+	sealer     *credentialSealer
+	log        *logrus.Logger
+}
+
+// NewCxService creates the Cx service for the HSS configured in cfg
+func NewCxService(cfg *config.HSSConfig, hssStore store.HSSStore, log *logrus.Logger) *CxService {
+	s := &CxService{
+		store:      hssStore,
+		scscfNames: cfg.SCSCFNames,
+		log:        log,
+	}
+	sealer, err := newCredentialSealer(cfg.CredentialKEK)
+	if err != nil {
+		log.WithError(err).Error("Invalid credential KEK, sealed AKA keys cannot be used")
+	}
+	s.sealer = sealer
+	s.server = diameter.NewServer(&diameter.Config{
+		OriginHost:   cfg.DiameterHost,
+		OriginRealm:  cfg.DiameterRealm,
+		VendorID:     cx.Vendor3GPP,
+		ProductName:  "souverix-hss",
+		Applications: []diameter.Application{cx.Application},
+		Handler:      &cx.Handler{HSS: s},
+		Log:          log,
+	})
+	return s
+}
+
+// ListenAndServe serves Cx peers on the TCP address addr
+func (s *CxService) ListenAndServe(addr string) error {
+	return s.server.ListenAndServe(addr)
+}
+
+// Serve serves Cx peers on l
+func (s *CxService) Serve(l net.Listener) error {
+	return s.server.Serve(l)
+}
+
+// Close disconnects all peers
+func (s *CxService) Close(ctx context.Context) error {
+	return s.server.Close(ctx)
+}
+
+// capabilities returns the Server-Capabilities the I-CSCF selects an
+// S-CSCF for sub with
+func (s *CxService) capabilities(sub *ims.Subscriber) *cx.ServerCapabilities {
+	return &cx.ServerCapabilities{
+		Mandatory:   sub.SCSCFCapabilities.Mandatory,
+		Optional:    sub.SCSCFCapabilities.Optional,
+		ServerNames: s.scscfNames,
+	}
+}
+
+// subscriber looks up the subscriber owning impu, directly or through a
+// wildcarded identity, and checks that impi, if given, is its private
+// identity. Of the owners of a shared IMPU, the one with impi is chosen.
+func (s *CxService) subscriber(impi, impu string) (*ims.Subscriber, diameter.Result, bool) {
+	var owners []*ims.Subscriber
+	var err error
+	if impu == "" && impi != "" {
+		var sub *ims.Subscriber
+		if sub, err = s.store.GetSubscriber(impi); err == nil {
+			owners = []*ims.Subscriber{sub}
+		}
+	} else {
+		owners, _, err = LookupIMPU(s.store, impu)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, cx.Experimental(cx.ResultErrorUserUnknown), false
+	}
+	if err != nil {
+		s.log.WithError(err).Error("HSS store lookup failed")
+		return nil, diameter.Result{Code: diameter.ResultUnableToComply}, false
+	}
+	if impi == "" {
+		return owners[0], cx.Success, true
+	}
+	for _, sub := range owners {
+		if sub.IMPI == impi {
+			return sub, cx.Success, true
+		}
+	}
+	return nil, cx.Experimental(cx.ResultErrorIdentitiesDontMatch), false
+}
+
+// UserAuthorization answers a UAR (TS 29.228 section 6.1.1)
+func (s *CxService) UserAuthorization(ctx context.Context, req *cx.UAR) *cx.UAA {
+	sub, result, ok := s.subscriber(req.UserName, req.PublicIdentity)
+	if !ok {
+		return &cx.UAA{Result: result}
+	}
+
+	switch req.AuthorizationType {
+	case cx.AuthorizationDeRegistration:
+		if sub.SCSCFName == "" {
+			return &cx.UAA{Result: cx.Experimental(cx.ResultErrorIdentityNotRegistered)}
+		}
+		return &cx.UAA{Result: cx.Success, ServerName: sub.SCSCFName}
+	case cx.AuthorizationRegistrationAndCapabilities:
+		return &cx.UAA{Result: cx.Experimental(cx.ResultFirstRegistration), ServerCapabilities: s.capabilities(sub)}
+	}
+
+	if sub.SCSCFName != "" {
+		return &cx.UAA{Result: cx.Experimental(cx.ResultSubsequentRegistration), ServerName: sub.SCSCFName}
+	}
+	return &cx.UAA{Result: cx.Experimental(cx.ResultFirstRegistration), ServerCapabilities: s.capabilities(sub)}
+}
+
+// ServerAssignment answers a SAR (TS 29.228 section 6.1.2)
+func (s *CxService) ServerAssignment(ctx context.Context, req *cx.SAR) *cx.SAA {
+	impu := ""
+	if len(req.PublicIdentities) > 0 {
+		impu = req.PublicIdentities[0]
+	}
+	sub, result, ok := s.subscriber(req.UserName, impu)
+	if !ok {
+		return &cx.SAA{Result: result}
+	}
+
+	switch req.AssignmentType {
+	case cx.AssignmentNoAssignment:
+		if sub.SCSCFName == "" {
+			return &cx.SAA{Result: cx.Experimental(cx.ResultErrorIdentityNotRegistered)}
+		}
+		if sub.SCSCFName != req.ServerName {
+			return &cx.SAA{Result: diameter.Result{Code: diameter.ResultUnableToComply}}
+		}
+	case cx.AssignmentRegistration, cx.AssignmentReRegistration:
+		sub.SCSCFName = req.ServerName
+		sub.Registered = true
+	case cx.AssignmentUnregisteredUser:
+		sub.SCSCFName = req.ServerName
+		sub.Registered = false
+	case cx.AssignmentTimeoutDeregistration, cx.AssignmentUserDeregistration,
+		cx.AssignmentAdministrativeDeregistration, cx.AssignmentDeregistrationTooMuchData:
+		sub.SCSCFName = ""
+		sub.Registered = false
+	case cx.AssignmentTimeoutDeregistrationStoreServerName, cx.AssignmentUserDeregistrationStoreServerName:
+		sub.Registered = false
+	case cx.AssignmentAuthenticationFailure, cx.AssignmentAuthenticationTimeout:
+		if !sub.Registered {
+			sub.SCSCFName = ""
+		}
+	default:
+		return &cx.SAA{Result: cx.Experimental(cx.ResultErrorInAssignmentType)}
+	}
+
+	if req.AssignmentType != cx.AssignmentNoAssignment {
+		if err := s.updateRegistration(sub, impu); err != nil {
+			s.log.WithError(err).WithField("impi", sub.IMPI).Error("failed to store server assignment")
+			return &cx.SAA{Result: diameter.Result{Code: diameter.ResultUnableToComply}}
+		}
+	}
+
+	answer := &cx.SAA{Result: cx.Success, UserName: sub.IMPI}
+	if sub.SCSCFName != "" && req.UserDataAlreadyAvailable != cx.UserDataAlreadyAvailable {
+		userData, err := subscriptionUserData(sub)
+		if err != nil {
+			s.log.WithError(err).WithField("impi", sub.IMPI).Error("failed to encode user data")
+			return &cx.SAA{Result: diameter.Result{Code: diameter.ResultUnableToComply}}
+		}
+		answer.UserData = userData
+	}
+	return answer
+}
+
+// updateRegistration stores the registration state of sub after a server
+// assignment, leaving the rest of the stored subscriber alone, and reloads
+// sub from the store
+func (s *CxService) updateRegistration(sub *ims.Subscriber, impu string) error {
+	stored, err := s.store.UpdateSubscriber(sub.IMPI, func(current *ims.Subscriber) (*ims.Subscriber, error) {
+		current.SCSCFName = sub.SCSCFName
+		current.Registered = sub.Registered
+		return current, nil
+	})
+	if err != nil {
+		return err
+	}
+	*sub = *stored
+	if sub.SCSCFName == "" {
+		return s.store.DeleteRegistration(sub.IMPI)
+	}
+
+	reg, err := s.store.GetRegistration(sub.IMPI)
+	if errors.Is(err, store.ErrNotFound) {
+		reg = &ims.Registration{IMPI: sub.IMPI, IMPU: impu}
+	} else if err != nil {
+		return err
+	}
+	if reg.IMPU == "" {
+		reg.IMPU = sub.IMPU
+	}
+	reg.ImplicitIMPUs = ImplicitRegistrationSet(sub, reg.IMPU)[1:]
+	reg.SCSCFName = sub.SCSCFName
+	reg.State = ims.RegistrationStateUnregistered
+	if sub.Registered {
+		reg.State = ims.RegistrationStateRegistered
+	}
+	return s.store.UpsertRegistration(reg)
+}
+
+// MultimediaAuth answers a MAR (TS 29.228 section 6.3)
+func (s *CxService) MultimediaAuth(ctx context.Context, req *cx.MAR) *cx.MAA {
+	sub, result, ok := s.subscriber(req.UserName, req.PublicIdentity)
+	if !ok {
+		return &cx.MAA{Result: result}
+	}
+
+	scheme := req.AuthScheme
+	if scheme == "" || scheme == cx.SchemeUnknown {
+		switch sub.AuthData.AuthScheme {
+		case "AKA":
+			scheme = cx.SchemeAKAv1MD5
+		default:
+			scheme = cx.SchemeSIPDigest
+		}
+	}
+	switch scheme {
+	case cx.SchemeSIPDigest:
+		return s.digestAuth(sub, req)
+	case cx.SchemeAKAv1MD5:
+		return s.akaAuth(sub, req)
+	}
+	return &cx.MAA{Result: cx.Experimental(cx.ResultErrorAuthSchemeNotSupported)}
+}
+
+// digestAuth returns the SIP Digest HA1 of the subscriber (TS 29.228
+// Annex F). A 64 digit HA1 is a SHA-256 hash (RFC 7616).
+func (s *CxService) digestAuth(sub *ims.Subscriber, req *cx.MAR) *cx.MAA {
+	realm := sub.AuthData.Realm
+	if realm == "" {
+		realm = domainOf(sub.IMPI)
+	}
+	ha1 := sub.AuthData.HA1
+	if ha1 == "" {
+		username := sub.AuthData.Username
+		if username == "" {
+			username = sub.IMPI
+		}
+		sum := md5.Sum([]byte(username + ":" + realm + ":" + sub.AuthData.Password))
+		ha1 = hex.EncodeToString(sum[:])
+	}
+	algorithm := "MD5"
+	if len(ha1) == sha256.Size*2 {
+		algorithm = "SHA-256"
+	}
+
+	return &cx.MAA{
+		Result:         cx.Success,
+		UserName:       sub.IMPI,
+		PublicIdentity: req.PublicIdentity,
+		AuthItems: []cx.AuthItem{{
+			ItemNumber: 1,
+			Scheme:     cx.SchemeSIPDigest,
+			Digest: &cx.DigestAuthenticate{
+				Realm:     realm,
+				Algorithm: algorithm,
+				QoP:       "auth",
+				HA1:       ha1,
+			},
+		}},
+	}
+}
+
+// akaAuth generates IMS AKA vectors from the subscriber's Milenage data,
+// resynchronising SQN first when the MAR carries RAND || AUTS
+// (TS 29.228 section 6.3.1, TS 33.203 section 6.3)
+func (s *CxService) akaAuth(sub *ims.Subscriber, req *cx.MAR) *cx.MAA {
+	m, amf, err := s.milenage(sub)
+	if err != nil {
+		s.log.WithError(err).WithField("impi", sub.IMPI).Warn("Subscriber has no usable AKA credentials")
+		return &cx.MAA{Result: cx.Experimental(cx.ResultErrorAuthSchemeNotSupported)}
+	}
+
+	resync := false
+	var sqnMS uint64
+	if len(req.Authorization) > 0 {
+		if len(req.Authorization) != 16+aka.AUTSLen {
+			return &cx.MAA{Result: diameter.Result{Code: diameter.ResultInvalidAVPValue}}
+		}
+		sqnMS, err = aka.Resynchronize(m, req.Authorization[:16], req.Authorization[16:])
+		if err != nil {
+			s.log.WithError(err).WithField("impi", sub.IMPI).Warn("AKA resynchronisation rejected")
+			return &cx.MAA{Result: diameter.Result{Code: diameter.ResultAuthenticationRejected}}
+		}
+		resync = true
+	}
+
+	count := int(req.NumberAuthItems)
+	if count < 1 {
+		count = 1
+	}
+
+	// Reserve count sequence numbers atomically in the store, so concurrent
+	// MARs and subscriber writes never reuse or roll one back
+	var sqn uint64
+	_, err = s.store.AdvanceSQN(sub.IMPI, func(current uint64) uint64 {
+		sqn = current
+		if resync {
+			sqn = sqnMS
+		}
+		next := sqn
+		for i := 0; i < count; i++ {
+			next = aka.NextSQN(next)
+		}
+		return next
+	})
+	if err != nil {
+		s.log.WithError(err).Error("Failed to store AKA sequence number")
+		return &cx.MAA{Result: diameter.Result{Code: diameter.ResultUnableToComply}}
+	}
+	if resync {
+		s.log.WithFields(logrus.Fields{"impi": sub.IMPI, "sqn_ms": sqnMS}).Info("AKA sequence number resynchronised")
+	}
+
+	items := make([]cx.AuthItem, 0, count)
+	for i := 0; i < count; i++ {
+		sqn = aka.NextSQN(sqn)
+		v, err := aka.GenerateVector(m, sqn, amf, nil)
+		if err != nil {
+			s.log.WithError(err).Error("AKA vector generation failed")
+			return &cx.MAA{Result: diameter.Result{Code: diameter.ResultUnableToComply}}
+		}
+		items = append(items, cx.AuthItem{
+			ItemNumber:         uint32(i + 1),
+			Scheme:             cx.SchemeAKAv1MD5,
+			Authenticate:       v.SIPAuthenticate(),
+			Authorization:      v.XRES,
+			ConfidentialityKey: v.CK,
+			IntegrityKey:       v.IK,
+		})
+	}
+
+	return &cx.MAA{
+		Result:         cx.Success,
+		UserName:       sub.IMPI,
+		PublicIdentity: req.PublicIdentity,
+		AuthItems:      items,
+	}
+}
+
+// milenage opens and decodes the hex encoded K, OPc and AMF of a subscriber
+func (s *CxService) milenage(sub *ims.Subscriber) (*aka.Milenage, []byte, error) {
+	authData := &sub.AuthData
+	k, err := s.openKey(sub.IMPI, "K", authData.K)
+	if err != nil {
+		return nil, nil, err
+	}
+	opc, err := s.openKey(sub.IMPI, "OPc", authData.OPc)
+	if err != nil {
+		return nil, nil, err
+	}
+	amf := []byte{0x80, 0x00}
+	if authData.AMF != "" {
+		if amf, err = hex.DecodeString(authData.AMF); err != nil || len(amf) != 2 {
+			return nil, nil, fmt.Errorf("invalid AMF %q", authData.AMF)
+		}
+	}
+	m, err := aka.NewMilenage(k, opc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, amf, nil
+}
+
+// openKey opens a stored AKA key and decodes it from hex
+func (s *CxService) openKey(impi, field, value string) ([]byte, error) {
+	plain, err := s.sealer.open(impi, field, value)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(plain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", field, err)
+	}
+	return key, nil
+}
+
+// LocationInfo answers a LIR (TS 29.228 section 6.1.4)
+func (s *CxService) LocationInfo(ctx context.Context, req *cx.LIR) *cx.LIA {
+	sub, result, ok := s.subscriber("", req.PublicIdentity)
+	if !ok {
+		return &cx.LIA{Result: result}
+	}
+
+	if req.AuthorizationType == cx.AuthorizationRegistrationAndCapabilities {
+		return &cx.LIA{Result: cx.Success, ServerCapabilities: s.capabilities(sub)}
+	}
+	if sub.SCSCFName != "" {
+		return &cx.LIA{Result: cx.Success, ServerName: sub.SCSCFName}
+	}
+	// Identities with filter criteria have services while unregistered
+	if len(sub.ServiceProfile.InitialFilterCriteria) > 0 {
+		return &cx.LIA{Result: cx.Experimental(cx.ResultUnregisteredService), ServerCapabilities: s.capabilities(sub)}
+	}
+	return &cx.LIA{Result: cx.Experimental(cx.ResultErrorIdentityNotRegistered)}
+}
+
+// DeregisterSubscriber sends a RTR to the S-CSCF serving impi and clears the
+// assignment once it is acknowledged
+func (s *CxService) DeregisterSubscriber(ctx context.Context, impi string, reasonCode uint32, reasonInfo string) error {
+	sub, err := s.store.GetSubscriber(impi)
+	if err != nil {
+		return err
+	}
+	client, err := s.scscfClient(sub)
+	if err != nil {
+		return err
+	}
+
+	rta, err := client.RegistrationTermination(ctx, &cx.RTR{
+		DestinationHost:  client.Peer().RemoteHost(),
+		UserName:         sub.IMPI,
+		PublicIdentities: sub.ServiceProfile.PublicIdentities,
+		ReasonCode:       reasonCode,
+		ReasonInfo:       reasonInfo,
+	})
+	if err != nil {
+		return fmt.Errorf("RTR failed: %w", err)
+	}
+	if err := rta.Result.Err(); err != nil {
+		return fmt.Errorf("registration termination rejected by %s: %w", sub.SCSCFName, err)
+	}
+
+	sub.SCSCFName = ""
+	sub.Registered = false
+	return s.updateRegistration(sub, sub.IMPU)
+}
+
+// PushProfile sends the current subscription of impi to its S-CSCF with a PPR
+func (s *CxService) PushProfile(ctx context.Context, impi string) error {
+	sub, err := s.store.GetSubscriber(impi)
+	if err != nil {
+		return err
+	}
+	client, err := s.scscfClient(sub)
+	if err != nil {
+		return err
+	}
+	userData, err := subscriptionUserData(sub)
+	if err != nil {
+		return err
+	}
+
+	ppa, err := client.PushProfile(ctx, &cx.PPR{
+		DestinationHost: client.Peer().RemoteHost(),
+		UserName:        sub.IMPI,
+		UserData:        userData,
+	})
+	if err != nil {
+		return fmt.Errorf("PPR failed: %w", err)
+	}
+	if err := ppa.Result.Err(); err != nil {
+		return fmt.Errorf("push profile rejected by %s: %w", sub.SCSCFName, err)
+	}
+	return nil
+}
+
+// scscfClient returns a Cx client for the connected S-CSCF serving sub
+func (s *CxService) scscfClient(sub *ims.Subscriber) (*cx.Client, error) {
+	if sub.SCSCFName == "" {
+		return nil, fmt.Errorf("subscriber %s has no S-CSCF assigned", sub.IMPI)
+	}
+	peer := s.server.Peer(serverHost(sub.SCSCFName))
+	if peer == nil {
+		return nil, fmt.Errorf("S-CSCF %s is not connected", sub.SCSCFName)
+	}
+	return cx.NewClient(peer), nil
+}
+
+// serverHost returns the host of a Server-Name, which is a SIP URI or a bare
+// host name, for matching against peer Origin-Hosts
+func serverHost(serverName string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(serverName, "sip:"), "sips:")
+	if i := strings.IndexAny(host, ";?>"); i >= 0 {
+		host = host[:i]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// domainOf returns the domain part of an identity
+func domainOf(identity string) string {
+	if _, domain, ok := strings.Cut(identity, "@"); ok {
+		return domain
+	}
+	return identity
+}
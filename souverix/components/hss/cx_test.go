@@ -0,0 +1,419 @@
+package hss
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/aka"
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	commonhss "github.com/dasmlab/souverix/common/hss"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return log
+}
+
+// startCxService serves the Cx interface from a memory store seeded with bob
+func startCxService(t *testing.T) (*CxService, store.HSSStore, string) {
+	t.Helper()
+	hssStore, err := store.NewMemHSSStore(testLogger())
+	if err != nil {
+		t.Fatalf("NewMemHSSStore() error = %v", err)
+	}
+	err = hssStore.UpsertSubscriber(&ims.Subscriber{
+		IMPI: "bob@ims.local",
+		IMPU: "sip:bob@ims.local",
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities: []string{"sip:bob@ims.local", "tel:+15145550002"},
+			InitialFilterCriteria: []ims.FilterCriteria{{
+				Priority: 1,
+				Trigger: ims.TriggerPoint{
+					ConditionTypeCNF: "1",
+					SPT:              []ims.ServicePointTrigger{{Group: "0", Method: "INVITE"}},
+				},
+				ApplicationServer: ims.ApplicationServer{ServerName: "sip:as.ims.local", DefaultHandling: "SESSION_TERMINATED"},
+			}},
+		},
+		AuthData: ims.AuthData{AuthScheme: "Digest", Username: "bob", Realm: "ims.local", HA1: "feedface"},
+	})
+	if err != nil {
+		t.Fatalf("UpsertSubscriber() error = %v", err)
+	}
+
+	service := NewCxService(&config.HSSConfig{
+		DiameterHost:  "hss.ims.local",
+		DiameterRealm: "ims.local",
+		SCSCFNames:    []string{"sip:scscf1.ims.local"},
+		CredentialKEK: testKEK,
+	}, hssStore, testLogger())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go service.Serve(l)
+	t.Cleanup(func() { service.Close(context.Background()) })
+	return service, hssStore, l.Addr().String()
+}
+
+// dialSCSCF connects an S-CSCF HSS client named scscf1.ims.local
+func dialSCSCF(t *testing.T, service *CxService, addr string) *commonhss.HSSClient {
+	t.Helper()
+	client, err := commonhss.DialHSSClient(context.Background(), addr, diameter.Config{
+		OriginHost:  "scscf1.ims.local",
+		OriginRealm: "ims.local",
+		Log:         testLogger(),
+	}, "sip:scscf1.ims.local")
+	if err != nil {
+		t.Fatalf("DialHSSClient() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for service.server.Peer("scscf1.ims.local") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("S-CSCF did not connect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return client
+}
+
+func TestCxService_UserAuthorization(t *testing.T) {
+	service, hssStore, _ := startCxService(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		setup      func()
+		req        *cx.UAR
+		wantResult diameter.Result
+		wantServer string
+	}{
+		{
+			name:       "first registration",
+			req:        &cx.UAR{UserName: "bob@ims.local", PublicIdentity: "tel:+15145550002"},
+			wantResult: cx.Experimental(cx.ResultFirstRegistration),
+		},
+		{
+			name:       "unknown user",
+			req:        &cx.UAR{UserName: "eve@ims.local", PublicIdentity: "sip:eve@ims.local"},
+			wantResult: cx.Experimental(cx.ResultErrorUserUnknown),
+		},
+		{
+			name:       "identities do not match",
+			req:        &cx.UAR{UserName: "alice@ims.local", PublicIdentity: "sip:bob@ims.local"},
+			wantResult: cx.Experimental(cx.ResultErrorIdentitiesDontMatch),
+		},
+		{
+			name:       "de-registration of an unregistered user",
+			req:        &cx.UAR{UserName: "bob@ims.local", PublicIdentity: "sip:bob@ims.local", AuthorizationType: cx.AuthorizationDeRegistration},
+			wantResult: cx.Experimental(cx.ResultErrorIdentityNotRegistered),
+		},
+		{
+			name: "subsequent registration",
+			setup: func() {
+				sub, _ := hssStore.GetSubscriber("bob@ims.local")
+				sub.SCSCFName = "sip:scscf2.ims.local"
+				hssStore.UpsertSubscriber(sub)
+			},
+			req:        &cx.UAR{UserName: "bob@ims.local", PublicIdentity: "sip:bob@ims.local"},
+			wantResult: cx.Experimental(cx.ResultSubsequentRegistration),
+			wantServer: "sip:scscf2.ims.local",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			uaa := service.UserAuthorization(ctx, tt.req)
+			if uaa.Result != tt.wantResult {
+				t.Errorf("Result = %+v, want %+v", uaa.Result, tt.wantResult)
+			}
+			if uaa.ServerName != tt.wantServer {
+				t.Errorf("ServerName = %q, want %q", uaa.ServerName, tt.wantServer)
+			}
+			if tt.wantResult == cx.Experimental(cx.ResultFirstRegistration) &&
+				(uaa.ServerCapabilities == nil || len(uaa.ServerCapabilities.ServerNames) != 1) {
+				t.Errorf("ServerCapabilities = %+v", uaa.ServerCapabilities)
+			}
+		})
+	}
+}
+
+func TestCxService_ServerAssignment(t *testing.T) {
+	service, hssStore, _ := startCxService(t)
+	ctx := context.Background()
+
+	sar := func(assignment uint32) *cx.SAA {
+		return service.ServerAssignment(ctx, &cx.SAR{
+			UserName:         "bob@ims.local",
+			PublicIdentities: []string{"sip:bob@ims.local"},
+			ServerName:       "sip:scscf1.ims.local",
+			AssignmentType:   assignment,
+		})
+	}
+
+	if saa := sar(cx.AssignmentNoAssignment); saa.Result != cx.Experimental(cx.ResultErrorIdentityNotRegistered) {
+		t.Errorf("NO_ASSIGNMENT before registration Result = %+v", saa.Result)
+	}
+
+	saa := sar(cx.AssignmentRegistration)
+	if saa.Result.Err() != nil {
+		t.Fatalf("REGISTRATION Result = %+v", saa.Result)
+	}
+	subscription, err := cx.ParseIMSSubscription(saa.UserData)
+	if err != nil {
+		t.Fatalf("ParseIMSSubscription() error = %v", err)
+	}
+	sp := subscription.ServiceProfiles[0]
+	if subscription.PrivateID != "bob@ims.local" || len(sp.PublicIdentities) != 2 || len(sp.InitialFilterCriteria) != 1 {
+		t.Errorf("user data = %+v", subscription)
+	}
+	if ifc := sp.InitialFilterCriteria[0]; !ifc.TriggerPoint.ConditionTypeCNF || ifc.ApplicationServer.DefaultHandling != cx.SessionTerminated {
+		t.Errorf("filter criteria = %+v", ifc)
+	}
+
+	if scscf, _ := hssStore.GetSCSCFForSubscriber("bob@ims.local"); scscf != "sip:scscf1.ims.local" {
+		t.Errorf("stored S-CSCF = %q", scscf)
+	}
+	if reg, err := hssStore.GetRegistration("bob@ims.local"); err != nil || reg.State != ims.RegistrationStateRegistered {
+		t.Errorf("registration = %+v, %v", reg, err)
+	}
+
+	if saa := sar(cx.AssignmentNoAssignment); saa.Result.Err() != nil || len(saa.UserData) == 0 {
+		t.Errorf("NO_ASSIGNMENT after registration = %+v", saa)
+	}
+
+	if saa := sar(cx.AssignmentUserDeregistration); saa.Result.Err() != nil {
+		t.Errorf("USER_DEREGISTRATION Result = %+v", saa.Result)
+	}
+	if _, err := hssStore.GetRegistration("bob@ims.local"); err == nil {
+		t.Error("registration kept after de-registration")
+	}
+	if sub, _ := hssStore.GetSubscriber("bob@ims.local"); sub.SCSCFName != "" || sub.Registered {
+		t.Errorf("subscriber after de-registration = %+v", sub)
+	}
+
+	if saa := sar(99); saa.Result != cx.Experimental(cx.ResultErrorInAssignmentType) {
+		t.Errorf("unknown assignment type Result = %+v", saa.Result)
+	}
+}
+
+func TestCxService_MultimediaAuth(t *testing.T) {
+	service, hssStore, _ := startCxService(t)
+	ctx := context.Background()
+
+	// bob has a provisioned HA1
+	maa := service.MultimediaAuth(ctx, &cx.MAR{UserName: "bob@ims.local", PublicIdentity: "sip:bob@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeUnknown})
+	if maa.Result.Err() != nil || len(maa.AuthItems) != 1 || maa.AuthItems[0].Digest.HA1 != "feedface" {
+		t.Errorf("MAA = %+v", maa)
+	}
+
+	// alice is seeded with the HA1 of her password
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "alice@ims.local", PublicIdentity: "sip:alice@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeSIPDigest})
+	sum := md5.Sum([]byte("alice@ims.local:ims.local:secret123"))
+	if maa.Result.Err() != nil || maa.AuthItems[0].Digest.HA1 != hex.EncodeToString(sum[:]) || maa.AuthItems[0].Digest.Algorithm != "MD5" {
+		t.Errorf("MAA = %+v", maa)
+	}
+
+	// dave's HA1 is derived from a provisioned password, erin's is SHA-256
+	sha := sha256.Sum256([]byte("erin:ims.local:secret"))
+	for _, sub := range []*ims.Subscriber{
+		{IMPI: "dave@ims.local", IMPU: "sip:dave@ims.local", AuthData: ims.AuthData{Username: "dave", Realm: "ims.local", Password: "secret"}},
+		{IMPI: "erin@ims.local", IMPU: "sip:erin@ims.local", AuthData: ims.AuthData{Username: "erin", Realm: "ims.local", HA1: hex.EncodeToString(sha[:])}},
+	} {
+		if err := hssStore.UpsertSubscriber(sub); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+	}
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "dave@ims.local", PublicIdentity: "sip:dave@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeSIPDigest})
+	sum = md5.Sum([]byte("dave:ims.local:secret"))
+	if maa.Result.Err() != nil || maa.AuthItems[0].Digest.HA1 != hex.EncodeToString(sum[:]) {
+		t.Errorf("MAA = %+v", maa)
+	}
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "erin@ims.local", PublicIdentity: "sip:erin@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeSIPDigest})
+	if maa.Result.Err() != nil || maa.AuthItems[0].Digest.Algorithm != "SHA-256" {
+		t.Errorf("SHA-256 MAA = %+v", maa)
+	}
+
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "bob@ims.local", PublicIdentity: "sip:bob@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeAKAv1MD5})
+	if maa.Result != cx.Experimental(cx.ResultErrorAuthSchemeNotSupported) {
+		t.Errorf("AKA MAA Result = %+v", maa.Result)
+	}
+}
+
+func TestCxService_MultimediaAuth_AKA(t *testing.T) {
+	service, hssStore, _ := startCxService(t)
+	ctx := context.Background()
+
+	// Milenage test set 1 credentials (TS 35.208). K is sealed with the
+	// KEK; the plaintext OPc stands for a key stored before sealing.
+	k, _ := hex.DecodeString("465b5ce8b199b49faa5f0a2ee238a6bc")
+	opc, _ := hex.DecodeString("cd63cb71954a9f4e48a5994e37a02baf")
+	sealedK, err := service.sealer.seal("carol@ims.local", "K", hex.EncodeToString(k))
+	if err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	err = hssStore.UpsertSubscriber(&ims.Subscriber{
+		IMPI:     "carol@ims.local",
+		IMPU:     "sip:carol@ims.local",
+		AuthData: ims.AuthData{AuthScheme: "AKA", K: sealedK, OPc: hex.EncodeToString(opc), AMF: "8000"},
+	})
+	if err != nil {
+		t.Fatalf("UpsertSubscriber() error = %v", err)
+	}
+	m, err := aka.NewMilenage(k, opc)
+	if err != nil {
+		t.Fatalf("NewMilenage() error = %v", err)
+	}
+
+	stale, _ := hssStore.GetSubscriber("carol@ims.local")
+	maa := service.MultimediaAuth(ctx, &cx.MAR{UserName: "carol@ims.local", PublicIdentity: "sip:carol@ims.local", NumberAuthItems: 2, AuthScheme: cx.SchemeUnknown})
+	if maa.Result.Err() != nil || len(maa.AuthItems) != 2 {
+		t.Fatalf("MAA = %+v", maa)
+	}
+	for i, item := range maa.AuthItems {
+		if item.ItemNumber != uint32(i+1) || item.Scheme != cx.SchemeAKAv1MD5 || len(item.Authenticate) != 32 {
+			t.Fatalf("auth item %d = %+v", i, item)
+		}
+		xres, ck, ik, _, err := m.F2345(item.Authenticate[:16])
+		if err != nil {
+			t.Fatalf("F2345() error = %v", err)
+		}
+		if !bytes.Equal(item.Authorization, xres) || !bytes.Equal(item.ConfidentialityKey, ck) || !bytes.Equal(item.IntegrityKey, ik) {
+			t.Errorf("auth item %d does not match Milenage output", i)
+		}
+	}
+	sub, _ := hssStore.GetSubscriber("carol@ims.local")
+	if want := aka.NextSQN(aka.NextSQN(0)); sub.AuthData.SQN != want {
+		t.Errorf("stored SQN = %#x, want %#x", sub.AuthData.SQN, want)
+	}
+
+	// A write of a subscriber read before the MAR, as on a SAR, keeps the SQN
+	stale.Registered = true
+	hssStore.UpsertSubscriber(stale)
+	if sub, _ = hssStore.GetSubscriber("carol@ims.local"); sub.AuthData.SQN != aka.NextSQN(aka.NextSQN(0)) {
+		t.Errorf("SQN after subscriber write = %#x, rolled back", sub.AuthData.SQN)
+	}
+
+	// The UE reports SQN_MS far ahead of the HSS
+	rnd := maa.AuthItems[0].Authenticate[:16]
+	sqnMS := []byte{0, 0, 0, 0, 0x10, 0x00}
+	akStar, _ := m.F5Star(rnd)
+	_, macS, _ := m.F1(rnd, sqnMS, []byte{0, 0})
+	auts := make([]byte, 0, aka.AUTSLen)
+	for i := range sqnMS {
+		auts = append(auts, sqnMS[i]^akStar[i])
+	}
+	auts = append(auts, macS...)
+
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "carol@ims.local", PublicIdentity: "sip:carol@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeAKAv1MD5, Authorization: append(append([]byte(nil), rnd...), auts...)})
+	if maa.Result.Err() != nil || len(maa.AuthItems) != 1 {
+		t.Fatalf("resync MAA = %+v", maa)
+	}
+	sub, _ = hssStore.GetSubscriber("carol@ims.local")
+	if want := aka.NextSQN(0x1000); sub.AuthData.SQN != want {
+		t.Errorf("SQN after resync = %#x, want %#x", sub.AuthData.SQN, want)
+	}
+
+	auts[len(auts)-1] ^= 0xff
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "carol@ims.local", PublicIdentity: "sip:carol@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeAKAv1MD5, Authorization: append(append([]byte(nil), rnd...), auts...)})
+	if maa.Result.Code != diameter.ResultAuthenticationRejected {
+		t.Errorf("MAA with forged AUTS Result = %+v", maa.Result)
+	}
+
+	// A key sealed for another subscriber does not open
+	moved, _ := hssStore.GetSubscriber("carol@ims.local")
+	moved.IMPI, moved.IMPU = "mallory@ims.local", "sip:mallory@ims.local"
+	hssStore.UpsertSubscriber(moved)
+	maa = service.MultimediaAuth(ctx, &cx.MAR{UserName: "mallory@ims.local", PublicIdentity: "sip:mallory@ims.local", NumberAuthItems: 1, AuthScheme: cx.SchemeAKAv1MD5})
+	if maa.Result.Err() == nil {
+		t.Errorf("MAA with a moved sealed key = %+v, want an error", maa.Result)
+	}
+}
+
+func TestCxService_LocationInfo(t *testing.T) {
+	service, hssStore, _ := startCxService(t)
+	ctx := context.Background()
+
+	if lia := service.LocationInfo(ctx, &cx.LIR{PublicIdentity: "sip:alice@ims.local"}); lia.Result != cx.Experimental(cx.ResultErrorIdentityNotRegistered) {
+		t.Errorf("unregistered alice Result = %+v", lia.Result)
+	}
+	if lia := service.LocationInfo(ctx, &cx.LIR{PublicIdentity: "tel:+15145550002"}); lia.Result != cx.Experimental(cx.ResultUnregisteredService) {
+		t.Errorf("unregistered bob with services Result = %+v", lia.Result)
+	}
+
+	hssStore.AssignSCSCF("bob@ims.local", func(string) (string, error) { return "sip:scscf1.ims.local", nil })
+	scscf, _ := hssStore.GetSCSCFForSubscriber("bob@ims.local")
+	if lia := service.LocationInfo(ctx, &cx.LIR{PublicIdentity: "tel:+15145550002"}); lia.Result.Err() != nil || lia.ServerName != scscf {
+		t.Errorf("registered bob LIA = %+v, want server %q", lia, scscf)
+	}
+}
+
+func TestCxService_SCSCFClient(t *testing.T) {
+	service, hssStore, addr := startCxService(t)
+	client := dialSCSCF(t, service, addr)
+	ctx := context.Background()
+
+	scscf, _, err := client.GetSCSCFAssignment("sip:bob@ims.local")
+	if err != nil || scscf != "sip:scscf1.ims.local" {
+		t.Fatalf("GetSCSCFAssignment() = %q, %v", scscf, err)
+	}
+
+	// The first profile download assigns bob for unregistered services
+	profile, err := client.GetServiceProfile("sip:bob@ims.local")
+	if err != nil {
+		t.Fatalf("GetServiceProfile() error = %v", err)
+	}
+	if profile.Registered || len(profile.IFC) != 1 || profile.IFC[0].ApplicationServer != "sip:as.ims.local" {
+		t.Errorf("GetServiceProfile() = %+v", profile)
+	}
+
+	ha1, err := client.GetAuthVectors("bob@ims.local")
+	if err != nil || string(ha1) != "feedface" {
+		t.Errorf("GetAuthVectors() = %q, %v", ha1, err)
+	}
+
+	// HSS initiated requests reach the connected S-CSCF
+	if err := service.PushProfile(ctx, "bob@ims.local"); err == nil {
+		t.Error("PushProfile() succeeded for a profile the S-CSCF has not cached")
+	}
+	if err := service.DeregisterSubscriber(ctx, "bob@ims.local", cx.ReasonPermanentTermination, "test"); err != nil {
+		t.Fatalf("DeregisterSubscriber() error = %v", err)
+	}
+	if sub, _ := hssStore.GetSubscriber("bob@ims.local"); sub.SCSCFName != "" {
+		t.Errorf("S-CSCF still assigned after RTR: %q", sub.SCSCFName)
+	}
+	if err := service.DeregisterSubscriber(ctx, "bob@ims.local", cx.ReasonPermanentTermination, ""); err == nil {
+		t.Error("DeregisterSubscriber() succeeded without an assigned S-CSCF")
+	}
+}
+
+func TestServerHost(t *testing.T) {
+	tests := map[string]string{
+		"sip:scscf1.ims.local":                "scscf1.ims.local",
+		"sip:scscf1.ims.local:6060":           "scscf1.ims.local",
+		"sips:scscf1.ims.local;transport=tcp": "scscf1.ims.local",
+		"scscf1.ims.local":                    "scscf1.ims.local",
+	}
+	for serverName, want := range tests {
+		if got := serverHost(serverName); got != want {
+			t.Errorf("serverHost(%q) = %q, want %q", serverName, got, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package hss
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+// IdentityAttributes returns the attributes of impu in the service profile
+// of sub that lists it
+func IdentityAttributes(sub *ims.Subscriber, impu string) ims.PublicIdentityAttributes {
+	if profile := identityProfile(sub, impu); profile != nil {
+		return profile.IdentityAttributes[impu]
+	}
+	return ims.PublicIdentityAttributes{}
+}
+
+// ImplicitRegistrationSet returns the public identities registered together
+// with impu (TS 23.228 section 4.3.3.3): impu first, then the other members
+// of its implicit registration set and its alias identities, which share
+// its service profile and alias group.
+func ImplicitRegistrationSet(sub *ims.Subscriber, impu string) []string {
+	set := []string{impu}
+	seen := map[string]bool{impu: true}
+	add := func(identity string) {
+		if !seen[identity] {
+			seen[identity] = true
+			set = append(set, identity)
+		}
+	}
+
+	for _, irs := range sub.ImplicitRegistrationSets {
+		if containsString(irs.IMPUs, impu) {
+			for _, identity := range irs.IMPUs {
+				add(identity)
+			}
+		}
+	}
+	if profile := identityProfile(sub, impu); profile != nil {
+		if group := profile.IdentityAttributes[impu].AliasGroup; group != "" {
+			for _, identity := range profile.PublicIdentities {
+				if profile.IdentityAttributes[identity].AliasGroup == group {
+					add(identity)
+				}
+			}
+		}
+	}
+	return set
+}
+
+// LookupIMPU returns the subscribers impu belongs to, ordered by IMPI, and
+// the provisioned identity it matched. An identity that is not provisioned
+// itself is matched against the wildcarded IMPUs and PSIs indexed by the
+// store (TS 23.003 section 13.5); each subscriber matches through its
+// lowest matching identity.
+func LookupIMPU(hssStore store.HSSStore, impu string) ([]*ims.Subscriber, string, error) {
+	subs, err := hssStore.GetSubscribersByIMPU(impu)
+	if err == nil || !errors.Is(err, store.ErrNotFound) {
+		return subs, impu, err
+	}
+
+	wildcards, err := hssStore.ListWildcardIdentities()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The wildcards are ordered by IMPI, then IMPU, so the first identity
+	// of a subscriber that matches is its lowest
+	var impis []string
+	lowest := make(map[string]string)
+	for _, w := range wildcards {
+		if _, ok := lowest[w.IMPI]; ok {
+			continue
+		}
+		if re := compiledWildcard(w.Wildcard); re != nil && re.MatchString(impu) {
+			lowest[w.IMPI] = w.IMPU
+			impis = append(impis, w.IMPI)
+		}
+	}
+
+	matched := ""
+	var owners []*ims.Subscriber
+	for _, impi := range impis {
+		if matched != "" && lowest[impi] != matched {
+			continue
+		}
+		sub, err := hssStore.GetSubscriber(impi)
+		if errors.Is(err, store.ErrNotFound) {
+			// Deleted since the wildcards were listed
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		matched = lowest[impi]
+		owners = append(owners, sub)
+	}
+	if len(owners) == 0 {
+		return nil, "", fmt.Errorf("subscriber %w for IMPU: %s", store.ErrNotFound, impu)
+	}
+	return owners, matched, nil
+}
+
+// WildcardRegexp compiles the wildcard of a wildcarded identity. Following
+// TS 23.003 section 13.5, the regular expression parts are delimited by
+// exclamation marks and the rest is literal, as in "sip:chat-!.*!@ims.local";
+// a wildcard without delimiters is a regular expression as a whole.
+func WildcardRegexp(wildcard string) (*regexp.Regexp, error) {
+	expr := wildcard
+	if strings.Contains(wildcard, "!") {
+		parts := strings.Split(wildcard, "!")
+		if len(parts)%2 == 0 {
+			return nil, fmt.Errorf("wildcard %q has an unterminated expression", wildcard)
+		}
+		var b strings.Builder
+		for i, part := range parts {
+			if i%2 == 0 {
+				b.WriteString(regexp.QuoteMeta(part))
+			} else {
+				b.WriteString("(?:" + part + ")")
+			}
+		}
+		expr = b.String()
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid wildcard %q: %w", wildcard, err)
+	}
+	return re, nil
+}
+
+// IsWildcarded reports whether attrs describe a wildcarded IMPU or PSI
+func IsWildcarded(attrs ims.PublicIdentityAttributes) bool {
+	return attrs.Wildcard != "" ||
+		attrs.IdentityType == ims.IdentityTypeWildcardedIMPU ||
+		attrs.IdentityType == ims.IdentityTypeWildcardedPSI
+}
+
+// maxCachedWildcards bounds the compiled wildcard cache; it is emptied
+// when full, as provisioning rarely has that many wildcards
+const maxCachedWildcards = 4096
+
+// wildcardCache holds the compiled wildcards by wildcard, nil for an
+// invalid one, so lookups do not compile them for every request
+var wildcardCache = struct {
+	sync.Mutex
+	regexps map[string]*regexp.Regexp
+}{regexps: make(map[string]*regexp.Regexp)}
+
+// compiledWildcard returns the cached regular expression of wildcard, or
+// nil if it is invalid
+func compiledWildcard(wildcard string) *regexp.Regexp {
+	wildcardCache.Lock()
+	defer wildcardCache.Unlock()
+
+	if re, ok := wildcardCache.regexps[wildcard]; ok {
+		return re
+	}
+	re, err := WildcardRegexp(wildcard)
+	if err != nil {
+		re = nil
+	}
+	if len(wildcardCache.regexps) >= maxCachedWildcards {
+		wildcardCache.regexps = make(map[string]*regexp.Regexp)
+	}
+	wildcardCache.regexps[wildcard] = re
+	return re
+}
+
+// identityProfile returns the service profile of sub holding impu. The
+// primary IMPU belongs to the first profile even when it is not listed.
+func identityProfile(sub *ims.Subscriber, impu string) *ims.ServiceProfile {
+	if profile := profileOf(sub, impu); profile != nil {
+		return profile
+	}
+	if impu == sub.IMPU {
+		return &sub.ServiceProfile
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package hss
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// identitySubscriber has an implicit registration set, an alias pair, a
+// barred identity and a wildcarded PSI
+func identitySubscriber() *ims.Subscriber {
+	return &ims.Subscriber{
+		IMPI: "dave@ims.local",
+		IMPU: "sip:dave@ims.local",
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities: []string{"sip:dave@ims.local", "tel:+15145550010", "sip:dave.work@ims.local", "sip:conf!.*!@ims.local"},
+			IdentityAttributes: map[string]ims.PublicIdentityAttributes{
+				"tel:+15145550010":        {AliasGroup: "1"},
+				"sip:dave.work@ims.local": {Barred: true},
+				"sip:conf!.*!@ims.local":  {IdentityType: ims.IdentityTypeWildcardedPSI, Wildcard: "sip:conf!.*!@ims.local"},
+			},
+		},
+		AdditionalProfiles: []ims.ServiceProfile{{
+			PublicIdentities:   []string{"sip:dave.alias@ims.local"},
+			IdentityAttributes: map[string]ims.PublicIdentityAttributes{"sip:dave.alias@ims.local": {AliasGroup: "1"}},
+		}},
+		ImplicitRegistrationSets: []ims.ImplicitRegistrationSet{
+			{ID: "1", IMPUs: []string{"sip:dave@ims.local", "sip:dave.work@ims.local"}},
+		},
+	}
+}
+
+func TestImplicitRegistrationSet(t *testing.T) {
+	sub := identitySubscriber()
+	sub.ServiceProfile.IdentityAttributes["sip:dave@ims.local"] = ims.PublicIdentityAttributes{AliasGroup: "1"}
+
+	tests := []struct {
+		impu string
+		want []string
+	}{
+		{"sip:dave@ims.local", []string{"sip:dave@ims.local", "sip:dave.work@ims.local", "tel:+15145550010"}},
+		{"sip:dave.work@ims.local", []string{"sip:dave.work@ims.local", "sip:dave@ims.local"}},
+		{"tel:+15145550010", []string{"tel:+15145550010", "sip:dave@ims.local"}},
+		// Aliases only span one service profile
+		{"sip:dave.alias@ims.local", []string{"sip:dave.alias@ims.local"}},
+	}
+	for _, tt := range tests {
+		if got := ImplicitRegistrationSet(sub, tt.impu); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ImplicitRegistrationSet(%s) = %v, want %v", tt.impu, got, tt.want)
+		}
+	}
+	if !IdentityAttributes(sub, "sip:dave.work@ims.local").Barred {
+		t.Error("IdentityAttributes() of a barred identity is not barred")
+	}
+}
+
+func TestWildcardRegexp(t *testing.T) {
+	tests := []struct {
+		wildcard string
+		match    []string
+		noMatch  []string
+		wantErr  bool
+	}{
+		{
+			wildcard: "sip:conf!.*!@ims.local",
+			match:    []string{"sip:conf@ims.local", "sip:conf-42@ims.local"},
+			noMatch:  []string{"sip:conf-42@imsXlocal", "sip:chat@ims.local"},
+		},
+		{
+			wildcard: `tel:\+1514555[0-9]{4}`,
+			match:    []string{"tel:+15145551234"},
+			noMatch:  []string{"tel:+151455512345"},
+		},
+		{wildcard: "sip:conf!.*@ims.local", wantErr: true},
+		{wildcard: "sip:conf!(!@ims.local", wantErr: true},
+	}
+	for _, tt := range tests {
+		re, err := WildcardRegexp(tt.wildcard)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("WildcardRegexp(%q) error = %v, wantErr %v", tt.wildcard, err, tt.wantErr)
+		}
+		for _, s := range tt.match {
+			if !re.MatchString(s) {
+				t.Errorf("WildcardRegexp(%q) does not match %s", tt.wildcard, s)
+			}
+		}
+		for _, s := range tt.noMatch {
+			if re.MatchString(s) {
+				t.Errorf("WildcardRegexp(%q) matches %s", tt.wildcard, s)
+			}
+		}
+	}
+}
+
+func TestCompiledWildcard(t *testing.T) {
+	re := compiledWildcard("sip:chat-!.*!@ims.local")
+	if re == nil || !re.MatchString("sip:chat-1@ims.local") {
+		t.Fatalf("compiledWildcard() = %v", re)
+	}
+	if again := compiledWildcard("sip:chat-!.*!@ims.local"); again != re {
+		t.Error("compiledWildcard() compiled a cached wildcard again")
+	}
+	if re := compiledWildcard("sip:!unterminated@ims.local"); re != nil {
+		t.Errorf("compiledWildcard(invalid) = %v, want nil", re)
+	}
+}
+
+func TestLookupIMPU(t *testing.T) {
+	hssStore, err := store.NewMemHSSStore(testLogger())
+	if err != nil {
+		t.Fatalf("NewMemHSSStore() error = %v", err)
+	}
+	if err := hssStore.UpsertSubscriber(identitySubscriber()); err != nil {
+		t.Fatalf("UpsertSubscriber() error = %v", err)
+	}
+	// Two devices of one user share the line number
+	for _, impi := range []string{"erin-phone@ims.local", "erin-tablet@ims.local"} {
+		err := hssStore.UpsertSubscriber(&ims.Subscriber{
+			IMPI: impi,
+			IMPU: "tel:+15145550020",
+			ServiceProfile: ims.ServiceProfile{
+				PublicIdentities:   []string{"tel:+15145550020"},
+				IdentityAttributes: map[string]ims.PublicIdentityAttributes{"tel:+15145550020": {Shared: true}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("UpsertSubscriber(%s) error = %v", impi, err)
+		}
+	}
+
+	owners, identity, err := LookupIMPU(hssStore, "tel:+15145550020")
+	if err != nil || len(owners) != 2 || identity != "tel:+15145550020" {
+		t.Fatalf("LookupIMPU(shared) = %v, %q, %v", owners, identity, err)
+	}
+
+	owners, identity, err = LookupIMPU(hssStore, "sip:conf-7@ims.local")
+	if err != nil || len(owners) != 1 || owners[0].IMPI != "dave@ims.local" || identity != "sip:conf!.*!@ims.local" {
+		t.Errorf("LookupIMPU(wildcard) = %v, %q, %v", owners, identity, err)
+	}
+	if _, _, err := LookupIMPU(hssStore, "sip:nobody@ims.local"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("LookupIMPU(unknown) error = %v, want ErrNotFound", err)
+	}
+
+	// The Cx interface resolves shared and wildcarded identities
+	service := NewCxService(&config.HSSConfig{DiameterHost: "hss.ims.local", DiameterRealm: "ims.local"}, hssStore, testLogger())
+	ctx := context.Background()
+	if uaa := service.UserAuthorization(ctx, &cx.UAR{UserName: "erin-tablet@ims.local", PublicIdentity: "tel:+15145550020"}); uaa.Result.Err() != nil {
+		t.Errorf("UAA for the second owner of a shared identity Result = %+v", uaa.Result)
+	}
+	if uaa := service.UserAuthorization(ctx, &cx.UAR{UserName: "dave@ims.local", PublicIdentity: "tel:+15145550020"}); uaa.Result != cx.Experimental(cx.ResultErrorIdentitiesDontMatch) {
+		t.Errorf("UAA for a non-owner Result = %+v", uaa.Result)
+	}
+	if lia := service.LocationInfo(ctx, &cx.LIR{PublicIdentity: "sip:conf-7@ims.local"}); lia.Result == cx.Experimental(cx.ResultErrorUserUnknown) {
+		t.Errorf("LIA for a wildcarded PSI Result = %+v", lia.Result)
+	}
+}
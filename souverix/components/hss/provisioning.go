@@ -0,0 +1,186 @@
+package hss
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// subscriptionList is the bulk provisioning document: a sequence of
+// IMSSubscription documents under an IMSSubscriptions root
+type subscriptionList struct {
+	XMLName       xml.Name              `xml:"IMSSubscriptions"`
+	Subscriptions []*cx.IMSSubscription `xml:"IMSSubscription"`
+}
+
+// ImportResult counts the subscribers written by ImportSubscriptions
+type ImportResult struct {
+	Created int
+	Updated int
+}
+
+// ImportSubscriptions reads an IMSSubscription document, or an
+// IMSSubscriptions list of them, and upserts a subscriber for each. Every
+// document is validated, and checked against the public identities of
+// other subscribers, before the whole list is written in one transaction.
+// Authentication data, S-CSCF capabilities and registration state of
+// existing subscribers are kept. check, which may be nil, is given each
+// stored subscriber and its update in the write transaction, and aborts
+// the import by returning an error.
+func ImportSubscriptions(hssStore store.HSSStore, r io.Reader, check store.SubscriberMerger) (*ImportResult, error) {
+	subscriptions, err := ParseSubscriptions(r)
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers := make([]*ims.Subscriber, 0, len(subscriptions))
+	batch := make(map[string]bool)
+	for _, subscription := range subscriptions {
+		batch[subscription.PrivateID] = true
+	}
+	for _, subscription := range subscriptions {
+		sub := DecodeSubscription(subscription)
+		for _, sp := range subscription.ServiceProfiles {
+			for _, id := range sp.PublicIdentities {
+				owner, err := hssStore.GetSubscriberByIMPU(id.Identity)
+				if err == nil && owner.IMPI != sub.IMPI && !batch[owner.IMPI] {
+					return nil, fmt.Errorf("import of %s failed: %w: %s belongs to %s", sub.IMPI, store.ErrIMPUConflict, id.Identity, owner.IMPI)
+				}
+			}
+		}
+		subscribers = append(subscribers, sub)
+	}
+
+	existing := make(map[string]bool)
+	merge := func(old, sub *ims.Subscriber) error {
+		if check != nil {
+			if err := check(old, sub); err != nil {
+				return err
+			}
+		}
+		existing[sub.IMPI] = old != nil
+		if old == nil {
+			return nil
+		}
+		sub.AuthData = old.AuthData
+		sub.Registered = old.Registered
+		sub.Contact = old.Contact
+		sub.SCSCFName = old.SCSCFName
+		sub.SCSCFCapabilities = old.SCSCFCapabilities
+		sub.ServiceProfile.TelephoneNumberRanges = old.ServiceProfile.TelephoneNumberRanges
+		sub.ServiceProfile.RichCallData = old.ServiceProfile.RichCallData
+		return nil
+	}
+	if err := hssStore.UpsertSubscribers(subscribers, merge); err != nil {
+		return nil, fmt.Errorf("import failed: %w", err)
+	}
+
+	result := &ImportResult{}
+	for _, sub := range subscribers {
+		if existing[sub.IMPI] {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+	}
+	return result, nil
+}
+
+// ParseSubscriptions decodes and validates an IMSSubscription document or
+// an IMSSubscriptions list. Private and public identities must be unique
+// across the list.
+func ParseSubscriptions(r io.Reader) ([]*cx.IMSSubscription, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	root, err := rootElement(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []*cx.IMSSubscription
+	switch root {
+	case "IMSSubscription":
+		subscription, err := cx.ParseIMSSubscription(data)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	case "IMSSubscriptions":
+		var list subscriptionList
+		if err := xml.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("invalid IMSSubscriptions: %w", err)
+		}
+		subscriptions = list.Subscriptions
+	default:
+		return nil, fmt.Errorf("unexpected root element %s", root)
+	}
+
+	impis := make(map[string]bool)
+	impus := make(map[string]string)
+	for _, subscription := range subscriptions {
+		if err := subscription.Validate(); err != nil {
+			return nil, err
+		}
+		if impis[subscription.PrivateID] {
+			return nil, fmt.Errorf("IMSSubscription %s listed twice", subscription.PrivateID)
+		}
+		impis[subscription.PrivateID] = true
+		for _, sp := range subscription.ServiceProfiles {
+			for _, id := range sp.PublicIdentities {
+				if owner, ok := impus[id.Identity]; ok {
+					return nil, fmt.Errorf("PublicIdentity %s in both %s and %s", id.Identity, owner, subscription.PrivateID)
+				}
+				impus[id.Identity] = subscription.PrivateID
+			}
+		}
+	}
+	return subscriptions, nil
+}
+
+// ExportSubscriptions writes every subscriber of the store as an
+// IMSSubscriptions list, ordered by private identity
+func ExportSubscriptions(hssStore store.HSSStore, w io.Writer) error {
+	subscribers, err := hssStore.ListSubscribers()
+	if err != nil {
+		return err
+	}
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].IMPI < subscribers[j].IMPI
+	})
+
+	list := subscriptionList{}
+	for _, sub := range subscribers {
+		list.Subscriptions = append(list.Subscriptions, EncodeSubscription(sub))
+	}
+	data, err := xml.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// rootElement returns the local name of the document element
+func rootElement(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("invalid subscription document: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package hss
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// provisionedSubscriber uses every field carried by IMSSubscription
+func provisionedSubscriber() *ims.Subscriber {
+	mediaProfile := 2
+	return &ims.Subscriber{
+		IMPI: "carol@ims.local",
+		IMPU: "sip:carol@ims.local",
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities:         []string{"sip:carol@ims.local", "tel:+15145550003", "sip:carol-!.*!@ims.local"},
+			CoreNetworkServices:      []string{"mmtel", "rcs"},
+			SharedIFCSets:            []int{1, 4},
+			SubscribedMediaProfileID: &mediaProfile,
+			IdentityAttributes: map[string]ims.PublicIdentityAttributes{
+				"tel:+15145550003":         {Barred: true, DisplayName: "Carol", AliasGroup: "A1"},
+				"sip:carol-!.*!@ims.local": {IdentityType: ims.IdentityTypeWildcardedIMPU, Wildcard: "sip:carol-.*@ims.local"},
+			},
+			InitialFilterCriteria: []ims.FilterCriteria{{
+				Priority: 10,
+				Trigger: ims.TriggerPoint{ConditionTypeCNF: "false", SPT: []ims.ServicePointTrigger{
+					{Group: "0", Method: "INVITE"},
+					{Group: "0,1", SessionCase: ims.SessionCaseTerminatingUnregistered},
+					{Group: "1", ConditionNegated: true, Header: "Priority", HeaderContent: "emergency"},
+					{Group: "1", SDPLine: "m", SDPLineContent: "^video"},
+					{Group: "2", RequestURI: "^sip:carol"},
+				}},
+				ApplicationServer:    ims.ApplicationServer{ServerName: "sip:vm.ims.local", DefaultHandling: "SESSION_TERMINATED", ServiceInfo: "vm=1"},
+				ProfilePartIndicator: "UNREGISTERED",
+			}},
+		},
+		AdditionalProfiles: []ims.ServiceProfile{{
+			PublicIdentities: []string{"sip:conference@ims.local"},
+			IdentityAttributes: map[string]ims.PublicIdentityAttributes{
+				"sip:conference@ims.local": {IdentityType: ims.IdentityTypeDistinctPSI},
+			},
+			InitialFilterCriteria: []ims.FilterCriteria{{
+				Priority:          1,
+				ApplicationServer: ims.ApplicationServer{ServerName: "sip:conf.ims.local", DefaultHandling: "SESSION_CONTINUED"},
+			}},
+		}},
+	}
+}
+
+func TestSubscription_RoundTrip(t *testing.T) {
+	sub := provisionedSubscriber()
+
+	data, err := EncodeSubscription(sub).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	subscription, err := cx.ParseIMSSubscription(data)
+	if err != nil {
+		t.Fatalf("ParseIMSSubscription() error = %v", err)
+	}
+	if err := subscription.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	if got := DecodeSubscription(subscription); !reflect.DeepEqual(got, sub) {
+		t.Errorf("DecodeSubscription() = %+v, want %+v", got, sub)
+	}
+}
+
+func TestImportExportSubscriptions(t *testing.T) {
+	hssStore, err := store.NewMemHSSStore(testLogger())
+	if err != nil {
+		t.Fatalf("NewMemHSSStore() error = %v", err)
+	}
+	alice, err := hssStore.GetSubscriber("alice@ims.local")
+	if err != nil {
+		t.Fatalf("GetSubscriber() error = %v", err)
+	}
+
+	// Export the seeded subscriber, add carol, and import the list back
+	var exported bytes.Buffer
+	if err := ExportSubscriptions(hssStore, &exported); err != nil {
+		t.Fatalf("ExportSubscriptions() error = %v", err)
+	}
+	carol, err := EncodeSubscription(provisionedSubscriber()).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	document := strings.Replace(exported.String(), "</IMSSubscriptions>",
+		strings.TrimPrefix(string(carol), `<?xml version="1.0" encoding="UTF-8"?>`+"\n")+"</IMSSubscriptions>", 1)
+
+	result, err := ImportSubscriptions(hssStore, strings.NewReader(document), nil)
+	if err != nil {
+		t.Fatalf("ImportSubscriptions() error = %v", err)
+	}
+	if result.Created != 1 || result.Updated != 1 {
+		t.Errorf("ImportSubscriptions() = %+v, want 1 created and 1 updated", result)
+	}
+
+	got, err := hssStore.GetSubscriber("alice@ims.local")
+	if err != nil || got.AuthData != alice.AuthData || !reflect.DeepEqual(got.ServiceProfile, alice.ServiceProfile) {
+		t.Errorf("alice after import = %+v, %v, want %+v", got, err, alice)
+	}
+	if sub, err := hssStore.GetSubscriberByIMPU("sip:conference@ims.local"); err != nil || sub.IMPI != "carol@ims.local" {
+		t.Errorf("GetSubscriberByIMPU(conference) = %v, %v", sub, err)
+	}
+
+	exported.Reset()
+	if err := ExportSubscriptions(hssStore, &exported); err != nil {
+		t.Fatalf("ExportSubscriptions() error = %v", err)
+	}
+	subscriptions, err := ParseSubscriptions(&exported)
+	if err != nil || len(subscriptions) != 2 || subscriptions[1].PrivateID != "carol@ims.local" {
+		t.Fatalf("ParseSubscriptions(export) = %d, %v", len(subscriptions), err)
+	}
+	if got := DecodeSubscription(subscriptions[1]); !reflect.DeepEqual(got, provisionedSubscriber()) {
+		t.Errorf("exported carol = %+v", got)
+	}
+}
+
+func TestImportSubscriptions_Rejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		wantErr  error
+	}{
+		{
+			name:     "unknown root element",
+			document: `<Subscribers/>`,
+		},
+		{
+			name: "schema violation",
+			document: `<IMSSubscriptions>
+  <IMSSubscription><PrivateID>dave@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:dave@ims.local</Identity></PublicIdentity></ServiceProfile></IMSSubscription>
+  <IMSSubscription><PrivateID>erin@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>erin</Identity></PublicIdentity></ServiceProfile></IMSSubscription>
+</IMSSubscriptions>`,
+		},
+		{
+			name: "identity shared within the list",
+			document: `<IMSSubscriptions>
+  <IMSSubscription><PrivateID>dave@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:dave@ims.local</Identity></PublicIdentity></ServiceProfile></IMSSubscription>
+  <IMSSubscription><PrivateID>erin@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:dave@ims.local</Identity></PublicIdentity></ServiceProfile></IMSSubscription>
+</IMSSubscriptions>`,
+		},
+		{
+			name:     "identity of another subscriber",
+			document: `<IMSSubscription><PrivateID>dave@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:dave@ims.local</Identity></PublicIdentity><PublicIdentity><Identity>sip:alice@ims.local</Identity></PublicIdentity></ServiceProfile></IMSSubscription>`,
+			wantErr:  store.ErrIMPUConflict,
+		},
+		{
+			name: "identity of another subscriber later in the list",
+			document: `<IMSSubscriptions>
+  <IMSSubscription><PrivateID>dave@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:dave@ims.local</Identity></PublicIdentity></ServiceProfile></IMSSubscription>
+  <IMSSubscription><PrivateID>erin@ims.local</PrivateID><ServiceProfile><PublicIdentity><Identity>sip:alice@ims.local</Identity></PublicIdentity></ServiceProfile></IMSSubscription>
+</IMSSubscriptions>`,
+			wantErr: store.ErrIMPUConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hssStore, err := store.NewMemHSSStore(testLogger())
+			if err != nil {
+				t.Fatalf("NewMemHSSStore() error = %v", err)
+			}
+			_, err = ImportSubscriptions(hssStore, strings.NewReader(tt.document), nil)
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Fatalf("ImportSubscriptions() error = %v, want %v", err, tt.wantErr)
+			}
+			if _, err := hssStore.GetSubscriber("dave@ims.local"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("dave written by a rejected import: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package hss
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// subscriptionUserData encodes the Cx User-Data of a subscriber
+func subscriptionUserData(sub *ims.Subscriber) ([]byte, error) {
+	return EncodeSubscription(sub).Marshal()
+}
+
+// EncodeSubscription maps a subscriber to its IMSSubscription. The primary
+// IMPU is the first public identity of the first service profile.
+func EncodeSubscription(sub *ims.Subscriber) *cx.IMSSubscription {
+	subscription := &cx.IMSSubscription{
+		PrivateID:       sub.IMPI,
+		ServiceProfiles: []cx.ServiceProfile{encodeServiceProfile(&sub.ServiceProfile, subscriberIMPUs(sub))},
+	}
+	for i := range sub.AdditionalProfiles {
+		profile := &sub.AdditionalProfiles[i]
+		subscription.ServiceProfiles = append(subscription.ServiceProfiles, encodeServiceProfile(profile, profile.PublicIdentities))
+	}
+	return subscription
+}
+
+// DecodeSubscription maps an IMSSubscription to a subscriber without
+// authentication data. The first service profile becomes the subscriber's
+// ServiceProfile, the others its AdditionalProfiles.
+func DecodeSubscription(subscription *cx.IMSSubscription) *ims.Subscriber {
+	sub := &ims.Subscriber{IMPI: subscription.PrivateID}
+	for i, sp := range subscription.ServiceProfiles {
+		profile := decodeServiceProfile(&sp)
+		if i == 0 {
+			sub.ServiceProfile = profile
+			if len(profile.PublicIdentities) > 0 {
+				sub.IMPU = profile.PublicIdentities[0]
+			}
+			continue
+		}
+		sub.AdditionalProfiles = append(sub.AdditionalProfiles, profile)
+	}
+	return sub
+}
+
+// identityTypes maps the ims identity type names to their Cx values
+var identityTypes = map[string]int{
+	ims.IdentityTypePublicUser:     cx.IdentityTypePublicUser,
+	ims.IdentityTypeDistinctPSI:    cx.IdentityTypeDistinctPSI,
+	ims.IdentityTypeWildcardedPSI:  cx.IdentityTypeWildcardedPSI,
+	ims.IdentityTypeWildcardedIMPU: cx.IdentityTypeWildcardedIMPU,
+}
+
+// encodeServiceProfile encodes profile with the given public identities
+func encodeServiceProfile(profile *ims.ServiceProfile, identities []string) cx.ServiceProfile {
+	out := cx.ServiceProfile{}
+	for _, impu := range identities {
+		out.PublicIdentities = append(out.PublicIdentities, encodePublicIdentity(impu, profile.IdentityAttributes[impu]))
+	}
+
+	if profile.SubscribedMediaProfileID != nil || len(profile.CoreNetworkServices) > 0 {
+		cn := &cx.CoreNetworkServicesAuthorization{SubscribedMediaProfileID: profile.SubscribedMediaProfileID}
+		if len(profile.CoreNetworkServices) > 0 {
+			cn.Extension = &cx.CoreNetworkServicesAuthorizationExtension{ServiceIDs: profile.CoreNetworkServices}
+		}
+		out.CoreNetworkServicesAuthorization = cn
+	}
+	if len(profile.SharedIFCSets) > 0 {
+		out.Extension = &cx.ServiceProfileExtension{SharedIFCSetIDs: profile.SharedIFCSets}
+	}
+
+	for _, fc := range profile.InitialFilterCriteria {
+		ifc := cx.InitialFilterCriteria{
+			Priority: fc.Priority,
+			ApplicationServer: cx.ApplicationServer{
+				ServerName:  fc.ApplicationServer.ServerName,
+				ServiceInfo: fc.ApplicationServer.ServiceInfo,
+			},
+		}
+		if fc.ApplicationServer.DefaultHandling == "SESSION_TERMINATED" {
+			ifc.ApplicationServer.DefaultHandling = cx.SessionTerminated
+		}
+		switch fc.ProfilePartIndicator {
+		case "REGISTERED":
+			indicator := cx.ProfilePartRegistered
+			ifc.ProfilePartIndicator = &indicator
+		case "UNREGISTERED":
+			indicator := cx.ProfilePartUnregistered
+			ifc.ProfilePartIndicator = &indicator
+		}
+
+		if len(fc.Trigger.SPT) > 0 {
+			cnf, _ := strconv.ParseBool(fc.Trigger.ConditionTypeCNF)
+			tp := &cx.TriggerPoint{ConditionTypeCNF: cnf || fc.Trigger.ConditionTypeCNF == "CNF"}
+			for _, spt := range fc.Trigger.SPT {
+				tp.SPT = append(tp.SPT, servicePointTrigger(spt))
+			}
+			ifc.TriggerPoint = tp
+		}
+		out.InitialFilterCriteria = append(out.InitialFilterCriteria, ifc)
+	}
+	return out
+}
+
+// encodePublicIdentity encodes a public identity, adding extensions only
+// for attributes that differ from their defaults
+func encodePublicIdentity(impu string, attrs ims.PublicIdentityAttributes) cx.PublicIdentity {
+	id := cx.PublicIdentity{Identity: impu, BarringIndication: attrs.Barred}
+
+	ext := &cx.PublicIdentityExtension{}
+	if t, ok := identityTypes[attrs.IdentityType]; ok && attrs.IdentityType != ims.IdentityTypePublicUser {
+		ext.IdentityType = &t
+	}
+	wildcardIMPU := ""
+	if attrs.IdentityType == ims.IdentityTypeWildcardedIMPU {
+		wildcardIMPU = attrs.Wildcard
+	} else {
+		ext.WildcardedPSI = attrs.Wildcard
+	}
+	if attrs.DisplayName != "" || attrs.AliasGroup != "" || wildcardIMPU != "" {
+		ext.Extension = &cx.PublicIdentityExtension2{DisplayName: attrs.DisplayName, AliasIdentityGroupID: attrs.AliasGroup}
+		if wildcardIMPU != "" {
+			ext.Extension.Extension = &cx.PublicIdentityExtension3{WildcardedIMPU: wildcardIMPU}
+		}
+	}
+	if ext.IdentityType != nil || ext.WildcardedPSI != "" || ext.Extension != nil {
+		id.Extension = ext
+	}
+	return id
+}
+
+// decodeServiceProfile maps a Cx service profile to the ims model
+func decodeServiceProfile(sp *cx.ServiceProfile) ims.ServiceProfile {
+	profile := ims.ServiceProfile{}
+	for _, id := range sp.PublicIdentities {
+		profile.PublicIdentities = append(profile.PublicIdentities, id.Identity)
+		attrs, ok := decodePublicIdentity(&id)
+		if !ok {
+			continue
+		}
+		if profile.IdentityAttributes == nil {
+			profile.IdentityAttributes = make(map[string]ims.PublicIdentityAttributes)
+		}
+		profile.IdentityAttributes[id.Identity] = attrs
+	}
+
+	if cn := sp.CoreNetworkServicesAuthorization; cn != nil {
+		profile.SubscribedMediaProfileID = cn.SubscribedMediaProfileID
+		if cn.Extension != nil {
+			profile.CoreNetworkServices = cn.Extension.ServiceIDs
+		}
+	}
+	if sp.Extension != nil {
+		profile.SharedIFCSets = sp.Extension.SharedIFCSetIDs
+	}
+
+	for _, ifc := range sp.InitialFilterCriteria {
+		fc := ims.FilterCriteria{
+			Priority: ifc.Priority,
+			ApplicationServer: ims.ApplicationServer{
+				ServerName:      ifc.ApplicationServer.ServerName,
+				DefaultHandling: "SESSION_CONTINUED",
+				ServiceInfo:     ifc.ApplicationServer.ServiceInfo,
+			},
+		}
+		if ifc.ApplicationServer.DefaultHandling == cx.SessionTerminated {
+			fc.ApplicationServer.DefaultHandling = "SESSION_TERMINATED"
+		}
+		if ifc.ProfilePartIndicator != nil {
+			fc.ProfilePartIndicator = "REGISTERED"
+			if *ifc.ProfilePartIndicator == cx.ProfilePartUnregistered {
+				fc.ProfilePartIndicator = "UNREGISTERED"
+			}
+		}
+		if ifc.TriggerPoint != nil {
+			fc.Trigger.ConditionTypeCNF = strconv.FormatBool(ifc.TriggerPoint.ConditionTypeCNF)
+			for _, spt := range ifc.TriggerPoint.SPT {
+				fc.Trigger.SPT = append(fc.Trigger.SPT, decodeServicePointTrigger(spt))
+			}
+		}
+		profile.InitialFilterCriteria = append(profile.InitialFilterCriteria, fc)
+	}
+	return profile
+}
+
+// decodePublicIdentity returns the attributes of a public identity; false
+// means they are all defaults
+func decodePublicIdentity(id *cx.PublicIdentity) (ims.PublicIdentityAttributes, bool) {
+	attrs := ims.PublicIdentityAttributes{Barred: id.BarringIndication}
+	if ext := id.Extension; ext != nil {
+		for name, t := range identityTypes {
+			if t == id.Type() && t != cx.IdentityTypePublicUser {
+				attrs.IdentityType = name
+			}
+		}
+		attrs.Wildcard = ext.WildcardedPSI
+		if ext2 := ext.Extension; ext2 != nil {
+			attrs.DisplayName = ext2.DisplayName
+			attrs.AliasGroup = ext2.AliasIdentityGroupID
+			if ext2.Extension != nil && ext2.Extension.WildcardedIMPU != "" {
+				attrs.Wildcard = ext2.Extension.WildcardedIMPU
+			}
+		}
+	}
+	return attrs, attrs != ims.PublicIdentityAttributes{}
+}
+
+// sessionCases maps the ims session case names to their Cx values
+var sessionCases = map[string]int{
+	ims.SessionCaseOriginating:             cx.SessionCaseOriginating,
+	ims.SessionCaseTerminatingRegistered:   cx.SessionCaseTerminatingRegistered,
+	ims.SessionCaseTerminatingUnregistered: cx.SessionCaseTerminatingUnregistered,
+	ims.SessionCaseOriginatingUnregistered: cx.SessionCaseOriginatingUnregistered,
+	ims.SessionCaseOriginatingCDIV:         cx.SessionCaseOriginatingCDIV,
+}
+
+// servicePointTrigger encodes spt, which carries a single condition
+func servicePointTrigger(spt ims.ServicePointTrigger) cx.SPT {
+	out := cx.SPT{ConditionNegated: spt.ConditionNegated}
+	for _, g := range strings.Split(spt.Group, ",") {
+		group, _ := strconv.Atoi(strings.TrimSpace(g))
+		out.Group = append(out.Group, group)
+	}
+
+	switch {
+	case spt.Method != "":
+		out.Method = spt.Method
+	case spt.RequestURI != "":
+		out.RequestURI = spt.RequestURI
+	case spt.Header != "":
+		out.SIPHeader = &cx.SIPHeader{Header: spt.Header, Content: spt.HeaderContent}
+	case spt.SessionCase != "":
+		if sc, ok := sessionCases[spt.SessionCase]; ok {
+			out.SessionCase = &sc
+		}
+	case spt.SDPLine != "":
+		out.SessionDescription = &cx.SessionDescription{Line: spt.SDPLine, Content: spt.SDPLineContent}
+	}
+	return out
+}
+
+// decodeServicePointTrigger maps a Cx service point trigger to the ims model
+func decodeServicePointTrigger(spt cx.SPT) ims.ServicePointTrigger {
+	groups := make([]string, len(spt.Group))
+	for i, g := range spt.Group {
+		groups[i] = strconv.Itoa(g)
+	}
+	out := ims.ServicePointTrigger{
+		ConditionNegated: spt.ConditionNegated,
+		Group:            strings.Join(groups, ","),
+		Method:           spt.Method,
+		RequestURI:       spt.RequestURI,
+	}
+	if spt.SIPHeader != nil {
+		out.Header, out.HeaderContent = spt.SIPHeader.Header, spt.SIPHeader.Content
+	}
+	if spt.SessionCase != nil {
+		for name, sc := range sessionCases {
+			if sc == *spt.SessionCase {
+				out.SessionCase = name
+			}
+		}
+	}
+	if spt.SessionDescription != nil {
+		out.SDPLine, out.SDPLineContent = spt.SessionDescription.Line, spt.SessionDescription.Content
+	}
+	return out
+}
+
+// subscriberIMPUs returns the primary IMPU followed by the other public
+// identities of the first service profile
+func subscriberIMPUs(sub *ims.Subscriber) []string {
+	impus := []string{}
+	seen := map[string]bool{}
+	for _, impu := range append([]string{sub.IMPU}, sub.ServiceProfile.PublicIdentities...) {
+		if impu != "" && !seen[impu] {
+			seen[impu] = true
+			impus = append(impus, impu)
+		}
+	}
+	return impus
+}
@@ -181,7 +181,16 @@ func NewIBCF(cfg *config.Config, log *logrus.Logger) (*IBCF, error) {
 // initSTIR initializes STIR/SHAKEN for IBCF
 func (i *IBCF) initSTIR(cfg *config.Config) error {
 	// Similar to SBC STIR initialization
-	acmeMgr, err := stir.NewACMECertificateManager(&cfg.ZeroTrust.ACME, i.log)
+	var keys stir.KeyProvider
+	if cfg.ZeroTrust.STIRKey.Source != "" {
+		var err error
+		keys, err = stir.NewKeyProvider(&cfg.ZeroTrust.STIRKey, cfg.ZeroTrust.ACME.KeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to create STIR key provider: %w", err)
+		}
+	}
+
+	acmeMgr, err := stir.NewACMECertificateManagerWithKeys(&cfg.ZeroTrust.ACME, keys, i.log)
 	if err != nil {
 		return fmt.Errorf("failed to create ACME certificate manager: %w", err)
 	}
@@ -194,7 +203,7 @@ func (i *IBCF) initSTIR(cfg *config.Config) error {
 	}
 
 	i.stirSigner = stir.NewSTIRSigner(
-		acmeMgr.GetPrivateKey(),
+		acmeMgr.GetSigner(),
 		acmeMgr.GetCertificateURL(),
 		attestation,
 	)
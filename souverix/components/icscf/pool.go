@@ -0,0 +1,196 @@
+package icscf
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// ErrNoSCSCF is returned when no reachable S-CSCF of the pool supports the
+// mandatory capabilities of a subscriber
+var ErrNoSCSCF = errors.New("no suitable S-CSCF available")
+
+// pooledSCSCF is an S-CSCF of the pool with its selection state
+type pooledSCSCF struct {
+	name         string
+	weight       int
+	capabilities map[uint32]bool
+
+	// current is the smooth weighted round-robin counter
+	current int
+}
+
+// Pool is the set of S-CSCFs the I-CSCF selects from. Among the reachable
+// S-CSCFs supporting every mandatory capability, those supporting the most
+// optional capabilities are preferred, and new assignments are spread over
+// them in proportion to their weights.
+type Pool struct {
+	servers    []*pooledSCSCF
+	retryAfter time.Duration
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu   sync.Mutex
+	down map[string]time.Time // key: S-CSCF host, value: end of the back-off
+}
+
+// NewPool creates the S-CSCF pool configured in cfg
+func NewPool(cfg *config.ICSCFConfig) *Pool {
+	p := &Pool{
+		retryAfter: cfg.RetryAfter,
+		now:        time.Now,
+		down:       make(map[string]time.Time),
+	}
+	if p.retryAfter <= 0 {
+		p.retryAfter = 30 * time.Second
+	}
+	for _, entry := range cfg.SCSCFPool {
+		server := &pooledSCSCF{
+			name:         entry.Name,
+			weight:       max(entry.Weight, 1),
+			capabilities: make(map[uint32]bool),
+		}
+		for _, c := range entry.Capabilities {
+			server.capabilities[c] = true
+		}
+		p.servers = append(p.servers, server)
+	}
+	return p
+}
+
+// Select picks an S-CSCF matching caps, leaving out unreachable ones and
+// those in exclude. When caps names candidate servers that are in the pool,
+// only those are considered.
+func (p *Pool) Select(caps *cx.ServerCapabilities, exclude ...string) (string, error) {
+	if caps == nil {
+		caps = &cx.ServerCapabilities{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []*pooledSCSCF
+	best := -1
+	for _, server := range p.eligible(caps.ServerNames) {
+		if p.isDown(server.name) || containsHost(exclude, server.name) || !server.supports(caps.Mandatory) {
+			continue
+		}
+		score := 0
+		for _, c := range caps.Optional {
+			if server.capabilities[c] {
+				score++
+			}
+		}
+		switch {
+		case score > best:
+			best = score
+			candidates = []*pooledSCSCF{server}
+		case score == best:
+			candidates = append(candidates, server)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoSCSCF
+	}
+
+	// Smooth weighted round-robin over the best candidates
+	total := 0
+	var chosen *pooledSCSCF
+	for _, server := range candidates {
+		server.current += server.weight
+		total += server.weight
+		if chosen == nil || server.current > chosen.current {
+			chosen = server
+		}
+	}
+	chosen.current -= total
+	return chosen.name, nil
+}
+
+// Reachable reports whether name is not backing off after a failure. S-CSCFs
+// outside the pool are reachable until marked otherwise.
+func (p *Pool) Reachable(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.isDown(name)
+}
+
+// MarkUnreachable leaves name out of selection for the retry interval
+func (p *Pool) MarkUnreachable(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[hostOf(name)] = p.now().Add(p.retryAfter)
+}
+
+// MarkReachable returns name to selection, for example after it answered
+// a request or an OPTIONS probe
+func (p *Pool) MarkReachable(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.down, hostOf(name))
+}
+
+// eligible returns the pool members listed in names, or the whole pool when
+// names lists none of them
+func (p *Pool) eligible(names []string) []*pooledSCSCF {
+	var listed []*pooledSCSCF
+	for _, server := range p.servers {
+		if containsHost(names, server.name) {
+			listed = append(listed, server)
+		}
+	}
+	if len(listed) == 0 {
+		return p.servers
+	}
+	return listed
+}
+
+// isDown reports whether name is backing off; p.mu must be held
+func (p *Pool) isDown(name string) bool {
+	host := hostOf(name)
+	until, ok := p.down[host]
+	if ok && !p.now().Before(until) {
+		delete(p.down, host)
+		return false
+	}
+	return ok
+}
+
+// supports reports whether the S-CSCF has every capability in required
+func (s *pooledSCSCF) supports(required []uint32) bool {
+	for _, c := range required {
+		if !s.capabilities[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsHost reports whether names holds a server with the host of name.
+// Server names are SIP URIs or bare host names.
+func containsHost(names []string, name string) bool {
+	host := hostOf(name)
+	for _, n := range names {
+		if hostOf(n) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOf returns the lower-cased host of a Server-Name
+func hostOf(serverName string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(serverName, "sip:"), "sips:")
+	if i := strings.IndexAny(host, ";?>"); i >= 0 {
+		host = host[:i]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,118 @@
+package icscf
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+// testPool has two S-CSCFs supporting capability 1, one of which also
+// supports 2, and one without capabilities
+func testPool() *Pool {
+	return NewPool(&config.ICSCFConfig{
+		SCSCFPool: []config.SCSCFEntry{
+			{Name: "sip:scscf1.ims.local", Weight: 1, Capabilities: []uint32{1}},
+			{Name: "sip:scscf2.ims.local:5060", Weight: 1, Capabilities: []uint32{1, 2}},
+			{Name: "sip:scscf3.ims.local", Weight: 1},
+		},
+		RetryAfter: time.Minute,
+	})
+}
+
+func TestPool_Select(t *testing.T) {
+	tests := []struct {
+		name    string
+		caps    *cx.ServerCapabilities
+		exclude []string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "mandatory capability",
+			caps: &cx.ServerCapabilities{Mandatory: []uint32{2}},
+			want: "sip:scscf2.ims.local:5060",
+		},
+		{
+			name: "optional capability preferred",
+			caps: &cx.ServerCapabilities{Mandatory: []uint32{1}, Optional: []uint32{2, 7}},
+			want: "sip:scscf2.ims.local:5060",
+		},
+		{
+			name:    "excluded S-CSCF",
+			caps:    &cx.ServerCapabilities{Mandatory: []uint32{1}, Optional: []uint32{2}},
+			exclude: []string{"scscf2.ims.local"},
+			want:    "sip:scscf1.ims.local",
+		},
+		{
+			name: "candidate server names",
+			caps: &cx.ServerCapabilities{ServerNames: []string{"scscf3.ims.local", "sip:other.ims.local"}},
+			want: "sip:scscf3.ims.local",
+		},
+		{
+			name:    "unsupported capability",
+			caps:    &cx.ServerCapabilities{Mandatory: []uint32{1, 9}},
+			wantErr: ErrNoSCSCF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testPool().Select(tt.caps, tt.exclude...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Select() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Select() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPool_Weights(t *testing.T) {
+	pool := NewPool(&config.ICSCFConfig{SCSCFPool: []config.SCSCFEntry{
+		{Name: "sip:big.ims.local", Weight: 3},
+		{Name: "sip:small.ims.local", Weight: 1},
+	}})
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		name, err := pool.Select(nil)
+		if err != nil {
+			t.Fatalf("Select() error = %v", err)
+		}
+		counts[name]++
+	}
+	if counts["sip:big.ims.local"] != 6 || counts["sip:small.ims.local"] != 2 {
+		t.Errorf("Select() distribution = %v, want 6:2", counts)
+	}
+}
+
+func TestPool_Reachability(t *testing.T) {
+	pool := testPool()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	caps := &cx.ServerCapabilities{Mandatory: []uint32{1}}
+
+	pool.MarkUnreachable("sip:scscf1.ims.local")
+	pool.MarkUnreachable("scscf2.ims.local")
+	if pool.Reachable("sip:scscf2.ims.local;transport=tcp") {
+		t.Error("Reachable() = true for an S-CSCF marked unreachable")
+	}
+	if _, err := pool.Select(caps); !errors.Is(err, ErrNoSCSCF) {
+		t.Errorf("Select() with both S-CSCFs down error = %v", err)
+	}
+
+	pool.MarkReachable("sip:scscf2.ims.local")
+	if got, err := pool.Select(caps); err != nil || got != "sip:scscf2.ims.local:5060" {
+		t.Errorf("Select() after recovery = %q, %v", got, err)
+	}
+
+	// The back-off ends after the retry interval
+	now = now.Add(time.Minute)
+	if !pool.Reachable("sip:scscf1.ims.local") {
+		t.Error("Reachable() = false after the retry interval")
+	}
+}
@@ -0,0 +1,181 @@
+// Package icscf implements S-CSCF selection for the Interrogating-CSCF
+// (3GPP TS 24.229 section 5.3, TS 29.228 section 6.1)
+package icscf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/hss"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/sirupsen/logrus"
+)
+
+// HSS is the Cx client used by the I-CSCF, normally a *cx.Client
+type HSS interface {
+	UserAuthorization(ctx context.Context, req *cx.UAR) (*cx.UAA, error)
+	LocationInfo(ctx context.Context, req *cx.LIR) (*cx.LIA, error)
+}
+
+// Selector chooses the S-CSCF that REGISTER and terminating requests are
+// forwarded to. The assignment of a subscriber is kept in the HSSStore, so
+// every I-CSCF sends it to the same S-CSCF until that S-CSCF fails.
+type Selector struct {
+	hss   HSS
+	store store.HSSStore
+	pool  *Pool
+	log   *logrus.Logger
+}
+
+// NewSelector creates the S-CSCF selector of the I-CSCF configured in cfg
+func NewSelector(cfg *config.Config, hss HSS, hssStore store.HSSStore, log *logrus.Logger) *Selector {
+	return &Selector{
+		hss:   hss,
+		store: hssStore,
+		pool:  NewPool(&cfg.IMS.ICSCF),
+		log:   log,
+	}
+}
+
+// Pool returns the S-CSCF pool, whose reachability the SIP transaction
+// layer reports
+func (s *Selector) Pool() *Pool {
+	return s.pool
+}
+
+// SelectForRegister returns the S-CSCF a REGISTER of impu by impi is
+// forwarded to (TS 24.229 section 5.3.1.2). An assigned S-CSCF is kept
+// while it is reachable.
+func (s *Selector) SelectForRegister(ctx context.Context, impi, impu string) (string, error) {
+	uaa, err := s.userAuthorization(ctx, impi, impu, cx.AuthorizationRegistration)
+	if err != nil {
+		return "", err
+	}
+	if uaa.ServerName != "" && s.pool.Reachable(uaa.ServerName) {
+		return uaa.ServerName, nil
+	}
+
+	caps := uaa.ServerCapabilities
+	if uaa.ServerName != "" {
+		// The assigned S-CSCF is down: ask for the capabilities needed to
+		// select another one
+		s.log.WithFields(logrus.Fields{"impi": impi, "scscf": uaa.ServerName}).Warn("assigned S-CSCF unreachable, reselecting")
+		if caps, err = s.capabilities(ctx, impi, impu); err != nil {
+			return "", err
+		}
+	}
+	return s.assign(impi, caps)
+}
+
+// Failover selects another S-CSCF after failed did not answer a REGISTER
+// forwarded to it (TS 24.229 section 5.3.1.3). failed is left out of
+// selection for the retry interval.
+func (s *Selector) Failover(ctx context.Context, impi, impu, failed string) (string, error) {
+	s.pool.MarkUnreachable(failed)
+	s.log.WithFields(logrus.Fields{"impi": impi, "scscf": failed}).Warn("S-CSCF did not respond, failing over")
+
+	caps, err := s.capabilities(ctx, impi, impu)
+	if err != nil {
+		return "", err
+	}
+	return s.assign(impi, caps)
+}
+
+// SelectForRequest returns the S-CSCF a request terminating at impu is
+// forwarded to (TS 24.229 section 5.3.2). Unregistered identities with
+// services get an S-CSCF assigned.
+func (s *Selector) SelectForRequest(ctx context.Context, impu string) (string, error) {
+	lia, err := s.locationInfo(ctx, impu, cx.AuthorizationRegistration)
+	if err != nil {
+		return "", err
+	}
+	if lia.ServerName != "" && s.pool.Reachable(lia.ServerName) {
+		return lia.ServerName, nil
+	}
+
+	caps := lia.ServerCapabilities
+	if lia.ServerName != "" {
+		if lia, err = s.locationInfo(ctx, impu, cx.AuthorizationRegistrationAndCapabilities); err != nil {
+			return "", err
+		}
+		caps = lia.ServerCapabilities
+	}
+	// A shared identity is served through its first owner
+	owners, _, err := hss.LookupIMPU(s.store, impu)
+	if err != nil {
+		return "", err
+	}
+	return s.assign(owners[0].IMPI, caps)
+}
+
+// assign keeps the stored S-CSCF of impi while it is reachable, and
+// otherwise stores a new S-CSCF selected from the pool. Selection advances
+// the pool's round-robin, so it runs once, before the store callback that
+// a concurrent assignment may make the store retry.
+func (s *Selector) assign(impi string, caps *cx.ServerCapabilities) (string, error) {
+	sub, err := s.store.GetSubscriber(impi)
+	if err != nil {
+		return "", fmt.Errorf("S-CSCF selection for %s failed: %w", impi, err)
+	}
+	var selectErr error
+	candidate := sub.SCSCFName
+	if candidate == "" || !s.pool.Reachable(candidate) {
+		candidate, selectErr = s.pool.Select(caps, sub.SCSCFName)
+	}
+
+	assigned, err := s.store.AssignSCSCF(impi, func(current string) (string, error) {
+		if current != "" && s.pool.Reachable(current) {
+			return current, nil
+		}
+		return candidate, selectErr
+	})
+	if err != nil {
+		return "", fmt.Errorf("S-CSCF selection for %s failed: %w", impi, err)
+	}
+	return assigned, nil
+}
+
+// capabilities asks the HSS for the Server-Capabilities of a subscriber
+func (s *Selector) capabilities(ctx context.Context, impi, impu string) (*cx.ServerCapabilities, error) {
+	uaa, err := s.userAuthorization(ctx, impi, impu, cx.AuthorizationRegistrationAndCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	return uaa.ServerCapabilities, nil
+}
+
+// userAuthorization sends a UAR and checks its result
+func (s *Selector) userAuthorization(ctx context.Context, impi, impu string, authorizationType uint32) (*cx.UAA, error) {
+	uaa, err := s.hss.UserAuthorization(ctx, &cx.UAR{
+		UserName:          impi,
+		PublicIdentity:    impu,
+		AuthorizationType: authorizationType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("UAR failed: %w", err)
+	}
+	if err := uaa.Result.Err(); err != nil {
+		return nil, fmt.Errorf("user authorization rejected for %s: %w", impu, err)
+	}
+	return uaa, nil
+}
+
+// locationInfo sends a LIR and checks its result
+func (s *Selector) locationInfo(ctx context.Context, impu string, authorizationType uint32) (*cx.LIA, error) {
+	lia, err := s.hss.LocationInfo(ctx, &cx.LIR{
+		PublicIdentity:    impu,
+		AuthorizationType: authorizationType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("LIR failed: %w", err)
+	}
+	if err := lia.Result.Err(); err != nil {
+		return nil, fmt.Errorf("location info rejected for %s: %w", impu, err)
+	}
+	if lia.ServerName == "" && lia.ServerCapabilities == nil {
+		return nil, fmt.Errorf("no S-CSCF for %s: %w", impu, store.ErrNotFound)
+	}
+	return lia, nil
+}
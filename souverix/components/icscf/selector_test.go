@@ -0,0 +1,170 @@
+package icscf
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/hss"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return log
+}
+
+// cxService adapts the HSS Cx service to the client interface
+type cxService struct {
+	*hss.CxService
+}
+
+func (c cxService) UserAuthorization(ctx context.Context, req *cx.UAR) (*cx.UAA, error) {
+	return c.CxService.UserAuthorization(ctx, req), nil
+}
+
+func (c cxService) LocationInfo(ctx context.Context, req *cx.LIR) (*cx.LIA, error) {
+	return c.CxService.LocationInfo(ctx, req), nil
+}
+
+// newTestSelector selects from testPool for subscribers of a memory HSS.
+// carol requires capability 1.
+func newTestSelector(t *testing.T) (*Selector, store.HSSStore) {
+	t.Helper()
+	hssStore, err := store.NewMemHSSStore(testLogger())
+	if err != nil {
+		t.Fatalf("NewMemHSSStore() error = %v", err)
+	}
+	err = hssStore.UpsertSubscriber(&ims.Subscriber{
+		IMPI:              "carol@ims.local",
+		IMPU:              "sip:carol@ims.local",
+		SCSCFCapabilities: ims.SCSCFCapabilities{Mandatory: []uint32{1}},
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities: []string{"sip:carol@ims.local"},
+			InitialFilterCriteria: []ims.FilterCriteria{{
+				Priority:          1,
+				ApplicationServer: ims.ApplicationServer{ServerName: "sip:vm.ims.local", DefaultHandling: "SESSION_CONTINUED"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpsertSubscriber() error = %v", err)
+	}
+
+	service := hss.NewCxService(&config.HSSConfig{DiameterHost: "hss.ims.local", DiameterRealm: "ims.local"}, hssStore, testLogger())
+	selector := NewSelector(&config.Config{}, cxService{service}, hssStore, testLogger())
+	selector.pool = testPool()
+	return selector, hssStore
+}
+
+func TestSelector_Failover(t *testing.T) {
+	selector, hssStore := newTestSelector(t)
+	ctx := context.Background()
+	now := time.Now()
+	selector.pool.now = func() time.Time { return now }
+
+	first, err := selector.SelectForRegister(ctx, "carol@ims.local", "sip:carol@ims.local")
+	if err != nil || first == "sip:scscf3.ims.local" {
+		t.Fatalf("SelectForRegister() = %q, %v", first, err)
+	}
+
+	// A retried REGISTER lands on the same S-CSCF
+	for i := 0; i < 3; i++ {
+		if got, err := selector.SelectForRegister(ctx, "carol@ims.local", "sip:carol@ims.local"); err != nil || got != first {
+			t.Fatalf("SelectForRegister() retry = %q, %v, want %q", got, err, first)
+		}
+	}
+
+	second, err := selector.Failover(ctx, "carol@ims.local", "sip:carol@ims.local", first)
+	if err != nil || second == first || second == "sip:scscf3.ims.local" {
+		t.Fatalf("Failover() = %q, %v", second, err)
+	}
+	if stored, _ := hssStore.GetSCSCFForSubscriber("carol@ims.local"); stored != second {
+		t.Errorf("stored S-CSCF = %q, want %q", stored, second)
+	}
+	if got, err := selector.SelectForRegister(ctx, "carol@ims.local", "sip:carol@ims.local"); err != nil || got != second {
+		t.Errorf("SelectForRegister() after failover = %q, %v, want %q", got, err, second)
+	}
+
+	// The S-CSCF without capability 1 is never used
+	selector.pool.MarkUnreachable(second)
+	if _, err := selector.SelectForRegister(ctx, "carol@ims.local", "sip:carol@ims.local"); !errors.Is(err, ErrNoSCSCF) {
+		t.Errorf("SelectForRegister() with no suitable S-CSCF error = %v, want ErrNoSCSCF", err)
+	}
+	if stored, _ := hssStore.GetSCSCFForSubscriber("carol@ims.local"); stored != second {
+		t.Errorf("failed selection changed the stored S-CSCF to %q", stored)
+	}
+
+	// Once the first S-CSCF's back-off ends it takes over
+	now = now.Add(time.Minute)
+	selector.pool.MarkUnreachable(second)
+	if got, err := selector.SelectForRegister(ctx, "carol@ims.local", "sip:carol@ims.local"); err != nil || got != first {
+		t.Errorf("SelectForRegister() after recovery = %q, %v, want %q", got, err, first)
+	}
+}
+
+func TestSelector_SelectForRequest(t *testing.T) {
+	selector, hssStore := newTestSelector(t)
+	ctx := context.Background()
+
+	// Unregistered identities with services are assigned an S-CSCF
+	got, err := selector.SelectForRequest(ctx, "sip:carol@ims.local")
+	if err != nil || got == "sip:scscf3.ims.local" {
+		t.Fatalf("SelectForRequest(carol) = %q, %v", got, err)
+	}
+	if stored, _ := hssStore.GetSCSCFForSubscriber("carol@ims.local"); stored != got {
+		t.Errorf("stored S-CSCF = %q, want %q", stored, got)
+	}
+
+	// Terminating requests follow the failover of the assigned S-CSCF
+	selector.pool.MarkUnreachable(got)
+	next, err := selector.SelectForRequest(ctx, "sip:carol@ims.local")
+	if err != nil || next == got {
+		t.Errorf("SelectForRequest() after failure = %q, %v", next, err)
+	}
+
+	// alice has no services while unregistered
+	if _, err := selector.SelectForRequest(ctx, "sip:alice@ims.local"); err == nil {
+		t.Error("SelectForRequest(unregistered alice) succeeded")
+	}
+	if _, err := selector.SelectForRegister(ctx, "nobody@ims.local", "sip:nobody@ims.local"); err == nil {
+		t.Error("SelectForRegister(unknown) succeeded")
+	}
+}
+
+// retryingStore runs every S-CSCF selector twice, as a store retrying a
+// conflicting transaction does
+type retryingStore struct {
+	store.HSSStore
+}
+
+func (s retryingStore) AssignSCSCF(impi string, selectSCSCF store.SCSCFSelector) (string, error) {
+	return s.HSSStore.AssignSCSCF(impi, func(current string) (string, error) {
+		selectSCSCF(current)
+		return selectSCSCF(current)
+	})
+}
+
+func TestSelector_AssignRetried(t *testing.T) {
+	selector, hssStore := newTestSelector(t)
+	selector.store = retryingStore{hssStore}
+
+	// Store retries do not advance the round-robin
+	reference := testPool()
+	for _, name := range []string{"dave", "erin", "frank"} {
+		impi := name + "@ims.local"
+		if err := hssStore.UpsertSubscriber(&ims.Subscriber{IMPI: impi, IMPU: "sip:" + impi}); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+		want, _ := reference.Select(nil)
+		if got, err := selector.assign(impi, nil); err != nil || got != want {
+			t.Errorf("assign(%s) = %q, %v, want %q", impi, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package pcscf
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dasmlab/ims/internal/charging"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/sirupsen/logrus"
+)
+
+// creditExhaustedReason is the Reason of the BYEs of a session whose credit
+// ran out
+const creditExhaustedReason = `SIP;cause=402;text="Credit limit reached"`
+
+// SetCharging makes the P-CSCF charge the sessions and requests of its UEs
+// with charger, whose Run the caller starts. The sessions whose credit runs
+// out are ended with BYEs sent through sender, which may be nil to only
+// stop charging them.
+func (h *Handler) SetCharging(charger *charging.Charger, sender RequestSender) {
+	h.mu.Lock()
+	h.charger = charger
+	h.sender = sender
+	h.mu.Unlock()
+	charger.SetTerminateHandler(h.creditExhausted)
+}
+
+// chargingHost returns the host the P-CSCF generates ICIDs at
+func (h *Handler) chargingHost(msg *sip.Message) string {
+	if h.cfg.Address != "" {
+		return h.cfg.Address
+	}
+	if ip, _ := splitAddr(msg.LocalAddr); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// chargeRequest passes a request of the UE, or of the core towards it, to
+// the charger. It returns the response rejecting an INVITE that gets no
+// credit.
+func (h *Handler) chargeRequest(ctx context.Context, msg *sip.Message, fromUE bool) *sip.Message {
+	h.mu.Lock()
+	charger := h.charger
+	h.mu.Unlock()
+	if charger == nil {
+		return nil
+	}
+
+	err := charger.Request(ctx, msg, fromUE)
+	if err == nil {
+		return nil
+	}
+	h.log.WithError(err).WithField("call-id", msg.GetHeader("Call-ID")).Warn("session not authorized by online charging")
+	if errors.Is(err, charging.ErrNoCredit) {
+		return newResponse(msg, sip.StatusPaymentRequired, "Payment Required")
+	}
+	return newResponse(msg, sip.StatusServiceUnavailable, "Service Unavailable")
+}
+
+// chargeResponse passes a response to a request of the UE, or of the core
+// towards it, to the charger
+func (h *Handler) chargeResponse(ctx context.Context, msg *sip.Message) {
+	h.mu.Lock()
+	charger := h.charger
+	h.mu.Unlock()
+	if charger != nil {
+		charger.Response(ctx, msg)
+	}
+}
+
+// creditExhausted releases a session whose credit ran out: its media, and
+// its dialog with a BYE to the UE and one to the core
+func (h *Handler) creditExhausted(callID string) {
+	h.mu.Lock()
+	s := h.sessions[callID]
+	h.mu.Unlock()
+	if s == nil {
+		return
+	}
+	h.log.WithFields(logrus.Fields{"call-id": callID, "identity": s.Identity}).Info("session ended by online charging")
+	h.releaseMedia(context.Background(), s)
+	h.endDialog(s, creditExhaustedReason)
+}
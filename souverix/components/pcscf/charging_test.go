@@ -0,0 +1,115 @@
+package pcscf
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/charging"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/ro"
+)
+
+// fakeOCS answers every CCR-I and CCR-U with cca
+type fakeOCS struct {
+	mu   sync.Mutex
+	cca  ro.CCA
+	ccrs []*ro.CCR
+}
+
+func (f *fakeOCS) CreditControl(ctx context.Context, req *ro.CCR) (*ro.CCA, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ccrs = append(f.ccrs, req)
+	cca := f.cca
+	cca.SessionID = "ocs;1"
+	if req.RequestType == ro.RequestTermination {
+		cca = ro.CCA{SessionID: req.SessionID, Result: ro.Success}
+	}
+	return &cca, nil
+}
+
+func (f *fakeOCS) RequestTypes() []uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var types []uint32
+	for _, ccr := range f.ccrs {
+		types = append(types, ccr.RequestType)
+	}
+	return types
+}
+
+func chargingHandler(ocs *fakeOCS) (*Handler, *charging.Charger, *charging.Stub, *fakeSender) {
+	h, _ := testHandler(false)
+	stub := charging.NewStub(time.Minute)
+	charger := charging.NewCharger(charging.NodePCSCF, "pcscf.ims.local", 0, stub, ocs, testLogger())
+	sender := &fakeSender{}
+	h.SetCharging(charger, sender)
+	return h, charger, stub, sender
+}
+
+func TestHandler_ChargingNoCredit(t *testing.T) {
+	ocs := &fakeOCS{cca: ro.CCA{Result: diameter.Result{Code: ro.ResultCreditLimitReached}}}
+	h, charger, _, _ := chargingHandler(ocs)
+
+	_, response := h.HandleRequest(context.Background(), ueInvite("call-1"))
+	if response == nil || response.StatusCode != sip.StatusPaymentRequired {
+		t.Fatalf("INVITE without credit answered with %v, want 402", response)
+	}
+	if charger.Sessions() != 0 || len(h.sessions) != 0 {
+		t.Errorf("sessions kept for a rejected INVITE")
+	}
+}
+
+func TestHandler_ChargingCreditExhausted(t *testing.T) {
+	ocs := &fakeOCS{cca: ro.CCA{Result: ro.Success, GrantedTime: 20 * time.Millisecond, FinalUnit: true}}
+	h, charger, stub, sender := chargingHandler(ocs)
+	ctx := context.Background()
+
+	forward, response := h.HandleRequest(ctx, ueInvite("call-1"))
+	if response != nil {
+		t.Fatalf("INVITE rejected with %d", response.StatusCode)
+	}
+	icid := sip.GetChargingVector(forward)
+	if icid == nil {
+		t.Fatal("INVITE forwarded without P-Charging-Vector")
+	}
+	ok := answered(forward)
+	ok.SetHeader("P-Charging-Vector", icid.String()+";term-ioi=other.net")
+	if toUE := h.HandleResponse(ctx, ok); toUE.GetHeader("P-Charging-Vector") != "" {
+		t.Error("P-Charging-Vector sent to the UE")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	charger.Expire(ctx)
+
+	byes := sender.Sent()
+	if len(byes) != 2 {
+		t.Fatalf("sent %d BYEs, want 2", len(byes))
+	}
+	for _, bye := range byes {
+		if bye.Method != sip.MethodBYE || !strings.Contains(bye.GetHeader("Reason"), "cause=402") {
+			t.Errorf("BYE = %s %v", bye.Method, bye.Headers)
+		}
+	}
+	if byes[0].URI != "sip:alice@10.0.0.2:5060" {
+		t.Errorf("first BYE to %s, want the UE", byes[0].URI)
+	}
+	if types := ocs.RequestTypes(); len(types) != 2 || types[0] != ro.RequestInitial || types[1] != ro.RequestTermination {
+		t.Errorf("CCR types = %v", types)
+	}
+
+	records := stub.Records()
+	if len(records) != 2 || records[0].Type != charging.RecordStart || records[1].Type != charging.RecordStop {
+		t.Fatalf("records = %+v", records)
+	}
+	if r := records[1]; r.ICID != icid.ICID || r.TermIOI != "other.net" || !r.Originating || r.CalledParty != "sip:bob@ims.local" {
+		t.Errorf("Stop record = %+v", r)
+	}
+	if charger.Sessions() != 0 || len(h.sessions) != 0 {
+		t.Errorf("sessions kept after the credit ran out")
+	}
+}
@@ -0,0 +1,84 @@
+package pcscf
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rx"
+)
+
+// FakePCRF is an in-memory PCRF for tests and lab setups. It implements
+// rx.PCRF, to be served with rx.Handler, and authorizes every session
+// unless told to reject them.
+type FakePCRF struct {
+	mu         sync.Mutex
+	reject     diameter.Result
+	sessions   map[string]*rx.AAR // key: Session-Id, value: last AAR
+	terminated []string
+}
+
+// NewFakePCRF creates a PCRF that authorizes every session
+func NewFakePCRF() *FakePCRF {
+	return &FakePCRF{sessions: make(map[string]*rx.AAR)}
+}
+
+// Reject makes the PCRF answer the next AARs with result; a successful
+// result authorizes them again
+func (f *FakePCRF) Reject(result diameter.Result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reject = result
+}
+
+// AA implements rx.PCRF
+func (f *FakePCRF) AA(ctx context.Context, req *rx.AAR) *rx.AAA {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reject.Code != 0 && !f.reject.Success() {
+		return &rx.AAA{Result: f.reject}
+	}
+	if _, ok := f.sessions[req.SessionID]; !ok && req.RequestType == rx.RequestUpdate {
+		return &rx.AAA{Result: diameter.Result{Code: diameter.ResultUnknownSessionID}}
+	}
+	f.sessions[req.SessionID] = req
+	return &rx.AAA{Result: rx.Success}
+}
+
+// SessionTermination implements rx.PCRF
+func (f *FakePCRF) SessionTermination(ctx context.Context, req *rx.STR) *rx.STA {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sessions[req.SessionID]; !ok {
+		return &rx.STA{Result: diameter.Result{Code: diameter.ResultUnknownSessionID}}
+	}
+	delete(f.sessions, req.SessionID)
+	f.terminated = append(f.terminated, req.SessionID)
+	return &rx.STA{Result: rx.Success}
+}
+
+// Session returns the last AAR of an active session
+func (f *FakePCRF) Session(id string) (*rx.AAR, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req, ok := f.sessions[id]
+	return req, ok
+}
+
+// Sessions returns the Session-Ids of the active sessions
+func (f *FakePCRF) Sessions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.sessions))
+	for id := range f.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Terminated returns the Session-Ids of the sessions ended by a STR, in order
+func (f *FakePCRF) Terminated() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.terminated...)
+}
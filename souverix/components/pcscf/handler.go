@@ -0,0 +1,676 @@
+// Package pcscf implements the security functions of the Proxy-CSCF: the
+// sec-agree negotiation of RFC 3329, the IPsec security associations of
+// 3GPP TS 33.203, set up with the IMS AKA keys of each registration
+// (TS 24.229 section 5.2.2), and the assertion of the UE's identity to the
+// trust domain (TS 24.229 section 5.2.6.3). It also reserves the bearers of
+// the media of sessions through policy control, over Rx or N5 (TS 24.229
+// section 5.2.7), and charges the sessions of its UEs.
+package pcscf
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/charging"
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/sirupsen/logrus"
+)
+
+// expiryInterval is how often expired security associations are removed
+const expiryInterval = 5 * time.Second
+
+// statusSecurityAgreementRequired is the 494 response of RFC 3329
+const statusSecurityAgreementRequired = 494
+
+// registrationGrace keeps security associations past the registration
+// expiry, for the re-REGISTER that refreshes it
+const registrationGrace = 30 * time.Second
+
+// akaKeyParam matches the ck and ik parameters the S-CSCF adds to an IMS
+// AKA challenge for the P-CSCF
+var akaKeyParam = regexp.MustCompile(`(?i),?\s*\b(ck|ik)\s*=\s*"?([0-9a-f]*)"?`)
+
+// offer is a Security-Client awaiting the challenge of its REGISTER
+type offer struct {
+	ue      net.IP
+	pcscf   net.IP
+	client  SecurityMechanism // Mechanism chosen from the Security-Client
+	expires time.Time
+}
+
+// agreement is a security agreement with a UE and its IPsec SAs
+type agreement struct {
+	server      SecurityMechanism // Security-Server sent to the UE
+	sa          *SecurityAssociation
+	established bool // A registration succeeded over it
+}
+
+// Handler is the P-CSCF. It negotiates a security agreement on the initial
+// REGISTER of a UE, installs IPsec SAs with the keys of the IMS AKA
+// challenge and only accepts later requests of the UE over them.
+type Handler struct {
+	cfg config.PCSCFConfig
+	sas SAManager
+	log *logrus.Logger
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu          sync.Mutex
+	offers      map[string]*offer        // key: Call-ID of the REGISTER
+	agreements  map[string][]*agreement  // key: UE IP address
+	registering map[string]*agreement    // key: Call-ID of a protected REGISTER
+	registers   map[string]string        // key: Call-ID of a REGISTER, value: UE transport address
+	identities  map[string]*registration // key: UE transport address
+	pending     map[uint32]bool          // SPIs of SAs being installed or removed
+
+	// Policy control of the media bearers and charging, when set
+	policy   Policy
+	charger  *charging.Charger
+	sender   RequestSender
+	sessions map[string]*MediaSession // key: Call-ID
+}
+
+// NewHandler creates the P-CSCF configured in cfg, installing SAs with sas
+func NewHandler(cfg *config.Config, sas SAManager, log *logrus.Logger) *Handler {
+	pcscfCfg := cfg.IMS.PCSCF
+	if pcscfCfg.ProtectedPortC <= 0 {
+		pcscfCfg.ProtectedPortC = 5100
+	}
+	if pcscfCfg.ProtectedPortS <= 0 {
+		pcscfCfg.ProtectedPortS = 5101
+	}
+	if len(pcscfCfg.IntegrityAlgorithms) == 0 {
+		pcscfCfg.IntegrityAlgorithms = []string{AlgHMACSHA196, AlgHMACMD596}
+	}
+	if len(pcscfCfg.EncryptionAlgorithms) == 0 {
+		pcscfCfg.EncryptionAlgorithms = []string{EAlgAESCBC, EAlgDESEDE3CBC, EAlgNull}
+	}
+	if pcscfCfg.TemporarySALifetime <= 0 {
+		pcscfCfg.TemporarySALifetime = 240 * time.Second
+	}
+
+	return &Handler{
+		cfg:         pcscfCfg,
+		sas:         sas,
+		log:         log,
+		now:         time.Now,
+		offers:      make(map[string]*offer),
+		agreements:  make(map[string][]*agreement),
+		registering: make(map[string]*agreement),
+		registers:   make(map[string]string),
+		identities:  make(map[string]*registration),
+		pending:     make(map[uint32]bool),
+		sessions:    make(map[string]*MediaSession),
+	}
+}
+
+// HandleRequest processes a request from a UE. It returns the request to
+// forward towards the core, or the response that rejects it.
+func (h *Handler) HandleRequest(ctx context.Context, msg *sip.Message) (*sip.Message, *sip.Message) {
+	if msg.GetHeader("From") == "" || msg.GetHeader("To") == "" || msg.GetHeader("Call-ID") == "" {
+		return nil, newResponse(msg, sip.StatusBadRequest, "Bad Request")
+	}
+	if msg.Method == sip.MethodREGISTER {
+		return h.register(msg)
+	}
+
+	ue, _ := splitAddr(msg.RemoteAddr)
+	h.mu.Lock()
+	a := h.protectedBy(msg)
+	known := len(h.agreements[ue.String()]) > 0
+	h.mu.Unlock()
+
+	// Only REGISTER may use SAs that no registration succeeded over yet
+	// (TS 33.203 section 7.4)
+	if a != nil && !a.established {
+		a = nil
+	}
+	if a == nil && (h.cfg.RequireSecAgree || known) {
+		h.log.WithFields(logrus.Fields{"method": msg.Method, "remote": msg.RemoteAddr, "local": msg.LocalAddr}).Warn("request outside the security agreement")
+		return nil, newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+	h.assertIdentity(msg)
+	sip.EnsureChargingVector(msg, h.chargingHost(msg))
+	if response := h.chargeRequest(ctx, msg, true); response != nil {
+		return nil, response
+	}
+	if response := h.mediaRequest(ctx, msg, true); response != nil {
+		h.chargeResponse(ctx, response)
+		return nil, response
+	}
+	return msg, nil
+}
+
+// HandleINVITE processes an INVITE from a UE
+func (h *Handler) HandleINVITE(ctx context.Context, msg *sip.Message) (*sip.Message, *sip.Message) {
+	return h.HandleRequest(ctx, msg)
+}
+
+// register negotiates the security agreement of a REGISTER (TS 24.229
+// section 5.2.2.1 and 5.2.2.4)
+func (h *Handler) register(msg *sip.Message) (*sip.Message, *sip.Message) {
+	client, err := ParseSecurityMechanisms(msg.GetHeaderAll(HeaderSecurityClient))
+	if err != nil {
+		h.log.WithError(err).Warn("invalid Security-Client")
+		return nil, newResponse(msg, sip.StatusBadRequest, "Bad Request")
+	}
+	callID := msg.GetHeader("Call-ID")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	protected := h.protectedBy(msg)
+	if protected == nil && h.onProtectedPort(msg) {
+		h.log.WithField("remote", msg.RemoteAddr).Warn("REGISTER on a protected port without security association")
+		return nil, newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+	if protected != nil {
+		verify, err := ParseSecurityMechanisms(msg.GetHeaderAll(HeaderSecurityVerify))
+		if err != nil || !containsMechanism(verify, protected.server) {
+			h.log.WithField("remote", msg.RemoteAddr).Warn("Security-Verify does not match the Security-Server sent")
+			return nil, newResponse(msg, sip.StatusForbidden, "Forbidden")
+		}
+		h.registering[callID] = protected
+	}
+
+	// Every REGISTER of the UE offers a Security-Client, from which a new
+	// agreement is set up when it is challenged
+	chosen, ok := h.choose(client)
+	switch {
+	case ok:
+		ue, _ := splitAddr(msg.RemoteAddr)
+		pcscf := net.ParseIP(h.cfg.Address)
+		if pcscf == nil {
+			pcscf, _ = splitAddr(msg.LocalAddr)
+		}
+		if ue == nil || pcscf == nil {
+			h.log.WithFields(logrus.Fields{"remote": msg.RemoteAddr, "local": msg.LocalAddr}).Error("REGISTER without transport addresses")
+			return nil, newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+		}
+		h.offers[callID] = &offer{ue: ue, pcscf: pcscf, client: chosen, expires: h.now().Add(h.cfg.TemporarySALifetime)}
+	case protected != nil || !h.cfg.RequireSecAgree:
+	case len(client) > 0:
+		return nil, newResponse(msg, statusSecurityAgreementRequired, "Security Agreement Required")
+	default:
+		response := newResponse(msg, sip.StatusExtensionRequired, "Extension Required")
+		response.SetHeader("Require", OptionSecAgree)
+		return nil, response
+	}
+
+	forward := *msg
+	forward.Headers = make(map[string][]string, len(msg.Headers))
+	for name, values := range msg.Headers {
+		forward.Headers[name] = append([]string(nil), values...)
+	}
+	stripSecAgree(&forward)
+	setIntegrityProtected(&forward, protected != nil)
+	policeUE(&forward)
+	h.registers[callID] = msg.RemoteAddr
+	return &forward, nil
+}
+
+// HandleResponse processes a response from the core towards a UE and returns
+// the response to send to it. The challenge of a REGISTER sets up the SAs
+// of the agreement and its 200 OK establishes them; the SDP answer of a
+// session updates the authorization of its media.
+func (h *Handler) HandleResponse(ctx context.Context, msg *sip.Message) *sip.Message {
+	h.chargeResponse(ctx, msg)
+	// The UE is outside the trust domain
+	sip.Egress(msg)
+	if _, method, _ := strings.Cut(msg.GetHeader("CSeq"), " "); !strings.EqualFold(strings.TrimSpace(method), sip.MethodREGISTER) {
+		h.mediaResponse(ctx, msg, false)
+		return msg
+	}
+	callID := msg.GetHeader("Call-ID")
+
+	switch {
+	case msg.StatusCode == sip.StatusUnauthorized:
+		return h.challenged(ctx, msg, callID)
+	case msg.StatusCode >= 200 && msg.StatusCode < 300:
+		h.registered(ctx, msg, callID)
+	case msg.StatusCode >= 300:
+		h.mu.Lock()
+		delete(h.offers, callID)
+		delete(h.registering, callID)
+		delete(h.registers, callID)
+		h.mu.Unlock()
+	}
+	return msg
+}
+
+// challenged removes the AKA keys from a 401 response and installs the
+// temporary SAs of the agreement offered to the UE in its Security-Server
+func (h *Handler) challenged(ctx context.Context, msg *sip.Message, callID string) *sip.Message {
+	// The keys are for the P-CSCF only (TS 24.229 section 5.2.2.1)
+	var ck, ik []byte
+	for name, challenges := range msg.Headers {
+		if !strings.EqualFold(name, "WWW-Authenticate") {
+			continue
+		}
+		for i, challenge := range challenges {
+			for _, m := range akaKeyParam.FindAllStringSubmatch(challenge, -1) {
+				key, err := hex.DecodeString(m[2])
+				if err != nil {
+					continue
+				}
+				if strings.EqualFold(m[1], "ck") {
+					ck = key
+				} else {
+					ik = key
+				}
+			}
+			challenges[i] = akaKeyParam.ReplaceAllString(challenge, "")
+		}
+	}
+
+	a, err := h.offerAgreement(callID, ck, ik)
+	if err != nil {
+		h.log.WithError(err).Error("cannot set up security associations")
+		return newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+	}
+	if a == nil {
+		return msg
+	}
+
+	// Installing the SAs talks to the kernel, so it runs outside h.mu with
+	// the SPIs reserved
+	err = h.sas.Install(ctx, a.sa)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pending, a.sa.SPIPC)
+	delete(h.pending, a.sa.SPIPS)
+	if err != nil {
+		h.log.WithError(err).WithField("ue", a.sa.UE.String()).Error("cannot install security associations")
+		return newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+	}
+	ue := a.sa.UE.String()
+	h.agreements[ue] = append(h.agreements[ue], a)
+
+	msg.SetHeader(HeaderSecurityServer, a.server.String())
+	h.log.WithFields(logrus.Fields{"ue": ue, "spi-c": a.server.SPIC, "spi-s": a.server.SPIS}).Debug("temporary security associations installed")
+	return msg
+}
+
+// offerAgreement takes the offer of the REGISTER callID and returns the
+// agreement to set up from it with the AKA keys ck and ik, its SPIs
+// reserved, or nil when there is none
+func (h *Handler) offerAgreement(callID string, ck, ik []byte) (*agreement, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.offers[callID]
+	delete(h.offers, callID)
+	delete(h.registering, callID)
+	delete(h.registers, callID)
+	if !ok || ck == nil || ik == nil {
+		return nil, nil
+	}
+
+	integrityKey, encryptionKey, err := DeriveKeys(o.client.Algorithm, o.client.Encryption, ck, ik)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive IPsec keys: %w", err)
+	}
+	spiPC, spiPS, err := h.allocateSPIs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot allocate SPIs: %w", err)
+	}
+	h.pending[spiPC] = true
+	h.pending[spiPS] = true
+
+	a := &agreement{
+		server: SecurityMechanism{
+			Mechanism:  MechanismIPsec3GPP,
+			Preference: "0.1",
+			Algorithm:  o.client.Algorithm,
+			Encryption: o.client.Encryption,
+			Protocol:   "esp",
+			Mode:       "trans",
+			SPIC:       spiPC,
+			SPIS:       spiPS,
+			PortC:      h.cfg.ProtectedPortC,
+			PortS:      h.cfg.ProtectedPortS,
+		},
+		sa: &SecurityAssociation{
+			UE:            o.ue,
+			PCSCF:         o.pcscf,
+			PortUC:        o.client.PortC,
+			PortUS:        o.client.PortS,
+			PortPC:        h.cfg.ProtectedPortC,
+			PortPS:        h.cfg.ProtectedPortS,
+			SPIUC:         o.client.SPIC,
+			SPIUS:         o.client.SPIS,
+			SPIPC:         spiPC,
+			SPIPS:         spiPS,
+			Integrity:     o.client.Algorithm,
+			Encryption:    o.client.Encryption,
+			IntegrityKey:  integrityKey,
+			EncryptionKey: encryptionKey,
+			Expires:       h.now().Add(h.cfg.TemporarySALifetime),
+		},
+	}
+	return a, nil
+}
+
+// registered records the identities a registration grants the UE, then
+// establishes the agreement it succeeded over for the registration lifetime
+// and removes the older agreements of the UE (TS 33.203 section 7.4)
+func (h *Handler) registered(ctx context.Context, msg *sip.Message, callID string) {
+	h.removeSAs(ctx, h.establish(msg, callID))
+}
+
+// establish does the bookkeeping of registered and returns the agreements
+// whose SAs are to be removed
+func (h *Handler) establish(msg *sip.Message, callID string) []*agreement {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.offers, callID)
+	expires := registrationExpires(msg)
+	if addr, ok := h.registers[callID]; ok {
+		delete(h.registers, callID)
+		h.recordIdentities(addr, msg, expires)
+	}
+
+	a, ok := h.registering[callID]
+	delete(h.registering, callID)
+	if !ok {
+		return nil
+	}
+
+	if expires == 0 {
+		// De-registered: the SAs protect this response and go with the next
+		// expiry run
+		a.sa.Expires = h.now()
+		return nil
+	}
+	a.established = true
+	a.sa.Expires = h.now().Add(time.Duration(expires)*time.Second + registrationGrace)
+
+	ue := a.sa.UE.String()
+	var replaced []*agreement
+	for _, other := range h.agreements[ue] {
+		if other != a {
+			h.detach(other)
+			replaced = append(replaced, other)
+		}
+	}
+	h.agreements[ue] = []*agreement{a}
+	return replaced
+}
+
+// Run removes expired state until ctx is done
+func (h *Handler) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Expire(ctx)
+		}
+	}
+}
+
+// Expire removes expired offers, registered identities and security
+// associations, and releases the media of sessions that were never answered
+func (h *Handler) Expire(ctx context.Context) {
+	now := h.now()
+	h.expireMedia(ctx, now)
+	h.removeSAs(ctx, h.expire(now))
+}
+
+// expire removes the state expired at now and returns the agreements whose
+// SAs are to be removed
+func (h *Handler) expire(now time.Time) []*agreement {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for callID, o := range h.offers {
+		if now.After(o.expires) {
+			delete(h.offers, callID)
+		}
+	}
+	for addr, r := range h.identities {
+		if now.After(r.expires) {
+			delete(h.identities, addr)
+		}
+	}
+	var expired []*agreement
+	for ue, agreements := range h.agreements {
+		kept := agreements[:0]
+		for _, a := range agreements {
+			if now.Before(a.sa.Expires) {
+				kept = append(kept, a)
+				continue
+			}
+			h.detach(a)
+			expired = append(expired, a)
+		}
+		if len(kept) == 0 {
+			delete(h.agreements, ue)
+		} else {
+			h.agreements[ue] = kept
+		}
+	}
+	return expired
+}
+
+// detach forgets the registrations over a, whose SAs are about to be
+// removed, and keeps its SPIs reserved until they are. h.mu is held.
+func (h *Handler) detach(a *agreement) {
+	for callID, r := range h.registering {
+		if r == a {
+			delete(h.registering, callID)
+		}
+	}
+	h.pending[a.sa.SPIPC] = true
+	h.pending[a.sa.SPIPS] = true
+}
+
+// removeSAs uninstalls the SAs of detached agreements. h.mu is not held, as
+// removing them talks to the kernel.
+func (h *Handler) removeSAs(ctx context.Context, agreements []*agreement) {
+	for _, a := range agreements {
+		if err := h.sas.Remove(ctx, a.sa); err != nil {
+			h.log.WithError(err).WithField("ue", a.sa.UE.String()).Warn("cannot remove security associations")
+		}
+		h.mu.Lock()
+		delete(h.pending, a.sa.SPIPC)
+		delete(h.pending, a.sa.SPIPS)
+		h.mu.Unlock()
+	}
+}
+
+// protectedBy returns the agreement whose SAs msg arrived over: from the
+// UE's protected client port to the P-CSCF's protected server port. h.mu is
+// held.
+func (h *Handler) protectedBy(msg *sip.Message) *agreement {
+	ue, port := splitAddr(msg.RemoteAddr)
+	if ue == nil || !h.onProtectedPort(msg) {
+		return nil
+	}
+	for _, a := range h.agreements[ue.String()] {
+		if a.sa.PortUC == port && h.now().Before(a.sa.Expires) {
+			return a
+		}
+	}
+	return nil
+}
+
+// onProtectedPort reports whether msg arrived on the protected server port
+func (h *Handler) onProtectedPort(msg *sip.Message) bool {
+	_, port := splitAddr(msg.LocalAddr)
+	return port == h.cfg.ProtectedPortS
+}
+
+// choose returns the ipsec-3gpp mechanism of client with the preferred
+// algorithms, if any is acceptable
+func (h *Handler) choose(client []SecurityMechanism) (SecurityMechanism, bool) {
+	for _, alg := range h.cfg.IntegrityAlgorithms {
+		for _, ealg := range h.cfg.EncryptionAlgorithms {
+			for _, m := range client {
+				if m.Mechanism == MechanismIPsec3GPP && m.Algorithm == alg && m.Encryption == ealg &&
+					m.Protocol == "esp" && m.Mode == "trans" &&
+					m.SPIC != 0 && m.SPIS != 0 && m.PortC != 0 && m.PortS != 0 {
+					return m, true
+				}
+			}
+		}
+	}
+	return SecurityMechanism{}, false
+}
+
+// allocateSPIs returns two random SPIs the P-CSCF neither uses nor has
+// pending yet. SPIs below 256 are reserved (RFC 4303 section 2.1). h.mu is
+// held.
+func (h *Handler) allocateSPIs() (uint32, uint32, error) {
+	used := make(map[uint32]bool)
+	for spi := range h.pending {
+		used[spi] = true
+	}
+	for _, agreements := range h.agreements {
+		for _, a := range agreements {
+			used[a.sa.SPIPC] = true
+			used[a.sa.SPIPS] = true
+		}
+	}
+
+	var spis [2]uint32
+	for i := range spis {
+		for {
+			var b [4]byte
+			if _, err := rand.Read(b[:]); err != nil {
+				return 0, 0, err
+			}
+			spi := binary.BigEndian.Uint32(b[:])
+			if spi >= 256 && !used[spi] {
+				used[spi] = true
+				spis[i] = spi
+				break
+			}
+		}
+	}
+	return spis[0], spis[1], nil
+}
+
+// containsMechanism reports whether mechanisms include m
+func containsMechanism(mechanisms []SecurityMechanism, m SecurityMechanism) bool {
+	for _, other := range mechanisms {
+		if other.Equal(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripSecAgree removes the security agreement headers, which end at the
+// P-CSCF (RFC 3329 section 2.3.1)
+func stripSecAgree(msg *sip.Message) {
+	for name, values := range msg.Headers {
+		switch {
+		case strings.EqualFold(name, HeaderSecurityClient), strings.EqualFold(name, HeaderSecurityVerify):
+			delete(msg.Headers, name)
+		case strings.EqualFold(name, "Require"), strings.EqualFold(name, "Proxy-Require"):
+			if kept := removeOption(values, OptionSecAgree); len(kept) > 0 {
+				msg.Headers[name] = kept
+			} else {
+				delete(msg.Headers, name)
+			}
+		}
+	}
+}
+
+// setIntegrityProtected sets the integrity-protected parameter of the
+// Authorization header for the S-CSCF (TS 24.229 section 5.2.2.1)
+func setIntegrityProtected(msg *sip.Message, protected bool) {
+	value := `"no"`
+	if protected {
+		value = `"yes"`
+	}
+	for name, values := range msg.Headers {
+		if !strings.EqualFold(name, "Authorization") || len(values) == 0 {
+			continue
+		}
+		credentials := integrityProtectedParam.ReplaceAllString(values[0], "")
+		values[0] = credentials + ", integrity-protected=" + value
+	}
+}
+
+// integrityProtectedParam matches an integrity-protected parameter the UE
+// must not set itself
+var integrityProtectedParam = regexp.MustCompile(`(?i),?\s*\bintegrity-protected\s*=\s*"?[a-z-]*"?`)
+
+// registrationExpires returns the registration lifetime a REGISTER
+// response grants, the longest of its contacts
+func registrationExpires(msg *sip.Message) int {
+	expires := -1
+	for _, contact := range msg.GetHeaderAll("Contact") {
+		for _, param := range strings.Split(contact, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if !strings.EqualFold(name, "expires") {
+				continue
+			}
+			if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > expires {
+				expires = n
+			}
+		}
+	}
+	if expires < 0 {
+		expires, _ = strconv.Atoi(msg.GetHeader("Expires"))
+	}
+	return expires
+}
+
+// splitAddr splits a host:port transport address
+func splitAddr(addr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.ParseIP(addr), 0
+	}
+	n, _ := strconv.Atoi(port)
+	return net.ParseIP(host), n
+}
+
+// newResponse creates a response to msg, or a replacement of response msg
+func newResponse(msg *sip.Message, statusCode int, reason string) *sip.Message {
+	response := &sip.Message{
+		Version:    "SIP/2.0",
+		StatusCode: statusCode,
+		StatusText: reason,
+		Headers:    make(map[string][]string),
+		Transport:  msg.Transport,
+		RemoteAddr: msg.RemoteAddr,
+		LocalAddr:  msg.LocalAddr,
+	}
+
+	for _, via := range msg.GetHeaderAll("Via") {
+		response.AddHeader("Via", via)
+	}
+	response.SetHeader("From", msg.GetHeader("From"))
+	response.SetHeader("To", msg.GetHeader("To"))
+	response.SetHeader("Call-ID", msg.GetHeader("Call-ID"))
+	response.SetHeader("CSeq", msg.GetHeader("CSeq"))
+	if msg.IsRequest() && !strings.Contains(response.GetHeader("To"), ";tag=") {
+		response.SetHeader("To", response.GetHeader("To")+";tag="+generateTag())
+	}
+
+	return response
+}
+
+// generateTag returns a random To tag
+func generateTag() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
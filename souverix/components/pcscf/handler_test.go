@@ -0,0 +1,296 @@
+package pcscf
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	testCK = "000102030405060708090a0b0c0d0e0f"
+	testIK = "f0e0d0c0b0a090807060504030201000"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return log
+}
+
+func testHandler(requireSecAgree bool) (*Handler, *FakeSAManager) {
+	cfg := &config.Config{IMS: config.IMSConfig{PCSCF: config.PCSCFConfig{
+		Address:         "10.0.0.1",
+		ProtectedPortC:  5100,
+		ProtectedPortS:  5101,
+		RequireSecAgree: requireSecAgree,
+	}}}
+	sas := NewFakeSAManager()
+	return NewHandler(cfg, sas, testLogger()), sas
+}
+
+// ueRequest builds a request of the UE at 10.0.0.2 from port to the P-CSCF
+// on localPort
+func ueRequest(method, callID string, port, localPort int) *sip.Message {
+	msg := &sip.Message{
+		Method:     method,
+		URI:        "sip:ims.local",
+		Version:    "SIP/2.0",
+		Headers:    make(map[string][]string),
+		Transport:  "udp",
+		RemoteAddr: "10.0.0.2:" + strconv.Itoa(port),
+		LocalAddr:  "10.0.0.1:" + strconv.Itoa(localPort),
+	}
+	msg.SetHeader("Via", "SIP/2.0/UDP 10.0.0.2:"+strconv.Itoa(port)+";branch=z9hG4bK"+callID)
+	msg.SetHeader("From", "<sip:alice@ims.local>;tag=1")
+	msg.SetHeader("To", "<sip:alice@ims.local>")
+	msg.SetHeader("Call-ID", callID)
+	msg.SetHeader("CSeq", "1 "+method)
+	return msg
+}
+
+func registerRequest(callID string, port, localPort int, client string) *sip.Message {
+	msg := ueRequest(sip.MethodREGISTER, callID, port, localPort)
+	msg.SetHeader("Authorization", `Digest username="alice@ims.local", realm="ims.local", uri="sip:ims.local", nonce="", response=""`)
+	msg.SetHeader("Require", OptionSecAgree)
+	msg.SetHeader("Proxy-Require", OptionSecAgree)
+	msg.SetHeader("Supported", "path, sec-agree")
+	if client != "" {
+		msg.SetHeader(HeaderSecurityClient, client)
+	}
+	return msg
+}
+
+// coreResponse builds the response of the core to req
+func coreResponse(req *sip.Message, statusCode int, reason string) *sip.Message {
+	response := newResponse(req, statusCode, reason)
+	response.RemoteAddr = "10.0.1.1:5060"
+	return response
+}
+
+func challenge(req *sip.Message) *sip.Message {
+	response := coreResponse(req, sip.StatusUnauthorized, "Unauthorized")
+	response.SetHeader("WWW-Authenticate", `Digest realm="ims.local", nonce="abc", algorithm=AKAv1-MD5, qop="auth", ik="`+testIK+`", ck="`+testCK+`"`)
+	return response
+}
+
+func registered(req *sip.Message, expires int) *sip.Message {
+	response := coreResponse(req, sip.StatusOK, "OK")
+	response.SetHeader("Contact", "<sip:alice@10.0.0.2:5064>;expires="+strconv.Itoa(expires))
+	return response
+}
+
+// establish runs the initial registration of the UE over protected port
+// portUC and returns the agreed Security-Server
+func establish(t *testing.T, h *Handler, callID string, portUC int) string {
+	t.Helper()
+	ctx := context.Background()
+	client := "ipsec-3gpp;alg=hmac-sha-1-96;ealg=aes-cbc;spi-c=1000;spi-s=2000;port-c=" + strconv.Itoa(portUC) + ";port-s=5064"
+
+	forward, response := h.HandleRequest(ctx, registerRequest(callID, 5060, 5060, client))
+	if response != nil {
+		t.Fatalf("initial REGISTER rejected with %d", response.StatusCode)
+	}
+	challenged := h.HandleResponse(ctx, challenge(forward))
+	server := challenged.GetHeader(HeaderSecurityServer)
+	if server == "" {
+		t.Fatalf("401 without Security-Server: %v", challenged.Headers)
+	}
+
+	protected := registerRequest(callID, portUC, 5101, client)
+	protected.SetHeader(HeaderSecurityVerify, server)
+	forward, response = h.HandleRequest(ctx, protected)
+	if response != nil {
+		t.Fatalf("protected REGISTER rejected with %d", response.StatusCode)
+	}
+	h.HandleResponse(ctx, registered(forward, 600))
+	return server
+}
+
+func TestHandler_SecAgree(t *testing.T) {
+	h, sas := testHandler(true)
+	ctx := context.Background()
+	client := "ipsec-3gpp;alg=hmac-md5-96;spi-c=1000;spi-s=2000;port-c=5062;port-s=5064, ipsec-3gpp;alg=hmac-sha-1-96;ealg=aes-cbc;spi-c=1001;spi-s=2001;port-c=5062;port-s=5064"
+
+	forward, response := h.HandleRequest(ctx, registerRequest("reg-1", 5060, 5060, client))
+	if response != nil {
+		t.Fatalf("initial REGISTER rejected with %d", response.StatusCode)
+	}
+	for _, name := range []string{HeaderSecurityClient, "Require", "Proxy-Require"} {
+		if forward.GetHeader(name) != "" {
+			t.Errorf("forwarded REGISTER keeps %s", name)
+		}
+	}
+	if supported := forward.GetHeader("Supported"); supported != "path, sec-agree" {
+		t.Errorf("forwarded Supported = %q", supported)
+	}
+	if auth := forward.GetHeader("Authorization"); !strings.HasSuffix(auth, `integrity-protected="no"`) {
+		t.Errorf("initial REGISTER Authorization = %s", auth)
+	}
+
+	challenged := h.HandleResponse(ctx, challenge(forward))
+	if auth := challenged.GetHeader("WWW-Authenticate"); strings.Contains(auth, "ck=") || strings.Contains(auth, "ik=") || !strings.Contains(auth, `nonce="abc"`) {
+		t.Errorf("401 WWW-Authenticate = %s", auth)
+	}
+	server, err := ParseSecurityMechanisms(challenged.GetHeaderAll(HeaderSecurityServer))
+	if err != nil || len(server) != 1 {
+		t.Fatalf("Security-Server = %v, %v", challenged.GetHeaderAll(HeaderSecurityServer), err)
+	}
+	if server[0].Algorithm != AlgHMACSHA196 || server[0].Encryption != EAlgAESCBC || server[0].PortC != 5100 || server[0].PortS != 5101 {
+		t.Errorf("Security-Server = %+v, want the preferred algorithms and the protected ports", server[0])
+	}
+
+	installed := sas.Installed()
+	if len(installed) != 1 {
+		t.Fatalf("%d security associations installed, want 1", len(installed))
+	}
+	sa := installed[0]
+	if sa.SPIUC != 1001 || sa.SPIUS != 2001 || sa.SPIPC != server[0].SPIC || sa.SPIPS != server[0].SPIS ||
+		sa.UE.String() != "10.0.0.2" || sa.PCSCF.String() != "10.0.0.1" || sa.PortUC != 5062 || sa.PortPS != 5101 {
+		t.Errorf("security association = %+v", sa)
+	}
+	if len(sa.IntegrityKey) != 20 || len(sa.EncryptionKey) != 16 {
+		t.Errorf("key lengths = %d, %d, want 20 and 16", len(sa.IntegrityKey), len(sa.EncryptionKey))
+	}
+
+	// Requests other than REGISTER need an established agreement
+	if _, response := h.HandleRequest(ctx, ueRequest(sip.MethodINVITE, "call-0", 5062, 5101)); response == nil || response.StatusCode != sip.StatusForbidden {
+		t.Errorf("INVITE over temporary SAs response = %v", response)
+	}
+
+	tests := []struct {
+		name       string
+		port       int
+		localPort  int
+		verify     string
+		wantStatus int
+	}{
+		{"no Security-Verify", 5062, 5101, "", sip.StatusForbidden},
+		{"tampered Security-Verify", 5062, 5101, strings.Replace(server[0].String(), "aes-cbc", "null", 1), sip.StatusForbidden},
+		{"unknown protected client port", 5070, 5101, server[0].String(), sip.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := registerRequest("reg-1", tt.port, tt.localPort, client)
+		if tt.verify != "" {
+			req.SetHeader(HeaderSecurityVerify, tt.verify)
+		}
+		if _, response := h.HandleRequest(ctx, req); response == nil || response.StatusCode != tt.wantStatus {
+			t.Errorf("%s: response = %v, want %d", tt.name, response, tt.wantStatus)
+		}
+	}
+
+	protected := registerRequest("reg-1", 5062, 5101, client)
+	protected.SetHeader(HeaderSecurityVerify, "ipsec-3gpp; q=0.1; alg=hmac-sha-1-96; ealg=aes-cbc; spi-c="+strconv.Itoa(int(server[0].SPIC))+"; spi-s="+strconv.Itoa(int(server[0].SPIS))+"; port-c=5100; port-s=5101")
+	forward, response = h.HandleRequest(ctx, protected)
+	if response != nil {
+		t.Fatalf("protected REGISTER rejected with %d", response.StatusCode)
+	}
+	if forward.GetHeader(HeaderSecurityVerify) != "" {
+		t.Error("forwarded REGISTER keeps Security-Verify")
+	}
+	if auth := forward.GetHeader("Authorization"); !strings.HasSuffix(auth, `integrity-protected="yes"`) {
+		t.Errorf("protected REGISTER Authorization = %s", auth)
+	}
+	h.HandleResponse(ctx, registered(forward, 600))
+
+	tests = []struct {
+		name       string
+		port       int
+		localPort  int
+		verify     string
+		wantStatus int
+	}{
+		{"protected", 5062, 5101, "", 0},
+		{"unprotected port", 5060, 5060, "", sip.StatusForbidden},
+		{"unprotected client port", 5060, 5101, "", sip.StatusForbidden},
+		{"unprotected server port", 5062, 5060, "", sip.StatusForbidden},
+	}
+	for _, tt := range tests {
+		forward, response := h.HandleINVITE(ctx, ueRequest(sip.MethodINVITE, "call-1", tt.port, tt.localPort))
+		switch {
+		case tt.wantStatus == 0 && forward == nil:
+			t.Errorf("%s: INVITE rejected with %d", tt.name, response.StatusCode)
+		case tt.wantStatus != 0 && (response == nil || response.StatusCode != tt.wantStatus):
+			t.Errorf("%s: INVITE response = %v, want %d", tt.name, response, tt.wantStatus)
+		}
+	}
+}
+
+func TestHandler_Reregistration(t *testing.T) {
+	h, sas := testHandler(true)
+	ctx := context.Background()
+	oldServer := establish(t, h, "reg-1", 5062)
+	old := sas.Installed()[0]
+
+	// Re-registration over the old SAs sets up new ones
+	client := "ipsec-3gpp;alg=hmac-sha-1-96;ealg=aes-cbc;spi-c=1002;spi-s=2002;port-c=5066;port-s=5068"
+	req := registerRequest("reg-1", 5062, 5101, client)
+	req.SetHeader(HeaderSecurityVerify, oldServer)
+	forward, response := h.HandleRequest(ctx, req)
+	if response != nil {
+		t.Fatalf("re-REGISTER rejected with %d", response.StatusCode)
+	}
+	newServer := h.HandleResponse(ctx, challenge(forward)).GetHeader(HeaderSecurityServer)
+	if len(sas.Installed()) != 2 {
+		t.Fatalf("%d security associations installed during re-registration, want 2", len(sas.Installed()))
+	}
+
+	req = registerRequest("reg-1", 5066, 5101, client)
+	req.SetHeader(HeaderSecurityVerify, newServer)
+	forward, response = h.HandleRequest(ctx, req)
+	if response != nil {
+		t.Fatalf("re-REGISTER over the new SAs rejected with %d", response.StatusCode)
+	}
+	h.HandleResponse(ctx, registered(forward, 600))
+
+	installed := sas.Installed()
+	if len(installed) != 1 || installed[0] == old || installed[0].PortUC != 5066 {
+		t.Fatalf("security associations after re-registration = %+v", installed)
+	}
+	if _, response := h.HandleRequest(ctx, ueRequest(sip.MethodINVITE, "call-1", 5062, 5101)); response == nil {
+		t.Error("INVITE over the replaced SAs accepted")
+	}
+
+	// The SAs outlive the registration only by the grace period
+	h.now = func() time.Time { return time.Now().Add(600*time.Second + registrationGrace + time.Second) }
+	h.Expire(ctx)
+	if installed := sas.Installed(); len(installed) != 0 {
+		t.Errorf("%d security associations left after expiry", len(installed))
+	}
+}
+
+func TestHandler_WithoutSecAgree(t *testing.T) {
+	ctx := context.Background()
+
+	h, _ := testHandler(true)
+	if _, response := h.HandleRequest(ctx, registerRequest("reg-1", 5060, 5060, "")); response == nil || response.StatusCode != sip.StatusExtensionRequired || response.GetHeader("Require") != OptionSecAgree {
+		t.Errorf("REGISTER without Security-Client response = %v", response)
+	}
+	if _, response := h.HandleRequest(ctx, registerRequest("reg-2", 5060, 5060, "tls;q=0.1")); response == nil || response.StatusCode != statusSecurityAgreementRequired {
+		t.Errorf("REGISTER without an acceptable mechanism response = %v", response)
+	}
+	req := ueRequest(sip.MethodINVITE, "call-1", 5060, 5060)
+	req.Headers["Call-ID"] = nil
+	if _, response := h.HandleINVITE(ctx, req); response == nil || response.StatusCode != sip.StatusBadRequest {
+		t.Errorf("INVITE without Call-ID response = %v", response)
+	}
+
+	// Without the requirement, UEs that never negotiated are accepted
+	h, sas := testHandler(false)
+	forward, response := h.HandleRequest(ctx, registerRequest("reg-1", 5060, 5060, ""))
+	if response != nil {
+		t.Fatalf("REGISTER without Security-Client rejected with %d", response.StatusCode)
+	}
+	h.HandleResponse(ctx, h.HandleResponse(ctx, challenge(forward)))
+	if len(sas.Installed()) != 0 {
+		t.Error("security associations installed without Security-Client")
+	}
+	if forward, _ := h.HandleINVITE(ctx, ueRequest(sip.MethodINVITE, "call-1", 5060, 5060)); forward == nil {
+		t.Error("INVITE of a UE without security agreement rejected")
+	}
+}
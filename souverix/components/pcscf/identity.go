@@ -0,0 +1,150 @@
+package pcscf
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dasmlab/ims/internal/sip"
+)
+
+// registration holds the public identities a registration granted a UE
+type registration struct {
+	identities []string // P-Associated-URI, the default public identity first
+	expires    time.Time
+}
+
+// recordIdentities keeps the P-Associated-URI of the 2xx response to a
+// REGISTER of the UE at addr, or forgets its identities on de-registration.
+// h.mu is held.
+func (h *Handler) recordIdentities(addr string, msg *sip.Message, expires int) {
+	identities := nameAddrURIs(msg.GetHeaderAll("P-Associated-URI"))
+	if expires <= 0 || len(identities) == 0 {
+		delete(h.identities, addr)
+		return
+	}
+	h.identities[addr] = &registration{
+		identities: identities,
+		expires:    h.now().Add(time.Duration(expires) * time.Second),
+	}
+}
+
+// assertIdentity replaces what the UE claims about itself with what the
+// P-CSCF asserts: the P-Preferred-Identity if it is one of the UE's
+// registered identities, otherwise its default public identity (TS 24.229
+// section 5.2.6.3.3)
+func (h *Handler) assertIdentity(msg *sip.Message) {
+	policeUE(msg)
+
+	preferred := nameAddrURIs(msg.GetHeaderAll("P-Preferred-Identity"))
+	msg.RemoveHeader("P-Preferred-Identity")
+
+	h.mu.Lock()
+	var identities []string
+	if r, ok := h.identities[msg.RemoteAddr]; ok && h.now().Before(r.expires) {
+		identities = r.identities
+	}
+	h.mu.Unlock()
+	if len(identities) == 0 {
+		h.log.WithField("remote", msg.RemoteAddr).Debug("request of an unregistered UE, no identity asserted")
+		return
+	}
+
+	asserted := identities[0]
+	for _, uri := range preferred {
+		if identity := matchURI(identities, uri); identity != "" {
+			asserted = identity
+			break
+		}
+	}
+	msg.SetHeader("P-Asserted-Identity", "<"+asserted+">")
+}
+
+// policeUE removes the trust domain headers of a request from the UE, which
+// is outside the trust domain. The UE provides its own access network
+// information; only what claims to be network provided is removed.
+func policeUE(msg *sip.Message) {
+	var access []string
+	for _, value := range msg.GetHeaderAll("P-Access-Network-Info") {
+		if !strings.Contains(strings.ToLower(value), "network-provided") {
+			access = append(access, value)
+		}
+	}
+	sip.StripTrustDomainHeaders(msg)
+	for _, value := range access {
+		msg.AddHeader("P-Access-Network-Info", value)
+	}
+}
+
+// nameAddrURIs returns the URIs of a list of name-addr or addr-spec values,
+// as in P-Associated-URI and P-Preferred-Identity
+func nameAddrURIs(values []string) []string {
+	var uris []string
+	for _, value := range values {
+		for _, entry := range splitNameAddrs(value) {
+			uri := entry
+			if start := strings.Index(entry, "<"); start >= 0 {
+				if end := strings.Index(entry[start:], ">"); end > 0 {
+					uri = entry[start+1 : start+end]
+				}
+			} else {
+				uri, _, _ = strings.Cut(entry, ";")
+			}
+			if uri = strings.TrimSpace(uri); uri != "" {
+				uris = append(uris, uri)
+			}
+		}
+	}
+	return uris
+}
+
+// splitNameAddrs splits a comma separated header value, ignoring commas
+// inside quotes and angle brackets
+func splitNameAddrs(s string) []string {
+	var parts []string
+	var quoted, bracketed bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				bracketed = true
+			}
+		case '>':
+			if !quoted {
+				bracketed = false
+			}
+		case ',':
+			if !quoted && !bracketed {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// matchURI returns the identity of identities that uri names. The scheme and
+// host of SIP URIs are case-insensitive (RFC 3261 section 19.1.4).
+func matchURI(identities []string, uri string) string {
+	for _, identity := range identities {
+		if canonicalURI(identity) == canonicalURI(uri) {
+			return identity
+		}
+	}
+	return ""
+}
+
+// canonicalURI lower-cases the scheme and host part of uri
+func canonicalURI(uri string) string {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return uri
+	}
+	user, host, ok := strings.Cut(rest, "@")
+	if !ok {
+		return strings.ToLower(scheme) + ":" + strings.ToLower(rest)
+	}
+	return strings.ToLower(scheme) + ":" + user + "@" + strings.ToLower(host)
+}
@@ -0,0 +1,82 @@
+package pcscf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/sip"
+)
+
+func TestHandler_AssertIdentity(t *testing.T) {
+	h, _ := testHandler(false)
+	ctx := context.Background()
+
+	// A request before registration gets no asserted identity
+	invite := ueRequest(sip.MethodINVITE, "call-0", 5060, 5060)
+	invite.SetHeader("P-Asserted-Identity", "<sip:bob@ims.local>")
+	forward, _ := h.HandleINVITE(ctx, invite)
+	if forward == nil || forward.GetHeader("P-Asserted-Identity") != "" {
+		t.Fatalf("INVITE of an unregistered UE forwarded as %v", forward)
+	}
+
+	forward, _ = h.HandleRequest(ctx, registerRequest("reg-1", 5060, 5060, ""))
+	ok := registered(forward, 600)
+	ok.SetHeader("P-Associated-URI", `<sip:alice@ims.local>, "Alice" <tel:+15145550001>, <sip:alice.work@ims.local>`)
+	ok.SetHeader("P-Charging-Vector", "icid-value=abcd")
+	if response := h.HandleResponse(ctx, ok); response.GetHeader("P-Charging-Vector") != "" {
+		t.Error("P-Charging-Vector sent to the UE")
+	}
+
+	tests := []struct {
+		name      string
+		preferred string
+		want      string
+	}{
+		{"default identity", "", "<sip:alice@ims.local>"},
+		{"preferred registered identity", `"Alice" <tel:+15145550001>`, "<tel:+15145550001>"},
+		{"preferred identity differing in host case", "<sip:alice.work@IMS.local>", "<sip:alice.work@ims.local>"},
+		{"preferred identity of someone else", "<sip:bob@ims.local>", "<sip:alice@ims.local>"},
+	}
+	for _, tt := range tests {
+		invite := ueRequest(sip.MethodINVITE, "call-1", 5060, 5060)
+		if tt.preferred != "" {
+			invite.SetHeader("P-Preferred-Identity", tt.preferred)
+		}
+		invite.SetHeader("P-Asserted-Identity", "<sip:bob@ims.local>")
+		invite.SetHeader("P-Charging-Vector", "icid-value=forged")
+		invite.AddHeader("P-Access-Network-Info", "3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=2340100010000001")
+		invite.AddHeader("P-Access-Network-Info", "3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=2340100010000002; network-provided")
+
+		forward, response := h.HandleINVITE(ctx, invite)
+		if response != nil {
+			t.Fatalf("%s: INVITE rejected with %d", tt.name, response.StatusCode)
+		}
+		if got := forward.GetHeaderAll("P-Asserted-Identity"); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: P-Asserted-Identity = %v, want %s", tt.name, got, tt.want)
+		}
+		if forward.GetHeader("P-Preferred-Identity") != "" {
+			t.Errorf("%s: forwarded headers = %v", tt.name, forward.Headers)
+		}
+		// The forged charging vector is replaced by one the P-CSCF generates
+		if v := sip.GetChargingVector(forward); v == nil || v.ICID == "forged" || v.GeneratedAt != "10.0.0.1" {
+			t.Errorf("%s: P-Charging-Vector = %q", tt.name, forward.GetHeader("P-Charging-Vector"))
+		}
+		if access := forward.GetHeaderAll("P-Access-Network-Info"); len(access) != 1 || access[0] != "3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=2340100010000001" {
+			t.Errorf("%s: P-Access-Network-Info = %v", tt.name, access)
+		}
+	}
+
+	// Another UE behind a different address is not registered
+	invite = ueRequest(sip.MethodINVITE, "call-2", 5070, 5060)
+	invite.SetHeader("P-Preferred-Identity", "<sip:alice@ims.local>")
+	if forward, _ := h.HandleINVITE(ctx, invite); forward.GetHeader("P-Asserted-Identity") != "" {
+		t.Error("identity asserted for a UE that did not register")
+	}
+
+	// De-registration withdraws the identities
+	forward, _ = h.HandleRequest(ctx, registerRequest("reg-1", 5060, 5060, ""))
+	h.HandleResponse(ctx, registered(forward, 0))
+	if forward, _ := h.HandleINVITE(ctx, ueRequest(sip.MethodINVITE, "call-3", 5060, 5060)); forward.GetHeader("P-Asserted-Identity") != "" {
+		t.Error("identity asserted after de-registration")
+	}
+}
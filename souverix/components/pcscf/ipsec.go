@@ -0,0 +1,142 @@
+package pcscf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Algorithms of the ipsec-3gpp mechanism (TS 33.203 section 6.3)
+const (
+	AlgHMACSHA196  = "hmac-sha-1-96"
+	AlgHMACMD596   = "hmac-md5-96"
+	EAlgAESCBC     = "aes-cbc"
+	EAlgDESEDE3CBC = "des-ede3-cbc"
+	EAlgNull       = "null"
+)
+
+// SecurityAssociation is the set of four unidirectional IPsec SAs between a
+// UE and the P-CSCF (TS 33.203 section 7.1). The UE sends requests from its
+// protected client port to the P-CSCF's protected server port and receives
+// them on its protected server port from the P-CSCF's protected client port.
+type SecurityAssociation struct {
+	UE    net.IP
+	PCSCF net.IP
+
+	PortUC, PortUS int    // Protected ports of the UE
+	PortPC, PortPS int    // Protected ports of the P-CSCF
+	SPIUC, SPIUS   uint32 // SPIs the UE receives on
+	SPIPC, SPIPS   uint32 // SPIs the P-CSCF receives on
+
+	Integrity     string // alg
+	Encryption    string // ealg
+	IntegrityKey  []byte
+	EncryptionKey []byte
+
+	Expires time.Time
+}
+
+// SAManager installs and removes the security associations in the IP stack
+type SAManager interface {
+	Install(ctx context.Context, sa *SecurityAssociation) error
+	Remove(ctx context.Context, sa *SecurityAssociation) error
+}
+
+// NewSAManager creates the SAManager of the configured IPsec backend
+func NewSAManager(cfg *config.PCSCFConfig, log *logrus.Logger) (SAManager, error) {
+	switch cfg.IPsecBackend {
+	case "", "xfrm":
+		m, err := NewXFRMManager(log)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case "fake":
+		return NewFakeSAManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown IPsec backend: %s", cfg.IPsecBackend)
+	}
+}
+
+// DeriveKeys derives the ESP keys of the negotiated algorithms from the
+// IMS AKA keys (TS 33.203 section 7.1 and annex I)
+func DeriveKeys(integrity, encryption string, ck, ik []byte) (integrityKey, encryptionKey []byte, err error) {
+	if len(ck) != 16 || len(ik) != 16 {
+		return nil, nil, fmt.Errorf("CK and IK must be 128 bits")
+	}
+
+	switch integrity {
+	case AlgHMACMD596:
+		integrityKey = append([]byte(nil), ik...)
+	case AlgHMACSHA196:
+		// IK extended with 32 zero bits to 160 bits
+		integrityKey = append(append([]byte(nil), ik...), 0, 0, 0, 0)
+	default:
+		return nil, nil, fmt.Errorf("unsupported integrity algorithm: %s", integrity)
+	}
+
+	switch encryption {
+	case EAlgNull, "":
+	case EAlgAESCBC:
+		encryptionKey = append([]byte(nil), ck...)
+	case EAlgDESEDE3CBC:
+		// CK1 || CK2 || CK1, where CK1 and CK2 are the two halves of CK
+		encryptionKey = append(append([]byte(nil), ck...), ck[:8]...)
+	default:
+		return nil, nil, fmt.Errorf("unsupported encryption algorithm: %s", encryption)
+	}
+	return integrityKey, encryptionKey, nil
+}
+
+// FakeSAManager records security associations instead of installing them,
+// for tests and hosts without IPsec support
+type FakeSAManager struct {
+	mu  sync.Mutex
+	sas map[uint32]*SecurityAssociation // key: SPIPS
+}
+
+// NewFakeSAManager creates an empty FakeSAManager
+func NewFakeSAManager() *FakeSAManager {
+	return &FakeSAManager{sas: make(map[uint32]*SecurityAssociation)}
+}
+
+// Install records sa
+func (f *FakeSAManager) Install(ctx context.Context, sa *SecurityAssociation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sas[sa.SPIPS]; ok {
+		return fmt.Errorf("security association with SPI %d already installed", sa.SPIPS)
+	}
+	f.sas[sa.SPIPS] = sa
+	return nil
+}
+
+// Remove forgets sa
+func (f *FakeSAManager) Remove(ctx context.Context, sa *SecurityAssociation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sas[sa.SPIPS]; !ok {
+		return fmt.Errorf("no security association with SPI %d", sa.SPIPS)
+	}
+	delete(f.sas, sa.SPIPS)
+	return nil
+}
+
+// Installed returns the security associations currently installed, ordered
+// by the P-CSCF's server SPI
+func (f *FakeSAManager) Installed() []*SecurityAssociation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sas := make([]*SecurityAssociation, 0, len(f.sas))
+	for _, sa := range f.sas {
+		sas = append(sas, sa)
+	}
+	sort.Slice(sas, func(i, j int) bool { return sas[i].SPIPS < sas[j].SPIPS })
+	return sas
+}
@@ -0,0 +1,111 @@
+package pcscf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestDeriveKeys(t *testing.T) {
+	ck := bytes.Repeat([]byte{0xc1}, 8)
+	ck = append(ck, bytes.Repeat([]byte{0xc2}, 8)...)
+	ik := bytes.Repeat([]byte{0x1c}, 16)
+
+	tests := []struct {
+		integrity, encryption string
+		wantIK, wantCK        []byte
+		wantErr               bool
+	}{
+		{integrity: AlgHMACMD596, encryption: EAlgNull, wantIK: ik},
+		{integrity: AlgHMACSHA196, encryption: EAlgAESCBC, wantIK: append(append([]byte(nil), ik...), 0, 0, 0, 0), wantCK: ck},
+		{integrity: AlgHMACSHA196, encryption: EAlgDESEDE3CBC, wantIK: append(append([]byte(nil), ik...), 0, 0, 0, 0), wantCK: append(append([]byte(nil), ck...), ck[:8]...)},
+		{integrity: "hmac-sha-256", encryption: EAlgNull, wantErr: true},
+		{integrity: AlgHMACMD596, encryption: "blowfish", wantErr: true},
+	}
+	for _, tt := range tests {
+		integrityKey, encryptionKey, err := DeriveKeys(tt.integrity, tt.encryption, ck, ik)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("DeriveKeys(%s, %s) error = %v, wantErr %v", tt.integrity, tt.encryption, err, tt.wantErr)
+		}
+		if !bytes.Equal(integrityKey, tt.wantIK) || !bytes.Equal(encryptionKey, tt.wantCK) {
+			t.Errorf("DeriveKeys(%s, %s) = %x, %x, want %x, %x", tt.integrity, tt.encryption, integrityKey, encryptionKey, tt.wantIK, tt.wantCK)
+		}
+	}
+	if _, _, err := DeriveKeys(AlgHMACMD596, EAlgNull, ck[:8], ik); err == nil {
+		t.Error("DeriveKeys() accepted a short CK")
+	}
+}
+
+func TestXFRMMessages(t *testing.T) {
+	sa := &SecurityAssociation{
+		UE:            net.ParseIP("10.0.0.2"),
+		PCSCF:         net.ParseIP("10.0.0.1"),
+		PortUC:        5062,
+		PortUS:        5064,
+		PortPC:        5100,
+		PortPS:        5101,
+		SPIUC:         0x1111,
+		SPIUS:         0x2222,
+		SPIPC:         0x3333,
+		SPIPS:         0x4444,
+		Integrity:     AlgHMACSHA196,
+		Encryption:    EAlgNull,
+		IntegrityKey:  []byte{0xaa, 0xbb},
+		EncryptionKey: nil,
+	}
+
+	install := xfrmInstallMessages(sa)
+	if len(install) != 12 {
+		t.Fatalf("xfrmInstallMessages() = %d messages, want 4 states and 8 policies", len(install))
+	}
+
+	// The first state receives on the P-CSCF's protected server port
+	state := install[0]
+	if state.typ != xfrmMsgNewSA || state.flags&nlmFAck == 0 {
+		t.Errorf("first message type %#x flags %#x, want an acknowledged new SA", state.typ, state.flags)
+	}
+	if got := net.IP(state.data[56:60]); !got.Equal(sa.PCSCF) {
+		t.Errorf("state destination = %v, want %v", got, sa.PCSCF)
+	}
+	if got := net.IP(state.data[80:84]); !got.Equal(sa.UE) {
+		t.Errorf("state source = %v, want %v", got, sa.UE)
+	}
+	if spi := binary.BigEndian.Uint32(state.data[72:]); spi != 0x4444 || state.data[76] != protoESP {
+		t.Errorf("state SPI = %#x, protocol %d, want 0x4444 over ESP", spi, state.data[76])
+	}
+	auth := state.data[sizeofXfrmUsersaInfo+4:]
+	if name := string(bytes.TrimRight(auth[:sizeofXfrmAlgoName], "\x00")); name != "hmac(sha1)" {
+		t.Errorf("integrity algorithm = %q, want hmac(sha1)", name)
+	}
+	if bits, trunc := binary.NativeEndian.Uint32(auth[64:]), binary.NativeEndian.Uint32(auth[68:]); bits != 16 || trunc != 96 {
+		t.Errorf("integrity key %d bits truncated to %d, want 16 and 96", bits, trunc)
+	}
+	if key := auth[72:74]; !bytes.Equal(key, sa.IntegrityKey) {
+		t.Errorf("integrity key = %x, want %x", key, sa.IntegrityKey)
+	}
+	if !bytes.Contains(state.data, []byte("ecb(cipher_null)")) {
+		t.Error("state without the null encryption algorithm")
+	}
+
+	// The last policy sends TCP from the P-CSCF's protected client port
+	policy := install[11]
+	if policy.typ != xfrmMsgNewPolicy || policy.data[160] != xfrmPolicyOut || policy.data[44] != protoTCP {
+		t.Errorf("last message type %#x, dir %d, protocol %d, want an outbound TCP policy", policy.typ, policy.data[160], policy.data[44])
+	}
+	if dport, sport := binary.BigEndian.Uint16(policy.data[32:]), binary.BigEndian.Uint16(policy.data[36:]); dport != 5064 || sport != 5100 {
+		t.Errorf("policy ports %d to %d, want 5100 to 5064", sport, dport)
+	}
+	tmpl := policy.data[sizeofXfrmUserpolicyInfo+4:]
+	if spi := binary.BigEndian.Uint32(tmpl[16:]); spi != 0x2222 {
+		t.Errorf("policy template SPI = %#x, want 0x2222", spi)
+	}
+
+	remove := xfrmRemoveMessages(sa)
+	if len(remove) != 12 || remove[0].typ != xfrmMsgDelPolicy || remove[11].typ != xfrmMsgDelSA {
+		t.Errorf("xfrmRemoveMessages() = %v, want policies before states", remove)
+	}
+	if len(remove[0].data) != sizeofXfrmUserpolicyID || len(remove[11].data) != sizeofXfrmUsersaID {
+		t.Errorf("delete requests of %d and %d bytes", len(remove[0].data), len(remove[11].data))
+	}
+}
@@ -0,0 +1,396 @@
+package pcscf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dasmlab/ims/internal/sdp"
+	"github.com/dasmlab/ims/internal/sip"
+)
+
+// earlySessionTimeout releases the media of a session whose INVITE got no
+// final response, as Timer C of RFC 3261 would cancel it
+const earlySessionTimeout = 3 * time.Minute
+
+// SetPolicy makes the P-CSCF reserve the bearers of the media of sessions
+// with policy. The sessions policy control ends are released with BYEs sent
+// through sender, which may be nil to only release their media.
+func (h *Handler) SetPolicy(policy Policy, sender RequestSender) {
+	h.mu.Lock()
+	h.policy = policy
+	h.sender = sender
+	h.mu.Unlock()
+	policy.SetAbortHandler(h.policyAborted)
+}
+
+// HandleCoreRequest processes a request from the core towards a UE. It
+// returns the request to forward to the UE, or the response that rejects it.
+func (h *Handler) HandleCoreRequest(ctx context.Context, msg *sip.Message) (*sip.Message, *sip.Message) {
+	if response := h.chargeRequest(ctx, msg, false); response != nil {
+		return nil, response
+	}
+	// The UE is outside the trust domain
+	sip.Egress(msg)
+	if response := h.mediaRequest(ctx, msg, false); response != nil {
+		h.chargeResponse(ctx, response)
+		return nil, response
+	}
+	return msg, nil
+}
+
+// HandleUEResponse processes a response from a UE towards the core and
+// returns the response to forward
+func (h *Handler) HandleUEResponse(ctx context.Context, msg *sip.Message) *sip.Message {
+	policeUE(msg)
+	h.chargeResponse(ctx, msg)
+	h.mediaResponse(ctx, msg, true)
+	return msg
+}
+
+// mediaRequest authorizes the media of an SDP offer in a request of the UE,
+// or of the core towards it, and releases it on BYE and CANCEL (TS 24.229
+// section 5.2.7). It returns the response rejecting the request when the
+// bearers cannot be reserved. With charging, sessions are tracked without
+// SDP too, for the BYEs that end them when their credit runs out.
+func (h *Handler) mediaRequest(ctx context.Context, msg *sip.Message, fromUE bool) *sip.Message {
+	callID := msg.GetHeader("Call-ID")
+	h.mu.Lock()
+	policy := h.policy
+	charged := h.charger != nil
+	s, exists := h.sessions[callID]
+	h.mu.Unlock()
+	if policy == nil && !charged {
+		return nil
+	}
+
+	cseq, _ := splitCSeq(msg)
+	if exists {
+		s.mu.Lock()
+		if cseq > s.cseq {
+			s.cseq = cseq
+		}
+		s.mu.Unlock()
+	}
+
+	switch msg.Method {
+	case sip.MethodBYE, sip.MethodCANCEL:
+		if exists {
+			h.releaseMedia(ctx, s)
+		}
+		return nil
+	case sip.MethodINVITE, sip.MethodUPDATE:
+	default:
+		return nil
+	}
+	offer, ok, err := sdpBody(msg)
+	if err != nil {
+		h.log.WithError(err).WithField("call-id", callID).Warn("invalid SDP offer")
+		return newResponse(msg, sip.StatusNotAcceptableHere, "Not Acceptable Here")
+	}
+
+	if !exists {
+		if msg.Method != sip.MethodINVITE || (!ok && !charged) {
+			return nil
+		}
+		s = h.newMediaSession(msg, fromUE, cseq)
+	}
+
+	if ok && policy != nil {
+		s.mu.Lock()
+		if fromUE {
+			s.Local = offer
+		} else {
+			s.Remote = offer
+		}
+		s.LocalOffer = fromUE
+		err := policy.Authorize(ctx, s)
+		s.mu.Unlock()
+		if err != nil {
+			h.log.WithError(err).WithField("call-id", callID).Warn("cannot reserve media bearers")
+			if errors.Is(err, ErrNotAuthorized) {
+				return newResponse(msg, sip.StatusNotAcceptableHere, "Not Acceptable Here")
+			}
+			return newResponse(msg, sip.StatusServiceUnavailable, "Service Unavailable")
+		}
+	}
+	if !exists {
+		h.mu.Lock()
+		h.sessions[callID] = s
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// newMediaSession creates the media session of an initial INVITE
+func (h *Handler) newMediaSession(msg *sip.Message, fromUE bool, cseq int) *MediaSession {
+	s := &MediaSession{
+		CallID:        msg.GetHeader("Call-ID"),
+		Originating:   fromUE,
+		created:       h.now(),
+		cseq:          cseq,
+		callerContact: firstURI(msg.GetHeaderAll("Contact")),
+	}
+	if fromUE {
+		s.UE, _ = splitAddr(msg.RemoteAddr)
+		s.Identity = firstURI(msg.GetHeaderAll("P-Asserted-Identity"))
+		if strings.HasPrefix(strings.ToLower(msg.URI), "urn:service:") {
+			s.ServiceURN = msg.URI[len("urn:service:"):]
+		}
+	} else {
+		s.UE = net.ParseIP(uriHost(msg.URI))
+		s.Identity = firstURI(msg.GetHeaderAll("P-Called-Party-ID"))
+		if s.Identity == "" {
+			s.Identity = firstURI(msg.GetHeaderAll("To"))
+		}
+	}
+	return s
+}
+
+// mediaResponse updates the media of a session with the SDP answer of a
+// response from the UE, or of the core towards it. Reservation failures on
+// the answer are only logged: the bearers of the offer stay reserved. An
+// initial INVITE that fails releases the media.
+func (h *Handler) mediaResponse(ctx context.Context, msg *sip.Message, fromUE bool) {
+	_, method := splitCSeq(msg)
+	if method != sip.MethodINVITE && method != sip.MethodUPDATE {
+		return
+	}
+	callID := msg.GetHeader("Call-ID")
+	h.mu.Lock()
+	policy := h.policy
+	s := h.sessions[callID]
+	h.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	established := s.established
+	s.mu.Unlock()
+	if msg.StatusCode >= 300 {
+		if method == sip.MethodINVITE && !established {
+			h.releaseMedia(ctx, s)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.StatusCode >= 200 && method == sip.MethodINVITE && !s.established {
+		s.established = true
+		s.caller = msg.GetHeader("From")
+		s.callee = msg.GetHeader("To")
+		s.calleeContact = firstURI(msg.GetHeaderAll("Contact"))
+		s.routes = nil
+		for _, value := range msg.GetHeaderAll("Record-Route") {
+			s.routes = append(s.routes, splitNameAddrs(value)...)
+		}
+	}
+
+	if policy == nil {
+		return
+	}
+	answer, ok, err := sdpBody(msg)
+	if err != nil {
+		h.log.WithError(err).WithField("call-id", callID).Warn("invalid SDP answer")
+		return
+	}
+	if !ok {
+		return
+	}
+	if fromUE {
+		s.Local = answer
+	} else {
+		s.Remote = answer
+	}
+	if err := policy.Authorize(ctx, s); err != nil {
+		h.log.WithError(err).WithField("call-id", callID).Warn("cannot update media bearers with the answer")
+	}
+}
+
+// releaseMedia forgets s and ends its policy session
+func (h *Handler) releaseMedia(ctx context.Context, s *MediaSession) {
+	h.mu.Lock()
+	policy := h.policy
+	if h.sessions[s.CallID] == s {
+		delete(h.sessions, s.CallID)
+	}
+	h.mu.Unlock()
+	if policy == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := policy.Release(ctx, s); err != nil {
+		h.log.WithError(err).WithField("call-id", s.CallID).Warn("cannot release media bearers")
+	}
+}
+
+// expireMedia releases the media of the sessions whose initial INVITE got
+// no final response in time
+func (h *Handler) expireMedia(ctx context.Context, now time.Time) {
+	h.mu.Lock()
+	sessions := make([]*MediaSession, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.mu.Lock()
+		expired := !s.established && now.Sub(s.created) > earlySessionTimeout
+		s.mu.Unlock()
+		if expired {
+			h.releaseMedia(ctx, s)
+		}
+	}
+}
+
+// policyAborted releases a session policy control ended: its media is gone
+// and an established dialog is ended with a BYE to the UE and one to the
+// core (TS 24.229 section 5.2.8.1.2)
+func (h *Handler) policyAborted(callID string) {
+	h.mu.Lock()
+	s := h.sessions[callID]
+	delete(h.sessions, callID)
+	h.mu.Unlock()
+	if s == nil {
+		return
+	}
+	h.log.WithField("call-id", callID).Info("session ended by policy control")
+	h.endDialog(s, `SIP;cause=503;text="Media bearer released"`)
+}
+
+// endDialog sends the BYEs that end the dialog of s, once it is established,
+// with reason as their Reason header. s is no longer in h.sessions.
+func (h *Handler) endDialog(s *MediaSession, reason string) {
+	h.mu.Lock()
+	sender := h.sender
+	charger := h.charger
+	h.mu.Unlock()
+
+	s.mu.Lock()
+	established := s.established
+	var byes []*sip.Message
+	if established {
+		byes = s.byes(reason)
+	}
+	s.mu.Unlock()
+	if !established {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if charger != nil {
+		// The session is charged as ended by the BYE to the UE
+		charger.Request(ctx, byes[0], s.Originating)
+	}
+	if sender == nil {
+		return
+	}
+	for _, bye := range byes {
+		if err := sender.SendRequest(ctx, bye); err != nil {
+			h.log.WithError(err).WithField("call-id", s.CallID).Warn("cannot send BYE")
+		}
+	}
+}
+
+// byes builds the BYE to the UE and the one to its peer that end the dialog
+// of s, the BYE to the UE first. The BYE to the peer follows the route set
+// of the UE past the P-CSCF. s.mu is held.
+func (s *MediaSession) byes(reason string) []*sip.Message {
+	// The route set of the caller is the reverse of the Record-Route
+	routes := append([]string(nil), s.routes...)
+	if s.Originating {
+		for i, j := 0, len(routes)-1; i < j; i, j = i+1, j-1 {
+			routes[i], routes[j] = routes[j], routes[i]
+		}
+	}
+	if len(routes) > 0 {
+		routes = routes[1:]
+	}
+
+	// Towards the callee the caller's From is the local party
+	toCallee := s.bye(s.calleeContact, s.caller, s.callee, reason)
+	toCaller := s.bye(s.callerContact, s.callee, s.caller, reason)
+	if s.Originating {
+		for _, route := range routes {
+			toCallee.AddHeader("Route", route)
+		}
+		return []*sip.Message{toCaller, toCallee}
+	}
+	for _, route := range routes {
+		toCaller.AddHeader("Route", route)
+	}
+	return []*sip.Message{toCallee, toCaller}
+}
+
+// bye builds a BYE of the dialog of s to target
+func (s *MediaSession) bye(target, from, to, reason string) *sip.Message {
+	msg := &sip.Message{
+		Method:  sip.MethodBYE,
+		URI:     target,
+		Version: "SIP/2.0",
+		Headers: make(map[string][]string),
+	}
+	msg.SetHeader("Max-Forwards", "70")
+	msg.SetHeader("From", from)
+	msg.SetHeader("To", to)
+	msg.SetHeader("Call-ID", s.CallID)
+	msg.SetHeader("CSeq", strconv.Itoa(s.cseq+1)+" "+sip.MethodBYE)
+	msg.SetHeader("Reason", reason)
+	msg.SetHeader("Content-Length", "0")
+	return msg
+}
+
+// sdpBody parses the SDP body of msg; ok is false when it has none
+func sdpBody(msg *sip.Message) (*sdp.Session, bool, error) {
+	contentType, _, _ := strings.Cut(msg.GetHeader("Content-Type"), ";")
+	if !strings.EqualFold(strings.TrimSpace(contentType), sdp.ContentType) || strings.TrimSpace(msg.Body) == "" {
+		return nil, false, nil
+	}
+	s, err := sdp.Parse(msg.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return s, true, nil
+}
+
+// splitCSeq returns the sequence number and method of the CSeq of msg
+func splitCSeq(msg *sip.Message) (int, string) {
+	number, method, _ := strings.Cut(strings.TrimSpace(msg.GetHeader("CSeq")), " ")
+	n, _ := strconv.Atoi(number)
+	return n, strings.ToUpper(strings.TrimSpace(method))
+}
+
+// firstURI returns the first URI of name-addr header values
+func firstURI(values []string) string {
+	if uris := nameAddrURIs(values); len(uris) > 0 {
+		return uris[0]
+	}
+	return ""
+}
+
+// uriHost returns the host of a SIP URI
+func uriHost(uri string) string {
+	_, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return ""
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	if i := strings.IndexAny(rest, ";?>"); i >= 0 {
+		rest = rest[:i]
+	}
+	if host, _, err := net.SplitHostPort(rest); err == nil {
+		return host
+	}
+	return strings.Trim(rest, "[]")
+}
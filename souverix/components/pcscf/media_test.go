@@ -0,0 +1,278 @@
+package pcscf
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rx"
+)
+
+// fakeSender records the requests the P-CSCF originates
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []*sip.Message
+}
+
+func (f *fakeSender) SendRequest(ctx context.Context, req *sip.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, req)
+	return nil
+}
+
+func (f *fakeSender) Sent() []*sip.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*sip.Message(nil), f.sent...)
+}
+
+// connectPCRF connects an Rx policy to pcrf over Diameter and returns the
+// policy and the PCRF's client towards the P-CSCF
+func connectPCRF(t *testing.T, pcrf *FakePCRF) (*RxPolicy, *rx.Client) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := diameter.NewServer(&diameter.Config{
+		OriginHost:   "pcrf.ims.local",
+		OriginRealm:  "ims.local",
+		VendorID:     rx.Vendor3GPP,
+		Applications: []diameter.Application{rx.Application},
+		Handler:      &rx.Handler{PCRF: pcrf},
+		Log:          testLogger(),
+	})
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close(context.Background()) })
+
+	policy, err := DialRxPolicy(context.Background(), &config.PCSCFConfig{
+		AFApplicationID: "IMS Services",
+		PCRFAddr:        l.Addr().String(),
+		DiameterHost:    "pcscf.ims.local",
+		DiameterRealm:   "ims.local",
+	}, testLogger())
+	if err != nil {
+		t.Fatalf("DialRxPolicy() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Peer("pcscf.ims.local") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("P-CSCF peer not registered on the PCRF")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return policy, rx.NewClient(server.Peer("pcscf.ims.local"))
+}
+
+func policyHandler(t *testing.T) (*Handler, *FakePCRF, *rx.Client, *fakeSender) {
+	t.Helper()
+	h, _ := testHandler(false)
+	pcrf := NewFakePCRF()
+	policy, client := connectPCRF(t, pcrf)
+	sender := &fakeSender{}
+	h.SetPolicy(policy, sender)
+	return h, pcrf, client, sender
+}
+
+// withSDP sets the SDP body of msg
+func withSDP(msg *sip.Message, body string) *sip.Message {
+	msg.SetHeader("Content-Type", "application/sdp")
+	msg.Body = body
+	return msg
+}
+
+func ueInvite(callID string) *sip.Message {
+	msg := withSDP(ueRequest(sip.MethodINVITE, callID, 5060, 5060), ueOffer)
+	msg.URI = "sip:bob@ims.local"
+	msg.SetHeader("To", "<sip:bob@ims.local>")
+	msg.SetHeader("Contact", "<sip:alice@10.0.0.2:5060>")
+	return msg
+}
+
+func answered(req *sip.Message) *sip.Message {
+	response := withSDP(coreResponse(req, sip.StatusOK, "OK"), peerAnswer)
+	response.SetHeader("To", "<sip:bob@ims.local>;tag=2")
+	response.SetHeader("Contact", "<sip:bob@198.51.100.1:5060>")
+	response.AddHeader("Record-Route", "<sip:scscf.ims.local;lr>, <sip:pcscf.ims.local;lr>")
+	return response
+}
+
+// waitFor polls cond until it holds or a second passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandler_MediaPolicy(t *testing.T) {
+	ctx := context.Background()
+	h, pcrf, _, _ := policyHandler(t)
+
+	invite := ueInvite("call-1")
+	invite.URI = "urn:service:sos"
+	forward, response := h.HandleRequest(ctx, invite)
+	if response != nil {
+		t.Fatalf("INVITE rejected with %d", response.StatusCode)
+	}
+	ids := pcrf.Sessions()
+	if len(ids) != 1 {
+		t.Fatalf("PCRF sessions = %v, want 1", ids)
+	}
+	aar, _ := pcrf.Session(ids[0])
+	if aar.RequestType != rx.RequestInitial || !aar.UEAddress.Equal(net.ParseIP("10.0.0.2")) ||
+		aar.ServiceURN != "sos" || aar.AFApplicationID != "IMS Services" || len(aar.MediaComponents) != 2 || len(aar.SpecificActions) != 3 {
+		t.Errorf("initial AAR = %+v", aar)
+	}
+
+	// The answer updates the session with the peer's flows
+	h.HandleResponse(ctx, answered(forward))
+	aar, _ = pcrf.Session(ids[0])
+	if aar.RequestType != rx.RequestUpdate || len(aar.MediaComponents[0].CodecData) != 2 || aar.MediaComponents[1].FlowStatus != rx.FlowRemoved {
+		t.Errorf("AAR with the answer = %+v", aar)
+	}
+
+	bye := ueRequest(sip.MethodBYE, "call-1", 5060, 5060)
+	bye.SetHeader("CSeq", "2 BYE")
+	if _, response := h.HandleRequest(ctx, bye); response != nil {
+		t.Fatalf("BYE rejected with %d", response.StatusCode)
+	}
+	if terminated := pcrf.Terminated(); len(terminated) != 1 || terminated[0] != ids[0] {
+		t.Errorf("terminated sessions = %v, want %v", terminated, ids)
+	}
+}
+
+func TestHandler_MediaPolicyRejected(t *testing.T) {
+	ctx := context.Background()
+	h, pcrf, _, _ := policyHandler(t)
+
+	tests := []struct {
+		name   string
+		result diameter.Result
+		want   int
+	}{
+		{"not authorized", rx.Experimental(rx.ResultRequestedServiceNotAuthorized), sip.StatusNotAcceptableHere},
+		{"filter restrictions", rx.Experimental(rx.ResultFilterRestrictions), sip.StatusNotAcceptableHere},
+		{"unable to comply", diameter.Result{Code: diameter.ResultUnableToComply}, sip.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pcrf.Reject(tt.result)
+			forward, response := h.HandleRequest(ctx, ueInvite("call-"+tt.name))
+			if forward != nil || response == nil || response.StatusCode != tt.want {
+				t.Errorf("HandleRequest() = %v, %v, want a %d response", forward, response, tt.want)
+			}
+		})
+	}
+
+	pcrf.Reject(rx.Success)
+	if _, response := h.HandleRequest(ctx, withSDP(ueInvite("call-bad"), "v=0\r\nm=audio\r\n")); response == nil || response.StatusCode != sip.StatusNotAcceptableHere {
+		t.Errorf("INVITE with an invalid SDP response = %v", response)
+	}
+	if len(pcrf.Sessions()) != 0 {
+		t.Errorf("PCRF sessions = %v, want none", pcrf.Sessions())
+	}
+}
+
+func TestHandler_MediaPolicyTerminating(t *testing.T) {
+	ctx := context.Background()
+	h, pcrf, _, _ := policyHandler(t)
+
+	invite := withSDP(ueRequest(sip.MethodINVITE, "call-1", 5060, 5060), peerAnswer)
+	invite.URI = "sip:alice@10.0.0.2:5060"
+	invite.RemoteAddr = "10.0.1.1:5060"
+	invite.SetHeader("P-Called-Party-ID", "<sip:alice@ims.local>")
+	if _, response := h.HandleCoreRequest(ctx, invite); response != nil {
+		t.Fatalf("INVITE rejected with %d", response.StatusCode)
+	}
+	ids := pcrf.Sessions()
+	if len(ids) != 1 {
+		t.Fatalf("PCRF sessions = %v, want 1", ids)
+	}
+	if aar, _ := pcrf.Session(ids[0]); !aar.UEAddress.Equal(net.ParseIP("10.0.0.2")) || aar.SubscriptionID != "sip:alice@ims.local" {
+		t.Errorf("initial AAR = %+v", aar)
+	}
+
+	// The failure of the initial INVITE ends the session
+	busy := newResponse(invite, sip.StatusBusyHere, "Busy Here")
+	if h.HandleUEResponse(ctx, busy) != busy {
+		t.Error("HandleUEResponse() did not return the response")
+	}
+	if terminated := pcrf.Terminated(); len(terminated) != 1 {
+		t.Errorf("terminated sessions = %v, want %v", terminated, ids)
+	}
+}
+
+func TestHandler_MediaPolicyAborted(t *testing.T) {
+	ctx := context.Background()
+	h, pcrf, client, sender := policyHandler(t)
+
+	forward, _ := h.HandleRequest(ctx, ueInvite("call-1"))
+	h.HandleResponse(ctx, answered(forward))
+	id := pcrf.Sessions()[0]
+
+	asa, err := client.AbortSession(ctx, &rx.ASR{SessionID: id, AbortCause: rx.AbortBearerReleased})
+	if err != nil || asa.Result != rx.Success {
+		t.Fatalf("AbortSession() = %+v, %v", asa, err)
+	}
+	waitFor(t, "the STR", func() bool { return len(pcrf.Terminated()) == 1 })
+	waitFor(t, "the BYEs", func() bool { return len(sender.Sent()) == 2 })
+
+	toUE, toPeer := sender.Sent()[0], sender.Sent()[1]
+	if toUE.URI != "sip:alice@10.0.0.2:5060" || toUE.GetHeader("From") != "<sip:bob@ims.local>;tag=2" ||
+		toUE.GetHeader("CSeq") != "2 BYE" || len(toUE.GetHeaderAll("Route")) != 0 {
+		t.Errorf("BYE to the UE = %s %v", toUE.URI, toUE.Headers)
+	}
+	if toPeer.URI != "sip:bob@198.51.100.1:5060" || toPeer.GetHeader("To") != "<sip:bob@ims.local>;tag=2" ||
+		toPeer.GetHeader("Route") != "<sip:scscf.ims.local;lr>" || toPeer.GetHeader("Reason") == "" {
+		t.Errorf("BYE to the peer = %s %v", toPeer.URI, toPeer.Headers)
+	}
+
+	// The session is gone
+	asa, err = client.AbortSession(ctx, &rx.ASR{SessionID: id})
+	if err != nil || asa.Result.Code != diameter.ResultUnknownSessionID {
+		t.Errorf("second AbortSession() = %+v, %v", asa, err)
+	}
+}
+
+func TestHandler_MediaPolicyExpiry(t *testing.T) {
+	ctx := context.Background()
+	h, pcrf, client, sender := policyHandler(t)
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	h.HandleRequest(ctx, ueInvite("call-1"))
+	id := pcrf.Sessions()[0]
+
+	h.Expire(ctx)
+	if len(pcrf.Terminated()) != 0 {
+		t.Fatal("session released before the INVITE timed out")
+	}
+	now = now.Add(earlySessionTimeout + time.Second)
+	h.Expire(ctx)
+	if terminated := pcrf.Terminated(); len(terminated) != 1 || terminated[0] != id {
+		t.Errorf("terminated sessions = %v, want [%s]", terminated, id)
+	}
+
+	// The release of the bearer of an early session sends no BYE
+	h.HandleRequest(ctx, ueInvite("call-2"))
+	raa, err := client.ReAuth(ctx, &rx.RAR{SessionID: pcrf.Sessions()[0], SpecificActions: []uint32{rx.ActionIndicationOfReleaseOfBearer}})
+	if err != nil || raa.Result != rx.Success {
+		t.Fatalf("ReAuth() = %+v, %v", raa, err)
+	}
+	waitFor(t, "the STR", func() bool { return len(pcrf.Terminated()) == 2 })
+	if len(sender.Sent()) != 0 {
+		t.Errorf("BYEs sent for an early session: %v", sender.Sent())
+	}
+}
@@ -0,0 +1,426 @@
+package pcscf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/souverix/common/diameter/rx"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// n5Timeout bounds a request to the PCF
+const n5Timeout = 5 * time.Second
+
+// N5 events the P-CSCF subscribes to (TS 29.514 section 5.6.3.3)
+const (
+	eventFailedResourcesAllocation = "FAILED_RESOURCES_ALLOCATION"
+	eventLossOfBearer              = "LOSS_OF_BEARER"
+	eventReleaseOfBearer           = "RELEASE_OF_BEARER"
+)
+
+// n5MediaComponent is a MediaComponent of Npcf_PolicyAuthorization
+type n5MediaComponent struct {
+	MedCompN    int                            `json:"medCompN"`
+	MedType     string                         `json:"medType,omitempty"`
+	FStatus     string                         `json:"fStatus,omitempty"`
+	MarBwUl     string                         `json:"marBwUl,omitempty"`
+	MarBwDl     string                         `json:"marBwDl,omitempty"`
+	Codecs      []string                       `json:"codecs,omitempty"`
+	MedSubComps map[string]n5MediaSubComponent `json:"medSubComps,omitempty"`
+}
+
+// n5MediaSubComponent is a MediaSubComponent of Npcf_PolicyAuthorization
+type n5MediaSubComponent struct {
+	FNum      int      `json:"fNum"`
+	FDescs    []string `json:"fDescs,omitempty"`
+	FlowUsage string   `json:"flowUsage,omitempty"`
+}
+
+// n5EventsSubscription is an EventsSubscReqData
+type n5EventsSubscription struct {
+	Events []struct {
+		Event string `json:"event"`
+	} `json:"events"`
+	NotifURI string `json:"notifUri"`
+}
+
+// n5AppSessionRequest is the AppSessionContextReqData of a new app session,
+// or with only MedComponents the AppSessionContextUpdateData of an update
+type n5AppSessionRequest struct {
+	AFAppID       string                      `json:"afAppId,omitempty"`
+	MedComponents map[string]n5MediaComponent `json:"medComponents,omitempty"`
+	NotifURI      string                      `json:"notifUri,omitempty"`
+	SuppFeat      string                      `json:"suppFeat,omitempty"`
+	UEIPv4        string                      `json:"ueIpv4,omitempty"`
+	UEIPv6        string                      `json:"ueIpv6,omitempty"`
+	ServURN       string                      `json:"servUrn,omitempty"`
+	EvSubsc       *n5EventsSubscription       `json:"evSubsc,omitempty"`
+}
+
+// n5ProblemDetails is the ProblemDetails of an error response
+type n5ProblemDetails struct {
+	Status int    `json:"status"`
+	Cause  string `json:"cause"`
+	Detail string `json:"detail"`
+}
+
+// n5Session is an app session of the PCF
+type n5Session struct {
+	callID string
+	uri    string
+}
+
+// N5Policy authorizes media with a PCF through its Npcf_PolicyAuthorization
+// service (TS 29.514), the 5G counterpart of Rx. Requests use HTTP/2, over
+// cleartext with prior knowledge for http URLs. The PCF notifies the P-CSCF
+// at the routes RegisterRoutes adds, authenticated with an OAuth2 bearer
+// token, under a random notification id per app session.
+type N5Policy struct {
+	apiRoot      string
+	notifyURL    string
+	notifyTokens []string
+	appID        string
+	client       *http.Client
+	log          *logrus.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*n5Session // key: notification id
+	aborted  func(callID string)
+}
+
+// NewN5Policy creates the N5 policy of the P-CSCF configured in cfg
+func NewN5Policy(cfg *config.PCSCFConfig, log *logrus.Logger) *N5Policy {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	if len(cfg.PolicyNotifyTokens) == 0 {
+		log.Warn("no PCF notification tokens configured, PCF notifications are refused")
+	}
+	return &N5Policy{
+		apiRoot:      strings.TrimRight(cfg.PCFURL, "/"),
+		notifyURL:    strings.TrimRight(cfg.PolicyNotifyURL, "/"),
+		notifyTokens: cfg.PolicyNotifyTokens,
+		appID:        cfg.AFApplicationID,
+		client:       &http.Client{Transport: transport, Timeout: n5Timeout},
+		log:          log,
+		sessions:     make(map[string]*n5Session),
+	}
+}
+
+// n5NotificationID returns a random notification id of 128 bits, so the
+// notification URIs of app sessions cannot be guessed
+func n5NotificationID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// SetAbortHandler implements Policy
+func (p *N5Policy) SetAbortHandler(aborted func(callID string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aborted = aborted
+}
+
+// Authorize creates the app session of s, or updates it once it exists
+// (TS 29.514 section 4.2.2 and 4.2.3)
+func (p *N5Policy) Authorize(ctx context.Context, s *MediaSession) error {
+	components := n5MediaComponents(mediaComponents(s))
+	if s.policyID != "" {
+		body := map[string]interface{}{"ascReqData": n5AppSessionRequest{MedComponents: components}}
+		_, err := p.request(ctx, http.MethodPatch, s.policyID, "application/merge-patch+json", body)
+		return err
+	}
+
+	id, err := n5NotificationID()
+	if err != nil {
+		return fmt.Errorf("cannot allocate notification id: %w", err)
+	}
+	notifyURI := p.notifyURL + "/" + id
+
+	req := n5AppSessionRequest{
+		AFAppID:       p.appID,
+		MedComponents: components,
+		NotifURI:      notifyURI,
+		SuppFeat:      "0",
+		ServURN:       s.ServiceURN,
+		EvSubsc:       &n5EventsSubscription{NotifURI: notifyURI},
+	}
+	if ip4 := s.UE.To4(); ip4 != nil {
+		req.UEIPv4 = ip4.String()
+	} else if s.UE != nil {
+		req.UEIPv6 = s.UE.String()
+	}
+	for _, event := range []string{eventLossOfBearer, eventReleaseOfBearer, eventFailedResourcesAllocation} {
+		req.EvSubsc.Events = append(req.EvSubsc.Events, struct {
+			Event string `json:"event"`
+		}{event})
+	}
+
+	resp, err := p.request(ctx, http.MethodPost, p.apiRoot+"/npcf-policyauthorization/v1/app-sessions", "application/json",
+		map[string]interface{}{"ascReqData": req})
+	if err != nil {
+		return err
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("app session created without a location: %w", err)
+	}
+
+	s.policyID = location.String()
+	p.mu.Lock()
+	p.sessions[id] = &n5Session{callID: s.CallID, uri: s.policyID}
+	p.mu.Unlock()
+	return nil
+}
+
+// Release deletes the app session of s (TS 29.514 section 4.2.4)
+func (p *N5Policy) Release(ctx context.Context, s *MediaSession) error {
+	if s.policyID == "" {
+		return nil
+	}
+	p.mu.Lock()
+	for id, session := range p.sessions {
+		if session.uri == s.policyID {
+			delete(p.sessions, id)
+		}
+	}
+	p.mu.Unlock()
+	_, err := p.request(ctx, http.MethodPost, s.policyID+"/delete", "application/json", nil)
+	return err
+}
+
+// request sends a request to the PCF. Error responses are returned as
+// errors, wrapping ErrNotAuthorized when the PCF refuses the service.
+func (p *N5Policy) request(ctx context.Context, method, target, contentType string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("PCF request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var problem n5ProblemDetails
+		json.NewDecoder(resp.Body).Decode(&problem)
+		switch problem.Cause {
+		case "REQUESTED_SERVICE_NOT_AUTHORIZED", "INVALID_SERVICE_INFORMATION", "FILTER_RESTRICTIONS":
+			return nil, fmt.Errorf("%w: %s", ErrNotAuthorized, problem.Cause)
+		}
+		return nil, fmt.Errorf("PCF returned status %d: %s %s", resp.StatusCode, problem.Cause, problem.Detail)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp, nil
+}
+
+// RegisterRoutes registers the notification routes of the PCF under the
+// path of the configured notification URL
+func (p *N5Policy) RegisterRoutes(r gin.IRouter) {
+	path := "/"
+	if u, err := url.Parse(p.notifyURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	group := r.Group(path, p.authenticate())
+	group.POST("/:id/terminate", p.terminate)
+	group.POST("/:id/notify", p.notify)
+}
+
+// authenticate checks the OAuth2 bearer token of a PCF notification
+// (TS 29.500 section 6.7.3)
+func (p *N5Policy) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok {
+			ok = false
+			for _, t := range p.notifyTokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			p.log.WithField("remote_addr", c.ClientIP()).Warn("PCF notification without a valid bearer token")
+			c.Header("WWW-Authenticate", `Bearer realm="pcscf-policy-notify"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, n5ProblemDetails{
+				Status: http.StatusUnauthorized, Cause: "UNAUTHORIZED", Detail: "invalid or missing bearer token",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// terminate handles the termination request of the PCF: the session ends
+// and its app session is deleted (TS 29.514 section 4.2.5.3)
+func (p *N5Policy) terminate(c *gin.Context) {
+	var info struct {
+		TermCause string `json:"termCause"`
+	}
+	if err := c.ShouldBindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !p.abort(c.Param("id")) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	p.log.WithFields(logrus.Fields{"id": c.Param("id"), "cause": info.TermCause}).Info("PCF terminated app session")
+	c.Status(http.StatusNoContent)
+}
+
+// notify handles the event notifications of the PCF. The release of the
+// bearers of a session, or the failure to allocate them, ends it; the loss
+// of a bearer is only logged, as it may be recovered.
+func (p *N5Policy) notify(c *gin.Context) {
+	var notification struct {
+		EvNotifs []struct {
+			Event string `json:"event"`
+		} `json:"evNotifs"`
+	}
+	if err := c.ShouldBindJSON(&notification); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id := c.Param("id")
+	p.mu.Lock()
+	_, ok := p.sessions[id]
+	p.mu.Unlock()
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	for _, n := range notification.EvNotifs {
+		switch n.Event {
+		case eventReleaseOfBearer, eventFailedResourcesAllocation:
+			p.log.WithFields(logrus.Fields{"id": id, "event": n.Event}).Info("bearer released, ending session")
+			p.abort(id)
+			c.Status(http.StatusNoContent)
+			return
+		case eventLossOfBearer:
+			p.log.WithField("id", id).Warn("bearer lost")
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// abort ends the app session with notification id in the background: the
+// SIP session is released then the app session deleted. It reports whether
+// the session existed.
+func (p *N5Policy) abort(id string) bool {
+	p.mu.Lock()
+	session, ok := p.sessions[id]
+	delete(p.sessions, id)
+	aborted := p.aborted
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	go func() {
+		if aborted != nil {
+			aborted(session.callID)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), n5Timeout)
+		defer cancel()
+		if _, err := p.request(ctx, http.MethodPost, session.uri+"/delete", "application/json", nil); err != nil {
+			p.log.WithError(err).WithField("session", session.uri).Warn("cannot delete aborted app session")
+		}
+	}()
+	return true
+}
+
+// n5MediaComponents converts Rx media components to their N5 form
+func n5MediaComponents(components []rx.MediaComponent) map[string]n5MediaComponent {
+	converted := make(map[string]n5MediaComponent, len(components))
+	for _, c := range components {
+		n5 := n5MediaComponent{
+			MedCompN: int(c.Number),
+			MedType:  n5MediaTypes[c.MediaType],
+			FStatus:  n5FlowStatuses[c.FlowStatus],
+			MarBwUl:  bitRate(c.MaxRequestedBandwidthUL),
+			MarBwDl:  bitRate(c.MaxRequestedBandwidthDL),
+			Codecs:   c.CodecData,
+		}
+		for _, sub := range c.SubComponents {
+			if n5.MedSubComps == nil {
+				n5.MedSubComps = make(map[string]n5MediaSubComponent)
+			}
+			usage := "NO_INFO"
+			if sub.FlowUsage == rx.UsageRTCP {
+				usage = "RTCP"
+			}
+			n5.MedSubComps[strconv.Itoa(int(sub.FlowNumber))] = n5MediaSubComponent{
+				FNum:      int(sub.FlowNumber),
+				FDescs:    sub.FlowDescriptions,
+				FlowUsage: usage,
+			}
+		}
+		converted[strconv.Itoa(int(c.Number))] = n5
+	}
+	return converted
+}
+
+// n5MediaTypes maps Media-Type values to MediaType
+var n5MediaTypes = map[uint32]string{
+	rx.MediaAudio:       "AUDIO",
+	rx.MediaVideo:       "VIDEO",
+	rx.MediaData:        "DATA",
+	rx.MediaApplication: "APPLICATION",
+	rx.MediaControl:     "CONTROL",
+	rx.MediaText:        "TEXT",
+	rx.MediaMessage:     "MESSAGE",
+	rx.MediaOther:       "OTHER",
+}
+
+// n5FlowStatuses maps Flow-Status values to FlowStatus
+var n5FlowStatuses = map[uint32]string{
+	rx.FlowEnabledUplink:   "ENABLED-UPLINK",
+	rx.FlowEnabledDownlink: "ENABLED-DOWNLINK",
+	rx.FlowEnabled:         "ENABLED",
+	rx.FlowDisabled:        "DISABLED",
+	rx.FlowRemoved:         "REMOVED",
+}
+
+// bitRate formats bits per second as a BitRate of TS 29.571, "" for zero
+func bitRate(bps uint32) string {
+	switch {
+	case bps == 0:
+		return ""
+	case bps%1000 == 0:
+		return strconv.FormatUint(uint64(bps/1000), 10) + " Kbps"
+	default:
+		return strconv.FormatUint(uint64(bps), 10) + " bps"
+	}
+}
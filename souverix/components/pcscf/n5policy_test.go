@@ -0,0 +1,207 @@
+package pcscf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/gin-gonic/gin"
+)
+
+// fakePCF serves the app sessions of Npcf_PolicyAuthorization over h2c
+type fakePCF struct {
+	mu       sync.Mutex
+	cause    string
+	requests []string // method and path, in order
+	created  n5AppSessionRequest
+	updated  n5AppSessionRequest
+}
+
+func (f *fakePCF) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.ProtoMajor != 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.cause != "" {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(n5ProblemDetails{Status: http.StatusForbidden, Cause: f.cause})
+		return
+	}
+
+	var body struct {
+		AscReqData n5AppSessionRequest `json:"ascReqData"`
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/npcf-policyauthorization/v1/app-sessions":
+		json.NewDecoder(r.Body).Decode(&body)
+		f.created = body.AscReqData
+		w.Header().Set("Location", "/npcf-policyauthorization/v1/app-sessions/1")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPatch && r.Header.Get("Content-Type") == "application/merge-patch+json":
+		json.NewDecoder(r.Body).Decode(&body)
+		f.updated = body.AscReqData
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/delete"):
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Reject makes the PCF refuse the next requests with cause
+func (f *fakePCF) Reject(cause string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cause = cause
+}
+
+// AppSessions returns the last app session creation and update requests
+func (f *fakePCF) AppSessions() (created, updated n5AppSessionRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.created, f.updated
+}
+
+func (f *fakePCF) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func startPCF(t *testing.T) (*fakePCF, string) {
+	t.Helper()
+	pcf := &fakePCF{}
+	server := httptest.NewUnstartedServer(pcf)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return pcf, server.URL
+}
+
+func TestN5Policy(t *testing.T) {
+	ctx := context.Background()
+	pcf, url := startPCF(t)
+	p := NewN5Policy(&config.PCSCFConfig{AFApplicationID: "IMS Services", PCFURL: url, PolicyNotifyURL: "http://pcscf.ims.local/npcf-notify"}, testLogger())
+
+	s := &MediaSession{CallID: "call-1", UE: net.ParseIP("10.0.0.2"), Originating: true, LocalOffer: true, Local: mustParseSDP(t, ueOffer)}
+	if err := p.Authorize(ctx, s); err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	if s.policyID != url+"/npcf-policyauthorization/v1/app-sessions/1" {
+		t.Errorf("app session = %q", s.policyID)
+	}
+	created, _ := pcf.AppSessions()
+	audio := created.MedComponents["1"]
+	id, ok := strings.CutPrefix(created.NotifURI, "http://pcscf.ims.local/npcf-notify/")
+	if !ok || len(id) != 32 {
+		t.Errorf("notification URI = %q, want a 128 bit id", created.NotifURI)
+	}
+	if created.AFAppID != "IMS Services" || created.UEIPv4 != "10.0.0.2" ||
+		created.EvSubsc == nil || len(created.EvSubsc.Events) != 3 {
+		t.Errorf("app session request = %+v", created)
+	}
+	if audio.MedType != "AUDIO" || audio.FStatus != "ENABLED" || audio.MarBwDl != "49 Kbps" || audio.MedSubComps["2"].FlowUsage != "RTCP" {
+		t.Errorf("audio media component = %+v", audio)
+	}
+
+	s.Remote = mustParseSDP(t, peerAnswer)
+	if err := p.Authorize(ctx, s); err != nil {
+		t.Fatalf("Authorize() with the answer error = %v", err)
+	}
+	if _, updated := pcf.AppSessions(); updated.AFAppID != "" || updated.MedComponents["1"].MarBwUl != "38 Kbps" || updated.MedComponents["2"].FStatus != "REMOVED" {
+		t.Errorf("app session update = %+v", updated)
+	}
+
+	if err := p.Release(ctx, s); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	want := []string{
+		"POST /npcf-policyauthorization/v1/app-sessions",
+		"PATCH /npcf-policyauthorization/v1/app-sessions/1",
+		"POST /npcf-policyauthorization/v1/app-sessions/1/delete",
+	}
+	if got := pcf.Requests(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("PCF requests = %v, want %v", got, want)
+	}
+
+	pcf.Reject("REQUESTED_SERVICE_NOT_AUTHORIZED")
+	if err := p.Authorize(ctx, &MediaSession{UE: net.ParseIP("10.0.0.3"), Local: s.Local}); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("Authorize() refused error = %v, want ErrNotAuthorized", err)
+	}
+	pcf.Reject("INSUFFICIENT_RESOURCES")
+	if err := p.Authorize(ctx, &MediaSession{UE: net.ParseIP("10.0.0.3"), Local: s.Local}); err == nil || errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("Authorize() failed error = %v", err)
+	}
+}
+
+func TestN5Policy_Notifications(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	pcf, url := startPCF(t)
+	p := NewN5Policy(&config.PCSCFConfig{
+		PCFURL: url, PolicyNotifyURL: "http://pcscf.ims.local/npcf-notify", PolicyNotifyTokens: []string{"pcf-token"},
+	}, testLogger())
+	aborted := make(chan string, 1)
+	p.SetAbortHandler(func(callID string) { aborted <- callID })
+	router := gin.New()
+	p.RegisterRoutes(router)
+
+	token := "pcf-token"
+	post := func(path, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	s := &MediaSession{CallID: "call-1", UE: net.ParseIP("10.0.0.2"), Local: mustParseSDP(t, ueOffer)}
+	if err := p.Authorize(ctx, s); err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	created, _ := pcf.AppSessions()
+	path := strings.TrimPrefix(created.NotifURI, "http://pcscf.ims.local")
+
+	// Only the PCF may end a session
+	for _, token = range []string{"", "guess"} {
+		if code := post(path+"/terminate", `{"termCause":"PDU_SESSION_TERMINATION"}`); code != http.StatusUnauthorized {
+			t.Errorf("termination with token %q status = %d, want 401", token, code)
+		}
+	}
+	token = "pcf-token"
+	if code := post("/npcf-notify/1/notify", `{"evNotifs":[{"event":"RELEASE_OF_BEARER"}]}`); code != http.StatusNotFound {
+		t.Errorf("notification of an unknown id status = %d", code)
+	}
+
+	if code := post(path+"/notify", `{"evNotifs":[{"event":"LOSS_OF_BEARER"}]}`); code != http.StatusNoContent {
+		t.Errorf("loss of bearer notification status = %d", code)
+	}
+	if code := post(path+"/notify", `{"evNotifs":[{"event":"RELEASE_OF_BEARER"}]}`); code != http.StatusNoContent {
+		t.Errorf("release of bearer notification status = %d", code)
+	}
+	if callID := <-aborted; callID != "call-1" {
+		t.Errorf("aborted Call-ID = %q", callID)
+	}
+	waitFor(t, "the app session deletion", func() bool { return len(pcf.Requests()) == 2 })
+
+	if code := post(path+"/terminate", `{"termCause":"PDU_SESSION_TERMINATION"}`); code != http.StatusNotFound {
+		t.Errorf("termination of an ended session status = %d", code)
+	}
+	if code := post(path+"/notify", `{`); code != http.StatusBadRequest {
+		t.Errorf("invalid notification status = %d", code)
+	}
+}
@@ -0,0 +1,287 @@
+package pcscf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sdp"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/souverix/common/diameter/rx"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotAuthorized is returned when policy control refuses the media of a
+// session, as opposed to failing to answer
+var ErrNotAuthorized = errors.New("media not authorized by policy control")
+
+// Policy reserves the bearers of the media of SIP sessions through policy
+// control: a PCRF over Rx or a PCF over N5
+type Policy interface {
+	// Authorize creates the policy session of s, or updates it with the
+	// current offer and answer
+	Authorize(ctx context.Context, s *MediaSession) error
+
+	// Release ends the policy session of s
+	Release(ctx context.Context, s *MediaSession) error
+
+	// SetAbortHandler sets the function called with the Call-ID of a
+	// session policy control ends on its own, after the loss of its bearer
+	SetAbortHandler(aborted func(callID string))
+}
+
+// NewPolicy creates the policy backend selected in cfg, or nil when the
+// P-CSCF reserves no bearers
+func NewPolicy(ctx context.Context, cfg *config.PCSCFConfig, log *logrus.Logger) (Policy, error) {
+	switch cfg.PolicyBackend {
+	case "":
+		return nil, nil
+	case "rx":
+		p, err := DialRxPolicy(ctx, cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case "n5":
+		if cfg.PCFURL == "" || cfg.PolicyNotifyURL == "" {
+			return nil, fmt.Errorf("the n5 policy backend needs a PCF URL and a notification URL")
+		}
+		return NewN5Policy(cfg, log), nil
+	default:
+		return nil, fmt.Errorf("unknown policy backend %q", cfg.PolicyBackend)
+	}
+}
+
+// RequestSender delivers requests originated by the P-CSCF, such as the BYE
+// of a session whose bearer was lost
+type RequestSender interface {
+	SendRequest(ctx context.Context, req *sip.Message) error
+}
+
+// MediaSession is a SIP session of a UE whose media is authorized by
+// policy control, or which is charged
+type MediaSession struct {
+	CallID      string
+	UE          net.IP       // UE address, which identifies its IP-CAN session
+	Identity    string       // Public identity of the served user
+	Originating bool         // The UE sent the initial INVITE
+	ServiceURN  string       // Emergency service URN, for emergency sessions
+	Local       *sdp.Session // Last SDP of the UE
+	Remote      *sdp.Session // Last SDP of the UE's peer
+	LocalOffer  bool         // The last offer came from the UE
+
+	// policyID is the Rx Session-Id or the N5 app session URI, set by the
+	// backend
+	policyID string
+
+	// mu serializes the policy requests of the session
+	mu          sync.Mutex
+	created     time.Time
+	established bool
+
+	// Dialog state, for the BYEs of an aborted session
+	cseq          int    // Highest CSeq of the requests of the dialog
+	caller        string // From of the dialog, with its tag
+	callee        string // To of the dialog, with its tag
+	callerContact string
+	calleeContact string
+	routes        []string // Record-Route of the 2xx response
+}
+
+// mediaComponents derives the Media-Component-Descriptions of s from the
+// SDP offer and answer of the UE and its peer (TS 29.213 section 6.2).
+// Before the answer to the first offer, the addresses of the side that did
+// not send SDP yet are left as "any".
+func mediaComponents(s *MediaSession) []rx.MediaComponent {
+	local, remote := s.Local, s.Remote
+	count := 0
+	if local != nil {
+		count = len(local.Media)
+	}
+	if remote != nil && len(remote.Media) > count {
+		count = len(remote.Media)
+	}
+
+	var components []rx.MediaComponent
+	for i := 0; i < count; i++ {
+		ue := media(local, i)
+		peer := media(remote, i)
+		typed := ue
+		if typed == nil {
+			typed = peer
+		}
+
+		c := rx.MediaComponent{
+			Number:     uint32(i + 1),
+			MediaType:  mediaType(typed.Type),
+			FlowStatus: flowStatus(local, ue, remote, peer),
+		}
+		// b=AS is the bandwidth the sender of the SDP wants to receive
+		if ue != nil {
+			if as, ok := ue.Bandwidth("AS"); ok {
+				c.MaxRequestedBandwidthDL = uint32(as) * 1000
+			}
+		}
+		if peer != nil {
+			if as, ok := peer.Bandwidth("AS"); ok {
+				c.MaxRequestedBandwidthUL = uint32(as) * 1000
+			}
+		}
+		c.CodecData = codecData(s, ue, peer)
+
+		if c.FlowStatus != rx.FlowRemoved {
+			ueAddr, uePort := endpoint(local, ue)
+			if ueAddr == "any" && s.UE != nil {
+				ueAddr = s.UE.String()
+			}
+			peerAddr, peerPort := endpoint(remote, peer)
+			proto := "17"
+			if strings.HasPrefix(strings.ToUpper(typed.Proto), "TCP") {
+				proto = "6"
+			}
+			c.SubComponents = []rx.MediaSubComponent{
+				{FlowNumber: 1, FlowDescriptions: flowDescriptions(proto, ueAddr, uePort, peerAddr, peerPort)},
+				{FlowNumber: 2, FlowUsage: rx.UsageRTCP, FlowDescriptions: flowDescriptions(proto, ueAddr, rtcpPort(ue, uePort), peerAddr, rtcpPort(peer, peerPort))},
+			}
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+// media returns the m= section i of s, if any
+func media(s *sdp.Session, i int) *sdp.Media {
+	if s == nil || i >= len(s.Media) {
+		return nil
+	}
+	return s.Media[i]
+}
+
+// endpoint returns the address and port media m is received on, "any" and
+// 0 when unknown
+func endpoint(s *sdp.Session, m *sdp.Media) (string, int) {
+	if m == nil {
+		return "any", 0
+	}
+	addr := s.ConnectionAddress(m)
+	if addr == "" {
+		return "any", m.Port
+	}
+	return addr, m.Port
+}
+
+// rtcpPort returns the RTCP port of media m received on port: its
+// a=rtcp attribute (RFC 3605), or the next port
+func rtcpPort(m *sdp.Media, port int) int {
+	if port == 0 {
+		return 0
+	}
+	if value, ok := m.Attribute("rtcp"); ok {
+		if p, err := strconv.Atoi(strings.Fields(value + " ")[0]); err == nil {
+			return p
+		}
+	}
+	return port + 1
+}
+
+// flowDescriptions returns the IPFilterRules of the downlink and uplink
+// flows between the UE and its peer. Unknown ports are left out.
+func flowDescriptions(proto, ueAddr string, uePort int, peerAddr string, peerPort int) []string {
+	ue, peer := ueAddr, peerAddr
+	if uePort > 0 {
+		ue += " " + strconv.Itoa(uePort)
+	}
+	if peerPort > 0 {
+		peer += " " + strconv.Itoa(peerPort)
+	}
+	return []string{
+		"permit out " + proto + " from " + peer + " to " + ue,
+		"permit in " + proto + " from " + ue + " to " + peer,
+	}
+}
+
+// flowStatus derives the Flow-Status of a media component from the
+// direction the UE's SDP gives it, or else the reverse of the direction
+// its peer's SDP gives it (TS 29.213 section 6.2.2)
+func flowStatus(local *sdp.Session, ue *sdp.Media, remote *sdp.Session, peer *sdp.Media) uint32 {
+	if (ue != nil && ue.Port == 0) || (peer != nil && peer.Port == 0) {
+		return rx.FlowRemoved
+	}
+	var direction string
+	switch {
+	case ue != nil:
+		direction = local.Direction(ue)
+	case peer != nil:
+		direction = map[string]string{
+			sdp.SendOnly: sdp.RecvOnly,
+			sdp.RecvOnly: sdp.SendOnly,
+		}[remote.Direction(peer)]
+		if direction == "" {
+			direction = remote.Direction(peer)
+		}
+	}
+	switch direction {
+	case sdp.SendOnly:
+		return rx.FlowEnabledUplink
+	case sdp.RecvOnly:
+		return rx.FlowEnabledDownlink
+	case sdp.Inactive:
+		return rx.FlowDisabled
+	default:
+		return rx.FlowEnabled
+	}
+}
+
+// codecData encodes the media sections of the offer and answer as
+// Codec-Data: the direction, offer or answer, then the SDP lines (TS 29.214
+// section 5.3.7)
+func codecData(s *MediaSession, ue, peer *sdp.Media) []string {
+	var data []string
+	add := func(direction string, offered bool, m *sdp.Media) {
+		if m == nil {
+			return
+		}
+		kind := "answer"
+		if offered {
+			kind = "offer"
+		}
+		data = append(data, direction+"\n"+kind+"\n"+m.String())
+	}
+	// The offer comes first
+	if s.LocalOffer {
+		add("uplink", true, ue)
+		add("downlink", false, peer)
+	} else {
+		add("downlink", true, peer)
+		add("uplink", false, ue)
+	}
+	return data
+}
+
+// mediaType maps an SDP media type to Media-Type
+func mediaType(t string) uint32 {
+	switch strings.ToLower(t) {
+	case "audio":
+		return rx.MediaAudio
+	case "video":
+		return rx.MediaVideo
+	case "data":
+		return rx.MediaData
+	case "application":
+		return rx.MediaApplication
+	case "control":
+		return rx.MediaControl
+	case "text":
+		return rx.MediaText
+	case "message":
+		return rx.MediaMessage
+	default:
+		return rx.MediaOther
+	}
+}
@@ -0,0 +1,110 @@
+package pcscf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sdp"
+	"github.com/dasmlab/souverix/common/diameter/rx"
+)
+
+const (
+	ueOffer = "v=0\r\no=alice 1 1 IN IP4 10.0.0.2\r\ns=-\r\nc=IN IP4 10.0.0.2\r\nt=0 0\r\n" +
+		"m=audio 49170 RTP/AVP 96\r\nb=AS:49\r\na=rtpmap:96 AMR-WB/16000\r\n" +
+		"m=video 49180 RTP/AVP 99\r\na=rtpmap:99 H264/90000\r\na=sendonly\r\n"
+	peerAnswer = "v=0\r\no=bob 1 1 IN IP4 198.51.100.1\r\ns=-\r\nc=IN IP4 198.51.100.1\r\nt=0 0\r\n" +
+		"m=audio 50000 RTP/AVP 96\r\nb=AS:38\r\na=rtpmap:96 AMR-WB/16000\r\na=rtcp:50010\r\n" +
+		"m=video 0 RTP/AVP 99\r\n"
+)
+
+func mustParseSDP(t *testing.T, body string) *sdp.Session {
+	t.Helper()
+	s, err := sdp.Parse(body)
+	if err != nil {
+		t.Fatalf("sdp.Parse() error = %v", err)
+	}
+	return s
+}
+
+func TestMediaComponents(t *testing.T) {
+	s := &MediaSession{UE: net.ParseIP("10.0.0.2"), Originating: true, LocalOffer: true, Local: mustParseSDP(t, ueOffer)}
+
+	// Before the answer the peer is unknown
+	components := mediaComponents(s)
+	if len(components) != 2 {
+		t.Fatalf("mediaComponents() = %d components, want 2", len(components))
+	}
+	audio := components[0]
+	if audio.Number != 1 || audio.MediaType != rx.MediaAudio || audio.FlowStatus != rx.FlowEnabled ||
+		audio.MaxRequestedBandwidthDL != 49000 || audio.MaxRequestedBandwidthUL != 0 {
+		t.Errorf("audio component = %+v", audio)
+	}
+	want := []string{"permit out 17 from any to 10.0.0.2 49170", "permit in 17 from 10.0.0.2 49170 to any"}
+	if got := audio.SubComponents[0].FlowDescriptions; !reflect.DeepEqual(got, want) {
+		t.Errorf("offer flows = %v, want %v", got, want)
+	}
+	if len(audio.CodecData) != 1 || !strings.HasPrefix(audio.CodecData[0], "uplink\noffer\nm=audio 49170 RTP/AVP 96\r\n") {
+		t.Errorf("offer codec data = %q", audio.CodecData)
+	}
+	if components[1].FlowStatus != rx.FlowEnabledUplink {
+		t.Errorf("sendonly video Flow-Status = %d, want ENABLED-UPLINK", components[1].FlowStatus)
+	}
+
+	s.Remote = mustParseSDP(t, peerAnswer)
+	components = mediaComponents(s)
+	audio = components[0]
+	if audio.MaxRequestedBandwidthUL != 38000 || len(audio.CodecData) != 2 || !strings.HasPrefix(audio.CodecData[1], "downlink\nanswer\n") {
+		t.Errorf("answered audio component = %+v", audio)
+	}
+	wantRTP := []string{"permit out 17 from 198.51.100.1 50000 to 10.0.0.2 49170", "permit in 17 from 10.0.0.2 49170 to 198.51.100.1 50000"}
+	wantRTCP := []string{"permit out 17 from 198.51.100.1 50010 to 10.0.0.2 49171", "permit in 17 from 10.0.0.2 49171 to 198.51.100.1 50010"}
+	if got := audio.SubComponents[0].FlowDescriptions; !reflect.DeepEqual(got, wantRTP) {
+		t.Errorf("RTP flows = %v, want %v", got, wantRTP)
+	}
+	if sub := audio.SubComponents[1]; sub.FlowUsage != rx.UsageRTCP || !reflect.DeepEqual(sub.FlowDescriptions, wantRTCP) {
+		t.Errorf("RTCP flows = %+v, want %v", sub, wantRTCP)
+	}
+	// The rejected video stream is removed
+	if video := components[1]; video.FlowStatus != rx.FlowRemoved || len(video.SubComponents) != 0 {
+		t.Errorf("rejected video component = %+v", video)
+	}
+}
+
+func TestMediaComponents_Terminating(t *testing.T) {
+	// The offer of the peer reaches the UE, whose address is known from its
+	// contact
+	s := &MediaSession{UE: net.ParseIP("10.0.0.2"), Remote: mustParseSDP(t, strings.Replace(peerAnswer, "a=rtcp:50010\r\n", "a=recvonly\r\n", 1))}
+	audio := mediaComponents(s)[0]
+	want := []string{"permit out 17 from 198.51.100.1 50000 to 10.0.0.2", "permit in 17 from 10.0.0.2 to 198.51.100.1 50000"}
+	if got := audio.SubComponents[0].FlowDescriptions; !reflect.DeepEqual(got, want) {
+		t.Errorf("flows = %v, want %v", got, want)
+	}
+	// The peer only receives, so the UE only sends
+	if audio.FlowStatus != rx.FlowEnabledUplink || !strings.HasPrefix(audio.CodecData[0], "downlink\noffer\n") {
+		t.Errorf("audio component = %+v", audio)
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	ctx := context.Background()
+	if p, err := NewPolicy(ctx, &config.PCSCFConfig{}, testLogger()); p != nil || err != nil {
+		t.Errorf("NewPolicy() without backend = %v, %v", p, err)
+	}
+	p, err := NewPolicy(ctx, &config.PCSCFConfig{PolicyBackend: "n5", PCFURL: "http://pcf", PolicyNotifyURL: "http://pcscf/notify"}, testLogger())
+	if _, ok := p.(*N5Policy); !ok || err != nil {
+		t.Errorf("NewPolicy(n5) = %T, %v", p, err)
+	}
+	for _, cfg := range []config.PCSCFConfig{
+		{PolicyBackend: "rx"},
+		{PolicyBackend: "n5"},
+		{PolicyBackend: "gx"},
+	} {
+		if p, err := NewPolicy(ctx, &cfg, testLogger()); p != nil || err == nil {
+			t.Errorf("NewPolicy(%+v) = %v, %v, want an error", cfg, p, err)
+		}
+	}
+}
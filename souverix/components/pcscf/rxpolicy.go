@@ -0,0 +1,190 @@
+package pcscf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/souverix/common/diameter"
+	"github.com/dasmlab/souverix/common/diameter/rx"
+	"github.com/sirupsen/logrus"
+)
+
+// PCRF sends the Rx requests of the P-CSCF to the PCRF; *rx.Client
+// implements it
+type PCRF interface {
+	AA(ctx context.Context, req *rx.AAR) (*rx.AAA, error)
+	SessionTermination(ctx context.Context, req *rx.STR) (*rx.STA, error)
+}
+
+// RxPolicy authorizes media with a PCRF over Rx (TS 29.214). It also answers
+// the ASR and RAR of the PCRF, as the rx.AF of the P-CSCF's Diameter peer.
+type RxPolicy struct {
+	pcrf  PCRF
+	appID string
+	log   *logrus.Logger
+
+	mu       sync.Mutex
+	sessions map[string]string // key: Rx Session-Id, value: Call-ID
+	aborted  func(callID string)
+}
+
+// NewRxPolicy creates the Rx policy of the P-CSCF configured in cfg
+func NewRxPolicy(cfg *config.PCSCFConfig, pcrf PCRF, log *logrus.Logger) *RxPolicy {
+	return &RxPolicy{
+		pcrf:     pcrf,
+		appID:    cfg.AFApplicationID,
+		log:      log,
+		sessions: make(map[string]string),
+	}
+}
+
+// DialRxPolicy connects to the PCRF configured in cfg and returns the Rx
+// policy using the connection
+func DialRxPolicy(ctx context.Context, cfg *config.PCSCFConfig, log *logrus.Logger) (*RxPolicy, error) {
+	if cfg.PCRFAddr == "" {
+		return nil, fmt.Errorf("no PCRF address configured")
+	}
+	p := NewRxPolicy(cfg, nil, log)
+	peer, err := diameter.Dial(ctx, "tcp", cfg.PCRFAddr, &diameter.Config{
+		OriginHost:   cfg.DiameterHost,
+		OriginRealm:  cfg.DiameterRealm,
+		VendorID:     rx.Vendor3GPP,
+		Applications: []diameter.Application{rx.Application},
+		Handler:      &rx.Handler{AF: p},
+		Log:          log,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the PCRF: %w", err)
+	}
+	p.pcrf = rx.NewClient(peer)
+	return p, nil
+}
+
+// SetAbortHandler implements Policy
+func (p *RxPolicy) SetAbortHandler(aborted func(callID string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aborted = aborted
+}
+
+// Authorize sends the initial AAR of s, or an update once its Rx session
+// exists (TS 29.214 section 4.4.1 and 4.4.2)
+func (p *RxPolicy) Authorize(ctx context.Context, s *MediaSession) error {
+	req := &rx.AAR{
+		SessionID:       s.policyID,
+		RequestType:     rx.RequestUpdate,
+		AFApplicationID: p.appID,
+		MediaComponents: mediaComponents(s),
+	}
+	if s.policyID == "" {
+		req.RequestType = rx.RequestInitial
+		req.UEAddress = s.UE
+		req.SubscriptionID = s.Identity
+		req.ServiceURN = s.ServiceURN
+		req.SpecificActions = []uint32{
+			rx.ActionIndicationOfLossOfBearer,
+			rx.ActionIndicationOfReleaseOfBearer,
+			rx.ActionIndicationOfFailedResourcesAllocate,
+		}
+	}
+
+	aaa, err := p.pcrf.AA(ctx, req)
+	if err != nil {
+		return fmt.Errorf("AAR failed: %w", err)
+	}
+	switch {
+	case aaa.Result.Success():
+	case aaa.Result.VendorID == rx.Vendor3GPP && (aaa.Result.Code == rx.ResultInvalidServiceInformation ||
+		aaa.Result.Code == rx.ResultFilterRestrictions || aaa.Result.Code == rx.ResultRequestedServiceNotAuthorized):
+		return fmt.Errorf("%w: %v", ErrNotAuthorized, aaa.Result.Err())
+	default:
+		return fmt.Errorf("AAR rejected: %w", aaa.Result.Err())
+	}
+
+	if s.policyID == "" {
+		s.policyID = aaa.SessionID
+		p.mu.Lock()
+		p.sessions[aaa.SessionID] = s.CallID
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// Release sends the STR of s (TS 29.214 section 4.4.4)
+func (p *RxPolicy) Release(ctx context.Context, s *MediaSession) error {
+	if s.policyID == "" {
+		return nil
+	}
+	p.mu.Lock()
+	delete(p.sessions, s.policyID)
+	p.mu.Unlock()
+	return p.terminate(ctx, s.policyID, diameter.TerminationLogout)
+}
+
+// terminate sends the STR of Rx session id
+func (p *RxPolicy) terminate(ctx context.Context, id string, cause uint32) error {
+	sta, err := p.pcrf.SessionTermination(ctx, &rx.STR{SessionID: id, TerminationCause: cause})
+	if err != nil {
+		return fmt.Errorf("STR failed: %w", err)
+	}
+	return sta.Result.Err()
+}
+
+// AbortSession implements rx.AF. The session is released and its Rx
+// session terminated once the ASR is answered (TS 29.214 section 4.4.6.2).
+func (p *RxPolicy) AbortSession(ctx context.Context, req *rx.ASR) *rx.ASA {
+	if !p.abort(req.SessionID) {
+		return &rx.ASA{Result: diameter.Result{Code: diameter.ResultUnknownSessionID}}
+	}
+	p.log.WithFields(logrus.Fields{"session": req.SessionID, "cause": req.AbortCause}).Info("PCRF aborted session")
+	return &rx.ASA{Result: rx.Success}
+}
+
+// ReAuth implements rx.AF. The release of the bearers of a session, or the
+// failure to allocate them, ends it (TS 24.229 section 5.2.8.1.2); the loss
+// of a bearer is only logged, as it may be recovered.
+func (p *RxPolicy) ReAuth(ctx context.Context, req *rx.RAR) *rx.RAA {
+	p.mu.Lock()
+	_, ok := p.sessions[req.SessionID]
+	p.mu.Unlock()
+	if !ok {
+		return &rx.RAA{Result: diameter.Result{Code: diameter.ResultUnknownSessionID}}
+	}
+
+	for _, action := range req.SpecificActions {
+		switch action {
+		case rx.ActionIndicationOfReleaseOfBearer, rx.ActionIndicationOfFailedResourcesAllocate:
+			p.log.WithFields(logrus.Fields{"session": req.SessionID, "action": action}).Info("bearer released, ending session")
+			p.abort(req.SessionID)
+			return &rx.RAA{Result: rx.Success}
+		case rx.ActionIndicationOfLossOfBearer:
+			p.log.WithField("session", req.SessionID).Warn("bearer lost")
+		}
+	}
+	return &rx.RAA{Result: rx.Success}
+}
+
+// abort ends Rx session id in the background: the SIP session is released
+// then the Rx session terminated. It reports whether the session existed.
+func (p *RxPolicy) abort(id string) bool {
+	p.mu.Lock()
+	callID, ok := p.sessions[id]
+	delete(p.sessions, id)
+	aborted := p.aborted
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	go func() {
+		if aborted != nil {
+			aborted(callID)
+		}
+		if err := p.terminate(context.Background(), id, diameter.TerminationAdministrative); err != nil {
+			p.log.WithError(err).WithField("session", id).Warn("cannot terminate aborted Rx session")
+		}
+	}()
+	return true
+}
@@ -0,0 +1,181 @@
+package pcscf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Security mechanism agreement headers (RFC 3329)
+const (
+	HeaderSecurityClient = "Security-Client"
+	HeaderSecurityServer = "Security-Server"
+	HeaderSecurityVerify = "Security-Verify"
+
+	// OptionSecAgree is the option tag of RFC 3329 in Require, Proxy-Require
+	// and Supported
+	OptionSecAgree = "sec-agree"
+
+	// MechanismIPsec3GPP is the mechanism name of TS 33.203 IPsec
+	MechanismIPsec3GPP = "ipsec-3gpp"
+)
+
+// SecurityMechanism is one entry of a Security-Client, Security-Server or
+// Security-Verify header. The ipsec-3gpp parameters are those of TS 33.203
+// section 7.2 and TS 24.229 annex H.
+type SecurityMechanism struct {
+	Mechanism  string
+	Preference string // q value, kept as sent
+	Algorithm  string // alg
+	Encryption string // ealg, "null" when absent
+	Protocol   string // prot, "esp" when absent
+	Mode       string // mod, "trans" when absent
+	SPIC       uint32
+	SPIS       uint32
+	PortC      int
+	PortS      int
+
+	// Other parameters, with lower case names
+	Params map[string]string
+}
+
+// ParseSecurityMechanisms parses the values of a security agreement header,
+// each of which may list several mechanisms
+func ParseSecurityMechanisms(values []string) ([]SecurityMechanism, error) {
+	var mechanisms []SecurityMechanism
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			m, err := parseSecurityMechanism(entry)
+			if err != nil {
+				return nil, err
+			}
+			mechanisms = append(mechanisms, m)
+		}
+	}
+	return mechanisms, nil
+}
+
+func parseSecurityMechanism(entry string) (SecurityMechanism, error) {
+	parts := strings.Split(entry, ";")
+	m := SecurityMechanism{
+		Mechanism:  strings.ToLower(strings.TrimSpace(parts[0])),
+		Encryption: "null",
+		Protocol:   "esp",
+		Mode:       "trans",
+	}
+	if m.Mechanism == "" {
+		return m, fmt.Errorf("security mechanism without a name: %q", entry)
+	}
+
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		var err error
+		switch name {
+		case "":
+		case "q":
+			m.Preference = value
+		case "alg":
+			m.Algorithm = strings.ToLower(value)
+		case "ealg":
+			m.Encryption = strings.ToLower(value)
+		case "prot":
+			m.Protocol = strings.ToLower(value)
+		case "mod":
+			m.Mode = strings.ToLower(value)
+		case "spi-c":
+			m.SPIC, err = parseSPI(value)
+		case "spi-s":
+			m.SPIS, err = parseSPI(value)
+		case "port-c":
+			m.PortC, err = parsePort(value)
+		case "port-s":
+			m.PortS, err = parsePort(value)
+		default:
+			if m.Params == nil {
+				m.Params = make(map[string]string)
+			}
+			m.Params[name] = value
+		}
+		if err != nil {
+			return m, fmt.Errorf("invalid %s in %q: %w", name, entry, err)
+		}
+	}
+	return m, nil
+}
+
+func parseSPI(value string) (uint32, error) {
+	spi, err := strconv.ParseUint(value, 10, 32)
+	return uint32(spi), err
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	return int(port), err
+}
+
+// String formats m as a header value. Parameters at their default value are
+// left out, except ealg which TS 24.229 has the P-CSCF always send.
+func (m SecurityMechanism) String() string {
+	var b strings.Builder
+	b.WriteString(m.Mechanism)
+	if m.Preference != "" {
+		b.WriteString(";q=" + m.Preference)
+	}
+	if m.Algorithm != "" {
+		b.WriteString(";alg=" + m.Algorithm)
+	}
+	if m.Encryption != "" {
+		b.WriteString(";ealg=" + m.Encryption)
+	}
+	if m.Protocol != "" && m.Protocol != "esp" {
+		b.WriteString(";prot=" + m.Protocol)
+	}
+	if m.Mode != "" && m.Mode != "trans" {
+		b.WriteString(";mod=" + m.Mode)
+	}
+	if m.Mechanism == MechanismIPsec3GPP {
+		fmt.Fprintf(&b, ";spi-c=%d;spi-s=%d;port-c=%d;port-s=%d", m.SPIC, m.SPIS, m.PortC, m.PortS)
+	}
+	names := make([]string, 0, len(m.Params))
+	for name := range m.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(";" + name)
+		if value := m.Params[name]; value != "" {
+			b.WriteString("=" + value)
+		}
+	}
+	return b.String()
+}
+
+// Equal reports whether m and other describe the same mechanism, as RFC 3329
+// section 2.3.1 requires of Security-Verify and the Security-Server sent
+func (m SecurityMechanism) Equal(other SecurityMechanism) bool {
+	return m.String() == other.String()
+}
+
+// removeOption removes option from the option tags in values, dropping
+// values left empty
+func removeOption(values []string, option string) []string {
+	var kept []string
+	for _, value := range values {
+		var tags []string
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !strings.EqualFold(tag, option) {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) > 0 {
+			kept = append(kept, strings.Join(tags, ", "))
+		}
+	}
+	return kept
+}
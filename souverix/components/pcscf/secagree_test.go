@@ -0,0 +1,63 @@
+package pcscf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSecurityMechanisms(t *testing.T) {
+	values := []string{
+		"ipsec-3gpp; alg=hmac-sha-1-96; spi-c=1111; spi-s=2222; port-c=5062; port-s=5064, ipsec-3gpp;alg=hmac-md5-96;ealg=aes-cbc;spi-c=3333;spi-s=4444;port-c=5062;port-s=5064",
+		"tls;q=0.2",
+	}
+	got, err := ParseSecurityMechanisms(values)
+	if err != nil {
+		t.Fatalf("ParseSecurityMechanisms() error = %v", err)
+	}
+	want := []SecurityMechanism{
+		{Mechanism: "ipsec-3gpp", Algorithm: "hmac-sha-1-96", Encryption: "null", Protocol: "esp", Mode: "trans", SPIC: 1111, SPIS: 2222, PortC: 5062, PortS: 5064},
+		{Mechanism: "ipsec-3gpp", Algorithm: "hmac-md5-96", Encryption: "aes-cbc", Protocol: "esp", Mode: "trans", SPIC: 3333, SPIS: 4444, PortC: 5062, PortS: 5064},
+		{Mechanism: "tls", Preference: "0.2", Encryption: "null", Protocol: "esp", Mode: "trans"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSecurityMechanisms() = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{"ipsec-3gpp;spi-c=x", "ipsec-3gpp;port-s=70000", ";alg=hmac-md5-96"} {
+		if _, err := ParseSecurityMechanisms([]string{bad}); err == nil {
+			t.Errorf("ParseSecurityMechanisms(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSecurityMechanism_String(t *testing.T) {
+	m := SecurityMechanism{
+		Mechanism:  MechanismIPsec3GPP,
+		Preference: "0.1",
+		Algorithm:  AlgHMACSHA196,
+		Encryption: EAlgNull,
+		Protocol:   "esp",
+		Mode:       "trans",
+		SPIC:       10,
+		SPIS:       11,
+		PortC:      5100,
+		PortS:      5101,
+	}
+	want := "ipsec-3gpp;q=0.1;alg=hmac-sha-1-96;ealg=null;spi-c=10;spi-s=11;port-c=5100;port-s=5101"
+	if got := m.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// Security-Verify echoes the Security-Server, possibly reformatted
+	verify, err := ParseSecurityMechanisms([]string{"ipsec-3gpp; q=0.1; alg=hmac-sha-1-96; spi-c=10; spi-s=11; port-c=5100; port-s=5101; prot=esp"})
+	if err != nil || len(verify) != 1 || !verify[0].Equal(m) {
+		t.Errorf("Security-Verify %+v does not equal %+v (error %v)", verify, m, err)
+	}
+}
+
+func TestRemoveOption(t *testing.T) {
+	got := removeOption([]string{"sec-agree", "precondition, Sec-Agree"}, OptionSecAgree)
+	if want := []string{"precondition"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removeOption() = %v, want %v", got, want)
+	}
+}
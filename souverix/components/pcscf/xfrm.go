@@ -0,0 +1,235 @@
+package pcscf
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// xfrmAlgorithms maps ipsec-3gpp algorithms to Linux crypto API names
+var xfrmAlgorithms = map[string]string{
+	AlgHMACSHA196:  "hmac(sha1)",
+	AlgHMACMD596:   "hmac(md5)",
+	EAlgAESCBC:     "cbc(aes)",
+	EAlgDESEDE3CBC: "cbc(des3_ede)",
+	EAlgNull:       "ecb(cipher_null)",
+}
+
+// XFRM netlink messages, attributes and values (linux/xfrm.h)
+const (
+	xfrmMsgNewSA     = 0x10
+	xfrmMsgDelSA     = 0x11
+	xfrmMsgNewPolicy = 0x13
+	xfrmMsgDelPolicy = 0x14
+
+	xfrmaAlgCrypt     = 2
+	xfrmaTmpl         = 5
+	xfrmaAlgAuthTrunc = 20
+
+	xfrmPolicyIn  = 0
+	xfrmPolicyOut = 1
+
+	xfrmModeTransport = 0
+	xfrmInf           = ^uint64(0)
+
+	// Linux address families and IP protocols
+	afInet     = 2
+	afInet6    = 10
+	protoTCP   = 6
+	protoUDP   = 17
+	protoESP   = 50
+	truncICV96 = 96
+)
+
+// Sizes of the XFRM netlink structures
+const (
+	sizeofXfrmSelector       = 56
+	sizeofXfrmUsersaInfo     = 224
+	sizeofXfrmUsersaID       = 24
+	sizeofXfrmUserpolicyInfo = 168
+	sizeofXfrmUserpolicyID   = 64
+	sizeofXfrmUserTmpl       = 64
+	sizeofXfrmAlgoName       = 64
+)
+
+// Netlink request flags (linux/netlink.h)
+const (
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+	nlmFExcl    = 0x200
+	nlmFCreate  = 0x400
+)
+
+// xfrmMessage is an XFRM netlink request without its netlink header. The
+// keys of an SA travel in it to the kernel only, never on a command line.
+type xfrmMessage struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+// xfrmFlow is one of the four unidirectional SAs of a SecurityAssociation
+type xfrmFlow struct {
+	src, dst     net.IP
+	sport, dport int
+	spi          uint32
+	dir          uint8
+}
+
+// xfrmFlows returns the SAs of sa (TS 33.203 section 7.1)
+func xfrmFlows(sa *SecurityAssociation) []xfrmFlow {
+	ue, pcscf := sa.UE, sa.PCSCF
+	return []xfrmFlow{
+		{src: ue, dst: pcscf, sport: sa.PortUC, dport: sa.PortPS, spi: sa.SPIPS, dir: xfrmPolicyIn},
+		{src: ue, dst: pcscf, sport: sa.PortUS, dport: sa.PortPC, spi: sa.SPIPC, dir: xfrmPolicyIn},
+		{src: pcscf, dst: ue, sport: sa.PortPS, dport: sa.PortUC, spi: sa.SPIUC, dir: xfrmPolicyOut},
+		{src: pcscf, dst: ue, sport: sa.PortPC, dport: sa.PortUS, spi: sa.SPIUS, dir: xfrmPolicyOut},
+	}
+}
+
+// xfrmInstallMessages returns the requests that install sa: an ESP
+// transport mode state per flow, and a policy per flow for each of UDP and
+// TCP
+func xfrmInstallMessages(sa *SecurityAssociation) []xfrmMessage {
+	var msgs []xfrmMessage
+	for _, f := range xfrmFlows(sa) {
+		msgs = append(msgs, xfrmMessage{
+			typ:   xfrmMsgNewSA,
+			flags: nlmFRequest | nlmFAck | nlmFCreate | nlmFExcl,
+			data:  xfrmNewSA(sa, f),
+		})
+	}
+	for _, f := range xfrmFlows(sa) {
+		for _, proto := range []uint8{protoUDP, protoTCP} {
+			msgs = append(msgs, xfrmMessage{
+				typ:   xfrmMsgNewPolicy,
+				flags: nlmFRequest | nlmFAck | nlmFCreate | nlmFExcl,
+				data:  xfrmNewPolicy(f, proto),
+			})
+		}
+	}
+	return msgs
+}
+
+// xfrmRemoveMessages returns the requests that remove sa, policies first
+func xfrmRemoveMessages(sa *SecurityAssociation) []xfrmMessage {
+	var msgs []xfrmMessage
+	for _, f := range xfrmFlows(sa) {
+		for _, proto := range []uint8{protoUDP, protoTCP} {
+			id := make([]byte, sizeofXfrmUserpolicyID)
+			putXfrmSelector(id, f, proto)
+			id[60] = f.dir
+			msgs = append(msgs, xfrmMessage{typ: xfrmMsgDelPolicy, flags: nlmFRequest | nlmFAck, data: id})
+		}
+	}
+	for _, f := range xfrmFlows(sa) {
+		id := make([]byte, sizeofXfrmUsersaID)
+		family := putXfrmAddress(id[0:16], f.dst)
+		binary.BigEndian.PutUint32(id[16:], f.spi)
+		binary.NativeEndian.PutUint16(id[20:], family)
+		id[22] = protoESP
+		msgs = append(msgs, xfrmMessage{typ: xfrmMsgDelSA, flags: nlmFRequest | nlmFAck, data: id})
+	}
+	return msgs
+}
+
+// xfrmNewSA encodes the xfrm_usersa_info of flow f of sa with its
+// algorithms
+func xfrmNewSA(sa *SecurityAssociation, f xfrmFlow) []byte {
+	info := make([]byte, sizeofXfrmUsersaInfo)
+	family := putXfrmAddress(info[56:72], f.dst) // id.daddr
+	binary.BigEndian.PutUint32(info[72:], f.spi)
+	info[76] = protoESP
+	putXfrmAddress(info[80:96], f.src)
+	putXfrmLifetime(info[96:160])
+	binary.NativeEndian.PutUint16(info[212:], family)
+	info[214] = xfrmModeTransport
+
+	auth := make([]byte, sizeofXfrmAlgoName+8+len(sa.IntegrityKey))
+	copy(auth, xfrmAlgorithms[sa.Integrity])
+	binary.NativeEndian.PutUint32(auth[sizeofXfrmAlgoName:], uint32(len(sa.IntegrityKey)*8))
+	binary.NativeEndian.PutUint32(auth[sizeofXfrmAlgoName+4:], truncICV96)
+	copy(auth[sizeofXfrmAlgoName+8:], sa.IntegrityKey)
+
+	encryption, key := xfrmAlgorithms[EAlgNull], []byte(nil)
+	if sa.Encryption != EAlgNull && sa.Encryption != "" {
+		encryption, key = xfrmAlgorithms[sa.Encryption], sa.EncryptionKey
+	}
+	crypt := make([]byte, sizeofXfrmAlgoName+4+len(key))
+	copy(crypt, encryption)
+	binary.NativeEndian.PutUint32(crypt[sizeofXfrmAlgoName:], uint32(len(key)*8))
+	copy(crypt[sizeofXfrmAlgoName+4:], key)
+
+	info = appendNetlinkAttr(info, xfrmaAlgAuthTrunc, auth)
+	return appendNetlinkAttr(info, xfrmaAlgCrypt, crypt)
+}
+
+// xfrmNewPolicy encodes the xfrm_userpolicy_info of flow f for proto with
+// the template of its SA
+func xfrmNewPolicy(f xfrmFlow, proto uint8) []byte {
+	info := make([]byte, sizeofXfrmUserpolicyInfo)
+	family := putXfrmSelector(info, f, proto)
+	putXfrmLifetime(info[56:120])
+	info[160] = f.dir
+
+	tmpl := make([]byte, sizeofXfrmUserTmpl)
+	putXfrmAddress(tmpl[0:16], f.dst) // id.daddr
+	binary.BigEndian.PutUint32(tmpl[16:], f.spi)
+	tmpl[20] = protoESP
+	binary.NativeEndian.PutUint16(tmpl[24:], family)
+	putXfrmAddress(tmpl[28:44], f.src)
+	tmpl[48] = xfrmModeTransport
+	for _, offset := range []int{52, 56, 60} { // aalgos, ealgos, calgos
+		binary.NativeEndian.PutUint32(tmpl[offset:], ^uint32(0))
+	}
+	return appendNetlinkAttr(info, xfrmaTmpl, tmpl)
+}
+
+// putXfrmSelector encodes the xfrm_selector of the traffic of flow f over
+// proto at the start of b and returns its address family
+func putXfrmSelector(b []byte, f xfrmFlow, proto uint8) uint16 {
+	family := putXfrmAddress(b[0:16], f.dst)
+	putXfrmAddress(b[16:32], f.src)
+	binary.BigEndian.PutUint16(b[32:], uint16(f.dport))
+	binary.BigEndian.PutUint16(b[34:], 0xffff)
+	binary.BigEndian.PutUint16(b[36:], uint16(f.sport))
+	binary.BigEndian.PutUint16(b[38:], 0xffff)
+	binary.NativeEndian.PutUint16(b[40:], family)
+	prefix := uint8(32)
+	if family == afInet6 {
+		prefix = 128
+	}
+	b[42], b[43] = prefix, prefix
+	b[44] = proto
+	return family
+}
+
+// putXfrmAddress encodes ip as an xfrm_address_t and returns its family
+func putXfrmAddress(b []byte, ip net.IP) uint16 {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b, ip4)
+		return afInet
+	}
+	copy(b, ip.To16())
+	return afInet6
+}
+
+// putXfrmLifetime encodes an xfrm_lifetime_cfg without byte or packet
+// limits; the P-CSCF removes the SAs itself when they expire
+func putXfrmLifetime(b []byte) {
+	for i := 0; i < 4; i++ {
+		binary.NativeEndian.PutUint64(b[i*8:], xfrmInf)
+	}
+}
+
+// appendNetlinkAttr appends the attribute typ with value to b, padded to
+// four bytes
+func appendNetlinkAttr(b []byte, typ uint16, value []byte) []byte {
+	var header [4]byte
+	binary.NativeEndian.PutUint16(header[0:], uint16(4+len(value)))
+	binary.NativeEndian.PutUint16(header[2:], typ)
+	b = append(append(b, header[:]...), value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
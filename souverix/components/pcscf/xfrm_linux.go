@@ -0,0 +1,154 @@
+//go:build linux
+
+package pcscf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// XFRMManager installs security associations in the Linux kernel's XFRM
+// framework over an XFRM netlink socket. It needs CAP_NET_ADMIN.
+type XFRMManager struct {
+	log *logrus.Logger
+
+	// send delivers a request to the kernel, replaced in tests
+	send func(ctx context.Context, msg xfrmMessage) error
+}
+
+// NewXFRMManager creates an XFRMManager, failing when the kernel has no
+// XFRM netlink support
+func NewXFRMManager(log *logrus.Logger) (*XFRMManager, error) {
+	fd, err := openXFRMSocket()
+	if err != nil {
+		return nil, fmt.Errorf("xfrm IPsec backend: %w", err)
+	}
+	unix.Close(fd)
+	return &XFRMManager{log: log, send: sendXFRM}, nil
+}
+
+// Install adds the XFRM states and policies of sa. A partly installed sa is
+// removed again.
+func (m *XFRMManager) Install(ctx context.Context, sa *SecurityAssociation) error {
+	for _, msg := range xfrmInstallMessages(sa) {
+		if err := m.send(ctx, msg); err != nil {
+			m.remove(ctx, sa)
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the XFRM states and policies of sa
+func (m *XFRMManager) Remove(ctx context.Context, sa *SecurityAssociation) error {
+	return m.remove(ctx, sa)
+}
+
+// remove sends every delete request, returning the first error, so that
+// one missing entry does not leave the others behind
+func (m *XFRMManager) remove(ctx context.Context, sa *SecurityAssociation) error {
+	var first error
+	for _, msg := range xfrmRemoveMessages(sa) {
+		if err := m.send(ctx, msg); err != nil {
+			m.log.WithError(err).Debug("xfrm delete failed")
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// xfrmSeq numbers the netlink requests
+var xfrmSeq atomic.Uint32
+
+// openXFRMSocket opens a netlink socket to the kernel's XFRM framework
+func openXFRMSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_XFRM)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// sendXFRM sends msg on its own socket and waits for the kernel's
+// acknowledgement until ctx is done
+func sendXFRM(ctx context.Context, msg xfrmMessage) error {
+	fd, err := openXFRMSocket()
+	if err != nil {
+		return fmt.Errorf("xfrm socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if deadline, ok := ctx.Deadline(); ok {
+		tv := unix.NsecToTimeval(max(time.Until(deadline), time.Millisecond).Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return fmt.Errorf("xfrm socket: %w", err)
+		}
+	}
+
+	seq := xfrmSeq.Add(1)
+	req := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(msg.data))
+	binary.NativeEndian.PutUint32(req[0:], uint32(unix.SizeofNlMsghdr+len(msg.data)))
+	binary.NativeEndian.PutUint16(req[4:], msg.typ)
+	binary.NativeEndian.PutUint16(req[6:], msg.flags)
+	binary.NativeEndian.PutUint32(req[8:], seq)
+	req = append(req, msg.data...)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("xfrm request %#x: %w", msg.typ, err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("xfrm request %#x: %w", msg.typ, err)
+		}
+		if done, err := xfrmAck(buf[:n], seq); done {
+			if err != nil {
+				return fmt.Errorf("xfrm request %#x: %w", msg.typ, err)
+			}
+			return nil
+		}
+	}
+}
+
+// xfrmAck looks for the acknowledgement of request seq in the netlink
+// messages of b and returns the error it reports
+func xfrmAck(b []byte, seq uint32) (bool, error) {
+	for len(b) >= unix.SizeofNlMsghdr {
+		length := int(binary.NativeEndian.Uint32(b[0:]))
+		if length < unix.SizeofNlMsghdr || length > len(b) {
+			return true, errors.New("truncated reply")
+		}
+		typ, replySeq := binary.NativeEndian.Uint16(b[4:]), binary.NativeEndian.Uint32(b[8:])
+		if typ == unix.NLMSG_ERROR && replySeq == seq {
+			if length < unix.SizeofNlMsghdr+4 {
+				return true, errors.New("truncated error")
+			}
+			// A zero error acknowledges the request
+			if errno := int32(binary.NativeEndian.Uint32(b[unix.SizeofNlMsghdr:])); errno != 0 {
+				return true, unix.Errno(-errno)
+			}
+			return true, nil
+		}
+		b = b[min((length+3)&^3, len(b)):]
+	}
+	return false, nil
+}
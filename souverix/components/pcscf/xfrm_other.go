@@ -0,0 +1,32 @@
+//go:build !linux
+
+package pcscf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errNoXFRM is returned on platforms without the Linux XFRM framework
+var errNoXFRM = fmt.Errorf("xfrm IPsec backend is only available on Linux")
+
+// XFRMManager installs security associations in the Linux kernel's XFRM
+// framework
+type XFRMManager struct{}
+
+// NewXFRMManager fails on platforms other than Linux
+func NewXFRMManager(log *logrus.Logger) (*XFRMManager, error) {
+	return nil, errNoXFRM
+}
+
+// Install is unavailable on platforms other than Linux
+func (m *XFRMManager) Install(ctx context.Context, sa *SecurityAssociation) error {
+	return errNoXFRM
+}
+
+// Remove is unavailable on platforms other than Linux
+func (m *XFRMManager) Remove(ctx context.Context, sa *SecurityAssociation) error {
+	return errNoXFRM
+}
@@ -1,5 +1,7 @@
 package ims
 
+import "time"
+
 // Subscriber represents an IMS subscriber
 type Subscriber struct {
 	// IMS Public User Identity (IMPU)
@@ -17,18 +19,90 @@ type Subscriber struct {
 	// S-CSCF assignment
 	SCSCFName string
 
+	// Capabilities the serving S-CSCF must or should support
+	SCSCFCapabilities SCSCFCapabilities
+
 	// Service profile
 	ServiceProfile ServiceProfile
 
 	// Authentication data
 	AuthData AuthData
+
+	// Further service profiles of the subscription, each with its own
+	// public identities
+	AdditionalProfiles []ServiceProfile
+
+	// Public identities registered together (TS 23.228 section 4.3.3.3)
+	ImplicitRegistrationSets []ImplicitRegistrationSet
+
+	// Version of the stored subscriber: 1 when created, then incremented
+	// by the store on every write, including registration and AKA
+	// sequence number changes
+	Version uint64
+}
+
+// SCSCFCapabilities are the Server-Capabilities used by the I-CSCF to select
+// an S-CSCF (TS 29.228 section 6.7). Values are operator defined.
+type SCSCFCapabilities struct {
+	Mandatory []uint32
+	Optional  []uint32
+}
+
+// ImplicitRegistrationSet is a set of public identities registered,
+// re-registered and deregistered as one
+type ImplicitRegistrationSet struct {
+	ID    string
+	IMPUs []string
 }
 
 // ServiceProfile represents a subscriber's service profile
 type ServiceProfile struct {
 	PublicIdentities []string
-	CoreNetworkServices []string
+	TelephoneNumberRanges []TNRange // Number blocks assigned to the subscriber
+	CoreNetworkServices []string // Authorized service identifiers
 	InitialFilterCriteria []FilterCriteria
+	SharedIFCSets []int // Shared iFC set identifiers provisioned on the S-CSCF
+	SubscribedMediaProfileID *int // Media policy of the profile, nil when unrestricted
+
+	// Attributes of the public identities, keyed by identity; an identity
+	// without an entry is an unbarred public user identity
+	IdentityAttributes map[string]PublicIdentityAttributes
+
+	// Enterprise branding for STIR/SHAKEN Rich Call Data
+	RichCallData RichCallData
+}
+
+// PublicIdentityAttributes qualifies a public identity of a service profile
+type PublicIdentityAttributes struct {
+	Barred       bool
+	IdentityType string // One of the IdentityType values, empty for a public user identity
+	Wildcard     string // Regular expression of a wildcarded PSI or IMPU
+	DisplayName  string
+	AliasGroup   string // Alias identity group ID
+	Shared       bool   // Also an identity of other private identities (TS 23.228 section 4.3.3.4)
+}
+
+// Public identity types (TS 29.228 Annex B)
+const (
+	IdentityTypePublicUser     = "PUBLIC_USER_IDENTITY"
+	IdentityTypeDistinctPSI    = "DISTINCT_PSI"
+	IdentityTypeWildcardedPSI  = "WILDCARDED_PSI"
+	IdentityTypeWildcardedIMPU = "WILDCARDED_IMPU"
+)
+
+// TNRange is an inclusive block of E.164 telephone numbers (e.g. +15145550000-+15145550999)
+type TNRange struct {
+	Start string
+	End   string
+}
+
+// RichCallData holds the branded caller information signed into RCD PASSporTs
+type RichCallData struct {
+	DisplayName string // Verified caller name ("nam")
+	JCard       string // Inline jCard JSON ("jcd")
+	JCardURL    string // URL of a jCard ("jcl")
+	LogoURL     string // URL of the caller logo ("icn")
+	CallReason  string // Call reason ("crn")
 }
 
 // FilterCriteria represents Initial Filter Criteria (iFC) for AS routing
@@ -36,6 +110,7 @@ type FilterCriteria struct {
 	Priority    int
 	Trigger     TriggerPoint
 	ApplicationServer ApplicationServer
+	ProfilePartIndicator string // "REGISTERED", "UNREGISTERED" or empty for both
 }
 
 // TriggerPoint represents a trigger point for AS invocation
@@ -47,15 +122,30 @@ type TriggerPoint struct {
 // ServicePointTrigger represents a service point trigger
 type ServicePointTrigger struct {
 	ConditionNegated bool
-	Group            string
+	Group            string // Comma-separated group numbers
 	Method           string
-	RequestURI       string
+	RequestURI       string // Regular expression
+	Header           string // SIP header name
+	HeaderContent    string // Regular expression, empty matches presence
+	SessionCase      string // One of the SessionCase values
+	SDPLine          string // SDP line type (e.g. "m")
+	SDPLineContent   string // Regular expression, empty matches presence
 }
 
+// Session cases of a service point trigger (TS 29.228 Annex B)
+const (
+	SessionCaseOriginating             = "ORIGINATING_SESSION"
+	SessionCaseTerminatingRegistered   = "TERMINATING_REGISTERED"
+	SessionCaseTerminatingUnregistered = "TERMINATING_UNREGISTERED"
+	SessionCaseOriginatingUnregistered = "ORIGINATING_UNREGISTERED"
+	SessionCaseOriginatingCDIV         = "ORIGINATING_CDIV"
+)
+
 // ApplicationServer represents an Application Server
 type ApplicationServer struct {
 	ServerName string
 	DefaultHandling string // "SESSION_CONTINUED", "SESSION_TERMINATED"
+	ServiceInfo string // Opaque data passed to the AS in third-party REGISTER
 }
 
 // AuthData represents authentication data for a subscriber
@@ -65,6 +155,12 @@ type AuthData struct {
 	Realm      string
 	Password   string // Hashed
 	HA1        string // Pre-computed HA1 for Digest
+
+	// IMS AKA (Milenage) subscriber data, hex encoded
+	K   string // 128-bit subscriber key
+	OPc string // 128-bit operator variant key derived from OP and K
+	AMF string // 16-bit authentication management field
+	SQN uint64 // Last sequence number sent to the subscriber (48-bit)
 }
 
 // Session represents an IMS session
@@ -116,9 +212,25 @@ type Registration struct {
 	IMPU        string
 	Contact     string
 	Expires     int
+	ImplicitIMPUs []string // Identities registered together with IMPU
 	Path        []string
 	SCSCFName   string
 	State       RegistrationState
+
+	// Registered contacts of the public identity and the Service-Route
+	// returned to the UE
+	Contacts     []ContactBinding
+	ServiceRoute []string
+}
+
+// ContactBinding is a contact address registered for a public identity
+type ContactBinding struct {
+	URI        string
+	Expires    time.Time
+	CallID     string
+	CSeq       int
+	Path       []string
+	InstanceID string // +sip.instance feature tag (RFC 5626)
 }
 
 // RegistrationState represents the state of a registration
@@ -0,0 +1,99 @@
+package media
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// TDMRate is the sample rate of TDM circuits
+const TDMRate = 8000
+
+// Codec encodes and decodes the audio of an RTP payload format. Codecs
+// other than G.711, such as AMR-WB or Opus, are added to a Registry.
+type Codec interface {
+	// Name is the encoding name of the rtpmap attribute, e.g. PCMU
+	Name() string
+	// PayloadType is the static or default dynamic payload type
+	PayloadType() uint8
+	// ClockRate is the sample rate of the decoded audio
+	ClockRate() int
+	// Decode returns the linear samples of a payload
+	Decode(payload []byte) ([]int16, error)
+	// Encode returns the payload of linear samples
+	Encode(samples []int16) ([]byte, error)
+}
+
+// Concealer is implemented by codecs with their own packet loss
+// concealment. Conceal returns the samples replacing a lost frame of n
+// samples, the lost'th lost in a row.
+type Concealer interface {
+	Conceal(n, lost int) []int16
+}
+
+// Registry is the codecs of a media gateway by payload type
+type Registry struct {
+	mu     sync.RWMutex
+	codecs map[uint8]Codec
+}
+
+// NewRegistry creates a registry of the G.711 codecs
+func NewRegistry() *Registry {
+	r := &Registry{codecs: make(map[uint8]Codec)}
+	r.Register(PCMU)
+	r.Register(PCMA)
+	return r
+}
+
+// Register adds a codec at its payload type, replacing any other
+func (r *Registry) Register(c Codec) {
+	r.RegisterAs(c.PayloadType(), c)
+}
+
+// RegisterAs adds a codec at a dynamic payload type negotiated in SDP
+func (r *Registry) RegisterAs(payloadType uint8, c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[payloadType] = c
+}
+
+// Lookup returns the codec of a payload type
+func (r *Registry) Lookup(payloadType uint8) (Codec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.codecs[payloadType]
+	return c, ok
+}
+
+// ByName returns the codec with an encoding name, case insensitive
+func (r *Registry) ByName(name string) (Codec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.codecs {
+		if strings.EqualFold(c.Name(), name) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Resample converts samples at rate to the TDM rate. Wideband rates that
+// are multiples of it are decimated by averaging.
+func Resample(samples []int16, rate int) ([]int16, error) {
+	if rate == TDMRate {
+		return samples, nil
+	}
+	if rate < TDMRate || rate%TDMRate != 0 {
+		return nil, fmt.Errorf("unsupported sample rate %d", rate)
+	}
+	factor := rate / TDMRate
+	out := make([]int16, len(samples)/factor)
+	for i := range out {
+		sum := 0
+		for _, s := range samples[i*factor : (i+1)*factor] {
+			sum += int(s)
+		}
+		out[i] = int16(sum / factor)
+	}
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// DefaultEventPayloadType is the dynamic payload type of telephone-event
+// offered by the MGW
+const DefaultEventPayloadType = 101
+
+// Event is a telephone event of RFC 4733 section 2.3
+type Event struct {
+	Event    uint8 // 0-9, 10 for *, 11 for #, 12-15 for A-D
+	End      bool
+	Volume   uint8  // power level in -dBm0
+	Duration uint16 // in timestamp units since the event timestamp
+}
+
+// DecodeEvent decodes the payload of a telephone-event packet
+func DecodeEvent(payload []byte) (Event, error) {
+	if len(payload) < 4 {
+		return Event{}, fmt.Errorf("%w: telephone-event of %d bytes", ErrMalformed, len(payload))
+	}
+	return Event{
+		Event:    payload[0],
+		End:      payload[1]&0x80 != 0,
+		Volume:   payload[1] & 0x3f,
+		Duration: binary.BigEndian.Uint16(payload[2:4]),
+	}, nil
+}
+
+// Encode returns the payload of the event
+func (e Event) Encode() []byte {
+	b := []byte{e.Event, e.Volume & 0x3f, 0, 0}
+	if e.End {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], e.Duration)
+	return b
+}
+
+// Digit returns the DTMF digit of the event, 0 for other events
+func (e Event) Digit() byte {
+	if e.Event > 15 {
+		return 0
+	}
+	return "0123456789*#ABCD"[e.Event]
+}
+
+// Name returns the event of the DTMF detection package of H.248.1 annex
+// E.6 for the digit, "" for other events
+func (e Event) Name() string {
+	switch d := e.Digit(); {
+	case d == 0:
+		return ""
+	case d == '*':
+		return "ds"
+	case d == '#':
+		return "do"
+	case d >= 'A':
+		return "d" + string(d+'a'-'A')
+	default:
+		return "d" + string(d)
+	}
+}
+
+// dtmfFrequencies are the row and column frequencies of the DTMF digits,
+// by event
+var dtmfFrequencies = [16][2]float64{
+	{941, 1336}, {697, 1209}, {697, 1336}, {697, 1477},
+	{770, 1209}, {770, 1336}, {770, 1477}, {852, 1209},
+	{852, 1336}, {852, 1477}, {941, 1209}, {941, 1477},
+	{697, 1633}, {770, 1633}, {852, 1633}, {941, 1633},
+}
+
+// Tone returns n samples of the DTMF tone of an event, from sample offset
+// of the event, at its volume
+func Tone(e Event, offset, n int) []int16 {
+	samples := make([]int16, n)
+	if e.Event > 15 {
+		return samples
+	}
+	// 0 dBm0 is a sine of amplitude 32768/1.414 (G.711 table 5); each of
+	// the two frequencies is at the volume of the event
+	amplitude := 32768 / math.Sqrt2 * math.Pow(10, -float64(e.Volume)/20)
+	f := dtmfFrequencies[e.Event]
+	for i := range samples {
+		t := float64(offset+i) / TDMRate
+		v := amplitude * (math.Sin(2*math.Pi*f[0]*t) + math.Sin(2*math.Pi*f[1]*t))
+		samples[i] = int16(math.Max(math.Min(v, math.MaxInt16), math.MinInt16))
+	}
+	return samples
+}
+
+// DTMFDetector reports the telephone events of a stream once each, though
+// they are sent in several packets and their end is retransmitted
+// (RFC 4733 section 2.5)
+type DTMFDetector struct {
+	seen      bool
+	timestamp uint32
+}
+
+// Detect returns the event of a telephone-event packet, and whether it
+// is a new event
+func (d *DTMFDetector) Detect(p *Packet) (Event, bool, error) {
+	e, err := DecodeEvent(p.Payload)
+	if err != nil {
+		return e, false, err
+	}
+	if d.seen && p.Timestamp == d.timestamp {
+		return e, false, nil
+	}
+	d.seen, d.timestamp = true, p.Timestamp
+	return e, true, nil
+}
@@ -0,0 +1,87 @@
+package media
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEvent_RoundTrip(t *testing.T) {
+	e := Event{Event: 11, End: true, Volume: 10, Duration: 1280}
+	got, err := DecodeEvent(e.Encode())
+	if err != nil || got != e {
+		t.Errorf("DecodeEvent(Encode()) = %+v, %v, want %+v", got, err, e)
+	}
+	if _, err := DecodeEvent([]byte{1, 2}); err == nil {
+		t.Error("DecodeEvent() of 2 bytes error = nil")
+	}
+}
+
+func TestEvent_Names(t *testing.T) {
+	tests := []struct {
+		event uint8
+		digit byte
+		name  string
+	}{
+		{0, '0', "d0"},
+		{9, '9', "d9"},
+		{10, '*', "ds"},
+		{11, '#', "do"},
+		{12, 'A', "da"},
+		{15, 'D', "dd"},
+		{16, 0, ""},
+	}
+	for _, tt := range tests {
+		e := Event{Event: tt.event}
+		if e.Digit() != tt.digit || e.Name() != tt.name {
+			t.Errorf("event %d: Digit() = %q, Name() = %q, want %q and %q", tt.event, e.Digit(), e.Name(), tt.digit, tt.name)
+		}
+	}
+}
+
+// power returns the power of samples at frequency f, with the Goertzel
+// algorithm
+func power(samples []int16, f float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*f/TDMRate)
+	var s1, s2 float64
+	for _, s := range samples {
+		s0 := float64(s) + coeff*s1 - s2
+		s2, s1 = s1, s0
+	}
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+func TestTone(t *testing.T) {
+	// Digit 5 is 770 Hz and 1336 Hz
+	samples := Tone(Event{Event: 5, Volume: 10}, 0, 400)
+	tone := math.Min(power(samples, 770), power(samples, 1336))
+	for _, f := range []float64{697, 852, 941, 1209, 1477, 1633} {
+		if p := power(samples, f); p > tone/10 {
+			t.Errorf("power at %v Hz = %g, tone %g", f, p, tone)
+		}
+	}
+	if louder := Tone(Event{Event: 5, Volume: 0}, 0, 400); power(louder, 770) <= power(samples, 770) {
+		t.Error("volume 0 is not louder than volume 10")
+	}
+}
+
+func TestDTMFDetector(t *testing.T) {
+	var d DTMFDetector
+	packets := []struct {
+		timestamp uint32
+		event     Event
+		want      bool
+	}{
+		{1000, Event{Event: 1, Duration: 160}, true},
+		{1000, Event{Event: 1, Duration: 320}, false},
+		{1000, Event{Event: 1, End: true, Duration: 480}, false},
+		{1000, Event{Event: 1, End: true, Duration: 480}, false},
+		{2000, Event{Event: 1, Duration: 160}, true},
+		{3000, Event{Event: 11, End: true, Duration: 800}, true},
+	}
+	for i, p := range packets {
+		e, isNew, err := d.Detect(&Packet{Timestamp: p.timestamp, Payload: p.event.Encode()})
+		if err != nil || isNew != p.want || e != p.event {
+			t.Errorf("packet %d: Detect() = %+v, %v, %v, want new %v", i, e, isNew, err, p.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package media
+
+// The G.711 codecs, 8 bit logarithmic samples at 8 kHz
+var (
+	PCMU Codec = &g711{name: "PCMU", payloadType: 0, encode: linearToULaw, decode: ulawToLinear}
+	PCMA Codec = &g711{name: "PCMA", payloadType: 8, encode: linearToALaw, decode: alawToLinear}
+)
+
+// g711 is a G.711 codec, a companding law
+type g711 struct {
+	name        string
+	payloadType uint8
+	encode      func(int16) byte
+	decode      func(byte) int16
+}
+
+func (c g711) Name() string       { return c.name }
+func (c g711) PayloadType() uint8 { return c.payloadType }
+func (c g711) ClockRate() int     { return TDMRate }
+
+func (c g711) Decode(payload []byte) ([]int16, error) {
+	samples := make([]int16, len(payload))
+	for i, b := range payload {
+		samples[i] = c.decode(b)
+	}
+	return samples, nil
+}
+
+func (c g711) Encode(samples []int16) ([]byte, error) {
+	payload := make([]byte, len(samples))
+	for i, s := range samples {
+		payload[i] = c.encode(s)
+	}
+	return payload, nil
+}
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+// linearToULaw compands a linear sample with the μ-law of G.711
+func linearToULaw(sample int16) byte {
+	pcm := int(sample)
+	sign := 0
+	if pcm < 0 {
+		pcm, sign = -pcm, 0x80
+	}
+	if pcm > ulawClip {
+		pcm = ulawClip
+	}
+	pcm += ulawBias
+	exponent := 7
+	for mask := 0x4000; pcm&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (pcm >> (exponent + 3)) & 0x0f
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// ulawToLinear expands a μ-law sample
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0f) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+// alawSegmentEnds are the upper bounds of the segments of the A-law, on
+// 13 bit magnitudes
+var alawSegmentEnds = [8]int{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+
+// linearToALaw compands a linear sample with the A-law of G.711. Even bits
+// are inverted.
+func linearToALaw(sample int16) byte {
+	pcm := int(sample) >> 3
+	mask := byte(0xd5)
+	if pcm < 0 {
+		mask, pcm = 0x55, -pcm-1
+	}
+	segment := 0
+	for segment < len(alawSegmentEnds) && pcm > alawSegmentEnds[segment] {
+		segment++
+	}
+	if segment == len(alawSegmentEnds) {
+		return 0x7f ^ mask
+	}
+	a := byte(segment << 4)
+	if segment < 2 {
+		a |= byte(pcm>>1) & 0x0f
+	} else {
+		a |= byte(pcm>>segment) & 0x0f
+	}
+	return a ^ mask
+}
+
+// alawToLinear expands an A-law sample
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0f) << 4
+	switch segment := int(a&0x70) >> 4; segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
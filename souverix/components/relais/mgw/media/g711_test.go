@@ -0,0 +1,107 @@
+package media
+
+import (
+	"testing"
+)
+
+func TestG711_KnownValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		codec  Codec
+		sample byte
+		linear int16
+	}{
+		{"μ-law zero", PCMU, 0xff, 0},
+		{"μ-law max", PCMU, 0x80, 32124},
+		{"μ-law min", PCMU, 0x00, -32124},
+		{"A-law smallest positive", PCMA, 0xd5, 8},
+		{"A-law smallest negative", PCMA, 0x55, -8},
+		{"A-law max", PCMA, 0xaa, 32256},
+		{"A-law min", PCMA, 0x2a, -32256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, err := tt.codec.Decode([]byte{tt.sample})
+			if err != nil || len(samples) != 1 || samples[0] != tt.linear {
+				t.Errorf("Decode(%#x) = %v, %v, want %d", tt.sample, samples, err, tt.linear)
+			}
+			payload, err := tt.codec.Encode([]int16{tt.linear})
+			if err != nil || len(payload) != 1 || payload[0] != tt.sample {
+				t.Errorf("Encode(%d) = %x, %v, want %#x", tt.linear, payload, err, tt.sample)
+			}
+		})
+	}
+}
+
+func TestG711_RoundTrip(t *testing.T) {
+	for _, codec := range []Codec{PCMU, PCMA} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			// Every companded value expands to a sample that compands back
+			// to the same level
+			all := make([]byte, 256)
+			for i := range all {
+				all[i] = byte(i)
+			}
+			samples, _ := codec.Decode(all)
+			again, _ := codec.Encode(samples)
+			expanded, _ := codec.Decode(again)
+			for i := range samples {
+				if expanded[i] != samples[i] {
+					t.Errorf("%#x: %d re-encodes to %d", i, samples[i], expanded[i])
+				}
+			}
+		})
+	}
+}
+
+func TestG711_Quantization(t *testing.T) {
+	// The error of companding is within a quantization step, relatively
+	// small for loud samples
+	for _, codec := range []Codec{PCMU, PCMA} {
+		for _, s := range []int16{-32768, -20000, -1000, -100, 0, 100, 1000, 20000, 32767} {
+			payload, _ := codec.Encode([]int16{s})
+			got, _ := codec.Decode(payload)
+			diff := int(got[0]) - int(s)
+			if diff < 0 {
+				diff = -diff
+			}
+			limit := int(s) / 16
+			if limit < 0 {
+				limit = -limit
+			}
+			if limit < 16 {
+				limit = 16
+			}
+			if diff > limit {
+				t.Errorf("%s: %d decodes to %d", codec.Name(), s, got[0])
+			}
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if c, ok := r.Lookup(0); !ok || c != PCMU {
+		t.Errorf("Lookup(0) = %v, %v", c, ok)
+	}
+	if c, ok := r.ByName("pcma"); !ok || c != PCMA {
+		t.Errorf("ByName(pcma) = %v, %v", c, ok)
+	}
+	if _, ok := r.Lookup(96); ok {
+		t.Error("Lookup(96) found a codec")
+	}
+	r.RegisterAs(96, PCMU)
+	if c, ok := r.Lookup(96); !ok || c != PCMU {
+		t.Errorf("Lookup(96) after RegisterAs = %v, %v", c, ok)
+	}
+}
+
+func TestResample(t *testing.T) {
+	got, err := Resample([]int16{10, 20, 30, 50}, 16000)
+	if err != nil || len(got) != 2 || got[0] != 15 || got[1] != 40 {
+		t.Errorf("Resample(16000) = %v, %v", got, err)
+	}
+	if _, err := Resample([]int16{1}, 11025); err == nil {
+		t.Error("Resample(11025) error = nil")
+	}
+}
@@ -0,0 +1,108 @@
+package media
+
+// Status is the outcome of playing out a frame from a jitter buffer
+type Status int
+
+const (
+	// StatusPlayed is a packet played out in order
+	StatusPlayed Status = iota
+	// StatusLost is a packet missing at its playout time
+	StatusLost
+	// StatusBuffering is no packet to play out: the buffer is filling
+	// up, initially or after an underrun
+	StatusBuffering
+)
+
+// JitterBuffer reorders the packets of a stream and delays their playout
+// by Depth packets, absorbing the jitter of the network. Packets arriving
+// after their playout time are dropped.
+type JitterBuffer struct {
+	depth   int
+	max     int
+	packets map[uint16]*Packet
+
+	playing bool
+	played  bool   // a packet was played out, next is set
+	next    uint16 // sequence number of the next packet to play out
+
+	// Late counts the packets dropped after their playout time, and
+	// Overflow those dropped when the buffer is full
+	Late     int
+	Overflow int
+}
+
+// NewJitterBuffer creates a jitter buffer delaying playout by depth
+// packets and holding at most max
+func NewJitterBuffer(depth, max int) *JitterBuffer {
+	if depth < 1 {
+		depth = 1
+	}
+	if max < depth {
+		max = depth
+	}
+	return &JitterBuffer{depth: depth, max: max, packets: make(map[uint16]*Packet)}
+}
+
+// Len returns the number of packets buffered
+func (j *JitterBuffer) Len() int {
+	return len(j.packets)
+}
+
+// Push adds a packet received. It returns false for late and duplicate
+// packets, which are dropped.
+func (j *JitterBuffer) Push(p *Packet) bool {
+	if j.played && seqBefore(p.Sequence, j.next) {
+		j.Late++
+		return false
+	}
+	if _, ok := j.packets[p.Sequence]; ok {
+		return false
+	}
+	j.packets[p.Sequence] = p
+	// When full, the oldest packet is dropped: playout fell behind
+	for len(j.packets) > j.max {
+		oldest := j.oldest()
+		delete(j.packets, oldest)
+		j.Overflow++
+		if j.playing {
+			j.next = oldest + 1
+		}
+	}
+	return true
+}
+
+// Pop returns the packet to play out next. Once playing, a missing packet
+// is lost; an empty buffer is an underrun, rebuffering before playing on.
+func (j *JitterBuffer) Pop() (*Packet, Status) {
+	if !j.playing {
+		if len(j.packets) < j.depth {
+			return nil, StatusBuffering
+		}
+		j.playing = true
+		j.next = j.oldest()
+	}
+	if len(j.packets) == 0 {
+		j.playing = false
+		return nil, StatusBuffering
+	}
+	p, ok := j.packets[j.next]
+	j.next++
+	j.played = true
+	if !ok {
+		return nil, StatusLost
+	}
+	delete(j.packets, p.Sequence)
+	return p, StatusPlayed
+}
+
+// oldest returns the first sequence number buffered
+func (j *JitterBuffer) oldest() uint16 {
+	var first uint16
+	found := false
+	for seq := range j.packets {
+		if !found || seqBefore(seq, first) {
+			first, found = seq, true
+		}
+	}
+	return first
+}
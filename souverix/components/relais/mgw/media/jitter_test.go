@@ -0,0 +1,106 @@
+package media
+
+import (
+	"testing"
+)
+
+// pop returns the sequence numbers played out by n pops, -1 for losses
+// and -2 while buffering
+func pop(j *JitterBuffer, n int) []int {
+	var got []int
+	for i := 0; i < n; i++ {
+		p, status := j.Pop()
+		switch status {
+		case StatusPlayed:
+			got = append(got, int(p.Sequence))
+		case StatusLost:
+			got = append(got, -1)
+		default:
+			got = append(got, -2)
+		}
+	}
+	return got
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJitterBuffer(t *testing.T) {
+	tests := []struct {
+		name string
+		push []uint16
+		pops int
+		want []int
+	}{
+		{"in order", []uint16{10, 11, 12, 13}, 5, []int{10, 11, 12, 13, -2}},
+		{"reordered", []uint16{11, 10, 13, 12}, 4, []int{10, 11, 12, 13}},
+		{"loss", []uint16{10, 11, 13, 14}, 4, []int{10, 11, -1, 13}},
+		{"wrap around", []uint16{65534, 65535, 0, 1}, 4, []int{65534, 65535, 0, 1}},
+		{"filling up", []uint16{10, 11}, 1, []int{-2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := NewJitterBuffer(3, 10)
+			for _, seq := range tt.push {
+				j.Push(&Packet{Sequence: seq})
+			}
+			if got := pop(j, tt.pops); !equal(got, tt.want) {
+				t.Errorf("played %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJitterBuffer_LateAndDuplicate(t *testing.T) {
+	j := NewJitterBuffer(2, 10)
+	j.Push(&Packet{Sequence: 1})
+	j.Push(&Packet{Sequence: 2})
+	if j.Push(&Packet{Sequence: 2}) {
+		t.Error("Push() of a duplicate = true")
+	}
+	pop(j, 2)
+	if j.Push(&Packet{Sequence: 1}) || j.Late != 1 {
+		t.Errorf("Push() of a late packet accepted, Late = %d", j.Late)
+	}
+}
+
+func TestJitterBuffer_Underrun(t *testing.T) {
+	j := NewJitterBuffer(2, 10)
+	j.Push(&Packet{Sequence: 1})
+	j.Push(&Packet{Sequence: 2})
+	if got := pop(j, 3); !equal(got, []int{1, 2, -2}) {
+		t.Fatalf("played %v", got)
+	}
+	// After an underrun playout resumes once refilled, from the first
+	// packet buffered
+	j.Push(&Packet{Sequence: 6})
+	if got := pop(j, 1); !equal(got, []int{-2}) {
+		t.Fatalf("played %v while refilling", got)
+	}
+	j.Push(&Packet{Sequence: 7})
+	if got := pop(j, 2); !equal(got, []int{6, 7}) {
+		t.Errorf("played %v after underrun, want [6 7]", got)
+	}
+}
+
+func TestJitterBuffer_Overflow(t *testing.T) {
+	j := NewJitterBuffer(1, 3)
+	for seq := uint16(1); seq <= 5; seq++ {
+		j.Push(&Packet{Sequence: seq})
+	}
+	if j.Len() != 3 || j.Overflow != 2 {
+		t.Errorf("Len() = %d, Overflow = %d, want 3 and 2", j.Len(), j.Overflow)
+	}
+	if got := pop(j, 3); !equal(got, []int{3, 4, 5}) {
+		t.Errorf("played %v, want [3 4 5]", got)
+	}
+}
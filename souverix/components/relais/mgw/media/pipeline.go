@@ -0,0 +1,299 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FrameDuration is the playout interval of a pipeline, the usual
+// packetization time of voice
+const FrameDuration = 20 * time.Millisecond
+
+// frameSamples is the number of TDM samples of a frame
+const frameSamples = TDMRate * int(FrameDuration/time.Millisecond) / 1000
+
+const (
+	defaultJitterDepth = 3
+	defaultJitterMax   = 50
+)
+
+// maxTimestampGap is the largest gap between the RTP timestamps of two
+// packets that is concealed, in TDM samples; a larger jump starts a new
+// talkspurt, played on without filling
+const maxTimestampGap = 3 * frameSamples
+
+// Config configures a pipeline
+type Config struct {
+	Codecs *Registry // NewRegistry() when nil
+
+	// TDM is the law of the circuit; when nil the samples are written as
+	// 16 bit little endian linear PCM
+	TDM Codec
+
+	JitterDepth int // packets, 3 when 0
+	JitterMax   int // packets, 50 when 0
+
+	// EventPayloadType is the payload type of telephone-event,
+	// DefaultEventPayloadType when 0. OnEvent is called once for each
+	// event received.
+	EventPayloadType uint8
+	OnEvent          func(Event)
+}
+
+// Stats are the counters of a pipeline
+type Stats struct {
+	Received  int // packets accepted
+	Invalid   int // packets that cannot be decoded
+	Late      int // packets dropped after their playout time
+	Overflow  int // packets dropped from a full jitter buffer
+	Played    int // audio packets played out
+	Concealed int // gaps concealing lost audio
+	Events    int // telephone events detected
+}
+
+// Pipeline bridges the RTP stream of a termination to a circuit: packets
+// are pushed as they are received and a frame is written to the circuit at
+// each Tick, every FrameDuration
+type Pipeline struct {
+	config Config
+	sink   io.Writer
+
+	mu      sync.Mutex
+	jitter  *JitterBuffer
+	dtmf    DTMFDetector
+	started bool
+	codec   Codec   // of the last audio packet
+	last    []int16 // last audio frame, for concealment
+	lost    int     // frames lost in a row
+	ended   bool    // the current telephone event has ended
+	stats   Stats
+
+	// queue holds the samples to play out, in RTP timestamp order. When
+	// synced, timestamp is the RTP timestamp of the sample following them.
+	queue     []int16
+	synced    bool
+	timestamp uint32
+}
+
+// NewPipeline creates a pipeline writing to the circuit sink
+func NewPipeline(sink io.Writer, config Config) *Pipeline {
+	if config.Codecs == nil {
+		config.Codecs = NewRegistry()
+	}
+	if config.JitterDepth == 0 {
+		config.JitterDepth = defaultJitterDepth
+	}
+	if config.JitterMax == 0 {
+		config.JitterMax = defaultJitterMax
+	}
+	if config.EventPayloadType == 0 {
+		config.EventPayloadType = DefaultEventPayloadType
+	}
+	return &Pipeline{
+		config: config,
+		sink:   sink,
+		jitter: NewJitterBuffer(config.JitterDepth, config.JitterMax),
+	}
+}
+
+// Push adds an RTP packet received to the jitter buffer. data is copied.
+func (p *Pipeline) Push(data []byte) error {
+	packet, err := Decode(append([]byte(nil), data...))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.Invalid++
+		return err
+	}
+	if _, ok := p.config.Codecs.Lookup(packet.PayloadType); !ok && packet.PayloadType != p.config.EventPayloadType {
+		p.stats.Invalid++
+		return fmt.Errorf("unsupported payload type %d", packet.PayloadType)
+	}
+	late := p.jitter.Late
+	if p.jitter.Push(packet) {
+		p.stats.Received++
+	}
+	p.stats.Late += p.jitter.Late - late
+	return nil
+}
+
+// Tick writes the next frame of exactly frameSamples samples to the
+// circuit, taking as many packets as it needs whatever their packetization
+// time. Nothing is written until the jitter buffer first fills up; then
+// losses and underruns are concealed.
+func (p *Pipeline) Tick() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.queue) < frameSamples {
+		overflow := p.jitter.Overflow
+		packet, status := p.jitter.Pop()
+		p.stats.Overflow += p.jitter.Overflow - overflow
+		switch {
+		case status == StatusPlayed && packet.PayloadType == p.config.EventPayloadType:
+			// Events carry the timestamp of their start
+			p.synced = false
+			p.queue = append(p.queue, p.event(packet)...)
+		case status == StatusPlayed:
+			p.queueAudio(packet)
+		case status == StatusLost:
+			p.queueConcealed(p.frameLen())
+		case !p.started:
+			return nil
+		default:
+			// After an underrun the stream goes on at a timestamp of its own
+			p.synced = false
+			p.queue = append(p.queue, p.conceal(frameSamples-len(p.queue))...)
+		}
+		p.started = true
+	}
+	err := p.write(p.queue[:frameSamples])
+	p.queue = append(p.queue[:0], p.queue[frameSamples:]...)
+	return err
+}
+
+// Stats returns the counters of the pipeline
+func (p *Pipeline) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// queueAudio queues the TDM samples of an audio packet at its timestamp:
+// a gap since the previous packet is concealed and the samples already
+// queued are dropped
+func (p *Pipeline) queueAudio(packet *Packet) {
+	codec, _ := p.config.Codecs.Lookup(packet.PayloadType)
+	samples, err := DecodeAudio(codec, packet.Payload)
+	if err != nil {
+		p.stats.Invalid++
+		p.queueConcealed(p.frameLen())
+		return
+	}
+	played := samples
+	if p.synced && !packet.Marker && codec == p.codec {
+		gap := int(int32(packet.Timestamp-p.timestamp)) * TDMRate / codec.ClockRate()
+		switch {
+		case gap < 0 && -gap >= len(samples):
+			p.stats.Late++
+			return
+		case gap < 0:
+			played = samples[-gap:]
+		case gap > 0 && gap <= maxTimestampGap:
+			p.queue = append(p.queue, p.conceal(gap)...)
+		}
+	}
+	p.codec, p.last, p.lost = codec, samples, 0
+	p.synced = true
+	p.timestamp = packet.Timestamp + uint32(len(samples)*codec.ClockRate()/TDMRate)
+	p.stats.Played++
+	p.queue = append(p.queue, played...)
+}
+
+// queueConcealed queues n samples concealing a lost packet
+func (p *Pipeline) queueConcealed(n int) {
+	p.queue = append(p.queue, p.conceal(n)...)
+	if p.synced {
+		p.timestamp += uint32(n * p.codec.ClockRate() / TDMRate)
+	}
+}
+
+// frameLen returns the number of samples of the last audio packet, those
+// of a lost one
+func (p *Pipeline) frameLen() int {
+	if len(p.last) == 0 {
+		return frameSamples
+	}
+	return len(p.last)
+}
+
+// conceal returns n samples replacing lost audio
+func (p *Pipeline) conceal(n int) []int16 {
+	p.lost++
+	p.stats.Concealed++
+	if c, ok := p.codec.(Concealer); ok {
+		if samples, err := Resample(c.Conceal(n*p.codec.ClockRate()/TDMRate, p.lost), p.codec.ClockRate()); err == nil {
+			return samples
+		}
+	}
+	return conceal(p.last, n, p.lost)
+}
+
+// event returns the in-band DTMF tone of a telephone-event packet, for
+// the part of the event since the previous packet
+func (p *Pipeline) event(packet *Packet) []int16 {
+	e, isNew, err := p.dtmf.Detect(packet)
+	if err != nil {
+		p.stats.Invalid++
+		return make([]int16, frameSamples)
+	}
+	if isNew {
+		p.ended = false
+		p.stats.Events++
+		if p.config.OnEvent != nil {
+			p.config.OnEvent(e)
+		}
+	}
+	// The retransmissions of the end of an event are silent
+	if p.ended {
+		return make([]int16, frameSamples)
+	}
+	p.ended = e.End
+	offset := int(e.Duration) - frameSamples
+	if offset < 0 {
+		offset = 0
+	}
+	return Tone(e, offset, frameSamples)
+}
+
+// write writes samples to the circuit in its law
+func (p *Pipeline) write(samples []int16) error {
+	var data []byte
+	if p.config.TDM != nil {
+		var err error
+		if data, err = p.config.TDM.Encode(samples); err != nil {
+			return err
+		}
+	} else {
+		data = make([]byte, 2*len(samples))
+		for i, s := range samples {
+			binary.LittleEndian.PutUint16(data[2*i:], uint16(s))
+		}
+	}
+	_, err := p.sink.Write(data)
+	return err
+}
+
+// DecodeAudio returns the samples of a payload at the TDM rate
+func DecodeAudio(codec Codec, payload []byte) ([]int16, error) {
+	samples, err := codec.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return Resample(samples, codec.ClockRate())
+}
+
+// Transcode converts the audio of an RTP packet to the samples of a
+// circuit in law tdm
+func Transcode(data []byte, codecs *Registry, tdm Codec) ([]byte, error) {
+	packet, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	codec, ok := codecs.Lookup(packet.PayloadType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported payload type %d", packet.PayloadType)
+	}
+	// Without transcoding, the payload is already in the law of the circuit
+	if codec == tdm {
+		return packet.Payload, nil
+	}
+	samples, err := DecodeAudio(codec, packet.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return tdm.Encode(samples)
+}
@@ -0,0 +1,311 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// packet returns the wire format of an RTP packet
+func packet(t *testing.T, pt uint8, seq uint16, timestamp uint32, payload []byte) []byte {
+	t.Helper()
+	b, err := (&Packet{PayloadType: pt, Sequence: seq, Timestamp: timestamp, SSRC: 1, Payload: payload}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	return b
+}
+
+// frame returns a frame of 160 samples of value v in codec
+func frame(codec Codec, v int16) []byte {
+	samples := make([]int16, frameSamples)
+	for i := range samples {
+		samples[i] = v
+	}
+	payload, _ := codec.Encode(samples)
+	return payload
+}
+
+// transcoded returns the frame of value v in codec from, in codec to
+func transcoded(from, to Codec, v int16) []byte {
+	samples, _ := from.Decode(frame(from, v))
+	payload, _ := to.Encode(samples)
+	return payload
+}
+
+// linear returns the samples of 16 bit little endian PCM
+func linear(b []byte) []int16 {
+	samples := make([]int16, len(b)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return samples
+}
+
+func TestPipeline_Transcoding(t *testing.T) {
+	// μ-law RTP to an A-law circuit
+	var sink bytes.Buffer
+	p := NewPipeline(&sink, Config{TDM: PCMA, JitterDepth: 2})
+	for i := uint16(0); i < 3; i++ {
+		if err := p.Push(packet(t, 0, i, uint32(i)*uint32(frameSamples), frame(PCMU, 1000))); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := p.Tick(); err != nil {
+			t.Fatalf("Tick() error = %v", err)
+		}
+	}
+	if sink.Len() != 3*frameSamples {
+		t.Fatalf("sink has %d bytes, want %d", sink.Len(), 3*frameSamples)
+	}
+	if want := transcoded(PCMU, PCMA, 1000); !bytes.Equal(sink.Bytes()[:frameSamples], want) {
+		t.Errorf("sink frame = %x, want %x", sink.Bytes()[:8], want[:8])
+	}
+	if stats := p.Stats(); stats.Received != 3 || stats.Played != 3 || stats.Concealed != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestPipeline_PacketizationTime(t *testing.T) {
+	for _, ptime := range []int{10, 30} {
+		n := TDMRate * ptime / 1000
+		var sink bytes.Buffer
+		p := NewPipeline(&sink, Config{JitterDepth: 1})
+		var want []int16
+		for i := 0; i < 6; i++ {
+			samples := make([]int16, n)
+			for j := range samples {
+				samples[j] = int16(1000 * (i + 1))
+			}
+			payload, _ := PCMA.Encode(samples)
+			p.Push(packet(t, 8, uint16(i+1), uint32(i*n), payload))
+			decoded, _ := PCMA.Decode(payload)
+			want = append(want, decoded...)
+		}
+		// Each tick plays a frame of 20 ms, however the audio is packetized
+		ticks := 6 * n / frameSamples
+		for i := 0; i < ticks; i++ {
+			if err := p.Tick(); err != nil {
+				t.Fatalf("Tick() error = %v", err)
+			}
+		}
+		got := linear(sink.Bytes())
+		if len(got) != ticks*frameSamples {
+			t.Fatalf("ptime %d: %d samples written in %d ticks, want %d", ptime, len(got), ticks, ticks*frameSamples)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("ptime %d: sample %d = %d, want %d", ptime, i, got[i], want[i])
+			}
+		}
+		if stats := p.Stats(); stats.Played != 6 || stats.Concealed != 0 {
+			t.Errorf("ptime %d: Stats() = %+v, want 6 played", ptime, stats)
+		}
+	}
+}
+
+func TestPipeline_Timestamps(t *testing.T) {
+	var sink bytes.Buffer
+	p := NewPipeline(&sink, Config{JitterDepth: 1})
+	p.Push(packet(t, 8, 1, 0, frame(PCMA, 1000)))
+	// A frame skipped by the sender, then a packet overlapping the previous
+	// one by 80 samples
+	p.Push(packet(t, 8, 2, 320, frame(PCMA, 2000)))
+	p.Push(packet(t, 8, 3, 400, frame(PCMA, 3000)))
+	for i := 0; i < 4; i++ {
+		p.Tick()
+	}
+	samples := linear(sink.Bytes())
+	if len(samples) != 4*frameSamples {
+		t.Fatalf("%d samples written, want %d", len(samples), 4*frameSamples)
+	}
+	value := func(v int16) int16 {
+		decoded, _ := PCMA.Decode(frame(PCMA, v))
+		return decoded[0]
+	}
+	for _, want := range []struct {
+		at    int
+		value int16
+	}{
+		{0, value(1000)},
+		{frameSamples, value(1000)}, // concealed
+		{2 * frameSamples, value(2000)},
+		{3 * frameSamples, value(3000)},
+	} {
+		if got := samples[want.at]; got != want.value {
+			t.Errorf("sample %d = %d, want %d", want.at, got, want.value)
+		}
+	}
+	// Only the last 80 samples of packet 3 are new: the underrun after them
+	// is concealed within the last frame
+	if stats := p.Stats(); stats.Played != 3 || stats.Concealed != 2 {
+		t.Errorf("Stats() = %+v, want 3 played and 2 concealed", stats)
+	}
+}
+
+func TestPipeline_BuffersBeforePlayout(t *testing.T) {
+	var sink bytes.Buffer
+	p := NewPipeline(&sink, Config{})
+	p.Push(packet(t, 8, 1, 0, frame(PCMA, 500)))
+	p.Tick()
+	if sink.Len() != 0 {
+		t.Errorf("sink has %d bytes before the jitter buffer filled up", sink.Len())
+	}
+}
+
+func TestPipeline_Concealment(t *testing.T) {
+	var sink bytes.Buffer
+	p := NewPipeline(&sink, Config{JitterDepth: 1})
+	p.Push(packet(t, 8, 1, 0, frame(PCMA, 8000)))
+	p.Push(packet(t, 8, 3, 320, frame(PCMA, 8000)))
+	// Packet 2 is lost, then the stream stops for the rest of the call
+	for i := 0; i < 9; i++ {
+		p.Tick()
+	}
+	samples := linear(sink.Bytes())
+	if len(samples) != 9*frameSamples {
+		t.Fatalf("%d samples written, want %d", len(samples), 9*frameSamples)
+	}
+	// Lost frames repeat the last one, fading out to silence
+	at := func(frame int) int16 { return samples[frame*frameSamples] }
+	if at(0) == 0 || at(1) != at(0) || at(2) != at(0) || at(3) != at(0) {
+		t.Errorf("frames start with %d %d %d %d, want the last frame repeated", at(0), at(1), at(2), at(3))
+	}
+	if !(at(4) < at(3) && at(5) < at(4) && at(6) < at(5) && at(7) < at(6)) {
+		t.Errorf("concealment does not fade: %d %d %d %d", at(4), at(5), at(6), at(7))
+	}
+	if at(8) != 0 {
+		t.Errorf("frame 8 = %d, want silence", at(8))
+	}
+	if stats := p.Stats(); stats.Played != 2 || stats.Concealed != 7 {
+		t.Errorf("Stats() = %+v, want 2 played and 7 concealed", stats)
+	}
+}
+
+// fadeCodec is a codec with its own concealment, of constant samples
+type fadeCodec struct{}
+
+func (fadeCodec) Name() string                           { return "FADE" }
+func (fadeCodec) PayloadType() uint8                     { return 96 }
+func (fadeCodec) ClockRate() int                         { return 16000 }
+func (fadeCodec) Decode(payload []byte) ([]int16, error) { return make([]int16, 2*len(payload)), nil }
+func (fadeCodec) Encode(samples []int16) ([]byte, error) { return make([]byte, len(samples)/2), nil }
+func (fadeCodec) Conceal(n, lost int) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = 42
+	}
+	return samples
+}
+
+func TestPipeline_PluggableCodec(t *testing.T) {
+	codecs := NewRegistry()
+	codecs.Register(fadeCodec{})
+	var sink bytes.Buffer
+	p := NewPipeline(&sink, Config{Codecs: codecs, JitterDepth: 1})
+	if err := p.Push(packet(t, 96, 1, 0, make([]byte, 160))); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	p.Tick()
+	p.Tick()
+	samples := linear(sink.Bytes())
+	// 320 wideband samples are 160 at the TDM rate
+	if len(samples) != 2*frameSamples {
+		t.Fatalf("%d samples written, want %d", len(samples), 2*frameSamples)
+	}
+	if samples[frameSamples] != 42 {
+		t.Errorf("concealed sample = %d, want the codec concealment", samples[frameSamples])
+	}
+}
+
+func TestPipeline_UnsupportedPayload(t *testing.T) {
+	p := NewPipeline(&bytes.Buffer{}, Config{})
+	if err := p.Push(packet(t, 18, 1, 0, []byte{1})); err == nil {
+		t.Error("Push() of G.729 error = nil")
+	}
+	if err := p.Push([]byte{1, 2, 3}); err == nil {
+		t.Error("Push() of garbage error = nil")
+	}
+	if stats := p.Stats(); stats.Invalid != 2 {
+		t.Errorf("Invalid = %d, want 2", stats.Invalid)
+	}
+}
+
+func TestPipeline_DTMF(t *testing.T) {
+	var events []Event
+	var sink bytes.Buffer
+	p := NewPipeline(&sink, Config{JitterDepth: 1, OnEvent: func(e Event) { events = append(events, e) }})
+
+	// Digit 7 in three packets and two retransmissions of its end
+	seq := uint16(1)
+	for _, e := range []Event{
+		{Event: 7, Volume: 10, Duration: 160},
+		{Event: 7, Volume: 10, Duration: 320},
+		{Event: 7, Volume: 10, Duration: 480, End: true},
+		{Event: 7, Volume: 10, Duration: 480, End: true},
+		{Event: 7, Volume: 10, Duration: 480, End: true},
+	} {
+		p.Push(packet(t, DefaultEventPayloadType, seq, 8000, e.Encode()))
+		seq++
+	}
+	for i := 0; i < 5; i++ {
+		p.Tick()
+	}
+	if len(events) != 1 || events[0].Digit() != '7' {
+		t.Fatalf("events = %+v, want digit 7 once", events)
+	}
+	samples := linear(sink.Bytes())
+	if len(samples) != 5*frameSamples {
+		t.Fatalf("%d samples written", len(samples))
+	}
+	// The tone is regenerated in band for the duration of the event,
+	// silence after
+	tone := samples[:3*frameSamples]
+	if power(tone, 852) < 100*power(tone, 941) || power(tone, 1209) < 100*power(tone, 1336) {
+		t.Error("tone is not the DTMF tone of 7")
+	}
+	for _, s := range samples[3*frameSamples:] {
+		if s != 0 {
+			t.Fatal("retransmitted end of event is not silent")
+		}
+	}
+}
+
+func TestPipeline_FileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tdm.pcm")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	p := NewPipeline(f, Config{TDM: PCMU, JitterDepth: 1})
+	p.Push(packet(t, 0, 1, 0, frame(PCMU, -300)))
+	if err := p.Tick(); err != nil {
+		t.Fatalf("Tick() error = %v", err)
+	}
+	f.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(data, frame(PCMU, -300)) {
+		t.Errorf("file has %d bytes, want the μ-law frame passed through", len(data))
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	codecs := NewRegistry()
+	got, err := Transcode(packet(t, 0, 1, 0, frame(PCMU, 2000)), codecs, PCMA)
+	if err != nil || !bytes.Equal(got, transcoded(PCMU, PCMA, 2000)) {
+		t.Errorf("Transcode(PCMU to PCMA) = %x, %v", got, err)
+	}
+	got, err = Transcode(packet(t, 8, 1, 0, []byte{1, 2, 3}), codecs, PCMA)
+	if err != nil || !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("Transcode(PCMA to PCMA) = %x, %v, want the payload", got, err)
+	}
+	if _, err := Transcode(packet(t, 99, 1, 0, nil), codecs, PCMA); err == nil {
+		t.Error("Transcode() of an unknown payload type error = nil")
+	}
+}
@@ -0,0 +1,22 @@
+package media
+
+// fadeFrames is the number of lost frames over which concealment fades out
+// to silence
+const fadeFrames = 5
+
+// conceal returns the samples replacing a lost frame of n samples, the
+// lost'th lost in a row: the last frame received is repeated, fading out
+// by 20% a frame, as in G.711 appendix I, to silence from the sixth
+func conceal(last []int16, n, lost int) []int16 {
+	samples := make([]int16, n)
+	if len(last) == 0 || lost > fadeFrames {
+		return samples
+	}
+	start := 1 - float64(lost-1)/fadeFrames
+	end := 1 - float64(lost)/fadeFrames
+	for i := range samples {
+		gain := start + (end-start)*float64(i)/float64(n)
+		samples[i] = int16(float64(last[i%len(last)]) * gain)
+	}
+	return samples
+}
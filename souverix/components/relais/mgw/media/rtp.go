@@ -0,0 +1,103 @@
+// Package media implements the media path of the MGW between RTP and TDM
+// circuits: RTP depacketization, pluggable audio codecs with G.711 μ-law
+// and A-law, a jitter buffer with packet loss concealment, and RFC 4733
+// telephone events, regenerated as in-band DTMF on the circuit.
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// rtpVersion is the version of RTP (RFC 3550 section 5.1)
+const rtpVersion = 2
+
+// ErrMalformed is returned when an RTP packet cannot be decoded
+var ErrMalformed = errors.New("malformed RTP packet")
+
+// Packet is an RTP packet (RFC 3550 section 5.1)
+type Packet struct {
+	Marker      bool
+	PayloadType uint8
+	Sequence    uint16
+	Timestamp   uint32
+	SSRC        uint32
+	CSRC        []uint32
+	Payload     []byte
+}
+
+// Decode decodes an RTP packet. Header extensions are skipped and padding
+// is removed from the payload.
+func Decode(b []byte) (*Packet, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformed, len(b))
+	}
+	if version := b[0] >> 6; version != rtpVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrMalformed, version)
+	}
+	p := &Packet{
+		Marker:      b[1]&0x80 != 0,
+		PayloadType: b[1] & 0x7f,
+		Sequence:    binary.BigEndian.Uint16(b[2:4]),
+		Timestamp:   binary.BigEndian.Uint32(b[4:8]),
+		SSRC:        binary.BigEndian.Uint32(b[8:12]),
+	}
+	offset := 12
+	count := int(b[0] & 0x0f)
+	if len(b) < offset+4*count {
+		return nil, fmt.Errorf("%w: truncated CSRC list", ErrMalformed)
+	}
+	for i := 0; i < count; i++ {
+		p.CSRC = append(p.CSRC, binary.BigEndian.Uint32(b[offset:]))
+		offset += 4
+	}
+	if b[0]&0x10 != 0 {
+		if len(b) < offset+4 {
+			return nil, fmt.Errorf("%w: truncated extension", ErrMalformed)
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(b[offset+2:]))
+		if len(b) < offset {
+			return nil, fmt.Errorf("%w: truncated extension", ErrMalformed)
+		}
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 {
+		padding := int(b[end-1])
+		if padding == 0 || end-padding < offset {
+			return nil, fmt.Errorf("%w: invalid padding", ErrMalformed)
+		}
+		end -= padding
+	}
+	p.Payload = b[offset:end]
+	return p, nil
+}
+
+// Encode returns the wire format of the packet
+func (p *Packet) Encode() ([]byte, error) {
+	if p.PayloadType > 0x7f {
+		return nil, fmt.Errorf("invalid payload type %d", p.PayloadType)
+	}
+	if len(p.CSRC) > 15 {
+		return nil, fmt.Errorf("too many CSRCs: %d", len(p.CSRC))
+	}
+	b := make([]byte, 12+4*len(p.CSRC), 12+4*len(p.CSRC)+len(p.Payload))
+	b[0] = rtpVersion<<6 | byte(len(p.CSRC))
+	b[1] = p.PayloadType
+	if p.Marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:4], p.Sequence)
+	binary.BigEndian.PutUint32(b[4:8], p.Timestamp)
+	binary.BigEndian.PutUint32(b[8:12], p.SSRC)
+	for i, csrc := range p.CSRC {
+		binary.BigEndian.PutUint32(b[12+4*i:], csrc)
+	}
+	return append(b, p.Payload...), nil
+}
+
+// seqBefore reports whether sequence number a is before b, with wrap
+// around (RFC 3550 appendix A.1)
+func seqBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
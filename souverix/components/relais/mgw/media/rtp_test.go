@@ -0,0 +1,90 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPacket_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet *Packet
+	}{
+		{"audio", &Packet{PayloadType: 0, Sequence: 1000, Timestamp: 160000, SSRC: 0xdeadbeef, Payload: []byte{1, 2, 3}}},
+		{"marker and CSRCs", &Packet{Marker: true, PayloadType: 101, Sequence: 65535, Timestamp: 1, SSRC: 7, CSRC: []uint32{1, 2}, Payload: []byte{4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.packet.Encode()
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			got, err := Decode(b)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.packet) {
+				t.Errorf("Decode(Encode()) = %+v, want %+v", got, tt.packet)
+			}
+		})
+	}
+}
+
+func TestDecode_ExtensionAndPadding(t *testing.T) {
+	b := []byte{
+		0xb0, 0x08, 0x00, 0x01, // V=2, P, X, PT 8, seq 1
+		0, 0, 0, 160, 0, 0, 0, 9,
+		0xbe, 0xde, 0x00, 0x01, 1, 2, 3, 4, // one word of extension
+		0xd5, 0xd5, 0, 0, 3, // payload and 3 octets of padding
+	}
+	p, err := Decode(b)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if p.PayloadType != 8 || p.Sequence != 1 || p.Timestamp != 160 || p.SSRC != 9 {
+		t.Errorf("Decode() header = %+v", p)
+	}
+	if !bytes.Equal(p.Payload, []byte{0xd5, 0xd5}) {
+		t.Errorf("Payload = %x, want d5d5", p.Payload)
+	}
+}
+
+func TestDecode_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short", []byte{0x80, 0, 0}},
+		{"version 1", []byte{0x40, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"truncated CSRC", []byte{0x82, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"truncated extension", []byte{0x90, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0xbe, 0xde, 0, 2}},
+		{"padding too long", []byte{0xa0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Decode() error = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestSeqBefore(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{65535, 0, true},
+		{0, 65535, false},
+	}
+	for _, tt := range tests {
+		if got := seqBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqBefore(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -4,58 +4,564 @@ package mgw
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/dasmlab/ims/internal/common/node"
+	"github.com/dasmlab/ims/internal/relais/mgw/media"
+	"github.com/dasmlab/ims/internal/sdp"
+	"github.com/dasmlab/souverix/common/h248"
 )
 
+// Config configures the gateway
+type Config struct {
+	MID            string // H.248 message ID of the gateway
+	ControlAddress string // UDP address of the H.248 control interface
+	MGC            string // UDP address of the controlling MGCF, the only one served
+	MediaIP        string // Address of the RTP terminations
+	Circuits       int    // Number of TDM circuits, CICs 1 to Circuits
+
+	// TDMLaw is the companding law of the circuits, PCMA or PCMU
+	TDMLaw string
+	// Sink returns the TDM side of a circuit, where the RTP received in
+	// its context is played out. Media are not bridged when nil.
+	Sink func(circuit string) io.Writer
+}
+
+// DefaultConfig returns the configuration of a gateway on the local host. Its
+// MGC must be set before it starts.
+func DefaultConfig() Config {
+	return Config{
+		MID:            "[127.0.0.1]:" + strconv.Itoa(h248.DefaultPort),
+		ControlAddress: "127.0.0.1:" + strconv.Itoa(h248.DefaultPort),
+		MediaIP:        "127.0.0.1",
+		Circuits:       30,
+		TDMLaw:         "PCMA",
+	}
+}
+
 // MGW implements the Media Gateway node.
 type MGW struct {
 	*node.BaseNode
-	// Add MGW specific fields here
+	config Config
+	peer   *h248.Peer
+	codecs *media.Registry
+	law    media.Codec
+
+	mu          sync.Mutex
+	contexts    map[uint32]*mediaContext
+	circuits    map[string]*Termination // TDM terminations, key: ID
+	nextContext uint32
+	nextRTP     int
 }
 
 // New creates a new MGW instance.
 func New() *MGW {
-	return &MGW{
+	return NewWithConfig(DefaultConfig())
+}
+
+// NewWithConfig creates an MGW with its configuration
+func NewWithConfig(config Config) *MGW {
+	m := &MGW{
 		BaseNode: node.NewBaseNode("mgw"),
+		config:   config,
+		codecs:   media.NewRegistry(),
+		contexts: make(map[uint32]*mediaContext),
+		circuits: make(map[string]*Termination),
+	}
+	var ok bool
+	if m.law, ok = m.codecs.ByName(config.TDMLaw); !ok {
+		m.law = media.PCMA
+	}
+	for cic := 1; cic <= config.Circuits; cic++ {
+		id := h248.TDMTermination(uint16(cic))
+		m.circuits[id] = &Termination{ID: id, Kind: KindTDM, Mode: h248.ModeInactive}
 	}
+	return m
 }
 
 // Start initializes and starts the MGW node.
 func (m *MGW) Start(ctx context.Context) error {
-	// TODO: Implement MGW startup
-	// - Initialize RTP handlers
-	// - Initialize TDM interfaces
-	// - Connect to MGCF
-	// - Start health checks
-	
+	conn, err := net.ListenPacket("udp", m.config.ControlAddress)
+	if err != nil {
+		return fmt.Errorf("cannot listen for H.248: %w", err)
+	}
+	if err := m.Serve(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
 	m.BaseNode.SetHealth("healthy", map[string]interface{}{
 		"started": true,
 	})
-	
+
+	return nil
+}
+
+// Serve answers the H.248 requests of the MGCF on conn, ignoring those of
+// any other address
+func (m *MGW) Serve(conn net.PacketConn) error {
+	if m.config.MGC == "" {
+		return fmt.Errorf("no MGCF configured")
+	}
+	peer, err := h248.NewPeerFrom(conn, m.config.MID, m, m.config.MGC)
+	if err != nil {
+		return fmt.Errorf("MGCF address: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peer = peer
 	return nil
 }
 
 // Stop gracefully stops the MGW node.
 func (m *MGW) Stop(ctx context.Context) error {
-	// TODO: Implement MGW shutdown
-	// - Close RTP handlers
-	// - Close TDM interfaces
-	// - Drain active media conversions
-	
+	m.mu.Lock()
+	peer := m.peer
+	for id, c := range m.contexts {
+		for _, t := range c.terminations {
+			m.subtract(c, t)
+		}
+		delete(m.contexts, id)
+	}
+	m.mu.Unlock()
+	if peer != nil {
+		peer.Close()
+	}
+
 	m.BaseNode.SetHealth("unhealthy", map[string]interface{}{
 		"stopped": true,
 	})
-	
+
 	return nil
 }
 
-// ConvertRTPToTDM converts RTP media to TDM.
+// ConvertRTPToTDM converts the audio of an RTP packet to the samples of a
+// circuit, in its companding law.
 func (m *MGW) ConvertRTPToTDM(rtpStream []byte) ([]byte, error) {
-	// TODO: Implement RTP to TDM conversion
-	// - Process RTP packets
-	// - Convert to TDM format
-	// - Update metrics
-	
 	m.BaseNode.IncrementMessages()
-	return nil, nil
+	samples, err := media.Transcode(rtpStream, m.codecs, m.law)
+	if err != nil {
+		m.BaseNode.IncrementErrors()
+		return nil, err
+	}
+	return samples, nil
+}
+
+// Codecs returns the codecs of the gateway, where codecs other than G.711
+// are registered
+func (m *MGW) Codecs() *media.Registry {
+	return m.codecs
+}
+
+// Kind is the kind of a termination
+type Kind int
+
+const (
+	// KindTDM is a circuit of the PSTN side, a physical termination
+	KindTDM Kind = iota
+	// KindRTP is an RTP stream of the IMS side, an ephemeral termination
+	KindRTP
+)
+
+// Termination is a termination of the gateway, the source or sink of the
+// media of a context
+type Termination struct {
+	ID      string
+	Kind    Kind
+	Mode    string
+	Local   string // SDP of RTP terminations
+	Remote  string
+	Context uint32 // h248.ContextNull when idle
+
+	conn     net.PacketConn // RTP socket
+	pipeline *media.Pipeline
+	source   *net.UDPAddr // RTP is received from, when known
+}
+
+// mediaContext is a context, the terminations whose media are joined
+type mediaContext struct {
+	id           uint32
+	terminations map[string]*Termination
+}
+
+// Context returns copies of the terminations of a context, nil for an
+// unknown context
+func (m *MGW) Context(id uint32) []Termination {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.contexts[id]
+	if c == nil {
+		return nil
+	}
+	terminations := make([]Termination, 0, len(c.terminations))
+	for _, t := range c.terminations {
+		terminations = append(terminations, *t)
+	}
+	return terminations
+}
+
+// Contexts returns the number of contexts
+func (m *MGW) Contexts() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.contexts)
+}
+
+// Notify reports events observed on a termination to the MGCF
+func (m *MGW) Notify(ctx context.Context, terminationID string, requestID uint32, events ...string) error {
+	m.mu.Lock()
+	peer := m.peer
+	contextID := h248.ContextNull
+	for _, c := range m.contexts {
+		if c.terminations[terminationID] != nil {
+			contextID = c.id
+		}
+	}
+	m.mu.Unlock()
+	if peer == nil || m.config.MGC == "" {
+		return fmt.Errorf("no MGCF to notify")
+	}
+	_, err := peer.Request(ctx, m.config.MGC, h248.Action{
+		ContextID: contextID,
+		Commands: []h248.Command{{
+			Type:          h248.CommandNotify,
+			TerminationID: terminationID,
+			RequestID:     requestID,
+			Events:        events,
+		}},
+	})
+	return err
+}
+
+// ServeH248 implements h248.Handler, executing the commands of the MGCF in
+// order. A transaction stops at its first failed command.
+func (m *MGW) ServeH248(p *h248.Peer, mid string, req *h248.Transaction) *h248.Transaction {
+	m.BaseNode.IncrementMessages()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply := &h248.Transaction{}
+	for _, action := range req.Actions {
+		replied, err := m.execute(action)
+		reply.Actions = append(reply.Actions, replied)
+		if err != nil {
+			m.BaseNode.IncrementErrors()
+			break
+		}
+	}
+	return reply
+}
+
+// execute executes the commands of an action. m.mu must be held.
+func (m *MGW) execute(action h248.Action) (h248.Action, error) {
+	replied := h248.Action{ContextID: action.ContextID}
+	var c *mediaContext
+	switch action.ContextID {
+	case h248.ContextChoose:
+		m.nextContext++
+		c = &mediaContext{id: m.nextContext, terminations: make(map[string]*Termination)}
+		m.contexts[c.id] = c
+		replied.ContextID = c.id
+	case h248.ContextNull, h248.ContextAll:
+	default:
+		if c = m.contexts[action.ContextID]; c == nil {
+			e := h248.Errorf(h248.ErrorUnknownContext, "unknown context %d", action.ContextID)
+			replied.Commands = []h248.Command{{TerminationID: h248.TerminationRoot, Error: e}}
+			return replied, e
+		}
+	}
+
+	var err error
+	for _, cmd := range action.Commands {
+		var result h248.Command
+		result, err = m.command(c, cmd)
+		replied.Commands = append(replied.Commands, result)
+		if err != nil {
+			break
+		}
+	}
+	// A context created for a failed action is not left half set up
+	if err != nil && action.ContextID == h248.ContextChoose {
+		for _, t := range c.terminations {
+			m.subtract(c, t)
+		}
+	}
+	if c != nil && len(c.terminations) == 0 {
+		delete(m.contexts, c.id)
+	}
+	return replied, err
+}
+
+// command executes a command in context c, nil for the null context.
+// m.mu must be held.
+func (m *MGW) command(c *mediaContext, cmd h248.Command) (h248.Command, error) {
+	result := h248.Command{Type: cmd.Type, TerminationID: cmd.TerminationID}
+	fail := func(code int, format string, args ...any) (h248.Command, error) {
+		result.Error = h248.Errorf(code, format, args...)
+		return result, result.Error
+	}
+
+	switch cmd.Type {
+	case h248.CommandAdd:
+		if c == nil {
+			return fail(h248.ErrorBadRequest, "Add to the null context")
+		}
+		var t *Termination
+		if cmd.TerminationID == h248.TerminationChoose {
+			var err error
+			if t, err = m.newRTP(c.id); err != nil {
+				return fail(h248.ErrorInsufficientResource, "%v", err)
+			}
+		} else {
+			if t = m.circuits[cmd.TerminationID]; t == nil {
+				return fail(h248.ErrorUnknownTermination, "unknown termination %s", cmd.TerminationID)
+			}
+			if t.Context != h248.ContextNull {
+				return fail(h248.ErrorTerminationInUse, "%s is in context %d", t.ID, t.Context)
+			}
+		}
+		t.Context = c.id
+		c.terminations[t.ID] = t
+		t.apply(cmd.Streams)
+		m.connect(c)
+		result.TerminationID = t.ID
+		result.Streams = t.streams()
+
+	case h248.CommandModify:
+		t := m.termination(c, cmd.TerminationID)
+		if t == nil {
+			return fail(h248.ErrorUnknownTermination, "unknown termination %s", cmd.TerminationID)
+		}
+		t.apply(cmd.Streams)
+		result.Streams = t.streams()
+
+	case h248.CommandSubtract:
+		if c == nil {
+			return fail(h248.ErrorBadRequest, "Subtract from the null context")
+		}
+		if cmd.TerminationID == h248.TerminationAll {
+			for _, t := range c.terminations {
+				m.subtract(c, t)
+			}
+			break
+		}
+		t := c.terminations[cmd.TerminationID]
+		if t == nil {
+			return fail(h248.ErrorUnknownTermination, "%s is not in context %d", cmd.TerminationID, c.id)
+		}
+		m.subtract(c, t)
+
+	default:
+		return fail(h248.ErrorNotImplemented, "%s not supported by the gateway", cmd.Type)
+	}
+	return result, nil
+}
+
+// termination returns a termination of context c, or an idle circuit in
+// the null context. m.mu must be held.
+func (m *MGW) termination(c *mediaContext, id string) *Termination {
+	if c != nil {
+		return c.terminations[id]
+	}
+	if t := m.circuits[id]; t != nil && t.Context == h248.ContextNull {
+		return t
+	}
+	return nil
+}
+
+// subtract removes a termination from its context: RTP terminations are
+// deleted, circuits return to the null context. m.mu must be held.
+func (m *MGW) subtract(c *mediaContext, t *Termination) {
+	delete(c.terminations, t.ID)
+	t.Context = h248.ContextNull
+	if t.Kind == KindRTP {
+		t.conn.Close()
+		return
+	}
+	t.Mode, t.Remote = h248.ModeInactive, ""
+}
+
+// connect bridges the RTP terminations of context c to its circuit. m.mu
+// must be held.
+func (m *MGW) connect(c *mediaContext) {
+	if m.config.Sink == nil {
+		return
+	}
+	var circuit *Termination
+	for _, t := range c.terminations {
+		if t.Kind == KindTDM {
+			circuit = t
+		}
+	}
+	if circuit == nil {
+		return
+	}
+	for _, t := range c.terminations {
+		if t.Kind == KindRTP && t.pipeline == nil {
+			m.bridge(t, circuit.ID)
+		}
+	}
+}
+
+// bridge plays the RTP received on termination t out to a circuit, until
+// t is subtracted. Telephone events are notified to the MGCF as events of
+// the DTMF detection package. m.mu must be held.
+func (m *MGW) bridge(t *Termination, circuit string) {
+	sink := m.config.Sink(circuit)
+	if sink == nil {
+		return
+	}
+	id := t.ID
+	t.pipeline = media.NewPipeline(sink, media.Config{
+		Codecs: m.codecs,
+		TDM:    m.law,
+		OnEvent: func(e media.Event) {
+			if name := e.Name(); name != "" && m.config.MGC != "" {
+				go m.Notify(context.Background(), id, 0, "dd/"+name)
+			}
+		},
+	})
+	done := make(chan struct{})
+	go m.receive(t, t.conn, t.pipeline, done)
+	go play(t.pipeline, done)
+}
+
+// receive pushes the packets received on an RTP termination from its remote
+// to its pipeline while the termination receives, until its socket is
+// closed
+func (m *MGW) receive(t *Termination, conn net.PacketConn, pipeline *media.Pipeline, done chan<- struct{}) {
+	defer close(done)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		receiving := (t.Mode == h248.ModeSendReceive || t.Mode == h248.ModeReceiveOnly) && t.accepts(from)
+		m.mu.Unlock()
+		if !receiving {
+			continue
+		}
+		if err := pipeline.Push(buf[:n]); err != nil {
+			m.BaseNode.IncrementErrors()
+		}
+	}
+}
+
+// play writes a frame of a pipeline to its circuit every frame duration
+func play(pipeline *media.Pipeline, done <-chan struct{}) {
+	ticker := time.NewTicker(media.FrameDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := pipeline.Tick(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newRTP creates an RTP termination with its socket. m.mu must be held.
+func (m *MGW) newRTP(contextID uint32) (*Termination, error) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(m.config.MediaIP, "0"))
+	if err != nil {
+		return nil, err
+	}
+	m.nextRTP++
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return &Termination{
+		ID:    "RTP/" + strconv.Itoa(m.nextRTP),
+		Kind:  KindRTP,
+		Mode:  h248.ModeInactive,
+		Local: localSDP(m.config.MediaIP, contextID, port),
+		conn:  conn,
+	}, nil
+}
+
+// localSDP returns the session description of an RTP termination,
+// offering G.711
+func localSDP(ip string, contextID uint32, port int) string {
+	network := "IP4"
+	if strings.Contains(ip, ":") {
+		network = "IP6"
+	}
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 1 IN %s %s", contextID, network, ip),
+		"s=-",
+		fmt.Sprintf("c=IN %s %s", network, ip),
+		"t=0 0",
+		fmt.Sprintf("m=audio %d RTP/AVP 0 8 %d", port, media.DefaultEventPayloadType),
+		"a=rtpmap:0 PCMU/8000",
+		"a=rtpmap:8 PCMA/8000",
+		fmt.Sprintf("a=rtpmap:%d telephone-event/8000", media.DefaultEventPayloadType),
+		fmt.Sprintf("a=fmtp:%d 0-15", media.DefaultEventPayloadType),
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// apply applies the stream parameters of a command to t
+func (t *Termination) apply(streams []h248.Stream) {
+	for _, s := range streams {
+		if s.Mode != "" {
+			t.Mode = s.Mode
+		}
+		if s.Remote != "" && t.Kind == KindRTP {
+			t.Remote = s.Remote
+			t.source = remoteAddress(s.Remote)
+		}
+	}
+}
+
+// accepts reports whether RTP from addr is received on t: from the address
+// of its remote description, or else from the first source, latched. m.mu
+// must be held.
+func (t *Termination) accepts(addr net.Addr) bool {
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if t.source == nil {
+		t.source = from
+		return true
+	}
+	return t.source.Port == from.Port && t.source.IP.Equal(from.IP)
+}
+
+// remoteAddress returns the address of the audio of a session description,
+// nil when it has none to receive from
+func remoteAddress(description string) *net.UDPAddr {
+	session, err := sdp.Parse(description)
+	if err != nil {
+		return nil
+	}
+	for _, m := range session.Media {
+		if m.Type != "audio" || m.Port == 0 {
+			continue
+		}
+		ip := net.ParseIP(session.ConnectionAddress(m))
+		if ip == nil || ip.IsUnspecified() {
+			return nil
+		}
+		return &net.UDPAddr{IP: ip, Port: m.Port}
+	}
+	return nil
+}
+
+// streams returns the Media descriptor of t for replies
+func (t *Termination) streams() []h248.Stream {
+	if t.Kind != KindRTP {
+		return nil
+	}
+	return []h248.Stream{{ID: 1, Local: t.Local}}
 }
@@ -0,0 +1,359 @@
+package mgw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/relais/mgw/media"
+	"github.com/dasmlab/souverix/common/h248"
+)
+
+const remoteSDP = "v=0\r\nc=IN IP4 192.0.2.7\r\nm=audio 6000 RTP/AVP 0\r\n"
+
+// startGateway serves a gateway with circuits on a loopback address and
+// returns it with a controller of its own loopback address
+func startGateway(t *testing.T, circuits int) (*MGW, *h248.Controller) {
+	t.Helper()
+	return startGatewayWithSink(t, circuits, nil)
+}
+
+// startGatewayWithSink starts a gateway bridging media to the circuits of
+// sink
+func startGatewayWithSink(t *testing.T, circuits int, sink func(string) io.Writer) (*MGW, *h248.Controller) {
+	t.Helper()
+	mgcConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	m := NewWithConfig(Config{
+		MID:            "mgw1",
+		ControlAddress: "127.0.0.1:0",
+		MGC:            mgcConn.LocalAddr().String(),
+		MediaIP:        "127.0.0.1",
+		Circuits:       circuits,
+		TDMLaw:         "PCMU",
+		Sink:           sink,
+	})
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	c := h248.NewController(mgcConn, "mgcf1", m.peer.Addr().String())
+	t.Cleanup(func() {
+		c.Close()
+		m.Stop(context.Background())
+	})
+	return m, c
+}
+
+// termination returns the termination id of the terminations of a context
+func termination(terminations []Termination, id string) *Termination {
+	for i := range terminations {
+		if terminations[i].ID == id {
+			return &terminations[i]
+		}
+	}
+	return nil
+}
+
+func TestMGW_CallSetupAndRelease(t *testing.T) {
+	m, c := startGateway(t, 4)
+	ctx := context.Background()
+
+	b, err := c.Setup(ctx, 2, "")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if b.ContextID == h248.ContextNull || b.TDM != "TDM/2" || !strings.HasPrefix(b.RTP, "RTP/") {
+		t.Fatalf("Setup() = %+v", b)
+	}
+	if !strings.Contains(b.LocalSDP, "c=IN IP4 127.0.0.1") || !strings.Contains(b.LocalSDP, "RTP/AVP 0 8") {
+		t.Errorf("LocalSDP = %q", b.LocalSDP)
+	}
+	terminations := m.Context(b.ContextID)
+	if len(terminations) != 2 {
+		t.Fatalf("context has %d terminations, want 2", len(terminations))
+	}
+	if rtp := termination(terminations, b.RTP); rtp == nil || rtp.Mode != h248.ModeSendOnly {
+		t.Errorf("RTP termination = %+v, want SendOnly", rtp)
+	}
+	if tdm := termination(terminations, "TDM/2"); tdm == nil || tdm.Mode != h248.ModeSendReceive {
+		t.Errorf("TDM termination = %+v, want SendReceive", tdm)
+	}
+
+	// Answer through-connects the RTP side to the remote party
+	if err := c.Connect(ctx, b, remoteSDP); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	rtp := termination(m.Context(b.ContextID), b.RTP)
+	if rtp == nil || rtp.Mode != h248.ModeSendReceive || rtp.Remote != remoteSDP {
+		t.Errorf("RTP termination after Connect = %+v", rtp)
+	}
+
+	if err := c.Release(ctx, b); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if m.Contexts() != 0 {
+		t.Errorf("Contexts() = %d after release, want 0", m.Contexts())
+	}
+	// The circuit is idle again
+	b, err = c.Setup(ctx, 2, remoteSDP)
+	if err != nil {
+		t.Fatalf("Setup() after release error = %v", err)
+	}
+	if rtp := termination(m.Context(b.ContextID), b.RTP); rtp == nil || rtp.Remote != remoteSDP {
+		t.Errorf("RTP termination = %+v, want remote SDP", rtp)
+	}
+}
+
+func TestMGW_Errors(t *testing.T) {
+	m, c := startGateway(t, 2)
+	ctx := context.Background()
+
+	b, err := c.Setup(ctx, 1, "")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+		code int
+	}{
+		{"circuit in use", func() error { _, err := c.Setup(ctx, 1, ""); return err }, h248.ErrorTerminationInUse},
+		{"unknown circuit", func() error { _, err := c.Setup(ctx, 9, ""); return err }, h248.ErrorUnknownTermination},
+		{"unknown context", func() error {
+			return c.Connect(ctx, &h248.Bearer{ContextID: 77, RTP: "RTP/1"}, "")
+		}, h248.ErrorUnknownContext},
+		{"unknown termination", func() error {
+			return c.Connect(ctx, &h248.Bearer{ContextID: b.ContextID, RTP: "RTP/99"}, "")
+		}, h248.ErrorUnknownTermination},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e *h248.Error
+			if err := tt.run(); !errors.As(err, &e) || e.Code != tt.code {
+				t.Errorf("error = %v, want error %d", err, tt.code)
+			}
+		})
+	}
+
+	// Failed setups leave no context behind
+	if m.Contexts() != 1 {
+		t.Errorf("Contexts() = %d, want 1", m.Contexts())
+	}
+}
+
+func TestMGW_Notify(t *testing.T) {
+	m, c := startGateway(t, 1)
+	notified := make(chan string, 1)
+	c.SetNotifyHandler(func(contextID uint32, termination string, events []string) {
+		notified <- termination + " " + strings.Join(events, ",")
+	})
+
+	if err := m.Notify(context.Background(), "TDM/1", 1, "al/on"); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	select {
+	case got := <-notified:
+		if got != "TDM/1 al/on" {
+			t.Errorf("notified %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("controller not notified")
+	}
+}
+
+// syncBuffer is a buffer written by the media goroutines of a gateway
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// rtpAddress returns the address of the media of a session description
+func rtpAddress(t *testing.T, sdp string) string {
+	t.Helper()
+	var port int
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, "m=audio ") {
+			fmt.Sscanf(line, "m=audio %d", &port)
+		}
+	}
+	if port == 0 {
+		t.Fatalf("no audio port in %q", sdp)
+	}
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// rtpSender returns a socket sending RTP and the session description of
+// its address
+func rtpSender(t *testing.T) (net.PacketConn, string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return conn, fmt.Sprintf("v=0\r\nc=IN IP4 127.0.0.1\r\nm=audio %d RTP/AVP 8 %d\r\n", port, media.DefaultEventPayloadType)
+}
+
+// sendRTP sends RTP packets of payload type pt from conn to address,
+// numbered from seq. Audio payloads are of a sample per byte.
+func sendRTP(t *testing.T, conn net.PacketConn, address string, pt uint8, seq uint16, payloads ...[]byte) {
+	t.Helper()
+	to, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr() error = %v", err)
+	}
+	timestamp := uint32(8000)
+	for i, payload := range payloads {
+		b, _ := (&media.Packet{PayloadType: pt, Sequence: seq + uint16(i), Timestamp: timestamp, SSRC: 3, Payload: payload}).Encode()
+		if _, err := conn.WriteTo(b, to); err != nil {
+			t.Fatalf("WriteTo() error = %v", err)
+		}
+		// Telephone events keep the timestamp of their start
+		if pt != media.DefaultEventPayloadType {
+			timestamp += uint32(len(payload))
+		}
+	}
+}
+
+func TestMGW_MediaBridge(t *testing.T) {
+	sinks := map[string]*syncBuffer{"TDM/1": {}, "TDM/2": {}}
+	_, c := startGatewayWithSink(t, 2, func(circuit string) io.Writer { return sinks[circuit] })
+	notified := make(chan string, 1)
+	c.SetNotifyHandler(func(contextID uint32, termination string, events []string) {
+		notified <- strings.Join(events, ",")
+	})
+	ctx := context.Background()
+
+	sender, remote := rtpSender(t)
+	b, err := c.Setup(ctx, 2, remote)
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if !strings.Contains(b.LocalSDP, "telephone-event/8000") {
+		t.Errorf("LocalSDP = %q, want telephone-event offered", b.LocalSDP)
+	}
+	address := rtpAddress(t, b.LocalSDP)
+
+	// Until answer the RTP termination only sends: media received are not
+	// played out
+	sendRTP(t, sender, address, 0, 1, make([]byte, 160), make([]byte, 160), make([]byte, 160))
+	time.Sleep(100 * time.Millisecond)
+	if n := sinks["TDM/2"].Len(); n != 0 {
+		t.Fatalf("circuit got %d bytes before answer", n)
+	}
+
+	if err := c.Connect(ctx, b, remote); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	// Media from another address than the remote one are dropped
+	stranger, _ := rtpSender(t)
+	sendRTP(t, stranger, address, 8, 4, make([]byte, 160), make([]byte, 160), make([]byte, 160))
+	time.Sleep(100 * time.Millisecond)
+	if n := sinks["TDM/2"].Len(); n != 0 {
+		t.Fatalf("circuit got %d bytes from another address", n)
+	}
+
+	voice, _ := media.PCMA.Encode([]int16{1000, -1000, 2000, -2000})
+	sendRTP(t, sender, address, 8, 4, voice, voice, voice)
+	deadline := time.Now().Add(2 * time.Second)
+	for sinks["TDM/2"].Len() < len(voice) {
+		if time.Now().After(deadline) {
+			t.Fatal("no media played out to the circuit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The A-law RTP is transcoded to the μ-law circuit
+	samples, _ := media.PCMA.Decode(voice)
+	want, _ := media.PCMU.Encode(samples)
+	if got := sinks["TDM/2"].Bytes(); !bytes.Equal(got[:len(want)], want) {
+		t.Errorf("circuit got %x, want %x", got[:len(want)], want)
+	}
+	if sinks["TDM/1"].Len() != 0 {
+		t.Error("media played out to another circuit")
+	}
+
+	// Telephone events are notified to the MGCF
+	sendRTP(t, sender, address, media.DefaultEventPayloadType, 7,
+		media.Event{Event: 5, Volume: 10, Duration: 160}.Encode(),
+		media.Event{Event: 5, Volume: 10, Duration: 320, End: true}.Encode(),
+		media.Event{Event: 5, Volume: 10, Duration: 320, End: true}.Encode())
+	select {
+	case events := <-notified:
+		if events != "dd/d5" {
+			t.Errorf("notified %q, want dd/d5", events)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DTMF not notified")
+	}
+
+	if err := c.Release(ctx, b); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+}
+
+func TestTermination_Accepts(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 6000}
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.8"), Port: 6000}
+
+	tr := &Termination{Kind: KindRTP}
+	tr.apply([]h248.Stream{{Remote: remoteSDP}})
+	if !tr.accepts(remote) || tr.accepts(other) {
+		t.Error("accepts() does not follow the remote description")
+	}
+
+	// Without an address to receive from, the first source is latched
+	tr = &Termination{Kind: KindRTP}
+	tr.apply([]h248.Stream{{Remote: "v=0\r\nc=IN IP4 0.0.0.0\r\nm=audio 6000 RTP/AVP 0\r\n"}})
+	if !tr.accepts(other) || !tr.accepts(other) || tr.accepts(remote) {
+		t.Error("accepts() does not latch on the first source")
+	}
+}
+
+func TestMGW_ConvertRTPToTDM(t *testing.T) {
+	m := NewWithConfig(Config{Circuits: 1, TDMLaw: "PCMA"})
+	samples := []int16{0, 500, -500, 12000}
+	payload, _ := media.PCMU.Encode(samples)
+	packet, _ := (&media.Packet{PayloadType: 0, Sequence: 1, Payload: payload}).Encode()
+
+	got, err := m.ConvertRTPToTDM(packet)
+	if err != nil {
+		t.Fatalf("ConvertRTPToTDM() error = %v", err)
+	}
+	decoded, _ := media.PCMU.Decode(payload)
+	want, _ := media.PCMA.Encode(decoded)
+	if !bytes.Equal(got, want) {
+		t.Errorf("ConvertRTPToTDM() = %x, want %x", got, want)
+	}
+	if _, err := m.ConvertRTPToTDM([]byte{0x80}); err == nil {
+		t.Error("ConvertRTPToTDM() of a truncated packet error = nil")
+	}
+}
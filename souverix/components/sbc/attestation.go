@@ -0,0 +1,147 @@
+package sbc
+
+import (
+	"net"
+	"strings"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/internal/stir"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/sirupsen/logrus"
+)
+
+// peerProfile is a configured peer with its networks parsed
+type peerProfile struct {
+	config.PeerProfile
+	nets  []*net.IPNet
+	hosts map[string]bool
+}
+
+// parsePeerProfiles parses the networks of the configured peer profiles
+func parsePeerProfiles(profiles []config.PeerProfile, log *logrus.Logger) []*peerProfile {
+	peers := make([]*peerProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		peer := &peerProfile{
+			PeerProfile: profile,
+			hosts:       make(map[string]bool),
+		}
+		for _, network := range profile.Networks {
+			network = strings.TrimSpace(network)
+			if network == "" {
+				continue
+			}
+			if _, ipNet, err := net.ParseCIDR(network); err == nil {
+				peer.nets = append(peer.nets, ipNet)
+				continue
+			}
+			if ip := net.ParseIP(network); ip == nil && log != nil {
+				log.WithField("peer", profile.ID).Debugf("peer network %q is not an IP, matching as host name", network)
+			}
+			peer.hosts[network] = true
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// matchPeer returns the peer profile the remote address belongs to, if any
+func (s *SBC) matchPeer(remoteAddr string) *peerProfile {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+
+	for _, peer := range s.peers {
+		if peer.hosts[host] {
+			return peer
+		}
+		if ip == nil {
+			continue
+		}
+		for _, ipNet := range peer.nets {
+			if ipNet.Contains(ip) {
+				return peer
+			}
+		}
+	}
+	return nil
+}
+
+// lookupCaller returns the HSS subscriber placing the call, or nil if unknown.
+// The asserted identity of an authenticated customer takes precedence over
+// From, and a number can also identify the subscriber through its TN ranges.
+// Only calls from the trust domain identify a caller, as anyone else can set
+// these headers; without a configured trust domain no call does.
+func (s *SBC) lookupCaller(msg *sip.Message, origTN string) *ims.Subscriber {
+	s.mu.RLock()
+	hssStore := s.hssStore
+	s.mu.RUnlock()
+	if hssStore == nil || !s.trustDomain.Contains(msg.RemoteAddr) {
+		return nil
+	}
+
+	if value := msg.GetHeader("P-Asserted-Identity"); value != "" {
+		if sub, err := hssStore.GetSubscriberByIMPU(extractURI(value)); err == nil {
+			return sub
+		}
+	}
+	if value := msg.GetHeader("From"); value != "" {
+		if sub, err := hssStore.GetSubscriberByIMPU(extractURI(value)); err == nil {
+			return sub
+		}
+	}
+
+	if origTN == "" {
+		return nil
+	}
+	if sub, err := hssStore.GetSubscriberByTN(origTN); err == nil {
+		return sub
+	}
+	return nil
+}
+
+// attest sets the attestation level and origid of a PASSporT to sign.
+// With "auto" attestation the level is derived per call from the HSS
+// subscriber data and the peer the call came from.
+func (s *SBC) attest(req *stir.SignRequest, msg *sip.Message, sub *ims.Subscriber) {
+	peer := s.matchPeer(msg.RemoteAddr)
+
+	if s.autoAttestation {
+		subscriberKnown := sub != nil
+		numberControl := sub != nil && store.SubscriberOwnsTN(sub, req.OrigTN)
+		externalOrigin := peer != nil && !peer.Trusted
+		req.Attestation = stir.DetermineAttestationLevel(subscriberKnown, numberControl, externalOrigin)
+
+		s.log.WithFields(logrus.Fields{
+			"orig_tn":          req.OrigTN,
+			"subscriber_known": subscriberKnown,
+			"number_control":   numberControl,
+			"external_origin":  externalOrigin,
+			"attest":           req.Attestation,
+		}).Debug("attestation level determined")
+	}
+
+	req.OrigID = s.origIDFor(msg.RemoteAddr, peer, sub)
+}
+
+// origIDFor returns the origid of the origination point: the customer if the
+// caller is a known subscriber, otherwise the trunk the call arrived on
+func (s *SBC) origIDFor(remoteAddr string, peer *peerProfile, sub *ims.Subscriber) string {
+	switch {
+	case sub != nil:
+		return s.origIDs.Get("customer:" + sub.IMPI)
+	case peer != nil:
+		return s.origIDs.Get("trunk:" + peer.ID)
+	case remoteAddr != "":
+		host := remoteAddr
+		if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			host = h
+		}
+		return s.origIDs.Get("trunk:" + host)
+	default:
+		return ""
+	}
+}
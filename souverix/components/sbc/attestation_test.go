@@ -0,0 +1,168 @@
+package sbc
+
+import (
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/internal/stir"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/sirupsen/logrus"
+)
+
+func newAttestationTestSBC(t *testing.T) *SBC {
+	t.Helper()
+
+	sbc := newTransitTestSBC(t, STIRTransitKeep)
+	sbc.autoAttestation = true
+	sbc.peers = parsePeerProfiles([]config.PeerProfile{
+		{ID: "PEER-TRUSTED", Networks: []string{"10.0.0.0/8"}, Trusted: true},
+		{ID: "PEER-EXTERNAL", Networks: []string{"192.0.2.10"}, Trusted: false},
+	}, nil)
+	sbc.trustDomain = sip.NewTrustDomain([]string{"10.0.0.0/8"})
+
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	hssStore, _ := store.NewMemHSSStore(log)
+	hssStore.UpsertSubscriber(&ims.Subscriber{
+		IMPU: "sip:+15145559876@ims.local",
+		IMPI: "acme@ims.local",
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities: []string{"sip:+15145559876@ims.local", "tel:+15145559876"},
+			TelephoneNumberRanges: []ims.TNRange{
+				{Start: "+15145550100", End: "+15145550199"},
+			},
+		},
+	})
+	sbc.SetHSSStore(hssStore)
+	return sbc
+}
+
+func TestSBC_AutoAttestation(t *testing.T) {
+	sbc := newAttestationTestSBC(t)
+
+	tests := []struct {
+		name       string
+		from       string
+		asserted   string
+		remoteAddr string
+		want       stir.AttestationLevel
+	}{
+		{"own number", "sip:+15145559876@ims.local", "", "10.1.1.1:5060", stir.AttestationFull},
+		{"number in TN range", "<tel:+15145550150>", "", "10.1.1.1:5060", stir.AttestationFull},
+		{"customer presenting foreign number", "sip:+15145554444@ims.local", "<sip:+15145559876@ims.local>", "10.1.1.1:5060", stir.AttestationPartial},
+		{"unknown caller", "sip:+15145554444@ims.local", "", "10.1.1.1:5060", stir.AttestationGateway},
+		{"untrusted peer", "sip:+15145559876@ims.local", "", "192.0.2.10:5060", stir.AttestationGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &sip.Message{
+				Method:     sip.MethodINVITE,
+				URI:        "sip:+15145551234@example.com",
+				RemoteAddr: tt.remoteAddr,
+				Headers: map[string][]string{
+					"From":    {tt.from},
+					"To":      {"sip:+15145551234@example.com"},
+					"Call-ID": {"test-call-id"},
+				},
+			}
+			if tt.asserted != "" {
+				msg.SetHeader("P-Asserted-Identity", tt.asserted)
+			}
+
+			if err := sbc.signSTIR(msg); err != nil {
+				t.Fatalf("signSTIR() error = %v", err)
+			}
+			passport, err := sbc.stirVerifier.VerifyINVITE(msg.GetHeader("Identity"))
+			if err != nil {
+				t.Fatalf("VerifyINVITE() error = %v", err)
+			}
+			if passport.Attest != tt.want {
+				t.Errorf("attest = %v, want %v", passport.Attest, tt.want)
+			}
+			if passport.OrigID == "" {
+				t.Error("origid not set")
+			}
+		})
+	}
+}
+
+func TestSBC_TrustDomain(t *testing.T) {
+	sbc := newAttestationTestSBC(t)
+	domain := []string{"10.0.0.0/8", "pcscf.ims.local"}
+
+	tests := []struct {
+		name         string
+		networks     []string
+		remoteAddr   string
+		wantAsserted bool
+		want         stir.AttestationLevel
+	}{
+		{"P-CSCF in the trust domain", domain, "10.1.1.1:5060", true, stir.AttestationFull},
+		{"trusted host name", domain, "pcscf.ims.local:5060", true, stir.AttestationFull},
+		// Neither the asserted identity nor From of an outsider identify the caller
+		{"outside the trust domain", domain, "192.0.2.99:5060", false, stir.AttestationGateway},
+		// Without a configured trust domain nothing is believed
+		{"no trust domain", nil, "10.1.1.1:5060", false, stir.AttestationGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sbc.trustDomain = sip.NewTrustDomain(tt.networks)
+			msg := &sip.Message{
+				Method:  sip.MethodINVITE,
+				URI:     "sip:+15145551234@example.com",
+				Version: "SIP/2.0",
+				Headers: map[string][]string{
+					"From":                {"<sip:+15145559876@ims.local>;tag=1"},
+					"To":                  {"<sip:+15145551234@example.com>"},
+					"Call-ID":             {"trust-call-id"},
+					"CSeq":                {"1 INVITE"},
+					"P-Asserted-Identity": {"<sip:+15145559876@ims.local>"},
+					"P-Charging-Vector":   {"icid-value=1234"},
+				},
+			}
+
+			if _, err := sbc.ProcessMessage(msg, tt.remoteAddr); err != nil {
+				t.Fatalf("ProcessMessage() error = %v", err)
+			}
+			if got := msg.GetHeader("P-Asserted-Identity") != ""; got != tt.wantAsserted {
+				t.Errorf("P-Asserted-Identity kept = %v, want %v", got, tt.wantAsserted)
+			}
+			if got := msg.GetHeader("P-Charging-Vector") != ""; got != tt.wantAsserted {
+				t.Errorf("P-Charging-Vector kept = %v, want %v", got, tt.wantAsserted)
+			}
+			passport, err := sbc.stirVerifier.VerifyINVITE(msg.GetHeader("Identity"))
+			if err != nil {
+				t.Fatalf("VerifyINVITE() error = %v", err)
+			}
+			if passport.Attest != tt.want {
+				t.Errorf("attest = %v, want %v", passport.Attest, tt.want)
+			}
+		})
+	}
+}
+
+func TestSBC_OrigIDPerOrigin(t *testing.T) {
+	sbc := newAttestationTestSBC(t)
+	sbc.origIDs.Set("trunk:PEER-EXTERNAL", "provisioned-origid")
+
+	customer := &ims.Subscriber{IMPI: "acme@ims.local"}
+	trusted := sbc.matchPeer("10.2.3.4:5060")
+	external := sbc.matchPeer("192.0.2.10:5060")
+
+	if trusted == nil || trusted.ID != "PEER-TRUSTED" {
+		t.Fatalf("matchPeer() = %v, want PEER-TRUSTED", trusted)
+	}
+	if got := sbc.origIDFor("192.0.2.10:5060", external, nil); got != "provisioned-origid" {
+		t.Errorf("origIDFor() trunk = %v, want provisioned-origid", got)
+	}
+	if a, b := sbc.origIDFor("10.2.3.4:5060", trusted, customer), sbc.origIDFor("10.2.3.4:5060", trusted, nil); a == b {
+		t.Error("origIDFor() should distinguish customer from trunk")
+	}
+	if got := sbc.origIDFor("", nil, nil); got != "" {
+		t.Errorf("origIDFor() without origin = %v, want empty", got)
+	}
+}
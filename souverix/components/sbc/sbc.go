@@ -2,6 +2,7 @@ package sbc
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -11,8 +12,10 @@ import (
 	"time"
 
 	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/li"
 	"github.com/dasmlab/ims/internal/sip"
 	"github.com/dasmlab/ims/internal/stir"
+	"github.com/dasmlab/ims/internal/store"
 	"github.com/sirupsen/logrus"
 )
 
@@ -34,8 +37,32 @@ type SBC struct {
 
 	// STIR/SHAKEN
 	stirSigner   *stir.STIRSigner
+	stirCerts    *stir.ACMECertificateManager
 	stirVerifier *stir.STIRVerifier
 	enableSTIR   bool
+	rcdFetcher   stir.RCDContentFetcher
+	stopRenewal  context.CancelFunc
+
+	// Per-call attestation ("auto") and origination identifiers
+	autoAttestation bool
+	origIDs         *stir.OrigIDRegistry
+	peers           []*peerProfile
+
+	// Nodes whose asserted identities are believed, nil if unchecked
+	trustDomain *sip.TrustDomain
+
+	// Subscriber data (Rich Call Data lookup)
+	hssStore store.HSSStore
+
+	// Session timers (RFC 4028), nil when not enforced
+	sessionTimers *sip.SessionTimerPolicy
+	sessions      map[string]*timedSession // key: Call-ID
+	sender        RequestSender
+	media         MediaReleaser
+	intercept     *li.InterceptController
+	sentBy        string // Via sent-by of the requests the SBC sends
+	now           func() time.Time
+	stopTimers    context.CancelFunc
 
 	// Message handlers
 	handlers map[string]MessageHandler
@@ -54,6 +81,24 @@ func NewSBC(cfg *config.Config, log *logrus.Logger) (*SBC, error) {
 		topologyHiding: cfg.IMS.SBC.TopologyHiding,
 		enableSTIR:     cfg.IMS.SBC.EnableSTIR,
 		handlers:       make(map[string]MessageHandler),
+		origIDs:        stir.NewOrigIDRegistry(cfg.IMS.Domain),
+		peers:          parsePeerProfiles(cfg.IMS.SBC.Peers, log),
+		trustDomain:    sip.NewTrustDomain(cfg.IMS.TrustDomain.Networks),
+		sessions:       make(map[string]*timedSession),
+		sentBy:         sentBy(cfg),
+		now:            time.Now,
+	}
+
+	if cfg.IMS.SBC.SessionInterval > 0 {
+		policy := sip.NewSessionTimerPolicy(cfg.IMS.SBC.SessionInterval)
+		sbc.sessionTimers = &policy
+	}
+
+	// Record provisioned trunk origids
+	for _, peer := range cfg.IMS.SBC.Peers {
+		if peer.OrigID != "" {
+			sbc.origIDs.Set("trunk:"+peer.ID, peer.OrigID)
+		}
 	}
 
 	// Initialize rate limiter
@@ -78,7 +123,16 @@ func NewSBC(cfg *config.Config, log *logrus.Logger) (*SBC, error) {
 // initSTIR initializes STIR/SHAKEN signing and verification
 func (s *SBC) initSTIR(cfg *config.Config) error {
 	// Initialize ACME certificate manager for STIR/SHAKEN
-	acmeMgr, err := stir.NewACMECertificateManager(&cfg.ZeroTrust.ACME, s.log)
+	var keys stir.KeyProvider
+	if cfg.ZeroTrust.STIRKey.Source != "" {
+		var err error
+		keys, err = stir.NewKeyProvider(&cfg.ZeroTrust.STIRKey, cfg.ZeroTrust.ACME.KeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to create STIR key provider: %w", err)
+		}
+	}
+
+	acmeMgr, err := stir.NewACMECertificateManagerWithKeys(&cfg.ZeroTrust.ACME, keys, s.log)
 	if err != nil {
 		return fmt.Errorf("failed to create ACME certificate manager: %w", err)
 	}
@@ -90,24 +144,41 @@ func (s *SBC) initSTIR(cfg *config.Config) error {
 	} else if cfg.IMS.SBC.STIRAttestation == "C" {
 		attestation = stir.AttestationGateway
 	} else if cfg.IMS.SBC.STIRAttestation == "auto" {
-		// Auto-detect based on subscriber info (simplified - always A for now)
-		attestation = stir.AttestationFull
+		// Determined per call from subscriber and origin data (see attest)
+		s.autoAttestation = true
 	}
 
 	// Create STIR signer
 	s.stirSigner = stir.NewSTIRSigner(
-		acmeMgr.GetPrivateKey(),
+		acmeMgr.GetSigner(),
 		acmeMgr.GetCertificateURL(),
 		attestation,
 	)
 
+	s.stirCerts = acmeMgr
+
 	// Create STIR verifier
 	s.stirVerifier = stir.NewSTIRVerifier(acmeMgr)
+	rcdFetcher := stir.NewHTTPRCDContentFetcher()
+	rcdFetcher.SetAllowedHosts(cfg.IMS.SBC.RCDAllowedHosts)
+	s.rcdFetcher = stir.NewCachedRCDContentFetcher(rcdFetcher, cfg.IMS.SBC.RCDAllowedHosts)
+
+	// Renew the certificate until the SBC stops
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopRenewal = cancel
+	acmeMgr.StartRenewal(ctx)
 
 	s.log.Info("STIR/SHAKEN initialized with ACME certificate management")
 	return nil
 }
 
+// SetHSSStore sets the subscriber store used for Rich Call Data lookups
+func (s *SBC) SetHSSStore(hssStore store.HSSStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hssStore = hssStore
+}
+
 // Start starts the SBC listeners
 func (s *SBC) Start() error {
 	// Start UDP listener
@@ -127,6 +198,19 @@ func (s *SBC) Start() error {
 		}
 	}
 
+	// Tear down sessions whose refresh is missed
+	if s.sessionTimers != nil {
+		s.mu.RLock()
+		sender := s.sender
+		s.mu.RUnlock()
+		if sender == nil {
+			s.log.Warn("session timers enforced without a request sender: sessions are not refreshed and expired ones get no BYE")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopTimers = cancel
+		go s.runSessionTimers(ctx)
+	}
+
 	s.log.Info("SBC started")
 	return nil
 }
@@ -142,6 +226,12 @@ func (s *SBC) Stop() error {
 	if s.tlsListener != nil {
 		s.tlsListener.Close()
 	}
+	if s.stopTimers != nil {
+		s.stopTimers()
+	}
+	if s.stopRenewal != nil {
+		s.stopRenewal()
+	}
 
 	s.log.Info("SBC stopped")
 	return nil
@@ -189,6 +279,15 @@ func (s *SBC) ProcessMessage(msg *sip.Message, remoteAddr string) (*sip.Message,
 		s.normalizeHeaders(msg)
 	}
 
+	// Asserted identities and charging headers are only believed from the
+	// trust domain (RFC 3325)
+	if removed := s.trustDomain.Police(msg); len(removed) > 0 {
+		s.log.WithFields(logrus.Fields{
+			"remote_addr": remoteAddr,
+			"headers":     removed,
+		}).Debug("removed headers from outside the trust domain")
+	}
+
 	// Emergency call handling (highest priority - bypasses everything)
 	if msg.IsRequest() && msg.Method == sip.MethodINVITE {
 		isEmergency, err := s.processEmergency(msg)
@@ -216,6 +315,14 @@ func (s *SBC) ProcessMessage(msg *sip.Message, remoteAddr string) (*sip.Message,
 		}
 	}
 
+	// Session timers are negotiated before topology hiding, which removes
+	// the route set of responses and rewrites the Via a 422 is sent back on
+	if msg.IsResponse() {
+		s.sessionTimerResponse(msg)
+	} else if response := s.sessionTimerRequest(msg); response != nil {
+		return response, nil
+	}
+
 	// Topology hiding
 	if s.topologyHiding {
 		s.hideTopology(msg)
@@ -238,6 +345,9 @@ func (s *SBC) ProcessMessage(msg *sip.Message, remoteAddr string) (*sip.Message,
 		// Default handler: forward message
 		response, err = s.defaultHandler(msg)
 	}
+	if err == nil && response != nil && response.IsResponse() && msg.IsRequest() {
+		s.sessionTimerResponse(response)
+	}
 
 	duration := time.Since(start)
 	s.log.WithFields(logrus.Fields{
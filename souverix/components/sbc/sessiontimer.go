@@ -0,0 +1,487 @@
+package sbc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/li"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionTimerInterval is how often session timers are checked
+const sessionTimerInterval = time.Second
+
+// sessionSetupTimeout ends the tracking of a session whose initial INVITE
+// gets no final response, longer than the 3 minutes of Timer C of proxies
+// (RFC 3261 section 16.6)
+const sessionSetupTimeout = 5 * time.Minute
+
+// sessionExpiredReason is the Reason of the BYEs ending a session whose
+// refresh was missed
+const sessionExpiredReason = `SIP;cause=408;text="Session timer expired"`
+
+// RequestSender sends the requests the SBC originates on a leg of a call.
+// SendRequest returns an error when the request gets no 2xx response; it
+// acknowledges the 2xx of a re-INVITE.
+type RequestSender interface {
+	SendRequest(ctx context.Context, req *sip.Message) error
+}
+
+// MediaReleaser releases the media resources of a call, such as its relayed
+// ports and transcoders
+type MediaReleaser interface {
+	ReleaseMedia(ctx context.Context, callID string) error
+}
+
+// timedSession is a call whose session timer the SBC enforces
+type timedSession struct {
+	callID string
+
+	// pending is the last INVITE or UPDATE of the session, until its 2xx
+	pending *sip.Message
+
+	// timer is nil until the initial INVITE is answered, by deadline
+	timer    *sip.SessionTimer
+	deadline time.Time
+
+	caller, callee               string // From and To of the initial INVITE
+	callerContact, calleeContact string
+	callerCSeq, calleeCSeq       int
+
+	// Route sets to each party, from the Record-Route of the initial
+	// INVITE and of its 2xx
+	callerRoutes, calleeRoutes []string
+
+	// Whether each party allows UPDATE, and the session description it
+	// sent last, for refreshes by re-INVITE
+	callerUpdate, calleeUpdate bool
+	callerSDP, calleeSDP       string
+}
+
+// SetRequestSender makes the SBC send its refreshes and the BYEs ending
+// expired sessions through sender
+func (s *SBC) SetRequestSender(sender RequestSender) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sender = sender
+}
+
+// SetMediaReleaser makes the SBC release the media of the sessions it ends
+// with media
+func (s *SBC) SetMediaReleaser(media MediaReleaser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.media = media
+}
+
+// SetLawfulIntercept makes the SBC report the end of the sessions it ends
+// to ic, so that their interception ends with them
+func (s *SBC) SetLawfulIntercept(ic *li.InterceptController) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intercept = ic
+}
+
+// sessionTimerRequest negotiates the session timer of an INVITE or UPDATE
+// (RFC 4028 section 8.1) and tracks the session it belongs to. It returns
+// the 422 response rejecting a session interval too small.
+func (s *SBC) sessionTimerRequest(msg *sip.Message) *sip.Message {
+	if s.sessionTimers == nil {
+		return nil
+	}
+	callID := msg.GetHeader("Call-ID")
+	switch msg.Method {
+	case sip.MethodBYE:
+		s.mu.Lock()
+		delete(s.sessions, callID)
+		s.mu.Unlock()
+		return nil
+	case sip.MethodINVITE, sip.MethodUPDATE:
+	default:
+		return nil
+	}
+
+	if response := s.sessionTimers.CheckRequest(msg); response != nil {
+		s.log.WithFields(logrus.Fields{
+			"call_id": callID,
+			"min_se":  response.GetHeader("Min-SE"),
+		}).Debug("session interval too small")
+		return response
+	}
+
+	cseq, _ := splitCSeq(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.sessions[callID]
+	if ts == nil {
+		if msg.Method != sip.MethodINVITE {
+			return nil
+		}
+		ts = &timedSession{
+			callID:        callID,
+			deadline:      s.now().Add(sessionSetupTimeout),
+			caller:        msg.GetHeader("From"),
+			callee:        msg.GetHeader("To"),
+			callerContact: extractURI(msg.GetHeader("Contact")),
+			callerRoutes:  recordRoutes(msg),
+			callerUpdate:  allowsUpdate(msg),
+		}
+		s.sessions[callID] = ts
+	}
+	if msg.GetHeader("From") == ts.caller {
+		ts.callerCSeq = cseq
+		ts.callerSDP = sdpBody(msg, ts.callerSDP)
+	} else {
+		ts.calleeCSeq = cseq
+		ts.calleeSDP = sdpBody(msg, ts.calleeSDP)
+	}
+	ts.pending = msg
+	return nil
+}
+
+// sessionTimerResponse completes the negotiation of the session timer of a
+// session with the 2xx response to its INVITE or UPDATE (RFC 4028 section
+// 8.2), starting or restarting its timer. An initial INVITE that fails
+// ends the tracking of the session.
+func (s *SBC) sessionTimerResponse(resp *sip.Message) {
+	if s.sessionTimers == nil {
+		return
+	}
+	cseq, method := splitCSeq(resp)
+	if method != sip.MethodINVITE && method != sip.MethodUPDATE {
+		return
+	}
+	callID := resp.GetHeader("Call-ID")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := s.sessions[callID]
+	if ts == nil || resp.StatusCode < 200 || ts.pending == nil {
+		return
+	}
+	if pending, pendingMethod := splitCSeq(ts.pending); pending != cseq || pendingMethod != method {
+		return
+	}
+	req := ts.pending
+	ts.pending = nil
+	if resp.StatusCode >= 300 {
+		if ts.timer == nil {
+			delete(s.sessions, callID)
+		}
+		return
+	}
+	if req.GetHeader("From") == ts.caller {
+		ts.calleeSDP = sdpBody(resp, ts.calleeSDP)
+	} else {
+		ts.callerSDP = sdpBody(resp, ts.callerSDP)
+	}
+
+	se := s.sessionTimers.CheckResponse(req, resp)
+	if se == nil {
+		return
+	}
+	now := s.now()
+	if ts.timer != nil {
+		ts.timer.Refresh(se, now)
+		return
+	}
+	ts.timer = sip.NewSessionTimer(se, now)
+	ts.callee = resp.GetHeader("To")
+	ts.calleeContact = extractURI(resp.GetHeader("Contact"))
+	ts.calleeRoutes = calleeRoutes(recordRoutes(resp), ts.callerRoutes)
+	ts.calleeUpdate = allowsUpdate(resp)
+	s.log.WithFields(logrus.Fields{
+		"call_id":   callID,
+		"interval":  se.Interval,
+		"refresher": se.Refresher,
+	}).Debug("session timer started")
+}
+
+// runSessionTimers checks the session timers until ctx is done
+func (s *SBC) runSessionTimers(ctx context.Context) {
+	ticker := time.NewTicker(sessionTimerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.ExpireSessions(ctx)
+		}
+	}
+}
+
+// ExpireSessions ends the sessions whose refresh was missed with a BYE on
+// both legs, releasing their media and interception. Sessions neither UA
+// refreshes are refreshed by the SBC on both legs, and ended when one
+// fails. Sessions whose setup never completed are forgotten.
+func (s *SBC) ExpireSessions(ctx context.Context) {
+	now := s.now()
+	var expired, refresh, abandoned []*timedSession
+	s.mu.Lock()
+	sender, media := s.sender, s.media
+	for _, ts := range s.sessions {
+		switch {
+		case ts.timer == nil && !now.Before(ts.deadline):
+			abandoned = append(abandoned, ts)
+			delete(s.sessions, ts.callID)
+		case ts.timer == nil:
+		case !now.Before(ts.timer.ExpiresAt()):
+			expired = append(expired, ts)
+			delete(s.sessions, ts.callID)
+		case ts.timer.Refresher == "" && sender != nil && !now.Before(ts.timer.RefreshAt()):
+			refresh = append(refresh, ts)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ts := range abandoned {
+		s.log.WithField("call_id", ts.callID).Debug("session setup timed out")
+		if media != nil {
+			if err := media.ReleaseMedia(ctx, ts.callID); err != nil {
+				s.log.WithError(err).WithField("call_id", ts.callID).Warn("cannot release media")
+			}
+		}
+	}
+	for _, ts := range refresh {
+		if err := s.refreshSession(ctx, sender, ts); err != nil {
+			s.log.WithError(err).WithField("call_id", ts.callID).Warn("session refresh failed")
+			s.mu.Lock()
+			delete(s.sessions, ts.callID)
+			s.mu.Unlock()
+			expired = append(expired, ts)
+		}
+	}
+	for _, ts := range expired {
+		s.log.WithField("call_id", ts.callID).Info("session timer expired")
+		s.endSession(ctx, ts, sessionExpiredReason)
+	}
+}
+
+// refreshSession sends the requests refreshing ts on both legs: an UPDATE
+// to a party that allows it, or else a re-INVITE with the session
+// description of the other party (RFC 4028 section 7.4)
+func (s *SBC) refreshSession(ctx context.Context, sender RequestSender, ts *timedSession) error {
+	s.mu.Lock()
+	refreshes := ts.refreshes(s.sentBy)
+	se := ts.timer.SessionExpires
+	s.mu.Unlock()
+
+	// The SBC is the UAC of its refreshes
+	se.Refresher = sip.RefresherUAC
+	for _, refresh := range refreshes {
+		sip.SetSessionExpires(refresh, &se)
+		if err := sender.SendRequest(ctx, refresh); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	ts.timer.Refresh(nil, s.now())
+	s.mu.Unlock()
+	return nil
+}
+
+// endSession sends the BYEs ending ts on both legs, with reason as their
+// Reason header, and releases its media and interception. ts is no longer
+// in s.sessions.
+func (s *SBC) endSession(ctx context.Context, ts *timedSession, reason string) {
+	s.mu.Lock()
+	sender, media, intercept := s.sender, s.media, s.intercept
+	byes := ts.requests(s.sentBy, sip.MethodBYE)
+	s.mu.Unlock()
+	for _, bye := range byes {
+		bye.SetHeader("Reason", reason)
+	}
+
+	if intercept != nil {
+		// The mediation device closes the intercepted session on its BYE
+		if err := intercept.InterceptMessage(byes[0], extractURI(ts.caller), extractURI(ts.callee)); err != nil {
+			s.log.WithError(err).WithField("call_id", ts.callID).Warn("cannot report session end to LI")
+		}
+	}
+	if media != nil {
+		if err := media.ReleaseMedia(ctx, ts.callID); err != nil {
+			s.log.WithError(err).WithField("call_id", ts.callID).Warn("cannot release media")
+		}
+	}
+	if sender == nil {
+		return
+	}
+	for _, bye := range byes {
+		if err := sender.SendRequest(ctx, bye); err != nil {
+			s.log.WithError(err).WithField("call_id", ts.callID).Warn("cannot send BYE")
+		}
+	}
+}
+
+// requests builds the in-dialog requests of method the SBC sends on both
+// legs of ts, the one to the callee first. s.mu is held.
+func (ts *timedSession) requests(sentBy, method string) []*sip.Message {
+	return []*sip.Message{ts.toCallee(sentBy, method), ts.toCaller(sentBy, method)}
+}
+
+// refreshes builds the requests refreshing both legs of ts, the one to the
+// callee first. s.mu is held.
+func (ts *timedSession) refreshes(sentBy string) []*sip.Message {
+	toCallee := ts.toCallee(sentBy, refreshMethod(ts.calleeUpdate))
+	toCaller := ts.toCaller(sentBy, refreshMethod(ts.callerUpdate))
+	if toCallee.Method == sip.MethodINVITE {
+		setSDP(toCallee, ts.callerSDP)
+	}
+	if toCaller.Method == sip.MethodINVITE {
+		setSDP(toCaller, ts.calleeSDP)
+	}
+	return []*sip.Message{toCallee, toCaller}
+}
+
+// toCallee builds a request of method to the callee of ts, from the caller
+func (ts *timedSession) toCallee(sentBy, method string) *sip.Message {
+	ts.callerCSeq++
+	return ts.request(sentBy, method, ts.calleeContact, ts.calleeRoutes, ts.caller, ts.callee, ts.callerCSeq)
+}
+
+// toCaller builds a request of method to the caller of ts, from the callee
+func (ts *timedSession) toCaller(sentBy, method string) *sip.Message {
+	ts.calleeCSeq++
+	return ts.request(sentBy, method, ts.callerContact, ts.callerRoutes, ts.callee, ts.caller, ts.calleeCSeq)
+}
+
+// request builds a request of the dialog of ts to target along routes
+func (ts *timedSession) request(sentBy, method, target string, routes []string, from, to string, cseq int) *sip.Message {
+	msg := &sip.Message{
+		Method:  method,
+		URI:     target,
+		Version: "SIP/2.0",
+		Headers: make(map[string][]string),
+	}
+	msg.SetHeader("Via", "SIP/2.0/UDP "+sentBy+";branch=z9hG4bK"+generateBranch())
+	for _, route := range routes {
+		msg.AddHeader("Route", route)
+	}
+	msg.SetHeader("Max-Forwards", "70")
+	msg.SetHeader("From", from)
+	msg.SetHeader("To", to)
+	msg.SetHeader("Call-ID", ts.callID)
+	msg.SetHeader("CSeq", strconv.Itoa(cseq)+" "+method)
+	msg.SetHeader("Content-Length", "0")
+	return msg
+}
+
+// refreshMethod returns the method of the refreshes to a party that allows
+// UPDATE or not
+func refreshMethod(update bool) string {
+	if update {
+		return sip.MethodUPDATE
+	}
+	return sip.MethodINVITE
+}
+
+// setSDP sets the session description of msg
+func setSDP(msg *sip.Message, sdp string) {
+	if sdp == "" {
+		return
+	}
+	msg.Body = sdp
+	msg.SetHeader("Content-Type", "application/sdp")
+	msg.SetHeader("Content-Length", strconv.Itoa(len(sdp)))
+}
+
+// sdpBody returns the session description of msg, or else last
+func sdpBody(msg *sip.Message, last string) string {
+	if msg.Body == "" || !strings.HasPrefix(strings.ToLower(msg.GetHeader("Content-Type")), "application/sdp") {
+		return last
+	}
+	return msg.Body
+}
+
+// allowsUpdate reports whether the Allow header of msg lists UPDATE
+func allowsUpdate(msg *sip.Message) bool {
+	for _, value := range msg.GetHeaderAll("Allow") {
+		for _, method := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(method), sip.MethodUPDATE) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordRoutes returns the Record-Route entries of msg, in order
+func recordRoutes(msg *sip.Message) []string {
+	var routes []string
+	for _, value := range msg.GetHeaderAll("Record-Route") {
+		for _, route := range splitNameAddrs(value) {
+			if route != "" {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes
+}
+
+// calleeRoutes returns the route set to the callee: the entries of the
+// Record-Route of the 2xx added past the SBC, those not already in the
+// INVITE, nearest first
+func calleeRoutes(answered, invite []string) []string {
+	downstream := answered[:max(len(answered)-len(invite), 0)]
+	routes := make([]string, 0, len(downstream))
+	for i := len(downstream) - 1; i >= 0; i-- {
+		routes = append(routes, downstream[i])
+	}
+	return routes
+}
+
+// splitNameAddrs splits a comma separated header value, ignoring commas
+// inside quotes and angle brackets
+func splitNameAddrs(s string) []string {
+	var parts []string
+	var quoted, bracketed bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				bracketed = true
+			}
+		case '>':
+			if !quoted {
+				bracketed = false
+			}
+		case ',':
+			if !quoted && !bracketed {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// sentBy returns the Via sent-by of the SBC: the host of its SIP address,
+// or the IMS domain when it listens on every interface
+func sentBy(cfg *config.Config) string {
+	host, port, err := net.SplitHostPort(cfg.Server.SIPAddr)
+	if err != nil {
+		return cfg.IMS.Domain
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = cfg.IMS.Domain
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// splitCSeq returns the sequence number and method of the CSeq of msg
+func splitCSeq(msg *sip.Message) (int, string) {
+	number, method, _ := strings.Cut(strings.TrimSpace(msg.GetHeader("CSeq")), " ")
+	n, _ := strconv.Atoi(number)
+	return n, strings.ToUpper(strings.TrimSpace(method))
+}
@@ -0,0 +1,370 @@
+package sbc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/li"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeSender records the requests sent, failing those of fail
+type fakeSender struct {
+	sent []*sip.Message
+	fail map[string]bool // key: request URI
+}
+
+func (f *fakeSender) SendRequest(ctx context.Context, req *sip.Message) error {
+	f.sent = append(f.sent, req)
+	if f.fail[req.URI] {
+		return errors.New("408 Request Timeout")
+	}
+	return nil
+}
+
+// fakeMedia records the calls whose media is released
+type fakeMedia struct {
+	released []string
+}
+
+func (f *fakeMedia) ReleaseMedia(ctx context.Context, callID string) error {
+	f.released = append(f.released, callID)
+	return nil
+}
+
+// fakeMediationDevice records the intercepted signaling
+type fakeMediationDevice struct {
+	signaling []*sip.Message
+}
+
+func (f *fakeMediationDevice) SendSignaling(msg *sip.Message, targetID string) error {
+	f.signaling = append(f.signaling, msg)
+	return nil
+}
+
+func (f *fakeMediationDevice) SendMedia(rtpData []byte, targetID string) error { return nil }
+
+func (f *fakeMediationDevice) IsAvailable() bool { return true }
+
+// newTimerSBC returns an SBC enforcing session timers of interval, with a
+// clock set by the returned function
+func newTimerSBC(t *testing.T, interval time.Duration) (*SBC, func(time.Duration)) {
+	t.Helper()
+	cfg := &config.Config{IMS: config.IMSConfig{SBC: config.SBCConfig{SessionInterval: interval}}}
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	s, err := NewSBC(cfg, log)
+	if err != nil {
+		t.Fatalf("NewSBC() error = %v", err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = start.Add(d) }
+}
+
+// timerRequest returns a request of the call st-1 from alice to bob
+func timerRequest(method string, cseq string, headers ...string) *sip.Message {
+	msg := &sip.Message{
+		Method:  method,
+		URI:     "sip:bob@example.com",
+		Version: "SIP/2.0",
+		Headers: map[string][]string{
+			"Via":     {"SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1"},
+			"From":    {"<sip:alice@example.com>;tag=a1"},
+			"To":      {"<sip:bob@example.com>"},
+			"Call-ID": {"st-1"},
+			"CSeq":    {cseq},
+			"Contact": {"<sip:alice@192.0.2.1>"},
+		},
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		msg.SetHeader(headers[i], headers[i+1])
+	}
+	return msg
+}
+
+// answer sends a 2xx to req through s as the callee would
+func answer(t *testing.T, s *SBC, req *sip.Message, headers ...string) *sip.Message {
+	t.Helper()
+	resp := &sip.Message{
+		Version:    "SIP/2.0",
+		StatusCode: sip.StatusOK,
+		StatusText: "OK",
+		Headers: map[string][]string{
+			"From":    {req.GetHeader("From")},
+			"To":      {"<sip:bob@example.com>;tag=b1"},
+			"Call-ID": {req.GetHeader("Call-ID")},
+			"CSeq":    {req.GetHeader("CSeq")},
+			"Contact": {"<sip:bob@192.0.2.2>"},
+		},
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		resp.SetHeader(headers[i], headers[i+1])
+	}
+	out, err := s.ProcessMessage(resp, "192.0.2.2:5060")
+	if err != nil {
+		t.Fatalf("ProcessMessage(200) error = %v", err)
+	}
+	return out
+}
+
+// forward sends req through s, failing on a response
+func forward(t *testing.T, s *SBC, req *sip.Message) {
+	t.Helper()
+	s.RegisterHandler(req.Method, func(msg *sip.Message) (*sip.Message, error) { return nil, nil })
+	if resp, err := s.ProcessMessage(req, "192.0.2.1:5060"); err != nil || resp != nil {
+		t.Fatalf("ProcessMessage(%s) = %v, %v, want forwarded", req.Method, resp, err)
+	}
+}
+
+func TestSBC_SessionIntervalTooSmall(t *testing.T) {
+	s, _ := newTimerSBC(t, 1800*time.Second)
+	s.topologyHiding = true
+	resp, err := s.ProcessMessage(timerRequest(sip.MethodINVITE, "1 INVITE", "Session-Expires", "60"), "192.0.2.1:5060")
+	if err != nil {
+		t.Fatalf("ProcessMessage() error = %v", err)
+	}
+	if resp.StatusCode != sip.StatusSessionIntervalTooSmall || resp.GetHeader("Min-SE") != "90" {
+		t.Errorf("response = %d with Min-SE %q, want 422 with Min-SE 90", resp.StatusCode, resp.GetHeader("Min-SE"))
+	}
+	// The 422 goes back on the Via of the INVITE as received
+	if got := resp.GetHeader("Via"); got != "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1" {
+		t.Errorf("422 Via = %q, want the received Via", got)
+	}
+	if len(s.sessions) != 0 {
+		t.Error("rejected INVITE tracked")
+	}
+}
+
+func TestSBC_SessionTimerNegotiation(t *testing.T) {
+	s, _ := newTimerSBC(t, 1800*time.Second)
+	invite := timerRequest(sip.MethodINVITE, "1 INVITE", "Supported", "timer")
+	forward(t, s, invite)
+	if got := invite.GetHeader("Session-Expires"); got != "1800" {
+		t.Errorf("forwarded Session-Expires = %q, want 1800", got)
+	}
+
+	// The callee does not support session timers: the caller refreshes
+	resp := answer(t, s, invite)
+	if got := resp.GetHeader("Session-Expires"); got != "1800;refresher=uac" {
+		t.Errorf("2xx Session-Expires = %q, want 1800;refresher=uac", got)
+	}
+	if !sip.SupportsTimer(resp) {
+		t.Error("2xx does not require timer")
+	}
+	ts := s.sessions["st-1"]
+	if ts == nil || ts.timer == nil || ts.timer.Refresher != sip.RefresherUAC {
+		t.Fatalf("session = %+v, want timer refreshed by the caller", ts)
+	}
+}
+
+func TestSBC_SessionRefreshedByUA(t *testing.T) {
+	s, setNow := newTimerSBC(t, 1800*time.Second)
+	sender := &fakeSender{}
+	s.SetRequestSender(sender)
+	invite := timerRequest(sip.MethodINVITE, "1 INVITE", "Supported", "timer")
+	forward(t, s, invite)
+	answer(t, s, invite, "Session-Expires", "1800;refresher=uas")
+
+	// The callee refreshes within the interval
+	setNow(900 * time.Second)
+	update := timerRequest(sip.MethodUPDATE, "1 UPDATE", "Session-Expires", "1800;refresher=uas")
+	update.SetHeader("From", "<sip:bob@example.com>;tag=b1")
+	forward(t, s, update)
+	answer(t, s, update, "Session-Expires", "1800;refresher=uas")
+
+	setNow(1800 * time.Second)
+	s.ExpireSessions(context.Background())
+	if len(sender.sent) != 0 || s.sessions["st-1"] == nil {
+		t.Fatalf("refreshed session ended, sent %d requests", len(sender.sent))
+	}
+	if s.sessions["st-1"].calleeCSeq != 1 || s.sessions["st-1"].callerCSeq != 1 {
+		t.Errorf("CSeq of caller %d, of callee %d", s.sessions["st-1"].callerCSeq, s.sessions["st-1"].calleeCSeq)
+	}
+}
+
+func TestSBC_SessionExpired(t *testing.T) {
+	s, setNow := newTimerSBC(t, 1800*time.Second)
+	sender := &fakeSender{}
+	media := &fakeMedia{}
+	md := &fakeMediationDevice{}
+	ic := li.NewInterceptController(md, s.log)
+	ic.ActivateWarrant(&li.InterceptTarget{IMPI: "sip:alice@example.com", WarrantID: "w1", WarrantType: "signaling+media"})
+	s.SetRequestSender(sender)
+	s.SetMediaReleaser(media)
+	s.SetLawfulIntercept(ic)
+
+	invite := timerRequest(sip.MethodINVITE, "5 INVITE", "Supported", "timer", "Record-Route", "<sip:p1.example.com;lr>")
+	forward(t, s, invite)
+	answer(t, s, invite, "Record-Route", "<sip:p2.example.com;lr>,<sip:p1.example.com;lr>")
+
+	// Not yet expired
+	setNow(1767 * time.Second)
+	s.ExpireSessions(context.Background())
+	if len(sender.sent) != 0 {
+		t.Fatalf("sent %d requests before expiry", len(sender.sent))
+	}
+
+	// The caller missed its refresh: both legs get a BYE
+	setNow(1768 * time.Second)
+	s.ExpireSessions(context.Background())
+	if len(sender.sent) != 2 {
+		t.Fatalf("sent %d requests, want 2 BYEs", len(sender.sent))
+	}
+	toCallee, toCaller := sender.sent[0], sender.sent[1]
+	if toCallee.Method != sip.MethodBYE || toCallee.URI != "sip:bob@192.0.2.2" || toCallee.GetHeader("CSeq") != "6 BYE" ||
+		toCallee.GetHeader("From") != "<sip:alice@example.com>;tag=a1" || toCallee.GetHeader("To") != "<sip:bob@example.com>;tag=b1" {
+		t.Errorf("BYE to the callee = %s", toCallee)
+	}
+	if toCaller.Method != sip.MethodBYE || toCaller.URI != "sip:alice@192.0.2.1" ||
+		toCaller.GetHeader("From") != "<sip:bob@example.com>;tag=b1" || toCaller.GetHeader("To") != "<sip:alice@example.com>;tag=a1" {
+		t.Errorf("BYE to the caller = %s", toCaller)
+	}
+	// Each BYE follows the route set to its party on a branch of its own
+	if got := toCallee.GetHeaderAll("Route"); len(got) != 1 || got[0] != "<sip:p2.example.com;lr>" {
+		t.Errorf("Route to the callee = %v, want p2", got)
+	}
+	if got := toCaller.GetHeaderAll("Route"); len(got) != 1 || got[0] != "<sip:p1.example.com;lr>" {
+		t.Errorf("Route to the caller = %v, want p1", got)
+	}
+	if !strings.Contains(toCallee.GetHeader("Via"), ";branch=z9hG4bK") || toCallee.GetHeader("Via") == toCaller.GetHeader("Via") {
+		t.Errorf("Via = %q and %q, want a branch per BYE", toCallee.GetHeader("Via"), toCaller.GetHeader("Via"))
+	}
+	if toCaller.GetHeader("Reason") != sessionExpiredReason {
+		t.Errorf("Reason = %q", toCaller.GetHeader("Reason"))
+	}
+	if len(media.released) != 1 || media.released[0] != "st-1" {
+		t.Errorf("media released %v, want st-1", media.released)
+	}
+	if len(md.signaling) != 1 || md.signaling[0].Method != sip.MethodBYE {
+		t.Errorf("LI got %d messages, want the BYE", len(md.signaling))
+	}
+	if len(s.sessions) != 0 {
+		t.Error("expired session still tracked")
+	}
+}
+
+func TestSBC_SessionRefreshedBySBC(t *testing.T) {
+	s, setNow := newTimerSBC(t, 1800*time.Second)
+	sender := &fakeSender{fail: map[string]bool{}}
+	media := &fakeMedia{}
+	s.SetRequestSender(sender)
+	s.SetMediaReleaser(media)
+
+	// Neither UA supports session timers
+	invite := timerRequest(sip.MethodINVITE, "1 INVITE", "Allow", "INVITE, ACK, BYE, UPDATE")
+	forward(t, s, invite)
+	answer(t, s, invite, "Allow", "INVITE, ACK, BYE, UPDATE")
+
+	setNow(900 * time.Second)
+	s.ExpireSessions(context.Background())
+	if len(sender.sent) != 2 || sender.sent[0].Method != sip.MethodUPDATE || sender.sent[1].Method != sip.MethodUPDATE {
+		t.Fatalf("sent %d requests, want an UPDATE on both legs", len(sender.sent))
+	}
+	if got := sender.sent[0].GetHeader("Session-Expires"); got != "1800;refresher=uac" {
+		t.Errorf("UPDATE Session-Expires = %q", got)
+	}
+
+	// The next refresh fails on the caller leg: the session is ended
+	sender.sent = nil
+	sender.fail["sip:alice@192.0.2.1"] = true
+	setNow(1800 * time.Second)
+	s.ExpireSessions(context.Background())
+	var byes int
+	for _, req := range sender.sent {
+		if req.Method == sip.MethodBYE {
+			byes++
+		}
+	}
+	if byes != 2 || len(media.released) != 1 || len(s.sessions) != 0 {
+		t.Errorf("sent %d BYEs, released %v, %d sessions left", byes, media.released, len(s.sessions))
+	}
+}
+
+func TestSBC_SessionRefreshedByReINVITE(t *testing.T) {
+	s, setNow := newTimerSBC(t, 1800*time.Second)
+	sender := &fakeSender{}
+	s.SetRequestSender(sender)
+
+	// Only the caller allows UPDATE
+	const offer, answerSDP = "v=0\r\no=alice 1 1 IN IP4 192.0.2.1\r\n", "v=0\r\no=bob 1 1 IN IP4 192.0.2.2\r\n"
+	invite := timerRequest(sip.MethodINVITE, "1 INVITE", "Allow", "INVITE, ACK, BYE, UPDATE", "Content-Type", "application/sdp")
+	invite.Body = offer
+	forward(t, s, invite)
+	resp := &sip.Message{Version: "SIP/2.0", StatusCode: sip.StatusOK, StatusText: "OK", Body: answerSDP, Headers: map[string][]string{
+		"From":         {invite.GetHeader("From")},
+		"To":           {"<sip:bob@example.com>;tag=b1"},
+		"Call-ID":      {"st-1"},
+		"CSeq":         {"1 INVITE"},
+		"Contact":      {"<sip:bob@192.0.2.2>"},
+		"Allow":        {"INVITE, ACK, BYE"},
+		"Content-Type": {"application/sdp"},
+	}}
+	s.ProcessMessage(resp, "192.0.2.2:5060")
+
+	setNow(900 * time.Second)
+	s.ExpireSessions(context.Background())
+	if len(sender.sent) != 2 {
+		t.Fatalf("sent %d requests, want a refresh on both legs", len(sender.sent))
+	}
+	toCallee, toCaller := sender.sent[0], sender.sent[1]
+	if toCallee.Method != sip.MethodINVITE || toCallee.Body != offer || toCallee.GetHeader("Content-Type") != "application/sdp" {
+		t.Errorf("refresh of the callee = %s, want a re-INVITE with the offer of the caller", toCallee)
+	}
+	if toCaller.Method != sip.MethodUPDATE || toCaller.Body != "" {
+		t.Errorf("refresh of the caller = %s, want an UPDATE", toCaller)
+	}
+}
+
+func TestSBC_SessionSetupTimeout(t *testing.T) {
+	s, setNow := newTimerSBC(t, 1800*time.Second)
+	sender := &fakeSender{}
+	media := &fakeMedia{}
+	s.SetRequestSender(sender)
+	s.SetMediaReleaser(media)
+
+	// The INVITE never gets a final response
+	forward(t, s, timerRequest(sip.MethodINVITE, "1 INVITE"))
+	setNow(sessionSetupTimeout - time.Second)
+	s.ExpireSessions(context.Background())
+	if len(s.sessions) != 1 {
+		t.Fatal("session setup forgotten before its timeout")
+	}
+	setNow(sessionSetupTimeout)
+	s.ExpireSessions(context.Background())
+	if len(s.sessions) != 0 || len(sender.sent) != 0 {
+		t.Errorf("%d sessions left, sent %d requests, want the setup forgotten", len(s.sessions), len(sender.sent))
+	}
+	if len(media.released) != 1 {
+		t.Errorf("media released %v, want st-1", media.released)
+	}
+}
+
+func TestSBC_SessionEndedByBYE(t *testing.T) {
+	s, _ := newTimerSBC(t, 1800*time.Second)
+	invite := timerRequest(sip.MethodINVITE, "1 INVITE")
+	forward(t, s, invite)
+	answer(t, s, invite)
+	forward(t, s, timerRequest(sip.MethodBYE, "2 BYE"))
+	if len(s.sessions) != 0 {
+		t.Error("session tracked after BYE")
+	}
+
+	// A failed INVITE is not tracked either
+	invite = timerRequest(sip.MethodINVITE, "1 INVITE")
+	forward(t, s, invite)
+	resp := &sip.Message{Version: "SIP/2.0", StatusCode: sip.StatusBusyHere, StatusText: "Busy Here", Headers: map[string][]string{
+		"Call-ID": {"st-1"},
+		"CSeq":    {"1 INVITE"},
+	}}
+	s.ProcessMessage(resp, "192.0.2.2:5060")
+	if len(s.sessions) != 0 {
+		t.Error("session tracked after a failed INVITE")
+	}
+}
@@ -1,19 +1,38 @@
 package sbc
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/dasmlab/ims/internal/sip"
 	"github.com/dasmlab/ims/internal/stir"
+	"github.com/dasmlab/ims/pkg/ims"
 	"github.com/sirupsen/logrus"
 )
 
+// STIR transit policies for INVITEs that already carry an Identity header
+const (
+	STIRTransitKeep   = "keep"   // forward received PASSporTs untouched
+	STIRTransitResign = "resign" // replace received PASSporTs with our own, gateway attested
+	STIRTransitDiv    = "div"    // keep received PASSporTs and add a div PASSporT if retargeted
+)
+
 // signSTIR signs an INVITE message with STIR/SHAKEN
 func (s *SBC) signSTIR(msg *sip.Message) error {
 	if s.stirSigner == nil {
 		return fmt.Errorf("STIR signer not initialized")
 	}
+	if s.stirCerts != nil && !s.stirCerts.HasCertificate() {
+		// A PASSporT is only verifiable once its certificate is published
+		return fmt.Errorf("STIR/SHAKEN certificate not issued yet")
+	}
+
+	// An INVITE that already carries a PASSporT is a transit call
+	if identities := msg.GetHeaderAll("Identity"); len(identities) > 0 {
+		return s.applyTransitPolicy(msg, identities)
+	}
 
 	// Extract calling and called numbers from SIP headers
 	from := msg.GetHeader("From")
@@ -29,8 +48,17 @@ func (s *SBC) signSTIR(msg *sip.Message) error {
 		return nil
 	}
 
-	// Sign the INVITE
-	token, err := s.stirSigner.SignINVITE(origTN, destTN, callID)
+	// Sign the INVITE, with Rich Call Data if the caller has branding
+	req := &stir.SignRequest{
+		OrigTN: origTN,
+		DestTN: destTN,
+		CallID: callID,
+	}
+	caller := s.lookupCaller(msg, origTN)
+	s.attest(req, msg, caller)
+	s.addRichCallData(req, caller)
+
+	token, err := s.stirSigner.Sign(req)
 	if err != nil {
 		return fmt.Errorf("failed to sign INVITE: %w", err)
 	}
@@ -47,46 +75,286 @@ func (s *SBC) signSTIR(msg *sip.Message) error {
 	return nil
 }
 
+// applyTransitPolicy keeps, re-signs or extends the PASSporTs of a transit INVITE
+func (s *SBC) applyTransitPolicy(msg *sip.Message, identities []string) error {
+	switch s.config.IMS.SBC.STIRTransitPolicy {
+	case STIRTransitResign:
+		return s.resignTransit(msg)
+	case STIRTransitDiv:
+		return s.addDiversion(msg, identities)
+	default:
+		s.log.Debug("transit INVITE already signed, keeping Identity")
+		return nil
+	}
+}
+
+// resignTransit replaces received PASSporTs with a gateway-attested one of ours
+func (s *SBC) resignTransit(msg *sip.Message) error {
+	origTN := s.extractTN(msg.GetHeader("From"))
+	destTN := s.targetTN(msg)
+	callID := msg.GetHeader("Call-ID")
+
+	if origTN == "" || destTN == "" {
+		s.log.Debug("skipping STIR re-signing - missing telephone numbers")
+		return nil
+	}
+
+	token, err := s.stirSigner.SignINVITEWithAttestation(origTN, destTN, callID, stir.AttestationGateway)
+	if err != nil {
+		return fmt.Errorf("failed to re-sign transit INVITE: %w", err)
+	}
+
+	for name := range msg.Headers {
+		if strings.EqualFold(name, "Identity") {
+			delete(msg.Headers, name)
+		}
+	}
+	msg.SetHeader("Identity", token)
+
+	s.log.WithFields(logrus.Fields{
+		"orig_tn": origTN,
+		"dest_tn": destTN,
+		"call_id": callID,
+	}).Debug("transit INVITE re-signed")
+
+	return nil
+}
+
+// addDiversion adds a div PASSporT (RFC 8946) when the INVITE has been
+// retargeted away from the destination of the most recent PASSporT
+func (s *SBC) addDiversion(msg *sip.Message, identities []string) error {
+	// The most recent PASSporT is the last Identity header
+	identityToken, err := stir.ParseIdentityHeader(identities[len(identities)-1])
+	if err != nil {
+		return fmt.Errorf("failed to parse Identity header: %w", err)
+	}
+	prev, err := stir.DecodePASSporT(identityToken)
+	if err != nil {
+		return err
+	}
+
+	newDestTN := s.targetTN(msg)
+	if newDestTN == "" {
+		s.log.Debug("skipping div PASSporT - missing target telephone number")
+		return nil
+	}
+	for _, tn := range prev.Dest.TN {
+		if tn == newDestTN {
+			// Not retargeted, nothing to add
+			return nil
+		}
+	}
+
+	// Prefer the diverting number signalled in SIP if it matches the previous dest
+	divertingTN := ""
+	if tn := s.divertingTN(msg); tn != "" {
+		for _, dest := range prev.Dest.TN {
+			if dest == tn {
+				divertingTN = tn
+				break
+			}
+		}
+	}
+
+	callID := msg.GetHeader("Call-ID")
+	token, err := s.stirSigner.SignDiversion(prev, divertingTN, newDestTN, callID)
+	if err != nil {
+		return fmt.Errorf("failed to sign div PASSporT: %w", err)
+	}
+
+	addIdentityHeader(msg, token)
+
+	s.log.WithFields(logrus.Fields{
+		"orig_tn": prev.Orig.TN,
+		"dest_tn": newDestTN,
+		"call_id": callID,
+	}).Debug("div PASSporT added for retargeted INVITE")
+
+	return nil
+}
+
 // verifySTIR verifies the STIR/SHAKEN signature in an INVITE message
 func (s *SBC) verifySTIR(msg *sip.Message) error {
 	if s.stirVerifier == nil {
 		return fmt.Errorf("STIR verifier not initialized")
 	}
 
-	// Get Identity header
-	identityHeader := msg.GetHeader("Identity")
-	if identityHeader == "" {
+	// Get Identity headers (one original plus any div PASSporTs)
+	identityHeaders := msg.GetHeaderAll("Identity")
+	if len(identityHeaders) == 0 {
 		s.log.Debug("no Identity header found, skipping STIR verification")
 		return nil
 	}
 
-	// Parse Identity header (may be base64 encoded)
-	identityToken, err := stir.ParseIdentityHeader(identityHeader)
-	if err != nil {
-		return fmt.Errorf("failed to parse Identity header: %w", err)
+	// Parse Identity headers (may be base64 encoded)
+	identityTokens := make([]string, 0, len(identityHeaders))
+	for _, identityHeader := range identityHeaders {
+		identityToken, err := stir.ParseIdentityHeader(identityHeader)
+		if err != nil {
+			return fmt.Errorf("failed to parse Identity header: %w", err)
+		}
+		identityTokens = append(identityTokens, identityToken)
 	}
 
-	// Verify the token
-	passport, err := s.stirVerifier.VerifyINVITE(identityToken)
+	// Verify the tokens and the div chain
+	chain, err := s.stirVerifier.VerifyChain(identityTokens)
 	if err != nil {
 		return fmt.Errorf("STIR verification failed: %w", err)
 	}
+	passport := chain.Original
 
 	// Log verification result
 	s.log.WithFields(logrus.Fields{
-		"orig_tn":  passport.Orig.TN,
-		"dest_tn":  passport.Dest.TN,
-		"attest":   passport.Attest,
-		"verified": true,
+		"orig_tn":    passport.Orig.TN,
+		"dest_tn":    chain.Final().Dest.TN,
+		"attest":     passport.Attest,
+		"diversions": len(chain.Diversions),
+		"verified":   true,
 	}).Info("STIR/SHAKEN verification successful")
 
 	// Add verification result to message headers for downstream processing
 	msg.SetHeader("X-STIR-Attestation", string(passport.Attest))
 	msg.SetHeader("X-STIR-Verified", "true")
+	if chain.IsDiverted() {
+		msg.SetHeader("X-STIR-Diverted", "true")
+	}
+
+	// Present verified Rich Call Data to the called party
+	if passport.RCD != nil {
+		rcd, err := stir.VerifyRCD(passport, s.rcdFetcher)
+		switch {
+		case errors.Is(err, stir.ErrRCDContentPending), errors.Is(err, stir.ErrRCDContentUnavailable):
+			// Only the signed name and reason without the referenced
+			// content, until it is fetched for later calls
+			s.applyVerifiedRCD(msg, &stir.VerifiedRCD{DisplayName: passport.RCD.Nam, CallReason: passport.RCD.CRN})
+		case err != nil:
+			s.log.WithError(err).Warn("Rich Call Data verification failed, ignoring RCD")
+		default:
+			s.applyVerifiedRCD(msg, rcd)
+		}
+	}
 
 	return nil
 }
 
+// addRichCallData adds the caller's enterprise RCD from the HSS to req
+func (s *SBC) addRichCallData(req *stir.SignRequest, sub *ims.Subscriber) {
+	if sub == nil {
+		return
+	}
+
+	data := sub.ServiceProfile.RichCallData
+	if data.DisplayName == "" {
+		return
+	}
+
+	rcd := &stir.RCDClaim{
+		Nam: data.DisplayName,
+		JCL: data.JCardURL,
+		ICN: data.LogoURL,
+		CRN: data.CallReason,
+	}
+	if data.JCard != "" {
+		rcd.JCD = json.RawMessage(data.JCard)
+	}
+
+	rcdi, err := stir.ComputeRCDI(rcd, s.rcdFetcher)
+	if err != nil {
+		// Sign the display name only rather than unprotected URLs
+		s.log.WithError(err).Warn("failed to compute rcdi, signing RCD without referenced content")
+		rcd = &stir.RCDClaim{Nam: data.DisplayName, CRN: data.CallReason}
+		rcdi = nil
+	}
+
+	req.RCD = rcd
+	req.RCDI = rcdi
+}
+
+// applyVerifiedRCD sets the verified caller name and logo on the INVITE
+func (s *SBC) applyVerifiedRCD(msg *sip.Message, rcd *stir.VerifiedRCD) {
+	if from := msg.GetHeader("From"); from != "" {
+		msg.SetHeader("From", withDisplayName(from, rcd.DisplayName))
+	}
+	if rcd.IconURL != "" {
+		msg.AddHeader("Call-Info", "<"+rcd.IconURL+">;purpose=icon")
+	}
+	if rcd.CallReason != "" {
+		msg.SetHeader("X-STIR-Call-Reason", rcd.CallReason)
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"call_id":      msg.GetHeader("Call-ID"),
+		"display_name": rcd.DisplayName,
+	}).Debug("verified Rich Call Data applied")
+}
+
+// extractURI returns the bare URI of a name-addr or addr-spec header value
+func extractURI(header string) string {
+	if start := strings.Index(header, "<"); start >= 0 {
+		if end := strings.Index(header[start:], ">"); end > 0 {
+			return header[start+1 : start+end]
+		}
+	}
+	return strings.TrimSpace(strings.Split(header, ";")[0])
+}
+
+// withDisplayName replaces the display name of a From/To header value
+func withDisplayName(header, name string) string {
+	quoted := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+
+	if start := strings.Index(header, "<"); start >= 0 {
+		return quoted + " " + header[start:]
+	}
+
+	// addr-spec form: header parameters follow the URI
+	uri, params, _ := strings.Cut(header, ";")
+	result := quoted + " <" + strings.TrimSpace(uri) + ">"
+	if params != "" {
+		result += ";" + params
+	}
+	return result
+}
+
+// addIdentityHeader appends an Identity header, reusing the existing header key
+func addIdentityHeader(msg *sip.Message, token string) {
+	for name := range msg.Headers {
+		if strings.EqualFold(name, "Identity") {
+			msg.Headers[name] = append(msg.Headers[name], token)
+			return
+		}
+	}
+	msg.AddHeader("Identity", token)
+}
+
+// targetTN returns the telephone number the INVITE is currently targeted at.
+// The Request-URI reflects retargeting, so it takes precedence over To.
+func (s *SBC) targetTN(msg *sip.Message) string {
+	if tn := s.extractTN(msg.URI); tn != "" {
+		return tn
+	}
+	return s.extractTN(msg.GetHeader("To"))
+}
+
+// divertingTN returns the most recent diverting number from the
+// Diversion (RFC 5806) or History-Info (RFC 7044) headers
+func (s *SBC) divertingTN(msg *sip.Message) string {
+	// The most recent diversion is the top-most Diversion entry
+	if diversion := msg.GetHeader("Diversion"); diversion != "" {
+		return s.extractTN(strings.Split(diversion, ",")[0])
+	}
+
+	// History-Info entries are in order, the last one being the current target
+	var entries []string
+	for _, value := range msg.GetHeaderAll("History-Info") {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+	if len(entries) >= 2 {
+		return s.extractTN(entries[len(entries)-2])
+	}
+
+	return ""
+}
+
 // extractTN extracts a telephone number from a SIP URI
 func (s *SBC) extractTN(sipURI string) string {
 	// Simple extraction - in production, use proper SIP URI parsing
@@ -105,6 +373,7 @@ func (s *SBC) extractTN(sipURI string) string {
 	
 	// Remove "sip:" prefix if present
 	userPart = strings.TrimPrefix(userPart, "sip:")
+	userPart = strings.TrimPrefix(userPart, "tel:")
 	
 	// Extract display name if present (format: "Display Name" <sip:number@domain>)
 	if strings.Contains(userPart, "<") {
@@ -112,11 +381,14 @@ func (s *SBC) extractTN(sipURI string) string {
 		if len(parts) > 1 {
 			userPart = strings.Trim(parts[1], ">")
 			userPart = strings.TrimPrefix(userPart, "sip:")
+			userPart = strings.TrimPrefix(userPart, "tel:")
 		}
 	}
 	
-	// Remove any parameters (e.g., ;tag=...)
+	// Remove any parameters (e.g., ;tag=...) and URI headers (e.g., ?Reason=...)
 	userPart = strings.Split(userPart, ";")[0]
+	userPart = strings.Split(userPart, "?")[0]
+	userPart = strings.TrimRight(userPart, ">")
 	
 	// Clean up the number (remove + if needed, or keep it)
 	return strings.TrimSpace(userPart)
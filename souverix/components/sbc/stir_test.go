@@ -1,10 +1,16 @@
 package sbc
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"testing"
 
 	"github.com/dasmlab/ims/internal/config"
 	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/internal/stir"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
 	"github.com/sirupsen/logrus"
 )
 
@@ -137,3 +143,219 @@ func TestSBC_ExtractTN(t *testing.T) {
 		})
 	}
 }
+
+// newTransitTestSBC creates an SBC whose STIR signer/verifier use a local key
+func newTransitTestSBC(t *testing.T, policy string) *SBC {
+	t.Helper()
+
+	cfg := &config.Config{
+		IMS: config.IMSConfig{
+			SBC: config.SBCConfig{
+				EnableSTIR:        true,
+				STIRAttestation:   "A",
+				STIRTransitPolicy: policy,
+			},
+		},
+		ZeroTrust: config.ZeroTrustConfig{
+			ACME: config.ACMEConfig{Domain: "ims.local"},
+		},
+	}
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	sbc, err := NewSBC(cfg, log)
+	if err != nil {
+		t.Fatalf("NewSBC() error = %v", err)
+	}
+
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	sbc.stirSigner = stir.NewSTIRSigner(privateKey, "https://ims.local/cert.pem", stir.AttestationFull)
+	sbc.stirVerifier = stir.NewSTIRVerifier(&staticCertFetcher{publicKey: &privateKey.PublicKey})
+	return sbc
+}
+
+// divertedINVITE returns an INVITE originally signed for +15145551234 and
+// retargeted to +15145550000
+func divertedINVITE(t *testing.T, sbc *SBC) *sip.Message {
+	t.Helper()
+
+	original, err := sbc.stirSigner.SignINVITE("+15145559876", "+15145551234", "test-call-id")
+	if err != nil {
+		t.Fatalf("SignINVITE() error = %v", err)
+	}
+
+	return &sip.Message{
+		Method:  sip.MethodINVITE,
+		URI:     "sip:+15145550000@ims.local",
+		Version: "SIP/2.0",
+		Headers: map[string][]string{
+			"From":      {"sip:+15145559876@peer.com;tag=1"},
+			"To":        {"sip:+15145551234@ims.local"},
+			"Call-ID":   {"test-call-id"},
+			"CSeq":      {"1 INVITE"},
+			"Identity":  {original},
+			"Diversion": {"<sip:+15145551234@ims.local>;reason=unconditional"},
+		},
+	}
+}
+
+func TestSBC_STIRTransitPolicy(t *testing.T) {
+	tests := []struct {
+		policy         string
+		wantIdentities int
+		wantDiverted   bool
+		wantAttest     stir.AttestationLevel
+	}{
+		{STIRTransitKeep, 1, false, stir.AttestationFull},
+		{STIRTransitDiv, 2, true, stir.AttestationFull},
+		{STIRTransitResign, 1, false, stir.AttestationGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			sbc := newTransitTestSBC(t, tt.policy)
+			msg := divertedINVITE(t, sbc)
+
+			if err := sbc.signSTIR(msg); err != nil {
+				t.Fatalf("signSTIR() error = %v", err)
+			}
+			if got := len(msg.GetHeaderAll("Identity")); got != tt.wantIdentities {
+				t.Fatalf("Identity headers = %d, want %d", got, tt.wantIdentities)
+			}
+
+			tokens := msg.GetHeaderAll("Identity")
+			chain, err := sbc.stirVerifier.VerifyChain(tokens)
+			if err != nil {
+				t.Fatalf("VerifyChain() error = %v", err)
+			}
+			if chain.IsDiverted() != tt.wantDiverted {
+				t.Errorf("IsDiverted() = %v, want %v", chain.IsDiverted(), tt.wantDiverted)
+			}
+			if chain.Original.Attest != tt.wantAttest {
+				t.Errorf("attest = %v, want %v", chain.Original.Attest, tt.wantAttest)
+			}
+
+			if err := sbc.verifySTIR(msg); err != nil {
+				t.Fatalf("verifySTIR() error = %v", err)
+			}
+			if got := msg.GetHeader("X-STIR-Diverted") == "true"; got != tt.wantDiverted {
+				t.Errorf("X-STIR-Diverted = %v, want %v", got, tt.wantDiverted)
+			}
+		})
+	}
+}
+
+func TestSBC_STIRTransitDiv_NotRetargeted(t *testing.T) {
+	sbc := newTransitTestSBC(t, STIRTransitDiv)
+	msg := divertedINVITE(t, sbc)
+	msg.URI = "sip:+15145551234@ims.local"
+	delete(msg.Headers, "Diversion")
+
+	if err := sbc.signSTIR(msg); err != nil {
+		t.Fatalf("signSTIR() error = %v", err)
+	}
+	if got := len(msg.GetHeaderAll("Identity")); got != 1 {
+		t.Errorf("Identity headers = %d, want 1", got)
+	}
+}
+
+// staticCertFetcher returns a fixed public key
+type staticCertFetcher struct {
+	publicKey *ecdsa.PublicKey
+}
+
+func (f *staticCertFetcher) FetchCertificate(certURL string) (*ecdsa.PublicKey, error) {
+	return f.publicKey, nil
+}
+
+func TestSBC_STIRRichCallData(t *testing.T) {
+	sbc := newTransitTestSBC(t, STIRTransitKeep)
+
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	hssStore, _ := store.NewMemHSSStore(log)
+	hssStore.UpsertSubscriber(&ims.Subscriber{
+		IMPU: "sip:+15145559876@ims.local",
+		IMPI: "acme@ims.local",
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities: []string{"sip:+15145559876@ims.local"},
+			RichCallData: ims.RichCallData{
+				DisplayName: "Acme \"Support\"",
+				LogoURL:     "https://rcd.example.com/logo.png",
+			},
+		},
+	})
+	sbc.SetHSSStore(hssStore)
+	sbc.rcdFetcher = staticRCDFetcher("logo-bytes")
+	sbc.trustDomain = sip.NewTrustDomain([]string{"10.0.0.0/8"})
+
+	msg := &sip.Message{
+		Method:     sip.MethodINVITE,
+		URI:        "sip:+15145551234@example.com",
+		Version:    "SIP/2.0",
+		RemoteAddr: "10.1.1.1:5060",
+		Headers: map[string][]string{
+			"From":    {"<sip:+15145559876@ims.local>;tag=1"},
+			"To":      {"sip:+15145551234@example.com"},
+			"Call-ID": {"test-call-id"},
+			"CSeq":    {"1 INVITE"},
+		},
+	}
+
+	if err := sbc.signSTIR(msg); err != nil {
+		t.Fatalf("signSTIR() error = %v", err)
+	}
+	if err := sbc.verifySTIR(msg); err != nil {
+		t.Fatalf("verifySTIR() error = %v", err)
+	}
+
+	wantFrom := `"Acme \"Support\"" <sip:+15145559876@ims.local>;tag=1`
+	if got := msg.GetHeader("From"); got != wantFrom {
+		t.Errorf("From = %v, want %v", got, wantFrom)
+	}
+	if got := msg.GetHeader("Call-Info"); got != "<https://rcd.example.com/logo.png>;purpose=icon" {
+		t.Errorf("Call-Info = %v", got)
+	}
+
+	// Without allowed hosts the logo is dropped but the signed name stands
+	msg.SetHeader("From", "<sip:+15145559876@ims.local>;tag=1")
+	msg.RemoveHeader("Call-Info")
+	msg.RemoveHeader("Identity")
+	if err := sbc.signSTIR(msg); err != nil {
+		t.Fatalf("signSTIR() error = %v", err)
+	}
+	sbc.rcdFetcher = stir.NewCachedRCDContentFetcher(staticRCDFetcher("logo-bytes"), nil)
+	if err := sbc.verifySTIR(msg); err != nil {
+		t.Fatalf("verifySTIR() error = %v", err)
+	}
+	if got := msg.GetHeader("From"); got != wantFrom {
+		t.Errorf("From without allowed hosts = %v, want %v", got, wantFrom)
+	}
+	if got := msg.GetHeader("Call-Info"); got != "" {
+		t.Errorf("Call-Info without allowed hosts = %v", got)
+	}
+}
+
+func TestWithDisplayName(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"sip:+15145559876@ims.local;tag=1", `"Acme" <sip:+15145559876@ims.local>;tag=1`},
+		{"Old <sip:+15145559876@ims.local>;tag=1", `"Acme" <sip:+15145559876@ims.local>;tag=1`},
+		{"<tel:+15145559876>", `"Acme" <tel:+15145559876>`},
+	}
+
+	for _, tt := range tests {
+		if got := withDisplayName(tt.header, "Acme"); got != tt.want {
+			t.Errorf("withDisplayName(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// staticRCDFetcher returns the same content for every URL
+type staticRCDFetcher string
+
+func (f staticRCDFetcher) FetchRCDContent(url string) ([]byte, error) {
+	return []byte(f), nil
+}
@@ -0,0 +1,194 @@
+package scscf
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Digest algorithms used in REGISTER challenges
+const (
+	AlgorithmMD5    = "MD5"       // RFC 2617
+	AlgorithmSHA256 = "SHA-256"   // RFC 7616
+	AlgorithmAKAv1  = "AKAv1-MD5" // RFC 3310
+	AlgorithmAKAv2  = "AKAv2-MD5" // RFC 4169
+)
+
+// credentials is a parsed Digest Authorization header (RFC 3261 section 22.4)
+type credentials struct {
+	username  string
+	realm     string
+	nonce     string
+	uri       string
+	response  string
+	algorithm string
+	cnonce    string
+	qop       string
+	nc        string
+	auts      string // AKA resynchronisation token (RFC 3310 section 3.4)
+
+	// integrity-protected is added by the P-CSCF (TS 24.229 section 5.2.2)
+	integrityProtected string
+}
+
+// parseCredentials parses a Digest Authorization header
+func parseCredentials(header string) (*credentials, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, fmt.Errorf("unsupported authorization scheme %q", scheme)
+	}
+
+	params := parseParams(rest)
+	creds := &credentials{
+		username:           params["username"],
+		realm:              params["realm"],
+		nonce:              params["nonce"],
+		uri:                params["uri"],
+		response:           params["response"],
+		algorithm:          params["algorithm"],
+		cnonce:             params["cnonce"],
+		qop:                params["qop"],
+		nc:                 params["nc"],
+		auts:               params["auts"],
+		integrityProtected: params["integrity-protected"],
+	}
+	if creds.username == "" {
+		return nil, fmt.Errorf("authorization header without username")
+	}
+	return creds, nil
+}
+
+// parseParams splits comma separated auth-params, unquoting quoted values
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range splitList(s) {
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		}
+		if name != "" {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// challenge is an outstanding authentication challenge for one REGISTER
+type challenge struct {
+	nonce     string
+	impi      string
+	impu      string
+	realm     string
+	algorithm string
+	expires   time.Time
+
+	// SIP Digest
+	ha1 string
+
+	// IMS AKA
+	rand []byte
+	xres []byte
+	ck   []byte
+	ik   []byte
+
+	nc uint64 // Highest nonce count accepted
+}
+
+// isAKA reports whether the challenge carries an AKA vector
+func (c *challenge) isAKA() bool {
+	return c.algorithm == AlgorithmAKAv1 || c.algorithm == AlgorithmAKAv2
+}
+
+// header returns the WWW-Authenticate value. CK and IK are passed to the
+// P-CSCF for the security association (TS 24.229 section 5.4.1.2.1).
+func (c *challenge) header(stale bool) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `Digest realm="%s", nonce="%s", algorithm=%s, qop="auth"`, c.realm, c.nonce, c.algorithm)
+	if c.isAKA() {
+		fmt.Fprintf(&sb, `, ik="%s", ck="%s"`, hex.EncodeToString(c.ik), hex.EncodeToString(c.ck))
+	}
+	if stale {
+		sb.WriteString(", stale=TRUE")
+	}
+	return sb.String()
+}
+
+// verify checks the Digest response of creds for a request with method
+func (c *challenge) verify(creds *credentials, method string) error {
+	if creds.algorithm != "" && !strings.EqualFold(creds.algorithm, c.algorithm) {
+		return fmt.Errorf("algorithm %s does not match challenge %s", creds.algorithm, c.algorithm)
+	}
+	if creds.realm != c.realm {
+		return fmt.Errorf("realm %q does not match challenge", creds.realm)
+	}
+
+	// The challenge offers qop="auth" only: a response without it would
+	// escape the nonce count check and could be replayed
+	if creds.qop != "auth" {
+		return fmt.Errorf("unsupported qop %q", creds.qop)
+	}
+	nc, err := strconv.ParseUint(creds.nc, 16, 32)
+	if err != nil || creds.cnonce == "" {
+		return fmt.Errorf("invalid nonce count or cnonce")
+	}
+	if nc <= c.nc {
+		return fmt.Errorf("nonce count %d replayed", nc)
+	}
+
+	newHash := md5.New
+	ha1 := c.ha1
+	switch c.algorithm {
+	case AlgorithmSHA256:
+		newHash = sha256.New
+	case AlgorithmAKAv1:
+		ha1 = hashHex(newHash, creds.username, c.realm, string(c.xres))
+	case AlgorithmAKAv2:
+		ha1 = hashHex(newHash, creds.username, c.realm, akav2Password(c.xres, c.ik, c.ck))
+	}
+
+	ha2 := hashHex(newHash, method, creds.uri)
+	want := hashHex(newHash, ha1, creds.nonce, creds.nc, creds.cnonce, creds.qop, ha2)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(creds.response)), []byte(want)) != 1 {
+		return fmt.Errorf("digest response mismatch")
+	}
+
+	c.nc = nc
+	return nil
+}
+
+// hashHex returns the hex digest of the colon separated parts
+func hashHex(newHash func() hash.Hash, parts ...string) string {
+	h := newHash()
+	h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// akav2Password derives the AKAv2 password
+// base64(HMAC-MD5(RES || IK || CK, "http-digest-akav2-password")) (RFC 4169
+// section 3)
+func akav2Password(res, ik, ck []byte) string {
+	key := append(append(append([]byte(nil), res...), ik...), ck...)
+	mac := hmac.New(md5.New, key)
+	mac.Write([]byte("http-digest-akav2-password"))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newNonce returns a random Digest nonce
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
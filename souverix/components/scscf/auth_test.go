@@ -0,0 +1,127 @@
+package scscf
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    credentials
+		wantErr bool
+	}{
+		{
+			name:   "digest response",
+			header: `Digest username="alice@ims.local", realm="ims.local", nonce="abc=", uri="sip:ims.local", response="0123", algorithm=MD5, cnonce="xyz", qop=auth, nc=00000001`,
+			want: credentials{
+				username: "alice@ims.local", realm: "ims.local", nonce: "abc=", uri: "sip:ims.local",
+				response: "0123", algorithm: "MD5", cnonce: "xyz", qop: "auth", nc: "00000001",
+			},
+		},
+		{
+			name:   "initial REGISTER from the P-CSCF",
+			header: `Digest username="alice@ims.local", realm="ims.local", nonce="", uri="sip:ims.local", response="", integrity-protected="no"`,
+			want: credentials{
+				username: "alice@ims.local", realm: "ims.local", uri: "sip:ims.local", integrityProtected: "no",
+			},
+		},
+		{
+			name:   "AKA resynchronisation with a comma in a quoted value",
+			header: `Digest username="alice@ims.local", realm="a,b", nonce="n", uri="sip:ims.local", response="r", auts="AAEC"`,
+			want: credentials{
+				username: "alice@ims.local", realm: "a,b", nonce: "n", uri: "sip:ims.local", response: "r", auts: "AAEC",
+			},
+		},
+		{name: "basic scheme", header: `Basic YWxpY2U6c2VjcmV0`, wantErr: true},
+		{name: "no username", header: `Digest realm="ims.local"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCredentials(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("parseCredentials() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChallenge_Verify(t *testing.T) {
+	// RFC 2617 section 3.5 and RFC 7616 section 3.9.1 examples
+	tests := []struct {
+		name  string
+		ch    challenge
+		creds credentials
+	}{
+		{
+			name: "MD5",
+			ch: challenge{
+				realm: "testrealm@host.com", algorithm: AlgorithmMD5,
+				ha1: hashHex(md5.New, "Mufasa", "testrealm@host.com", "Circle Of Life"),
+			},
+			creds: credentials{
+				username: "Mufasa", realm: "testrealm@host.com", nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+				uri: "/dir/index.html", qop: "auth", nc: "00000001", cnonce: "0a4f113b",
+				response: "6629fae49393a05397450978507c4ef1",
+			},
+		},
+		{
+			name: "SHA-256",
+			ch: challenge{
+				realm: "http-auth@example.org", algorithm: AlgorithmSHA256,
+				ha1: hashHex(sha256.New, "Mufasa", "http-auth@example.org", "Circle of Life"),
+			},
+			creds: credentials{
+				username: "Mufasa", realm: "http-auth@example.org", nonce: "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+				uri: "/dir/index.html", qop: "auth", nc: "00000001", cnonce: "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+				algorithm: "SHA-256", response: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.ch.verify(&tt.creds, "GET"); err != nil {
+				t.Fatalf("verify() error = %v", err)
+			}
+			if err := tt.ch.verify(&tt.creds, "GET"); err == nil {
+				t.Error("verify() accepted a replayed nonce count")
+			}
+
+			tt.creds.nc = "00000002"
+			if err := tt.ch.verify(&tt.creds, "GET"); err == nil {
+				t.Error("verify() accepted a response computed for another nonce count")
+			}
+
+			// An RFC 2069 response without qop has no nonce count to check
+			newHash := md5.New
+			if tt.ch.algorithm == AlgorithmSHA256 {
+				newHash = sha256.New
+			}
+			tt.creds.qop, tt.creds.nc, tt.creds.cnonce = "", "", ""
+			tt.creds.response = hashHex(newHash, tt.ch.ha1, tt.creds.nonce, hashHex(newHash, "GET", tt.creds.uri))
+			if err := tt.ch.verify(&tt.creds, "GET"); err == nil {
+				t.Error("verify() accepted a response without qop")
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(`<sip:a@h;x=1>;expires=60, "B, Jr" <sip:b@h>, sip:c@h`)
+	want := []string{`<sip:a@h;x=1>;expires=60`, `"B, Jr" <sip:b@h>`, `sip:c@h`}
+	if len(got) != len(want) {
+		t.Fatalf("splitList() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("splitList()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
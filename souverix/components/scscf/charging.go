@@ -0,0 +1,43 @@
+package scscf
+
+import (
+	"strings"
+
+	"github.com/dasmlab/ims/internal/sip"
+)
+
+// chargeRequest sets the P-Charging-Vector of a request of user: requests
+// without one get a new ICID, and on the originating side the orig-ioi
+// identifies the home network while the term-ioi is left to the
+// terminating network (TS 24.229 section 5.4.3.2)
+func (s *ServiceRouter) chargeRequest(msg *sip.Message, user ServedUser) {
+	v := sip.EnsureChargingVector(msg, s.host())
+	if !isOriginating(user.SessionCase) || s.ioi == "" {
+		return
+	}
+	v.OrigIOI = s.ioi
+	v.TermIOI = ""
+	sip.SetChargingVector(msg, v)
+}
+
+// RouteResponse sets the P-Charging-Vector of a response to a request of
+// user: on the terminating side the term-ioi identifies the home network
+// (TS 24.229 section 5.4.3.3)
+func (s *ServiceRouter) RouteResponse(msg *sip.Message, user ServedUser) {
+	if isOriginating(user.SessionCase) || s.ioi == "" {
+		return
+	}
+	v := sip.GetChargingVector(msg)
+	if v == nil {
+		return
+	}
+	v.TermIOI = s.ioi
+	sip.SetChargingVector(msg, v)
+}
+
+// host returns the host of the server name of the S-CSCF
+func (s *ServiceRouter) host() string {
+	_, host, _ := strings.Cut(s.serverName, ":")
+	host, _, _ = strings.Cut(host, ";")
+	return host
+}
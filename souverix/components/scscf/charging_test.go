@@ -0,0 +1,51 @@
+package scscf
+
+import (
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+func TestServiceRouter_ChargingVector(t *testing.T) {
+	cfg := &config.Config{IMS: config.IMSConfig{
+		Domain: "ims.local",
+		SCSCF:  config.SCSCFConfig{ServerName: "sip:scscf1.ims.local"},
+	}}
+	router := NewServiceRouter(cfg, testLogger())
+
+	// The originating side sets its orig-ioi and drops a term-ioi
+	invite := inviteFromAlice()
+	invite.SetHeader("P-Charging-Vector", "icid-value=abc;icid-generated-at=10.0.0.1;term-ioi=forged.net")
+	router.Route(invite, ServedUser{IMPU: "sip:alice@ims.local", SessionCase: ims.SessionCaseOriginating})
+	v := sip.GetChargingVector(invite)
+	if v == nil || v.ICID != "abc" || v.OrigIOI != "ims.local" || v.TermIOI != "" {
+		t.Errorf("originating P-Charging-Vector = %q", invite.GetHeader("P-Charging-Vector"))
+	}
+
+	// A request without one gets an ICID of the S-CSCF
+	invite = inviteFromAlice()
+	router.Route(invite, ServedUser{IMPU: "sip:bob@ims.local", SessionCase: ims.SessionCaseTerminatingRegistered})
+	v = sip.GetChargingVector(invite)
+	if v == nil || v.ICID == "" || v.GeneratedAt != "scscf1.ims.local" || v.OrigIOI != "" {
+		t.Errorf("terminating P-Charging-Vector = %q", invite.GetHeader("P-Charging-Vector"))
+	}
+
+	// The terminating side answers with its term-ioi
+	response := newResponse(invite, sip.StatusOK, "OK")
+	v.OrigIOI = "other.net"
+	sip.SetChargingVector(response, v)
+	router.RouteResponse(response, ServedUser{IMPU: "sip:bob@ims.local", SessionCase: ims.SessionCaseTerminatingRegistered})
+	if got := sip.GetChargingVector(response); got.OrigIOI != "other.net" || got.TermIOI != "ims.local" {
+		t.Errorf("response P-Charging-Vector = %q", response.GetHeader("P-Charging-Vector"))
+	}
+
+	// The charging IOI overrides the domain
+	cfg.IMS.Charging.IOI = "operator.example"
+	invite = inviteFromAlice()
+	NewServiceRouter(cfg, testLogger()).Route(invite, ServedUser{IMPU: "sip:alice@ims.local", SessionCase: ims.SessionCaseOriginating})
+	if v := sip.GetChargingVector(invite); v.OrigIOI != "operator.example" {
+		t.Errorf("orig-ioi = %q, want operator.example", v.OrigIOI)
+	}
+}
@@ -0,0 +1,541 @@
+package scscf
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/hss"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/sirupsen/logrus"
+)
+
+// Default handling of an application server that does not respond
+const (
+	DefaultHandlingContinued  = "SESSION_CONTINUED"
+	DefaultHandlingTerminated = "SESSION_TERMINATED"
+)
+
+// odiParam is the Route URI parameter carrying the original dialog
+// identifier of a request sent over ISC
+const odiParam = "odi"
+
+// ServedUser is the user whose filter criteria apply to a request
+type ServedUser struct {
+	IMPU        string
+	SessionCase string // One of the ims.SessionCase values
+	Registered  bool
+	Profile     *FilterProfile
+}
+
+// FilterProfile is the initial filter criteria of a served user in
+// evaluation order. The regular expressions of its service point triggers
+// are compiled once, when the profile is loaded, and shared by every
+// request evaluated against it.
+type FilterProfile struct {
+	criteria []ims.FilterCriteria
+	patterns map[string]*regexp.Regexp // nil for an invalid expression
+}
+
+// NewFilterProfile sorts criteria by priority and compiles their regular
+// expressions. An invalid expression matches nothing.
+func NewFilterProfile(criteria []ims.FilterCriteria) *FilterProfile {
+	p := &FilterProfile{
+		criteria: make([]ims.FilterCriteria, len(criteria)),
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	copy(p.criteria, criteria)
+	sort.SliceStable(p.criteria, func(i, j int) bool {
+		return p.criteria[i].Priority < p.criteria[j].Priority
+	})
+
+	for _, fc := range p.criteria {
+		for _, spt := range fc.Trigger.SPT {
+			for _, pattern := range []string{spt.RequestURI, spt.HeaderContent, spt.SDPLineContent} {
+				if _, seen := p.patterns[pattern]; pattern == "" || seen {
+					continue
+				}
+				p.patterns[pattern], _ = regexp.Compile(pattern)
+			}
+		}
+	}
+	return p
+}
+
+// LoadFilterProfile returns the filter profile of impu in user data
+// downloaded with SAA
+func LoadFilterProfile(userData []byte, impu string) (*FilterProfile, error) {
+	criteria, err := FilterCriteria(userData, impu)
+	if err != nil {
+		return nil, err
+	}
+	return NewFilterProfile(criteria), nil
+}
+
+// Criteria returns the filter criteria in evaluation order
+func (p *FilterProfile) Criteria() []ims.FilterCriteria {
+	if p == nil {
+		return nil
+	}
+	return p.criteria
+}
+
+// ISCAction tells the S-CSCF what to do with a request after iFC evaluation
+type ISCAction int
+
+const (
+	// ISCForward sends Request to ApplicationServer
+	ISCForward ISCAction = iota
+	// ISCContinue routes Request onwards; no further filter criteria match
+	ISCContinue
+	// ISCReject answers Request with StatusCode
+	ISCReject
+)
+
+// ISCDecision is the outcome of filter criteria evaluation
+type ISCDecision struct {
+	Action            ISCAction
+	Request           *sip.Message
+	ApplicationServer ims.ApplicationServer // Set for ISCForward
+	ODI               string                // Set for ISCForward
+	StatusCode        int                   // Set for ISCReject
+	Reason            string                // Set for ISCReject
+}
+
+// Response returns the final response of a rejected request
+func (d *ISCDecision) Response() *sip.Message {
+	if d.Action != ISCReject {
+		return nil
+	}
+	return newResponse(d.Request, d.StatusCode, d.Reason)
+}
+
+// iscSession is a request held by an application server
+type iscSession struct {
+	user     ServedUser
+	next     int          // Index of the first criteria not yet evaluated
+	request  *sip.Message // Request as received, before the ISC routes
+	as       ims.ApplicationServer
+	deadline time.Time
+}
+
+// ServiceRouter evaluates initial filter criteria and routes requests to
+// application servers over ISC (TS 24.229 section 5.4.3). Each request
+// sent to an AS carries an original dialog identifier in the Route back
+// to the S-CSCF, so evaluation resumes where it stopped when the AS
+// returns the request.
+type ServiceRouter struct {
+	serverName string
+	timeout    time.Duration
+	ioi        string // Inter-operator identifier of the home network
+	log        *logrus.Logger
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*iscSession // key: ODI
+}
+
+// NewServiceRouter creates the ISC router of the S-CSCF configured in cfg
+func NewServiceRouter(cfg *config.Config, log *logrus.Logger) *ServiceRouter {
+	timeout := cfg.IMS.SCSCF.ISCTimeout
+	if timeout <= 0 {
+		timeout = 32 * time.Second
+	}
+	ioi := cfg.IMS.Charging.IOI
+	if ioi == "" {
+		ioi = cfg.IMS.Domain
+	}
+	return &ServiceRouter{
+		serverName: cfg.IMS.SCSCF.ServerName,
+		timeout:    timeout,
+		ioi:        ioi,
+		log:        log,
+		now:        time.Now,
+		sessions:   make(map[string]*iscSession),
+	}
+}
+
+// Route evaluates the filter criteria of user for a request that did not
+// come back from an application server. A topmost Route addressing this
+// S-CSCF, such as its Service-Route, is removed from msg, and its
+// P-Charging-Vector gets the inter-operator identifier of the originating
+// network.
+func (s *ServiceRouter) Route(msg *sip.Message, user ServedUser) *ISCDecision {
+	if _, own := s.ownRoute(msg); own {
+		popRoute(msg)
+	}
+	s.chargeRequest(msg, user)
+	return s.evaluate(msg, user, 0)
+}
+
+// Resume continues evaluation for a request an application server sent
+// back to the S-CSCF. It returns false when the topmost Route carries no
+// original dialog identifier of this S-CSCF.
+func (s *ServiceRouter) Resume(msg *sip.Message) (*ISCDecision, bool) {
+	params, own := s.ownRoute(msg)
+	odi := params[odiParam]
+	if !own || odi == "" {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	session := s.sessions[odi]
+	delete(s.sessions, odi)
+	s.mu.Unlock()
+
+	if session == nil {
+		return &ISCDecision{
+			Action:     ISCReject,
+			Request:    msg,
+			StatusCode: sip.StatusCallLegTransactionDoesNotExist,
+			Reason:     "Call/Transaction Does Not Exist",
+		}, true
+	}
+
+	popRoute(msg)
+	return s.evaluate(msg, session.user, session.next), true
+}
+
+// ASResponse handles a response from the application server holding the
+// request identified by odi. A timeout or a 5xx applies the default
+// handling of the AS; any other final response ends the ISC session, and
+// the response is forwarded as usual. A nil decision means there is
+// nothing more to do.
+func (s *ServiceRouter) ASResponse(odi string, statusCode int) *ISCDecision {
+	if statusCode < 200 {
+		return nil
+	}
+
+	s.mu.Lock()
+	session := s.sessions[odi]
+	delete(s.sessions, odi)
+	s.mu.Unlock()
+
+	if session == nil || (statusCode != sip.StatusRequestTimeout && statusCode < 500) {
+		return nil
+	}
+	return s.defaultHandling(odi, session)
+}
+
+// Expire applies the default handling of every application server that
+// held its request longer than the ISC timeout
+func (s *ServiceRouter) Expire() []*ISCDecision {
+	now := s.now()
+	expired := make(map[string]*iscSession)
+
+	s.mu.Lock()
+	for odi, session := range s.sessions {
+		if now.After(session.deadline) {
+			expired[odi] = session
+			delete(s.sessions, odi)
+		}
+	}
+	s.mu.Unlock()
+
+	decisions := make([]*ISCDecision, 0, len(expired))
+	for odi, session := range expired {
+		decisions = append(decisions, s.defaultHandling(odi, session))
+	}
+	return decisions
+}
+
+// Sessions returns the number of requests held by application servers
+func (s *ServiceRouter) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// defaultHandling continues evaluation without the failed AS or rejects
+// the request, as its filter criteria ask
+func (s *ServiceRouter) defaultHandling(odi string, session *iscSession) *ISCDecision {
+	s.log.WithFields(logrus.Fields{
+		"as":               session.as.ServerName,
+		"odi":              odi,
+		"default_handling": session.as.DefaultHandling,
+	}).Warn("application server did not respond")
+
+	if session.as.DefaultHandling == DefaultHandlingTerminated {
+		return &ISCDecision{
+			Action:     ISCReject,
+			Request:    session.request,
+			StatusCode: sip.StatusRequestTimeout,
+			Reason:     "Request Timeout",
+		}
+	}
+	return s.evaluate(session.request, session.user, session.next)
+}
+
+// evaluate finds the first filter criteria from index next matching msg
+func (s *ServiceRouter) evaluate(msg *sip.Message, user ServedUser, next int) *ISCDecision {
+	criteria := user.Profile.Criteria()
+	for i := next; i < len(criteria); i++ {
+		fc := criteria[i]
+		if !profilePartApplies(fc.ProfilePartIndicator, user.Registered) {
+			continue
+		}
+		if !user.Profile.triggerMatches(fc.Trigger, msg, user.SessionCase) {
+			continue
+		}
+		return s.forward(msg, user, i, fc.ApplicationServer)
+	}
+	return &ISCDecision{Action: ISCContinue, Request: msg}
+}
+
+// forward routes a copy of msg to as, through this S-CSCF on its way back
+func (s *ServiceRouter) forward(msg *sip.Message, user ServedUser, index int, as ims.ApplicationServer) *ISCDecision {
+	odi := newODI()
+	s.mu.Lock()
+	s.sessions[odi] = &iscSession{
+		user:     user,
+		next:     index + 1,
+		request:  copyMessage(msg),
+		as:       as,
+		deadline: s.now().Add(s.timeout),
+	}
+	s.mu.Unlock()
+
+	back := fmt.Sprintf("<%s;lr;%s=%s", s.serverName, odiParam, odi)
+	if isOriginating(user.SessionCase) {
+		back += ";orig"
+	}
+	routes := []string{"<" + as.ServerName + ";lr>", back + ">"}
+
+	request := copyMessage(msg)
+	request.Headers["Route"] = append(routes, removeHeader(request, "Route")...)
+	removeHeader(request, "P-Served-User")
+	request.SetHeader("P-Served-User", servedUserHeader(user))
+
+	s.log.WithFields(logrus.Fields{
+		"as":           as.ServerName,
+		"impu":         user.IMPU,
+		"session_case": user.SessionCase,
+		"priority":     user.Profile.criteria[index].Priority,
+	}).Info("forwarding request to application server")
+
+	return &ISCDecision{Action: ISCForward, Request: request, ApplicationServer: as, ODI: odi}
+}
+
+// ownRoute reports whether the topmost Route of msg addresses this
+// S-CSCF and returns its URI parameters
+func (s *ServiceRouter) ownRoute(msg *sip.Message) (map[string]string, bool) {
+	routes := splitList(strings.Join(msg.GetHeaderAll("Route"), ","))
+	if len(routes) == 0 {
+		return nil, false
+	}
+	uri := extractURI(routes[0])
+	if !strings.EqualFold(uriHost(uri), uriHost(s.serverName)) {
+		return nil, false
+	}
+	return uriParams(uri), true
+}
+
+// profilePartApplies reports whether criteria with the given profile part
+// indicator apply to a registered or unregistered served user
+func profilePartApplies(indicator string, registered bool) bool {
+	switch indicator {
+	case "REGISTERED":
+		return registered
+	case "UNREGISTERED":
+		return !registered
+	}
+	return true
+}
+
+// triggerMatches evaluates a trigger point against msg. Service point
+// triggers sharing a group number form a clause: in conjunctive normal
+// form the clauses are ORs joined by AND, otherwise ANDs joined by OR. A
+// trigger point without service point triggers always matches.
+func (p *FilterProfile) triggerMatches(tp ims.TriggerPoint, msg *sip.Message, sessionCase string) bool {
+	if len(tp.SPT) == 0 {
+		return true
+	}
+	cnf, _ := strconv.ParseBool(tp.ConditionTypeCNF)
+	cnf = cnf || tp.ConditionTypeCNF == "CNF"
+
+	clauses := make(map[int]bool)
+	var order []int
+	for _, spt := range tp.SPT {
+		result := p.sptMatches(spt, msg, sessionCase)
+		for _, group := range sptGroups(spt.Group) {
+			current, seen := clauses[group]
+			if !seen {
+				order = append(order, group)
+				clauses[group] = result
+				continue
+			}
+			if cnf {
+				clauses[group] = current || result
+			} else {
+				clauses[group] = current && result
+			}
+		}
+	}
+
+	for _, group := range order {
+		if cnf && !clauses[group] {
+			return false
+		}
+		if !cnf && clauses[group] {
+			return true
+		}
+	}
+	return cnf
+}
+
+// sptMatches evaluates a single service point trigger
+func (p *FilterProfile) sptMatches(spt ims.ServicePointTrigger, msg *sip.Message, sessionCase string) bool {
+	var result bool
+	switch {
+	case spt.Method != "":
+		result = strings.EqualFold(msg.Method, spt.Method)
+	case spt.RequestURI != "":
+		result = p.match(spt.RequestURI, msg.URI)
+	case spt.Header != "":
+		for _, value := range msg.GetHeaderAll(spt.Header) {
+			if spt.HeaderContent == "" || p.match(spt.HeaderContent, value) {
+				result = true
+			}
+		}
+	case spt.SessionCase != "":
+		result = spt.SessionCase == sessionCase
+	case spt.SDPLine != "":
+		for _, line := range strings.Split(msg.Body, "\n") {
+			kind, value, ok := strings.Cut(strings.TrimRight(line, "\r"), "=")
+			if !ok || kind != spt.SDPLine {
+				continue
+			}
+			if spt.SDPLineContent == "" || p.match(spt.SDPLineContent, value) {
+				result = true
+			}
+		}
+	}
+	if spt.ConditionNegated {
+		return !result
+	}
+	return result
+}
+
+// sptGroups parses the comma separated groups of a service point trigger
+func sptGroups(groups string) []int {
+	var out []int
+	for _, g := range strings.Split(groups, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(g))
+		if err != nil {
+			n = 0
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// match reports whether value matches the compiled pattern; an invalid
+// pattern matches nothing
+func (p *FilterProfile) match(pattern, value string) bool {
+	re := p.patterns[pattern]
+	return re != nil && re.MatchString(value)
+}
+
+// isOriginating reports whether a session case is served on the
+// originating side
+func isOriginating(sessionCase string) bool {
+	switch sessionCase {
+	case ims.SessionCaseOriginating, ims.SessionCaseOriginatingUnregistered, ims.SessionCaseOriginatingCDIV:
+		return true
+	}
+	return false
+}
+
+// servedUserHeader returns the P-Served-User header of user (RFC 5502)
+func servedUserHeader(user ServedUser) string {
+	sescase, regstate := "term", "unreg"
+	if isOriginating(user.SessionCase) {
+		sescase = "orig"
+	}
+	if user.Registered {
+		regstate = "reg"
+	}
+	return fmt.Sprintf("<%s>;sescase=%s;regstate=%s", user.IMPU, sescase, regstate)
+}
+
+// FilterCriteria returns the initial filter criteria of impu in user data
+// downloaded with SAA
+func FilterCriteria(userData []byte, impu string) ([]ims.FilterCriteria, error) {
+	subscription, err := cx.ParseIMSSubscription(userData)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := hss.DecodeSubscription(subscription)
+	for _, profile := range append([]ims.ServiceProfile{sub.ServiceProfile}, sub.AdditionalProfiles...) {
+		for _, identity := range profile.PublicIdentities {
+			if identity == impu {
+				return profile.InitialFilterCriteria, nil
+			}
+		}
+	}
+	return sub.ServiceProfile.InitialFilterCriteria, nil
+}
+
+// copyMessage returns a copy of msg with its own header map
+func copyMessage(msg *sip.Message) *sip.Message {
+	out := *msg
+	out.Headers = make(map[string][]string, len(msg.Headers))
+	for name, values := range msg.Headers {
+		out.Headers[name] = append([]string(nil), values...)
+	}
+	return &out
+}
+
+// removeHeader deletes every value of a header, whatever its case, and
+// returns the values removed
+func removeHeader(msg *sip.Message, name string) []string {
+	var removed []string
+	for k, v := range msg.Headers {
+		if strings.EqualFold(k, name) {
+			removed = append(removed, v...)
+			delete(msg.Headers, k)
+		}
+	}
+	return removed
+}
+
+// popRoute removes the topmost Route entry of msg
+func popRoute(msg *sip.Message) {
+	routes := splitList(strings.Join(removeHeader(msg, "Route"), ","))
+	if len(routes) > 1 {
+		msg.Headers["Route"] = routes[1:]
+	}
+}
+
+// uriParams returns the parameters of a SIP URI
+func uriParams(uri string) map[string]string {
+	params := make(map[string]string)
+	uri, _, _ = strings.Cut(uri, "?")
+	parts := strings.Split(uri, ";")
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if name != "" {
+			params[strings.ToLower(name)] = value
+		}
+	}
+	return params
+}
+
+// newODI returns a random original dialog identifier
+func newODI() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,338 @@
+package scscf
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+)
+
+func TestTriggerMatches(t *testing.T) {
+	invite := &sip.Message{
+		Method: "INVITE",
+		URI:    "sip:bob@ims.local",
+		Headers: map[string][]string{
+			"Accept-Contact": {"*;+g.3gpp.icsi-ref=\"urn%3Aurn-7%3A3gpp-service.ims.icsi.mmtel\""},
+		},
+		Body: "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\nm=audio 4000 RTP/AVP 0\r\n",
+	}
+	method := func(m, group string, negated bool) ims.ServicePointTrigger {
+		return ims.ServicePointTrigger{Method: m, Group: group, ConditionNegated: negated}
+	}
+
+	tests := []struct {
+		name string
+		tp   ims.TriggerPoint
+		want bool
+	}{
+		{name: "no trigger point", tp: ims.TriggerPoint{}, want: true},
+		{name: "method", tp: ims.TriggerPoint{SPT: []ims.ServicePointTrigger{method("INVITE", "0", false)}}, want: true},
+		{name: "negated method", tp: ims.TriggerPoint{SPT: []ims.ServicePointTrigger{method("INVITE", "0", true)}}, want: false},
+		{
+			name: "CNF: (INVITE or MESSAGE) and originating",
+			tp: ims.TriggerPoint{ConditionTypeCNF: "true", SPT: []ims.ServicePointTrigger{
+				method("INVITE", "0", false), method("MESSAGE", "0", false),
+				{SessionCase: ims.SessionCaseOriginating, Group: "1"},
+			}},
+			want: true,
+		},
+		{
+			name: "CNF: INVITE and terminating",
+			tp: ims.TriggerPoint{ConditionTypeCNF: "CNF", SPT: []ims.ServicePointTrigger{
+				method("INVITE", "0", false),
+				{SessionCase: ims.SessionCaseTerminatingRegistered, Group: "1"},
+			}},
+			want: false,
+		},
+		{
+			name: "DNF: (MESSAGE and originating) or (INVITE and audio)",
+			tp: ims.TriggerPoint{ConditionTypeCNF: "false", SPT: []ims.ServicePointTrigger{
+				method("MESSAGE", "0", false), {SessionCase: ims.SessionCaseOriginating, Group: "0"},
+				method("INVITE", "1", false), {SDPLine: "m", SDPLineContent: "^audio", Group: "1"},
+			}},
+			want: true,
+		},
+		{
+			name: "DNF: SPT shared by two groups",
+			tp: ims.TriggerPoint{SPT: []ims.ServicePointTrigger{
+				method("SUBSCRIBE", "0", false), {SDPLine: "m", SDPLineContent: "^video", Group: "1"},
+				{RequestURI: "^sip:bob@", Group: "0,1"},
+			}},
+			want: false,
+		},
+		{
+			name: "header content",
+			tp:   ims.TriggerPoint{SPT: []ims.ServicePointTrigger{{Header: "accept-contact", HeaderContent: "mmtel", Group: "0"}}},
+			want: true,
+		},
+		{
+			name: "header presence",
+			tp:   ims.TriggerPoint{SPT: []ims.ServicePointTrigger{{Header: "P-Asserted-Service", Group: "0"}}},
+			want: false,
+		},
+		{
+			name: "invalid request URI expression",
+			tp:   ims.TriggerPoint{SPT: []ims.ServicePointTrigger{{RequestURI: "(", Group: "0"}}},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := NewFilterProfile([]ims.FilterCriteria{{Trigger: tt.tp}})
+			if got := profile.triggerMatches(tt.tp, invite, ims.SessionCaseOriginating); got != tt.want {
+				t.Errorf("triggerMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testRouter is a ServiceRouter with a controllable clock
+type testRouter struct {
+	*ServiceRouter
+	clock time.Time
+}
+
+func newTestRouter() *testRouter {
+	cfg := &config.Config{IMS: config.IMSConfig{SCSCF: config.SCSCFConfig{
+		ServerName: "sip:scscf1.ims.local",
+		ISCTimeout: 10 * time.Second,
+	}}}
+	tr := &testRouter{
+		ServiceRouter: NewServiceRouter(cfg, testLogger()),
+		clock:         time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tr.now = func() time.Time { return tr.clock }
+	return tr
+}
+
+// servedAlice returns alice's originating filter criteria, out of priority
+// order: a terminating-only AS, then a telephony AS for INVITE and a
+// messaging AS for MESSAGE or INVITE
+func servedAlice(telephonyHandling string) ServedUser {
+	invite := ims.ServicePointTrigger{Method: "INVITE", Group: "0"}
+	return ServedUser{
+		IMPU:        "sip:alice@ims.local",
+		SessionCase: ims.SessionCaseOriginating,
+		Registered:  true,
+		Profile: NewFilterProfile([]ims.FilterCriteria{
+			{
+				Priority:          30,
+				Trigger:           ims.TriggerPoint{SPT: []ims.ServicePointTrigger{invite, {Method: "MESSAGE", Group: "1"}}},
+				ApplicationServer: ims.ApplicationServer{ServerName: "sip:msg.ims.local"},
+			},
+			{
+				Priority: 10,
+				Trigger: ims.TriggerPoint{ConditionTypeCNF: "true", SPT: []ims.ServicePointTrigger{
+					invite, {SessionCase: ims.SessionCaseTerminatingRegistered, Group: "1"},
+				}},
+				ApplicationServer: ims.ApplicationServer{ServerName: "sip:vm.ims.local"},
+			},
+			{
+				Priority:          20,
+				Trigger:           ims.TriggerPoint{SPT: []ims.ServicePointTrigger{invite}},
+				ApplicationServer: ims.ApplicationServer{ServerName: "sip:mmtel.ims.local", DefaultHandling: telephonyHandling},
+			},
+			{
+				Priority:             40,
+				ApplicationServer:    ims.ApplicationServer{ServerName: "sip:guest.ims.local"},
+				ProfilePartIndicator: "UNREGISTERED",
+			},
+		}),
+	}
+}
+
+func inviteFromAlice() *sip.Message {
+	return &sip.Message{
+		Method: "INVITE",
+		URI:    "sip:bob@ims.local",
+		Headers: map[string][]string{
+			"Via":     {"SIP/2.0/UDP pcscf.ims.local;branch=z9hG4bK1"},
+			"Route":   {"<sip:scscf1.ims.local;lr;orig>"},
+			"From":    {"<sip:alice@ims.local>;tag=a1"},
+			"To":      {"<sip:bob@ims.local>"},
+			"Call-ID": {"call-1"},
+			"CSeq":    {"1 INVITE"},
+		},
+	}
+}
+
+// returnFromAS simulates an AS proxying the request back to the S-CSCF
+func returnFromAS(t *testing.T, d *ISCDecision) *sip.Message {
+	t.Helper()
+	msg := copyMessage(d.Request)
+	popRoute(msg)
+	return msg
+}
+
+func TestServiceRouter_Chain(t *testing.T) {
+	tr := newTestRouter()
+
+	d := tr.Route(inviteFromAlice(), servedAlice(DefaultHandlingContinued))
+	if d.Action != ISCForward || d.ApplicationServer.ServerName != "sip:mmtel.ims.local" {
+		t.Fatalf("Route() = %+v, want forward to the telephony AS", d)
+	}
+	routes := d.Request.GetHeaderAll("Route")
+	wantBack := "<sip:scscf1.ims.local;lr;odi=" + d.ODI + ";orig>"
+	if len(routes) != 2 || routes[0] != "<sip:mmtel.ims.local;lr>" || routes[1] != wantBack {
+		t.Errorf("Route = %q, want the AS then %s", routes, wantBack)
+	}
+	if got := d.Request.GetHeader("P-Served-User"); got != "<sip:alice@ims.local>;sescase=orig;regstate=reg" {
+		t.Errorf("P-Served-User = %q", got)
+	}
+
+	d, ok := tr.Resume(returnFromAS(t, d))
+	if !ok || d.Action != ISCForward || d.ApplicationServer.ServerName != "sip:msg.ims.local" {
+		t.Fatalf("Resume() = %+v, %v, want forward to the messaging AS", d, ok)
+	}
+
+	d, ok = tr.Resume(returnFromAS(t, d))
+	if !ok || d.Action != ISCContinue || len(d.Request.GetHeaderAll("Route")) != 0 {
+		t.Fatalf("Resume() = %+v, %v, want continue without routes", d, ok)
+	}
+	if tr.Sessions() != 0 {
+		t.Errorf("Sessions() = %d after the chain completed", tr.Sessions())
+	}
+
+	// A request not carrying our ODI is not resumed; a stale ODI is rejected
+	if _, ok := tr.Resume(inviteFromAlice()); ok {
+		t.Error("Resume() accepted a request without an ODI")
+	}
+	stale := inviteFromAlice()
+	stale.SetHeader("Route", "<sip:scscf1.ims.local;lr;odi=deadbeef>")
+	if d, ok := tr.Resume(stale); !ok || d.Action != ISCReject || d.Response().StatusCode != sip.StatusCallLegTransactionDoesNotExist {
+		t.Errorf("Resume(stale) = %+v, %v", d, ok)
+	}
+}
+
+func TestServiceRouter_DefaultHandling(t *testing.T) {
+	t.Run("session continued on timeout", func(t *testing.T) {
+		tr := newTestRouter()
+		if d := tr.Route(inviteFromAlice(), servedAlice(DefaultHandlingContinued)); d.Action != ISCForward {
+			t.Fatalf("Route() = %+v", d)
+		}
+
+		tr.clock = tr.clock.Add(5 * time.Second)
+		if decisions := tr.Expire(); len(decisions) != 0 {
+			t.Fatalf("Expire() before the timeout = %d decisions", len(decisions))
+		}
+		tr.clock = tr.clock.Add(6 * time.Second)
+		decisions := tr.Expire()
+		if len(decisions) != 1 || decisions[0].ApplicationServer.ServerName != "sip:msg.ims.local" {
+			t.Fatalf("Expire() = %+v, want forward to the next AS", decisions)
+		}
+		if routes := decisions[0].Request.GetHeaderAll("Route"); len(routes) != 2 || strings.Contains(routes[1], "mmtel") {
+			t.Errorf("Route = %q", routes)
+		}
+	})
+
+	t.Run("session terminated on 5xx", func(t *testing.T) {
+		tr := newTestRouter()
+		d := tr.Route(inviteFromAlice(), servedAlice(DefaultHandlingTerminated))
+		if got := tr.ASResponse(d.ODI, sip.StatusTrying); got != nil {
+			t.Errorf("ASResponse(100) = %+v", got)
+		}
+		got := tr.ASResponse(d.ODI, 503)
+		if got == nil || got.Action != ISCReject {
+			t.Fatalf("ASResponse(503) = %+v, want reject", got)
+		}
+		resp := got.Response()
+		if resp.StatusCode != sip.StatusRequestTimeout || resp.GetHeader("Call-ID") != "call-1" {
+			t.Errorf("response = %d %s", resp.StatusCode, resp.GetHeader("Call-ID"))
+		}
+	})
+
+	t.Run("AS answers the request", func(t *testing.T) {
+		tr := newTestRouter()
+		d := tr.Route(inviteFromAlice(), servedAlice(DefaultHandlingTerminated))
+		if got := tr.ASResponse(d.ODI, sip.StatusBusyHere); got != nil || tr.Sessions() != 0 {
+			t.Errorf("ASResponse(486) = %+v, sessions %d", got, tr.Sessions())
+		}
+	})
+}
+
+func TestServiceRouter_Unregistered(t *testing.T) {
+	tr := newTestRouter()
+	user := servedAlice(DefaultHandlingContinued)
+	user.Registered = false
+	user.SessionCase = ims.SessionCaseOriginatingUnregistered
+
+	msg := inviteFromAlice()
+	msg.Method = "OPTIONS"
+	d := tr.Route(msg, user)
+	if d.Action != ISCForward || d.ApplicationServer.ServerName != "sip:guest.ims.local" {
+		t.Fatalf("Route() = %+v, want forward to the unregistered-only AS", d)
+	}
+	if got := d.Request.GetHeader("P-Served-User"); !strings.HasSuffix(got, "regstate=unreg") {
+		t.Errorf("P-Served-User = %q", got)
+	}
+}
+
+func TestNewFilterProfile(t *testing.T) {
+	bob := ims.ServicePointTrigger{RequestURI: "^sip:bob@", Group: "0"}
+	profile := NewFilterProfile([]ims.FilterCriteria{
+		{Priority: 20, Trigger: ims.TriggerPoint{SPT: []ims.ServicePointTrigger{bob}}},
+		{Priority: 10, Trigger: ims.TriggerPoint{SPT: []ims.ServicePointTrigger{bob, {Header: "Subject", HeaderContent: "(", Group: "1"}}}},
+	})
+
+	if criteria := profile.Criteria(); len(criteria) != 2 || criteria[0].Priority != 10 {
+		t.Fatalf("Criteria() = %+v, want priority order", criteria)
+	}
+	// Each expression is compiled once; an invalid one is kept as nil
+	if len(profile.patterns) != 2 || profile.patterns["^sip:bob@"] == nil || profile.patterns["("] != nil {
+		t.Errorf("patterns = %v", profile.patterns)
+	}
+	if !profile.match("^sip:bob@", "sip:bob@ims.local") || profile.match("(", "(") {
+		t.Error("match() does not use the compiled expressions")
+	}
+}
+
+func TestFilterCriteria(t *testing.T) {
+	terminating, registered := cx.SessionCaseTerminatingRegistered, cx.ProfilePartRegistered
+	sub := &cx.IMSSubscription{
+		PrivateID: "bob@ims.local",
+		ServiceProfiles: []cx.ServiceProfile{{
+			PublicIdentities: []cx.PublicIdentity{{Identity: "sip:bob@ims.local"}},
+			InitialFilterCriteria: []cx.InitialFilterCriteria{{
+				Priority: 5,
+				TriggerPoint: &cx.TriggerPoint{ConditionTypeCNF: true, SPT: []cx.SPT{
+					{Group: []int{0}, Method: "INVITE"},
+					{Group: []int{1, 2}, SessionCase: &terminating},
+					{Group: []int{2}, ConditionNegated: true, SIPHeader: &cx.SIPHeader{Header: "Priority", Content: "emergency"}},
+				}},
+				ApplicationServer:    cx.ApplicationServer{ServerName: "sip:vm.ims.local", DefaultHandling: cx.SessionTerminated},
+				ProfilePartIndicator: &registered,
+			}},
+		}},
+	}
+	data, err := sub.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	criteria, err := FilterCriteria(data, "sip:bob@ims.local")
+	if err != nil || len(criteria) != 1 {
+		t.Fatalf("FilterCriteria() = %+v, %v", criteria, err)
+	}
+	fc := criteria[0]
+	if fc.ApplicationServer.DefaultHandling != DefaultHandlingTerminated || fc.ProfilePartIndicator != "REGISTERED" {
+		t.Errorf("FilterCriteria() = %+v", fc)
+	}
+	want := []ims.ServicePointTrigger{
+		{Group: "0", Method: "INVITE"},
+		{Group: "1,2", SessionCase: ims.SessionCaseTerminatingRegistered},
+		{Group: "2", ConditionNegated: true, Header: "Priority", HeaderContent: "emergency"},
+	}
+	if len(fc.Trigger.SPT) != len(want) {
+		t.Fatalf("SPT = %+v", fc.Trigger.SPT)
+	}
+	for i := range want {
+		if fc.Trigger.SPT[i] != want[i] {
+			t.Errorf("SPT[%d] = %+v, want %+v", i, fc.Trigger.SPT[i], want[i])
+		}
+	}
+}
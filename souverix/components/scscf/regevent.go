@@ -0,0 +1,528 @@
+package scscf
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/hss"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/sirupsen/logrus"
+)
+
+// Subscription durations for the reg event package, in seconds (RFC 3680
+// section 5.2)
+const (
+	defaultRegEventExpires = 3761
+	minRegEventExpires     = 60
+)
+
+// RequestSender delivers requests originated by the S-CSCF, such as NOTIFY
+type RequestSender interface {
+	SendRequest(ctx context.Context, req *sip.Message) error
+}
+
+// regSubscription is a reg event subscription dialog
+type regSubscription struct {
+	callID    string
+	localTag  string
+	remoteTag string
+
+	target     string // IMPU whose registration state is watched
+	impi       string
+	subscriber string // Identity of the watcher (UE or P-CSCF)
+
+	remoteTarget string   // Contact of the SUBSCRIBE
+	routeSet     []string // Record-Route of the SUBSCRIBE
+	from         string   // Our side of the dialog: To of the SUBSCRIBE
+	to           string   // Watcher side: From of the SUBSCRIBE
+
+	expires time.Time
+	cseq    int
+	version int
+}
+
+// regIdentity is a public identity reported in reginfo documents, with
+// the wildcard of a wildcarded identity
+type regIdentity struct {
+	aor      string
+	wildcard string
+}
+
+// dialogID identifies a subscription by Call-ID and watcher tag
+func dialogID(callID, remoteTag string) string {
+	return callID + ";" + remoteTag
+}
+
+// RegEventNotifier serves SUBSCRIBE for the reg event package and sends
+// NOTIFY with reginfo documents on every registration change. Run follows
+// the registration changes of the store, made by any S-CSCF or HSS sharing it.
+type RegEventNotifier struct {
+	serverName string
+	maxExpires int
+	store      store.HSSStore
+	sender     RequestSender
+	log        *logrus.Logger
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu            sync.Mutex
+	subscriptions map[string]*regSubscription  // key: dialogID
+	known         map[string]*ims.Registration // key: IMPI, last state notified
+}
+
+// NewRegEventNotifier creates the reg event notifier of the S-CSCF
+// configured in cfg
+func NewRegEventNotifier(cfg *config.Config, hssStore store.HSSStore, sender RequestSender, log *logrus.Logger) *RegEventNotifier {
+	maxExpires := cfg.IMS.SCSCF.MaxExpires
+	if maxExpires < defaultRegEventExpires {
+		maxExpires = defaultRegEventExpires
+	}
+	return &RegEventNotifier{
+		serverName:    cfg.IMS.SCSCF.ServerName,
+		maxExpires:    maxExpires,
+		store:         hssStore,
+		sender:        sender,
+		log:           log,
+		now:           time.Now,
+		subscriptions: make(map[string]*regSubscription),
+		known:         make(map[string]*ims.Registration),
+	}
+}
+
+// HandleSubscribe processes a SUBSCRIBE for the reg event package. The
+// initial full state NOTIFY is sent before the response is returned.
+func (n *RegEventNotifier) HandleSubscribe(ctx context.Context, msg *sip.Message) *sip.Message {
+	event, _, _ := strings.Cut(msg.GetHeader("Event"), ";")
+	if !strings.EqualFold(strings.TrimSpace(event), "reg") {
+		response := newResponse(msg, sip.StatusBadEvent, "Bad Event")
+		response.SetHeader("Allow-Events", "reg")
+		return response
+	}
+	if accept := msg.GetHeader("Accept"); accept != "" && !strings.Contains(strings.ToLower(accept), ContentTypeRegInfo) {
+		response := newResponse(msg, sip.StatusNotAcceptable, "Not Acceptable")
+		response.SetHeader("Accept", ContentTypeRegInfo)
+		return response
+	}
+
+	expires := defaultRegEventExpires
+	if v := msg.GetHeader("Expires"); v != "" {
+		parsed, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || parsed < 0 {
+			return newResponse(msg, sip.StatusBadRequest, "Bad Request")
+		}
+		expires = parsed
+	}
+	if expires > 0 && expires < minRegEventExpires {
+		response := newResponse(msg, sip.StatusIntervalTooBrief, "Interval Too Brief")
+		response.SetHeader("Min-Expires", strconv.Itoa(minRegEventExpires))
+		return response
+	}
+	if expires > n.maxExpires {
+		expires = n.maxExpires
+	}
+
+	if tagParam(msg.GetHeader("To")) != "" {
+		return n.refresh(ctx, msg, expires)
+	}
+
+	target := extractURI(msg.URI)
+	owners, _, err := hss.LookupIMPU(n.store, target)
+	if errors.Is(err, store.ErrNotFound) {
+		return newResponse(msg, sip.StatusNotFound, "Not Found")
+	}
+	if err != nil {
+		n.log.WithError(err).WithField("impu", target).Error("HSS store lookup failed")
+		return newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+	}
+
+	watcher := extractURI(msg.GetHeader("P-Asserted-Identity"))
+	if watcher == "" {
+		watcher = extractURI(msg.GetHeader("From"))
+	}
+	sub := n.authorizedOwner(watcher, owners)
+	if sub == nil {
+		n.log.WithFields(logrus.Fields{"watcher": watcher, "impu": target}).Warn("reg event subscription rejected")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	remoteTarget := extractURI(msg.GetHeader("Contact"))
+	if remoteTarget == "" {
+		return newResponse(msg, sip.StatusBadRequest, "Bad Request")
+	}
+
+	response := newResponse(msg, sip.StatusOK, "OK")
+	s := &regSubscription{
+		callID:       msg.GetHeader("Call-ID"),
+		localTag:     tagParam(response.GetHeader("To")),
+		remoteTag:    tagParam(msg.GetHeader("From")),
+		target:       target,
+		impi:         sub.IMPI,
+		subscriber:   watcher,
+		remoteTarget: remoteTarget,
+		routeSet:     msg.GetHeaderAll("Record-Route"),
+		from:         response.GetHeader("To"),
+		to:           msg.GetHeader("From"),
+		expires:      n.now().Add(time.Duration(expires) * time.Second),
+	}
+	response.SetHeader("Expires", strconv.Itoa(expires))
+	response.SetHeader("Contact", "<"+n.serverName+">")
+
+	n.log.WithFields(logrus.Fields{
+		"watcher": watcher,
+		"impu":    target,
+		"expires": expires,
+	}).Info("reg event subscription created")
+
+	registrations := n.fullRegistrations(s.impi, s.target)
+	n.mu.Lock()
+	if expires > 0 {
+		n.subscriptions[dialogID(s.callID, s.remoteTag)] = s
+	}
+	notify := n.notify(s, "full", registrations, activeState(expires))
+	n.mu.Unlock()
+
+	n.send(ctx, notify)
+	return response
+}
+
+// refresh handles a SUBSCRIBE within an existing subscription dialog
+func (n *RegEventNotifier) refresh(ctx context.Context, msg *sip.Message, expires int) *sip.Message {
+	id := dialogID(msg.GetHeader("Call-ID"), tagParam(msg.GetHeader("From")))
+
+	n.mu.Lock()
+	s, ok := n.subscriptions[id]
+	if !ok || tagParam(msg.GetHeader("To")) != s.localTag {
+		n.mu.Unlock()
+		return newResponse(msg, sip.StatusCallLegTransactionDoesNotExist, "Call/Transaction Does Not Exist")
+	}
+	s.expires = n.now().Add(time.Duration(expires) * time.Second)
+	if expires == 0 {
+		delete(n.subscriptions, id)
+	}
+	n.mu.Unlock()
+
+	registrations := n.fullRegistrations(s.impi, s.target)
+	n.mu.Lock()
+	notify := n.notify(s, "full", registrations, activeState(expires))
+	n.mu.Unlock()
+
+	n.log.WithFields(logrus.Fields{"impu": s.target, "expires": expires}).Info("reg event subscription refreshed")
+	n.send(ctx, notify)
+
+	response := newResponse(msg, sip.StatusOK, "OK")
+	response.SetHeader("Expires", strconv.Itoa(expires))
+	response.SetHeader("Contact", "<"+n.serverName+">")
+	return response
+}
+
+// authorizedOwner returns the owner of the target identity whose
+// registration state watcher may subscribe to. Of the owners of a shared
+// identity, the watcher's own subscription is preferred.
+func (n *RegEventNotifier) authorizedOwner(watcher string, owners []*ims.Subscriber) *ims.Subscriber {
+	var authorized *ims.Subscriber
+	for _, sub := range owners {
+		if n.ownIdentity(watcher, sub) {
+			return sub
+		}
+		if authorized == nil && n.authorized(watcher, sub) {
+			authorized = sub
+		}
+	}
+	return authorized
+}
+
+// ownIdentity reports whether watcher is a public identity of sub
+func (n *RegEventNotifier) ownIdentity(watcher string, sub *ims.Subscriber) bool {
+	watcherSubs, err := n.store.GetSubscribersByIMPU(watcher)
+	if err != nil {
+		return false
+	}
+	for _, watcherSub := range watcherSubs {
+		if watcherSub.IMPI == sub.IMPI {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized reports whether watcher may subscribe to the registration state
+// of sub: the user itself, another identity of the same user, or a P-CSCF
+// on the registration path (TS 24.229 section 5.4.2.1.1)
+func (n *RegEventNotifier) authorized(watcher string, sub *ims.Subscriber) bool {
+	if watcher == "" {
+		return false
+	}
+	if n.ownIdentity(watcher, sub) {
+		return true
+	}
+	reg, err := n.store.GetRegistration(sub.IMPI)
+	if err != nil {
+		return false
+	}
+	host := uriHost(watcher)
+	for _, path := range reg.Path {
+		if uriHost(extractURI(path)) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistrationChanged sends partial state NOTIFYs for a registration stored
+// (reg) or deleted (reg nil); it is a store.RegistrationListener
+func (n *RegEventNotifier) RegistrationChanged(impi string, reg *ims.Registration) {
+	now := n.now()
+
+	n.mu.Lock()
+	old := n.known[impi]
+	if reg != nil {
+		regCopy := *reg
+		regCopy.Contacts = liveBindings(reg.Contacts, now)
+		n.known[impi] = &regCopy
+	} else {
+		delete(n.known, impi)
+	}
+	n.mu.Unlock()
+
+	// Every identity of the registration set changes with it
+	current := reg
+	if current == nil {
+		current = old
+	}
+	var elements []RegInfoRegistration
+	changed := false
+	if current != nil {
+		for _, id := range n.identities(impi, current) {
+			element, ok := diffRegistration(id.aor, old, reg, reg == nil, now)
+			element.WildcardedIdentity = id.wildcard
+			elements = append(elements, element)
+			changed = changed || ok
+		}
+	}
+
+	var notifies []*sip.Message
+	n.mu.Lock()
+	if changed {
+		for id, s := range n.subscriptions {
+			if s.impi != impi {
+				continue
+			}
+			if elements[0].State == RegStateTerminated {
+				// The last contact is gone: the subscription ends with it
+				// (TS 24.229 section 5.4.1.5)
+				delete(n.subscriptions, id)
+				notifies = append(notifies, n.notify(s, "partial", elements, "terminated;reason=noresource"))
+				continue
+			}
+			notifies = append(notifies, n.notify(s, "partial", elements, n.subscriptionState(s, now)))
+		}
+	}
+	n.mu.Unlock()
+
+	for _, notify := range notifies {
+		n.send(context.Background(), notify)
+	}
+}
+
+// Expire ends subscriptions that were not refreshed in time
+func (n *RegEventNotifier) Expire(ctx context.Context) {
+	now := n.now()
+
+	var expired []*regSubscription
+	n.mu.Lock()
+	for id, s := range n.subscriptions {
+		if now.Before(s.expires) {
+			continue
+		}
+		delete(n.subscriptions, id)
+		expired = append(expired, s)
+	}
+	n.mu.Unlock()
+
+	for _, s := range expired {
+		registrations := n.fullRegistrations(s.impi, s.target)
+		n.mu.Lock()
+		notify := n.notify(s, "full", registrations, "terminated;reason=timeout")
+		n.mu.Unlock()
+		n.send(ctx, notify)
+	}
+}
+
+// Run follows the registration changes of the store and expires
+// subscriptions until ctx is done
+func (n *RegEventNotifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	watching := n.watch(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !watching {
+				watching = n.watch(ctx)
+			}
+			n.Expire(ctx)
+		}
+	}
+}
+
+// watch subscribes to the registration changes of the store until ctx is
+// done and reports whether it succeeded
+func (n *RegEventNotifier) watch(ctx context.Context) bool {
+	if err := n.store.WatchRegistrations(ctx, n.RegistrationChanged); err != nil {
+		n.log.WithError(err).Error("failed to watch registration changes")
+		return false
+	}
+	return true
+}
+
+// Subscriptions returns the number of active subscriptions
+func (n *RegEventNotifier) Subscriptions() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.subscriptions)
+}
+
+// fullRegistrations returns the registration elements of a full state
+// NOTIFY for the registration of impi watched through target. It reads the
+// store, so it is called without n.mu held.
+func (n *RegEventNotifier) fullRegistrations(impi, target string) []RegInfoRegistration {
+	n.mu.Lock()
+	reg := n.known[impi]
+	n.mu.Unlock()
+	if reg == nil {
+		if stored, err := n.store.GetRegistration(impi); err == nil {
+			reg = stored
+			n.mu.Lock()
+			if n.known[impi] == nil {
+				n.known[impi] = stored
+			}
+			n.mu.Unlock()
+		}
+	}
+
+	var registrations []RegInfoRegistration
+	if reg != nil && reg.IMPU != "" {
+		for _, id := range n.identities(impi, reg) {
+			element := fullRegistration(id.aor, reg, n.now())
+			element.WildcardedIdentity = id.wildcard
+			registrations = append(registrations, element)
+		}
+	}
+	if len(registrations) == 0 {
+		registrations = []RegInfoRegistration{fullRegistration(target, reg, n.now())}
+	}
+	return registrations
+}
+
+// identities returns the identities of the registration set of reg that
+// reginfo documents report: its IMPU and the identities registered with it,
+// leaving out barred ones (TS 24.229 section 5.4.2.1.2)
+func (n *RegEventNotifier) identities(impi string, reg *ims.Registration) []regIdentity {
+	sub, err := n.store.GetSubscriber(impi)
+	var ids []regIdentity
+	for _, impu := range append([]string{reg.IMPU}, reg.ImplicitIMPUs...) {
+		var attrs ims.PublicIdentityAttributes
+		if err == nil {
+			attrs = hss.IdentityAttributes(sub, impu)
+		}
+		if !attrs.Barred {
+			ids = append(ids, regIdentity{aor: impu, wildcard: attrs.Wildcard})
+		}
+	}
+	return ids
+}
+
+// activeState returns the Subscription-State after a SUBSCRIBE; expires 0
+// is an unsubscription (RFC 6665 section 4.2.1.4)
+func activeState(expires int) string {
+	if expires == 0 {
+		return "terminated"
+	}
+	return "active;expires=" + strconv.Itoa(expires)
+}
+
+// subscriptionState returns the Subscription-State of an active subscription
+func (n *RegEventNotifier) subscriptionState(s *regSubscription, now time.Time) string {
+	remaining := int(s.expires.Sub(now).Seconds())
+	if remaining < 1 {
+		remaining = 1
+	}
+	return activeState(remaining)
+}
+
+// notify builds the next NOTIFY of subscription s. Called with n.mu held.
+func (n *RegEventNotifier) notify(s *regSubscription, state string, registrations []RegInfoRegistration, subscriptionState string) *sip.Message {
+	info := &RegInfo{Version: s.version, State: state, Registrations: registrations}
+	s.version++
+	s.cseq++
+
+	body, err := info.Marshal()
+	if err != nil {
+		n.log.WithError(err).Error("failed to encode reginfo")
+		return nil
+	}
+
+	msg := &sip.Message{
+		Method:  sip.MethodNOTIFY,
+		URI:     s.remoteTarget,
+		Version: "SIP/2.0",
+		Headers: make(map[string][]string),
+		Body:    string(body),
+	}
+	msg.SetHeader("Via", "SIP/2.0/UDP "+uriHost(n.serverName)+";branch=z9hG4bK"+generateTag()+generateTag())
+	msg.SetHeader("Max-Forwards", "70")
+	for _, route := range s.routeSet {
+		msg.AddHeader("Route", route)
+	}
+	msg.SetHeader("From", s.from)
+	msg.SetHeader("To", s.to)
+	msg.SetHeader("Call-ID", s.callID)
+	msg.SetHeader("CSeq", strconv.Itoa(s.cseq)+" "+sip.MethodNOTIFY)
+	msg.SetHeader("Contact", "<"+n.serverName+">")
+	msg.SetHeader("Event", "reg")
+	msg.SetHeader("Subscription-State", subscriptionState)
+	msg.SetHeader("Content-Type", ContentTypeRegInfo)
+	msg.SetHeader("Content-Length", strconv.Itoa(len(body)))
+	return msg
+}
+
+// send delivers a NOTIFY, logging failures
+func (n *RegEventNotifier) send(ctx context.Context, notify *sip.Message) {
+	if notify == nil || n.sender == nil {
+		return
+	}
+	if err := n.sender.SendRequest(ctx, notify); err != nil {
+		n.log.WithError(err).WithField("target", notify.URI).Warn("failed to send reg event NOTIFY")
+	}
+}
+
+// tagParam returns the tag parameter of a From or To header
+func tagParam(header string) string {
+	_, params := parseContact(header)
+	return params["tag"]
+}
+
+// uriHost returns the host part of a SIP URI
+func uriHost(uri string) string {
+	uri = impiFromIMPU(uri)
+	if at := strings.LastIndex(uri, "@"); at >= 0 {
+		uri = uri[at+1:]
+	}
+	for i, c := range uri {
+		if c == ';' || c == ':' || c == '>' || c == '?' {
+			return uri[:i]
+		}
+	}
+	return uri
+}
@@ -0,0 +1,349 @@
+package scscf
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/sip"
+)
+
+// recordingSender records the requests sent by the notifier
+type recordingSender struct {
+	mu       sync.Mutex
+	requests []*sip.Message
+}
+
+func (s *recordingSender) SendRequest(ctx context.Context, req *sip.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	return nil
+}
+
+// take returns and clears the recorded requests
+func (s *recordingSender) take() []*sip.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+type testNotifier struct {
+	*testRegistrar
+	notifier *RegEventNotifier
+	sender   *recordingSender
+}
+
+// newTestNotifier wires a registrar and a reg event notifier following the
+// registration changes of their store, as in the S-CSCF
+func newTestNotifier(t *testing.T) *testNotifier {
+	t.Helper()
+	tr := newTestRegistrar(t)
+
+	sender := &recordingSender{}
+	notifier := NewRegEventNotifier(tr.conf, tr.store, sender, testLogger())
+	notifier.now = tr.now
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if !notifier.watch(ctx) {
+		t.Fatal("failed to watch registration changes")
+	}
+
+	return &testNotifier{testRegistrar: tr, notifier: notifier, sender: sender}
+}
+
+// subscribe builds a reg event SUBSCRIBE for impu from watcher
+func subscribe(impu, watcher string, expires int, toTag string) *sip.Message {
+	msg := &sip.Message{Method: sip.MethodSUBSCRIBE, URI: impu, Version: "SIP/2.0"}
+	msg.SetHeader("Via", "SIP/2.0/UDP pcscf.ims.local;branch=z9hG4bKsub")
+	msg.SetHeader("From", "<"+watcher+">;tag=watcher")
+	to := "<" + impu + ">"
+	if toTag != "" {
+		to += ";tag=" + toTag
+	}
+	msg.SetHeader("To", to)
+	msg.SetHeader("Call-ID", "sub-"+watcher)
+	msg.SetHeader("CSeq", "1 SUBSCRIBE")
+	msg.SetHeader("Contact", "<sip:watcher@10.0.0.1:5060>")
+	msg.SetHeader("Record-Route", "<sip:pcscf.ims.local;lr>")
+	msg.SetHeader("Event", "reg")
+	msg.SetHeader("Accept", ContentTypeRegInfo)
+	msg.SetHeader("Expires", strconv.Itoa(expires))
+	return msg
+}
+
+// parseNotify checks a NOTIFY and decodes its reginfo body
+func parseNotify(t *testing.T, notify *sip.Message) *RegInfo {
+	t.Helper()
+	if notify.Method != sip.MethodNOTIFY || notify.GetHeader("Event") != "reg" || notify.GetHeader("Content-Type") != ContentTypeRegInfo {
+		t.Fatalf("unexpected request %s", notify)
+	}
+	info, err := ParseRegInfo([]byte(notify.Body))
+	if err != nil {
+		t.Fatalf("ParseRegInfo() error = %v", err)
+	}
+	return info
+}
+
+func TestRegEventNotifier_Lifecycle(t *testing.T) {
+	tn := newTestNotifier(t)
+	ctx := context.Background()
+
+	if resp := tn.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1,
+		"<sip:alice@10.0.0.1:5060>;expires=600", "Path", "<sip:term@pcscf.ims.local;lr>"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER status = %d", resp.StatusCode)
+	}
+	tn.sender.take()
+
+	// The UE subscribes to its own registration state
+	resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:alice@ims.local", 7200, ""))
+	if resp.StatusCode != sip.StatusOK || resp.GetHeader("Expires") != "7200" {
+		t.Fatalf("SUBSCRIBE = %d, Expires %q", resp.StatusCode, resp.GetHeader("Expires"))
+	}
+	toTag := tagParam(resp.GetHeader("To"))
+	notifies := tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs, want 1", len(notifies))
+	}
+	notify := notifies[0]
+	if notify.URI != "sip:watcher@10.0.0.1:5060" || notify.GetHeader("Route") != "<sip:pcscf.ims.local;lr>" ||
+		notify.GetHeader("Subscription-State") != "active;expires=7200" || tagParam(notify.GetHeader("From")) != toTag {
+		t.Errorf("initial NOTIFY = %s", notify)
+	}
+	info := parseNotify(t, notify)
+	if info.State != "full" || info.Version != 0 || len(info.Registrations) != 1 {
+		t.Fatalf("initial reginfo = %+v", info)
+	}
+	if reg := info.Registrations[0]; reg.AOR != "sip:alice@ims.local" || reg.State != RegStateActive ||
+		len(reg.Contacts) != 1 || reg.Contacts[0].URI != "sip:alice@10.0.0.1:5060" || reg.Contacts[0].Expires != 600 {
+		t.Errorf("initial registration = %+v", reg)
+	}
+
+	// A second device registers: partial state with the new contact only
+	tn.clock = tn.clock.Add(10 * time.Second)
+	if resp := tn.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 3, "<sip:alice@10.0.0.2:5060>;expires=600"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("second REGISTER status = %d", resp.StatusCode)
+	}
+	notifies = tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs for the new contact, want 1", len(notifies))
+	}
+	info = parseNotify(t, notifies[0])
+	if info.State != "partial" || info.Version != 1 || len(info.Registrations[0].Contacts) != 1 {
+		t.Fatalf("partial reginfo = %+v", info)
+	}
+	if c := info.Registrations[0].Contacts[0]; c.URI != "sip:alice@10.0.0.2:5060" || c.Event != ContactEventRegistered || c.State != RegStateActive {
+		t.Errorf("new contact = %+v", c)
+	}
+
+	// The first contact expires
+	tn.clock = tn.clock.Add(595 * time.Second)
+	tn.Expire(ctx)
+	notifies = tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs for the expired contact, want 1", len(notifies))
+	}
+	info = parseNotify(t, notifies[0])
+	if c := info.Registrations[0].Contacts; len(c) != 1 || c[0].URI != "sip:alice@10.0.0.1:5060" || c[0].Event != ContactEventExpired || c[0].State != RegStateTerminated {
+		t.Errorf("expired contact = %+v", c)
+	}
+	if info.Registrations[0].State != RegStateActive {
+		t.Errorf("registration state = %q, want active", info.Registrations[0].State)
+	}
+
+	// An administrative deletion deactivates the remaining contact and ends
+	// the subscription
+	if err := tn.store.DeleteRegistration("alice@ims.local"); err != nil {
+		t.Fatalf("DeleteRegistration() error = %v", err)
+	}
+	notifies = tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs for the deletion, want 1", len(notifies))
+	}
+	if state := notifies[0].GetHeader("Subscription-State"); state != "terminated;reason=noresource" {
+		t.Errorf("Subscription-State = %q", state)
+	}
+	info = parseNotify(t, notifies[0])
+	if reg := info.Registrations[0]; reg.State != RegStateTerminated || len(reg.Contacts) != 1 || reg.Contacts[0].Event != ContactEventDeactivated {
+		t.Errorf("deleted registration = %+v", reg)
+	}
+	if tn.notifier.Subscriptions() != 0 {
+		t.Errorf("Subscriptions() = %d after the registration ended", tn.notifier.Subscriptions())
+	}
+}
+
+func TestRegEventNotifier_UserDeregistration(t *testing.T) {
+	tn := newTestNotifier(t)
+	ctx := context.Background()
+
+	tn.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1, "<sip:alice@10.0.0.1:5060>")
+	tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:alice@ims.local", 600, ""))
+	tn.sender.take()
+
+	if resp := tn.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 3, "*", "Expires", "0"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("de-REGISTER status = %d", resp.StatusCode)
+	}
+	notifies := tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs, want 1", len(notifies))
+	}
+	info := parseNotify(t, notifies[0])
+	if c := info.Registrations[0].Contacts; len(c) != 1 || c[0].Event != ContactEventUnregistered {
+		t.Errorf("de-registered contacts = %+v", c)
+	}
+}
+
+func TestRegEventNotifier_Subscriptions(t *testing.T) {
+	tn := newTestNotifier(t)
+	ctx := context.Background()
+
+	tn.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1,
+		"<sip:alice@10.0.0.1:5060>", "Path", "<sip:term@pcscf.ims.local;lr>")
+	tn.sender.take()
+
+	badEvent := subscribe("sip:alice@ims.local", "sip:alice@ims.local", 600, "")
+	badEvent.SetHeader("Event", "presence")
+	if resp := tn.notifier.HandleSubscribe(ctx, badEvent); resp.StatusCode != sip.StatusBadEvent {
+		t.Errorf("presence SUBSCRIBE status = %d, want 489", resp.StatusCode)
+	}
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:nobody@ims.local", "sip:nobody@ims.local", 600, "")); resp.StatusCode != sip.StatusNotFound {
+		t.Errorf("unknown IMPU status = %d, want 404", resp.StatusCode)
+	}
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:bob@ims.local", 600, "")); resp.StatusCode != sip.StatusForbidden {
+		t.Errorf("foreign watcher status = %d, want 403", resp.StatusCode)
+	}
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:alice@ims.local", 30, "")); resp.StatusCode != sip.StatusIntervalTooBrief {
+		t.Errorf("short subscription status = %d, want 423", resp.StatusCode)
+	}
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:alice@ims.local", 600, "unknown")); resp.StatusCode != sip.StatusCallLegTransactionDoesNotExist {
+		t.Errorf("refresh of unknown dialog status = %d, want 481", resp.StatusCode)
+	}
+	if len(tn.sender.take()) != 0 {
+		t.Error("NOTIFY sent for a rejected SUBSCRIBE")
+	}
+
+	// The P-CSCF on the registration path may subscribe
+	resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:pcscf.ims.local", 600, ""))
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("P-CSCF SUBSCRIBE status = %d, want 200", resp.StatusCode)
+	}
+	toTag := tagParam(resp.GetHeader("To"))
+	tn.sender.take()
+
+	// Refresh, then let the subscription expire
+	tn.clock = tn.clock.Add(500 * time.Second)
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:pcscf.ims.local", 600, toTag)); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("refresh status = %d, want 200", resp.StatusCode)
+	}
+	notifies := tn.sender.take()
+	if len(notifies) != 1 || parseNotify(t, notifies[0]).State != "full" || notifies[0].GetHeader("CSeq") != "2 NOTIFY" {
+		t.Fatalf("refresh NOTIFYs = %v", notifies)
+	}
+
+	tn.clock = tn.clock.Add(300 * time.Second)
+	tn.notifier.Expire(ctx)
+	if tn.notifier.Subscriptions() != 1 {
+		t.Fatalf("Subscriptions() = %d before expiry, want 1", tn.notifier.Subscriptions())
+	}
+	tn.clock = tn.clock.Add(301 * time.Second)
+	tn.notifier.Expire(ctx)
+	notifies = tn.sender.take()
+	if len(notifies) != 1 || notifies[0].GetHeader("Subscription-State") != "terminated;reason=timeout" {
+		t.Fatalf("expiry NOTIFYs = %v", notifies)
+	}
+	if tn.notifier.Subscriptions() != 0 {
+		t.Errorf("Subscriptions() = %d after expiry", tn.notifier.Subscriptions())
+	}
+
+	// Unsubscribe
+	resp = tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:alice@ims.local", 600, ""))
+	toTag = tagParam(resp.GetHeader("To"))
+	tn.sender.take()
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("sip:alice@ims.local", "sip:alice@ims.local", 0, toTag)); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("unsubscribe status = %d, want 200", resp.StatusCode)
+	}
+	notifies = tn.sender.take()
+	if len(notifies) != 1 || !strings.HasPrefix(notifies[0].GetHeader("Subscription-State"), "terminated") || tn.notifier.Subscriptions() != 0 {
+		t.Errorf("unsubscribe NOTIFYs = %v, subscriptions %d", notifies, tn.notifier.Subscriptions())
+	}
+}
+
+func TestRegEventNotifier_RegistrationSet(t *testing.T) {
+	tn := newTestNotifier(t)
+	addIdentitySubscribers(t, tn.store)
+	ctx := context.Background()
+
+	if resp := tn.authenticate(t, "dave@ims.local", "sip:dave@ims.local", "secret", 1, "<sip:dave@10.0.0.5>;expires=600"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER status = %d", resp.StatusCode)
+	}
+	tn.sender.take()
+
+	// Subscribing to an implicitly registered identity reports the whole
+	// set, except the barred identity
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("tel:+15145550010", "sip:dave@ims.local", 600, "")); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("SUBSCRIBE status = %d", resp.StatusCode)
+	}
+	notifies := tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs, want 1", len(notifies))
+	}
+	info := parseNotify(t, notifies[0])
+	var aors []string
+	for _, reg := range info.Registrations {
+		aors = append(aors, reg.AOR)
+		if reg.State != RegStateActive || len(reg.Contacts) != 1 {
+			t.Errorf("registration %s = %+v", reg.AOR, reg)
+		}
+		wantWildcard := ""
+		if reg.AOR == "sip:dave-!.*!@ims.local" {
+			wantWildcard = "sip:dave-!.*!@ims.local"
+		}
+		if reg.WildcardedIdentity != wantWildcard {
+			t.Errorf("registration %s wildcardedIdentity = %q, want %q", reg.AOR, reg.WildcardedIdentity, wantWildcard)
+		}
+	}
+	want := "sip:dave@ims.local tel:+15145550010 sip:dave-!.*!@ims.local tel:+15145550020"
+	if got := strings.Join(aors, " "); got != want {
+		t.Errorf("full NOTIFY AORs = %q, want %q", got, want)
+	}
+	if !strings.Contains(notifies[0].Body, `xmlns="urn:3gpp:ns:extRegExp:1.0"`) {
+		t.Errorf("wildcardedIdentity outside its namespace: %s", notifies[0].Body)
+	}
+
+	// A change of the contacts updates every identity of the set
+	tn.clock = tn.clock.Add(10 * time.Second)
+	if resp := tn.authenticate(t, "dave@ims.local", "sip:dave@ims.local", "secret", 3, "<sip:dave@10.0.0.7>;expires=600"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("second REGISTER status = %d", resp.StatusCode)
+	}
+	notifies = tn.sender.take()
+	if len(notifies) != 1 {
+		t.Fatalf("sent %d NOTIFYs for the new contact, want 1", len(notifies))
+	}
+	info = parseNotify(t, notifies[0])
+	if info.State != "partial" || len(info.Registrations) != 4 {
+		t.Fatalf("partial reginfo = %+v", info)
+	}
+	for _, reg := range info.Registrations {
+		if len(reg.Contacts) != 1 || reg.Contacts[0].URI != "sip:dave@10.0.0.7" {
+			t.Errorf("partial registration %s = %+v", reg.AOR, reg)
+		}
+	}
+
+	// A user sharing an identity subscribes to its own registration
+	if resp := tn.authenticate(t, "erin@ims.local", "sip:erin@ims.local", "secret", 1, "<sip:erin@10.0.0.6>;expires=600"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER of erin status = %d", resp.StatusCode)
+	}
+	tn.sender.take()
+	if resp := tn.notifier.HandleSubscribe(ctx, subscribe("tel:+15145550020", "sip:erin@ims.local", 600, "")); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("SUBSCRIBE to a shared identity status = %d", resp.StatusCode)
+	}
+	info = parseNotify(t, tn.sender.take()[0])
+	if len(info.Registrations) != 2 || info.Registrations[0].AOR != "sip:erin@ims.local" || info.Registrations[0].Contacts[0].URI != "sip:erin@10.0.0.6" {
+		t.Errorf("shared identity reginfo = %+v", info)
+	}
+}
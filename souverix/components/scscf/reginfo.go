@@ -0,0 +1,171 @@
+package scscf
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+// ContentTypeRegInfo is the MIME type of registration information documents
+const ContentTypeRegInfo = "application/reginfo+xml"
+
+// Registration and contact states and events (RFC 3680 section 5.3)
+const (
+	RegStateInit       = "init"
+	RegStateActive     = "active"
+	RegStateTerminated = "terminated"
+
+	ContactEventRegistered   = "registered"
+	ContactEventCreated      = "created"
+	ContactEventRefreshed    = "refreshed"
+	ContactEventShortened    = "shortened"
+	ContactEventExpired      = "expired"
+	ContactEventDeactivated  = "deactivated"
+	ContactEventProbation    = "probation"
+	ContactEventUnregistered = "unregistered"
+	ContactEventRejected     = "rejected"
+)
+
+// RegInfo is a registration information document (RFC 3680 section 5.3)
+type RegInfo struct {
+	XMLName       xml.Name              `xml:"urn:ietf:params:xml:ns:reginfo reginfo"`
+	Version       int                   `xml:"version,attr"`
+	State         string                `xml:"state,attr"` // "full" or "partial"
+	Registrations []RegInfoRegistration `xml:"registration"`
+}
+
+// RegInfoRegistration is the registration state of one address of record.
+// The AOR of a wildcarded identity also carries its wildcard (TS 24.229
+// section 7.10.3).
+type RegInfoRegistration struct {
+	AOR                string           `xml:"aor,attr"`
+	ID                 string           `xml:"id,attr"`
+	State              string           `xml:"state,attr"`
+	Contacts           []RegInfoContact `xml:"contact"`
+	WildcardedIdentity string           `xml:"urn:3gpp:ns:extRegExp:1.0 wildcardedIdentity,omitempty"`
+}
+
+// RegInfoContact is the state of one registered contact
+type RegInfoContact struct {
+	ID      string `xml:"id,attr"`
+	State   string `xml:"state,attr"`
+	Event   string `xml:"event,attr"`
+	Expires int    `xml:"expires,attr,omitempty"`
+	CallID  string `xml:"callid,attr,omitempty"`
+	CSeq    int    `xml:"cseq,attr,omitempty"`
+	URI     string `xml:"uri"`
+}
+
+// Marshal encodes the document with an XML declaration
+func (r *RegInfo) Marshal() ([]byte, error) {
+	data, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// ParseRegInfo decodes a registration information document
+func ParseRegInfo(data []byte) (*RegInfo, error) {
+	var info RegInfo
+	if err := xml.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid reginfo document: %w", err)
+	}
+	return &info, nil
+}
+
+// fullRegistration describes every live contact of reg for a full state
+// document. A nil reg yields an address of record without contacts.
+func fullRegistration(aor string, reg *ims.Registration, now time.Time) RegInfoRegistration {
+	element := RegInfoRegistration{AOR: aor, ID: stateID(aor), State: RegStateInit}
+	if reg == nil {
+		return element
+	}
+	for _, b := range liveBindings(reg.Contacts, now) {
+		element.Contacts = append(element.Contacts, contactElement(b, RegStateActive, ContactEventRegistered, now))
+	}
+	if len(element.Contacts) > 0 {
+		element.State = RegStateActive
+	}
+	return element
+}
+
+// diffRegistration describes the contacts that changed between old and
+// reg for a partial state document. deleted marks a registration removed
+// from the store rather than updated by the UE.
+func diffRegistration(aor string, old, reg *ims.Registration, deleted bool, now time.Time) (RegInfoRegistration, bool) {
+	var oldContacts, newContacts []ims.ContactBinding
+	if old != nil {
+		oldContacts = old.Contacts
+	}
+	if reg != nil {
+		newContacts = liveBindings(reg.Contacts, now)
+	}
+
+	element := RegInfoRegistration{AOR: aor, ID: stateID(aor), State: RegStateTerminated}
+	if len(newContacts) > 0 {
+		element.State = RegStateActive
+	}
+
+	for _, b := range newContacts {
+		prev, found := findBinding(oldContacts, b.URI)
+		switch {
+		case !found:
+			element.Contacts = append(element.Contacts, contactElement(b, RegStateActive, ContactEventRegistered, now))
+		case b.Expires.After(prev.Expires):
+			element.Contacts = append(element.Contacts, contactElement(b, RegStateActive, ContactEventRefreshed, now))
+		case b.Expires.Before(prev.Expires):
+			element.Contacts = append(element.Contacts, contactElement(b, RegStateActive, ContactEventShortened, now))
+		}
+	}
+	for _, b := range oldContacts {
+		if _, found := findBinding(newContacts, b.URI); found {
+			continue
+		}
+		event := ContactEventUnregistered
+		switch {
+		case !b.Expires.After(now):
+			event = ContactEventExpired
+		case deleted:
+			event = ContactEventDeactivated
+		}
+		element.Contacts = append(element.Contacts, contactElement(b, RegStateTerminated, event, now))
+	}
+	return element, len(element.Contacts) > 0
+}
+
+// contactElement describes binding b
+func contactElement(b ims.ContactBinding, state, event string, now time.Time) RegInfoContact {
+	contact := RegInfoContact{
+		ID:     stateID(b.URI),
+		State:  state,
+		Event:  event,
+		CallID: b.CallID,
+		CSeq:   b.CSeq,
+		URI:    b.URI,
+	}
+	if state == RegStateActive {
+		contact.Expires = int(b.Expires.Sub(now).Seconds())
+	}
+	return contact
+}
+
+// findBinding returns the binding of bindings with the given URI
+func findBinding(bindings []ims.ContactBinding, uri string) (ims.ContactBinding, bool) {
+	for _, b := range bindings {
+		if b.URI == uri {
+			return b, true
+		}
+	}
+	return ims.ContactBinding{}, false
+}
+
+// stateID derives a stable element id from a URI
+func stateID(uri string) string {
+	h := fnv.New32a()
+	h.Write([]byte(uri))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
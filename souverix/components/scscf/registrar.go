@@ -0,0 +1,807 @@
+// Package scscf implements the Serving-CSCF registrar (3GPP TS 24.229
+// section 5.4.1)
+package scscf
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dasmlab/ims/internal/ai"
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/hss"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/sirupsen/logrus"
+)
+
+// expiryInterval is how often expired bindings and challenges are purged
+const expiryInterval = 5 * time.Second
+
+// HSS is the Cx client used by the registrar, normally a *cx.Client
+type HSS interface {
+	MultimediaAuth(ctx context.Context, req *cx.MAR) (*cx.MAA, error)
+	ServerAssignment(ctx context.Context, req *cx.SAR) (*cx.SAA, error)
+}
+
+// Registrar authenticates REGISTER requests with SIP Digest or IMS AKA and
+// maintains the contact bindings of registered public identities
+type Registrar struct {
+	cfg   config.SCSCFConfig
+	hss   HSS
+	store store.HSSStore
+	hooks *ai.HookManager
+	log   *logrus.Logger
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu         sync.Mutex
+	challenges map[string]*challenge // key: nonce
+	served     map[string]bool       // IMPIs with bindings on this S-CSCF
+}
+
+// NewRegistrar creates the registrar of the S-CSCF configured in cfg. hooks
+// may be nil.
+func NewRegistrar(cfg *config.Config, hss HSS, hssStore store.HSSStore, hooks *ai.HookManager, log *logrus.Logger) *Registrar {
+	scscfCfg := cfg.IMS.SCSCF
+	if scscfCfg.Realm == "" {
+		scscfCfg.Realm = cfg.IMS.Domain
+	}
+	if scscfCfg.NonceTTL <= 0 {
+		scscfCfg.NonceTTL = 30 * time.Second
+	}
+	if scscfCfg.MaxExpires <= 0 {
+		scscfCfg.MaxExpires = 600000
+	}
+	if scscfCfg.DefaultExpires <= 0 || scscfCfg.DefaultExpires > scscfCfg.MaxExpires {
+		scscfCfg.DefaultExpires = scscfCfg.MaxExpires
+	}
+
+	return &Registrar{
+		cfg:        scscfCfg,
+		hss:        hss,
+		store:      hssStore,
+		hooks:      hooks,
+		log:        log,
+		now:        time.Now,
+		challenges: make(map[string]*challenge),
+		served:     make(map[string]bool),
+	}
+}
+
+// HandleRegister processes a REGISTER forwarded by the I-CSCF and returns
+// the final response
+func (r *Registrar) HandleRegister(ctx context.Context, msg *sip.Message) *sip.Message {
+	impu := extractURI(msg.GetHeader("To"))
+	if impu == "" {
+		return newResponse(msg, sip.StatusBadRequest, "Bad Request")
+	}
+
+	var creds *credentials
+	impi := impiFromIMPU(impu)
+	if header := msg.GetHeader("Authorization"); header != "" {
+		var err error
+		if creds, err = parseCredentials(header); err != nil {
+			r.log.WithError(err).WithField("impu", impu).Warn("invalid REGISTER credentials")
+			return newResponse(msg, sip.StatusBadRequest, "Bad Request")
+		}
+		impi = creds.username
+	}
+
+	// An empty response only carries the private identity (TS 24.229
+	// section 5.1.1.2)
+	if creds == nil || creds.response == "" && creds.auts == "" {
+		return r.challenge(ctx, msg, impi, impu, nil, false)
+	}
+
+	r.mu.Lock()
+	ch, ok := r.challenges[creds.nonce]
+	if ok && r.now().After(ch.expires) {
+		delete(r.challenges, creds.nonce)
+		ok = false
+		r.mu.Unlock()
+		return r.challenge(ctx, msg, impi, impu, nil, true)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return r.challenge(ctx, msg, impi, impu, nil, false)
+	}
+	if ch.impi != impi || ch.impu != impu {
+		r.log.WithFields(logrus.Fields{"impi": impi, "impu": impu}).Warn("REGISTER credentials do not match the challenge")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	if creds.auts != "" {
+		return r.resynchronise(ctx, msg, ch, creds)
+	}
+
+	r.mu.Lock()
+	err := ch.verify(creds, msg.Method)
+	if ch.isAKA() {
+		// An AKA vector authenticates a single REGISTER
+		delete(r.challenges, ch.nonce)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		r.log.WithError(err).WithFields(logrus.Fields{"impi": impi, "impu": impu}).Warn("REGISTER authentication failed")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	return r.register(ctx, msg, impi, impu)
+}
+
+// challenge requests an authentication vector from the HSS and answers 401
+// Unauthorized. resync carries RAND || AUTS after a synchronisation failure.
+func (r *Registrar) challenge(ctx context.Context, msg *sip.Message, impi, impu string, resync []byte, stale bool) *sip.Message {
+	scheme := cx.SchemeUnknown
+	if resync != nil {
+		scheme = cx.SchemeAKAv1MD5
+	}
+	maa, err := r.hss.MultimediaAuth(ctx, &cx.MAR{
+		UserName:        impi,
+		PublicIdentity:  impu,
+		ServerName:      r.cfg.ServerName,
+		NumberAuthItems: 1,
+		AuthScheme:      scheme,
+		Authorization:   resync,
+	})
+	if err != nil {
+		r.log.WithError(err).WithField("impi", impi).Error("MAR failed")
+		return newResponse(msg, sip.StatusServerTimeout, "Server Time-out")
+	}
+	if err := maa.Result.Err(); err != nil || len(maa.AuthItems) == 0 {
+		r.log.WithError(err).WithField("impi", impi).Warn("HSS rejected authentication")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	ch, err := r.newChallenge(&maa.AuthItems[0], impi, impu, msg)
+	if err != nil {
+		r.log.WithError(err).WithField("impi", impi).Error("failed to build challenge")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	r.mu.Lock()
+	r.challenges[ch.nonce] = ch
+	r.mu.Unlock()
+
+	r.log.WithFields(logrus.Fields{
+		"impi":      impi,
+		"impu":      impu,
+		"algorithm": ch.algorithm,
+	}).Info("REGISTER challenged")
+
+	response := newResponse(msg, sip.StatusUnauthorized, "Unauthorized")
+	response.SetHeader("WWW-Authenticate", ch.header(stale))
+	return response
+}
+
+// newChallenge builds a challenge from the authentication item of a MAA
+func (r *Registrar) newChallenge(item *cx.AuthItem, impi, impu string, msg *sip.Message) (*challenge, error) {
+	ch := &challenge{
+		impi:    impi,
+		impu:    impu,
+		realm:   r.cfg.Realm,
+		expires: r.now().Add(r.cfg.NonceTTL),
+	}
+
+	switch item.Scheme {
+	case cx.SchemeSIPDigest:
+		if item.Digest == nil || item.Digest.HA1 == "" {
+			return nil, fmt.Errorf("digest authentication item without HA1")
+		}
+		nonce, err := newNonce()
+		if err != nil {
+			return nil, err
+		}
+		ch.nonce = nonce
+		ch.ha1 = item.Digest.HA1
+		ch.algorithm = AlgorithmMD5
+		if strings.EqualFold(item.Digest.Algorithm, AlgorithmSHA256) {
+			ch.algorithm = AlgorithmSHA256
+		}
+		if item.Digest.Realm != "" {
+			ch.realm = item.Digest.Realm
+		}
+	case cx.SchemeAKAv1MD5:
+		if len(item.Authenticate) != 32 || len(item.Authorization) == 0 {
+			return nil, fmt.Errorf("invalid AKA authentication item")
+		}
+		// The nonce is base64(RAND || AUTN) (RFC 3310 section 3.2)
+		ch.nonce = base64.StdEncoding.EncodeToString(item.Authenticate)
+		ch.rand = item.Authenticate[:16]
+		ch.xres = item.Authorization
+		ch.ck = item.ConfidentialityKey
+		ch.ik = item.IntegrityKey
+		ch.algorithm = AlgorithmAKAv1
+		if requestsAKAv2(msg) {
+			ch.algorithm = AlgorithmAKAv2
+		}
+	default:
+		return nil, fmt.Errorf("unsupported authentication scheme %q", item.Scheme)
+	}
+	return ch, nil
+}
+
+// resynchronise handles an AKA synchronisation failure: the HSS checks AUTS,
+// resets SQN and returns a fresh vector (TS 33.203 section 6.3.3)
+func (r *Registrar) resynchronise(ctx context.Context, msg *sip.Message, ch *challenge, creds *credentials) *sip.Message {
+	r.mu.Lock()
+	delete(r.challenges, ch.nonce)
+	r.mu.Unlock()
+
+	auts, err := base64.StdEncoding.DecodeString(creds.auts)
+	if !ch.isAKA() || err != nil {
+		r.log.WithField("impi", ch.impi).Warn("invalid AKA resynchronisation request")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+	resync := append(append([]byte(nil), ch.rand...), auts...)
+	return r.challenge(ctx, msg, ch.impi, ch.impu, resync, false)
+}
+
+// register updates the bindings of an authenticated REGISTER, informs the
+// HSS and answers 200 OK (RFC 3261 section 10.3)
+func (r *Registrar) register(ctx context.Context, msg *sip.Message, impi, impu string) *sip.Message {
+	now := r.now()
+
+	// A barred identity cannot be registered explicitly, only as part of
+	// an implicit registration set (TS 24.229 section 5.4.1.2.1)
+	sub, err := r.store.GetSubscriber(impi)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		r.log.WithError(err).WithField("impi", impi).Error("failed to load subscriber")
+	}
+	if sub != nil && hss.IdentityAttributes(sub, impu).Barred {
+		r.log.WithFields(logrus.Fields{"impi": impi, "impu": impu}).Warn("REGISTER of a barred public identity")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	reg, err := r.store.GetRegistration(impi)
+	if errors.Is(err, store.ErrNotFound) || err == nil && !registers(reg, impu) {
+		reg = &ims.Registration{IMPI: impi, IMPU: impu, State: ims.RegistrationStateInit}
+	} else if err != nil {
+		r.log.WithError(err).WithField("impi", impi).Error("failed to load registration")
+		return newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+	}
+	if sub != nil {
+		reg.ImplicitIMPUs = hss.ImplicitRegistrationSet(sub, reg.IMPU)[1:]
+	}
+	wasRegistered := reg.State == ims.RegistrationStateRegistered && len(liveBindings(reg.Contacts, now)) > 0
+
+	// A REGISTER without Contact only queries the bindings
+	if len(msg.GetHeaderAll("Contact")) == 0 {
+		if !wasRegistered {
+			return r.okResponse(msg, nil, nil)
+		}
+		reg.Contacts = liveBindings(reg.Contacts, now)
+		return r.okResponse(msg, reg, nil)
+	}
+
+	bindings, response := r.updateBindings(msg, reg, now)
+	if response != nil {
+		return response
+	}
+
+	if len(bindings) == 0 {
+		if wasRegistered {
+			r.deregister(ctx, reg, cx.AssignmentUserDeregistration)
+		}
+		return r.okResponse(msg, nil, nil)
+	}
+
+	assignment := cx.AssignmentRegistration
+	if wasRegistered {
+		assignment = cx.AssignmentReRegistration
+	}
+	saa, err := r.hss.ServerAssignment(ctx, &cx.SAR{
+		UserName:         impi,
+		PublicIdentities: []string{impu},
+		ServerName:       r.cfg.ServerName,
+		AssignmentType:   assignment,
+	})
+	if err != nil {
+		r.log.WithError(err).WithField("impi", impi).Error("SAR failed")
+		return newResponse(msg, sip.StatusServerTimeout, "Server Time-out")
+	}
+	if err := saa.Result.Err(); err != nil {
+		r.log.WithError(err).WithField("impi", impi).Warn("HSS rejected server assignment")
+		return newResponse(msg, sip.StatusForbidden, "Forbidden")
+	}
+
+	reg.Contacts = bindings
+	reg.Contact = bindings[0].URI
+	reg.Expires = int(maxExpiry(bindings).Sub(now).Seconds())
+	reg.Path = msg.GetHeaderAll("Path")
+	reg.SCSCFName = r.cfg.ServerName
+	reg.State = ims.RegistrationStateRegistered
+	reg.ServiceRoute = []string{r.serviceRoute()}
+	if err := r.store.UpsertRegistration(reg); err != nil {
+		r.log.WithError(err).WithField("impi", impi).Error("failed to store registration")
+		return newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+	}
+
+	r.mu.Lock()
+	r.served[impi] = true
+	r.mu.Unlock()
+
+	if !wasRegistered {
+		r.log.WithFields(logrus.Fields{
+			"impi":     impi,
+			"impu":     impu,
+			"contacts": len(bindings),
+		}).Info("subscriber registered")
+		r.notify(impi, impu)
+	}
+	return r.okResponse(msg, reg, associatedURIs(saa.UserData, append([]string{reg.IMPU}, reg.ImplicitIMPUs...)))
+}
+
+// registers reports whether reg registers impu, explicitly or implicitly
+func registers(reg *ims.Registration, impu string) bool {
+	if reg.IMPU == impu {
+		return true
+	}
+	for _, implicit := range reg.ImplicitIMPUs {
+		if implicit == impu {
+			return true
+		}
+	}
+	return false
+}
+
+// updateBindings applies the Contact and Expires headers of msg to the
+// bindings of reg. A non-nil response rejects the REGISTER.
+func (r *Registrar) updateBindings(msg *sip.Message, reg *ims.Registration, now time.Time) ([]ims.ContactBinding, *sip.Message) {
+	callID := msg.GetHeader("Call-ID")
+	cseq := parseCSeq(msg.GetHeader("CSeq"))
+	headerExpires := -1
+	if v := msg.GetHeader("Expires"); v != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n >= 0 {
+			headerExpires = n
+		}
+	}
+
+	bindings := liveBindings(reg.Contacts, now)
+	contacts := splitList(strings.Join(msg.GetHeaderAll("Contact"), ","))
+
+	// Contact: * with Expires: 0 removes every binding
+	if len(contacts) == 1 && strings.TrimSpace(contacts[0]) == "*" {
+		if headerExpires != 0 {
+			return nil, newResponse(msg, sip.StatusBadRequest, "Bad Request")
+		}
+		return nil, nil
+	}
+
+	for _, contact := range contacts {
+		uri, params := parseContact(contact)
+		if uri == "" {
+			return nil, newResponse(msg, sip.StatusBadRequest, "Bad Request")
+		}
+
+		expires := r.cfg.DefaultExpires
+		if headerExpires >= 0 {
+			expires = headerExpires
+		}
+		if v, ok := params["expires"]; ok {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				expires = n
+			}
+		}
+		if expires > 0 && expires < r.cfg.MinExpires {
+			response := newResponse(msg, sip.StatusIntervalTooBrief, "Interval Too Brief")
+			response.SetHeader("Min-Expires", strconv.Itoa(r.cfg.MinExpires))
+			return nil, response
+		}
+		if expires > r.cfg.MaxExpires {
+			expires = r.cfg.MaxExpires
+		}
+
+		instance := params["+sip.instance"]
+		idx := -1
+		for i, b := range bindings {
+			if b.URI == uri || instance != "" && b.InstanceID == instance {
+				idx = i
+				break
+			}
+		}
+		if idx >= 0 && bindings[idx].CallID == callID && cseq <= bindings[idx].CSeq {
+			// Out of order REGISTER (RFC 3261 section 10.3 step 7)
+			return nil, newResponse(msg, sip.StatusInternalServerError, "Server Internal Error")
+		}
+
+		if expires == 0 {
+			if idx >= 0 {
+				bindings = append(bindings[:idx], bindings[idx+1:]...)
+			}
+			continue
+		}
+		binding := ims.ContactBinding{
+			URI:        uri,
+			Expires:    now.Add(time.Duration(expires) * time.Second),
+			CallID:     callID,
+			CSeq:       cseq,
+			Path:       msg.GetHeaderAll("Path"),
+			InstanceID: instance,
+		}
+		if idx >= 0 {
+			bindings[idx] = binding
+		} else {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings, nil
+}
+
+// deregister removes a registration and informs the HSS
+func (r *Registrar) deregister(ctx context.Context, reg *ims.Registration, assignment uint32) {
+	// Store the emptied registration first so that watchers see the
+	// contacts go away before the registration is deleted
+	reg.Contacts = nil
+	reg.Contact = ""
+	reg.Expires = 0
+	reg.State = ims.RegistrationStateUnregistered
+	if err := r.store.UpsertRegistration(reg); err != nil {
+		r.log.WithError(err).WithField("impi", reg.IMPI).Error("failed to store registration")
+	}
+
+	if _, err := r.hss.ServerAssignment(ctx, &cx.SAR{
+		UserName:         reg.IMPI,
+		PublicIdentities: []string{reg.IMPU},
+		ServerName:       r.cfg.ServerName,
+		AssignmentType:   assignment,
+	}); err != nil {
+		r.log.WithError(err).WithField("impi", reg.IMPI).Error("de-registration SAR failed")
+	}
+	if err := r.store.DeleteRegistration(reg.IMPI); err != nil && !errors.Is(err, store.ErrNotFound) {
+		r.log.WithError(err).WithField("impi", reg.IMPI).Error("failed to delete registration")
+	}
+
+	r.mu.Lock()
+	delete(r.served, reg.IMPI)
+	r.mu.Unlock()
+
+	r.log.WithFields(logrus.Fields{
+		"impi":       reg.IMPI,
+		"impu":       reg.IMPU,
+		"assignment": assignment,
+	}).Info("subscriber de-registered")
+	r.notify(reg.IMPI, reg.IMPU)
+}
+
+// Run restores the registrations served by this S-CSCF from the store, then
+// purges expired bindings and challenges until ctx is done
+func (r *Registrar) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	restored := r.Restore() == nil
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !restored {
+				restored = r.Restore() == nil
+			}
+			r.Expire(ctx)
+		}
+	}
+}
+
+// Restore marks the registrations the store holds for this S-CSCF as
+// served, so that bindings stored before a restart still expire
+func (r *Registrar) Restore() error {
+	regs, err := r.store.ListRegistrations(r.cfg.ServerName)
+	if err != nil {
+		r.log.WithError(err).Error("failed to restore registrations")
+		return err
+	}
+
+	r.mu.Lock()
+	for _, reg := range regs {
+		r.served[reg.IMPI] = true
+	}
+	r.mu.Unlock()
+
+	r.log.WithField("registrations", len(regs)).Info("registrations restored")
+	return nil
+}
+
+// Expire drops expired challenges and bindings. Registrations left without
+// contacts are de-registered with the HSS (TIMEOUT_DEREGISTRATION).
+func (r *Registrar) Expire(ctx context.Context) {
+	now := r.now()
+
+	r.mu.Lock()
+	for nonce, ch := range r.challenges {
+		if now.After(ch.expires) {
+			delete(r.challenges, nonce)
+		}
+	}
+	impis := make([]string, 0, len(r.served))
+	for impi := range r.served {
+		impis = append(impis, impi)
+	}
+	r.mu.Unlock()
+
+	for _, impi := range impis {
+		reg, err := r.store.GetRegistration(impi)
+		if errors.Is(err, store.ErrNotFound) {
+			r.mu.Lock()
+			delete(r.served, impi)
+			r.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			r.log.WithError(err).WithField("impi", impi).Error("failed to load registration")
+			continue
+		}
+
+		live := liveBindings(reg.Contacts, now)
+		switch {
+		case len(live) == 0:
+			r.deregister(ctx, reg, cx.AssignmentTimeoutDeregistration)
+		case len(live) < len(reg.Contacts):
+			reg.Contacts = live
+			reg.Contact = live[0].URI
+			reg.Expires = int(maxExpiry(live).Sub(now).Seconds())
+			if err := r.store.UpsertRegistration(reg); err != nil {
+				r.log.WithError(err).WithField("impi", impi).Error("failed to store registration")
+			}
+		}
+	}
+}
+
+// Bindings returns the live contact bindings of a public identity. The
+// bindings of every subscriber sharing the identity are returned, and an
+// identity matching a wildcarded identity reaches the contacts of that
+// identity.
+func (r *Registrar) Bindings(impu string) []ims.ContactBinding {
+	owners, identity, err := hss.LookupIMPU(r.store, impu)
+	if err != nil {
+		return nil
+	}
+	var bindings []ims.ContactBinding
+	for _, sub := range owners {
+		reg, err := r.store.GetRegistration(sub.IMPI)
+		if err != nil || !registers(reg, identity) {
+			continue
+		}
+		bindings = append(bindings, liveBindings(reg.Contacts, r.now())...)
+	}
+	return bindings
+}
+
+// notify informs the AI agent hooks of a registration state change
+func (r *Registrar) notify(impi, impu string) {
+	if r.hooks != nil {
+		r.hooks.NotifyRegistration(impi, impu)
+	}
+}
+
+// serviceRoute returns the Service-Route of this S-CSCF; the orig parameter
+// marks originating requests from the UE (TS 24.229 section 5.4.1.2.2)
+func (r *Registrar) serviceRoute() string {
+	return "<" + r.cfg.ServerName + ";lr;orig>"
+}
+
+// okResponse builds the 200 OK listing every current binding
+func (r *Registrar) okResponse(msg *sip.Message, reg *ims.Registration, associated []string) *sip.Message {
+	response := newResponse(msg, sip.StatusOK, "OK")
+	response.SetHeader("Date", r.now().UTC().Format(time.RFC1123))
+	if reg == nil {
+		return response
+	}
+
+	now := r.now()
+	for _, b := range reg.Contacts {
+		expires := int(b.Expires.Sub(now).Seconds())
+		response.AddHeader("Contact", fmt.Sprintf("<%s>;expires=%d", b.URI, expires))
+	}
+	for _, path := range reg.Path {
+		response.AddHeader("Path", path)
+	}
+	for _, route := range reg.ServiceRoute {
+		response.AddHeader("Service-Route", route)
+	}
+	if len(associated) > 0 {
+		uris := make([]string, 0, len(associated))
+		for _, uri := range associated {
+			uris = append(uris, "<"+uri+">")
+		}
+		response.SetHeader("P-Associated-URI", strings.Join(uris, ", "))
+	}
+	return response
+}
+
+// associatedURIs returns the non-barred public identities of the user data
+// downloaded in SAA for the P-Associated-URI header: the registered identity
+// first, then the rest of its registration set, then the other identities
+// of the user. Wildcarded identities cannot be used as a URI and are left
+// out (TS 24.229 section 5.4.1.2.2).
+func associatedURIs(userData []byte, registered []string) []string {
+	uris := []string{registered[0]}
+	if len(userData) == 0 {
+		return uris
+	}
+	sub, err := cx.ParseIMSSubscription(userData)
+	if err != nil {
+		return uris
+	}
+
+	usable := make(map[string]bool)
+	var others []string
+	for _, profile := range sub.ServiceProfiles {
+		for _, identity := range profile.PublicIdentities {
+			t := identity.Type()
+			if identity.BarringIndication || t == cx.IdentityTypeWildcardedPSI || t == cx.IdentityTypeWildcardedIMPU {
+				continue
+			}
+			usable[identity.Identity] = true
+			others = append(others, identity.Identity)
+		}
+	}
+
+	seen := map[string]bool{registered[0]: true}
+	for _, identity := range append(registered[1:], others...) {
+		if usable[identity] && !seen[identity] {
+			seen[identity] = true
+			uris = append(uris, identity)
+		}
+	}
+	return uris
+}
+
+// liveBindings returns the bindings that have not expired at now
+func liveBindings(bindings []ims.ContactBinding, now time.Time) []ims.ContactBinding {
+	live := make([]ims.ContactBinding, 0, len(bindings))
+	for _, b := range bindings {
+		if b.Expires.After(now) {
+			live = append(live, b)
+		}
+	}
+	return live
+}
+
+// maxExpiry returns the latest expiry of bindings
+func maxExpiry(bindings []ims.ContactBinding) time.Time {
+	var latest time.Time
+	for _, b := range bindings {
+		if b.Expires.After(latest) {
+			latest = b.Expires
+		}
+	}
+	return latest
+}
+
+// requestsAKAv2 reports whether the UE asked for AKAv2 in its initial
+// Authorization header
+func requestsAKAv2(msg *sip.Message) bool {
+	creds, err := parseCredentials(msg.GetHeader("Authorization"))
+	return err == nil && strings.EqualFold(creds.algorithm, AlgorithmAKAv2)
+}
+
+// newResponse creates a response to req
+func newResponse(req *sip.Message, statusCode int, reason string) *sip.Message {
+	response := &sip.Message{
+		Version:    "SIP/2.0",
+		StatusCode: statusCode,
+		StatusText: reason,
+		Headers:    make(map[string][]string),
+	}
+
+	for _, via := range req.GetHeaderAll("Via") {
+		response.AddHeader("Via", via)
+	}
+	response.SetHeader("From", req.GetHeader("From"))
+	to := req.GetHeader("To")
+	if to != "" && !strings.Contains(to, ";tag=") {
+		to += ";tag=" + generateTag()
+	}
+	response.SetHeader("To", to)
+	response.SetHeader("Call-ID", req.GetHeader("Call-ID"))
+	response.SetHeader("CSeq", req.GetHeader("CSeq"))
+
+	return response
+}
+
+// parseContact splits a Contact value into its URI and header parameters
+func parseContact(contact string) (string, map[string]string) {
+	contact = strings.TrimSpace(contact)
+	var uri, rest string
+	if start := strings.Index(contact, "<"); start >= 0 {
+		end := strings.Index(contact[start:], ">")
+		if end < 0 {
+			return "", nil
+		}
+		uri = contact[start+1 : start+end]
+		rest = contact[start+end+1:]
+	} else {
+		uri, rest, _ = strings.Cut(contact, ";")
+		rest = ";" + rest
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Split(rest, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if name == "" {
+			continue
+		}
+		params[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return strings.TrimSpace(uri), params
+}
+
+// splitList splits a comma separated header value, ignoring commas inside
+// quotes and angle brackets
+func splitList(s string) []string {
+	var parts []string
+	var quoted bool
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			if !quoted {
+				depth++
+			}
+		case '>':
+			if !quoted && depth > 0 {
+				depth--
+			}
+		case ',':
+			if !quoted && depth == 0 {
+				if part := strings.TrimSpace(s[start:i]); part != "" {
+					parts = append(parts, part)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if part := strings.TrimSpace(s[start:]); part != "" {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// parseCSeq returns the sequence number of a CSeq header
+func parseCSeq(header string) int {
+	fields := strings.Fields(header)
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(fields[0])
+	return n
+}
+
+// extractURI returns the URI of a name-addr or addr-spec header value
+func extractURI(header string) string {
+	uri, _ := parseContact(header)
+	return uri
+}
+
+// impiFromIMPU derives the private identity from a public identity when
+// the UE sent no Authorization header (TS 23.003 section 13.3)
+func impiFromIMPU(impu string) string {
+	for _, scheme := range []string{"sips:", "sip:", "tel:"} {
+		if strings.HasPrefix(strings.ToLower(impu), scheme) {
+			return impu[len(scheme):]
+		}
+	}
+	return impu
+}
+
+// generateTag returns a random To tag
+func generateTag() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,621 @@
+package scscf
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/ai"
+	"github.com/dasmlab/ims/internal/aka"
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/dasmlab/ims/internal/hss"
+	"github.com/dasmlab/ims/internal/sip"
+	"github.com/dasmlab/ims/internal/store"
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/dasmlab/souverix/common/diameter/cx"
+	"github.com/sirupsen/logrus"
+)
+
+// Milenage test set 1 credentials (TS 35.208)
+const (
+	testK   = "465b5ce8b199b49faa5f0a2ee238a6bc"
+	testOPc = "cd63cb71954a9f4e48a5994e37a02baf"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return log
+}
+
+// cxServiceHSS runs the HSS Cx service in process
+type cxServiceHSS struct {
+	service *hss.CxService
+
+	mu   sync.Mutex
+	sars []*cx.SAR
+}
+
+func (h *cxServiceHSS) MultimediaAuth(ctx context.Context, req *cx.MAR) (*cx.MAA, error) {
+	return h.service.MultimediaAuth(ctx, req), nil
+}
+
+func (h *cxServiceHSS) ServerAssignment(ctx context.Context, req *cx.SAR) (*cx.SAA, error) {
+	h.mu.Lock()
+	h.sars = append(h.sars, req)
+	h.mu.Unlock()
+	return h.service.ServerAssignment(ctx, req), nil
+}
+
+func (h *cxServiceHSS) assignments() []uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	types := make([]uint32, 0, len(h.sars))
+	for _, sar := range h.sars {
+		types = append(types, sar.AssignmentType)
+	}
+	return types
+}
+
+// registrationHook records OnRegistration calls
+type registrationHook struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *registrationHook) OnSIPMessage(msg *sip.Message) error   { return nil }
+func (h *registrationHook) OnSessionStart(sessionID string) error { return nil }
+func (h *registrationHook) OnSessionEnd(sessionID string) error   { return nil }
+func (h *registrationHook) OnRegistration(impi, impu string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, impi+" "+impu)
+	return nil
+}
+
+func (h *registrationHook) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.events)
+}
+
+type testRegistrar struct {
+	*Registrar
+	conf  *config.Config
+	store store.HSSStore
+	hss   *cxServiceHSS
+	hook  *registrationHook
+	clock time.Time
+}
+
+// newTestRegistrar creates a registrar backed by an in-process HSS seeded
+// with a Digest, a SHA-256 and an AKA subscriber
+func newTestRegistrar(t *testing.T) *testRegistrar {
+	t.Helper()
+	hssStore, err := store.NewMemHSSStore(testLogger())
+	if err != nil {
+		t.Fatalf("NewMemHSSStore() error = %v", err)
+	}
+	sha := sha256.Sum256([]byte("bob@ims.local:ims.local:secret"))
+	for _, sub := range []*ims.Subscriber{
+		{
+			IMPI: "bob@ims.local", IMPU: "sip:bob@ims.local",
+			ServiceProfile: ims.ServiceProfile{PublicIdentities: []string{"sip:bob@ims.local", "tel:+15145550002"}},
+			AuthData:       ims.AuthData{AuthScheme: "Digest", Username: "bob@ims.local", Realm: "ims.local", HA1: hex.EncodeToString(sha[:])},
+		},
+		{
+			IMPI: "carol@ims.local", IMPU: "sip:carol@ims.local",
+			AuthData: ims.AuthData{AuthScheme: "AKA", K: testK, OPc: testOPc, AMF: "8000"},
+		},
+	} {
+		if err := hssStore.UpsertSubscriber(sub); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+	}
+
+	cfg := &config.Config{IMS: config.IMSConfig{
+		Domain: "ims.local",
+		HSS:    config.HSSConfig{DiameterHost: "hss.ims.local", DiameterRealm: "ims.local"},
+		SCSCF: config.SCSCFConfig{
+			ServerName:     "sip:scscf1.ims.local",
+			NonceTTL:       30 * time.Second,
+			MinExpires:     60,
+			MaxExpires:     7200,
+			DefaultExpires: 3600,
+		},
+	}}
+	h := &cxServiceHSS{service: hss.NewCxService(&cfg.IMS.HSS, hssStore, testLogger())}
+	hook := &registrationHook{}
+	hooks := ai.NewHookManager(testLogger())
+	hooks.RegisterHook(hook)
+
+	tr := &testRegistrar{
+		Registrar: NewRegistrar(cfg, h, hssStore, hooks, testLogger()),
+		conf:      cfg,
+		store:     hssStore,
+		hss:       h,
+		hook:      hook,
+		clock:     time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tr.now = func() time.Time { return tr.clock }
+	return tr
+}
+
+// register builds a REGISTER for impu; extra holds additional headers
+func register(impu string, cseq int, contact string, extra ...string) *sip.Message {
+	msg := &sip.Message{Method: sip.MethodREGISTER, URI: "sip:ims.local", Version: "SIP/2.0"}
+	msg.SetHeader("Via", "SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK"+strconv.Itoa(cseq))
+	msg.SetHeader("From", "<"+impu+">;tag=ue")
+	msg.SetHeader("To", "<"+impu+">")
+	msg.SetHeader("Call-ID", "reg-"+impu)
+	msg.SetHeader("CSeq", strconv.Itoa(cseq)+" REGISTER")
+	if contact != "" {
+		msg.SetHeader("Contact", contact)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		msg.AddHeader(extra[i], extra[i+1])
+	}
+	return msg
+}
+
+// authorization answers a WWW-Authenticate challenge like a UE: with the
+// password for Digest or with RES computed from the USIM key for AKA
+func authorization(t *testing.T, wwwAuth, username, password string) string {
+	t.Helper()
+	return authorizationNC(t, wwwAuth, username, password, 1)
+}
+
+// authorizationNC answers a challenge with nonce count nc
+func authorizationNC(t *testing.T, wwwAuth, username, password string, nc int) string {
+	t.Helper()
+	params := parseParams(strings.TrimPrefix(wwwAuth, "Digest "))
+	realm, nonce, algorithm := params["realm"], params["nonce"], params["algorithm"]
+
+	newHash := md5.New
+	var ha1 string
+	switch algorithm {
+	case AlgorithmMD5:
+		ha1 = hashHex(newHash, username, realm, password)
+	case AlgorithmSHA256:
+		newHash = sha256.New
+		ha1 = hashHex(newHash, username, realm, password)
+	case AlgorithmAKAv1, AlgorithmAKAv2:
+		res, ck, ik := usimRespond(t, nonce)
+		akaPassword := string(res)
+		if algorithm == AlgorithmAKAv2 {
+			akaPassword = akav2Password(res, ik, ck)
+		}
+		if params["ck"] != hex.EncodeToString(ck) || params["ik"] != hex.EncodeToString(ik) {
+			t.Errorf("challenge CK/IK = %s/%s, want %x/%x", params["ck"], params["ik"], ck, ik)
+		}
+		ha1 = hashHex(newHash, username, realm, akaPassword)
+	default:
+		t.Fatalf("unexpected algorithm %q", algorithm)
+	}
+
+	ha2 := hashHex(newHash, sip.MethodREGISTER, "sip:ims.local")
+	response := hashHex(newHash, ha1, nonce, fmt.Sprintf("%08x", nc), "cnonce", "auth", ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="sip:ims.local", response="%s", algorithm=%s, cnonce="cnonce", qop=auth, nc=%08x`,
+		username, realm, nonce, response, algorithm, nc)
+}
+
+// usimRespond runs the USIM side of AKA on a nonce: it checks MAC-A and
+// returns RES, CK and IK
+func usimRespond(t *testing.T, nonce string) (res, ck, ik []byte) {
+	t.Helper()
+	m := testMilenage(t)
+	data, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil || len(data) != 32 {
+		t.Fatalf("invalid AKA nonce %q", nonce)
+	}
+	rnd, autn := data[:16], data[16:]
+
+	res, ck, ik, ak, err := m.F2345(rnd)
+	if err != nil {
+		t.Fatalf("F2345() error = %v", err)
+	}
+	sqn := make([]byte, 6)
+	for i := range sqn {
+		sqn[i] = autn[i] ^ ak[i]
+	}
+	mac, _, err := m.F1(rnd, sqn, autn[6:8])
+	if err != nil || hex.EncodeToString(mac) != hex.EncodeToString(autn[8:]) {
+		t.Fatalf("AUTN MAC-A verification failed")
+	}
+	return res, ck, ik
+}
+
+func testMilenage(t *testing.T) *aka.Milenage {
+	t.Helper()
+	k, _ := hex.DecodeString(testK)
+	opc, _ := hex.DecodeString(testOPc)
+	m, err := aka.NewMilenage(k, opc)
+	if err != nil {
+		t.Fatalf("NewMilenage() error = %v", err)
+	}
+	return m
+}
+
+// authenticate runs the challenge/response exchange and returns the final
+// response
+func (tr *testRegistrar) authenticate(t *testing.T, impi, impu, password string, cseq int, contact string, extra ...string) *sip.Message {
+	t.Helper()
+	ctx := context.Background()
+
+	first := register(impu, cseq, contact, append([]string{"Authorization", `Digest username="` + impi + `", realm="ims.local", nonce="", uri="sip:ims.local", response=""`}, extra...)...)
+	challenge := tr.HandleRegister(ctx, first)
+	if challenge.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("initial REGISTER status = %d, want 401", challenge.StatusCode)
+	}
+	wwwAuth := challenge.GetHeader("WWW-Authenticate")
+	return tr.HandleRegister(ctx, register(impu, cseq+1, contact, append([]string{"Authorization", authorization(t, wwwAuth, impi, password)}, extra...)...))
+}
+
+func TestRegistrar_DigestRegistration(t *testing.T) {
+	tr := newTestRegistrar(t)
+
+	resp := tr.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1,
+		"<sip:alice@10.0.0.1:5060>;expires=600", "Path", "<sip:term@pcscf.ims.local;lr>")
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("authenticated REGISTER status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.GetHeader("Contact"); got != "<sip:alice@10.0.0.1:5060>;expires=600" {
+		t.Errorf("Contact = %q", got)
+	}
+	if got := resp.GetHeader("Service-Route"); got != "<sip:scscf1.ims.local;lr;orig>" {
+		t.Errorf("Service-Route = %q", got)
+	}
+	if got := resp.GetHeader("Path"); got != "<sip:term@pcscf.ims.local;lr>" {
+		t.Errorf("Path = %q", got)
+	}
+	if got := resp.GetHeader("P-Associated-URI"); got != "<sip:alice@ims.local>" {
+		t.Errorf("P-Associated-URI = %q", got)
+	}
+
+	reg, err := tr.store.GetRegistration("alice@ims.local")
+	if err != nil {
+		t.Fatalf("GetRegistration() error = %v", err)
+	}
+	if reg.State != ims.RegistrationStateRegistered || reg.SCSCFName != "sip:scscf1.ims.local" ||
+		len(reg.Contacts) != 1 || reg.Expires != 600 || len(reg.Path) != 1 {
+		t.Errorf("registration = %+v", reg)
+	}
+	if sub, _ := tr.store.GetSubscriber("alice@ims.local"); !sub.Registered {
+		t.Error("subscriber not marked registered in the HSS")
+	}
+	if tr.hook.count() != 1 {
+		t.Errorf("registration hook called %d times, want 1", tr.hook.count())
+	}
+	if got := tr.hss.assignments(); len(got) != 1 || got[0] != cx.AssignmentRegistration {
+		t.Errorf("SAR assignment types = %v", got)
+	}
+
+	// A refresh is a re-registration and does not notify the hooks again
+	resp = tr.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 3, "<sip:alice@10.0.0.1:5060>")
+	if resp.StatusCode != sip.StatusOK || resp.GetHeader("Contact") != "<sip:alice@10.0.0.1:5060>;expires=3600" {
+		t.Errorf("re-REGISTER = %d %q", resp.StatusCode, resp.GetHeader("Contact"))
+	}
+	if got := tr.hss.assignments(); got[len(got)-1] != cx.AssignmentReRegistration || tr.hook.count() != 1 {
+		t.Errorf("SAR assignment types = %v, hook calls = %d", got, tr.hook.count())
+	}
+}
+
+func TestRegistrar_SHA256(t *testing.T) {
+	tr := newTestRegistrar(t)
+
+	resp := tr.authenticate(t, "bob@ims.local", "sip:bob@ims.local", "secret", 1, "<sip:bob@10.0.0.2>")
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("SHA-256 REGISTER status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.GetHeader("P-Associated-URI"); got != "<sip:bob@ims.local>, <tel:+15145550002>" {
+		t.Errorf("P-Associated-URI = %q", got)
+	}
+}
+
+func TestRegistrar_AuthenticationFailures(t *testing.T) {
+	tr := newTestRegistrar(t)
+	ctx := context.Background()
+
+	if resp := tr.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "wrong", 1, "<sip:alice@10.0.0.1>"); resp.StatusCode != sip.StatusForbidden {
+		t.Errorf("wrong password status = %d, want 403", resp.StatusCode)
+	}
+
+	unknown := register("sip:mallory@ims.local", 1, "<sip:mallory@10.0.0.9>")
+	if resp := tr.HandleRegister(ctx, unknown); resp.StatusCode != sip.StatusForbidden {
+		t.Errorf("unknown user status = %d, want 403", resp.StatusCode)
+	}
+
+	// A nonce count may not be replayed
+	challenge := tr.HandleRegister(ctx, register("sip:alice@ims.local", 1, "<sip:alice@10.0.0.1>"))
+	auth := authorization(t, challenge.GetHeader("WWW-Authenticate"), "alice@ims.local", "secret123")
+	if resp := tr.HandleRegister(ctx, register("sip:alice@ims.local", 2, "<sip:alice@10.0.0.1>", "Authorization", auth)); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER status = %d, want 200", resp.StatusCode)
+	}
+	if resp := tr.HandleRegister(ctx, register("sip:alice@ims.local", 3, "<sip:alice@10.0.0.1>", "Authorization", auth)); resp.StatusCode != sip.StatusForbidden {
+		t.Errorf("replayed nonce count status = %d, want 403", resp.StatusCode)
+	}
+
+	// Expired nonces are challenged again with stale=TRUE
+	challenge = tr.HandleRegister(ctx, register("sip:alice@ims.local", 4, "<sip:alice@10.0.0.1>"))
+	auth = authorization(t, challenge.GetHeader("WWW-Authenticate"), "alice@ims.local", "secret123")
+	tr.clock = tr.clock.Add(time.Minute)
+	resp := tr.HandleRegister(ctx, register("sip:alice@ims.local", 5, "<sip:alice@10.0.0.1>", "Authorization", auth))
+	if resp.StatusCode != sip.StatusUnauthorized || !strings.Contains(resp.GetHeader("WWW-Authenticate"), "stale=TRUE") {
+		t.Errorf("expired nonce = %d %q", resp.StatusCode, resp.GetHeader("WWW-Authenticate"))
+	}
+}
+
+func TestRegistrar_AKA(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+	}{
+		{"AKAv1", ""},
+		{"AKAv2", AlgorithmAKAv2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestRegistrar(t)
+			ctx := context.Background()
+
+			initial := `Digest username="carol@ims.local", realm="ims.local", nonce="", uri="sip:ims.local", response=""`
+			if tt.algorithm != "" {
+				initial += ", algorithm=" + tt.algorithm
+			}
+			challenge := tr.HandleRegister(ctx, register("sip:carol@ims.local", 1, "<sip:carol@10.0.0.3>", "Authorization", initial))
+			wwwAuth := challenge.GetHeader("WWW-Authenticate")
+			want := AlgorithmAKAv1
+			if tt.algorithm != "" {
+				want = tt.algorithm
+			}
+			if challenge.StatusCode != sip.StatusUnauthorized || !strings.Contains(wwwAuth, "algorithm="+want) {
+				t.Fatalf("challenge = %d %q", challenge.StatusCode, wwwAuth)
+			}
+
+			auth := authorization(t, wwwAuth, "carol@ims.local", "")
+			resp := tr.HandleRegister(ctx, register("sip:carol@ims.local", 2, "<sip:carol@10.0.0.3>", "Authorization", auth))
+			if resp.StatusCode != sip.StatusOK {
+				t.Fatalf("AKA REGISTER status = %d, want 200", resp.StatusCode)
+			}
+
+			// The vector is consumed by a successful authentication
+			resp = tr.HandleRegister(ctx, register("sip:carol@ims.local", 3, "<sip:carol@10.0.0.3>", "Authorization", auth))
+			if resp.StatusCode != sip.StatusUnauthorized {
+				t.Errorf("reused AKA vector status = %d, want 401", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRegistrar_AKAResynchronisation(t *testing.T) {
+	tr := newTestRegistrar(t)
+	ctx := context.Background()
+	m := testMilenage(t)
+
+	challenge := tr.HandleRegister(ctx, register("sip:carol@ims.local", 1, "<sip:carol@10.0.0.3>", "Authorization", `Digest username="carol@ims.local", realm="ims.local", nonce="", uri="sip:ims.local", response=""`))
+	nonce := parseParams(strings.TrimPrefix(challenge.GetHeader("WWW-Authenticate"), "Digest "))["nonce"]
+	data, _ := base64.StdEncoding.DecodeString(nonce)
+
+	// The USIM is ahead of the HSS and answers with AUTS
+	rnd := data[:16]
+	sqnMS := []byte{0, 0, 0, 0, 0x20, 0x00}
+	akStar, _ := m.F5Star(rnd)
+	_, macS, _ := m.F1(rnd, sqnMS, []byte{0, 0})
+	auts := make([]byte, 0, aka.AUTSLen)
+	for i := range sqnMS {
+		auts = append(auts, sqnMS[i]^akStar[i])
+	}
+	auts = append(auts, macS...)
+
+	header := fmt.Sprintf(`Digest username="carol@ims.local", realm="ims.local", nonce="%s", uri="sip:ims.local", response="", auts="%s"`, nonce, base64.StdEncoding.EncodeToString(auts))
+	resp := tr.HandleRegister(ctx, register("sip:carol@ims.local", 2, "<sip:carol@10.0.0.3>", "Authorization", header))
+	if resp.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("resynchronisation status = %d, want 401", resp.StatusCode)
+	}
+	if sub, _ := tr.store.GetSubscriber("carol@ims.local"); sub.AuthData.SQN != aka.NextSQN(0x2000) {
+		t.Errorf("HSS SQN after resync = %#x, want %#x", sub.AuthData.SQN, aka.NextSQN(0x2000))
+	}
+
+	auth := authorization(t, resp.GetHeader("WWW-Authenticate"), "carol@ims.local", "")
+	if resp := tr.HandleRegister(ctx, register("sip:carol@ims.local", 3, "<sip:carol@10.0.0.3>", "Authorization", auth)); resp.StatusCode != sip.StatusOK {
+		t.Errorf("REGISTER after resync status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRegistrar_Bindings(t *testing.T) {
+	tr := newTestRegistrar(t)
+	ctx := context.Background()
+
+	resp := tr.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1,
+		`<sip:alice@10.0.0.1>;expires=600, <sip:alice@10.0.0.4>;+sip.instance="<urn:uuid:1>"`, "Expires", "1200")
+	if resp.StatusCode != sip.StatusOK || len(resp.GetHeaderAll("Contact")) != 2 {
+		t.Fatalf("REGISTER with two contacts = %d %q", resp.StatusCode, resp.GetHeaderAll("Contact"))
+	}
+	if got := tr.Bindings("sip:alice@ims.local"); len(got) != 2 || got[1].InstanceID != "<urn:uuid:1>" {
+		t.Fatalf("Bindings() = %+v", got)
+	}
+
+	// The authenticated nonce is reused for the following requests
+	challenge := tr.HandleRegister(ctx, register("sip:alice@ims.local", 10, "<sip:alice@10.0.0.1>"))
+	wwwAuth := challenge.GetHeader("WWW-Authenticate")
+	send := func(cseq int, contact string, nc int, extra ...string) *sip.Message {
+		auth := authorizationNC(t, wwwAuth, "alice@ims.local", "secret123", nc)
+		return tr.HandleRegister(ctx, register("sip:alice@ims.local", cseq, contact, append([]string{"Authorization", auth}, extra...)...))
+	}
+
+	if resp := send(11, "<sip:alice@10.0.0.1>;expires=30", 1); resp.StatusCode != sip.StatusIntervalTooBrief || resp.GetHeader("Min-Expires") != "60" {
+		t.Errorf("too brief = %d, Min-Expires %q", resp.StatusCode, resp.GetHeader("Min-Expires"))
+	}
+	if resp := send(1, "<sip:alice@10.0.0.1>", 2); resp.StatusCode != sip.StatusInternalServerError {
+		t.Errorf("out of order CSeq status = %d, want 500", resp.StatusCode)
+	}
+	if resp := send(12, "<sip:alice@10.0.0.1>;expires=0", 3); resp.StatusCode != sip.StatusOK || len(resp.GetHeaderAll("Contact")) != 1 {
+		t.Errorf("removing one contact = %d %q", resp.StatusCode, resp.GetHeaderAll("Contact"))
+	}
+	if resp := send(13, "*", 4); resp.StatusCode != sip.StatusBadRequest {
+		t.Errorf("Contact: * without Expires: 0 status = %d, want 400", resp.StatusCode)
+	}
+	if resp := send(14, "*", 5, "Expires", "0"); resp.StatusCode != sip.StatusOK || len(resp.GetHeaderAll("Contact")) != 0 {
+		t.Errorf("Contact: * = %d %q", resp.StatusCode, resp.GetHeaderAll("Contact"))
+	}
+
+	if _, err := tr.store.GetRegistration("alice@ims.local"); err == nil {
+		t.Error("registration kept after removing every contact")
+	}
+	if got := tr.hss.assignments(); got[len(got)-1] != cx.AssignmentUserDeregistration {
+		t.Errorf("SAR assignment types = %v", got)
+	}
+	if tr.hook.count() != 2 {
+		t.Errorf("registration hook called %d times, want 2", tr.hook.count())
+	}
+}
+
+func TestRegistrar_Expire(t *testing.T) {
+	tr := newTestRegistrar(t)
+	ctx := context.Background()
+
+	resp := tr.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1,
+		"<sip:alice@10.0.0.1>;expires=600, <sip:alice@10.0.0.4>;expires=1200")
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER status = %d, want 200", resp.StatusCode)
+	}
+
+	tr.clock = tr.clock.Add(900 * time.Second)
+	tr.Expire(ctx)
+	reg, err := tr.store.GetRegistration("alice@ims.local")
+	if err != nil || len(reg.Contacts) != 1 || reg.Contact != "sip:alice@10.0.0.4" || reg.Expires != 300 {
+		t.Fatalf("registration after first expiry = %+v, %v", reg, err)
+	}
+
+	tr.clock = tr.clock.Add(time.Hour)
+	tr.Expire(ctx)
+	if _, err := tr.store.GetRegistration("alice@ims.local"); err == nil {
+		t.Error("registration kept after every contact expired")
+	}
+	if got := tr.hss.assignments(); got[len(got)-1] != cx.AssignmentTimeoutDeregistration {
+		t.Errorf("SAR assignment types = %v", got)
+	}
+	if sub, _ := tr.store.GetSubscriber("alice@ims.local"); sub.Registered || sub.SCSCFName != "" {
+		t.Errorf("subscriber after timeout = %+v", sub)
+	}
+}
+
+func TestRegistrar_Restore(t *testing.T) {
+	tr := newTestRegistrar(t)
+	ctx := context.Background()
+
+	resp := tr.authenticate(t, "alice@ims.local", "sip:alice@ims.local", "secret123", 1, "<sip:alice@10.0.0.1>;expires=600")
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER status = %d, want 200", resp.StatusCode)
+	}
+
+	// A restarted S-CSCF only expires the bindings it restored
+	restarted := NewRegistrar(tr.conf, tr.hss, tr.store, nil, testLogger())
+	restarted.now = func() time.Time { return tr.clock.Add(time.Hour) }
+	restarted.Expire(ctx)
+	if _, err := tr.store.GetRegistration("alice@ims.local"); err != nil {
+		t.Fatalf("registration expired before restore: %v", err)
+	}
+	if err := restarted.Restore(); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	restarted.Expire(ctx)
+	if _, err := tr.store.GetRegistration("alice@ims.local"); err == nil {
+		t.Error("restored registration kept after its contact expired")
+	}
+}
+
+// addIdentitySubscribers provisions dave, whose implicit registration set
+// holds a barred, a wildcarded and a shared identity, and erin, who shares
+// a line number with dave. Both use the Digest password "secret".
+func addIdentitySubscribers(t *testing.T, hssStore store.HSSStore) {
+	t.Helper()
+	shared := ims.PublicIdentityAttributes{Shared: true}
+	for _, name := range []string{"dave", "erin"} {
+		ha1 := md5.Sum([]byte(name + "@ims.local:ims.local:secret"))
+		sub := &ims.Subscriber{
+			IMPI: name + "@ims.local", IMPU: "sip:" + name + "@ims.local",
+			ServiceProfile: ims.ServiceProfile{
+				PublicIdentities:   []string{"sip:" + name + "@ims.local", "tel:+15145550020"},
+				IdentityAttributes: map[string]ims.PublicIdentityAttributes{"tel:+15145550020": shared},
+			},
+			ImplicitRegistrationSets: []ims.ImplicitRegistrationSet{{ID: "1", IMPUs: []string{"sip:" + name + "@ims.local", "tel:+15145550020"}}},
+			AuthData:                 ims.AuthData{AuthScheme: "Digest", Username: name + "@ims.local", Realm: "ims.local", HA1: hex.EncodeToString(ha1[:])},
+		}
+		if name == "dave" {
+			sub.ServiceProfile.PublicIdentities = []string{
+				"sip:dave@ims.local", "sip:dave.other@ims.local", "sip:dave.barred@ims.local",
+				"tel:+15145550010", "sip:dave-!.*!@ims.local", "tel:+15145550020",
+			}
+			sub.ServiceProfile.IdentityAttributes = map[string]ims.PublicIdentityAttributes{
+				"sip:dave.barred@ims.local": {Barred: true},
+				"sip:dave-!.*!@ims.local":   {IdentityType: ims.IdentityTypeWildcardedIMPU, Wildcard: "sip:dave-!.*!@ims.local"},
+				"tel:+15145550020":          shared,
+			}
+			sub.ImplicitRegistrationSets = []ims.ImplicitRegistrationSet{{
+				ID:    "1",
+				IMPUs: []string{"sip:dave@ims.local", "sip:dave.barred@ims.local", "tel:+15145550010", "sip:dave-!.*!@ims.local", "tel:+15145550020"},
+			}}
+		}
+		if err := hssStore.UpsertSubscriber(sub); err != nil {
+			t.Fatalf("UpsertSubscriber(%s) error = %v", name, err)
+		}
+	}
+}
+
+func TestRegistrar_IdentitySets(t *testing.T) {
+	tr := newTestRegistrar(t)
+	addIdentitySubscribers(t, tr.store)
+
+	// Barred identities are only registered implicitly
+	if resp := tr.authenticate(t, "dave@ims.local", "sip:dave.barred@ims.local", "secret", 1, "<sip:dave@10.0.0.5>"); resp.StatusCode != sip.StatusForbidden {
+		t.Errorf("REGISTER of a barred identity status = %d, want 403", resp.StatusCode)
+	}
+
+	resp := tr.authenticate(t, "dave@ims.local", "sip:dave@ims.local", "secret", 3, "<sip:dave@10.0.0.5>")
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER status = %d, want 200", resp.StatusCode)
+	}
+	// The registration set comes first, without barred and wildcarded
+	// identities
+	want := "<sip:dave@ims.local>, <tel:+15145550010>, <tel:+15145550020>, <sip:dave.other@ims.local>"
+	if got := resp.GetHeader("P-Associated-URI"); got != want {
+		t.Errorf("P-Associated-URI = %q, want %q", got, want)
+	}
+
+	// Every identity of the set reaches the registered contact
+	for _, impu := range []string{"sip:dave@ims.local", "tel:+15145550010", "sip:dave-42@ims.local"} {
+		if got := tr.Bindings(impu); len(got) != 1 || got[0].URI != "sip:dave@10.0.0.5" {
+			t.Errorf("Bindings(%s) = %+v", impu, got)
+		}
+	}
+	if got := tr.Bindings("sip:dave.other@ims.local"); len(got) != 0 {
+		t.Errorf("Bindings() of an identity outside the set = %+v", got)
+	}
+
+	// A REGISTER of an implicitly registered identity refreshes the set
+	resp = tr.authenticate(t, "dave@ims.local", "tel:+15145550010", "secret", 5, "<sip:dave@10.0.0.5>")
+	if resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER of an implicit identity status = %d", resp.StatusCode)
+	}
+	if got := tr.hss.assignments(); got[len(got)-1] != cx.AssignmentReRegistration {
+		t.Errorf("SAR assignment types = %v", got)
+	}
+
+	// A shared identity forks to the contacts of every user sharing it
+	if resp := tr.authenticate(t, "erin@ims.local", "sip:erin@ims.local", "secret", 1, "<sip:erin@10.0.0.6>"); resp.StatusCode != sip.StatusOK {
+		t.Fatalf("REGISTER of erin status = %d", resp.StatusCode)
+	}
+	if got := tr.Bindings("tel:+15145550020"); len(got) != 2 || got[0].URI != "sip:dave@10.0.0.5" || got[1].URI != "sip:erin@10.0.0.6" {
+		t.Errorf("Bindings() of a shared identity = %+v", got)
+	}
+}
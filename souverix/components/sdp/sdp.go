@@ -0,0 +1,355 @@
+// Package sdp parses and formats the Session Description Protocol bodies
+// (RFC 8866) carried in SIP offers and answers.
+package sdp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the MIME type of an SDP body
+const ContentType = "application/sdp"
+
+// Media directions (RFC 8866 section 6.7)
+const (
+	SendRecv = "sendrecv"
+	SendOnly = "sendonly"
+	RecvOnly = "recvonly"
+	Inactive = "inactive"
+)
+
+// Attribute is an a= line. Flags such as a=sendrecv have an empty Value.
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// Bandwidth is a b= line; Value is in kilobits per second, except for
+// the RS and RR modifiers of RFC 3556 which are in bits per second
+type Bandwidth struct {
+	Type  string
+	Value int
+}
+
+// Connection is a c= line
+type Connection struct {
+	NetworkType string
+	AddressType string
+	Address     string
+}
+
+// Media is an m= section
+type Media struct {
+	Type       string // audio, video, text, application, message
+	Port       int
+	PortCount  int // Number of ports, 0 when not given
+	Proto      string
+	Formats    []string
+	Info       string
+	Connection *Connection
+	Bandwidths []Bandwidth
+	Attributes []Attribute
+}
+
+// Session is a session description. Lines the package does not model
+// (e, p, z, k, r and t beyond the first) are kept in Other, in order, and
+// written back after the timing line.
+type Session struct {
+	Version    int
+	Origin     string
+	Name       string
+	Info       string
+	URI        string
+	Connection *Connection
+	Bandwidths []Bandwidth
+	Timing     string
+	Other      []string
+	Attributes []Attribute
+	Media      []*Media
+}
+
+// Parse parses an SDP body
+func Parse(body string) (*Session, error) {
+	s := &Session{Version: -1}
+	var media *Media
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, fmt.Errorf("sdp line %d: invalid line %q", i+1, line)
+		}
+		kind, value := line[0], line[2:]
+
+		if kind == 'm' {
+			m, err := parseMedia(value)
+			if err != nil {
+				return nil, fmt.Errorf("sdp line %d: %w", i+1, err)
+			}
+			media = m
+			s.Media = append(s.Media, m)
+			continue
+		}
+
+		var err error
+		switch {
+		case kind == 'v' && media == nil:
+			s.Version, err = strconv.Atoi(value)
+		case kind == 'o' && media == nil:
+			s.Origin = value
+		case kind == 's' && media == nil:
+			s.Name = value
+		case kind == 'u' && media == nil:
+			s.URI = value
+		case kind == 't' && media == nil && s.Timing == "":
+			s.Timing = value
+		case kind == 'i':
+			if media != nil {
+				media.Info = value
+			} else {
+				s.Info = value
+			}
+		case kind == 'c':
+			var c *Connection
+			if c, err = parseConnection(value); err == nil {
+				if media != nil {
+					media.Connection = c
+				} else {
+					s.Connection = c
+				}
+			}
+		case kind == 'b':
+			var b Bandwidth
+			if b, err = parseBandwidth(value); err == nil {
+				if media != nil {
+					media.Bandwidths = append(media.Bandwidths, b)
+				} else {
+					s.Bandwidths = append(s.Bandwidths, b)
+				}
+			}
+		case kind == 'a':
+			name, attrValue, _ := strings.Cut(value, ":")
+			a := Attribute{Name: name, Value: attrValue}
+			if media != nil {
+				media.Attributes = append(media.Attributes, a)
+			} else {
+				s.Attributes = append(s.Attributes, a)
+			}
+		case media == nil:
+			s.Other = append(s.Other, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sdp line %d: %w", i+1, err)
+		}
+	}
+	if s.Version != 0 {
+		return nil, fmt.Errorf("sdp: missing or unsupported version")
+	}
+	return s, nil
+}
+
+func parseMedia(value string) (*Media, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid media %q", value)
+	}
+	m := &Media{Type: fields[0], Proto: fields[2], Formats: fields[3:]}
+	port, count, hasCount := strings.Cut(fields[1], "/")
+	var err error
+	if m.Port, err = strconv.Atoi(port); err != nil || m.Port < 0 || m.Port > 65535 {
+		return nil, fmt.Errorf("invalid media port %q", fields[1])
+	}
+	if hasCount {
+		if m.PortCount, err = strconv.Atoi(count); err != nil || m.PortCount < 1 {
+			return nil, fmt.Errorf("invalid media port count %q", fields[1])
+		}
+	}
+	return m, nil
+}
+
+func parseConnection(value string) (*Connection, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid connection %q", value)
+	}
+	// Multicast TTL and address count are not used for IMS media
+	address, _, _ := strings.Cut(fields[2], "/")
+	return &Connection{NetworkType: fields[0], AddressType: fields[1], Address: address}, nil
+}
+
+func parseBandwidth(value string) (Bandwidth, error) {
+	bwtype, bw, ok := strings.Cut(value, ":")
+	v, err := strconv.Atoi(bw)
+	if !ok || err != nil || v < 0 {
+		return Bandwidth{}, fmt.Errorf("invalid bandwidth %q", value)
+	}
+	return Bandwidth{Type: bwtype, Value: v}, nil
+}
+
+// String formats the session description with CRLF line endings
+func (s *Session) String() string {
+	var b strings.Builder
+	line := func(kind byte, value string) {
+		b.WriteByte(kind)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteString("\r\n")
+	}
+
+	line('v', strconv.Itoa(s.Version))
+	line('o', s.Origin)
+	name := s.Name
+	if name == "" {
+		name = "-"
+	}
+	line('s', name)
+	if s.Info != "" {
+		line('i', s.Info)
+	}
+	if s.URI != "" {
+		line('u', s.URI)
+	}
+	if s.Connection != nil {
+		line('c', s.Connection.String())
+	}
+	for _, bw := range s.Bandwidths {
+		line('b', bw.String())
+	}
+	timing := s.Timing
+	if timing == "" {
+		timing = "0 0"
+	}
+	line('t', timing)
+	for _, other := range s.Other {
+		b.WriteString(other)
+		b.WriteString("\r\n")
+	}
+	for _, a := range s.Attributes {
+		line('a', a.String())
+	}
+
+	for _, m := range s.Media {
+		b.WriteString(m.String())
+	}
+	return b.String()
+}
+
+// String formats the media section with CRLF line endings
+func (m *Media) String() string {
+	var b strings.Builder
+	line := func(kind byte, value string) {
+		b.WriteByte(kind)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteString("\r\n")
+	}
+
+	port := strconv.Itoa(m.Port)
+	if m.PortCount > 0 {
+		port += "/" + strconv.Itoa(m.PortCount)
+	}
+	line('m', strings.Join(append([]string{m.Type, port, m.Proto}, m.Formats...), " "))
+	if m.Info != "" {
+		line('i', m.Info)
+	}
+	if m.Connection != nil {
+		line('c', m.Connection.String())
+	}
+	for _, bw := range m.Bandwidths {
+		line('b', bw.String())
+	}
+	for _, a := range m.Attributes {
+		line('a', a.String())
+	}
+	return b.String()
+}
+
+// String formats the connection as the value of a c= line
+func (c *Connection) String() string {
+	return c.NetworkType + " " + c.AddressType + " " + c.Address
+}
+
+// String formats the bandwidth as the value of a b= line
+func (b Bandwidth) String() string {
+	return b.Type + ":" + strconv.Itoa(b.Value)
+}
+
+// String formats the attribute as the value of an a= line
+func (a Attribute) String() string {
+	if a.Value == "" {
+		return a.Name
+	}
+	return a.Name + ":" + a.Value
+}
+
+// Attribute returns the value of the first media attribute called name
+func (m *Media) Attribute(name string) (string, bool) {
+	return findAttribute(m.Attributes, name)
+}
+
+// AttributeValues returns the values of every media attribute called name
+func (m *Media) AttributeValues(name string) []string {
+	var values []string
+	for _, a := range m.Attributes {
+		if a.Name == name {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// Bandwidth returns the value of the media bandwidth of type bwtype
+func (m *Media) Bandwidth(bwtype string) (int, bool) {
+	for _, bw := range m.Bandwidths {
+		if strings.EqualFold(bw.Type, bwtype) {
+			return bw.Value, true
+		}
+	}
+	return 0, false
+}
+
+// Attribute returns the value of the first session attribute called name
+func (s *Session) Attribute(name string) (string, bool) {
+	return findAttribute(s.Attributes, name)
+}
+
+// ConnectionAddress returns the address media m is received on: its own
+// c= line, or else the session one
+func (s *Session) ConnectionAddress(m *Media) string {
+	if m.Connection != nil {
+		return m.Connection.Address
+	}
+	if s.Connection != nil {
+		return s.Connection.Address
+	}
+	return ""
+}
+
+// Direction returns the direction of media m: its own attribute, or else
+// the session one, or sendrecv. A port of zero rejects or disables the
+// media and makes it inactive.
+func (s *Session) Direction(m *Media) string {
+	if m.Port == 0 {
+		return Inactive
+	}
+	for _, attrs := range [][]Attribute{m.Attributes, s.Attributes} {
+		for _, a := range attrs {
+			switch a.Name {
+			case SendRecv, SendOnly, RecvOnly, Inactive:
+				return a.Name
+			}
+		}
+	}
+	return SendRecv
+}
+
+func findAttribute(attrs []Attribute, name string) (string, bool) {
+	for _, a := range attrs {
+		if a.Name == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+package sdp
+
+import (
+	"strings"
+	"testing"
+)
+
+const offer = "v=0\r\n" +
+	"o=alice 2890844526 2890844526 IN IP4 10.0.0.2\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 10.0.0.2\r\n" +
+	"b=AS:80\r\n" +
+	"t=0 0\r\n" +
+	"a=recvonly\r\n" +
+	"m=audio 49170 RTP/AVP 96 97\r\n" +
+	"b=AS:49\r\n" +
+	"a=rtpmap:96 AMR-WB/16000/1\r\n" +
+	"a=rtpmap:97 telephone-event/16000\r\n" +
+	"a=sendrecv\r\n" +
+	"m=video 51372/2 RTP/AVP 99\r\n" +
+	"c=IN IP4 10.0.0.3/127\r\n" +
+	"a=rtpmap:99 H264/90000\r\n" +
+	"m=text 0 RTP/AVP 98\r\n"
+
+func TestParse(t *testing.T) {
+	s, err := Parse(offer)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if s.Origin != "alice 2890844526 2890844526 IN IP4 10.0.0.2" || s.Connection.Address != "10.0.0.2" || len(s.Media) != 3 {
+		t.Fatalf("Parse() = %+v", s)
+	}
+
+	audio, video, text := s.Media[0], s.Media[1], s.Media[2]
+	if audio.Type != "audio" || audio.Port != 49170 || audio.Proto != "RTP/AVP" || strings.Join(audio.Formats, " ") != "96 97" {
+		t.Errorf("audio = %+v", audio)
+	}
+	if bw, ok := audio.Bandwidth("as"); !ok || bw != 49 {
+		t.Errorf("audio Bandwidth(AS) = %d, %v", bw, ok)
+	}
+	if got := audio.AttributeValues("rtpmap"); len(got) != 2 || got[0] != "96 AMR-WB/16000/1" {
+		t.Errorf("audio rtpmap = %v", got)
+	}
+	if video.PortCount != 2 || s.ConnectionAddress(video) != "10.0.0.3" || s.ConnectionAddress(audio) != "10.0.0.2" {
+		t.Errorf("video = %+v", video)
+	}
+
+	tests := []struct {
+		media *Media
+		want  string
+	}{
+		{audio, SendRecv}, // Media attribute wins over the session one
+		{video, RecvOnly},
+		{text, Inactive}, // Port zero
+	}
+	for _, tt := range tests {
+		if got := s.Direction(tt.media); got != tt.want {
+			t.Errorf("Direction(%s) = %s, want %s", tt.media.Type, got, tt.want)
+		}
+	}
+}
+
+func TestSession_String(t *testing.T) {
+	s, err := Parse(strings.ReplaceAll(offer, "\r\n", "\n"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	// Multicast TTLs are dropped
+	want := strings.Replace(offer, "10.0.0.3/127", "10.0.0.3", 1)
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"o=- 1 1 IN IP4 10.0.0.2\r\n",
+		"v=0\r\nm=audio x RTP/AVP 0\r\n",
+		"v=0\r\nm=audio 5000\r\n",
+		"v=0\r\nc=IN IP4\r\n",
+		"v=0\r\nb=AS\r\n",
+		"v=0\r\nbad line\r\n",
+	} {
+		if _, err := Parse(body); err == nil {
+			t.Errorf("Parse(%q) accepted", body)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ChargingVector is a P-Charging-Vector (RFC 7315 section 5.6): the IMS
+// charging identifier every node of a session reports, and the inter
+// operator identifiers of its originating and terminating networks
+type ChargingVector struct {
+	ICID        string
+	GeneratedAt string // icid-generated-at, the node that created the ICID
+	OrigIOI     string
+	TermIOI     string
+
+	// Params are the other parameters, such as access-network-charging-info,
+	// kept as received
+	Params []string
+}
+
+// NewICID returns a new globally unique IMS charging identifier
+func NewICID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ParseChargingVector parses a P-Charging-Vector header value
+func ParseChargingVector(value string) (*ChargingVector, error) {
+	v := &ChargingVector{}
+	for _, param := range strings.Split(value, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(param, "=")
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "icid-value":
+			v.ICID = strings.Trim(val, `"`)
+		case "icid-generated-at":
+			v.GeneratedAt = val
+		case "orig-ioi":
+			v.OrigIOI = strings.Trim(val, `"`)
+		case "term-ioi":
+			v.TermIOI = strings.Trim(val, `"`)
+		default:
+			v.Params = append(v.Params, param)
+		}
+	}
+	if v.ICID == "" {
+		return nil, fmt.Errorf("P-Charging-Vector without icid-value")
+	}
+	return v, nil
+}
+
+// String returns the header value of v
+func (v *ChargingVector) String() string {
+	params := []string{"icid-value=" + chargingToken(v.ICID)}
+	if v.GeneratedAt != "" {
+		params = append(params, "icid-generated-at="+v.GeneratedAt)
+	}
+	if v.OrigIOI != "" {
+		params = append(params, "orig-ioi="+chargingToken(v.OrigIOI))
+	}
+	if v.TermIOI != "" {
+		params = append(params, "term-ioi="+chargingToken(v.TermIOI))
+	}
+	return strings.Join(append(params, v.Params...), ";")
+}
+
+// chargingToken quotes a parameter value that is not a token
+func chargingToken(value string) string {
+	if strings.ContainsAny(value, " \t;,=\"") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+// GetChargingVector returns the P-Charging-Vector of msg; it returns nil
+// when msg has none or it is invalid
+func GetChargingVector(msg *Message) *ChargingVector {
+	value := msg.GetHeader("P-Charging-Vector")
+	if value == "" {
+		return nil
+	}
+	v, err := ParseChargingVector(value)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// SetChargingVector replaces the P-Charging-Vector of msg with v
+func SetChargingVector(msg *Message, v *ChargingVector) {
+	msg.RemoveHeader("P-Charging-Vector")
+	msg.SetHeader("P-Charging-Vector", v.String())
+}
+
+// EnsureChargingVector returns the P-Charging-Vector of msg. A request
+// without a valid one gets a new ICID generated at host (TS 24.229 section
+// 5.2.6.3.2).
+func EnsureChargingVector(msg *Message, host string) *ChargingVector {
+	if v := GetChargingVector(msg); v != nil {
+		return v
+	}
+	v := &ChargingVector{ICID: NewICID(), GeneratedAt: host}
+	SetChargingVector(msg, v)
+	return v
+}
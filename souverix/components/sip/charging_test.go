@@ -0,0 +1,67 @@
+package sip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChargingVector(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *ChargingVector
+		wantErr bool
+	}{
+		{
+			value: "icid-value=1234bc9876e;icid-generated-at=192.0.6.8;orig-ioi=home1.net",
+			want:  &ChargingVector{ICID: "1234bc9876e", GeneratedAt: "192.0.6.8", OrigIOI: "home1.net"},
+		},
+		{
+			value: `icid-value="AyretyU0dm+6O2IrT5tAFrbHLso=023551024"; orig-ioi=home1.net; term-ioi=home2.net; access-network-charging-info=x`,
+			want: &ChargingVector{
+				ICID:    "AyretyU0dm+6O2IrT5tAFrbHLso=023551024",
+				OrigIOI: "home1.net",
+				TermIOI: "home2.net",
+				Params:  []string{"access-network-charging-info=x"},
+			},
+		},
+		{value: "orig-ioi=home1.net", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseChargingVector(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseChargingVector(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseChargingVector(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+		if got == nil {
+			continue
+		}
+		// String round-trips
+		if again, err := ParseChargingVector(got.String()); err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("ParseChargingVector(%q) = %+v, %v", got.String(), again, err)
+		}
+	}
+}
+
+func TestEnsureChargingVector(t *testing.T) {
+	msg := &Message{Method: MethodINVITE}
+	v := EnsureChargingVector(msg, "pcscf.ims.local")
+	if len(v.ICID) != 32 || v.GeneratedAt != "pcscf.ims.local" {
+		t.Errorf("new charging vector = %+v", v)
+	}
+	if got := msg.GetHeader("P-Charging-Vector"); got != "icid-value="+v.ICID+";icid-generated-at=pcscf.ims.local" {
+		t.Errorf("P-Charging-Vector = %q", got)
+	}
+
+	// An existing vector is kept
+	v.OrigIOI = "ims.local"
+	SetChargingVector(msg, v)
+	if again := EnsureChargingVector(msg, "other"); !reflect.DeepEqual(again, v) {
+		t.Errorf("EnsureChargingVector() = %+v, want %+v", again, v)
+	}
+	if NewICID() == NewICID() {
+		t.Error("NewICID() is not unique")
+	}
+}
@@ -25,6 +25,7 @@ type Message struct {
 	// Transport info
 	Transport string // "udp", "tcp", "tls"
 	RemoteAddr string
+	LocalAddr  string // Address the message was received on
 }
 
 // IsRequest returns true if this is a SIP request
@@ -73,6 +74,15 @@ func (m *Message) AddHeader(name, value string) {
 	m.Headers[name] = append(m.Headers[name], value)
 }
 
+// RemoveHeader removes all values of a header (case-insensitive)
+func (m *Message) RemoveHeader(name string) {
+	for k := range m.Headers {
+		if strings.EqualFold(k, name) {
+			delete(m.Headers, k)
+		}
+	}
+}
+
 // String returns a string representation of the SIP message
 func (m *Message) String() string {
 	var sb strings.Builder
@@ -143,6 +153,7 @@ const (
 	StatusUnsupportedURIScheme  = 416
 	StatusBadExtension          = 420
 	StatusExtensionRequired     = 421
+	StatusSessionIntervalTooSmall = 422
 	StatusIntervalTooBrief      = 423
 	StatusTemporarilyUnavailable = 480
 	StatusCallLegTransactionDoesNotExist = 481
@@ -0,0 +1,271 @@
+package sip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session timer intervals (RFC 4028 section 4)
+const (
+	// DefaultSessionInterval is the recommended session interval
+	DefaultSessionInterval = 1800 * time.Second
+
+	// MinSessionInterval is the smallest Min-SE a node may require
+	MinSessionInterval = 90 * time.Second
+)
+
+// Refreshers of a session
+const (
+	RefresherUAC = "uac"
+	RefresherUAS = "uas"
+)
+
+// OptionTimer is the option tag of the session timer extension
+const OptionTimer = "timer"
+
+// SessionExpires is a Session-Expires header (RFC 4028 section 4)
+type SessionExpires struct {
+	Interval time.Duration
+
+	// Refresher is RefresherUAC or RefresherUAS, empty until the UAS
+	// chooses it. In a session timer returned by
+	// SessionTimerPolicy.CheckResponse it is empty when neither UA
+	// refreshes the session.
+	Refresher string
+}
+
+// ParseSessionExpires parses a Session-Expires header value
+func ParseSessionExpires(value string) (*SessionExpires, error) {
+	delta, params, _ := strings.Cut(value, ";")
+	interval, err := parseDeltaSeconds(delta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Session-Expires %q: %w", value, err)
+	}
+	se := &SessionExpires{Interval: interval}
+	for _, param := range strings.Split(params, ";") {
+		name, val, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "refresher") {
+			continue
+		}
+		switch refresher := strings.ToLower(strings.TrimSpace(val)); refresher {
+		case RefresherUAC, RefresherUAS:
+			se.Refresher = refresher
+		default:
+			return nil, fmt.Errorf("invalid Session-Expires refresher %q", val)
+		}
+	}
+	return se, nil
+}
+
+// String returns the header value of se
+func (se *SessionExpires) String() string {
+	value := strconv.Itoa(int(se.Interval / time.Second))
+	if se.Refresher != "" {
+		value += ";refresher=" + se.Refresher
+	}
+	return value
+}
+
+// ParseMinSE parses a Min-SE header value
+func ParseMinSE(value string) (time.Duration, error) {
+	delta, _, _ := strings.Cut(value, ";")
+	interval, err := parseDeltaSeconds(delta)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Min-SE %q: %w", value, err)
+	}
+	return interval, nil
+}
+
+// parseDeltaSeconds parses the delta-seconds of a header value
+func parseDeltaSeconds(value string) (time.Duration, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// GetSessionExpires returns the Session-Expires of msg, in its long or
+// compact form; it returns nil when msg has none or it is invalid
+func GetSessionExpires(msg *Message) *SessionExpires {
+	value := msg.GetHeader("Session-Expires")
+	if value == "" {
+		value = msg.GetHeader("x")
+	}
+	if value == "" {
+		return nil
+	}
+	se, err := ParseSessionExpires(value)
+	if err != nil {
+		return nil
+	}
+	return se
+}
+
+// SetSessionExpires replaces the Session-Expires of msg with se
+func SetSessionExpires(msg *Message, se *SessionExpires) {
+	msg.RemoveHeader("x")
+	msg.RemoveHeader("Session-Expires")
+	msg.SetHeader("Session-Expires", se.String())
+}
+
+// GetMinSE returns the Min-SE of msg, MinSessionInterval when it has none
+// or it is invalid
+func GetMinSE(msg *Message) time.Duration {
+	minSE, err := ParseMinSE(msg.GetHeader("Min-SE"))
+	if err != nil || minSE < MinSessionInterval {
+		return MinSessionInterval
+	}
+	return minSE
+}
+
+// SupportsTimer reports whether msg lists the timer option tag in its
+// Supported or Require headers
+func SupportsTimer(msg *Message) bool {
+	for _, name := range []string{"Supported", "k", "Require"} {
+		for _, value := range msg.GetHeaderAll(name) {
+			for _, option := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(option), OptionTimer) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// SessionTimerPolicy is the session timer policy of a proxy or B2BUA
+type SessionTimerPolicy struct {
+	// Interval is the session interval requested of sessions without
+	// one, and the largest one let through
+	Interval time.Duration
+
+	// MinSE is the smallest session interval accepted
+	MinSE time.Duration
+}
+
+// NewSessionTimerPolicy returns the policy of a session interval, the
+// default one when interval is 0
+func NewSessionTimerPolicy(interval time.Duration) SessionTimerPolicy {
+	if interval <= 0 {
+		interval = DefaultSessionInterval
+	}
+	if interval < MinSessionInterval {
+		interval = MinSessionInterval
+	}
+	return SessionTimerPolicy{Interval: interval, MinSE: MinSessionInterval}
+}
+
+// CheckRequest applies p to an INVITE or UPDATE forwarded (RFC 4028 section
+// 8.1). A session interval below the Min-SE of p is rejected with the 422
+// response returned. Otherwise req gets a Session-Expires of at most the
+// interval of p and a Min-SE of at least the one of p, and CheckRequest
+// returns nil.
+func (p SessionTimerPolicy) CheckRequest(req *Message) *Message {
+	se := GetSessionExpires(req)
+	if se != nil && se.Interval < p.MinSE {
+		response := &Message{
+			Version:    "SIP/2.0",
+			StatusCode: StatusSessionIntervalTooSmall,
+			StatusText: "Session Interval Too Small",
+			Headers:    make(map[string][]string),
+		}
+		for _, name := range []string{"Via", "From", "To", "Call-ID", "CSeq"} {
+			for _, value := range req.GetHeaderAll(name) {
+				response.AddHeader(name, value)
+			}
+		}
+		response.SetHeader("Min-SE", strconv.Itoa(int(p.MinSE/time.Second)))
+		response.SetHeader("Content-Length", "0")
+		return response
+	}
+
+	minSE := GetMinSE(req)
+	if minSE < p.MinSE {
+		minSE = p.MinSE
+		req.SetHeader("Min-SE", strconv.Itoa(int(minSE/time.Second)))
+	}
+	interval := p.Interval
+	if interval < minSE {
+		interval = minSE
+	}
+	// The refresher is chosen by the UAS; a proxy never sets it
+	switch {
+	case se == nil:
+		SetSessionExpires(req, &SessionExpires{Interval: interval})
+	case se.Interval > interval:
+		se.Interval = interval
+		SetSessionExpires(req, se)
+	}
+	return nil
+}
+
+// CheckResponse applies p to a 2xx response to an INVITE or UPDATE that
+// went through CheckRequest, and returns the session timer negotiated (RFC
+// 4028 section 8.2). A UAS that does not support session timers leaves the
+// refresh to the UAC when it supports them: resp then gets the
+// Session-Expires of req with refresher=uac. CheckResponse returns nil when
+// the request had no session timer.
+func (p SessionTimerPolicy) CheckResponse(req, resp *Message) *SessionExpires {
+	requested := GetSessionExpires(req)
+	if requested == nil {
+		return nil
+	}
+	uac := SupportsTimer(req)
+	if se := GetSessionExpires(resp); se != nil {
+		if se.Refresher == "" {
+			// The UAS must choose; it failed to, so choose as it would
+			// have (RFC 4028 section 9)
+			se.Refresher = RefresherUAS
+			if uac {
+				se.Refresher = RefresherUAC
+			}
+			SetSessionExpires(resp, se)
+		}
+		return se
+	}
+	se := &SessionExpires{Interval: requested.Interval}
+	if uac {
+		se.Refresher = RefresherUAC
+		SetSessionExpires(resp, se)
+		resp.AddHeader("Require", OptionTimer)
+	}
+	return se
+}
+
+// SessionTimer tracks the refreshes of a session (RFC 4028 section 10)
+type SessionTimer struct {
+	SessionExpires
+	Refreshed time.Time
+}
+
+// NewSessionTimer returns the timer of a session negotiated se at now
+func NewSessionTimer(se *SessionExpires, now time.Time) *SessionTimer {
+	return &SessionTimer{SessionExpires: *se, Refreshed: now}
+}
+
+// Refresh restarts t with the session timer se of a refresh at now
+func (t *SessionTimer) Refresh(se *SessionExpires, now time.Time) {
+	if se != nil {
+		t.SessionExpires = *se
+	}
+	t.Refreshed = now
+}
+
+// RefreshAt returns when the refresher sends its refresh, at half the
+// session interval
+func (t *SessionTimer) RefreshAt() time.Time {
+	return t.Refreshed.Add(t.Interval / 2)
+}
+
+// ExpiresAt returns when a session without refresh has expired: the
+// session interval less a third of it or 32 seconds, whichever is smaller
+func (t *SessionTimer) ExpiresAt() time.Time {
+	margin := t.Interval / 3
+	if margin > 32*time.Second {
+		margin = 32 * time.Second
+	}
+	return t.Refreshed.Add(t.Interval - margin)
+}
@@ -0,0 +1,145 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSessionExpires(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    SessionExpires
+		wantErr bool
+	}{
+		{value: "1800", want: SessionExpires{Interval: 1800 * time.Second}},
+		{value: "4000;refresher=uac", want: SessionExpires{Interval: 4000 * time.Second, Refresher: RefresherUAC}},
+		{value: " 90 ; Refresher=UAS;x=1", want: SessionExpires{Interval: 90 * time.Second, Refresher: RefresherUAS}},
+		{value: "1800;refresher=proxy", wantErr: true},
+		{value: "-5", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSessionExpires(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSessionExpires(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != nil && *got != tt.want {
+			t.Errorf("ParseSessionExpires(%q) = %+v, want %+v", tt.value, *got, tt.want)
+		}
+	}
+	if got := (&SessionExpires{Interval: 600 * time.Second, Refresher: RefresherUAS}).String(); got != "600;refresher=uas" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+// invite returns an INVITE with the given headers
+func invite(headers ...string) *Message {
+	msg := &Message{Method: MethodINVITE, URI: "sip:bob@ims.local", Version: "SIP/2.0", Headers: make(map[string][]string)}
+	msg.SetHeader("Via", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1")
+	msg.SetHeader("Call-ID", "st1")
+	msg.SetHeader("CSeq", "1 INVITE")
+	for i := 0; i+1 < len(headers); i += 2 {
+		msg.AddHeader(headers[i], headers[i+1])
+	}
+	return msg
+}
+
+func TestSessionTimerPolicy_CheckRequest(t *testing.T) {
+	p := SessionTimerPolicy{Interval: 1800 * time.Second, MinSE: 120 * time.Second}
+	tests := []struct {
+		name      string
+		req       *Message
+		wantCode  int
+		wantSE    string
+		wantMinSE string
+	}{
+		{"no timer", invite(), 0, "1800", "120"},
+		{"compact form", invite("x", "900"), 0, "900", "120"},
+		{"lowered", invite("Session-Expires", "7200"), 0, "1800", "120"},
+		{"larger Min-SE kept", invite("Session-Expires", "7200", "Min-SE", "3600"), 0, "3600", "3600"},
+		{"too small", invite("Session-Expires", "100", "Min-SE", "90"), StatusSessionIntervalTooSmall, "100", "90"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := p.CheckRequest(tt.req)
+			if tt.wantCode != 0 {
+				if response == nil || response.StatusCode != tt.wantCode || response.GetHeader("Min-SE") != "120" {
+					t.Fatalf("CheckRequest() = %+v, want %d with Min-SE 120", response, tt.wantCode)
+				}
+				if response.GetHeader("Call-ID") != "st1" || response.GetHeader("CSeq") != "1 INVITE" {
+					t.Errorf("422 headers = %v", response.Headers)
+				}
+				return
+			}
+			if response != nil {
+				t.Fatalf("CheckRequest() = %d, want nil", response.StatusCode)
+			}
+			if got := GetSessionExpires(tt.req); got == nil || got.String() != tt.wantSE {
+				t.Errorf("Session-Expires = %v, want %q", got, tt.wantSE)
+			}
+			if got := tt.req.GetHeader("Min-SE"); got != tt.wantMinSE {
+				t.Errorf("Min-SE = %q, want %q", got, tt.wantMinSE)
+			}
+		})
+	}
+}
+
+func TestSessionTimerPolicy_CheckResponse(t *testing.T) {
+	p := NewSessionTimerPolicy(0)
+	tests := []struct {
+		name        string
+		req         *Message
+		resp        []string
+		want        *SessionExpires
+		wantRequire bool
+	}{
+		{"no timer requested", invite(), nil, nil, false},
+		{"UAS refreshes", invite("Session-Expires", "1800", "Supported", "timer"),
+			[]string{"Session-Expires", "1800;refresher=uas"}, &SessionExpires{Interval: 1800 * time.Second, Refresher: RefresherUAS}, false},
+		{"UAS without timer", invite("Session-Expires", "1000", "Supported", "100rel, timer"),
+			nil, &SessionExpires{Interval: 1000 * time.Second, Refresher: RefresherUAC}, true},
+		{"neither UA", invite("Session-Expires", "1800"),
+			nil, &SessionExpires{Interval: 1800 * time.Second}, false},
+		{"refresher chosen for the UAS", invite("Session-Expires", "1800"),
+			[]string{"Session-Expires", "1200"}, &SessionExpires{Interval: 1200 * time.Second, Refresher: RefresherUAS}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &Message{Version: "SIP/2.0", StatusCode: StatusOK, StatusText: "OK", Headers: make(map[string][]string)}
+			for i := 0; i+1 < len(tt.resp); i += 2 {
+				resp.SetHeader(tt.resp[i], tt.resp[i+1])
+			}
+			got := p.CheckResponse(tt.req, resp)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Fatalf("CheckResponse() = %+v, want %+v", got, tt.want)
+			}
+			if got != nil && got.Refresher != "" && resp.GetHeader("Session-Expires") != got.String() {
+				t.Errorf("response Session-Expires = %q, want %q", resp.GetHeader("Session-Expires"), got.String())
+			}
+			if SupportsTimer(resp) != tt.wantRequire && tt.resp == nil {
+				t.Errorf("response Require = %v", resp.GetHeaderAll("Require"))
+			}
+		})
+	}
+}
+
+func TestSessionTimer(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	timer := NewSessionTimer(&SessionExpires{Interval: 1800 * time.Second, Refresher: RefresherUAC}, start)
+	if got := timer.RefreshAt(); !got.Equal(start.Add(900 * time.Second)) {
+		t.Errorf("RefreshAt() = %v", got)
+	}
+	if got := timer.ExpiresAt(); !got.Equal(start.Add(1768 * time.Second)) {
+		t.Errorf("ExpiresAt() = %v, want 32s before the interval", got)
+	}
+
+	// Short intervals expire a third early
+	timer.Refresh(&SessionExpires{Interval: 90 * time.Second}, start.Add(time.Minute))
+	if got := timer.ExpiresAt(); !got.Equal(start.Add(time.Minute + 60*time.Second)) {
+		t.Errorf("ExpiresAt() after refresh = %v", got)
+	}
+	if timer.Refresher != "" {
+		t.Errorf("Refresher = %q after refresh without one", timer.Refresher)
+	}
+}
@@ -0,0 +1,102 @@
+package sip
+
+import (
+	"net"
+	"strings"
+)
+
+// TrustDomainHeaders are the headers only believed when they come from a
+// node of the trust domain (RFC 3325, TS 24.229 section 4.4)
+var TrustDomainHeaders = []string{
+	"P-Asserted-Identity",
+	"P-Charging-Vector",
+	"P-Charging-Function-Addresses",
+	"P-Access-Network-Info",
+}
+
+// TrustDomain is a trust domain of RFC 3325: the nodes that comply with the
+// same Spec(T) and so assert identities for each other
+type TrustDomain struct {
+	nets  []*net.IPNet
+	hosts map[string]bool
+}
+
+// NewTrustDomain creates the trust domain of the nodes in networks, given
+// as CIDRs, IP addresses or host names. Without networks the domain
+// contains no node, so no asserted identity is believed.
+func NewTrustDomain(networks []string) *TrustDomain {
+	d := &TrustDomain{hosts: make(map[string]bool)}
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(network); err == nil {
+			d.nets = append(d.nets, ipNet)
+			continue
+		}
+		d.hosts[strings.ToLower(network)] = true
+	}
+	return d
+}
+
+// Contains reports whether the node at addr, a host or host:port, is part
+// of the trust domain. A nil domain contains no node.
+func (d *TrustDomain) Contains(addr string) bool {
+	if d == nil {
+		return false
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if d.hosts[strings.ToLower(host)] {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range d.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Police removes the trust domain headers of msg when it was received from
+// outside the domain and returns the names of the headers it removed
+func (d *TrustDomain) Police(msg *Message) []string {
+	if d.Contains(msg.RemoteAddr) {
+		return nil
+	}
+	return StripTrustDomainHeaders(msg)
+}
+
+// StripTrustDomainHeaders removes the trust domain headers of msg and
+// returns the names of the headers it removed
+func StripTrustDomainHeaders(msg *Message) []string {
+	var removed []string
+	for _, name := range TrustDomainHeaders {
+		if len(msg.GetHeaderAll(name)) > 0 {
+			msg.RemoveHeader(name)
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// Egress removes what msg must not carry out of the trust domain: the
+// charging headers, and the asserted identity of a user who requested
+// privacy with "Privacy: id" (RFC 3325 section 5)
+func Egress(msg *Message) {
+	msg.RemoveHeader("P-Charging-Vector")
+	msg.RemoveHeader("P-Charging-Function-Addresses")
+	for _, privacy := range msg.GetHeaderAll("Privacy") {
+		for _, value := range strings.Split(privacy, ";") {
+			if strings.EqualFold(strings.TrimSpace(value), "id") {
+				msg.RemoveHeader("P-Asserted-Identity")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package sip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrustDomain_Contains(t *testing.T) {
+	for _, networks := range [][]string{nil, {" "}} {
+		if d := NewTrustDomain(networks); d == nil || d.Contains("10.1.2.3:5060") || d.Contains("") {
+			t.Errorf("NewTrustDomain(%q) = %v, want an empty domain", networks, d)
+		}
+	}
+
+	d := NewTrustDomain([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1/32", "scscf.ims.local"})
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3:5060", true},
+		{"10.1.2.3", true},
+		{"[2001:db8::1]:5060", true},
+		{"192.0.2.1:5060", true},
+		{"192.0.2.2:5060", false},
+		{"SCSCF.ims.local:5060", true},
+		{"ue.example.com:5060", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := d.Contains(tt.addr); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTrustDomain_Police(t *testing.T) {
+	d := NewTrustDomain([]string{"10.0.0.0/8"})
+	newMsg := func(remoteAddr string) *Message {
+		return &Message{
+			Method:     MethodINVITE,
+			RemoteAddr: remoteAddr,
+			Headers: map[string][]string{
+				"From":                  {"<sip:alice@ims.local>;tag=1"},
+				"p-asserted-identity":   {"<sip:alice@ims.local>"},
+				"P-Charging-Vector":     {"icid-value=1234"},
+				"P-Access-Network-Info": {"3GPP-E-UTRAN-FDD; utran-cell-id-3gpp=2340100010000001"},
+			},
+		}
+	}
+
+	msg := newMsg("10.0.0.5:5060")
+	if removed := d.Police(msg); removed != nil || len(msg.Headers) != 4 {
+		t.Errorf("Police() from the trust domain removed %v", removed)
+	}
+
+	msg = newMsg("198.51.100.7:5060")
+	removed := d.Police(msg)
+	if want := []string{"P-Asserted-Identity", "P-Charging-Vector", "P-Access-Network-Info"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Police() removed %v, want %v", removed, want)
+	}
+	if len(msg.Headers) != 1 || msg.GetHeader("From") == "" {
+		t.Errorf("Police() left %v", msg.Headers)
+	}
+}
+
+func TestEgress(t *testing.T) {
+	msg := &Message{Headers: map[string][]string{
+		"P-Asserted-Identity": {"<sip:alice@ims.local>"},
+		"P-Charging-Vector":   {"icid-value=1234"},
+		"Privacy":             {"header; id"},
+	}}
+	Egress(msg)
+	if len(msg.Headers) != 1 {
+		t.Errorf("Egress() with Privacy: id left %v", msg.Headers)
+	}
+
+	msg = &Message{Headers: map[string][]string{
+		"P-Asserted-Identity": {"<sip:alice@ims.local>"},
+		"Privacy":             {"none"},
+	}}
+	Egress(msg)
+	if msg.GetHeader("P-Asserted-Identity") == "" {
+		t.Error("Egress() without privacy removed P-Asserted-Identity")
+	}
+}
@@ -1,16 +1,22 @@
 package stir
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/big"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/dasmlab/ims/internal/config"
@@ -21,60 +27,423 @@ import (
 // This addresses interoperability issues by using standard ACME protocol
 // instead of proprietary certificate distribution mechanisms
 type ACMECertificateManager struct {
-	config     *config.ACMEConfig
-	privateKey *ecdsa.PrivateKey
-	cert       *x509.Certificate
-	certURL    string
-	log        *logrus.Logger
-	httpClient *http.Client
+	config      *config.ACMEConfig
+	mu          sync.RWMutex
+	keys        KeyProvider
+	signer      *RotatingSigner
+	cert        *x509.Certificate
+	chainPEM    []byte
+	certURL     string
+	log         *logrus.Logger
+	httpClient  *http.Client
+	tokenSource SPCTokenSource
 }
 
+// acmeIssueTimeout bounds a complete ACME issuance (order to chain download)
+const acmeIssueTimeout = 5 * time.Minute
+
+// acmeStartupTimeout bounds the issuance attempted when the manager is
+// created, so that a slow directory does not hold up startup
+var acmeStartupTimeout = 30 * time.Second
+
 // NewACMECertificateManager creates a new ACME-based certificate manager for STIR/SHAKEN
+// with the signing key kept in a PEM file at KeyPath
 func NewACMECertificateManager(cfg *config.ACMEConfig, log *logrus.Logger) (*ACMECertificateManager, error) {
-	// Generate ECDSA key for STIR/SHAKEN (P-256 curve)
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
-	}
+	return NewACMECertificateManagerWithKeys(cfg, nil, log)
+}
 
+// NewACMECertificateManagerWithKeys creates a certificate manager whose signing
+// key comes from keys. If keys is nil the key is kept at KeyPath, or in memory
+// when KeyPath is empty.
+// A certificate persisted at CertPath is reused while it matches the key and is
+// not due for renewal; otherwise a certificate is obtained from the ACME
+// directory, or self-signed for development if no directory is configured.
+// A persisted certificate that is due for renewal but still valid is kept when
+// the directory cannot issue one. A directory that does not issue within
+// acmeStartupTimeout leaves the manager without a certificate until
+// StartRenewal obtains one; check HasCertificate before signing.
+func NewACMECertificateManagerWithKeys(cfg *config.ACMEConfig, keys KeyProvider, log *logrus.Logger) (*ACMECertificateManager, error) {
 	mgr := &ACMECertificateManager{
-		config:     cfg,
-		privateKey: privateKey,
-		log:        log,
+		config:  cfg,
+		keys:    keys,
+		certURL: fmt.Sprintf("https://%s/.well-known/stir/cert.pem", cfg.Domain),
+		log:     log,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		tokenSource: NewSPCTokenSource(cfg),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeStartupTimeout)
+	defer cancel()
+
+	key, err := mgr.initialKey(ctx)
+	if err != nil {
+		return nil, err
 	}
+	mgr.signer = NewRotatingSigner(key)
 
-	// Initialize certificate (will be obtained via ACME)
-	if err := mgr.obtainCertificate(); err != nil {
-		return nil, fmt.Errorf("failed to obtain certificate: %w", err)
+	persisted := false
+	if key, err = mgr.loadPersisted(ctx, key); err != nil {
+		log.WithError(err).Debug("no usable persisted STIR certificate")
+	} else if !mgr.needsRenewal(time.Now()) {
+		log.WithField("expires", mgr.CertificateExpiry()).Info("loaded persisted STIR/SHAKEN certificate")
+		return mgr, nil
+	} else {
+		persisted = time.Now().Before(mgr.CertificateExpiry())
+	}
+
+	if err := mgr.issue(ctx, key, nil); err != nil {
+		switch {
+		case persisted:
+			// The persisted certificate is due for renewal but still valid:
+			// keep signing with it while StartRenewal retries
+			log.WithError(err).WithField("expires", mgr.CertificateExpiry()).
+				Warn("STIR/SHAKEN certificate renewal failed, using the persisted certificate")
+		case errors.Is(err, context.DeadlineExceeded):
+			// The directory is slow: start without a certificate, and without
+			// signing, while StartRenewal retries
+			log.WithError(err).Warn("STIR/SHAKEN certificate not issued yet, retrying in the background")
+		default:
+			return nil, fmt.Errorf("failed to obtain certificate: %w", err)
+		}
 	}
 
 	return mgr, nil
 }
 
-// obtainCertificate obtains a certificate via ACME
-// This is a simplified implementation - full ACME client would be more complex
-func (m *ACMECertificateManager) obtainCertificate() error {
-	// TODO: Implement full ACME protocol (RFC 8555)
-	// For now, this is a placeholder that shows the integration point
-	
-	// In a full implementation, this would:
-	// 1. Create account with ACME provider
-	// 2. Request certificate for domain
-	// 3. Complete HTTP-01 or DNS-01 challenge
-	// 4. Download certificate
-	// 5. Store certificate and key
-	
-	m.log.Info("ACME certificate management initialized (placeholder)")
-	
-	// For now, generate a self-signed cert for development
-	return m.generateSelfSignedCert()
+// initialKey returns the signing key from the key provider, defaulting to a
+// file key at KeyPath. A key file that cannot be used is an error: a key
+// only kept in memory would be replaced, with its certificate, on restart.
+func (m *ACMECertificateManager) initialKey(ctx context.Context) (crypto.Signer, error) {
+	if m.keys == nil {
+		keys, err := NewKeyProvider(&config.STIRKeyConfig{}, m.config.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		m.keys = keys
+	}
+	key, err := m.keys.Signer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load STIR signing key: %w", err)
+	}
+	return key, nil
+}
+
+// SetSPCTokenSource overrides the SPC token source built from configuration
+func (m *ACMECertificateManager) SetSPCTokenSource(source SPCTokenSource) {
+	m.tokenSource = source
+}
+
+// issue obtains a certificate for key via ACME, or a self-signed development
+// certificate when no ACME directory is configured, and installs both. commit,
+// if not nil, commits a staged key once its certificate is obtained.
+func (m *ACMECertificateManager) issue(ctx context.Context, key crypto.Signer, commit func() error) error {
+	if m.config.DirectoryURL == "" {
+		m.log.Warn("no ACME directory configured, using self-signed STIR/SHAKEN certificate")
+		return m.generateSelfSignedCert(key, commit)
+	}
+	return m.obtainACMECertificate(ctx, key, commit)
+}
+
+// install makes key and its certificate current. New signatures use key from
+// now on; signatures already in progress finish with the previous key.
+func (m *ACMECertificateManager) install(key crypto.Signer, cert *x509.Certificate, chainPEM []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert = cert
+	m.chainPEM = chainPEM
+	m.signer.Rotate(key)
+}
+
+// RotateKey moves to a new signing key. The key provider stages the key and a
+// certificate is obtained for it before the key is committed and any new
+// signature uses it; if issuance fails the current key and certificate stay
+// in use, also after a restart.
+func (m *ACMECertificateManager) RotateKey(ctx context.Context) error {
+	next, commit, err := m.keys.Rotate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to rotate STIR signing key: %w", err)
+	}
+	if err := m.issue(ctx, next, commit); err != nil {
+		return fmt.Errorf("failed to obtain certificate for rotated key: %w", err)
+	}
+	m.log.Info("STIR/SHAKEN signing key rotated")
+	return nil
+}
+
+// obtainACMECertificate runs an RFC 8555 issuance for key and the configured
+// SPC, proving authority with a tkauth-01 challenge (RFC 9447/9448)
+func (m *ACMECertificateManager) obtainACMECertificate(ctx context.Context, key crypto.Signer, commit func() error) error {
+	if m.config.SPC == "" {
+		return fmt.Errorf("ACME issuance requires a Service Provider Code")
+	}
+	if m.tokenSource == nil {
+		return fmt.Errorf("ACME issuance requires an SPC token source")
+	}
+
+	accountKey, err := m.loadOrCreateAccountKey()
+	if err != nil {
+		return err
+	}
+	client := NewACMEClient(m.config.DirectoryURL, accountKey, m.httpClient)
+
+	var contact []string
+	if m.config.Email != "" {
+		contact = []string{"mailto:" + m.config.Email}
+	}
+	if err := client.Register(ctx, contact); err != nil {
+		return err
+	}
+
+	identifier, err := TNAuthListIdentifier(m.config.SPC)
+	if err != nil {
+		return err
+	}
+	order, err := client.NewOrder(ctx, []ACMEIdentifier{identifier})
+	if err != nil {
+		return err
+	}
+
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+
+	csr, err := CreateSTICSR(key, m.config.SPC)
+	if err != nil {
+		return err
+	}
+	order, err = client.FinalizeOrder(ctx, order, csr)
+	if err != nil {
+		return err
+	}
+	if order.Certificate == "" {
+		return fmt.Errorf("ACME order is valid but has no certificate URL")
+	}
+
+	chainPEM, err := client.DownloadCertificate(ctx, order.Certificate)
+	if err != nil {
+		return err
+	}
+	cert, err := parseLeafCertificate(chainPEM, key.Public())
+	if err != nil {
+		return err
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			return fmt.Errorf("failed to commit STIR signing key: %w", err)
+		}
+	}
+	if err := m.persist(chainPEM); err != nil {
+		return err
+	}
+	m.install(key, cert, chainPEM)
+
+	m.log.WithFields(logrus.Fields{
+		"spc":      m.config.SPC,
+		"expires":  cert.NotAfter,
+		"cert_url": m.certURL,
+	}).Info("STIR/SHAKEN certificate issued via ACME")
+
+	return nil
+}
+
+// authorize completes the tkauth-01 challenge of an authorization
+func (m *ACMECertificateManager) authorize(ctx context.Context, client *ACMEClient, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var challenge *ACMEChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == ChallengeTKAuth01 {
+			challenge = &authz.Challenges[i]
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("authorization for %s offers no %s challenge", authz.Identifier.Type, ChallengeTKAuth01)
+	}
+
+	fingerprint, err := client.AccountKeyFingerprint()
+	if err != nil {
+		return err
+	}
+	token, err := m.tokenSource.SPCToken(ctx, m.config.SPC, fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to obtain SPC token: %w", err)
+	}
+
+	if err := client.RespondTKAuth(ctx, challenge, token); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authzURL)
+	return err
+}
+
+// acmeMinRenewalInterval is the shortest time between two renewals
+const acmeMinRenewalInterval = time.Minute
+
+// StartRenewal renews the certificate before it expires until ctx is done.
+// Failed renewals are retried with backoff while the current certificate is valid.
+func (m *ACMECertificateManager) StartRenewal(ctx context.Context) {
+	go func() {
+		retry := time.Minute
+		renewed := false
+		for {
+			wait := time.Until(m.renewalTime())
+			if renewed && wait < acmeMinRenewalInterval {
+				// A new certificate already due for renewal is not
+				// renewed again right away
+				wait = acmeMinRenewalInterval
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := m.RenewCertificate(); err != nil {
+				m.log.WithError(err).WithField("retry_in", retry).Error("STIR/SHAKEN certificate renewal failed")
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry):
+				}
+				if retry < time.Hour {
+					retry *= 2
+				}
+				renewed = false
+				continue
+			}
+			retry = time.Minute
+			renewed = true
+		}
+	}()
+}
+
+// renewalTime returns when the current certificate should be renewed
+func (m *ACMECertificateManager) renewalTime() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return time.Now()
+	}
+	// A RenewBefore not shorter than the lifetime of the certificate would
+	// make every certificate due at once: renew at two thirds instead
+	lifetime := m.cert.NotAfter.Sub(m.cert.NotBefore)
+	if m.config.RenewBefore > 0 && m.config.RenewBefore < lifetime {
+		return m.cert.NotAfter.Add(-m.config.RenewBefore)
+	}
+	return m.cert.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// needsRenewal reports whether the certificate is missing or due for renewal at now
+func (m *ACMECertificateManager) needsRenewal(now time.Time) bool {
+	return !now.Before(m.renewalTime())
+}
+
+// loadPersisted loads the certificate chain at CertPath if it certifies key
+// and returns key. A provider keeping earlier keys may still hold the key of
+// the certificate when a rotation was not committed; that key is returned
+// then. key is returned unchanged when no persisted certificate is usable.
+func (m *ACMECertificateManager) loadPersisted(ctx context.Context, key crypto.Signer) (crypto.Signer, error) {
+	if m.config.CertPath == "" {
+		return key, fmt.Errorf("certificate persistence is not configured")
+	}
+
+	chainPEM, err := os.ReadFile(m.config.CertPath)
+	if err != nil {
+		return key, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	cert, err := parseLeafCertificate(chainPEM, key.Public())
+	if finder, ok := m.keys.(keyFinder); ok && err != nil {
+		leaf, parseErr := parseLeafCertificate(chainPEM, nil)
+		if parseErr != nil {
+			return key, parseErr
+		}
+		certified, findErr := finder.SignerFor(ctx, leaf.PublicKey)
+		if findErr != nil {
+			return key, err
+		}
+		key, cert, err = certified, leaf, nil
+	}
+	if err != nil {
+		return key, err
+	}
+
+	m.install(key, cert, chainPEM)
+	return key, nil
+}
+
+// persist writes the certificate chain to CertPath; the key is persisted by
+// its KeyProvider
+func (m *ACMECertificateManager) persist(chainPEM []byte) error {
+	if m.config.CertPath == "" {
+		return nil
+	}
+	if err := writeFileAtomic(m.config.CertPath, chainPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return nil
+}
+
+// loadOrCreateAccountKey loads the ACME account key, generating and
+// persisting one at AccountKeyPath if it does not exist yet
+func (m *ACMECertificateManager) loadOrCreateAccountKey() (*ecdsa.PrivateKey, error) {
+	path := m.config.AccountKeyPath
+	if path != "" {
+		key, err := loadECKey(path)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+	if path != "" {
+		if err := writeECKey(path, key); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// parseLeafCertificate parses the first certificate of a PEM chain and
+// checks that it certifies pub, if not nil
+func parseLeafCertificate(chainPEM []byte, pub crypto.PublicKey) (*x509.Certificate, error) {
+	block, _ := pem.Decode(chainPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	certKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || (pub != nil && !certKey.Equal(pub)) {
+		return nil, fmt.Errorf("certificate does not match the signing key")
+	}
+	return cert, nil
 }
 
 // generateSelfSignedCert generates a self-signed certificate for development
-func (m *ACMECertificateManager) generateSelfSignedCert() error {
+func (m *ACMECertificateManager) generateSelfSignedCert(key crypto.Signer, commit func() error) error {
 	template := x509.Certificate{
 		SerialNumber:          big.NewInt(1),
 		Subject: pkix.Name{
@@ -88,7 +457,7 @@ func (m *ACMECertificateManager) generateSelfSignedCert() error {
 		BasicConstraintsValid: true,
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &m.privateKey.PublicKey, m.privateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
 	if err != nil {
 		return fmt.Errorf("failed to create certificate: %w", err)
 	}
@@ -98,8 +467,12 @@ func (m *ACMECertificateManager) generateSelfSignedCert() error {
 		return fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
-	m.cert = cert
-	m.certURL = fmt.Sprintf("https://%s/.well-known/stir/cert.pem", m.config.Domain)
+	if commit != nil {
+		if err := commit(); err != nil {
+			return fmt.Errorf("failed to commit STIR signing key: %w", err)
+		}
+	}
+	m.install(key, cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
 
 	m.log.WithFields(logrus.Fields{
 		"domain": m.config.Domain,
@@ -109,9 +482,24 @@ func (m *ACMECertificateManager) generateSelfSignedCert() error {
 	return nil
 }
 
-// GetPrivateKey returns the private key for signing
+// GetPrivateKey returns the current signing key if it is an in-process ECDSA
+// key, or nil for keys held in an HSM or Vault (use GetSigner)
 func (m *ACMECertificateManager) GetPrivateKey() *ecdsa.PrivateKey {
-	return m.privateKey
+	key, _ := m.signer.Current().(*ecdsa.PrivateKey)
+	return key
+}
+
+// GetSigner returns the signer for PASSporTs. It follows key rotation, so
+// signers created from it never need to be rebuilt.
+func (m *ACMECertificateManager) GetSigner() crypto.Signer {
+	return m.signer
+}
+
+// CertificateChainPEM returns the PEM certificate chain to publish at the certificate URL
+func (m *ACMECertificateManager) CertificateChainPEM() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.chainPEM
 }
 
 // GetCertificateURL returns the URL where the certificate can be fetched
@@ -161,11 +549,23 @@ func (m *ACMECertificateManager) FetchCertificate(certURL string) (*ecdsa.Public
 // RenewCertificate renews the certificate before expiration
 func (m *ACMECertificateManager) RenewCertificate() error {
 	m.log.Info("renewing STIR/SHAKEN certificate via ACME")
-	return m.obtainCertificate()
+	ctx, cancel := context.WithTimeout(context.Background(), acmeIssueTimeout)
+	defer cancel()
+	return m.issue(ctx, m.signer.Current(), nil)
+}
+
+// HasCertificate reports whether a certificate for the signing key has been
+// obtained, i.e. whether PASSporTs signed now can be verified
+func (m *ACMECertificateManager) HasCertificate() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert != nil
 }
 
 // CertificateExpiry returns when the certificate expires
 func (m *ACMECertificateManager) CertificateExpiry() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	if m.cert == nil {
 		return time.Time{}
 	}
@@ -1,6 +1,13 @@
 package stir
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -123,3 +130,258 @@ func TestACMECertificateManager_RenewCertificate(t *testing.T) {
 		t.Error("RenewCertificate() should extend expiry")
 	}
 }
+
+func newTestACMEConfig(t *testing.T, directoryURL string) *config.ACMEConfig {
+	dir := t.TempDir()
+	return &config.ACMEConfig{
+		Provider:       "custom",
+		Email:          "noc@example.com",
+		Domain:         "ims.local",
+		DirectoryURL:   directoryURL,
+		SPC:            "1234",
+		SPCToken:       "spc-token",
+		CertPath:       filepath.Join(dir, "stir.crt"),
+		KeyPath:        filepath.Join(dir, "stir.key"),
+		AccountKeyPath: filepath.Join(dir, "account.key"),
+	}
+}
+
+func TestACMECertificateManager_ObtainViaTKAuth(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+	if server.issuedCount() != 1 {
+		t.Fatalf("issued = %d, want 1", server.issuedCount())
+	}
+	if !mgr.HasCertificate() {
+		t.Error("HasCertificate() = false after issuance")
+	}
+
+	// The published chain is leaf + CA and certifies the signing key
+	chain := mgr.CertificateChainPEM()
+	block, rest := pem.Decode(chain)
+	if block == nil {
+		t.Fatal("CertificateChainPEM() has no certificate")
+	}
+	if next, _ := pem.Decode(rest); next == nil {
+		t.Error("CertificateChainPEM() does not include the issuer")
+	}
+	leaf, _ := x509.ParseCertificate(block.Bytes)
+	if !mgr.GetPrivateKey().PublicKey.Equal(leaf.PublicKey) {
+		t.Error("issued certificate does not match the signing key")
+	}
+
+	// Cert, key and account key are persisted
+	for _, path := range []string{cfg.CertPath, cfg.KeyPath, cfg.AccountKeyPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be persisted: %v", path, err)
+		}
+	}
+	if info, err := os.Stat(cfg.KeyPath); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// A second manager reuses the persisted certificate without a new order
+	reloaded, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() reload error = %v", err)
+	}
+	if server.issuedCount() != 1 {
+		t.Errorf("issued = %d after reload, want 1", server.issuedCount())
+	}
+	if !reloaded.GetPrivateKey().Equal(mgr.GetPrivateKey()) {
+		t.Error("reloaded manager does not use the persisted key")
+	}
+
+	// Renewal issues a new certificate for the same key
+	if err := mgr.RenewCertificate(); err != nil {
+		t.Fatalf("RenewCertificate() error = %v", err)
+	}
+	if server.issuedCount() != 2 {
+		t.Errorf("issued = %d after renewal, want 2", server.issuedCount())
+	}
+}
+
+func TestACMECertificateManager_RejectedToken(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	cfg.SPCToken = "stale-token"
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	if _, err := NewACMECertificateManager(cfg, log); err == nil {
+		t.Fatal("NewACMECertificateManager() succeeded with a rejected SPC token")
+	}
+	if _, err := os.Stat(cfg.CertPath); err == nil {
+		t.Error("certificate persisted although issuance failed")
+	}
+}
+
+func TestACMECertificateManager_MissingSPC(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	cfg.SPC = ""
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	if _, err := NewACMECertificateManager(cfg, log); err == nil {
+		t.Fatal("NewACMECertificateManager() succeeded without an SPC")
+	}
+}
+
+func TestACMECertificateManager_SlowDirectory(t *testing.T) {
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer directory.Close()
+	cfg := newTestACMEConfig(t, directory.URL)
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	timeout := acmeStartupTimeout
+	acmeStartupTimeout = 100 * time.Millisecond
+	defer func() { acmeStartupTimeout = timeout }()
+
+	// Startup does not wait for the directory; renewal keeps trying
+	mgr, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+	if mgr.HasCertificate() {
+		t.Error("HasCertificate() = true before a certificate was issued")
+	}
+	if wait := time.Until(mgr.renewalTime()); wait > 0 {
+		t.Errorf("renewal without a certificate in %v, want now", wait)
+	}
+}
+
+func TestACMECertificateManager_UnusableKeyFile(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	os.WriteFile(cfg.KeyPath, []byte("not a key"), 0600)
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	// An in-memory key would be certified and lost on the next restart
+	if _, err := NewACMECertificateManager(cfg, log); err == nil {
+		t.Fatal("NewACMECertificateManager() succeeded with an unusable key file")
+	}
+	if _, err := os.Stat(cfg.CertPath); err == nil {
+		t.Error("certificate issued for a key that is not persisted")
+	}
+}
+
+func TestACMECertificateManager_RenewalTime(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	server.lifetime = 30 * time.Hour
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+
+	mgr.mu.RLock()
+	notBefore, notAfter := mgr.cert.NotBefore, mgr.cert.NotAfter
+	mgr.mu.RUnlock()
+
+	// Default: two thirds of the certificate lifetime
+	want := notBefore.Add(notAfter.Sub(notBefore) * 2 / 3)
+	if got := mgr.renewalTime(); !got.Equal(want) {
+		t.Errorf("renewalTime() = %v, want %v", got, want)
+	}
+
+	cfg.RenewBefore = 2 * time.Hour
+	if got := mgr.renewalTime(); !got.Equal(notAfter.Add(-2 * time.Hour)) {
+		t.Errorf("renewalTime() with RenewBefore = %v, want %v", got, notAfter.Add(-2*time.Hour))
+	}
+	if mgr.needsRenewal(time.Now()) {
+		t.Error("needsRenewal() = true for a fresh certificate")
+	}
+	if !mgr.needsRenewal(notAfter.Add(-time.Hour)) {
+		t.Error("needsRenewal() = false inside the renewal window")
+	}
+
+	// A RenewBefore not shorter than the lifetime is ignored
+	cfg.RenewBefore = 40 * time.Hour
+	if got := mgr.renewalTime(); !got.Equal(want) {
+		t.Errorf("renewalTime() with RenewBefore past the lifetime = %v, want %v", got, want)
+	}
+}
+
+func TestACMECertificateManager_StartRenewal(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+
+	// Renew as soon as the certificate is within 12h of expiry, i.e. now
+	cfg.RenewBefore = 12 * time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr.StartRenewal(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.issuedCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.issuedCount() < 2 {
+		t.Fatalf("issued = %d, want scheduled renewal", server.issuedCount())
+	}
+
+	// The renewed certificate is due at once too, but is not renewed again
+	// right away
+	time.Sleep(200 * time.Millisecond)
+	if server.issuedCount() != 2 {
+		t.Errorf("issued = %d, want renewals spaced by %v", server.issuedCount(), acmeMinRenewalInterval)
+	}
+	cancel()
+}
+
+func TestACMECertificateManager_PersistedCertificateWithoutCA(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+	expiry := mgr.CertificateExpiry()
+
+	// The CA is unreachable when the persisted certificate is due for renewal
+	cfg.DirectoryURL = "http://127.0.0.1:1/directory"
+	cfg.RenewBefore = 12 * time.Hour
+	reloaded, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() without CA error = %v", err)
+	}
+	if !reloaded.CertificateExpiry().Equal(expiry) {
+		t.Errorf("CertificateExpiry() = %v, want the persisted %v", reloaded.CertificateExpiry(), expiry)
+	}
+
+	// An expired certificate is not kept
+	server.lifetime = -time.Second
+	cfg.DirectoryURL = server.directoryURL()
+	if _, err := NewACMECertificateManager(cfg, log); err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+	cfg.DirectoryURL = "http://127.0.0.1:1/directory"
+	if _, err := NewACMECertificateManager(cfg, log); err == nil {
+		t.Error("NewACMECertificateManager() kept an expired certificate without CA")
+	}
+}
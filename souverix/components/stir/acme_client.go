@@ -0,0 +1,556 @@
+package stir
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME challenge and identifier types used for STIR/SHAKEN certificates
+const (
+	ChallengeTKAuth01      = "tkauth-01"  // RFC 9447 authority token challenge
+	IdentifierTNAuthList   = "TNAuthList" // RFC 9448
+	tkauthTokenTypeTNAuth  = "TNAuthList"
+	acmeContentTypeJOSE    = "application/jose+json"
+	acmeContentTypePEMCert = "application/pem-certificate-chain"
+)
+
+// OIDTNAuthList is the TNAuthList certificate extension (RFC 8226)
+var OIDTNAuthList = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 26}
+
+// ACMEClient is a minimal RFC 8555 client supporting the tkauth-01
+// authority-token challenge used to obtain STI certificates
+type ACMEClient struct {
+	directoryURL string
+	accountKey   *ecdsa.PrivateKey
+	httpClient   *http.Client
+	pollInterval time.Duration
+
+	mu         sync.Mutex
+	directory  *acmeDirectory
+	nonces     []string
+	accountURL string
+}
+
+// acmeDirectory is the ACME directory object (RFC 8555 Section 7.1.1)
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// ACMEIdentifier is an ACME order identifier
+type ACMEIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// ACMEOrder is an ACME order object
+type ACMEOrder struct {
+	URL            string           `json:"-"`
+	Status         string           `json:"status"`
+	Identifiers    []ACMEIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+	Error          *ACMEProblem     `json:"error,omitempty"`
+}
+
+// ACMEAuthorization is an ACME authorization object
+type ACMEAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier ACMEIdentifier  `json:"identifier"`
+	Challenges []ACMEChallenge `json:"challenges"`
+}
+
+// ACMEChallenge is an ACME challenge object
+type ACMEChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Status string       `json:"status"`
+	Token  string       `json:"token,omitempty"`
+	Error  *ACMEProblem `json:"error,omitempty"`
+}
+
+// ACMEProblem is an RFC 7807 problem document returned by an ACME server
+type ACMEProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (p *ACMEProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// NewACMEClient creates an ACME client for the given directory and account key
+func NewACMEClient(directoryURL string, accountKey *ecdsa.PrivateKey, httpClient *http.Client) *ACMEClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &ACMEClient{
+		directoryURL: directoryURL,
+		accountKey:   accountKey,
+		httpClient:   httpClient,
+		pollInterval: time.Second,
+	}
+}
+
+// AccountURL returns the account URL (kid) once registered
+func (c *ACMEClient) AccountURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accountURL
+}
+
+// AccountKeyFingerprint returns the fingerprint of the ACME account key in the
+// form expected by STI-PA token APIs: "SHA256 AB:CD:..." over the public key DER
+func (c *ACMEClient) AccountKeyFingerprint() (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&c.accountKey.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal account key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	hexParts := make([]string, len(sum))
+	for i, b := range sum {
+		hexParts[i] = fmt.Sprintf("%02X", b)
+	}
+	return "SHA256 " + strings.Join(hexParts, ":"), nil
+}
+
+// Register creates (or looks up) the ACME account for the account key
+func (c *ACMEClient) Register(ctx context.Context, contact []string) error {
+	dir, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"termsOfServiceAgreed": true,
+	}
+	if len(contact) > 0 {
+		payload["contact"] = contact
+	}
+
+	resp, err := c.post(ctx, dir.NewAccount, payload, true)
+	if err != nil {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+	resp.Body.Close()
+
+	accountURL := resp.Header.Get("Location")
+	if accountURL == "" {
+		return fmt.Errorf("ACME server did not return an account URL")
+	}
+
+	c.mu.Lock()
+	c.accountURL = accountURL
+	c.mu.Unlock()
+	return nil
+}
+
+// NewOrder creates an order for the given identifiers
+func (c *ACMEClient) NewOrder(ctx context.Context, identifiers []ACMEIdentifier) (*ACMEOrder, error) {
+	dir, err := c.getDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post(ctx, dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ACME order: %w", err)
+	}
+	defer resp.Body.Close()
+
+	order := &ACMEOrder{}
+	if err := json.NewDecoder(resp.Body).Decode(order); err != nil {
+		return nil, fmt.Errorf("failed to decode ACME order: %w", err)
+	}
+	order.URL = resp.Header.Get("Location")
+	return order, nil
+}
+
+// GetAuthorization fetches an authorization object
+func (c *ACMEClient) GetAuthorization(ctx context.Context, url string) (*ACMEAuthorization, error) {
+	authz := &ACMEAuthorization{}
+	if err := c.postAsGet(ctx, url, authz); err != nil {
+		return nil, fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	return authz, nil
+}
+
+// RespondTKAuth answers a tkauth-01 challenge with an authority token (RFC 9447 Section 3)
+func (c *ACMEClient) RespondTKAuth(ctx context.Context, challenge *ACMEChallenge, authorityToken string) error {
+	resp, err := c.post(ctx, challenge.URL, map[string]string{"atc": authorityToken}, false)
+	if err != nil {
+		return fmt.Errorf("failed to respond to %s challenge: %w", challenge.Type, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// WaitAuthorization polls an authorization until it is valid or fails
+func (c *ACMEClient) WaitAuthorization(ctx context.Context, url string) (*ACMEAuthorization, error) {
+	for {
+		authz, err := c.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		switch authz.Status {
+		case "valid":
+			return authz, nil
+		case "invalid", "deactivated", "expired", "revoked":
+			for _, chal := range authz.Challenges {
+				if chal.Error != nil {
+					return nil, fmt.Errorf("authorization %s: %w", authz.Status, chal.Error)
+				}
+			}
+			return nil, fmt.Errorf("authorization %s", authz.Status)
+		}
+		if err := c.sleep(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FinalizeOrder submits the CSR and waits for the order to become valid
+func (c *ACMEClient) FinalizeOrder(ctx context.Context, order *ACMEOrder, csrDER []byte) (*ACMEOrder, error) {
+	resp, err := c.post(ctx, order.Finalize, map[string]string{
+		"csr": base64.RawURLEncoding.EncodeToString(csrDER),
+	}, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize ACME order: %w", err)
+	}
+	resp.Body.Close()
+
+	for {
+		current := &ACMEOrder{}
+		if err := c.postAsGet(ctx, order.URL, current); err != nil {
+			return nil, fmt.Errorf("failed to fetch ACME order: %w", err)
+		}
+		current.URL = order.URL
+
+		switch current.Status {
+		case "valid":
+			return current, nil
+		case "invalid":
+			if current.Error != nil {
+				return nil, fmt.Errorf("order invalid: %w", current.Error)
+			}
+			return nil, fmt.Errorf("order invalid")
+		}
+		if err := c.sleep(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DownloadCertificate downloads the PEM certificate chain of a valid order
+func (c *ACMEClient) DownloadCertificate(ctx context.Context, certURL string) ([]byte, error) {
+	resp, err := c.postRaw(ctx, certURL, nil, false, acmeContentTypePEMCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	chain, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate chain: %w", err)
+	}
+	return chain, nil
+}
+
+// getDirectory fetches and caches the ACME directory
+func (c *ACMEClient) getDirectory(ctx context.Context) (*acmeDirectory, error) {
+	c.mu.Lock()
+	dir := c.directory
+	c.mu.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ACME directory: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACME directory fetch failed with status: %d", resp.StatusCode)
+	}
+
+	dir = &acmeDirectory{}
+	if err := json.NewDecoder(resp.Body).Decode(dir); err != nil {
+		return nil, fmt.Errorf("failed to decode ACME directory: %w", err)
+	}
+
+	c.mu.Lock()
+	c.directory = dir
+	c.mu.Unlock()
+	return dir, nil
+}
+
+// nonce returns a fresh anti-replay nonce
+func (c *ACMEClient) nonce(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mu.Unlock()
+		return nonce, nil
+	}
+	c.mu.Unlock()
+
+	dir, err := c.getDirectory(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch ACME nonce: %w", err)
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("ACME server did not return a nonce")
+	}
+	return nonce, nil
+}
+
+// saveNonce keeps the nonce returned with a response for the next request
+func (c *ACMEClient) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mu.Unlock()
+	}
+}
+
+// post sends a JWS-signed POST with a JSON payload
+func (c *ACMEClient) post(ctx context.Context, url string, payload interface{}, useJWK bool) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.postRaw(ctx, url, body, useJWK, "")
+}
+
+// postAsGet fetches a resource with POST-as-GET (RFC 8555 Section 6.3)
+func (c *ACMEClient) postAsGet(ctx context.Context, url string, out interface{}) error {
+	resp, err := c.postRaw(ctx, url, nil, false, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// postRaw sends a JWS-signed POST, retrying once on a badNonce error.
+// A nil payload is sent as an empty string (POST-as-GET).
+func (c *ACMEClient) postRaw(ctx context.Context, url string, payload []byte, useJWK bool, accept string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := c.signJWS(url, nonce, payload, useJWK)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", acmeContentTypeJOSE)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		c.saveNonce(resp)
+
+		if resp.StatusCode < 400 {
+			return resp, nil
+		}
+
+		problem := &ACMEProblem{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(problem)
+		resp.Body.Close()
+
+		if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+			continue
+		}
+		if problem.Type == "" {
+			return nil, fmt.Errorf("ACME request failed with status: %d", resp.StatusCode)
+		}
+		return nil, problem
+	}
+}
+
+// signJWS builds a flattened JWS (RFC 7515) signed with the account key
+func (c *ACMEClient) signJWS(url, nonce string, payload []byte, useJWK bool) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+
+	c.mu.Lock()
+	kid := c.accountURL
+	c.mu.Unlock()
+
+	if useJWK || kid == "" {
+		protected["jwk"] = ecJWK(&c.accountKey.PublicKey)
+	} else {
+		protected["kid"] = kid
+	}
+
+	protectedJSON, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protectedJSON)
+	encodedPayload := ""
+	if payload != nil {
+		encodedPayload = base64.RawURLEncoding.EncodeToString(payload)
+	}
+
+	digest := sha256.Sum256([]byte(encodedProtected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.accountKey, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign ACME request: %w", err)
+	}
+
+	// ES256 signatures are the fixed-size concatenation r || s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// sleep waits for the poll interval or until ctx is done
+func (c *ACMEClient) sleep(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.pollInterval):
+		return nil
+	}
+}
+
+// ecJWK returns the JWK (RFC 7517) form of a P-256 public key
+func ecJWK(pub *ecdsa.PublicKey) map[string]string {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// TNAuthListSPC encodes a TNAuthList (RFC 8226) holding a single Service
+// Provider Code entry, as used in STI certificates
+func TNAuthListSPC(spc string) ([]byte, error) {
+	ia5, err := asn1.MarshalWithParams(spc, "ia5")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SPC: %w", err)
+	}
+	// TNEntry ::= CHOICE { spc [0] EXPLICIT ServiceProviderCode, ... }
+	entry := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: ia5}
+	return asn1.Marshal([]asn1.RawValue{entry})
+}
+
+// ParseTNAuthListSPC returns the Service Provider Codes of a TNAuthList
+func ParseTNAuthListSPC(der []byte) ([]string, error) {
+	var entries []asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &entries); err != nil {
+		return nil, fmt.Errorf("invalid TNAuthList: %w", err)
+	}
+
+	var codes []string
+	for _, entry := range entries {
+		if entry.Class != asn1.ClassContextSpecific || entry.Tag != 0 {
+			continue
+		}
+		var spc string
+		if _, err := asn1.UnmarshalWithParams(entry.Bytes, &spc, "ia5"); err != nil {
+			return nil, fmt.Errorf("invalid SPC entry: %w", err)
+		}
+		codes = append(codes, spc)
+	}
+	return codes, nil
+}
+
+// TNAuthListIdentifier returns the ACME TNAuthList identifier for an SPC (RFC 9448)
+func TNAuthListIdentifier(spc string) (ACMEIdentifier, error) {
+	der, err := TNAuthListSPC(spc)
+	if err != nil {
+		return ACMEIdentifier{}, err
+	}
+	return ACMEIdentifier{
+		Type:  IdentifierTNAuthList,
+		Value: base64.RawURLEncoding.EncodeToString(der),
+	}, nil
+}
+
+// CreateSTICSR creates a CSR for an STI certificate carrying the TNAuthList
+// extension for spc, signed by key
+func CreateSTICSR(key crypto.Signer, spc string) ([]byte, error) {
+	tnAuthList, err := TNAuthListSPC(spc)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		ExtraExtensions: []pkix.Extension{
+			{Id: OIDTNAuthList, Value: tnAuthList},
+		},
+	}
+	template.Subject.CommonName = "SHAKEN " + spc
+	template.Subject.Organization = []string{"IMS Core STIR/SHAKEN"}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+	return csr, nil
+}
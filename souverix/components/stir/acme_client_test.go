@@ -0,0 +1,499 @@
+package stir
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACMEServer is an in-process ACME server issuing STI certificates
+// after a tkauth-01 challenge answered with the expected SPC token
+type fakeACMEServer struct {
+	*httptest.Server
+	t     *testing.T
+	spc   string
+	token string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu          sync.Mutex
+	nonce       int
+	nonces      map[string]bool
+	accounts    map[string]*ecdsa.PublicKey
+	badNonceFor string // path answered once with badNonce
+	authzValid  bool
+	orderStatus string
+	certPEM     []byte
+	issued      int
+	lifetime    time.Duration
+}
+
+func newFakeACMEServer(t *testing.T, spc, token string) *fakeACMEServer {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test STI-CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	f := &fakeACMEServer{
+		t:           t,
+		spc:         spc,
+		token:       token,
+		caKey:       caKey,
+		caCert:      caCert,
+		nonces:      make(map[string]bool),
+		accounts:    make(map[string]*ecdsa.PublicKey),
+		orderStatus: "pending",
+		lifetime:    12 * time.Hour,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", f.handleDirectory)
+	mux.HandleFunc("/nonce", f.handleNonce)
+	mux.HandleFunc("/account", f.handleAccount)
+	mux.HandleFunc("/order", f.handleNewOrder)
+	mux.HandleFunc("/order/1", f.handleOrder)
+	mux.HandleFunc("/authz/1", f.handleAuthz)
+	mux.HandleFunc("/chal/1", f.handleChallenge)
+	mux.HandleFunc("/finalize/1", f.handleFinalize)
+	mux.HandleFunc("/cert/1", f.handleCert)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeACMEServer) directoryURL() string {
+	return f.URL + "/directory"
+}
+
+func (f *fakeACMEServer) issuedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued
+}
+
+func (f *fakeACMEServer) newNonce(w http.ResponseWriter) {
+	f.mu.Lock()
+	f.nonce++
+	nonce := fmt.Sprintf("nonce-%d", f.nonce)
+	f.nonces[nonce] = true
+	f.mu.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (f *fakeACMEServer) problem(w http.ResponseWriter, status int, kind, detail string) {
+	f.newNonce(w)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ACMEProblem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail})
+}
+
+func (f *fakeACMEServer) reply(w http.ResponseWriter, status int, location string, body interface{}) {
+	f.newNonce(w)
+	if location != "" {
+		w.Header().Set("Location", f.URL+location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// verify checks the JWS of a request and returns its payload
+func (f *fakeACMEServer) verify(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != acmeContentTypeJOSE {
+		f.problem(w, http.StatusMethodNotAllowed, "malformed", "expected JOSE POST")
+		return nil, false
+	}
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &jws); err != nil {
+		f.problem(w, http.StatusBadRequest, "malformed", "invalid JWS")
+		return nil, false
+	}
+
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		JWK   map[string]string `json:"jwk"`
+		KID   string            `json:"kid"`
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil || protected.Alg != "ES256" {
+		f.problem(w, http.StatusBadRequest, "malformed", "invalid protected header")
+		return nil, false
+	}
+	if protected.URL != f.URL+r.URL.Path {
+		f.problem(w, http.StatusUnauthorized, "unauthorized", "url mismatch")
+		return nil, false
+	}
+
+	f.mu.Lock()
+	validNonce := f.nonces[protected.Nonce]
+	delete(f.nonces, protected.Nonce)
+	forceBadNonce := f.badNonceFor == r.URL.Path
+	if forceBadNonce {
+		f.badNonceFor = ""
+	}
+	f.mu.Unlock()
+	if !validNonce || forceBadNonce {
+		f.problem(w, http.StatusBadRequest, "badNonce", "invalid nonce")
+		return nil, false
+	}
+
+	var pub *ecdsa.PublicKey
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else {
+		f.mu.Lock()
+		pub = f.accounts[protected.KID]
+		f.mu.Unlock()
+	}
+	if pub == nil {
+		f.problem(w, http.StatusUnauthorized, "accountDoesNotExist", "unknown account")
+		return nil, false
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(pub, digest[:],
+		new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		f.problem(w, http.StatusUnauthorized, "unauthorized", "bad signature")
+		return nil, false
+	}
+
+	if r.URL.Path == "/account" {
+		f.mu.Lock()
+		f.accounts[f.URL+"/acct/1"] = pub
+		f.mu.Unlock()
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, true
+}
+
+func (f *fakeACMEServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(acmeDirectory{
+		NewNonce:   f.URL + "/nonce",
+		NewAccount: f.URL + "/account",
+		NewOrder:   f.URL + "/order",
+	})
+}
+
+func (f *fakeACMEServer) handleNonce(w http.ResponseWriter, r *http.Request) {
+	f.newNonce(w)
+}
+
+func (f *fakeACMEServer) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.verify(w, r); !ok {
+		return
+	}
+	f.reply(w, http.StatusCreated, "/acct/1", map[string]string{"status": "valid"})
+}
+
+func (f *fakeACMEServer) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	payload, ok := f.verify(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Identifiers []ACMEIdentifier `json:"identifiers"`
+	}
+	json.Unmarshal(payload, &req)
+	if len(req.Identifiers) != 1 || req.Identifiers[0].Type != IdentifierTNAuthList {
+		f.problem(w, http.StatusBadRequest, "rejectedIdentifier", "expected one TNAuthList identifier")
+		return
+	}
+	der, _ := base64.RawURLEncoding.DecodeString(req.Identifiers[0].Value)
+	codes, err := ParseTNAuthListSPC(der)
+	if err != nil || len(codes) != 1 || codes[0] != f.spc {
+		f.problem(w, http.StatusBadRequest, "rejectedIdentifier", "unexpected SPC")
+		return
+	}
+
+	f.mu.Lock()
+	f.authzValid = false
+	f.orderStatus = "pending"
+	f.mu.Unlock()
+	f.reply(w, http.StatusCreated, "/order/1", f.order())
+}
+
+func (f *fakeACMEServer) order() ACMEOrder {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	order := ACMEOrder{
+		Status:         f.orderStatus,
+		Authorizations: []string{f.URL + "/authz/1"},
+		Finalize:       f.URL + "/finalize/1",
+	}
+	if f.orderStatus == "valid" {
+		order.Certificate = f.URL + "/cert/1"
+	}
+	return order
+}
+
+func (f *fakeACMEServer) handleOrder(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.verify(w, r); !ok {
+		return
+	}
+	f.reply(w, http.StatusOK, "", f.order())
+}
+
+func (f *fakeACMEServer) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.verify(w, r); !ok {
+		return
+	}
+	f.mu.Lock()
+	status := "pending"
+	if f.authzValid {
+		status = "valid"
+	}
+	f.mu.Unlock()
+	f.reply(w, http.StatusOK, "", ACMEAuthorization{
+		Status:     status,
+		Identifier: ACMEIdentifier{Type: IdentifierTNAuthList},
+		Challenges: []ACMEChallenge{
+			{Type: ChallengeTKAuth01, URL: f.URL + "/chal/1", Status: status, Token: "challenge-token"},
+		},
+	})
+}
+
+func (f *fakeACMEServer) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	payload, ok := f.verify(w, r)
+	if !ok {
+		return
+	}
+	var resp struct {
+		ATC string `json:"atc"`
+	}
+	json.Unmarshal(payload, &resp)
+	if resp.ATC != f.token {
+		f.problem(w, http.StatusForbidden, "unauthorized", "invalid authority token")
+		return
+	}
+	f.mu.Lock()
+	f.authzValid = true
+	f.mu.Unlock()
+	f.reply(w, http.StatusOK, "", ACMEChallenge{Type: ChallengeTKAuth01, Status: "valid"})
+}
+
+func (f *fakeACMEServer) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	payload, ok := f.verify(w, r)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	authorized := f.authzValid
+	f.mu.Unlock()
+	if !authorized {
+		f.problem(w, http.StatusForbidden, "orderNotReady", "authorization pending")
+		return
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &req)
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || csr.CheckSignature() != nil {
+		f.problem(w, http.StatusBadRequest, "badCSR", "invalid CSR")
+		return
+	}
+
+	var tnAuthList []byte
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(OIDTNAuthList) {
+			tnAuthList = ext.Value
+		}
+	}
+	if codes, err := ParseTNAuthListSPC(tnAuthList); err != nil || len(codes) != 1 || codes[0] != f.spc {
+		f.problem(w, http.StatusBadRequest, "badCSR", "CSR lacks the authorized TNAuthList")
+		return
+	}
+
+	f.mu.Lock()
+	f.issued++
+	serial := int64(f.issued + 1)
+	lifetime := f.lifetime
+	f.mu.Unlock()
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(serial),
+		Subject:         csr.Subject,
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(lifetime),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: OIDTNAuthList, Value: tnAuthList}},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.t.Errorf("fake CA failed to issue: %v", err)
+		f.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+
+	f.mu.Lock()
+	f.certPEM = chain
+	f.orderStatus = "valid"
+	f.mu.Unlock()
+	f.reply(w, http.StatusOK, "/order/1", f.order())
+}
+
+func (f *fakeACMEServer) handleCert(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.verify(w, r); !ok {
+		return
+	}
+	f.mu.Lock()
+	chain := f.certPEM
+	f.mu.Unlock()
+	f.newNonce(w)
+	w.Header().Set("Content-Type", acmeContentTypePEMCert)
+	w.Write(chain)
+}
+
+func TestTNAuthListSPC(t *testing.T) {
+	der, err := TNAuthListSPC("1234")
+	if err != nil {
+		t.Fatalf("TNAuthListSPC() error = %v", err)
+	}
+
+	// SEQUENCE { [0] { IA5String "1234" } }
+	want := []byte{0x30, 0x08, 0xa0, 0x06, 0x16, 0x04, '1', '2', '3', '4'}
+	if string(der) != string(want) {
+		t.Errorf("TNAuthListSPC() = %x, want %x", der, want)
+	}
+
+	codes, err := ParseTNAuthListSPC(der)
+	if err != nil {
+		t.Fatalf("ParseTNAuthListSPC() error = %v", err)
+	}
+	if len(codes) != 1 || codes[0] != "1234" {
+		t.Errorf("ParseTNAuthListSPC() = %v, want [1234]", codes)
+	}
+}
+
+func TestCreateSTICSR(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	der, err := CreateSTICSR(key, "567A")
+	if err != nil {
+		t.Fatalf("CreateSTICSR() error = %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Errorf("CSR signature invalid: %v", err)
+	}
+
+	found := false
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(OIDTNAuthList) {
+			codes, err := ParseTNAuthListSPC(ext.Value)
+			found = err == nil && len(codes) == 1 && codes[0] == "567A"
+		}
+	}
+	if !found {
+		t.Error("CSR does not carry the TNAuthList extension for the SPC")
+	}
+}
+
+func TestACMEClient_RetriesBadNonce(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	server.badNonceFor = "/account"
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := NewACMEClient(server.directoryURL(), key, server.Client())
+
+	if err := client.Register(t.Context(), []string{"mailto:noc@example.com"}); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if client.AccountURL() != server.URL+"/acct/1" {
+		t.Errorf("AccountURL() = %s, want %s", client.AccountURL(), server.URL+"/acct/1")
+	}
+}
+
+func TestACMEClient_ProblemDocument(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := NewACMEClient(server.directoryURL(), key, server.Client())
+	if err := client.Register(t.Context(), nil); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	identifier, _ := TNAuthListIdentifier("9999")
+	_, err := client.NewOrder(t.Context(), []ACMEIdentifier{identifier})
+	if err == nil {
+		t.Fatal("NewOrder() succeeded for an SPC the server does not accept")
+	}
+
+	var problem *ACMEProblem
+	if !errors.As(err, &problem) || problem.Type != "urn:ietf:params:acme:error:rejectedIdentifier" {
+		t.Errorf("NewOrder() error = %v, want rejectedIdentifier problem", err)
+	}
+}
+
+func TestACMEClient_AccountKeyFingerprint(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := NewACMEClient("http://unused", key, nil)
+
+	fingerprint, err := client.AccountKeyFingerprint()
+	if err != nil {
+		t.Fatalf("AccountKeyFingerprint() error = %v", err)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	sum := sha256.Sum256(der)
+	if len(fingerprint) != len("SHA256 ")+len(sum)*3-1 || fingerprint[:7] != "SHA256 " {
+		t.Errorf("AccountKeyFingerprint() = %q, unexpected format", fingerprint)
+	}
+	if fingerprint[7:9] != fmt.Sprintf("%02X", sum[0]) {
+		t.Errorf("AccountKeyFingerprint() = %q, does not start with digest byte %02X", fingerprint, sum[0])
+	}
+}
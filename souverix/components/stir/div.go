@@ -0,0 +1,160 @@
+package stir
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DivClaim represents the diversion claim of a "div" PASSporT (RFC 8946).
+// It carries the identity the call was originally destined to.
+type DivClaim struct {
+	TN  string `json:"tn,omitempty"`
+	URI string `json:"uri,omitempty"`
+}
+
+// PASSporTChain is a verified original PASSporT followed by the "div"
+// PASSporTs added by each retargeting hop, in diversion order
+type PASSporTChain struct {
+	Original   *PASSporT
+	Diversions []*PASSporT
+}
+
+// Final returns the PASSporT describing the current destination of the call
+func (c *PASSporTChain) Final() *PASSporT {
+	if len(c.Diversions) > 0 {
+		return c.Diversions[len(c.Diversions)-1]
+	}
+	return c.Original
+}
+
+// IsDiverted returns true if the call has been retargeted at least once
+func (c *PASSporTChain) IsDiverted() bool {
+	return len(c.Diversions) > 0
+}
+
+// SignDiversion creates a "div" PASSporT chaining to prev (RFC 8946 Section 4).
+// The orig claim is copied from prev, dest is the new target and the div claim
+// holds the diverting identity. If divertingTN is empty, the first destination
+// of prev is used.
+func (s *STIRSigner) SignDiversion(prev *PASSporT, divertingTN, newDestTN string, callID string) (string, error) {
+	if prev == nil {
+		return "", fmt.Errorf("cannot sign div PASSporT without a previous PASSporT")
+	}
+	if divertingTN == "" {
+		if len(prev.Dest.TN) == 0 {
+			return "", fmt.Errorf("previous PASSporT has no destination to divert from")
+		}
+		divertingTN = prev.Dest.TN[0]
+	}
+	if newDestTN == "" {
+		return "", fmt.Errorf("diversion target is required")
+	}
+
+	passport := &PASSporT{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)), // Short-lived
+			ID:        callID,
+		},
+		Orig: prev.Orig,
+		Dest: DestClaim{
+			TN: []string{newDestTN},
+		},
+		Div: &DivClaim{
+			TN: divertingTN,
+		},
+	}
+
+	return s.sign(passport, PPTDiv)
+}
+
+// DecodePASSporT decodes a PASSporT without verifying its signature.
+// It is used by intermediaries that need the claims of a received PASSporT
+// (e.g. to chain a div PASSporT); callers must verify separately.
+func DecodePASSporT(identityToken string) (*PASSporT, error) {
+	passport := &PASSporT{}
+	token, _, err := jwt.NewParser().ParseUnverified(identityToken, passport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PASSporT: %w", err)
+	}
+	passport.PPT, _ = token.Header["ppt"].(string)
+	return passport, nil
+}
+
+// VerifyChain verifies a set of Identity header tokens as one original
+// PASSporT plus zero or more div PASSporTs, and checks that every div
+// PASSporT chains to its predecessor (same orig, div claim matching the
+// predecessor's dest, not issued before it). Tokens may be in any order.
+func (v *STIRVerifier) VerifyChain(identityTokens []string) (*PASSporTChain, error) {
+	if len(identityTokens) == 0 {
+		return nil, fmt.Errorf("no Identity tokens to verify")
+	}
+
+	chain := &PASSporTChain{}
+	var pending []*PASSporT
+
+	for _, identityToken := range identityTokens {
+		passport, err := v.VerifyINVITE(identityToken)
+		if err != nil {
+			return nil, err
+		}
+
+		switch passport.PPT {
+		case PPTDiv:
+			if passport.Div == nil || (passport.Div.TN == "" && passport.Div.URI == "") {
+				return nil, fmt.Errorf("div PASSporT is missing the div claim")
+			}
+			pending = append(pending, passport)
+		case "", PPTShaken:
+			if chain.Original != nil {
+				return nil, fmt.Errorf("multiple original PASSporTs in Identity headers")
+			}
+			chain.Original = passport
+		default:
+			return nil, fmt.Errorf("unsupported PASSporT extension: %s", passport.PPT)
+		}
+	}
+
+	if chain.Original == nil {
+		return nil, fmt.Errorf("div PASSporT without an original PASSporT")
+	}
+
+	// Link div PASSporTs one hop at a time starting from the original
+	current := chain.Original
+	for len(pending) > 0 {
+		next := -1
+		for i, div := range pending {
+			if chainsTo(div, current) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("div PASSporT for %s does not chain to a previous PASSporT", pending[0].Div.TN)
+		}
+
+		current = pending[next]
+		chain.Diversions = append(chain.Diversions, current)
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+
+	return chain, nil
+}
+
+// chainsTo reports whether the div PASSporT div retargets the call described by prev
+func chainsTo(div, prev *PASSporT) bool {
+	if div.Orig.TN != prev.Orig.TN {
+		return false
+	}
+	if div.IssuedAt != nil && prev.IssuedAt != nil && div.IssuedAt.Before(prev.IssuedAt.Time) {
+		return false
+	}
+	for _, tn := range prev.Dest.TN {
+		if tn == div.Div.TN {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package stir
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSTIRSigner_SignDiversion(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := NewSTIRSigner(privateKey, "https://example.com/cert.pem", AttestationFull)
+
+	original, _ := signer.SignINVITE("+15145559876", "+15145551234", "test-call-id")
+	prev, err := DecodePASSporT(original)
+	if err != nil {
+		t.Fatalf("DecodePASSporT() error = %v", err)
+	}
+	if prev.PPT != PPTShaken {
+		t.Errorf("DecodePASSporT() ppt = %v, want %v", prev.PPT, PPTShaken)
+	}
+
+	token, err := signer.SignDiversion(prev, "", "+15145550000", "test-call-id")
+	if err != nil {
+		t.Fatalf("SignDiversion() error = %v", err)
+	}
+
+	div, err := DecodePASSporT(token)
+	if err != nil {
+		t.Fatalf("DecodePASSporT() error = %v", err)
+	}
+	if div.PPT != PPTDiv {
+		t.Errorf("div ppt = %v, want %v", div.PPT, PPTDiv)
+	}
+	if div.Div == nil || div.Div.TN != "+15145551234" {
+		t.Errorf("div claim = %+v, want tn +15145551234", div.Div)
+	}
+	if div.Orig.TN != "+15145559876" {
+		t.Errorf("div orig TN = %v, want +15145559876", div.Orig.TN)
+	}
+	if div.Attest != "" {
+		t.Errorf("div attest = %v, want none", div.Attest)
+	}
+}
+
+func TestSTIRVerifier_VerifyChain(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := NewSTIRSigner(privateKey, "https://example.com/cert.pem", AttestationFull)
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: &privateKey.PublicKey})
+
+	original, _ := signer.SignINVITE("+15145559876", "+15145551234", "test-call-id")
+	prev, _ := DecodePASSporT(original)
+	div1, _ := signer.SignDiversion(prev, "", "+15145550000", "test-call-id")
+	prev1, _ := DecodePASSporT(div1)
+	div2, _ := signer.SignDiversion(prev1, "", "+15145550001", "test-call-id")
+
+	// Headers may arrive in any order
+	chain, err := verifier.VerifyChain([]string{div2, original, div1})
+	if err != nil {
+		t.Fatalf("VerifyChain() error = %v", err)
+	}
+
+	if !chain.IsDiverted() || len(chain.Diversions) != 2 {
+		t.Fatalf("VerifyChain() diversions = %d, want 2", len(chain.Diversions))
+	}
+	if chain.Original.Attest != AttestationFull {
+		t.Errorf("VerifyChain() original attest = %v, want %v", chain.Original.Attest, AttestationFull)
+	}
+	if got := chain.Final().Dest.TN[0]; got != "+15145550001" {
+		t.Errorf("VerifyChain() final dest = %v, want +15145550001", got)
+	}
+}
+
+func TestSTIRVerifier_VerifyChain_Broken(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := NewSTIRSigner(privateKey, "https://example.com/cert.pem", AttestationFull)
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: &privateKey.PublicKey})
+
+	original, _ := signer.SignINVITE("+15145559876", "+15145551234", "test-call-id")
+	prev, _ := DecodePASSporT(original)
+
+	tests := []struct {
+		name   string
+		tokens func() []string
+	}{
+		{"div without original", func() []string {
+			div, _ := signer.SignDiversion(prev, "", "+15145550000", "test-call-id")
+			return []string{div}
+		}},
+		{"div from wrong destination", func() []string {
+			div, _ := signer.SignDiversion(prev, "+15145557777", "+15145550000", "test-call-id")
+			return []string{original, div}
+		}},
+		{"div with different orig", func() []string {
+			other := *prev
+			other.Orig = OrigClaim{TN: "+15145558888"}
+			div, _ := signer.SignDiversion(&other, "", "+15145550000", "test-call-id")
+			return []string{original, div}
+		}},
+		{"two originals", func() []string {
+			again, _ := signer.SignINVITE("+15145559876", "+15145551234", "test-call-id")
+			return []string{original, again}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.VerifyChain(tt.tokens()); err == nil {
+				t.Error("VerifyChain() should fail")
+			}
+		})
+	}
+}
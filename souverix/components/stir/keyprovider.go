@@ -0,0 +1,316 @@
+package stir
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyProvider supplies the P-256 key used to sign PASSporTs and STI CSRs.
+// Keys may live outside the process (HSM, Vault); only crypto.Signer is exposed.
+type KeyProvider interface {
+	// Signer returns the current signing key, creating it if none exists
+	Signer(ctx context.Context) (crypto.Signer, error)
+
+	// Rotate stages a new signing key and returns it with commit, which
+	// makes it the key Signer returns. Until commit is called Signer keeps
+	// returning the current key, so a key no certificate could be obtained
+	// for is never used. Previously returned signers stay usable so in-flight
+	// signatures complete.
+	Rotate(ctx context.Context) (next crypto.Signer, commit func() error, err error)
+}
+
+// keyFinder is implemented by key providers that keep earlier keys, so that
+// the key of a persisted certificate is found again after a rotation that
+// was staged but not committed before a restart
+type keyFinder interface {
+	// SignerFor returns the key whose public key is pub and makes it the
+	// key Signer returns
+	SignerFor(ctx context.Context, pub crypto.PublicKey) (crypto.Signer, error)
+}
+
+// NewKeyProvider creates the key provider selected by cfg. defaultPath is the
+// file used by the "file" source when cfg.Path is empty; if both are empty the
+// key only lives in memory.
+func NewKeyProvider(cfg *config.STIRKeyConfig, defaultPath string) (KeyProvider, error) {
+	switch strings.ToLower(cfg.Source) {
+	case "", "file":
+		path := cfg.Path
+		if path == "" {
+			path = defaultPath
+		}
+		if path == "" {
+			return &memoryKeyProvider{}, nil
+		}
+		return NewFileKeyProvider(path), nil
+	case "pkcs11", "hsm":
+		provider, err := NewPKCS11KeyProvider(cfg.PKCS11Module, cfg.PKCS11TokenLabel, cfg.PKCS11PIN, cfg.PKCS11KeyLabel)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	case "vault":
+		if cfg.VaultAddress == "" || cfg.VaultKeyName == "" {
+			return nil, fmt.Errorf("vault key source requires an address and key name")
+		}
+		return NewVaultTransitKeyProvider(cfg.VaultAddress, cfg.VaultToken, cfg.VaultTransitMount, cfg.VaultKeyName), nil
+	}
+	return nil, fmt.Errorf("unsupported STIR key source: %s", cfg.Source)
+}
+
+// RotatingSigner is a crypto.Signer whose key can be replaced at any time.
+// Each Sign call uses the key that was current when it started, so rotation
+// never interrupts a signature in progress.
+type RotatingSigner struct {
+	current atomic.Pointer[signerRef]
+}
+
+// signerRef boxes a crypto.Signer for atomic replacement
+type signerRef struct {
+	signer crypto.Signer
+}
+
+// NewRotatingSigner creates a rotating signer starting with initial
+func NewRotatingSigner(initial crypto.Signer) *RotatingSigner {
+	r := &RotatingSigner{}
+	r.current.Store(&signerRef{signer: initial})
+	return r
+}
+
+// Current returns the signer currently in use
+func (r *RotatingSigner) Current() crypto.Signer {
+	return r.current.Load().signer
+}
+
+// Rotate makes next the current signer and returns the previous one
+func (r *RotatingSigner) Rotate(next crypto.Signer) crypto.Signer {
+	return r.current.Swap(&signerRef{signer: next}).signer
+}
+
+// Public returns the public key of the current signer
+func (r *RotatingSigner) Public() crypto.PublicKey {
+	return r.Current().Public()
+}
+
+// Sign signs digest with the current signer
+func (r *RotatingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return r.Current().Sign(rand, digest, opts)
+}
+
+// FileKeyProvider keeps the signing key in a PEM file so it survives restarts
+type FileKeyProvider struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileKeyProvider creates a provider for the PEM key at path
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{path: path}
+}
+
+// Signer loads the key, generating and persisting one if the file does not exist
+func (f *FileKeyProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key, err := loadECKey(f.path)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return f.generate()
+}
+
+// Rotate generates a new key, which commit writes over the key file
+func (f *FileKeyProvider) Rotate(ctx context.Context) (crypto.Signer, func() error, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+	}
+	commit := func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return writeECKey(f.path, key)
+	}
+	return key, commit, nil
+}
+
+// generate creates a P-256 key and writes it to the key file
+func (f *FileKeyProvider) generate() (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+	}
+	if err := writeECKey(f.path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// memoryKeyProvider holds an ephemeral key for development; the key and any
+// certificate issued for it change on every restart
+type memoryKeyProvider struct {
+	mu  sync.Mutex
+	key *ecdsa.PrivateKey
+}
+
+// Signer returns the in-memory key, generating it on first use
+func (m *memoryKeyProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.key == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		m.key = key
+	}
+	return m.key, nil
+}
+
+// Rotate generates a new in-memory key, which commit makes current
+func (m *memoryKeyProvider) Rotate(ctx context.Context) (crypto.Signer, func() error, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+	}
+	commit := func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.key = key
+		return nil
+	}
+	return key, commit, nil
+}
+
+// loadECKey reads a PEM encoded EC private key (SEC 1 or PKCS#8)
+func loadECKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode key PEM")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key: %w", err)
+		}
+		key, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not an ECDSA key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key PEM type: %s", block.Type)
+}
+
+// writeECKey writes key as a SEC 1 PEM file readable only by the owner
+func writeECKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path
+// so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ecdsaSignature is the ASN.1 form of an ECDSA signature returned by crypto.Signer
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// signingMethodES256Signer signs ES256 JWTs with any crypto.Signer, so keys
+// held in an HSM or Vault can sign PASSporTs. Verification is unchanged.
+type signingMethodES256Signer struct{}
+
+// signingMethodES256 is used for all PASSporTs signed by STIRSigner
+var signingMethodES256 jwt.SigningMethod = signingMethodES256Signer{}
+
+func (signingMethodES256Signer) Alg() string {
+	return jwt.SigningMethodES256.Alg()
+}
+
+func (signingMethodES256Signer) Verify(signingString string, sig []byte, key interface{}) error {
+	return jwt.SigningMethodES256.Verify(signingString, sig, key)
+}
+
+// Sign hashes signingString with SHA-256 and returns the JWS r || s signature
+func (signingMethodES256Signer) Sign(signingString string, key interface{}) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, jwt.ErrInvalidKeyType
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	der, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ecdsaSignature
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) != 0 || sig.R.BitLen() > 256 || sig.S.BitLen() > 256 {
+		return nil, fmt.Errorf("malformed ECDSA signature from signer")
+	}
+
+	out := make([]byte, 64)
+	sig.R.FillBytes(out[:32])
+	sig.S.FillBytes(out[32:])
+	return out, nil
+}
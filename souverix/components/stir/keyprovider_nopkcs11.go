@@ -0,0 +1,36 @@
+//go:build !pkcs11
+
+package stir
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+)
+
+// errNoPKCS11 is returned when the binary was built without PKCS#11 support.
+// PKCS#11 requires cgo; build with "-tags pkcs11" to enable it.
+var errNoPKCS11 = fmt.Errorf("PKCS#11 support not compiled in (build with -tags pkcs11)")
+
+// PKCS11KeyProvider keeps the signing key in a PKCS#11 token (HSM)
+type PKCS11KeyProvider struct{}
+
+// NewPKCS11KeyProvider fails in builds without PKCS#11 support
+func NewPKCS11KeyProvider(module, tokenLabel, pin, keyLabel string) (*PKCS11KeyProvider, error) {
+	return nil, errNoPKCS11
+}
+
+// Signer is unavailable without PKCS#11 support
+func (p *PKCS11KeyProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	return nil, errNoPKCS11
+}
+
+// Rotate is unavailable without PKCS#11 support
+func (p *PKCS11KeyProvider) Rotate(ctx context.Context) (crypto.Signer, func() error, error) {
+	return nil, nil, errNoPKCS11
+}
+
+// Close is a no-op without PKCS#11 support
+func (p *PKCS11KeyProvider) Close() error {
+	return nil
+}
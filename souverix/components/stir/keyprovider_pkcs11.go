@@ -0,0 +1,374 @@
+//go:build pkcs11
+
+package stir
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// oidNamedCurveP256 is the DER encoded CKA_EC_PARAMS for P-256
+var oidNamedCurveP256 = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+
+// PKCS11KeyProvider keeps the signing key in a PKCS#11 token (HSM).
+// Key pairs share a label; the one with the highest CKA_ID is current at
+// startup and rotation generates a new pair with a higher CKA_ID.
+type PKCS11KeyProvider struct {
+	ctx      *pkcs11.Ctx
+	session  pkcs11.SessionHandle
+	keyLabel string
+
+	// PKCS#11 sessions are not safe for concurrent use
+	mu sync.Mutex
+
+	// current is the CKA_ID of the current key pair, nil for the highest
+	current []byte
+}
+
+// NewPKCS11KeyProvider loads module, opens a session on the token labelled
+// tokenLabel and logs in with pin
+func NewPKCS11KeyProvider(module, tokenLabel, pin, keyLabel string) (*PKCS11KeyProvider, error) {
+	if module == "" {
+		return nil, fmt.Errorf("PKCS#11 module path is required")
+	}
+
+	p := pkcs11.New(module)
+	if p == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", module)
+	}
+	if err := p.Initialize(); err != nil {
+		p.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %w", err)
+	}
+
+	slot, err := findPKCS11Slot(p, tokenLabel)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, err
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	if err := p.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		p.CloseSession(session)
+		p.Finalize()
+		p.Destroy()
+		return nil, fmt.Errorf("PKCS#11 login failed: %w", err)
+	}
+
+	return &PKCS11KeyProvider{
+		ctx:      p,
+		session:  session,
+		keyLabel: keyLabel,
+	}, nil
+}
+
+// findPKCS11Slot returns the slot holding the token labelled tokenLabel
+func findPKCS11Slot(p *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(info.Label) == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("PKCS#11 token %q not found", tokenLabel)
+}
+
+// Signer returns the current key pair, generating one if the token has none
+func (p *PKCS11KeyProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	signer, err := p.currentKey()
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		if signer, err = p.generate(); err != nil {
+			return nil, err
+		}
+	}
+	p.current = signer.id
+	return signer, nil
+}
+
+// Rotate generates a new key pair on the token, which commit makes current.
+// Earlier key pairs are kept so signers holding them continue to work.
+func (p *PKCS11KeyProvider) Rotate(ctx context.Context) (crypto.Signer, func() error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next, err := p.generate()
+	if err != nil {
+		return nil, nil, err
+	}
+	commit := func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.current = next.id
+		return nil
+	}
+	return next, commit, nil
+}
+
+// SignerFor returns the key pair whose public key is pub and makes it current
+func (p *PKCS11KeyProvider) SignerFor(ctx context.Context, pub crypto.PublicKey) (crypto.Signer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		public, err := p.publicKey(key.id)
+		if err != nil || !public.Equal(pub) {
+			continue
+		}
+		p.current = key.id
+		return &pkcs11Signer{provider: p, handle: key.handle, id: key.id, public: public}, nil
+	}
+	return nil, fmt.Errorf("PKCS#11 key pair with the requested public key not found")
+}
+
+// Close logs out and releases the PKCS#11 module
+func (p *PKCS11KeyProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ctx.Logout(p.session)
+	p.ctx.CloseSession(p.session)
+	err := p.ctx.Finalize()
+	p.ctx.Destroy()
+	return err
+}
+
+// pkcs11Key is a private key object of the token
+type pkcs11Key struct {
+	handle pkcs11.ObjectHandle
+	id     []byte
+}
+
+// keys lists the private keys with the configured label. Called with mu held.
+func (p *PKCS11KeyProvider) keys() ([]pkcs11Key, error) {
+	handles, err := p.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.keyLabel),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]pkcs11Key, 0, len(handles))
+	for _, handle := range handles {
+		attrs, err := p.ctx.GetAttributeValue(p.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PKCS#11 key id: %w", err)
+		}
+		keys = append(keys, pkcs11Key{handle: handle, id: attrs[0].Value})
+	}
+	return keys, nil
+}
+
+// currentKey finds the current private key, or the one with the highest
+// CKA_ID before any is current. It returns nil if there is none. Called with
+// mu held.
+func (p *PKCS11KeyProvider) currentKey() (*pkcs11Signer, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var current *pkcs11Key
+	for i, key := range keys {
+		if p.current != nil {
+			if bytes.Equal(key.id, p.current) {
+				current = &keys[i]
+				break
+			}
+			continue
+		}
+		if current == nil || bytes.Compare(key.id, current.id) > 0 {
+			current = &keys[i]
+		}
+	}
+	if current == nil {
+		return nil, nil
+	}
+
+	pub, err := p.publicKey(current.id)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Signer{provider: p, handle: current.handle, id: current.id, public: pub}, nil
+}
+
+// publicKey reads the public key object with the given CKA_ID. Called with mu held.
+func (p *PKCS11KeyProvider) publicKey(id []byte) (*ecdsa.PublicKey, error) {
+	handles, err := p.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, fmt.Errorf("PKCS#11 public key for key id %x not found", id)
+	}
+
+	attrs, err := p.ctx.GetAttributeValue(p.session, handles[0], []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PKCS#11 EC point: %w", err)
+	}
+	return parseECPoint(attrs[0].Value)
+}
+
+// generate creates a P-256 key pair whose CKA_ID sorts after existing keys.
+// Called with mu held.
+func (p *PKCS11KeyProvider) generate() (*pkcs11Signer, error) {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(time.Now().UnixNano()))
+
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidNamedCurveP256),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.keyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, p.keyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+
+	_, privHandle, err := p.ctx.GenerateKeyPair(p.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}, public, private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PKCS#11 key pair: %w", err)
+	}
+
+	pub, err := p.publicKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Signer{provider: p, handle: privHandle, id: id, public: pub}, nil
+}
+
+// findObjects returns the handles of objects matching template. Called with mu held.
+func (p *PKCS11KeyProvider) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return nil, fmt.Errorf("PKCS#11 object search failed: %w", err)
+	}
+	defer p.ctx.FindObjectsFinal(p.session)
+
+	var handles []pkcs11.ObjectHandle
+	for {
+		batch, _, err := p.ctx.FindObjects(p.session, 16)
+		if err != nil {
+			return nil, fmt.Errorf("PKCS#11 object search failed: %w", err)
+		}
+		if len(batch) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, batch...)
+	}
+}
+
+// parseECPoint decodes a CKA_EC_POINT value: a DER OCTET STRING holding an
+// uncompressed P-256 point (some tokens omit the OCTET STRING wrapper)
+func parseECPoint(value []byte) (*ecdsa.PublicKey, error) {
+	point := value
+	var wrapped []byte
+	if rest, err := asn1.Unmarshal(value, &wrapped); err == nil && len(rest) == 0 {
+		point = wrapped
+	}
+	if len(point) != 65 || point[0] != 0x04 {
+		return nil, fmt.Errorf("unsupported EC point encoding")
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(point[1:33]),
+		Y:     new(big.Int).SetBytes(point[33:]),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("EC point is not on P-256")
+	}
+	return pub, nil
+}
+
+// pkcs11Signer signs with one private key object of a PKCS#11 token
+type pkcs11Signer struct {
+	provider *PKCS11KeyProvider
+	handle   pkcs11.ObjectHandle
+	id       []byte
+	public   *ecdsa.PublicKey
+}
+
+// Public returns the public key of the key pair
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs digest with CKM_ECDSA and returns an ASN.1 ECDSA signature
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	p := s.provider
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.handle); err != nil {
+		return nil, fmt.Errorf("PKCS#11 sign init failed: %w", err)
+	}
+	raw, err := p.ctx.Sign(p.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 sign failed: %w", err)
+	}
+	if len(raw) != 64 {
+		return nil, fmt.Errorf("unexpected PKCS#11 ECDSA signature length %d", len(raw))
+	}
+
+	// CKM_ECDSA returns r || s; crypto.Signer callers expect ASN.1
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(raw[:32]),
+		S: new(big.Int).SetBytes(raw[32:]),
+	})
+}
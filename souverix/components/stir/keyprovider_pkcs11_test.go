@@ -0,0 +1,92 @@
+//go:build pkcs11
+
+package stir
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"os"
+	"testing"
+)
+
+// newSoftHSMProvider opens the SoftHSM token described by the environment:
+// SOFTHSM2_MODULE (path to libsofthsm2.so), SOFTHSM2_TOKEN and SOFTHSM2_PIN.
+// Initialize a token with:
+//
+//	softhsm2-util --init-token --free --label stir-test --pin 1234 --so-pin 0000
+func newSoftHSMProvider(t *testing.T) *PKCS11KeyProvider {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		t.Skip("SOFTHSM2_MODULE not set")
+	}
+	token := os.Getenv("SOFTHSM2_TOKEN")
+	if token == "" {
+		token = "stir-test"
+	}
+
+	provider, err := NewPKCS11KeyProvider(module, token, os.Getenv("SOFTHSM2_PIN"), "stir-"+t.Name())
+	if err != nil {
+		t.Fatalf("NewPKCS11KeyProvider() error = %v", err)
+	}
+	t.Cleanup(func() { provider.Close() })
+	return provider
+}
+
+func TestPKCS11KeyProvider(t *testing.T) {
+	provider := newSoftHSMProvider(t)
+	ctx := context.Background()
+
+	first, err := provider.Signer(ctx)
+	if err != nil {
+		t.Fatalf("Signer() error = %v", err)
+	}
+	again, err := provider.Signer(ctx)
+	if err != nil {
+		t.Fatalf("Signer() error = %v", err)
+	}
+	if !first.Public().(*ecdsa.PublicKey).Equal(again.Public()) {
+		t.Error("Signer() returned a different key pair")
+	}
+
+	token, err := NewSTIRSigner(first, "https://example.com/cert.pem", AttestationFull).
+		SignINVITE("+15145559876", "+15145551234", "call-1")
+	if err != nil {
+		t.Fatalf("SignINVITE() error = %v", err)
+	}
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: first.Public().(*ecdsa.PublicKey)})
+	if _, err := verifier.VerifyINVITE(token); err != nil {
+		t.Errorf("VerifyINVITE() error = %v", err)
+	}
+
+	rotated, commit, err := provider.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if rotated.Public().(*ecdsa.PublicKey).Equal(first.Public()) {
+		t.Error("Rotate() returned the previous key pair")
+	}
+	if current, _ := provider.Signer(ctx); !current.Public().(*ecdsa.PublicKey).Equal(first.Public()) {
+		t.Error("Signer() returned the rotated key pair before commit")
+	}
+	if err := commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+	if current, _ := provider.Signer(ctx); !current.Public().(*ecdsa.PublicKey).Equal(rotated.Public()) {
+		t.Error("Signer() does not return the rotated key pair")
+	}
+	if found, err := provider.SignerFor(ctx, first.Public()); err != nil || !found.Public().(*ecdsa.PublicKey).Equal(first.Public()) {
+		t.Errorf("SignerFor() the previous key pair = %v, %v", found, err)
+	}
+
+	// The previous key pair still signs
+	if _, err := NewSTIRSigner(first, "https://example.com/cert.pem", AttestationFull).
+		SignINVITE("+15145559876", "+15145551234", "call-2"); err != nil {
+		t.Errorf("SignINVITE() with previous key pair error = %v", err)
+	}
+}
+
+func TestParseECPoint(t *testing.T) {
+	if _, err := parseECPoint([]byte{0x04, 0x01}); err == nil {
+		t.Error("parseECPoint() accepted a truncated point")
+	}
+}
@@ -0,0 +1,297 @@
+package stir
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// blockingSigner holds every Sign call until release is closed
+type blockingSigner struct {
+	key     *ecdsa.PrivateKey
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSigner) Public() crypto.PublicKey {
+	return b.key.Public()
+}
+
+func (b *blockingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	close(b.started)
+	<-b.release
+	return b.key.Sign(rand, digest, opts)
+}
+
+// opaqueSigner hides the concrete key type, as HSM and Vault signers do
+type opaqueSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (o *opaqueSigner) Public() crypto.PublicKey {
+	return o.key.Public()
+}
+
+func (o *opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return o.key.Sign(rand, digest, opts)
+}
+
+func TestNewKeyProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.STIRKeyConfig
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"default path", config.STIRKeyConfig{}, "/tmp/stir.key", "file", false},
+		{"explicit path", config.STIRKeyConfig{Source: "file", Path: "/tmp/other.key"}, "", "file", false},
+		{"no path", config.STIRKeyConfig{}, "", "memory", false},
+		{"vault", config.STIRKeyConfig{Source: "vault", VaultAddress: "http://vault:8200", VaultKeyName: "stir"}, "", "vault", false},
+		{"vault without address", config.STIRKeyConfig{Source: "vault", VaultKeyName: "stir"}, "", "", true},
+		{"unknown", config.STIRKeyConfig{Source: "tpm"}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewKeyProvider(&tt.cfg, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewKeyProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got string
+			switch provider.(type) {
+			case *FileKeyProvider:
+				got = "file"
+			case *memoryKeyProvider:
+				got = "memory"
+			case *VaultTransitKeyProvider:
+				got = "vault"
+			}
+			if got != tt.want {
+				t.Errorf("NewKeyProvider() = %T, want %s", provider, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "stir.key")
+	provider := NewFileKeyProvider(path)
+	ctx := context.Background()
+
+	first, err := provider.Signer(ctx)
+	if err != nil {
+		t.Fatalf("Signer() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("key file not persisted with mode 0600: %v", err)
+	}
+
+	// The same key is returned across restarts
+	again, err := NewFileKeyProvider(path).Signer(ctx)
+	if err != nil {
+		t.Fatalf("Signer() reload error = %v", err)
+	}
+	if !first.(*ecdsa.PrivateKey).Equal(again) {
+		t.Error("Signer() returned a different key after reload")
+	}
+
+	rotated, commit, err := provider.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if first.(*ecdsa.PrivateKey).Equal(rotated) {
+		t.Error("Rotate() returned the previous key")
+	}
+
+	// The staged key is not persisted before commit
+	if current, _ := NewFileKeyProvider(path).Signer(ctx); !first.(*ecdsa.PrivateKey).Equal(current) {
+		t.Error("Signer() returned the rotated key before commit")
+	}
+	if err := commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+	if current, _ := NewFileKeyProvider(path).Signer(ctx); !rotated.(*ecdsa.PrivateKey).Equal(current) {
+		t.Error("Signer() does not return the rotated key")
+	}
+}
+
+func TestFileKeyProvider_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stir.key")
+	os.WriteFile(path, []byte("not a key"), 0600)
+
+	if _, err := NewFileKeyProvider(path).Signer(context.Background()); err == nil {
+		t.Error("Signer() succeeded for a corrupt key file")
+	}
+	// The corrupt file must not be silently replaced
+	if data, _ := os.ReadFile(path); string(data) != "not a key" {
+		t.Error("Signer() overwrote an unreadable key file")
+	}
+}
+
+func TestSTIRSigner_OpaqueSigner(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := NewSTIRSigner(&opaqueSigner{key: key}, "https://example.com/cert.pem", AttestationFull)
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: &key.PublicKey})
+
+	token, err := signer.SignINVITE("+15145559876", "+15145551234", "call-1")
+	if err != nil {
+		t.Fatalf("SignINVITE() error = %v", err)
+	}
+	if _, err := verifier.VerifyINVITE(token); err != nil {
+		t.Errorf("VerifyINVITE() error = %v", err)
+	}
+}
+
+func TestRotatingSigner_InFlightSignature(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	blocking := &blockingSigner{key: oldKey, started: make(chan struct{}), release: make(chan struct{})}
+	rotating := NewRotatingSigner(blocking)
+	signer := NewSTIRSigner(rotating, "https://example.com/cert.pem", AttestationFull)
+
+	type result struct {
+		token string
+		err   error
+	}
+	inFlight := make(chan result)
+	go func() {
+		token, err := signer.SignINVITE("+15145559876", "+15145551234", "call-1")
+		inFlight <- result{token, err}
+	}()
+
+	// Rotate while the first signature is in progress
+	<-blocking.started
+	if previous := rotating.Rotate(newKey); previous != blocking {
+		t.Error("Rotate() did not return the previous signer")
+	}
+	close(blocking.release)
+
+	first := <-inFlight
+	if first.err != nil {
+		t.Fatalf("in-flight SignINVITE() error = %v", first.err)
+	}
+	if _, err := NewSTIRVerifier(&mockCertFetcher{publicKey: &oldKey.PublicKey}).VerifyINVITE(first.token); err != nil {
+		t.Errorf("in-flight signature does not verify with the previous key: %v", err)
+	}
+
+	second, err := signer.SignINVITE("+15145559876", "+15145551234", "call-2")
+	if err != nil {
+		t.Fatalf("SignINVITE() after rotation error = %v", err)
+	}
+	if _, err := NewSTIRVerifier(&mockCertFetcher{publicKey: &newKey.PublicKey}).VerifyINVITE(second); err != nil {
+		t.Errorf("signature after rotation does not verify with the new key: %v", err)
+	}
+}
+
+func TestACMECertificateManager_RotateKey(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManagerWithKeys(cfg, NewFileKeyProvider(cfg.KeyPath), log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManagerWithKeys() error = %v", err)
+	}
+	signer := NewSTIRSigner(mgr.GetSigner(), mgr.GetCertificateURL(), AttestationFull)
+	before := mgr.GetPrivateKey()
+
+	if err := mgr.RotateKey(context.Background()); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	after := mgr.GetPrivateKey()
+	if before.Equal(after) {
+		t.Fatal("RotateKey() kept the previous key")
+	}
+	if server.issuedCount() != 2 {
+		t.Errorf("issued = %d, want a certificate for the rotated key", server.issuedCount())
+	}
+
+	// The published certificate and existing signers follow the new key
+	cert, err := parseLeafCertificate(mgr.CertificateChainPEM(), after.Public())
+	if err != nil {
+		t.Fatalf("published certificate does not match the rotated key: %v", err)
+	}
+	token, err := signer.SignINVITE("+15145559876", "+15145551234", "call-1")
+	if err != nil {
+		t.Fatalf("SignINVITE() error = %v", err)
+	}
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: cert.PublicKey.(*ecdsa.PublicKey)})
+	if _, err := verifier.VerifyINVITE(token); err != nil {
+		t.Errorf("VerifyINVITE() with rotated certificate error = %v", err)
+	}
+}
+
+func TestACMECertificateManager_RotateKeyIssuanceFailure(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManager(cfg, log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManager() error = %v", err)
+	}
+	before := mgr.GetPrivateKey()
+	chain := string(mgr.CertificateChainPEM())
+
+	// The STI-PA token is no longer accepted, so no certificate can be issued
+	mgr.SetSPCTokenSource(&StaticSPCTokenSource{Token: "revoked"})
+	if err := mgr.RotateKey(context.Background()); err == nil {
+		t.Fatal("RotateKey() succeeded without a certificate")
+	}
+	if !before.Equal(mgr.GetPrivateKey()) || string(mgr.CertificateChainPEM()) != chain {
+		t.Error("failed rotation replaced the current key or certificate")
+	}
+
+	// The key file still holds the certified key
+	if key, err := loadECKey(cfg.KeyPath); err != nil || !before.Equal(key) {
+		t.Errorf("key file after failed rotation = %v, want the certified key", err)
+	}
+}
+
+func TestACMECertificateManager_UncommittedVaultRotation(t *testing.T) {
+	server := newFakeACMEServer(t, "1234", "spc-token")
+	cfg := newTestACMEConfig(t, server.directoryURL())
+	vault := newFakeVaultTransit(t, "root-token")
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+
+	mgr, err := NewACMECertificateManagerWithKeys(cfg, NewVaultTransitKeyProvider(vault.URL, "root-token", "", "stir"), log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManagerWithKeys() error = %v", err)
+	}
+	certified := mgr.GetSigner().Public()
+
+	mgr.SetSPCTokenSource(&StaticSPCTokenSource{Token: "revoked"})
+	if err := mgr.RotateKey(context.Background()); err == nil {
+		t.Fatal("RotateKey() succeeded without a certificate")
+	}
+
+	// After a restart the certified key version is used, not the latest
+	restarted, err := NewACMECertificateManagerWithKeys(cfg, NewVaultTransitKeyProvider(vault.URL, "root-token", "", "stir"), log)
+	if err != nil {
+		t.Fatalf("NewACMECertificateManagerWithKeys() restart error = %v", err)
+	}
+	if !restarted.GetSigner().Public().(*ecdsa.PublicKey).Equal(certified) {
+		t.Error("restarted manager does not use the certified key version")
+	}
+	if server.issuedCount() != 1 {
+		t.Errorf("issued = %d after restart, want the persisted certificate reused", server.issuedCount())
+	}
+}
@@ -0,0 +1,274 @@
+package stir
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultSignTimeout bounds a single Vault transit sign request
+const vaultSignTimeout = 10 * time.Second
+
+// VaultTransitKeyProvider keeps the signing key in a Vault transit engine.
+// The private key never leaves Vault; rotation creates a new key version.
+type VaultTransitKeyProvider struct {
+	address string
+	token   string
+	mount   string
+	keyName string
+	client  *http.Client
+
+	mu      sync.Mutex
+	version int // current key version, 0 for the latest
+}
+
+// NewVaultTransitKeyProvider creates a provider for the transit key keyName
+// at the Vault server address
+func NewVaultTransitKeyProvider(address, token, mount, keyName string) *VaultTransitKeyProvider {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultTransitKeyProvider{
+		address: strings.TrimRight(address, "/"),
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		keyName: keyName,
+		client: &http.Client{
+			Timeout: vaultSignTimeout,
+		},
+	}
+}
+
+// vaultTransitKey is the data of a transit key read response
+type vaultTransitKey struct {
+	Type          string `json:"type"`
+	LatestVersion int    `json:"latest_version"`
+	Keys          map[string]struct {
+		PublicKey string `json:"public_key"`
+	} `json:"keys"`
+}
+
+// Signer returns a signer pinned to the current key version, the latest
+// one until a rotation is committed, creating an ecdsa-p256 transit key if
+// it does not exist
+func (v *VaultTransitKeyProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	key, err := v.readKey(ctx)
+	if err == errVaultKeyNotFound {
+		if err := v.request(ctx, http.MethodPost, "keys/"+v.keyName, map[string]string{"type": "ecdsa-p256"}, nil); err != nil {
+			return nil, fmt.Errorf("failed to create transit key: %w", err)
+		}
+		key, err = v.readKey(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	version := v.version
+	if version == 0 {
+		version = key.LatestVersion
+		v.version = version
+	}
+	v.mu.Unlock()
+	return v.signer(key, version)
+}
+
+// Rotate creates a new key version and returns a signer pinned to it, which
+// commit makes current. Vault keeps every version, so an uncommitted one is
+// never used for signing; signers for earlier versions keep signing with
+// their version.
+func (v *VaultTransitKeyProvider) Rotate(ctx context.Context) (crypto.Signer, func() error, error) {
+	if err := v.request(ctx, http.MethodPost, "keys/"+v.keyName+"/rotate", nil, nil); err != nil {
+		return nil, nil, fmt.Errorf("failed to rotate transit key: %w", err)
+	}
+	key, err := v.readKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err := v.signer(key, key.LatestVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit := func() error {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.version = next.version
+		return nil
+	}
+	return next, commit, nil
+}
+
+// SignerFor returns a signer pinned to the key version whose public key is
+// pub and makes it current
+func (v *VaultTransitKeyProvider) SignerFor(ctx context.Context, pub crypto.PublicKey) (crypto.Signer, error) {
+	key, err := v.readKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for name := range key.Keys {
+		version, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		signer, err := v.signer(key, version)
+		if err != nil || !signer.public.Equal(pub) {
+			continue
+		}
+		v.mu.Lock()
+		v.version = version
+		v.mu.Unlock()
+		return signer, nil
+	}
+	return nil, fmt.Errorf("transit key %s has no version with the requested public key", v.keyName)
+}
+
+// signer returns a signer pinned to a version of key
+func (v *VaultTransitKeyProvider) signer(key *vaultTransitKey, version int) (*vaultSigner, error) {
+	if key.Type != "ecdsa-p256" {
+		return nil, fmt.Errorf("transit key %s has type %s, want ecdsa-p256", v.keyName, key.Type)
+	}
+	data, ok := key.Keys[strconv.Itoa(version)]
+	if !ok {
+		return nil, fmt.Errorf("transit key %s has no version %d", v.keyName, version)
+	}
+	pub, err := parseECPublicKeyPEM(data.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultSigner{provider: v, version: version, public: pub}, nil
+}
+
+// errVaultKeyNotFound is returned when the transit key does not exist
+var errVaultKeyNotFound = fmt.Errorf("transit key not found")
+
+// readKey reads the transit key metadata and public keys
+func (v *VaultTransitKeyProvider) readKey(ctx context.Context) (*vaultTransitKey, error) {
+	key := &vaultTransitKey{}
+	if err := v.request(ctx, http.MethodGet, "keys/"+v.keyName, nil, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// request calls the transit API at path and decodes the "data" member of the
+// response into out
+func (v *VaultTransitKeyProvider) request(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s", v.address, v.mount, path)
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return errVaultKeyNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&vaultErr)
+		return fmt.Errorf("vault returned status %d: %s", resp.StatusCode, strings.Join(vaultErr.Errors, "; "))
+	}
+
+	if out == nil {
+		return nil
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+// vaultSigner signs with one version of a Vault transit key
+type vaultSigner struct {
+	provider *VaultTransitKeyProvider
+	version  int
+	public   *ecdsa.PublicKey
+}
+
+// Public returns the public key of the pinned key version
+func (s *vaultSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs a SHA-256 digest with the pinned key version and returns an
+// ASN.1 ECDSA signature
+func (s *vaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("vault transit signer only supports SHA-256 digests")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultSignTimeout)
+	defer cancel()
+
+	var result struct {
+		Signature string `json:"signature"`
+	}
+	err := s.provider.request(ctx, http.MethodPost, "sign/"+s.provider.keyName+"/sha2-256", map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(digest),
+		"prehashed":            true,
+		"key_version":          s.version,
+		"marshaling_algorithm": "asn1",
+	}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("vault transit sign failed: %w", err)
+	}
+
+	// Signatures are returned as "vault:v<version>:<base64>"
+	parts := strings.SplitN(result.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("malformed vault signature")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// parseECPublicKeyPEM parses a PEM encoded P-256 public key
+func parseECPublicKeyPEM(data string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key PEM")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	pub, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an ECDSA key")
+	}
+	return pub, nil
+}
@@ -0,0 +1,157 @@
+package stir
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVaultTransit emulates the Vault transit engine for one ecdsa-p256 key
+type fakeVaultTransit struct {
+	*httptest.Server
+	token string
+
+	mu       sync.Mutex
+	versions []*ecdsa.PrivateKey
+	signedBy []int
+}
+
+func newFakeVaultTransit(t *testing.T, token string) *fakeVaultTransit {
+	f := &fakeVaultTransit{token: token}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeVaultTransit) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/transit/")
+	switch {
+	case path == "keys/stir" && r.Method == http.MethodGet:
+		if len(f.versions) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+			return
+		}
+		keys := map[string]interface{}{}
+		for i, key := range f.versions {
+			der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			keys[strconv.Itoa(i+1)] = map[string]string{
+				"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"type":           "ecdsa-p256",
+			"latest_version": len(f.versions),
+			"keys":           keys,
+		}})
+	case path == "keys/stir" && r.Method == http.MethodPost, path == "keys/stir/rotate":
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		f.versions = append(f.versions, key)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "sign/stir/sha2-256":
+		var req struct {
+			Input      string `json:"input"`
+			Prehashed  bool   `json:"prehashed"`
+			KeyVersion int    `json:"key_version"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Prehashed || req.KeyVersion < 1 || req.KeyVersion > len(f.versions) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"invalid request"}})
+			return
+		}
+		digest, _ := base64.StdEncoding.DecodeString(req.Input)
+		sig, _ := ecdsa.SignASN1(rand.Reader, f.versions[req.KeyVersion-1], digest)
+		f.signedBy = append(f.signedBy, req.KeyVersion)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+			"signature": fmt.Sprintf("vault:v%d:%s", req.KeyVersion, base64.StdEncoding.EncodeToString(sig)),
+		}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestVaultTransitKeyProvider(t *testing.T) {
+	vault := newFakeVaultTransit(t, "root-token")
+	provider := NewVaultTransitKeyProvider(vault.URL, "root-token", "transit", "stir")
+	ctx := context.Background()
+
+	// The transit key is created on first use
+	first, err := provider.Signer(ctx)
+	if err != nil {
+		t.Fatalf("Signer() error = %v", err)
+	}
+
+	token, err := NewSTIRSigner(first, "https://example.com/cert.pem", AttestationFull).
+		SignINVITE("+15145559876", "+15145551234", "call-1")
+	if err != nil {
+		t.Fatalf("SignINVITE() error = %v", err)
+	}
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: first.Public().(*ecdsa.PublicKey)})
+	if _, err := verifier.VerifyINVITE(token); err != nil {
+		t.Errorf("VerifyINVITE() error = %v", err)
+	}
+
+	rotated, commit, err := provider.Rotate(ctx)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if rotated.Public().(*ecdsa.PublicKey).Equal(first.Public()) {
+		t.Error("Rotate() returned the previous key version")
+	}
+	if current, _ := provider.Signer(ctx); !current.Public().(*ecdsa.PublicKey).Equal(first.Public()) {
+		t.Error("Signer() returned the rotated key version before commit")
+	}
+	commit()
+	if current, _ := provider.Signer(ctx); !current.Public().(*ecdsa.PublicKey).Equal(rotated.Public()) {
+		t.Error("Signer() does not return the committed key version")
+	}
+
+	// A signer obtained before rotation stays pinned to its key version
+	if _, err := NewSTIRSigner(first, "https://example.com/cert.pem", AttestationFull).
+		SignINVITE("+15145559876", "+15145551234", "call-2"); err != nil {
+		t.Fatalf("SignINVITE() with previous version error = %v", err)
+	}
+	if _, err := NewSTIRSigner(rotated, "https://example.com/cert.pem", AttestationFull).
+		SignINVITE("+15145559876", "+15145551234", "call-3"); err != nil {
+		t.Fatalf("SignINVITE() with rotated version error = %v", err)
+	}
+
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	want := []int{1, 1, 2}
+	if fmt.Sprint(vault.signedBy) != fmt.Sprint(want) {
+		t.Errorf("signed with key versions %v, want %v", vault.signedBy, want)
+	}
+}
+
+func TestVaultTransitKeyProvider_PermissionDenied(t *testing.T) {
+	vault := newFakeVaultTransit(t, "root-token")
+	provider := NewVaultTransitKeyProvider(vault.URL, "wrong-token", "", "stir")
+
+	_, err := provider.Signer(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Signer() error = %v, want permission denied", err)
+	}
+}
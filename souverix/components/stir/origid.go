@@ -0,0 +1,77 @@
+package stir
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+)
+
+// nameSpaceDNS is the RFC 4122 DNS namespace UUID
+var nameSpaceDNS = [16]byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// OrigIDRegistry assigns origid values (ATIS-1000074) to origination points
+// such as trunks and customers. Unless set explicitly, an origid is a
+// name-based UUID derived from the key, so it is stable across restarts.
+type OrigIDRegistry struct {
+	mu        sync.RWMutex
+	namespace [16]byte
+	ids       map[string]string
+}
+
+// NewOrigIDRegistry creates a registry whose derived origids are scoped to domain
+func NewOrigIDRegistry(domain string) *OrigIDRegistry {
+	return &OrigIDRegistry{
+		namespace: uuidV5(nameSpaceDNS, domain),
+		ids:       make(map[string]string),
+	}
+}
+
+// Set records a fixed origid for key (e.g. one provisioned for a trunk)
+func (r *OrigIDRegistry) Set(key, origID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids[key] = origID
+}
+
+// Get returns the origid set for key, or the one derived from it. Derived
+// origids are computed on each call rather than recorded, so keys taken from
+// arbitrary remote addresses do not accumulate.
+func (r *OrigIDRegistry) Get(key string) string {
+	r.mu.RLock()
+	origID, ok := r.ids[key]
+	r.mu.RUnlock()
+	if ok {
+		return origID
+	}
+	return formatUUID(uuidV5(r.namespace, key))
+}
+
+// Snapshot returns the origids set explicitly, keyed by origination point
+func (r *OrigIDRegistry) Snapshot() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make(map[string]string, len(r.ids))
+	for k, v := range r.ids {
+		ids[k] = v
+	}
+	return ids
+}
+
+// uuidV5 computes a name-based SHA-1 UUID (RFC 4122 Section 4.3)
+func uuidV5(namespace [16]byte, name string) [16]byte {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = (u[6] & 0x0f) | 0x50 // version 5
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return u
+}
+
+// formatUUID formats a UUID in its canonical string form
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
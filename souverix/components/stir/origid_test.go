@@ -0,0 +1,36 @@
+package stir
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestOrigIDRegistry(t *testing.T) {
+	registry := NewOrigIDRegistry("ims.local")
+
+	id := registry.Get("trunk:PEER-A")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("Get() = %v, want a version 5 UUID", id)
+	}
+
+	// Derived origids are stable across registries for the same domain
+	if again := NewOrigIDRegistry("ims.local").Get("trunk:PEER-A"); again != id {
+		t.Errorf("Get() = %v, want stable %v", again, id)
+	}
+	if other := NewOrigIDRegistry("other.example").Get("trunk:PEER-A"); other == id {
+		t.Error("Get() should differ between domains")
+	}
+	if other := registry.Get("trunk:PEER-B"); other == id {
+		t.Error("Get() should differ between origination points")
+	}
+
+	registry.Set("trunk:PEER-C", "fixed-origid")
+	if got := registry.Get("trunk:PEER-C"); got != "fixed-origid" {
+		t.Errorf("Get() = %v, want fixed-origid", got)
+	}
+
+	// Only origids set explicitly are recorded
+	if got := len(registry.Snapshot()); got != 1 {
+		t.Errorf("Snapshot() has %d entries, want 1", got)
+	}
+}
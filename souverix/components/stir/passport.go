@@ -1,6 +1,7 @@
 package stir
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"encoding/base64"
 	"fmt"
@@ -26,10 +27,27 @@ type PASSporT struct {
 	// PASSporT specific claims
 	Orig OrigClaim `json:"orig"`
 	Dest DestClaim `json:"dest"`
-	Attest AttestationLevel `json:"attest"`
+	Attest AttestationLevel `json:"attest,omitempty"`
 	OrigID string `json:"origid,omitempty"`
+
+	// Diversion claim (RFC 8946), only present in "div" PASSporTs
+	Div *DivClaim `json:"div,omitempty"`
+
+	// Rich Call Data claims (RFC 9795)
+	RCD  *RCDClaim         `json:"rcd,omitempty"`
+	RCDI map[string]string `json:"rcdi,omitempty"`
+
+	// PPT is the PASSporT extension carried in the JWT header ("shaken", "div").
+	// It is not a claim and is populated on verification.
+	PPT string `json:"-"`
 }
 
+// PASSporT extension types (ppt header values)
+const (
+	PPTShaken = "shaken" // RFC 8588
+	PPTDiv    = "div"    // RFC 8946
+)
+
 // OrigClaim represents the originating telephone number claim
 type OrigClaim struct {
 	TN string `json:"tn"` // Telephone number
@@ -42,15 +60,16 @@ type DestClaim struct {
 
 // STIRSigner signs SIP INVITE messages with STIR/SHAKEN
 type STIRSigner struct {
-	privateKey *ecdsa.PrivateKey
+	signer     crypto.Signer // P-256 key, possibly held in an HSM or Vault
 	certURL    string // URL to fetch public certificate
 	attestation AttestationLevel
 }
 
-// NewSTIRSigner creates a new STIR signer
-func NewSTIRSigner(privateKey *ecdsa.PrivateKey, certURL string, attestation AttestationLevel) *STIRSigner {
+// NewSTIRSigner creates a new STIR signer. signer may be an *ecdsa.PrivateKey
+// or any P-256 crypto.Signer, e.g. a RotatingSigner from ACMECertificateManager.
+func NewSTIRSigner(signer crypto.Signer, certURL string, attestation AttestationLevel) *STIRSigner {
 	return &STIRSigner{
-		privateKey: privateKey,
+		signer:     signer,
 		certURL:    certURL,
 		attestation: attestation,
 	}
@@ -58,30 +77,74 @@ func NewSTIRSigner(privateKey *ecdsa.PrivateKey, certURL string, attestation Att
 
 // SignINVITE signs an INVITE message with a PASSporT token
 func (s *STIRSigner) SignINVITE(origTN, destTN string, callID string) (string, error) {
+	return s.SignINVITEWithAttestation(origTN, destTN, callID, s.attestation)
+}
+
+// SignINVITEWithAttestation signs an INVITE with an explicit attestation level
+// instead of the signer default (e.g. gateway attestation for re-signed transit calls)
+func (s *STIRSigner) SignINVITEWithAttestation(origTN, destTN string, callID string, attestation AttestationLevel) (string, error) {
+	return s.Sign(&SignRequest{
+		OrigTN:      origTN,
+		DestTN:      destTN,
+		CallID:      callID,
+		Attestation: attestation,
+	})
+}
+
+// SignRequest describes the shaken PASSporT to create for an INVITE
+type SignRequest struct {
+	OrigTN      string
+	DestTN      string
+	CallID      string
+	Attestation AttestationLevel // signer default if empty
+	OrigID      string           // origination identifier (UUID), optional
+
+	// Rich Call Data (RFC 9795), optional
+	RCD  *RCDClaim
+	RCDI map[string]string
+}
+
+// Sign signs an INVITE with a shaken PASSporT built from req
+func (s *STIRSigner) Sign(req *SignRequest) (string, error) {
+	attestation := req.Attestation
+	if attestation == "" {
+		attestation = s.attestation
+	}
+
 	// Create PASSporT token
 	passport := &PASSporT{
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)), // Short-lived
-			ID:        callID,
+			ID:        req.CallID,
 		},
 		Orig: OrigClaim{
-			TN: origTN,
+			TN: req.OrigTN,
 		},
 		Dest: DestClaim{
-			TN: []string{destTN},
+			TN: []string{req.DestTN},
 		},
-		Attest: s.attestation,
+		Attest: attestation,
+		OrigID: req.OrigID,
+		RCD:    req.RCD,
+		RCDI:   req.RCDI,
 	}
 
+	return s.sign(passport, PPTShaken)
+}
+
+// sign signs a PASSporT with the given extension type
+func (s *STIRSigner) sign(passport *PASSporT, ppt string) (string, error) {
 	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, passport)
+	token := jwt.NewWithClaims(signingMethodES256, passport)
 
 	// Set header
+	token.Header["typ"] = "passport"
+	token.Header["ppt"] = ppt
 	token.Header["x5u"] = s.certURL // Certificate URL for verification
 
 	// Sign token
-	tokenString, err := token.SignedString(s.privateKey)
+	tokenString, err := token.SignedString(s.signer)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign PASSporT token: %w", err)
 	}
@@ -108,8 +171,10 @@ func NewSTIRVerifier(fetcher CertificateFetcher) *STIRVerifier {
 
 // VerifyINVITE verifies the Identity header in an INVITE message
 func (v *STIRVerifier) VerifyINVITE(identityHeader string) (*PASSporT, error) {
+	passport := &PASSporT{}
+
 	// Parse token
-	token, err := jwt.Parse(identityHeader, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(identityHeader, passport, func(token *jwt.Token) (interface{}, error) {
 		// Check signing method
 		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -138,35 +203,8 @@ func (v *STIRVerifier) VerifyINVITE(identityHeader string) (*PASSporT, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
-	// Extract claims
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid claims format")
-	}
-
-	// Build PASSporT from claims
-	passport := &PASSporT{}
-	
-	if orig, ok := claims["orig"].(map[string]interface{}); ok {
-		if tn, ok := orig["tn"].(string); ok {
-			passport.Orig.TN = tn
-		}
-	}
-
-	if dest, ok := claims["dest"].(map[string]interface{}); ok {
-		if tnArray, ok := dest["tn"].([]interface{}); ok {
-			passport.Dest.TN = make([]string, 0, len(tnArray))
-			for _, tn := range tnArray {
-				if tnStr, ok := tn.(string); ok {
-					passport.Dest.TN = append(passport.Dest.TN, tnStr)
-				}
-			}
-		}
-	}
-
-	if attest, ok := claims["attest"].(string); ok {
-		passport.Attest = AttestationLevel(attest)
-	}
+	// Tokens without a ppt header are treated as base PASSporTs
+	passport.PPT, _ = token.Header["ppt"].(string)
 
 	return passport, nil
 }
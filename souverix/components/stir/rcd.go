@@ -0,0 +1,309 @@
+package stir
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RCDClaim represents the Rich Call Data claim of a PASSporT (RFC 9795)
+type RCDClaim struct {
+	Nam string          `json:"nam"`           // Display name
+	JCD json.RawMessage `json:"jcd,omitempty"` // Inline jCard (RFC 7095)
+	JCL string          `json:"jcl,omitempty"` // URL of a jCard
+	ICN string          `json:"icn,omitempty"` // URL of an icon/logo
+	CRN string          `json:"crn,omitempty"` // Call reason
+}
+
+// VerifiedRCD is the Rich Call Data that passed signature and integrity checks.
+// URL-referenced content is only exposed when covered by a matching rcdi digest.
+type VerifiedRCD struct {
+	DisplayName string
+	CallReason  string
+	IconURL     string
+	JCard       json.RawMessage
+}
+
+// RCDContentFetcher fetches content referenced by URL from RCD claims
+type RCDContentFetcher interface {
+	FetchRCDContent(url string) ([]byte, error)
+}
+
+// HTTPRCDContentFetcher fetches RCD content over HTTP(S)
+type HTTPRCDContentFetcher struct {
+	client *http.Client
+}
+
+// NewHTTPRCDContentFetcher creates an HTTP fetcher for RCD content
+func NewHTTPRCDContentFetcher() *HTTPRCDContentFetcher {
+	return &HTTPRCDContentFetcher{
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// maxRCDContentSize bounds icon and jCard downloads
+const maxRCDContentSize = 1 << 20
+
+// maxRCDRedirects bounds the redirects followed by a fetch
+const maxRCDRedirects = 5
+
+// SetAllowedHosts makes f follow redirects to the https URLs of hosts only,
+// so that an allowed host cannot send a fetch elsewhere. Redirects are
+// followed to any host until it is called.
+func (f *HTTPRCDContentFetcher) SetAllowedHosts(hosts []string) {
+	f.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRCDRedirects {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+		return allowedRCDURL(hosts, req.URL.String())
+	}
+}
+
+// FetchRCDContent fetches the content at url
+func (f *HTTPRCDContentFetcher) FetchRCDContent(url string) ([]byte, error) {
+	resp, err := f.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch RCD content: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RCD content fetch failed with status: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRCDContentSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RCD content: %w", err)
+	}
+	return data, nil
+}
+
+// RCDDigest computes an rcdi integrity digest ("sha256-<base64>") over content
+func RCDDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyRCDDigest checks content against an rcdi digest value
+func verifyRCDDigest(digest string, content []byte) error {
+	alg, value, ok := strings.Cut(digest, "-")
+	if !ok {
+		return fmt.Errorf("malformed rcdi digest: %s", digest)
+	}
+
+	var h hash.Hash
+	switch alg {
+	case "sha256":
+		h = sha256.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported rcdi digest algorithm: %s", alg)
+	}
+	h.Write(content)
+
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != value {
+		return fmt.Errorf("rcdi digest mismatch")
+	}
+	return nil
+}
+
+// ComputeRCDI computes the rcdi claim for rcd. Every URL in the claim (icn,
+// jcl and URI-valued jCard properties) gets a digest keyed by its JSON pointer.
+// It returns nil if rcd references no URLs.
+func ComputeRCDI(rcd *RCDClaim, fetcher RCDContentFetcher) (map[string]string, error) {
+	refs, err := rcdReferences(rcd, fetcher)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	rcdi := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		content, err := ref.fetch(fetcher)
+		if err != nil {
+			return nil, err
+		}
+		rcdi[ref.pointer] = RCDDigest(content)
+	}
+	return rcdi, nil
+}
+
+// VerifyRCD validates the Rich Call Data of a verified PASSporT. If rcdi is
+// present, every referenced URL must have a digest and the fetched content
+// must match it; otherwise only the signed inline data is returned.
+// It returns nil if the PASSporT carries no RCD.
+func VerifyRCD(passport *PASSporT, fetcher RCDContentFetcher) (*VerifiedRCD, error) {
+	rcd := passport.RCD
+	if rcd == nil {
+		return nil, nil
+	}
+	if rcd.Nam == "" {
+		return nil, fmt.Errorf("rcd claim is missing nam")
+	}
+
+	verified := &VerifiedRCD{
+		DisplayName: rcd.Nam,
+		CallReason:  rcd.CRN,
+	}
+
+	if len(passport.RCDI) == 0 {
+		// Without rcdi, URL content is not integrity protected
+		if len(rcd.JCD) > 0 {
+			if uris, err := jcardURIs(rcd.JCD); err == nil && len(uris) == 0 {
+				verified.JCard = rcd.JCD
+			}
+		}
+		return verified, nil
+	}
+
+	refs, err := rcdReferences(rcd, fetcher)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range refs {
+		digest, ok := passport.RCDI[ref.pointer]
+		if !ok {
+			return nil, fmt.Errorf("rcdi is missing a digest for %s", ref.pointer)
+		}
+		content, err := ref.fetch(fetcher)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyRCDDigest(digest, content); err != nil {
+			return nil, fmt.Errorf("%s: %w", ref.pointer, err)
+		}
+	}
+
+	verified.IconURL = rcd.ICN
+	if len(rcd.JCD) > 0 {
+		verified.JCard = rcd.JCD
+	}
+	for _, ref := range refs {
+		if ref.pointer == "/jcl" {
+			verified.JCard = ref.content
+		}
+	}
+
+	return verified, nil
+}
+
+// rcdReference is a URL referenced from an RCD claim
+type rcdReference struct {
+	pointer string // JSON pointer (RFC 6901) used as the rcdi key
+	url     string
+	content []byte // already fetched content, if any
+}
+
+// fetch returns the content of the reference, fetching it if needed
+func (r rcdReference) fetch(fetcher RCDContentFetcher) ([]byte, error) {
+	if r.content != nil {
+		return r.content, nil
+	}
+	if fetcher == nil {
+		return nil, fmt.Errorf("no fetcher for %s content", r.pointer)
+	}
+	content, err := fetcher.FetchRCDContent(r.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", r.pointer, err)
+	}
+	return content, nil
+}
+
+// rcdReferences lists the URLs referenced by rcd. The jCard behind jcl is
+// fetched to discover the URIs it references.
+func rcdReferences(rcd *RCDClaim, fetcher RCDContentFetcher) ([]rcdReference, error) {
+	var refs []rcdReference
+
+	if rcd.ICN != "" {
+		refs = append(refs, rcdReference{pointer: "/icn", url: rcd.ICN})
+	}
+
+	if len(rcd.JCD) > 0 {
+		uris, err := jcardURIs(rcd.JCD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jcd: %w", err)
+		}
+		for _, u := range uris {
+			refs = append(refs, rcdReference{pointer: "/jcd" + u.pointer, url: u.url})
+		}
+	}
+
+	if rcd.JCL != "" {
+		if fetcher == nil {
+			return nil, fmt.Errorf("no fetcher for jcl content")
+		}
+		card, err := fetcher.FetchRCDContent(rcd.JCL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch /jcl: %w", err)
+		}
+		refs = append(refs, rcdReference{pointer: "/jcl", url: rcd.JCL, content: card})
+
+		uris, err := jcardURIs(card)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jCard at jcl: %w", err)
+		}
+		for _, u := range uris {
+			refs = append(refs, rcdReference{pointer: "/jcl" + u.pointer, url: u.url})
+		}
+	}
+
+	return refs, nil
+}
+
+// jcardURI is a URI-valued property of a jCard
+type jcardURI struct {
+	pointer string // relative to the jCard root, e.g. "/1/3/3"
+	url     string
+}
+
+// jcardURIs returns the URI-valued properties of a jCard (RFC 7095).
+// A jCard is ["vcard", [[name, params, type, value], ...]].
+func jcardURIs(card []byte) ([]jcardURI, error) {
+	var root []json.RawMessage
+	if err := json.Unmarshal(card, &root); err != nil {
+		return nil, err
+	}
+	if len(root) != 2 {
+		return nil, fmt.Errorf("jCard must have two elements")
+	}
+
+	var properties [][]json.RawMessage
+	if err := json.Unmarshal(root[1], &properties); err != nil {
+		return nil, fmt.Errorf("invalid jCard properties: %w", err)
+	}
+
+	var uris []jcardURI
+	for i, property := range properties {
+		if len(property) < 4 {
+			return nil, fmt.Errorf("jCard property %d is incomplete", i)
+		}
+		var valueType, value string
+		if json.Unmarshal(property[2], &valueType) != nil || valueType != "uri" {
+			continue
+		}
+		if err := json.Unmarshal(property[3], &value); err != nil {
+			return nil, fmt.Errorf("jCard property %d has a non-string uri", i)
+		}
+		uris = append(uris, jcardURI{
+			pointer: "/1/" + strconv.Itoa(i) + "/3",
+			url:     value,
+		})
+	}
+	return uris, nil
+}
@@ -0,0 +1,152 @@
+package stir
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// mapRCDFetcher serves RCD content from memory
+type mapRCDFetcher map[string][]byte
+
+func (m mapRCDFetcher) FetchRCDContent(url string) ([]byte, error) {
+	content, ok := m[url]
+	if !ok {
+		return nil, fmt.Errorf("not found: %s", url)
+	}
+	return content, nil
+}
+
+const testJCard = `["vcard",[["version",{},"text","4.0"],["fn",{},"text","Acme Corp"],["logo",{},"uri","https://rcd.example.com/logo-small.png"]]]`
+
+func newRCDFixture() (*RCDClaim, mapRCDFetcher) {
+	fetcher := mapRCDFetcher{
+		"https://rcd.example.com/logo.png":       []byte("logo-bytes"),
+		"https://rcd.example.com/logo-small.png": []byte("small-logo-bytes"),
+		"https://rcd.example.com/acme.json":      []byte(testJCard),
+	}
+	rcd := &RCDClaim{
+		Nam: "Acme Corp",
+		ICN: "https://rcd.example.com/logo.png",
+		JCL: "https://rcd.example.com/acme.json",
+		CRN: "Delivery update",
+	}
+	return rcd, fetcher
+}
+
+func TestComputeRCDI(t *testing.T) {
+	rcd, fetcher := newRCDFixture()
+
+	rcdi, err := ComputeRCDI(rcd, fetcher)
+	if err != nil {
+		t.Fatalf("ComputeRCDI() error = %v", err)
+	}
+
+	want := map[string]string{
+		"/icn":       RCDDigest([]byte("logo-bytes")),
+		"/jcl":       RCDDigest([]byte(testJCard)),
+		"/jcl/1/2/3": RCDDigest([]byte("small-logo-bytes")),
+	}
+	if len(rcdi) != len(want) {
+		t.Fatalf("ComputeRCDI() = %v, want %v", rcdi, want)
+	}
+	for pointer, digest := range want {
+		if rcdi[pointer] != digest {
+			t.Errorf("rcdi[%s] = %v, want %v", pointer, rcdi[pointer], digest)
+		}
+	}
+
+	// Inline jCard URIs are keyed under /jcd
+	inline := &RCDClaim{Nam: "Acme Corp", JCD: json.RawMessage(testJCard)}
+	rcdi, err = ComputeRCDI(inline, fetcher)
+	if err != nil {
+		t.Fatalf("ComputeRCDI() error = %v", err)
+	}
+	if _, ok := rcdi["/jcd/1/2/3"]; !ok || len(rcdi) != 1 {
+		t.Errorf("ComputeRCDI() inline = %v, want only /jcd/1/2/3", rcdi)
+	}
+}
+
+func TestSTIRSigner_SignWithRCD(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := NewSTIRSigner(privateKey, "https://example.com/cert.pem", AttestationFull)
+	verifier := NewSTIRVerifier(&mockCertFetcher{publicKey: &privateKey.PublicKey})
+
+	rcd, fetcher := newRCDFixture()
+	rcdi, _ := ComputeRCDI(rcd, fetcher)
+
+	token, err := signer.Sign(&SignRequest{
+		OrigTN: "+15145559876",
+		DestTN: "+15145551234",
+		CallID: "test-call-id",
+		RCD:    rcd,
+		RCDI:   rcdi,
+	})
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	passport, err := verifier.VerifyINVITE(token)
+	if err != nil {
+		t.Fatalf("VerifyINVITE() error = %v", err)
+	}
+
+	verified, err := VerifyRCD(passport, fetcher)
+	if err != nil {
+		t.Fatalf("VerifyRCD() error = %v", err)
+	}
+	if verified.DisplayName != "Acme Corp" {
+		t.Errorf("VerifyRCD() name = %v, want Acme Corp", verified.DisplayName)
+	}
+	if verified.IconURL != rcd.ICN {
+		t.Errorf("VerifyRCD() icon = %v, want %v", verified.IconURL, rcd.ICN)
+	}
+	if string(verified.JCard) != testJCard {
+		t.Errorf("VerifyRCD() jCard = %s, want %s", verified.JCard, testJCard)
+	}
+	if verified.CallReason != "Delivery update" {
+		t.Errorf("VerifyRCD() crn = %v, want Delivery update", verified.CallReason)
+	}
+}
+
+func TestVerifyRCD_Integrity(t *testing.T) {
+	rcd, fetcher := newRCDFixture()
+	rcdi, _ := ComputeRCDI(rcd, fetcher)
+
+	t.Run("tampered icon", func(t *testing.T) {
+		tampered := mapRCDFetcher{}
+		for k, v := range fetcher {
+			tampered[k] = v
+		}
+		tampered[rcd.ICN] = []byte("other-logo")
+		if _, err := VerifyRCD(&PASSporT{RCD: rcd, RCDI: rcdi}, tampered); err == nil {
+			t.Error("VerifyRCD() should fail for tampered icon")
+		}
+	})
+
+	t.Run("missing digest", func(t *testing.T) {
+		partial := map[string]string{"/icn": rcdi["/icn"]}
+		if _, err := VerifyRCD(&PASSporT{RCD: rcd, RCDI: partial}, fetcher); err == nil {
+			t.Error("VerifyRCD() should fail when a URL has no digest")
+		}
+	})
+
+	t.Run("missing nam", func(t *testing.T) {
+		if _, err := VerifyRCD(&PASSporT{RCD: &RCDClaim{ICN: rcd.ICN}}, fetcher); err == nil {
+			t.Error("VerifyRCD() should fail without nam")
+		}
+	})
+
+	t.Run("no rcdi", func(t *testing.T) {
+		verified, err := VerifyRCD(&PASSporT{RCD: rcd}, fetcher)
+		if err != nil {
+			t.Fatalf("VerifyRCD() error = %v", err)
+		}
+		if verified.DisplayName != "Acme Corp" || verified.IconURL != "" || verified.JCard != nil {
+			t.Errorf("VerifyRCD() = %+v, want name only", verified)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package stir
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRCDContentPending is returned for RCD content that is being fetched in
+// the background
+var ErrRCDContentPending = errors.New("RCD content not fetched yet")
+
+// ErrRCDContentUnavailable is returned for RCD content of hosts that are not
+// allowed or that failed to serve it
+var ErrRCDContentUnavailable = errors.New("RCD content unavailable")
+
+// RCD content cache limits
+const (
+	rcdCacheTTL          = time.Hour
+	rcdFailureTTL        = time.Minute
+	rcdCacheEntries      = 1024
+	rcdConcurrentFetches = 8
+)
+
+// CachedRCDContentFetcher fetches RCD content of allowed hosts in the
+// background and serves it from a bounded cache, so that verifying and
+// signing calls never wait on the network nor fetches URLs chosen by a
+// remote signer from arbitrary hosts
+type CachedRCDContentFetcher struct {
+	fetcher RCDContentFetcher
+	hosts   []string // allowed hosts; "*.example.com" allows the subdomains
+	now     func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*rcdCacheEntry // key: URL
+	fetching map[string]bool
+	slots    chan struct{} // bounds the concurrent background fetches
+}
+
+// rcdCacheEntry is the cached result of a fetch
+type rcdCacheEntry struct {
+	content []byte
+	err     error
+	expires time.Time
+}
+
+// NewCachedRCDContentFetcher serves the content fetcher fetches from the
+// https URLs of hosts. No URL is fetched when hosts is empty.
+func NewCachedRCDContentFetcher(fetcher RCDContentFetcher, hosts []string) *CachedRCDContentFetcher {
+	return &CachedRCDContentFetcher{
+		fetcher:  fetcher,
+		hosts:    hosts,
+		now:      time.Now,
+		entries:  make(map[string]*rcdCacheEntry),
+		fetching: make(map[string]bool),
+		slots:    make(chan struct{}, rcdConcurrentFetches),
+	}
+}
+
+// FetchRCDContent returns the cached content at rawURL. Content not cached
+// yet is fetched in the background and ErrRCDContentPending returned.
+func (c *CachedRCDContentFetcher) FetchRCDContent(rawURL string) ([]byte, error) {
+	if err := c.allowed(rawURL); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[rawURL]; ok && c.now().Before(e.expires) {
+		return e.content, e.err
+	}
+	if !c.fetching[rawURL] {
+		select {
+		case c.slots <- struct{}{}:
+			c.fetching[rawURL] = true
+			go c.fetch(rawURL)
+		default:
+			// Too many fetches in flight: a later call retries
+		}
+	}
+	return nil, ErrRCDContentPending
+}
+
+// fetch fetches rawURL into the cache
+func (c *CachedRCDContentFetcher) fetch(rawURL string) {
+	defer func() { <-c.slots }()
+	content, err := c.fetcher.FetchRCDContent(rawURL)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrRCDContentUnavailable, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fetching, rawURL)
+	now := c.now()
+	e := &rcdCacheEntry{content: content, err: err, expires: now.Add(rcdCacheTTL)}
+	if err != nil {
+		e.content = nil
+		e.expires = now.Add(rcdFailureTTL)
+	}
+	if len(c.entries) >= rcdCacheEntries {
+		c.evict(now)
+	}
+	c.entries[rawURL] = e
+}
+
+// evict removes the expired entries, or the one expiring first when none
+// is. c.mu is held.
+func (c *CachedRCDContentFetcher) evict(now time.Time) {
+	var oldest string
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= rcdCacheEntries {
+		delete(c.entries, oldest)
+	}
+}
+
+// allowed checks that rawURL is an https URL of an allowed host
+func (c *CachedRCDContentFetcher) allowed(rawURL string) error {
+	return allowedRCDURL(c.hosts, rawURL)
+}
+
+// allowedRCDURL checks that rawURL is an https URL of one of hosts
+func allowedRCDURL(hosts []string, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("%w: %q is not an https URL", ErrRCDContentUnavailable, rawURL)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %q is not allowed", ErrRCDContentUnavailable, host)
+}
@@ -0,0 +1,160 @@
+package stir
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRCDFetcher serves fixture content and counts its fetches
+type countingRCDFetcher struct {
+	mapRCDFetcher
+	fetches int32
+}
+
+func (f *countingRCDFetcher) FetchRCDContent(url string) ([]byte, error) {
+	atomic.AddInt32(&f.fetches, 1)
+	return f.mapRCDFetcher.FetchRCDContent(url)
+}
+
+// fetched waits for the background fetch of url and returns its result
+func fetched(t *testing.T, c *CachedRCDContentFetcher, url string) ([]byte, error) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		content, err := c.FetchRCDContent(url)
+		if !errors.Is(err, ErrRCDContentPending) {
+			return content, err
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still pending", url)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCachedRCDContentFetcher(t *testing.T) {
+	_, fixture := newRCDFixture()
+	fetcher := &countingRCDFetcher{mapRCDFetcher: fixture}
+	c := NewCachedRCDContentFetcher(fetcher, []string{"*.example.com"})
+
+	// The first call does not wait on the network
+	if _, err := c.FetchRCDContent("https://rcd.example.com/logo.png"); !errors.Is(err, ErrRCDContentPending) {
+		t.Fatalf("first FetchRCDContent() error = %v, want pending", err)
+	}
+	content, err := fetched(t, c, "https://rcd.example.com/logo.png")
+	if err != nil || string(content) != "logo-bytes" {
+		t.Fatalf("FetchRCDContent() = %q, %v", content, err)
+	}
+	c.FetchRCDContent("https://rcd.example.com/logo.png")
+	if n := atomic.LoadInt32(&fetcher.fetches); n != 1 {
+		t.Errorf("fetched %d times, want once", n)
+	}
+
+	// Failures are cached too
+	if _, err := fetched(t, c, "https://rcd.example.com/missing.png"); err == nil {
+		t.Error("FetchRCDContent() of a missing URL error = nil")
+	}
+	c.FetchRCDContent("https://rcd.example.com/missing.png")
+	if n := atomic.LoadInt32(&fetcher.fetches); n != 2 {
+		t.Errorf("fetched %d times, want failures cached", n)
+	}
+
+	// Cached entries expire
+	c.now = func() time.Time { return time.Now().Add(2 * rcdCacheTTL) }
+	if _, err := c.FetchRCDContent("https://rcd.example.com/logo.png"); !errors.Is(err, ErrRCDContentPending) {
+		t.Errorf("FetchRCDContent() after expiry error = %v, want pending", err)
+	}
+}
+
+func TestCachedRCDContentFetcher_AllowedHosts(t *testing.T) {
+	_, fixture := newRCDFixture()
+	tests := []struct {
+		name  string
+		hosts []string
+		url   string
+		ok    bool
+	}{
+		{"exact host", []string{"rcd.example.com"}, "https://rcd.example.com/logo.png", true},
+		{"subdomain", []string{"*.example.com"}, "https://rcd.example.com/logo.png", true},
+		{"other host", []string{"rcd.example.com"}, "https://169.254.169.254/latest/meta-data", false},
+		{"suffix of another domain", []string{"*.example.com"}, "https://rcd.badexample.com/logo.png", false},
+		{"plain http", []string{"rcd.example.com"}, "http://rcd.example.com/logo.png", false},
+		{"no allowlist", nil, "https://rcd.example.com/logo.png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := &countingRCDFetcher{mapRCDFetcher: fixture}
+			c := NewCachedRCDContentFetcher(fetcher, tt.hosts)
+			_, err := c.FetchRCDContent(tt.url)
+			if ok := errors.Is(err, ErrRCDContentPending); ok != tt.ok {
+				t.Errorf("FetchRCDContent(%q) error = %v, want allowed %v", tt.url, err, tt.ok)
+			}
+			if !tt.ok && !errors.Is(err, ErrRCDContentUnavailable) {
+				t.Errorf("FetchRCDContent(%q) error = %v, want unavailable", tt.url, err)
+			}
+			if !tt.ok {
+				time.Sleep(10 * time.Millisecond)
+				if n := atomic.LoadInt32(&fetcher.fetches); n != 0 {
+					t.Errorf("fetched a URL that is not allowed")
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPRCDContentFetcher_Redirects(t *testing.T) {
+	f := NewHTTPRCDContentFetcher()
+	f.SetAllowedHosts([]string{"*.example.com"})
+	from, _ := http.NewRequest(http.MethodGet, "https://rcd.example.com/logo.png", nil)
+	tests := []struct {
+		name string
+		url  string
+		via  int
+		ok   bool
+	}{
+		{"allowed host", "https://cdn.example.com/logo.png", 1, true},
+		{"internal address", "https://169.254.169.254/latest/meta-data", 1, false},
+		{"plain http", "http://cdn.example.com/logo.png", 1, false},
+		{"too many redirects", "https://cdn.example.com/logo.png", maxRCDRedirects, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			via := make([]*http.Request, tt.via)
+			for i := range via {
+				via[i] = from
+			}
+			if err := f.client.CheckRedirect(req, via); (err == nil) != tt.ok {
+				t.Errorf("CheckRedirect(%s) error = %v, want allowed %v", tt.url, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyRCD_Pending(t *testing.T) {
+	rcd, fixture := newRCDFixture()
+	rcdi, _ := ComputeRCDI(rcd, fixture)
+	passport := &PASSporT{RCD: rcd, RCDI: rcdi}
+
+	c := NewCachedRCDContentFetcher(fixture, []string{"rcd.example.com"})
+	if _, err := VerifyRCD(passport, c); !errors.Is(err, ErrRCDContentPending) {
+		t.Fatalf("VerifyRCD() error = %v, want pending", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		verified, err := VerifyRCD(passport, c)
+		if err == nil {
+			if verified.IconURL != rcd.ICN {
+				t.Errorf("IconURL = %q", verified.IconURL)
+			}
+			return
+		}
+		if !errors.Is(err, ErrRCDContentPending) || time.Now().After(deadline) {
+			t.Fatalf("VerifyRCD() error = %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
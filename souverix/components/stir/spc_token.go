@@ -0,0 +1,133 @@
+package stir
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+)
+
+// SPCTokenSource provides the authority token (SPC token) used to answer a
+// tkauth-01 challenge. fingerprint identifies the ACME account key the token
+// is bound to.
+type SPCTokenSource interface {
+	SPCToken(ctx context.Context, spc, fingerprint string) (string, error)
+}
+
+// StaticSPCTokenSource returns a pre-issued SPC token
+type StaticSPCTokenSource struct {
+	Token string
+}
+
+// SPCToken returns the configured token
+func (s *StaticSPCTokenSource) SPCToken(ctx context.Context, spc, fingerprint string) (string, error) {
+	if s.Token == "" {
+		return "", fmt.Errorf("no SPC token configured")
+	}
+	return s.Token, nil
+}
+
+// FileSPCTokenSource reads a pre-issued SPC token from a file on each use,
+// so a token refreshed on disk is picked up at the next renewal
+type FileSPCTokenSource struct {
+	Path string
+}
+
+// SPCToken reads the token file
+func (f *FileSPCTokenSource) SPCToken(ctx context.Context, spc, fingerprint string) (string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SPC token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("SPC token file %s is empty", f.Path)
+	}
+	return token, nil
+}
+
+// STIPATokenSource requests SPC tokens from an STI-PA token API (ATIS-1000080)
+type STIPATokenSource struct {
+	URL    string
+	client *http.Client
+}
+
+// NewSTIPATokenSource creates a token source for the STI-PA API at url
+func NewSTIPATokenSource(url string) *STIPATokenSource {
+	return &STIPATokenSource{
+		URL: url,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// SPCToken requests a token for spc bound to the account key fingerprint
+func (s *STIPATokenSource) SPCToken(ctx context.Context, spc, fingerprint string) (string, error) {
+	tnAuthList, err := TNAuthListSPC(spc)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"atc": map[string]interface{}{
+			"tktype":      tkauthTokenTypeTNAuth,
+			"tkvalue":     base64.StdEncoding.EncodeToString(tnAuthList),
+			"ca":          false,
+			"fingerprint": fingerprint,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request SPC token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("SPC token request failed with status: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Status string `json:"status"`
+		Token  string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode SPC token response: %w", err)
+	}
+	if result.Token == "" {
+		return "", fmt.Errorf("STI-PA returned no SPC token (status %q)", result.Status)
+	}
+	return result.Token, nil
+}
+
+// NewSPCTokenSource selects the SPC token source configured in cfg.
+// The STI-PA API takes precedence over a token file, which takes precedence
+// over an inline token. It returns nil if none is configured.
+func NewSPCTokenSource(cfg *config.ACMEConfig) SPCTokenSource {
+	switch {
+	case cfg.SPCTokenURL != "":
+		return NewSTIPATokenSource(cfg.SPCTokenURL)
+	case cfg.SPCTokenFile != "":
+		return &FileSPCTokenSource{Path: cfg.SPCTokenFile}
+	case cfg.SPCToken != "":
+		return &StaticSPCTokenSource{Token: cfg.SPCToken}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package stir
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dasmlab/ims/internal/config"
+)
+
+func TestNewSPCTokenSource(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ACMEConfig
+		want interface{}
+	}{
+		{"none", config.ACMEConfig{}, nil},
+		{"static", config.ACMEConfig{SPCToken: "t"}, &StaticSPCTokenSource{}},
+		{"file", config.ACMEConfig{SPCToken: "t", SPCTokenFile: "/tmp/t"}, &FileSPCTokenSource{}},
+		{"sti-pa", config.ACMEConfig{SPCTokenFile: "/tmp/t", SPCTokenURL: "http://sti-pa"}, &STIPATokenSource{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewSPCTokenSource(&tt.cfg)
+			switch tt.want.(type) {
+			case nil:
+				if got != nil {
+					t.Errorf("NewSPCTokenSource() = %T, want nil", got)
+				}
+			case *StaticSPCTokenSource:
+				if _, ok := got.(*StaticSPCTokenSource); !ok {
+					t.Errorf("NewSPCTokenSource() = %T, want *StaticSPCTokenSource", got)
+				}
+			case *FileSPCTokenSource:
+				if _, ok := got.(*FileSPCTokenSource); !ok {
+					t.Errorf("NewSPCTokenSource() = %T, want *FileSPCTokenSource", got)
+				}
+			case *STIPATokenSource:
+				if _, ok := got.(*STIPATokenSource); !ok {
+					t.Errorf("NewSPCTokenSource() = %T, want *STIPATokenSource", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFileSPCTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spc.token")
+	source := &FileSPCTokenSource{Path: path}
+
+	if _, err := source.SPCToken(context.Background(), "1234", ""); err == nil {
+		t.Error("SPCToken() succeeded for a missing file")
+	}
+
+	os.WriteFile(path, []byte("token-1\n"), 0600)
+	if got, err := source.SPCToken(context.Background(), "1234", ""); err != nil || got != "token-1" {
+		t.Errorf("SPCToken() = %q, %v, want token-1", got, err)
+	}
+
+	// A refreshed token is picked up without restarting
+	os.WriteFile(path, []byte("token-2"), 0600)
+	if got, _ := source.SPCToken(context.Background(), "1234", ""); got != "token-2" {
+		t.Errorf("SPCToken() = %q after refresh, want token-2", got)
+	}
+}
+
+func TestSTIPATokenSource(t *testing.T) {
+	wantValue, _ := TNAuthListSPC("1234")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ATC struct {
+				TKType      string `json:"tktype"`
+				TKValue     string `json:"tkvalue"`
+				CA          bool   `json:"ca"`
+				Fingerprint string `json:"fingerprint"`
+			} `json:"atc"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.ATC.TKType != "TNAuthList" || req.ATC.TKValue != base64.StdEncoding.EncodeToString(wantValue) ||
+			req.ATC.CA || req.ATC.Fingerprint != "SHA256 AA:BB" {
+			http.Error(w, "unexpected atc", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "success", "token": "spc-token"})
+	}))
+	defer server.Close()
+
+	source := NewSTIPATokenSource(server.URL)
+
+	token, err := source.SPCToken(context.Background(), "1234", "SHA256 AA:BB")
+	if err != nil {
+		t.Fatalf("SPCToken() error = %v", err)
+	}
+	if token != "spc-token" {
+		t.Errorf("SPCToken() = %q, want spc-token", token)
+	}
+
+	if _, err := source.SPCToken(context.Background(), "9999", "SHA256 AA:BB"); err == nil {
+		t.Error("SPCToken() succeeded for a request the STI-PA rejects")
+	}
+}
@@ -0,0 +1,799 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/sirupsen/logrus"
+)
+
+// testLogger returns a logger that only reports errors
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	return log
+}
+
+// hssStoreFactory creates a store for one conformance subtest. reopen, if not
+// nil, returns a new store over the same data to check persistence.
+type hssStoreFactory func(t *testing.T) (store HSSStore, reopen func() HSSStore)
+
+// testHSSStoreConformance runs the behaviour every HSSStore backend must share
+func testHSSStoreConformance(t *testing.T, newStore hssStoreFactory) {
+	conformanceSubscriber := func(name string, impus ...string) *ims.Subscriber {
+		return &ims.Subscriber{
+			IMPI: name + "@conformance.test",
+			IMPU: "sip:" + name + "@conformance.test",
+			ServiceProfile: ims.ServiceProfile{
+				PublicIdentities:      append([]string{"sip:" + name + "@conformance.test"}, impus...),
+				TelephoneNumberRanges: []ims.TNRange{{Start: "+15145550000", End: "+15145550099"}},
+			},
+			AuthData: ims.AuthData{
+				AuthScheme: "Digest", Username: name, Realm: "conformance.test",
+				K: "465b5ce8b199b49faa5f0a2ee238a6bc", OPc: "cd63cb71954a9f4e48a5994e37a02baf", AMF: "8000", SQN: 0xff9bb4d0b607,
+			},
+		}
+	}
+
+	t.Run("SubscriberRoundTrip", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("alice", "tel:+15145550001")
+
+		if err := store.UpsertSubscriber(sub); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+		got, err := store.GetSubscriber(sub.IMPI)
+		if err != nil {
+			t.Fatalf("GetSubscriber() error = %v", err)
+		}
+		if got.IMPU != sub.IMPU || got.AuthData != sub.AuthData ||
+			len(got.ServiceProfile.PublicIdentities) != 2 || len(got.ServiceProfile.TelephoneNumberRanges) != 1 {
+			t.Errorf("GetSubscriber() = %+v, want %+v", got, sub)
+		}
+	})
+
+	t.Run("UpsertRequiresIMPI", func(t *testing.T) {
+		store, _ := newStore(t)
+		if err := store.UpsertSubscriber(&ims.Subscriber{IMPU: "sip:x@conformance.test"}); err == nil {
+			t.Error("UpsertSubscriber() accepted a subscriber without IMPI")
+		}
+		if err := store.UpsertRegistration(&ims.Registration{IMPU: "sip:x@conformance.test"}); err == nil {
+			t.Error("UpsertRegistration() accepted a registration without IMPI")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		store, _ := newStore(t)
+		if _, err := store.GetSubscriber("nobody@conformance.test"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriber() error = %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetSubscriberByIMPU("sip:nobody@conformance.test"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriberByIMPU() error = %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetRegistration("nobody@conformance.test"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetRegistration() error = %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetSCSCFForSubscriber("nobody@conformance.test"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSCSCFForSubscriber() error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("IMPUIndex", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("bob", "tel:+15145550002")
+		if err := store.UpsertSubscriber(sub); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+
+		for _, impu := range []string{"sip:bob@conformance.test", "tel:+15145550002"} {
+			got, err := store.GetSubscriberByIMPU(impu)
+			if err != nil {
+				t.Fatalf("GetSubscriberByIMPU(%s) error = %v", impu, err)
+			}
+			if got.IMPI != sub.IMPI {
+				t.Errorf("GetSubscriberByIMPU(%s) IMPI = %s, want %s", impu, got.IMPI, sub.IMPI)
+			}
+		}
+
+		// Replacing the public identities drops the old ones from the index
+		sub.ServiceProfile.PublicIdentities = []string{"sip:bob@conformance.test", "tel:+15145550003"}
+		if err := store.UpsertSubscriber(sub); err != nil {
+			t.Fatalf("UpsertSubscriber() update error = %v", err)
+		}
+		if _, err := store.GetSubscriberByIMPU("tel:+15145550002"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriberByIMPU() for a removed identity error = %v, want ErrNotFound", err)
+		}
+		if got, err := store.GetSubscriberByIMPU("tel:+15145550003"); err != nil || got.IMPI != sub.IMPI {
+			t.Errorf("GetSubscriberByIMPU() for an added identity = %v, %v", got, err)
+		}
+	})
+
+	t.Run("TNIndex", func(t *testing.T) {
+		store, _ := newStore(t)
+		pbx := conformanceSubscriber("pbx")
+		pbx.ServiceProfile.TelephoneNumberRanges = []ims.TNRange{{Start: "+1 514 555 1000", End: "+1 514 555 1999"}}
+		did := conformanceSubscriber("did", "sip:+15145551234@conformance.test;user=phone")
+		did.ServiceProfile.TelephoneNumberRanges = nil
+		for _, sub := range []*ims.Subscriber{pbx, did} {
+			if err := store.UpsertSubscriber(sub); err != nil {
+				t.Fatalf("UpsertSubscriber() error = %v", err)
+			}
+		}
+
+		tests := []struct {
+			tn   string
+			want string
+		}{
+			{"+15145551000", pbx.IMPI},
+			{"15145551999", pbx.IMPI},
+			{"+1-514-555-1500", pbx.IMPI},
+			{"+15145551234", did.IMPI}, // an assigned number wins over its block
+			{"+15145552000", ""},
+			{"+151455510000", ""},
+			{"not a number", ""},
+		}
+		for _, tt := range tests {
+			got, err := store.GetSubscriberByTN(tt.tn)
+			switch {
+			case tt.want == "" && !errors.Is(err, ErrNotFound):
+				t.Errorf("GetSubscriberByTN(%q) = %v, %v, want ErrNotFound", tt.tn, got, err)
+			case tt.want != "" && (err != nil || got.IMPI != tt.want):
+				t.Errorf("GetSubscriberByTN(%q) = %v, %v, want %s", tt.tn, got, err, tt.want)
+			}
+		}
+
+		// Updating or deleting a subscriber drops its numbers from the index
+		pbx.ServiceProfile.TelephoneNumberRanges = []ims.TNRange{{Start: "+15145553000", End: "+15145553999"}}
+		if err := store.UpsertSubscriber(pbx); err != nil {
+			t.Fatalf("UpsertSubscriber() update error = %v", err)
+		}
+		if _, err := store.GetSubscriberByTN("+15145551500"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriberByTN() for a removed range error = %v, want ErrNotFound", err)
+		}
+		if got, err := store.GetSubscriberByTN("+15145553500"); err != nil || got.IMPI != pbx.IMPI {
+			t.Errorf("GetSubscriberByTN() for an added range = %v, %v", got, err)
+		}
+		store.DeleteSubscriber(did.IMPI)
+		if _, err := store.GetSubscriberByTN("+15145551234"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriberByTN() after delete error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("IMPUConflict", func(t *testing.T) {
+		store, _ := newStore(t)
+		if err := store.UpsertSubscriber(conformanceSubscriber("carol", "tel:+15145550004")); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+
+		thief := conformanceSubscriber("dave", "tel:+15145550004")
+		if err := store.UpsertSubscriber(thief); !errors.Is(err, ErrIMPUConflict) {
+			t.Fatalf("UpsertSubscriber() error = %v, want ErrIMPUConflict", err)
+		}
+
+		// The rejected upsert leaves no partial state behind
+		if _, err := store.GetSubscriber(thief.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("rejected subscriber was stored: %v", err)
+		}
+		if _, err := store.GetSubscriberByIMPU(thief.IMPU); !errors.Is(err, ErrNotFound) {
+			t.Errorf("rejected subscriber's identities were indexed: %v", err)
+		}
+		if got, _ := store.GetSubscriberByIMPU("tel:+15145550004"); got == nil || got.IMPI != "carol@conformance.test" {
+			t.Errorf("conflicting identity no longer resolves to its owner: %v", got)
+		}
+	})
+
+	t.Run("UpsertSubscribers", func(t *testing.T) {
+		store, _ := newStore(t)
+		owner := conformanceSubscriber("erin", "tel:+15145550005")
+		if err := store.UpsertSubscriber(owner); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+
+		// A conflict anywhere in the batch writes none of it
+		fresh := conformanceSubscriber("frank")
+		thief := conformanceSubscriber("grace", "tel:+15145550005")
+		if err := store.UpsertSubscribers([]*ims.Subscriber{fresh, thief}, nil); !errors.Is(err, ErrIMPUConflict) {
+			t.Fatalf("UpsertSubscribers() error = %v, want ErrIMPUConflict", err)
+		}
+		if _, err := store.GetSubscriber(fresh.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("subscriber of a rejected batch was stored: %v", err)
+		}
+		if got, _ := store.GetSubscriberByIMPU("tel:+15145550005"); got == nil || got.IMPI != owner.IMPI {
+			t.Errorf("rejected batch changed the owner of a public identity: %v", got)
+		}
+
+		// An identity may move between subscribers of the same batch, and
+		// merge sees the stored subscriber
+		moved := conformanceSubscriber("erin")
+		moved.AuthData = ims.AuthData{}
+		var merged []string
+		merge := func(stored, update *ims.Subscriber) error {
+			if stored != nil {
+				update.AuthData = stored.AuthData
+				merged = append(merged, stored.IMPI)
+			}
+			return nil
+		}
+		if err := store.UpsertSubscribers([]*ims.Subscriber{thief, moved}, merge); err != nil {
+			t.Fatalf("UpsertSubscribers() error = %v", err)
+		}
+		if got, _ := store.GetSubscriberByIMPU("tel:+15145550005"); got == nil || got.IMPI != thief.IMPI {
+			t.Errorf("moved identity resolves to %v, want %s", got, thief.IMPI)
+		}
+		if got, _ := store.GetSubscriber(owner.IMPI); got == nil || got.AuthData != owner.AuthData {
+			t.Errorf("merged subscriber = %+v, want the stored authentication data", got)
+		}
+		if len(merged) == 0 || merged[len(merged)-1] != owner.IMPI {
+			t.Errorf("merge saw stored subscribers %v", merged)
+		}
+
+		// Two subscribers of one batch cannot take the same identity
+		a, b := conformanceSubscriber("heidi", "tel:+15145550006"), conformanceSubscriber("ivan", "tel:+15145550006")
+		if err := store.UpsertSubscribers([]*ims.Subscriber{a, b}, nil); !errors.Is(err, ErrIMPUConflict) {
+			t.Errorf("UpsertSubscribers() error = %v, want ErrIMPUConflict", err)
+		}
+		if _, err := store.GetSubscriber(a.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("subscriber of a rejected batch was stored: %v", err)
+		}
+
+		// merge aborts the whole batch
+		errAbort := errors.New("abort")
+		abort := func(stored, update *ims.Subscriber) error {
+			if stored != nil {
+				return errAbort
+			}
+			return nil
+		}
+		if err := store.UpsertSubscribers([]*ims.Subscriber{a, conformanceSubscriber("erin")}, abort); !errors.Is(err, errAbort) {
+			t.Errorf("UpsertSubscribers() error = %v, want the merge error", err)
+		}
+		if _, err := store.GetSubscriber(a.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("subscriber of an aborted batch was stored: %v", err)
+		}
+	})
+
+	t.Run("UpdateSubscriber", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("uma", "tel:+15145550020")
+		store.UpsertSubscriber(sub)
+		other := conformanceSubscriber("vera", "tel:+15145550021")
+		store.UpsertSubscriber(other)
+		store.AdvanceSQN(sub.IMPI, func(current uint64) uint64 { return current + 1 })
+
+		// Only the fields update touches change
+		got, err := store.UpdateSubscriber(sub.IMPI, func(current *ims.Subscriber) (*ims.Subscriber, error) {
+			current.Registered = true
+			current.ServiceProfile.PublicIdentities = []string{sub.IMPU, "tel:+15145550022"}
+			return current, nil
+		})
+		if err != nil {
+			t.Fatalf("UpdateSubscriber() error = %v", err)
+		}
+		if !got.Registered || got.AuthData.SQN != sub.AuthData.SQN+1 || got.AuthData.K != sub.AuthData.K {
+			t.Errorf("UpdateSubscriber() = %+v", got)
+		}
+		if stored, _ := store.GetSubscriber(sub.IMPI); stored == nil || stored.Version != got.Version {
+			t.Errorf("stored subscriber = %+v, want version %d", stored, got.Version)
+		}
+		if _, err := store.GetSubscriberByIMPU("tel:+15145550020"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("removed identity still resolves: %v", err)
+		}
+		if found, _ := store.GetSubscriberByIMPU("tel:+15145550022"); found == nil || found.IMPI != sub.IMPI {
+			t.Errorf("added identity resolves to %v", found)
+		}
+
+		// Errors leave the subscriber alone
+		if _, err := store.UpdateSubscriber(sub.IMPI, func(current *ims.Subscriber) (*ims.Subscriber, error) {
+			current.ServiceProfile.PublicIdentities = []string{sub.IMPU, "tel:+15145550021"}
+			return current, nil
+		}); !errors.Is(err, ErrIMPUConflict) {
+			t.Errorf("UpdateSubscriber(conflict) error = %v, want ErrIMPUConflict", err)
+		}
+		errAbort := errors.New("abort")
+		if _, err := store.UpdateSubscriber(sub.IMPI, func(*ims.Subscriber) (*ims.Subscriber, error) {
+			return nil, errAbort
+		}); !errors.Is(err, errAbort) {
+			t.Errorf("UpdateSubscriber() error = %v, want the update error", err)
+		}
+		if stored, _ := store.GetSubscriber(sub.IMPI); stored == nil || stored.Version != got.Version {
+			t.Errorf("failed updates changed the subscriber: %+v", stored)
+		}
+		if _, err := store.UpdateSubscriber("nobody@conformance.test", func(current *ims.Subscriber) (*ims.Subscriber, error) {
+			return current, nil
+		}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("UpdateSubscriber(unknown) error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("wade")
+		version := func() uint64 {
+			got, err := store.GetSubscriber(sub.IMPI)
+			if err != nil {
+				t.Fatalf("GetSubscriber() error = %v", err)
+			}
+			return got.Version
+		}
+
+		store.UpsertSubscriber(sub)
+		first := version()
+		if first == 0 {
+			t.Fatal("stored subscriber has no version")
+		}
+
+		// Every write moves the version, whatever it changes
+		writes := map[string]func(){
+			"UpsertSubscriber": func() { store.UpsertSubscriber(conformanceSubscriber("wade")) },
+			"AdvanceSQN":       func() { store.AdvanceSQN(sub.IMPI, func(current uint64) uint64 { return current + 1 }) },
+			"AssignSCSCF": func() {
+				store.AssignSCSCF(sub.IMPI, func(string) (string, error) { return "sip:scscf1.ims.test", nil })
+			},
+		}
+		for _, name := range []string{"UpsertSubscriber", "AdvanceSQN", "AssignSCSCF"} {
+			before := version()
+			writes[name]()
+			if after := version(); after <= before {
+				t.Errorf("%s left the version at %d", name, after)
+			}
+		}
+	})
+
+	t.Run("SharedIMPU", func(t *testing.T) {
+		store, _ := newStore(t)
+		shared := func(sub *ims.Subscriber, impu string) *ims.Subscriber {
+			sub.ServiceProfile.IdentityAttributes = map[string]ims.PublicIdentityAttributes{impu: {Shared: true}}
+			return sub
+		}
+		for _, name := range []string{"grace", "frank"} {
+			if err := store.UpsertSubscriber(shared(conformanceSubscriber(name, "tel:+15145550010"), "tel:+15145550010")); err != nil {
+				t.Fatalf("UpsertSubscriber(%s) error = %v", name, err)
+			}
+		}
+
+		subs, err := store.GetSubscribersByIMPU("tel:+15145550010")
+		if err != nil || len(subs) != 2 || subs[0].IMPI != "frank@conformance.test" || subs[1].IMPI != "grace@conformance.test" {
+			t.Fatalf("GetSubscribersByIMPU() = %v, %v, want frank and grace", subs, err)
+		}
+		if got, err := store.GetSubscriberByIMPU("tel:+15145550010"); err != nil || got.IMPI != "frank@conformance.test" {
+			t.Errorf("GetSubscriberByIMPU() = %v, %v, want frank", got, err)
+		}
+		if subs, err := store.GetSubscribersByIMPU("sip:grace@conformance.test"); err != nil || len(subs) != 1 {
+			t.Errorf("GetSubscribersByIMPU() for an exclusive identity = %v, %v", subs, err)
+		}
+
+		// A subscriber not sharing the identity cannot claim it
+		if err := store.UpsertSubscriber(conformanceSubscriber("heidi", "tel:+15145550010")); !errors.Is(err, ErrIMPUConflict) {
+			t.Errorf("UpsertSubscriber() of an exclusive claim error = %v, want ErrIMPUConflict", err)
+		}
+
+		// Deleting one owner keeps the identity of the other
+		if err := store.DeleteSubscriber("frank@conformance.test"); err != nil {
+			t.Fatalf("DeleteSubscriber() error = %v", err)
+		}
+		if subs, err := store.GetSubscribersByIMPU("tel:+15145550010"); err != nil || len(subs) != 1 || subs[0].IMPI != "grace@conformance.test" {
+			t.Errorf("GetSubscribersByIMPU() after delete = %v, %v", subs, err)
+		}
+		if _, err := store.GetSubscribersByIMPU("tel:+15145550099"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscribersByIMPU(unknown) error = %v, want ErrNotFound", err)
+		}
+
+		// An exclusive identity cannot become shared while another
+		// subscriber holds it exclusively
+		if err := store.UpsertSubscriber(conformanceSubscriber("ivan", "tel:+15145550011")); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+		if err := store.UpsertSubscriber(shared(conformanceSubscriber("judy", "tel:+15145550011"), "tel:+15145550011")); !errors.Is(err, ErrIMPUConflict) {
+			t.Errorf("UpsertSubscriber() sharing an exclusive identity error = %v, want ErrIMPUConflict", err)
+		}
+	})
+
+	t.Run("DeleteSubscriber", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("erin", "tel:+15145550005")
+		store.UpsertSubscriber(sub)
+		store.UpsertRegistration(&ims.Registration{IMPI: sub.IMPI, IMPU: sub.IMPU, State: ims.RegistrationStateRegistered})
+
+		if err := store.DeleteSubscriber(sub.IMPI); err != nil {
+			t.Fatalf("DeleteSubscriber() error = %v", err)
+		}
+		if _, err := store.GetSubscriber(sub.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriber() after delete error = %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetSubscriberByIMPU("tel:+15145550005"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetSubscriberByIMPU() after delete error = %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetRegistration(sub.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetRegistration() after delete error = %v, want ErrNotFound", err)
+		}
+
+		// Freed identities can be claimed by another subscriber
+		if err := store.UpsertSubscriber(conformanceSubscriber("frank", "tel:+15145550005")); err != nil {
+			t.Errorf("UpsertSubscriber() with a freed identity error = %v", err)
+		}
+		// Deleting an unknown subscriber is not an error
+		if err := store.DeleteSubscriber("nobody@conformance.test"); err != nil {
+			t.Errorf("DeleteSubscriber() for unknown IMPI error = %v", err)
+		}
+	})
+
+	t.Run("ListSubscribers", func(t *testing.T) {
+		store, _ := newStore(t)
+		for _, name := range []string{"gina", "hank", "ivan"} {
+			if err := store.UpsertSubscriber(conformanceSubscriber(name)); err != nil {
+				t.Fatalf("UpsertSubscriber() error = %v", err)
+			}
+		}
+
+		subs, err := store.ListSubscribers()
+		if err != nil {
+			t.Fatalf("ListSubscribers() error = %v", err)
+		}
+		found := 0
+		for _, sub := range subs {
+			switch sub.IMPI {
+			case "gina@conformance.test", "hank@conformance.test", "ivan@conformance.test":
+				found++
+			}
+		}
+		if found != 3 {
+			t.Errorf("ListSubscribers() returned %d of 3 subscribers", found)
+		}
+
+		// Pages follow IMPI order
+		var impis []string
+		for after := ""; ; {
+			page, err := store.ListSubscribersPage(after, 2)
+			if err != nil {
+				t.Fatalf("ListSubscribersPage() error = %v", err)
+			}
+			if len(page) > 2 {
+				t.Fatalf("ListSubscribersPage() returned %d subscribers, want at most 2", len(page))
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, sub := range page {
+				impis = append(impis, sub.IMPI)
+			}
+			after = page[len(page)-1].IMPI
+		}
+		if len(impis) != len(subs) || !sort.StringsAreSorted(impis) {
+			t.Errorf("pages = %v, want the %d subscribers in order", impis, len(subs))
+		}
+		store.DeleteSubscriber("hank@conformance.test")
+		if page, _ := store.ListSubscribersPage("gina@conformance.test", 1); len(page) != 1 || page[0].IMPI != "ivan@conformance.test" {
+			t.Errorf("page after a deletion = %v", page)
+		}
+	})
+
+	t.Run("ListWildcardIdentities", func(t *testing.T) {
+		store, _ := newStore(t)
+		wildcarded := func(name string, wildcards ...string) *ims.Subscriber {
+			sub := conformanceSubscriber(name, wildcards...)
+			sub.ServiceProfile.IdentityAttributes = make(map[string]ims.PublicIdentityAttributes)
+			for _, w := range wildcards {
+				sub.ServiceProfile.IdentityAttributes[w] = ims.PublicIdentityAttributes{
+					IdentityType: ims.IdentityTypeWildcardedPSI, Wildcard: w,
+				}
+			}
+			return sub
+		}
+		for _, sub := range []*ims.Subscriber{
+			wildcarded("lena", "sip:room!.*!@conformance.test", "sip:chat!.*!@conformance.test"),
+			wildcarded("kurt", "sip:conf!.*!@conformance.test"),
+			conformanceSubscriber("mona"),
+		} {
+			if err := store.UpsertSubscriber(sub); err != nil {
+				t.Fatalf("UpsertSubscriber() error = %v", err)
+			}
+		}
+
+		got, err := store.ListWildcardIdentities()
+		if err != nil {
+			t.Fatalf("ListWildcardIdentities() error = %v", err)
+		}
+		want := []WildcardIdentity{
+			{IMPI: "kurt@conformance.test", IMPU: "sip:conf!.*!@conformance.test", Wildcard: "sip:conf!.*!@conformance.test"},
+			{IMPI: "lena@conformance.test", IMPU: "sip:chat!.*!@conformance.test", Wildcard: "sip:chat!.*!@conformance.test"},
+			{IMPI: "lena@conformance.test", IMPU: "sip:room!.*!@conformance.test", Wildcard: "sip:room!.*!@conformance.test"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListWildcardIdentities() = %v, want %v", got, want)
+		}
+
+		// Rewriting and deleting a subscriber updates the index
+		if err := store.UpsertSubscriber(wildcarded("lena", "sip:room!.*!@conformance.test")); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+		store.DeleteSubscriber("kurt@conformance.test")
+		got, _ = store.ListWildcardIdentities()
+		if !reflect.DeepEqual(got, want[2:]) {
+			t.Errorf("ListWildcardIdentities() after changes = %v, want %v", got, want[2:])
+		}
+	})
+
+	t.Run("Registration", func(t *testing.T) {
+		store, _ := newStore(t)
+		reg := &ims.Registration{
+			IMPI:    "judy@conformance.test",
+			IMPU:    "sip:judy@conformance.test",
+			Contact: "sip:judy@192.0.2.10:5060",
+			Expires: 3600,
+			Path:    []string{"<sip:pcscf.conformance.test;lr>"},
+			State:   ims.RegistrationStateRegistered,
+		}
+		if err := store.UpsertRegistration(reg); err != nil {
+			t.Fatalf("UpsertRegistration() error = %v", err)
+		}
+
+		reg.Expires = 600
+		if err := store.UpsertRegistration(reg); err != nil {
+			t.Fatalf("UpsertRegistration() update error = %v", err)
+		}
+		got, err := store.GetRegistration(reg.IMPI)
+		if err != nil {
+			t.Fatalf("GetRegistration() error = %v", err)
+		}
+		if got.Expires != 600 || got.State != ims.RegistrationStateRegistered || len(got.Path) != 1 {
+			t.Errorf("GetRegistration() = %+v", got)
+		}
+
+		if err := store.DeleteRegistration(reg.IMPI); err != nil {
+			t.Fatalf("DeleteRegistration() error = %v", err)
+		}
+		if _, err := store.GetRegistration(reg.IMPI); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetRegistration() after delete error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ListRegistrations", func(t *testing.T) {
+		store, _ := newStore(t)
+		for _, r := range []struct{ impi, scscf string }{
+			{"nina@conformance.test", "sip:scscf1.ims.test"},
+			{"mia@conformance.test", "sip:scscf1.ims.test"},
+			{"omar@conformance.test", "sip:scscf2.ims.test"},
+		} {
+			store.UpsertSubscriber(&ims.Subscriber{IMPI: r.impi, IMPU: "sip:" + r.impi})
+			store.UpsertRegistration(&ims.Registration{IMPI: r.impi, IMPU: "sip:" + r.impi, SCSCFName: r.scscf})
+		}
+
+		regs, err := store.ListRegistrations("sip:scscf1.ims.test")
+		if err != nil || len(regs) != 2 || regs[0].IMPI != "mia@conformance.test" || regs[1].IMPI != "nina@conformance.test" {
+			t.Fatalf("ListRegistrations() = %v, %v, want mia and nina", regs, err)
+		}
+
+		// A registration moves with its S-CSCF and leaves with its deletion
+		store.UpsertRegistration(&ims.Registration{IMPI: "mia@conformance.test", IMPU: "sip:mia@conformance.test", SCSCFName: "sip:scscf2.ims.test"})
+		store.DeleteRegistration("nina@conformance.test")
+		store.DeleteSubscriber("omar@conformance.test")
+		if regs, _ := store.ListRegistrations("sip:scscf1.ims.test"); len(regs) != 0 {
+			t.Errorf("ListRegistrations(scscf1) = %v, want none", regs)
+		}
+		if regs, _ := store.ListRegistrations("sip:scscf2.ims.test"); len(regs) != 1 || regs[0].IMPI != "mia@conformance.test" {
+			t.Errorf("ListRegistrations(scscf2) = %v, want mia", regs)
+		}
+	})
+
+	t.Run("WatchRegistrations", func(t *testing.T) {
+		store, _ := newStore(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		type change struct {
+			impi, scscf string
+			deleted     bool
+		}
+		changes := make(chan change, 10)
+		err := store.WatchRegistrations(ctx, func(impi string, reg *ims.Registration) {
+			if reg == nil {
+				changes <- change{impi: impi, deleted: true}
+				return
+			}
+			changes <- change{impi: impi, scscf: reg.SCSCFName}
+		})
+		if err != nil {
+			t.Fatalf("WatchRegistrations() error = %v", err)
+		}
+		next := func() change {
+			t.Helper()
+			select {
+			case c := <-changes:
+				return c
+			case <-time.After(2 * time.Second):
+				t.Fatal("no registration change reported")
+			}
+			return change{}
+		}
+
+		sub := conformanceSubscriber("pia")
+		store.UpsertSubscriber(sub)
+		store.UpsertRegistration(&ims.Registration{IMPI: sub.IMPI, IMPU: sub.IMPU, SCSCFName: "sip:scscf1.ims.test"})
+		if got := next(); got != (change{impi: sub.IMPI, scscf: "sip:scscf1.ims.test"}) {
+			t.Errorf("change = %+v, want the stored registration", got)
+		}
+		store.DeleteRegistration(sub.IMPI)
+		if got := next(); got != (change{impi: sub.IMPI, deleted: true}) {
+			t.Errorf("change = %+v, want a deletion", got)
+		}
+		store.UpsertRegistration(&ims.Registration{IMPI: sub.IMPI, IMPU: sub.IMPU})
+		next()
+		store.DeleteSubscriber(sub.IMPI)
+		if got := next(); got != (change{impi: sub.IMPI, deleted: true}) {
+			t.Errorf("change after subscriber deletion = %+v, want a deletion", got)
+		}
+	})
+
+	t.Run("SCSCFAssignment", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("kate")
+		store.UpsertSubscriber(sub)
+
+		if _, err := store.GetSCSCFForSubscriber(sub.IMPI); err == nil {
+			t.Error("GetSCSCFForSubscriber() succeeded before assignment")
+		}
+
+		// keepOrPick keeps the current S-CSCF unless it is down
+		keepOrPick := func(pick, down string) SCSCFSelector {
+			return func(current string) (string, error) {
+				if current != "" && current != down {
+					return current, nil
+				}
+				return pick, nil
+			}
+		}
+
+		assigned, err := store.AssignSCSCF(sub.IMPI, keepOrPick("sip:scscf1.ims.test", ""))
+		if err != nil || assigned != "sip:scscf1.ims.test" {
+			t.Fatalf("AssignSCSCF() = %q, %v", assigned, err)
+		}
+		got, err := store.GetSCSCFForSubscriber(sub.IMPI)
+		if err != nil || got != assigned {
+			t.Errorf("GetSCSCFForSubscriber() = %q, %v, want %q", got, err, assigned)
+		}
+		if stored, _ := store.GetSubscriber(sub.IMPI); stored.SCSCFName != assigned {
+			t.Errorf("subscriber SCSCFName = %q, want %q", stored.SCSCFName, assigned)
+		}
+
+		// The assignment is sticky until the selector replaces it
+		if got, err := store.AssignSCSCF(sub.IMPI, keepOrPick("sip:scscf2.ims.test", "")); err != nil || got != assigned {
+			t.Errorf("second AssignSCSCF() = %q, %v, want %q", got, err, assigned)
+		}
+		if got, err := store.AssignSCSCF(sub.IMPI, keepOrPick("sip:scscf2.ims.test", assigned)); err != nil || got != "sip:scscf2.ims.test" {
+			t.Errorf("AssignSCSCF() after failure = %q, %v", got, err)
+		}
+		if got, _ := store.GetSCSCFForSubscriber(sub.IMPI); got != "sip:scscf2.ims.test" {
+			t.Errorf("GetSCSCFForSubscriber() after reassignment = %q", got)
+		}
+
+		failed := errors.New("no S-CSCF")
+		if _, err := store.AssignSCSCF(sub.IMPI, func(string) (string, error) { return "", failed }); !errors.Is(err, failed) {
+			t.Errorf("AssignSCSCF() with failing selector error = %v", err)
+		}
+		if got, _ := store.GetSCSCFForSubscriber(sub.IMPI); got != "sip:scscf2.ims.test" {
+			t.Errorf("failed selection changed the assignment to %q", got)
+		}
+		if _, err := store.AssignSCSCF("nobody@ims.test", keepOrPick("sip:scscf1.ims.test", "")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AssignSCSCF(unknown) error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("SQN", func(t *testing.T) {
+		store, _ := newStore(t)
+		sub := conformanceSubscriber("liam")
+		store.UpsertSubscriber(sub)
+		start := sub.AuthData.SQN
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.AdvanceSQN(sub.IMPI, func(current uint64) uint64 { return current + 1 }); err != nil {
+					t.Errorf("AdvanceSQN() error = %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if got, _ := store.GetSubscriber(sub.IMPI); got.AuthData.SQN != start+8 {
+			t.Fatalf("SQN after concurrent advances = %d, want %d", got.AuthData.SQN, start+8)
+		}
+
+		// Writes of the whole subscriber never roll the SQN back
+		stale := conformanceSubscriber("liam")
+		stale.Registered = true
+		if err := store.UpsertSubscriber(stale); err != nil {
+			t.Fatalf("UpsertSubscriber() error = %v", err)
+		}
+		store.AssignSCSCF(sub.IMPI, func(string) (string, error) { return "sip:scscf1.ims.test", nil })
+		got, _ := store.GetSubscriber(sub.IMPI)
+		if got.AuthData.SQN != start+8 || !got.Registered {
+			t.Errorf("subscriber after upsert = SQN %d, registered %v, want SQN %d, registered", got.AuthData.SQN, got.Registered, start+8)
+		}
+
+		if sqn, err := store.AdvanceSQN(sub.IMPI, func(uint64) uint64 { return 32 }); err != nil || sqn != 32 {
+			t.Errorf("AdvanceSQN() = %d, %v, want 32", sqn, err)
+		}
+		if _, err := store.AdvanceSQN("nobody@conformance.test", func(current uint64) uint64 { return current }); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AdvanceSQN(unknown) error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ConcurrentUpserts", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		// Distinct subscribers are all stored
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := store.UpsertSubscriber(conformanceSubscriber(fmt.Sprintf("load%02d", i))); err != nil {
+					t.Errorf("UpsertSubscriber() error = %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Competing claims on one identity have exactly one winner
+		var mu sync.Mutex
+		winners := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := store.UpsertSubscriber(conformanceSubscriber(fmt.Sprintf("race%02d", i), "tel:+15145550099"))
+				if err == nil {
+					mu.Lock()
+					winners++
+					mu.Unlock()
+				} else if !errors.Is(err, ErrIMPUConflict) {
+					t.Errorf("UpsertSubscriber() error = %v, want ErrIMPUConflict", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if winners != 1 {
+			t.Errorf("%d subscribers claimed the same identity, want 1", winners)
+		}
+	})
+
+	t.Run("Persistence", func(t *testing.T) {
+		store, reopen := newStore(t)
+		if reopen == nil {
+			t.Skip("backend is not persistent")
+		}
+		sub := conformanceSubscriber("liam", "tel:+15145550010")
+		store.UpsertSubscriber(sub)
+		store.UpsertRegistration(&ims.Registration{IMPI: sub.IMPI, IMPU: sub.IMPU, State: ims.RegistrationStateRegistered})
+		store.AssignSCSCF(sub.IMPI, func(string) (string, error) { return "sip:scscf1.ims.test", nil })
+
+		reopened := reopen()
+		if got, err := reopened.GetSubscriberByIMPU("tel:+15145550010"); err != nil || got.IMPI != sub.IMPI {
+			t.Errorf("GetSubscriberByIMPU() after reopen = %v, %v", got, err)
+		}
+		if _, err := reopened.GetRegistration(sub.IMPI); err != nil {
+			t.Errorf("GetRegistration() after reopen error = %v", err)
+		}
+		if _, err := reopened.GetSCSCFForSubscriber(sub.IMPI); err != nil {
+			t.Errorf("GetSCSCFForSubscriber() after reopen error = %v", err)
+		}
+	})
+}
+
+func TestMemHSSStore_Conformance(t *testing.T) {
+	testHSSStoreConformance(t, func(t *testing.T) (HSSStore, func() HSSStore) {
+		store, err := NewMemHSSStore(testLogger())
+		if err != nil {
+			t.Fatalf("NewMemHSSStore() error = %v", err)
+		}
+		return store, nil
+	})
+}
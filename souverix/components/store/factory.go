@@ -0,0 +1,46 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/dasmlab/ims/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// NewHSSStore creates the HSSStore backend selected by cfg.Backend.
+// Persistent backends hold connections; callers should close them through
+// io.Closer when shutting down.
+func NewHSSStore(cfg *config.HSSConfig, log *logrus.Logger) (HSSStore, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return NewMemHSSStore(log)
+	case "postgres":
+		if cfg.DSN == "" {
+			return nil, fmt.Errorf("postgres HSS backend requires a DSN")
+		}
+		store, err := OpenPostgresHSSStore(cfg.DSN, log)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		if cfg.DSN == "" {
+			return nil, fmt.Errorf("sqlite HSS backend requires a DSN")
+		}
+		store, err := OpenSQLiteHSSStore(cfg.DSN, log)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "redis":
+		if cfg.DSN == "" {
+			return nil, fmt.Errorf("redis HSS backend requires a DSN")
+		}
+		store, err := OpenRedisHSSStore(cfg.DSN, log)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unsupported HSS backend: %s", cfg.Backend)
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dasmlab/ims/internal/config"
+)
+
+func TestNewHSSStore(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+
+	tests := []struct {
+		name    string
+		cfg     config.HSSConfig
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "default", cfg: config.HSSConfig{}, want: &MemHSSStore{}},
+		{name: "memory", cfg: config.HSSConfig{Backend: "memory"}, want: &MemHSSStore{}},
+		{name: "sqlite", cfg: config.HSSConfig{Backend: "sqlite", DSN: filepath.Join(t.TempDir(), "hss.db")}, want: &SQLHSSStore{}},
+		{name: "redis", cfg: config.HSSConfig{Backend: "redis", DSN: "redis://" + redisServer.Addr()}, want: &RedisHSSStore{}},
+		{name: "postgres without DSN", cfg: config.HSSConfig{Backend: "postgres"}, wantErr: true},
+		{name: "sqlite without DSN", cfg: config.HSSConfig{Backend: "sqlite"}, wantErr: true},
+		{name: "redis without DSN", cfg: config.HSSConfig{Backend: "redis"}, wantErr: true},
+		{name: "unknown backend", cfg: config.HSSConfig{Backend: "cassandra"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewHSSStore(&tt.cfg, testLogger())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewHSSStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if store != nil {
+					t.Errorf("NewHSSStore() returned %T with an error", store)
+				}
+				return
+			}
+
+			switch tt.want.(type) {
+			case *MemHSSStore:
+				if _, ok := store.(*MemHSSStore); !ok {
+					t.Errorf("NewHSSStore() = %T, want *MemHSSStore", store)
+				}
+			case *SQLHSSStore:
+				s, ok := store.(*SQLHSSStore)
+				if !ok {
+					t.Fatalf("NewHSSStore() = %T, want *SQLHSSStore", store)
+				}
+				s.Close()
+			case *RedisHSSStore:
+				s, ok := store.(*RedisHSSStore)
+				if !ok {
+					t.Fatalf("NewHSSStore() = %T, want *RedisHSSStore", store)
+				}
+				s.Close()
+			}
+		})
+	}
+}
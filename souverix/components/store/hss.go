@@ -1,7 +1,10 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/dasmlab/ims/pkg/ims"
@@ -13,26 +16,146 @@ type HSSStore interface {
 	// Subscriber operations
 	GetSubscriber(impi string) (*ims.Subscriber, error)
 	GetSubscriberByIMPU(impu string) (*ims.Subscriber, error)
+	GetSubscribersByIMPU(impu string) ([]*ims.Subscriber, error)
+	GetSubscriberByTN(tn string) (*ims.Subscriber, error)
 	UpsertSubscriber(sub *ims.Subscriber) error
 	DeleteSubscriber(impi string) error
 	ListSubscribers() ([]*ims.Subscriber, error)
 
+	// ListSubscribersPage returns at most limit subscribers ordered by
+	// IMPI, starting after the IMPI after, or from the first when empty
+	ListSubscribersPage(after string, limit int) ([]*ims.Subscriber, error)
+
+	// ListWildcardIdentities lists the wildcarded public identities of
+	// every subscriber, ordered by IMPI, then IMPU
+	ListWildcardIdentities() ([]WildcardIdentity, error)
+
+	// UpsertSubscribers writes a batch of subscribers in one transaction:
+	// all of them are stored, or none when an error is returned. merge,
+	// which may be nil, completes each subscriber from the stored one and
+	// aborts the batch by returning an error.
+	UpsertSubscribers(subs []*ims.Subscriber, merge SubscriberMerger) error
+
+	// UpdateSubscriber applies update to the stored subscriber impi and
+	// stores the result atomically, so the fields update leaves alone keep
+	// their stored value. It returns the subscriber as stored.
+	UpdateSubscriber(impi string, update SubscriberUpdater) (*ims.Subscriber, error)
+
 	// Registration operations
 	GetRegistration(impi string) (*ims.Registration, error)
 	UpsertRegistration(reg *ims.Registration) error
 	DeleteRegistration(impi string) error
+	ListRegistrations(scscfName string) ([]*ims.Registration, error)
+
+	// WatchRegistrations calls listener for every registration stored or
+	// deleted until ctx is done. Shared backends report the changes made
+	// by every HSS and S-CSCF instance, not only this one.
+	WatchRegistrations(ctx context.Context, listener RegistrationListener) error
 
 	// S-CSCF assignment
-	AssignSCSCF(impi string) (string, error)
+	AssignSCSCF(impi string, selectSCSCF SCSCFSelector) (string, error)
 	GetSCSCFForSubscriber(impi string) (string, error)
+
+	// AKA sequence numbers. Subscriber writes keep the stored SQN of an
+	// existing subscriber, so only AdvanceSQN moves it.
+	AdvanceSQN(impi string, advance SQNAdvancer) (uint64, error)
+}
+
+// Errors returned by HSSStore implementations
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrIMPUConflict = errors.New("public identity already assigned")
+)
+
+// SCSCFSelector chooses the S-CSCF of a subscriber from its current
+// assignment, which is empty when it has none. Returning current keeps
+// the assignment sticky.
+type SCSCFSelector func(current string) (string, error)
+
+// SubscriberMerger completes update, about to be written, from the stored
+// subscriber, which is nil for a new one. It may be called more than once
+// for a single write and must only change update; an error aborts the
+// write.
+type SubscriberMerger func(stored, update *ims.Subscriber) error
+
+// SubscriberUpdater returns the subscriber to store from a shallow copy of
+// the stored one, or an error that aborts the update. It may be called more
+// than once for a single UpdateSubscriber, must not have side effects and
+// must replace rather than modify the slices and maps of sub.
+type SubscriberUpdater func(sub *ims.Subscriber) (*ims.Subscriber, error)
+
+// SQNAdvancer returns the AKA sequence number to store for a subscriber from
+// its current one. It may be called more than once for a single AdvanceSQN
+// and must not have side effects.
+type SQNAdvancer func(current uint64) uint64
+
+// subscriberIMPUs returns the public identities indexed for a subscriber:
+// its IMPU and every identity of its service profiles
+func subscriberIMPUs(sub *ims.Subscriber) []string {
+	seen := make(map[string]bool)
+	var impus []string
+	all := append([]string{sub.IMPU}, sub.ServiceProfile.PublicIdentities...)
+	for _, profile := range sub.AdditionalProfiles {
+		all = append(all, profile.PublicIdentities...)
+	}
+	for _, impu := range all {
+		if impu != "" && !seen[impu] {
+			seen[impu] = true
+			impus = append(impus, impu)
+		}
+	}
+	return impus
+}
+
+// checkBatch checks that every subscriber of a batch has a private
+// identity, listed once
+func checkBatch(subs []*ims.Subscriber) error {
+	seen := make(map[string]bool)
+	for _, sub := range subs {
+		if sub.IMPI == "" {
+			return fmt.Errorf("IMPI is required")
+		}
+		if seen[sub.IMPI] {
+			return fmt.Errorf("subscriber %s listed twice", sub.IMPI)
+		}
+		seen[sub.IMPI] = true
+	}
+	return nil
+}
+
+// hasIMPU reports whether impu is indexed for sub
+func hasIMPU(sub *ims.Subscriber, impu string) bool {
+	for _, own := range subscriberIMPUs(sub) {
+		if own == impu {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedIMPU reports whether impu is marked as shared with other private
+// identities in any service profile of sub
+func sharedIMPU(sub *ims.Subscriber, impu string) bool {
+	if sub.ServiceProfile.IdentityAttributes[impu].Shared {
+		return true
+	}
+	for _, profile := range sub.AdditionalProfiles {
+		if profile.IdentityAttributes[impu].Shared {
+			return true
+		}
+	}
+	return false
 }
 
 // MemHSSStore is an in-memory implementation of HSSStore
 type MemHSSStore struct {
 	mu           sync.RWMutex
 	subscribers  map[string]*ims.Subscriber // key: IMPI
+	impuIndex    map[string]map[string]bool // key: IMPU, value: IMPI to shared flag
+	tnIndex      map[int][]tnRange // key: number of digits, sorted by tnRangeLess
+	wildcards    map[string][]WildcardIdentity // key: IMPI
 	registrations map[string]*ims.Registration // key: IMPI
-	scscfPool    []string // Available S-CSCF names
+	feed         registrationFeed
 	log          *logrus.Logger
 }
 
@@ -40,12 +163,11 @@ type MemHSSStore struct {
 func NewMemHSSStore(log *logrus.Logger) (*MemHSSStore, error) {
 	store := &MemHSSStore{
 		subscribers:   make(map[string]*ims.Subscriber),
+		impuIndex:     make(map[string]map[string]bool),
+		tnIndex:       make(map[int][]tnRange),
+		wildcards:     make(map[string][]WildcardIdentity),
 		registrations: make(map[string]*ims.Registration),
-		scscfPool: []string{
-			"scscf1.ims.local",
-			"scscf2.ims.local",
-		},
-		log: log,
+		log:           log,
 	}
 
 	// Seed a test subscriber
@@ -65,12 +187,14 @@ func (s *MemHSSStore) seedTestSubscriber() {
 		},
 		AuthData: ims.AuthData{
 			AuthScheme: "Digest",
-			Username:   "alice",
+			Username:   "alice@ims.local",
 			Realm:      "ims.local",
-			Password:   "secret123", // In production, this should be hashed
+			HA1:        "c5ca180391b741ab1262302b0f215dbd", // MD5("alice@ims.local:ims.local:secret123")
 		},
 	}
+	sub.Version = 1
 	s.subscribers[sub.IMPI] = sub
+	s.index(sub)
 	s.log.WithField("impi", sub.IMPI).Info("seeded test subscriber")
 }
 
@@ -81,7 +205,7 @@ func (s *MemHSSStore) GetSubscriber(impi string) (*ims.Subscriber, error) {
 
 	sub, ok := s.subscribers[impi]
 	if !ok {
-		return nil, fmt.Errorf("subscriber not found: %s", impi)
+		return nil, fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
 	}
 
 	// Return a copy to prevent external modification
@@ -89,52 +213,233 @@ func (s *MemHSSStore) GetSubscriber(impi string) (*ims.Subscriber, error) {
 	return &subCopy, nil
 }
 
-// GetSubscriberByIMPU retrieves a subscriber by IMPU
+// GetSubscriberByIMPU retrieves a subscriber by IMPU. Of the subscribers
+// sharing the IMPU, the one with the lowest IMPI is returned.
 func (s *MemHSSStore) GetSubscriberByIMPU(impu string) (*ims.Subscriber, error) {
+	subs, err := s.GetSubscribersByIMPU(impu)
+	if err != nil {
+		return nil, err
+	}
+	return subs[0], nil
+}
+
+// GetSubscribersByIMPU retrieves every subscriber the IMPU belongs to,
+// ordered by IMPI
+func (s *MemHSSStore) GetSubscribersByIMPU(impu string) ([]*ims.Subscriber, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for _, sub := range s.subscribers {
-		for _, pubID := range sub.ServiceProfile.PublicIdentities {
-			if pubID == impu {
-				subCopy := *sub
-				return &subCopy, nil
-			}
+	var subs []*ims.Subscriber
+	for impi := range s.impuIndex[impu] {
+		if sub, ok := s.subscribers[impi]; ok {
+			subCopy := *sub
+			subs = append(subs, &subCopy)
 		}
 	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("subscriber %w for IMPU: %s", ErrNotFound, impu)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].IMPI < subs[j].IMPI })
+	return subs, nil
+}
 
-	return nil, fmt.Errorf("subscriber not found for IMPU: %s", impu)
+// GetSubscriberByTN retrieves the subscriber owning a telephone number,
+// through one of its public identities or telephone number ranges
+func (s *MemHSSStore) GetSubscriberByTN(tn string) (*ims.Subscriber, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	digits := NormalizeTN(tn)
+	if r, ok := findTNRange(s.tnIndex[len(digits)], digits); ok && digits != "" {
+		if sub, ok := s.subscribers[r.impi]; ok {
+			subCopy := *sub
+			return &subCopy, nil
+		}
+	}
+	return nil, fmt.Errorf("subscriber %w for TN: %s", ErrNotFound, tn)
 }
 
 // UpsertSubscriber creates or updates a subscriber
 func (s *MemHSSStore) UpsertSubscriber(sub *ims.Subscriber) error {
+	return s.UpsertSubscribers([]*ims.Subscriber{sub}, nil)
+}
+
+// UpsertSubscribers creates or updates a batch of subscribers, restoring
+// the previous ones if any of them cannot be stored
+func (s *MemHSSStore) UpsertSubscribers(subs []*ims.Subscriber, merge SubscriberMerger) error {
+	if err := checkBatch(subs); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, err := s.upsert(subs, merge); err != nil {
+		return err
+	}
 
-	if sub.IMPI == "" {
-		return fmt.Errorf("IMPI is required")
+	for _, sub := range subs {
+		s.log.WithField("impi", sub.IMPI).Info("subscriber upserted")
 	}
+	return nil
+}
 
-	// Create a copy
-	subCopy := *sub
-	s.subscribers[sub.IMPI] = &subCopy
+// UpdateSubscriber applies update to a copy of the stored subscriber and
+// stores the result
+func (s *MemHSSStore) UpdateSubscriber(impi string, update SubscriberUpdater) (*ims.Subscriber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.log.WithField("impi", sub.IMPI).Info("subscriber upserted")
-	return nil
+	old, ok := s.subscribers[impi]
+	if !ok {
+		return nil, fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+	}
+	subCopy := *old
+	sub, err := update(&subCopy)
+	if err != nil {
+		return nil, err
+	}
+	sub.IMPI = impi
+
+	written, err := s.upsert([]*ims.Subscriber{sub}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.log.WithField("impi", impi).Info("subscriber updated")
+	stored := *written[0]
+	return &stored, nil
+}
+
+// upsert writes a checked batch of subscribers and returns them as stored,
+// restoring the previous ones on error; s.mu must be held
+func (s *MemHSSStore) upsert(subs []*ims.Subscriber, merge SubscriberMerger) ([]*ims.Subscriber, error) {
+	// Unindex the whole batch first, so identities moved between its
+	// subscribers do not conflict
+	previous := make(map[string]*ims.Subscriber)
+	for _, sub := range subs {
+		if old, ok := s.subscribers[sub.IMPI]; ok {
+			previous[sub.IMPI] = old
+			s.unindex(old)
+			delete(s.subscribers, sub.IMPI)
+		}
+	}
+
+	var written []*ims.Subscriber
+	rollback := func(err error) ([]*ims.Subscriber, error) {
+		for _, sub := range written {
+			s.unindex(sub)
+			delete(s.subscribers, sub.IMPI)
+		}
+		for impi, old := range previous {
+			s.index(old)
+			s.subscribers[impi] = old
+		}
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		subCopy := *sub
+		old := previous[sub.IMPI]
+		if merge != nil {
+			var oldCopy *ims.Subscriber
+			if old != nil {
+				copied := *old
+				oldCopy = &copied
+			}
+			if err := merge(oldCopy, &subCopy); err != nil {
+				return rollback(err)
+			}
+		}
+		subCopy.Version = 1
+		if old != nil {
+			subCopy.AuthData.SQN = old.AuthData.SQN
+			subCopy.Version = old.Version + 1
+		}
+
+		// An IMPU may belong to several subscribers only when all of
+		// them share it
+		for _, impu := range subscriberIMPUs(&subCopy) {
+			for owner, shared := range s.impuIndex[impu] {
+				if owner != sub.IMPI && !(shared && sharedIMPU(&subCopy, impu)) {
+					return rollback(fmt.Errorf("%w: %s belongs to %s", ErrIMPUConflict, impu, owner))
+				}
+			}
+		}
+
+		s.index(&subCopy)
+		s.subscribers[sub.IMPI] = &subCopy
+		written = append(written, &subCopy)
+	}
+	return written, nil
 }
 
 // DeleteSubscriber deletes a subscriber
 func (s *MemHSSStore) DeleteSubscriber(impi string) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
+	if sub, ok := s.subscribers[impi]; ok {
+		s.unindex(sub)
+	}
+	_, registered := s.registrations[impi]
 	delete(s.subscribers, impi)
 	delete(s.registrations, impi)
+	s.mu.Unlock()
 
+	if registered {
+		s.feed.notify(impi, nil)
+	}
 	s.log.WithField("impi", impi).Info("subscriber deleted")
 	return nil
 }
 
+// index adds the public identities, telephone numbers and wildcards of sub
+// to the indexes; s.mu must be held
+func (s *MemHSSStore) index(sub *ims.Subscriber) {
+	for _, impu := range subscriberIMPUs(sub) {
+		if s.impuIndex[impu] == nil {
+			s.impuIndex[impu] = make(map[string]bool)
+		}
+		s.impuIndex[impu][sub.IMPI] = sharedIMPU(sub, impu)
+	}
+	for _, r := range subscriberTNRanges(sub) {
+		ranges := s.tnIndex[len(r.start)]
+		i := sort.Search(len(ranges), func(i int) bool { return !tnRangeLess(ranges[i], r) })
+		ranges = append(ranges, tnRange{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = r
+		s.tnIndex[len(r.start)] = ranges
+	}
+	if wildcards := subscriberWildcards(sub); len(wildcards) > 0 {
+		s.wildcards[sub.IMPI] = wildcards
+	}
+}
+
+// unindex removes the public identities, telephone numbers and wildcards of
+// sub from the indexes; s.mu must be held
+func (s *MemHSSStore) unindex(sub *ims.Subscriber) {
+	for _, impu := range subscriberIMPUs(sub) {
+		delete(s.impuIndex[impu], sub.IMPI)
+		if len(s.impuIndex[impu]) == 0 {
+			delete(s.impuIndex, impu)
+		}
+	}
+	for _, old := range subscriberTNRanges(sub) {
+		digits := len(old.start)
+		ranges := s.tnIndex[digits]
+		kept := ranges[:0]
+		for _, r := range ranges {
+			if r.impi != sub.IMPI {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.tnIndex, digits)
+		} else {
+			s.tnIndex[digits] = kept
+		}
+	}
+	delete(s.wildcards, sub.IMPI)
+}
+
 // ListSubscribers lists all subscribers
 func (s *MemHSSStore) ListSubscribers() ([]*ims.Subscriber, error) {
 	s.mu.RLock()
@@ -149,6 +454,43 @@ func (s *MemHSSStore) ListSubscribers() ([]*ims.Subscriber, error) {
 	return subs, nil
 }
 
+// ListWildcardIdentities lists the wildcarded identities of all subscribers
+func (s *MemHSSStore) ListWildcardIdentities() ([]WildcardIdentity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var wildcards []WildcardIdentity
+	for _, own := range s.wildcards {
+		wildcards = append(wildcards, own...)
+	}
+	sortWildcards(wildcards)
+	return wildcards, nil
+}
+
+// ListSubscribersPage lists a page of subscribers ordered by IMPI
+func (s *MemHSSStore) ListSubscribersPage(after string, limit int) ([]*ims.Subscriber, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	impis := make([]string, 0, len(s.subscribers))
+	for impi := range s.subscribers {
+		if impi > after {
+			impis = append(impis, impi)
+		}
+	}
+	sort.Strings(impis)
+	if len(impis) > limit {
+		impis = impis[:limit]
+	}
+
+	subs := make([]*ims.Subscriber, 0, len(impis))
+	for _, impi := range impis {
+		subCopy := *s.subscribers[impi]
+		subs = append(subs, &subCopy)
+	}
+	return subs, nil
+}
+
 // GetRegistration retrieves a registration by IMPI
 func (s *MemHSSStore) GetRegistration(impi string) (*ims.Registration, error) {
 	s.mu.RLock()
@@ -156,7 +498,7 @@ func (s *MemHSSStore) GetRegistration(impi string) (*ims.Registration, error) {
 
 	reg, ok := s.registrations[impi]
 	if !ok {
-		return nil, fmt.Errorf("registration not found: %s", impi)
+		return nil, fmt.Errorf("registration %w: %s", ErrNotFound, impi)
 	}
 
 	regCopy := *reg
@@ -165,15 +507,16 @@ func (s *MemHSSStore) GetRegistration(impi string) (*ims.Registration, error) {
 
 // UpsertRegistration creates or updates a registration
 func (s *MemHSSStore) UpsertRegistration(reg *ims.Registration) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if reg.IMPI == "" {
 		return fmt.Errorf("IMPI is required")
 	}
 
 	regCopy := *reg
+	s.mu.Lock()
 	s.registrations[reg.IMPI] = &regCopy
+	s.mu.Unlock()
+
+	s.feed.notify(reg.IMPI, &regCopy)
 
 	s.log.WithFields(logrus.Fields{
 		"impi": reg.IMPI,
@@ -187,30 +530,59 @@ func (s *MemHSSStore) UpsertRegistration(reg *ims.Registration) error {
 // DeleteRegistration deletes a registration
 func (s *MemHSSStore) DeleteRegistration(impi string) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
+	_, registered := s.registrations[impi]
 	delete(s.registrations, impi)
+	s.mu.Unlock()
+
+	if registered {
+		s.feed.notify(impi, nil)
+	}
 	s.log.WithField("impi", impi).Info("registration deleted")
 	return nil
 }
 
-// AssignSCSCF assigns an S-CSCF to a subscriber (round-robin)
-func (s *MemHSSStore) AssignSCSCF(impi string) (string, error) {
+// WatchRegistrations calls listener for every registration change made
+// through this store until ctx is done
+func (s *MemHSSStore) WatchRegistrations(ctx context.Context, listener RegistrationListener) error {
+	s.feed.watch(ctx, listener)
+	return nil
+}
+
+// ListRegistrations lists the registrations held by the S-CSCF scscfName,
+// ordered by IMPI
+func (s *MemHSSStore) ListRegistrations(scscfName string) ([]*ims.Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	regs := make([]*ims.Registration, 0)
+	for _, reg := range s.registrations {
+		if reg.SCSCFName == scscfName {
+			regCopy := *reg
+			regs = append(regs, &regCopy)
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].IMPI < regs[j].IMPI })
+	return regs, nil
+}
+
+// AssignSCSCF stores the S-CSCF chosen by selectSCSCF for a subscriber
+func (s *MemHSSStore) AssignSCSCF(impi string, selectSCSCF SCSCFSelector) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(s.scscfPool) == 0 {
-		return "", fmt.Errorf("no S-CSCF available in pool")
+	sub, ok := s.subscribers[impi]
+	if !ok {
+		return "", fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
 	}
-
-	// Simple round-robin assignment
-	// In production, this would use more sophisticated logic
-	assigned := s.scscfPool[0]
-	
-	// Update subscriber's S-CSCF assignment
-	if sub, ok := s.subscribers[impi]; ok {
-		sub.SCSCFName = assigned
+	assigned, err := selectSCSCF(sub.SCSCFName)
+	if err != nil {
+		return "", err
 	}
+	if assigned == sub.SCSCFName {
+		return assigned, nil
+	}
+	sub.SCSCFName = assigned
+	sub.Version++
 
 	s.log.WithFields(logrus.Fields{
 		"impi": impi,
@@ -227,7 +599,7 @@ func (s *MemHSSStore) GetSCSCFForSubscriber(impi string) (string, error) {
 
 	sub, ok := s.subscribers[impi]
 	if !ok {
-		return "", fmt.Errorf("subscriber not found: %s", impi)
+		return "", fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
 	}
 
 	if sub.SCSCFName == "" {
@@ -236,3 +608,18 @@ func (s *MemHSSStore) GetSCSCFForSubscriber(impi string) (string, error) {
 
 	return sub.SCSCFName, nil
 }
+
+// AdvanceSQN replaces the AKA sequence number of a subscriber with the one
+// returned by advance and returns it
+func (s *MemHSSStore) AdvanceSQN(impi string, advance SQNAdvancer) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[impi]
+	if !ok {
+		return 0, fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+	}
+	sub.AuthData.SQN = advance(sub.AuthData.SQN)
+	sub.Version++
+	return sub.AuthData.SQN, nil
+}
@@ -111,7 +111,9 @@ func TestMemHSSStore_SCSCFAssignment(t *testing.T) {
 	store, _ := NewMemHSSStore(log)
 
 	// Assign
-	scscf, err := store.AssignSCSCF("alice@ims.local")
+	scscf, err := store.AssignSCSCF("alice@ims.local", func(string) (string, error) {
+		return "sip:scscf1.ims.local", nil
+	})
 	if err != nil {
 		t.Fatalf("AssignSCSCF() error = %v", err)
 	}
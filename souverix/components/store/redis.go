@@ -0,0 +1,1061 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// Redis key layout (all keys share the store prefix):
+//
+//	<prefix>sub:<impi>   subscriber JSON document
+//	<prefix>impu:<impu>  hash of the IMPIs owning the public identity to
+//	                     their shared flag ("1" or "0")
+//	<prefix>subs         set of all IMPIs
+//	<prefix>subindex     sorted set of all IMPIs, ordered lexically for
+//	                     paging
+//	<prefix>tn:<digits>  sorted set of the telephone number ranges of that
+//	                     many digits, as "<end>:<impi>:<start>" members
+//	<prefix>wildcards    hash of the IMPIs with wildcarded identities to
+//	                     the JSON list of those identities
+//	<prefix>reg:<impi>   registration JSON document
+//	<prefix>scscf:<name> set of the IMPIs registered with that S-CSCF
+//	<prefix>regchanges   stream of registration changes, with the IMPI and
+//	                     the registration JSON, empty for a deletion
+//	<prefix>schema       applied schema version
+const defaultRedisPrefix = "hss:"
+
+// redisTxRetries bounds optimistic transaction retries under contention
+const redisTxRetries = 10
+
+// redisSchemaVersion is the key layout version written by this store.
+// Bump it and add a step to migrate when the layout changes.
+const redisSchemaVersion = 6
+
+// redisTNPage is the number of candidate ranges read at a time when looking
+// up a telephone number
+const redisTNPage = 32
+
+// redisRegChangesLen is the approximate number of registration changes kept
+// in the change stream for watchers that fall behind
+const redisRegChangesLen = 10000
+
+// redisWatchBlock bounds a blocking read of the change stream, so watchers
+// notice cancellation
+const redisWatchBlock = time.Second
+
+// RedisHSSStore is a Redis implementation of HSSStore. Multi-key updates use
+// WATCH/MULTI/EXEC so concurrent writers cannot corrupt the IMPU index.
+type RedisHSSStore struct {
+	client redis.UniversalClient
+	prefix string
+	log    *logrus.Logger
+}
+
+// OpenRedisHSSStore connects to the Redis server at url (redis://host:port/db)
+func OpenRedisHSSStore(url string, log *logrus.Logger) (*RedisHSSStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	store, err := NewRedisHSSStore(client, log)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewRedisHSSStore creates a store on an existing client and migrates its key layout
+func NewRedisHSSStore(client redis.UniversalClient, log *logrus.Logger) (*RedisHSSStore, error) {
+	store := &RedisHSSStore{
+		client: client,
+		prefix: defaultRedisPrefix,
+		log:    log,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	if err := store.migrate(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close closes the Redis client
+func (s *RedisHSSStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisHSSStore) subKey(impi string) string   { return s.prefix + "sub:" + impi }
+func (s *RedisHSSStore) impuKey(impu string) string  { return s.prefix + "impu:" + impu }
+func (s *RedisHSSStore) regKey(impi string) string   { return s.prefix + "reg:" + impi }
+func (s *RedisHSSStore) scscfKey(name string) string { return s.prefix + "scscf:" + name }
+func (s *RedisHSSStore) tnKey(digits int) string     { return s.prefix + "tn:" + strconv.Itoa(digits) }
+func (s *RedisHSSStore) subsKey() string             { return s.prefix + "subs" }
+func (s *RedisHSSStore) subIndexKey() string         { return s.prefix + "subindex" }
+func (s *RedisHSSStore) wildcardsKey() string        { return s.prefix + "wildcards" }
+func (s *RedisHSSStore) regChangesKey() string       { return s.prefix + "regchanges" }
+func (s *RedisHSSStore) schemaKey() string           { return s.prefix + "schema" }
+
+// migrate records the key layout version, refusing to run against data
+// written by a newer layout
+func (s *RedisHSSStore) migrate(ctx context.Context) error {
+	current, err := s.client.Get(ctx, s.schemaKey()).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to read redis schema version: %w", err)
+	}
+	if current > redisSchemaVersion {
+		return fmt.Errorf("redis schema version %d is newer than supported version %d", current, redisSchemaVersion)
+	}
+	if current == redisSchemaVersion {
+		return nil
+	}
+
+	// Version 2 turned the IMPU index entries from a single IMPI into a
+	// hash of owners, so that identities can be shared
+	if current == 1 {
+		if err := s.migrateSharedIMPUs(ctx); err != nil {
+			return err
+		}
+	}
+	// Version 3 added the telephone number index
+	if current >= 1 && current < 3 {
+		if err := s.migrateTNRanges(ctx); err != nil {
+			return err
+		}
+	}
+	// Version 4 added the registrations by serving S-CSCF
+	if current >= 1 && current < 4 {
+		if err := s.migrateRegistrationSCSCFs(ctx); err != nil {
+			return err
+		}
+	}
+	// Version 5 added the ordered subscriber index
+	if current >= 1 && current < 5 {
+		if err := s.migrateSubscriberIndex(ctx); err != nil {
+			return err
+		}
+	}
+	// Version 6 added the wildcarded identity index
+	if current >= 1 && current < 6 {
+		if err := s.migrateWildcards(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.client.Set(ctx, s.schemaKey(), strconv.Itoa(redisSchemaVersion), 0).Err(); err != nil {
+		return fmt.Errorf("failed to write redis schema version: %w", err)
+	}
+	s.log.WithField("version", redisSchemaVersion).Info("HSS redis schema migrated")
+	return nil
+}
+
+// migrateSharedIMPUs converts the IMPU index entries of layout version 1
+func (s *RedisHSSStore) migrateSharedIMPUs(ctx context.Context) error {
+	iter := s.client.Scan(ctx, 0, s.impuKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		err := s.watch(ctx, func(tx *redis.Tx) error {
+			kind, err := tx.Type(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if kind != "string" {
+				// Removed or already converted
+				return nil
+			}
+			impi, err := tx.Get(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				pipe.HSet(ctx, key, impi, "0")
+				return nil
+			})
+			return err
+		}, key)
+		if err != nil {
+			return fmt.Errorf("failed to migrate IMPU index entry %s: %w", key, err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to scan IMPU index: %w", err)
+	}
+	return nil
+}
+
+// migrateTNRanges indexes the telephone numbers of the stored subscribers
+func (s *RedisHSSStore) migrateTNRanges(ctx context.Context) error {
+	impis, err := s.client.SMembers(ctx, s.subsKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	for _, impi := range impis {
+		err := s.watch(ctx, func(tx *redis.Tx) error {
+			sub, err := s.stored(ctx, tx, impi)
+			if err != nil || sub == nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				s.indexTNRanges(ctx, pipe, nil, sub)
+				return nil
+			})
+			return err
+		}, s.subKey(impi))
+		if err != nil {
+			return fmt.Errorf("failed to index telephone numbers of %s: %w", impi, err)
+		}
+	}
+	return nil
+}
+
+// migrateWildcards indexes the wildcarded identities of the stored subscribers
+func (s *RedisHSSStore) migrateWildcards(ctx context.Context) error {
+	impis, err := s.client.SMembers(ctx, s.subsKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	for _, impi := range impis {
+		err := s.watch(ctx, func(tx *redis.Tx) error {
+			sub, err := s.stored(ctx, tx, impi)
+			if err != nil || sub == nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return s.indexWildcards(ctx, pipe, sub.IMPI, sub)
+			})
+			return err
+		}, s.subKey(impi))
+		if err != nil {
+			return fmt.Errorf("failed to index wildcards of %s: %w", impi, err)
+		}
+	}
+	return nil
+}
+
+// migrateSubscriberIndex orders the stored IMPIs for paging
+func (s *RedisHSSStore) migrateSubscriberIndex(ctx context.Context) error {
+	impis, err := s.client.SMembers(ctx, s.subsKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	if len(impis) == 0 {
+		return nil
+	}
+	members := make([]redis.Z, len(impis))
+	for i, impi := range impis {
+		members[i] = redis.Z{Member: impi}
+	}
+	if err := s.client.ZAdd(ctx, s.subIndexKey(), members...).Err(); err != nil {
+		return fmt.Errorf("failed to index subscribers: %w", err)
+	}
+	return nil
+}
+
+// migrateRegistrationSCSCFs indexes the stored registrations by serving S-CSCF
+func (s *RedisHSSStore) migrateRegistrationSCSCFs(ctx context.Context) error {
+	iter := s.client.Scan(ctx, 0, s.regKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		impi := strings.TrimPrefix(key, s.regKey(""))
+		err := s.watch(ctx, func(tx *redis.Tx) error {
+			reg, err := s.storedRegistration(ctx, tx, impi)
+			if err != nil || reg == nil || reg.SCSCFName == "" {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SAdd(ctx, s.scscfKey(reg.SCSCFName), impi)
+				return nil
+			})
+			return err
+		}, key)
+		if err != nil {
+			return fmt.Errorf("failed to index registration %s: %w", impi, err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to scan registrations: %w", err)
+	}
+	return nil
+}
+
+// indexTNRanges replaces the telephone numbers indexed for old, which may be
+// nil, by those of sub, which may be nil
+func (s *RedisHSSStore) indexTNRanges(ctx context.Context, pipe redis.Pipeliner, old, sub *ims.Subscriber) {
+	if old != nil {
+		for _, r := range subscriberTNRanges(old) {
+			pipe.ZRem(ctx, s.tnKey(len(r.start)), r.end+":"+r.impi+":"+r.start)
+		}
+	}
+	if sub != nil {
+		for _, r := range subscriberTNRanges(sub) {
+			pipe.ZAdd(ctx, s.tnKey(len(r.start)), redis.Z{Member: r.end + ":" + r.impi + ":" + r.start})
+		}
+	}
+}
+
+// indexWildcards replaces the wildcarded identities indexed for impi by
+// those of sub, which may be nil
+func (s *RedisHSSStore) indexWildcards(ctx context.Context, pipe redis.Pipeliner, impi string, sub *ims.Subscriber) error {
+	var wildcards []WildcardIdentity
+	if sub != nil {
+		wildcards = subscriberWildcards(sub)
+	}
+	if len(wildcards) == 0 {
+		pipe.HDel(ctx, s.wildcardsKey(), impi)
+		return nil
+	}
+	data, err := json.Marshal(wildcards)
+	if err != nil {
+		return fmt.Errorf("failed to encode wildcards: %w", err)
+	}
+	pipe.HSet(ctx, s.wildcardsKey(), impi, data)
+	return nil
+}
+
+// watch runs fn in an optimistic transaction over keys, retrying on conflicts
+func (s *RedisHSSStore) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < redisTxRetries; i++ {
+		err := s.client.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("redis transaction aborted after %d retries", redisTxRetries)
+}
+
+// GetSubscriber retrieves a subscriber by IMPI
+func (s *RedisHSSStore) GetSubscriber(impi string) (*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.subKey(impi)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriber: %w", err)
+	}
+	return decodeSubscriber(data)
+}
+
+// GetSubscriberByIMPU retrieves a subscriber through the public identity
+// index. Of the subscribers sharing the IMPU, the one with the lowest IMPI
+// is returned.
+func (s *RedisHSSStore) GetSubscriberByIMPU(impu string) (*ims.Subscriber, error) {
+	subs, err := s.GetSubscribersByIMPU(impu)
+	if err != nil {
+		return nil, err
+	}
+	return subs[0], nil
+}
+
+// GetSubscribersByIMPU retrieves every subscriber the IMPU belongs to,
+// ordered by IMPI
+func (s *RedisHSSStore) GetSubscribersByIMPU(impu string) ([]*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	impis, err := s.client.HKeys(ctx, s.impuKey(impu)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IMPU index: %w", err)
+	}
+	sort.Strings(impis)
+
+	var subs []*ims.Subscriber
+	for _, impi := range impis {
+		sub, err := s.GetSubscriber(impi)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("subscriber %w for IMPU: %s", ErrNotFound, impu)
+	}
+	return subs, nil
+}
+
+// GetSubscriberByTN retrieves the subscriber owning a telephone number,
+// through one of its public identities or telephone number ranges
+func (s *RedisHSSStore) GetSubscriberByTN(tn string) (*ims.Subscriber, error) {
+	digits := NormalizeTN(tn)
+	if digits == "" {
+		return nil, fmt.Errorf("subscriber %w for TN: %s", ErrNotFound, tn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	// Members sort by end then IMPI: the first range covering the number
+	// owns it
+	for offset := int64(0); ; offset += redisTNPage {
+		members, err := s.client.ZRangeByLex(ctx, s.tnKey(len(digits)), &redis.ZRangeBy{
+			Min: "[" + digits, Max: "+", Offset: offset, Count: redisTNPage,
+		}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read telephone number index: %w", err)
+		}
+		for _, member := range members {
+			end, rest, _ := strings.Cut(member, ":")
+			i := strings.LastIndex(rest, ":")
+			if i < 0 {
+				continue
+			}
+			r := tnRange{impi: rest[:i], start: rest[i+1:], end: end}
+			if !r.covers(digits) {
+				continue
+			}
+			sub, err := s.GetSubscriber(r.impi)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return sub, err
+		}
+		if len(members) < redisTNPage {
+			return nil, fmt.Errorf("subscriber %w for TN: %s", ErrNotFound, tn)
+		}
+	}
+}
+
+// UpsertSubscriber creates or updates a subscriber and re-indexes its public
+// identities and telephone numbers atomically. The stored SQN of an existing
+// subscriber is kept.
+func (s *RedisHSSStore) UpsertSubscriber(sub *ims.Subscriber) error {
+	return s.UpsertSubscribers([]*ims.Subscriber{sub}, nil)
+}
+
+// UpsertSubscribers creates or updates a batch of subscribers in one
+// optimistic transaction over their keys and public identities
+func (s *RedisHSSStore) UpsertSubscribers(subs []*ims.Subscriber, merge SubscriberMerger) error {
+	if err := checkBatch(subs); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	var keys []string
+	for _, sub := range subs {
+		keys = append(keys, s.subKey(sub.IMPI))
+		for _, impu := range subscriberIMPUs(sub) {
+			keys = append(keys, s.impuKey(impu))
+		}
+	}
+
+	err := s.watch(ctx, func(tx *redis.Tx) error {
+		olds := make([]*ims.Subscriber, len(subs))
+		stored := make([]*ims.Subscriber, len(subs))
+		for i, sub := range subs {
+			old, err := s.stored(ctx, tx, sub.IMPI)
+			if err != nil {
+				return err
+			}
+			update := *sub
+			if merge != nil {
+				if err := merge(old, &update); err != nil {
+					return err
+				}
+			}
+			olds[i], stored[i] = old, &update
+		}
+		return s.write(ctx, tx, olds, stored)
+	}, keys...)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		s.log.WithField("impi", sub.IMPI).Info("subscriber upserted")
+	}
+	return nil
+}
+
+// UpdateSubscriber applies update to the stored subscriber and stores the
+// result, retrying when the subscriber changes concurrently
+func (s *RedisHSSStore) UpdateSubscriber(impi string, update SubscriberUpdater) (*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	var stored *ims.Subscriber
+	err := s.watch(ctx, func(tx *redis.Tx) error {
+		old, err := s.stored(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+		}
+		current := *old
+		sub, err := update(&current)
+		if err != nil {
+			return err
+		}
+		sub.IMPI = impi
+
+		// The new public identities are only known now
+		var keys []string
+		for _, impu := range subscriberIMPUs(sub) {
+			keys = append(keys, s.impuKey(impu))
+		}
+		if len(keys) > 0 {
+			if err := tx.Watch(ctx, keys...).Err(); err != nil {
+				return fmt.Errorf("failed to watch IMPU index: %w", err)
+			}
+		}
+		stored = sub
+		return s.write(ctx, tx, []*ims.Subscriber{old}, []*ims.Subscriber{sub})
+	}, s.subKey(impi))
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.WithField("impi", impi).Info("subscriber updated")
+	return stored, nil
+}
+
+// write stores subs over olds, whose entries are nil for new subscribers,
+// and re-indexes their public identities and telephone numbers in one
+// transaction. Sequence numbers are kept and versions advanced.
+func (s *RedisHSSStore) write(ctx context.Context, tx *redis.Tx, olds, subs []*ims.Subscriber) error {
+	batch := make(map[string]*ims.Subscriber)
+	data := make([][]byte, len(subs))
+	for i, sub := range subs {
+		sub.Version = 1
+		if old := olds[i]; old != nil {
+			sub.AuthData.SQN = old.AuthData.SQN
+			sub.Version = old.Version + 1
+		}
+		encoded, err := json.Marshal(sub)
+		if err != nil {
+			return fmt.Errorf("failed to encode subscriber: %w", err)
+		}
+		data[i] = encoded
+		batch[sub.IMPI] = sub
+	}
+
+	// An IMPU may belong to several subscribers only when all of them
+	// share it. Owners in the batch are checked against their new
+	// identities.
+	for _, sub := range subs {
+		for _, impu := range subscriberIMPUs(sub) {
+			owners, err := tx.HGetAll(ctx, s.impuKey(impu)).Result()
+			if err != nil {
+				return fmt.Errorf("failed to read IMPU index: %w", err)
+			}
+			for owner, shared := range owners {
+				if _, ok := batch[owner]; ok {
+					continue
+				}
+				if owner != sub.IMPI && !(shared == "1" && sharedIMPU(sub, impu)) {
+					return fmt.Errorf("%w: %s belongs to %s", ErrIMPUConflict, impu, owner)
+				}
+			}
+			for owner, other := range batch {
+				if owner != sub.IMPI && hasIMPU(other, impu) && !(sharedIMPU(other, impu) && sharedIMPU(sub, impu)) {
+					return fmt.Errorf("%w: %s belongs to %s", ErrIMPUConflict, impu, owner)
+				}
+			}
+		}
+	}
+
+	_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, sub := range subs {
+			if old := olds[i]; old != nil {
+				for _, impu := range subscriberIMPUs(old) {
+					pipe.HDel(ctx, s.impuKey(impu), sub.IMPI)
+				}
+			}
+		}
+		for i, sub := range subs {
+			for _, impu := range subscriberIMPUs(sub) {
+				shared := "0"
+				if sharedIMPU(sub, impu) {
+					shared = "1"
+				}
+				pipe.HSet(ctx, s.impuKey(impu), sub.IMPI, shared)
+			}
+			s.indexTNRanges(ctx, pipe, olds[i], sub)
+			if err := s.indexWildcards(ctx, pipe, sub.IMPI, sub); err != nil {
+				return err
+			}
+			pipe.Set(ctx, s.subKey(sub.IMPI), data[i], 0)
+			pipe.SAdd(ctx, s.subsKey(), sub.IMPI)
+			pipe.ZAdd(ctx, s.subIndexKey(), redis.Z{Member: sub.IMPI})
+		}
+		return nil
+	})
+	return err
+}
+
+// stored returns the stored subscriber impi, or nil if there is none
+func (s *RedisHSSStore) stored(ctx context.Context, tx *redis.Tx, impi string) (*ims.Subscriber, error) {
+	data, err := tx.Get(ctx, s.subKey(impi)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriber: %w", err)
+	}
+	return decodeSubscriber(data)
+}
+
+// DeleteSubscriber deletes a subscriber, its public identities and registration
+func (s *RedisHSSStore) DeleteSubscriber(impi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.watch(ctx, func(tx *redis.Tx) error {
+		old, err := s.stored(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		reg, err := s.storedRegistration(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if old != nil {
+				for _, impu := range subscriberIMPUs(old) {
+					pipe.HDel(ctx, s.impuKey(impu), impi)
+				}
+				s.indexTNRanges(ctx, pipe, old, nil)
+			}
+			pipe.HDel(ctx, s.wildcardsKey(), impi)
+			if reg != nil {
+				if reg.SCSCFName != "" {
+					pipe.SRem(ctx, s.scscfKey(reg.SCSCFName), impi)
+				}
+				s.publishRegistration(ctx, pipe, impi, nil)
+			}
+			pipe.Del(ctx, s.subKey(impi), s.regKey(impi))
+			pipe.SRem(ctx, s.subsKey(), impi)
+			pipe.ZRem(ctx, s.subIndexKey(), impi)
+			return nil
+		})
+		return err
+	}, s.subKey(impi), s.regKey(impi))
+	if err != nil {
+		return err
+	}
+
+	s.log.WithField("impi", impi).Info("subscriber deleted")
+	return nil
+}
+
+// ListSubscribers lists all subscribers
+func (s *RedisHSSStore) ListSubscribers() ([]*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	impis, err := s.client.SMembers(ctx, s.subsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscribers: %w", err)
+	}
+
+	return s.subscribers(ctx, impis)
+}
+
+// ListWildcardIdentities lists the wildcarded identities of all subscribers
+func (s *RedisHSSStore) ListWildcardIdentities() ([]WildcardIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	lists, err := s.client.HVals(ctx, s.wildcardsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wildcards: %w", err)
+	}
+	var wildcards []WildcardIdentity
+	for _, data := range lists {
+		var own []WildcardIdentity
+		if err := json.Unmarshal([]byte(data), &own); err != nil {
+			return nil, fmt.Errorf("failed to decode wildcards: %w", err)
+		}
+		wildcards = append(wildcards, own...)
+	}
+	sortWildcards(wildcards)
+	return wildcards, nil
+}
+
+// ListSubscribersPage lists at most limit subscribers whose IMPI sorts
+// after after
+func (s *RedisHSSStore) ListSubscribersPage(after string, limit int) ([]*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	min := "-"
+	if after != "" {
+		min = "(" + after
+	}
+	impis, err := s.client.ZRangeByLex(ctx, s.subIndexKey(), &redis.ZRangeBy{
+		Min: min, Max: "+", Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	return s.subscribers(ctx, impis)
+}
+
+// subscribers reads the subscribers impis, skipping deleted ones
+func (s *RedisHSSStore) subscribers(ctx context.Context, impis []string) ([]*ims.Subscriber, error) {
+	subs := make([]*ims.Subscriber, 0, len(impis))
+	if len(impis) == 0 {
+		return subs, nil
+	}
+
+	keys := make([]string, len(impis))
+	for i, impi := range impis {
+		keys[i] = s.subKey(impi)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscribers: %w", err)
+	}
+
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // deleted since SMEMBERS
+		}
+		sub, err := decodeSubscriber(data)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// GetRegistration retrieves a registration by IMPI
+func (s *RedisHSSStore) GetRegistration(impi string) (*ims.Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.regKey(impi)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("registration %w: %s", ErrNotFound, impi)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration: %w", err)
+	}
+	return decodeRegistration(data)
+}
+
+// storedRegistration returns the stored registration of impi, or nil if
+// there is none
+func (s *RedisHSSStore) storedRegistration(ctx context.Context, tx *redis.Tx, impi string) (*ims.Registration, error) {
+	data, err := tx.Get(ctx, s.regKey(impi)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration: %w", err)
+	}
+	return decodeRegistration(data)
+}
+
+// UpsertRegistration creates or updates a registration and moves it to the
+// set of its serving S-CSCF
+func (s *RedisHSSStore) UpsertRegistration(reg *ims.Registration) error {
+	if reg.IMPI == "" {
+		return fmt.Errorf("IMPI is required")
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to encode registration: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err = s.watch(ctx, func(tx *redis.Tx) error {
+		old, err := s.storedRegistration(ctx, tx, reg.IMPI)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if old != nil && old.SCSCFName != "" && old.SCSCFName != reg.SCSCFName {
+				pipe.SRem(ctx, s.scscfKey(old.SCSCFName), reg.IMPI)
+			}
+			if reg.SCSCFName != "" {
+				pipe.SAdd(ctx, s.scscfKey(reg.SCSCFName), reg.IMPI)
+			}
+			pipe.Set(ctx, s.regKey(reg.IMPI), data, 0)
+			s.publishRegistration(ctx, pipe, reg.IMPI, data)
+			return nil
+		})
+		return err
+	}, s.regKey(reg.IMPI))
+	if err != nil {
+		return fmt.Errorf("failed to upsert registration: %w", err)
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"impi":  reg.IMPI,
+		"impu":  reg.IMPU,
+		"state": reg.State,
+	}).Info("registration upserted")
+	return nil
+}
+
+// DeleteRegistration deletes a registration
+func (s *RedisHSSStore) DeleteRegistration(impi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.watch(ctx, func(tx *redis.Tx) error {
+		old, err := s.storedRegistration(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if old.SCSCFName != "" {
+				pipe.SRem(ctx, s.scscfKey(old.SCSCFName), impi)
+			}
+			pipe.Del(ctx, s.regKey(impi))
+			s.publishRegistration(ctx, pipe, impi, nil)
+			return nil
+		})
+		return err
+	}, s.regKey(impi))
+	if err != nil {
+		return fmt.Errorf("failed to delete registration: %w", err)
+	}
+	s.log.WithField("impi", impi).Info("registration deleted")
+	return nil
+}
+
+// publishRegistration appends a registration change to the change stream;
+// data is the registration JSON, nil for a deletion
+func (s *RedisHSSStore) publishRegistration(ctx context.Context, pipe redis.Pipeliner, impi string, data []byte) {
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.regChangesKey(),
+		MaxLen: redisRegChangesLen,
+		Approx: true,
+		Values: map[string]interface{}{"impi": impi, "data": data},
+	})
+}
+
+// WatchRegistrations calls listener for every registration change made by
+// any client of the Redis server until ctx is done, reading the change
+// stream from its current end
+func (s *RedisHSSStore) WatchRegistrations(ctx context.Context, listener RegistrationListener) error {
+	last := "0-0"
+	latest, err := s.client.XRevRangeN(ctx, s.regChangesKey(), "+", "-", 1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read registration changes: %w", err)
+	}
+	if len(latest) > 0 {
+		last = latest[0].ID
+	}
+
+	go func() {
+		for ctx.Err() == nil {
+			streams, err := s.client.XRead(ctx, &redis.XReadArgs{
+				Streams: []string{s.regChangesKey(), last},
+				Count:   100,
+				Block:   redisWatchBlock,
+			}).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.WithError(err).Warn("failed to read registration changes")
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(redisWatchBlock):
+				}
+				continue
+			}
+			for _, stream := range streams {
+				for _, message := range stream.Messages {
+					last = message.ID
+					s.dispatchRegistration(message, listener)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// dispatchRegistration calls listener with a registration change read from
+// the change stream
+func (s *RedisHSSStore) dispatchRegistration(message redis.XMessage, listener RegistrationListener) {
+	impi, _ := message.Values["impi"].(string)
+	data, _ := message.Values["data"].(string)
+	if impi == "" {
+		return
+	}
+	if data == "" {
+		listener(impi, nil)
+		return
+	}
+	reg, err := decodeRegistration(data)
+	if err != nil {
+		s.log.WithError(err).WithField("impi", impi).Error("invalid registration change")
+		return
+	}
+	listener(impi, reg)
+}
+
+// ListRegistrations lists the registrations held by the S-CSCF scscfName,
+// ordered by IMPI
+func (s *RedisHSSStore) ListRegistrations(scscfName string) ([]*ims.Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	impis, err := s.client.SMembers(ctx, s.scscfKey(scscfName)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list registrations: %w", err)
+	}
+
+	regs := make([]*ims.Registration, 0, len(impis))
+	if len(impis) == 0 {
+		return regs, nil
+	}
+	sort.Strings(impis)
+
+	keys := make([]string, len(impis))
+	for i, impi := range impis {
+		keys[i] = s.regKey(impi)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registrations: %w", err)
+	}
+
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // deleted since SMEMBERS
+		}
+		reg, err := decodeRegistration(data)
+		if err != nil {
+			return nil, err
+		}
+		if reg.SCSCFName == scscfName {
+			regs = append(regs, reg)
+		}
+	}
+	return regs, nil
+}
+
+// AssignSCSCF stores the S-CSCF chosen by selectSCSCF for a subscriber
+func (s *RedisHSSStore) AssignSCSCF(impi string, selectSCSCF SCSCFSelector) (string, error) {
+	var assigned string
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, s.subKey(impi)).Result()
+		if errors.Is(err, redis.Nil) {
+			return fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read subscriber: %w", err)
+		}
+
+		sub, err := decodeSubscriber(data)
+		if err != nil {
+			return err
+		}
+		if assigned, err = selectSCSCF(sub.SCSCFName); err != nil || assigned == sub.SCSCFName {
+			return err
+		}
+		sub.SCSCFName = assigned
+		sub.Version++
+		updated, err := json.Marshal(sub)
+		if err != nil {
+			return fmt.Errorf("failed to encode subscriber: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.subKey(impi), updated, 0)
+			return nil
+		})
+		return err
+	}, s.subKey(impi))
+	if err != nil {
+		return "", err
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"impi":  impi,
+		"scscf": assigned,
+	}).Info("S-CSCF assigned")
+	return assigned, nil
+}
+
+// AdvanceSQN replaces the AKA sequence number of a subscriber with the one
+// returned by advance and returns it, retrying when the subscriber changes
+// concurrently
+func (s *RedisHSSStore) AdvanceSQN(impi string, advance SQNAdvancer) (uint64, error) {
+	var sqn uint64
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.watch(ctx, func(tx *redis.Tx) error {
+		sub, err := s.stored(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		if sub == nil {
+			return fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+		}
+		sqn = advance(sub.AuthData.SQN)
+		sub.AuthData.SQN = sqn
+		sub.Version++
+		updated, err := json.Marshal(sub)
+		if err != nil {
+			return fmt.Errorf("failed to encode subscriber: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.subKey(impi), updated, 0)
+			return nil
+		})
+		return err
+	}, s.subKey(impi))
+	if err != nil {
+		return 0, err
+	}
+	return sqn, nil
+}
+
+// GetSCSCFForSubscriber retrieves the assigned S-CSCF for a subscriber
+func (s *RedisHSSStore) GetSCSCFForSubscriber(impi string) (string, error) {
+	sub, err := s.GetSubscriber(impi)
+	if err != nil {
+		return "", err
+	}
+	if sub.SCSCFName == "" {
+		return "", fmt.Errorf("no S-CSCF assigned for subscriber: %s", impi)
+	}
+	return sub.SCSCFName, nil
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+func TestRedisHSSStore_Conformance(t *testing.T) {
+	testHSSStoreConformance(t, func(t *testing.T) (HSSStore, func() HSSStore) {
+		server := miniredis.RunT(t)
+		url := "redis://" + server.Addr()
+
+		store, err := OpenRedisHSSStore(url, testLogger())
+		if err != nil {
+			t.Fatalf("OpenRedisHSSStore() error = %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		reopen := func() HSSStore {
+			reopened, err := OpenRedisHSSStore(url, testLogger())
+			if err != nil {
+				t.Fatalf("OpenRedisHSSStore() reopen error = %v", err)
+			}
+			t.Cleanup(func() { reopened.Close() })
+			return reopened
+		}
+		return store, reopen
+	})
+}
+
+func TestOpenRedisHSSStore_Errors(t *testing.T) {
+	if _, err := OpenRedisHSSStore("not a url", testLogger()); err == nil {
+		t.Error("OpenRedisHSSStore() accepted an invalid URL")
+	}
+
+	server := miniredis.RunT(t)
+	url := "redis://" + server.Addr()
+	server.Close()
+	if _, err := OpenRedisHSSStore(url, testLogger()); err == nil {
+		t.Error("OpenRedisHSSStore() succeeded without a server")
+	}
+}
+
+func TestRedisHSSStore_MigrateSharedIMPUs(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	// Version 1 indexed each public identity as a plain IMPI string
+	server.Set("hss:schema", "1")
+	server.Set("hss:sub:alice@ims.test", `{"IMPI":"alice@ims.test","IMPU":"sip:alice@ims.test",`+
+		`"ServiceProfile":{"TelephoneNumberRanges":[{"Start":"+15145550000","End":"+15145550099"}],`+
+		`"PublicIdentities":["sip:conf!.*!@ims.test"],`+
+		`"IdentityAttributes":{"sip:conf!.*!@ims.test":{"Wildcard":"sip:conf!.*!@ims.test"}}}}`)
+	server.SAdd("hss:subs", "alice@ims.test")
+	server.Set("hss:impu:sip:alice@ims.test", "alice@ims.test")
+	server.Set("hss:reg:alice@ims.test", `{"IMPI":"alice@ims.test","IMPU":"sip:alice@ims.test","SCSCFName":"sip:scscf1.ims.test"}`)
+
+	store, err := OpenRedisHSSStore("redis://"+server.Addr(), testLogger())
+	if err != nil {
+		t.Fatalf("OpenRedisHSSStore() error = %v", err)
+	}
+	defer store.Close()
+
+	if got, err := store.GetSubscriberByIMPU("sip:alice@ims.test"); err != nil || got.IMPI != "alice@ims.test" {
+		t.Errorf("GetSubscriberByIMPU() after migration = %v, %v", got, err)
+	}
+	if got, err := store.GetSubscriberByTN("+15145550042"); err != nil || got.IMPI != "alice@ims.test" {
+		t.Errorf("GetSubscriberByTN() after migration = %v, %v", got, err)
+	}
+	if regs, err := store.ListRegistrations("sip:scscf1.ims.test"); err != nil || len(regs) != 1 {
+		t.Errorf("ListRegistrations() after migration = %v, %v", regs, err)
+	}
+	if page, err := store.ListSubscribersPage("", 10); err != nil || len(page) != 1 {
+		t.Errorf("ListSubscribersPage() after migration = %v, %v", page, err)
+	}
+	if wildcards, err := store.ListWildcardIdentities(); err != nil || len(wildcards) != 1 {
+		t.Errorf("ListWildcardIdentities() after migration = %v, %v", wildcards, err)
+	}
+	if version, _ := server.Get("hss:schema"); version != "6" {
+		t.Errorf("schema version = %q, want 6", version)
+	}
+}
+
+func TestRedisHSSStore_WatchRegistrationsAcrossClients(t *testing.T) {
+	server := miniredis.RunT(t)
+	url := "redis://" + server.Addr()
+	watcher, err := OpenRedisHSSStore(url, testLogger())
+	if err != nil {
+		t.Fatalf("OpenRedisHSSStore() error = %v", err)
+	}
+	defer watcher.Close()
+	writer, err := OpenRedisHSSStore(url, testLogger())
+	if err != nil {
+		t.Fatalf("OpenRedisHSSStore() error = %v", err)
+	}
+	defer writer.Close()
+
+	// A change made before watching is not reported
+	writer.UpsertRegistration(&ims.Registration{IMPI: "old@ims.test", IMPU: "sip:old@ims.test"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	if err := watcher.WatchRegistrations(ctx, func(impi string, reg *ims.Registration) { changes <- impi }); err != nil {
+		t.Fatalf("WatchRegistrations() error = %v", err)
+	}
+
+	writer.UpsertRegistration(&ims.Registration{IMPI: "alice@ims.test", IMPU: "sip:alice@ims.test"})
+	select {
+	case impi := <-changes:
+		if impi != "alice@ims.test" {
+			t.Errorf("change of %s reported, want alice@ims.test", impi)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("change made by another client not reported")
+	}
+}
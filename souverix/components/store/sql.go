@@ -0,0 +1,1107 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dasmlab/ims/pkg/ims"
+	"github.com/jackc/pgx/v5/stdlib" // registers the "pgx" driver
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// storeOpTimeout bounds a single store operation against a remote backend
+const storeOpTimeout = 5 * time.Second
+
+// sqlRegistrationChannel is the NOTIFY channel of registration changes;
+// the payload is the IMPI
+const sqlRegistrationChannel = "hss_registrations"
+
+// sqlListenRetry is the delay before listening again after the connection
+// of a registration change feed failed
+const sqlListenRetry = time.Second
+
+// sqlDialect captures the differences between supported SQL databases
+type sqlDialect struct {
+	name      string
+	numbered  bool   // $1, $2 placeholders instead of ?
+	forUpdate string // row locking clause for read-modify-write transactions
+	notify    bool   // LISTEN/NOTIFY publishes changes to every client
+}
+
+var (
+	dialectPostgres = sqlDialect{name: "postgres", numbered: true, forUpdate: " FOR UPDATE", notify: true}
+	dialectSQLite   = sqlDialect{name: "sqlite"}
+)
+
+// rebind rewrites ? placeholders for the dialect
+func (d sqlDialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// SQLHSSStore is a database/sql implementation of HSSStore for PostgreSQL
+// (production) and SQLite (embedded/testing). Subscribers and registrations are
+// stored as JSON documents; public identities are indexed in hss_impus.
+// Registration changes are published with NOTIFY on PostgreSQL; an SQLite
+// database only reports the changes made through the same store.
+type SQLHSSStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	feed    registrationFeed // without NOTIFY
+	log     *logrus.Logger
+}
+
+// OpenPostgresHSSStore connects to PostgreSQL and applies pending migrations
+func OpenPostgresHSSStore(dsn string, log *logrus.Logger) (*SQLHSSStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %w", err)
+	}
+	store, err := newSQLHSSStore(db, dialectPostgres, log)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// OpenSQLiteHSSStore opens a SQLite database (a file path or ":memory:") and
+// applies pending migrations
+func OpenSQLiteHSSStore(dsn string, log *logrus.Logger) (*SQLHSSStore, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite: %w", err)
+	}
+	// SQLite allows one writer; a single connection also keeps ":memory:"
+	// databases from being private to each pooled connection
+	db.SetMaxOpenConns(1)
+
+	store, err := newSQLHSSStore(db, dialectSQLite, log)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func newSQLHSSStore(db *sql.DB, dialect sqlDialect, log *logrus.Logger) (*SQLHSSStore, error) {
+	store := &SQLHSSStore{
+		db:      db,
+		dialect: dialect,
+		log:     log,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", dialect.name, err)
+	}
+	if err := store.migrate(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Close closes the database connection pool
+func (s *SQLHSSStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlMigration is one schema version of the SQL store
+type sqlMigration struct {
+	version     int
+	description string
+	statements  []string
+
+	// backfill, if set, runs after the statements in the same transaction
+	backfill func(s *SQLHSSStore, ctx context.Context, tx *sql.Tx) error
+}
+
+// sqlMigrations are applied in order; append new versions, never edit applied ones
+var sqlMigrations = []sqlMigration{
+	{
+		version:     1,
+		description: "subscribers, public identity index and registrations",
+		statements: []string{
+			`CREATE TABLE hss_subscribers (
+				impi       TEXT PRIMARY KEY,
+				data       TEXT NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE TABLE hss_impus (
+				impu TEXT PRIMARY KEY,
+				impi TEXT NOT NULL REFERENCES hss_subscribers (impi) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX hss_impus_impi ON hss_impus (impi)`,
+			`CREATE TABLE hss_registrations (
+				impi       TEXT PRIMARY KEY,
+				impu       TEXT NOT NULL,
+				data       TEXT NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "public identities shared by several private identities",
+		statements: []string{
+			`CREATE TABLE hss_impus_v2 (
+				impu   TEXT NOT NULL,
+				impi   TEXT NOT NULL REFERENCES hss_subscribers (impi) ON DELETE CASCADE,
+				shared BOOLEAN NOT NULL DEFAULT FALSE,
+				PRIMARY KEY (impu, impi)
+			)`,
+			`INSERT INTO hss_impus_v2 (impu, impi) SELECT impu, impi FROM hss_impus`,
+			`DROP TABLE hss_impus`,
+			`ALTER TABLE hss_impus_v2 RENAME TO hss_impus`,
+			`CREATE INDEX hss_impus_impi ON hss_impus (impi)`,
+			// An identity that is not shared has a single owner
+			`CREATE UNIQUE INDEX hss_impus_exclusive ON hss_impus (impu) WHERE NOT shared`,
+		},
+	},
+	{
+		version:     3,
+		description: "telephone number index",
+		statements: []string{
+			`CREATE TABLE hss_tn_ranges (
+				impi     TEXT NOT NULL REFERENCES hss_subscribers (impi) ON DELETE CASCADE,
+				digits   INTEGER NOT NULL,
+				start_tn TEXT NOT NULL,
+				end_tn   TEXT NOT NULL
+			)`,
+			`CREATE INDEX hss_tn_ranges_end ON hss_tn_ranges (digits, end_tn)`,
+			`CREATE INDEX hss_tn_ranges_impi ON hss_tn_ranges (impi)`,
+		},
+		backfill: (*SQLHSSStore).backfillTNRanges,
+	},
+	{
+		version:     4,
+		description: "registrations by serving S-CSCF",
+		statements: []string{
+			`ALTER TABLE hss_registrations ADD COLUMN scscf TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX hss_registrations_scscf ON hss_registrations (scscf)`,
+		},
+		backfill: (*SQLHSSStore).backfillRegistrationSCSCFs,
+	},
+	{
+		version:     5,
+		description: "wildcarded public identity index",
+		statements: []string{
+			`CREATE TABLE hss_wildcards (
+				impi     TEXT NOT NULL REFERENCES hss_subscribers (impi) ON DELETE CASCADE,
+				impu     TEXT NOT NULL,
+				wildcard TEXT NOT NULL,
+				PRIMARY KEY (impi, impu)
+			)`,
+		},
+		backfill: (*SQLHSSStore).backfillWildcards,
+	},
+}
+
+// migrate applies pending migrations, each in its own transaction. A migration
+// applied concurrently by another HSS instance is detected and skipped.
+func (s *SQLHSSStore) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS hss_schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	for _, m := range sqlMigrations {
+		applied, err := s.migrationApplied(ctx, m.version)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		if err := s.applyMigration(ctx, m); err != nil {
+			// Another instance may have won the race for this version
+			if applied, _ := s.migrationApplied(ctx, m.version); applied {
+				continue
+			}
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+		s.log.WithFields(logrus.Fields{
+			"version":     m.version,
+			"description": m.description,
+		}).Info("HSS schema migration applied")
+	}
+	return nil
+}
+
+func (s *SQLHSSStore) migrationApplied(ctx context.Context, version int) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT COUNT(*) FROM hss_schema_migrations WHERE version = ?`), version).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (s *SQLHSSStore) applyMigration(ctx context.Context, m sqlMigration) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, stmt := range m.statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		if m.backfill != nil {
+			if err := m.backfill(s, ctx, tx); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO hss_schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`),
+			m.version, m.description, time.Now().UTC())
+		return err
+	})
+}
+
+// withTx runs fn in a transaction, committing on success
+func (s *SQLHSSStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSubscriber retrieves a subscriber by IMPI
+func (s *SQLHSSStore) GetSubscriber(impi string) (*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	var data string
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT data FROM hss_subscribers WHERE impi = ?`), impi).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriber: %w", err)
+	}
+	return decodeSubscriber(data)
+}
+
+// GetSubscriberByIMPU retrieves a subscriber through the public identity
+// index. Of the subscribers sharing the IMPU, the one with the lowest IMPI
+// is returned.
+func (s *SQLHSSStore) GetSubscriberByIMPU(impu string) (*ims.Subscriber, error) {
+	subs, err := s.GetSubscribersByIMPU(impu)
+	if err != nil {
+		return nil, err
+	}
+	return subs[0], nil
+}
+
+// GetSubscribersByIMPU retrieves every subscriber the IMPU belongs to,
+// ordered by IMPI
+func (s *SQLHSSStore) GetSubscribersByIMPU(impu string) ([]*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT s.data FROM hss_impus i JOIN hss_subscribers s ON s.impi = i.impi WHERE i.impu = ? ORDER BY i.impi`), impu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscribers: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []*ims.Subscriber
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read subscriber: %w", err)
+		}
+		sub, err := decodeSubscriber(data)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read subscribers: %w", err)
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("subscriber %w for IMPU: %s", ErrNotFound, impu)
+	}
+	return subs, nil
+}
+
+// GetSubscriberByTN retrieves the subscriber owning a telephone number,
+// through one of its public identities or telephone number ranges
+func (s *SQLHSSStore) GetSubscriberByTN(tn string) (*ims.Subscriber, error) {
+	digits := NormalizeTN(tn)
+	if digits == "" {
+		return nil, fmt.Errorf("subscriber %w for TN: %s", ErrNotFound, tn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	// Of the ranges covering the number, the one ending first owns it
+	var data string
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT s.data FROM hss_tn_ranges r JOIN hss_subscribers s ON s.impi = r.impi
+		WHERE r.digits = ? AND r.end_tn >= ? AND r.start_tn <= ? ORDER BY r.end_tn, r.impi LIMIT 1`),
+		len(digits), digits, digits).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("subscriber %w for TN: %s", ErrNotFound, tn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriber: %w", err)
+	}
+	return decodeSubscriber(data)
+}
+
+// UpsertSubscriber creates or updates a subscriber and re-indexes its public
+// identities and telephone numbers in one transaction. The stored SQN of an
+// existing subscriber is kept.
+func (s *SQLHSSStore) UpsertSubscriber(sub *ims.Subscriber) error {
+	return s.UpsertSubscribers([]*ims.Subscriber{sub}, nil)
+}
+
+// UpsertSubscribers creates or updates a batch of subscribers in one
+// transaction
+func (s *SQLHSSStore) UpsertSubscribers(subs []*ims.Subscriber, merge SubscriberMerger) error {
+	if err := checkBatch(subs); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// Unindex the whole batch first, so identities moved between its
+		// subscribers do not conflict
+		for _, sub := range subs {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+				`DELETE FROM hss_impus WHERE impi = ?`), sub.IMPI); err != nil {
+				return fmt.Errorf("failed to clear public identities: %w", err)
+			}
+		}
+		for _, sub := range subs {
+			if _, err := s.upsertSubscriber(ctx, tx, sub, merge); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		s.log.WithField("impi", sub.IMPI).Info("subscriber upserted")
+	}
+	return nil
+}
+
+// UpdateSubscriber applies update to the stored subscriber and stores the
+// result in one transaction
+func (s *SQLHSSStore) UpdateSubscriber(impi string, update SubscriberUpdater) (*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	var stored *ims.Subscriber
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		old, err := s.lockedSubscriber(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		sub, err := update(old)
+		if err != nil {
+			return err
+		}
+		sub.IMPI = impi
+
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`DELETE FROM hss_impus WHERE impi = ?`), impi); err != nil {
+			return fmt.Errorf("failed to clear public identities: %w", err)
+		}
+		stored, err = s.upsertSubscriber(ctx, tx, sub, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.WithField("impi", impi).Info("subscriber updated")
+	return stored, nil
+}
+
+// lockedSubscriber reads the subscriber impi for update within tx
+func (s *SQLHSSStore) lockedSubscriber(ctx context.Context, tx *sql.Tx, impi string) (*ims.Subscriber, error) {
+	var data string
+	err := tx.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT data FROM hss_subscribers WHERE impi = ?`+s.dialect.forUpdate), impi).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscriber: %w", err)
+	}
+	return decodeSubscriber(data)
+}
+
+// upsertSubscriber writes sub and indexes its public identities, which
+// must have been cleared, and telephone numbers. It returns the subscriber
+// as stored.
+func (s *SQLHSSStore) upsertSubscriber(ctx context.Context, tx *sql.Tx, sub *ims.Subscriber, merge SubscriberMerger) (*ims.Subscriber, error) {
+	stored := *sub
+	old, err := s.lockedSubscriber(ctx, tx, sub.IMPI)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if merge != nil {
+		if err := merge(old, &stored); err != nil {
+			return nil, err
+		}
+	}
+	stored.Version = 1
+	if old != nil {
+		stored.AuthData.SQN = old.AuthData.SQN
+		stored.Version = old.Version + 1
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode subscriber: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO hss_subscribers (impi, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (impi) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`),
+		sub.IMPI, string(data), time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert subscriber: %w", err)
+	}
+
+	for _, impu := range subscriberIMPUs(&stored) {
+		shared := sharedIMPU(&stored, impu)
+
+		// An IMPU may belong to several subscribers only when all of
+		// them share it
+		owners, err := s.impuOwners(ctx, tx, impu)
+		if err != nil {
+			return nil, err
+		}
+		for owner, ownerShared := range owners {
+			if !(shared && ownerShared) {
+				return nil, fmt.Errorf("%w: %s belongs to %s", ErrIMPUConflict, impu, owner)
+			}
+		}
+
+		// A concurrent exclusive owner violates hss_impus_exclusive
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO hss_impus (impu, impi, shared) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`),
+			impu, sub.IMPI, shared)
+		if err != nil {
+			return nil, fmt.Errorf("failed to index public identity: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			var owner string
+			tx.QueryRowContext(ctx, s.dialect.rebind(
+				`SELECT impi FROM hss_impus WHERE impu = ? AND impi <> ?`), impu, sub.IMPI).Scan(&owner)
+			return nil, fmt.Errorf("%w: %s belongs to %s", ErrIMPUConflict, impu, owner)
+		}
+	}
+	if err := s.indexTNRanges(ctx, tx, &stored); err != nil {
+		return nil, err
+	}
+	if err := s.indexWildcards(ctx, tx, &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// impuOwners returns the other subscribers indexed under impu with their
+// shared flag. The subscriber being upserted has no rows left at this point.
+func (s *SQLHSSStore) impuOwners(ctx context.Context, tx *sql.Tx, impu string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(
+		`SELECT impi, shared FROM hss_impus WHERE impu = ?`), impu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public identity owners: %w", err)
+	}
+	defer rows.Close()
+
+	owners := make(map[string]bool)
+	for rows.Next() {
+		var impi string
+		var shared bool
+		if err := rows.Scan(&impi, &shared); err != nil {
+			return nil, fmt.Errorf("failed to read public identity owners: %w", err)
+		}
+		owners[impi] = shared
+	}
+	return owners, rows.Err()
+}
+
+// indexTNRanges replaces the telephone numbers indexed for sub
+func (s *SQLHSSStore) indexTNRanges(ctx context.Context, tx *sql.Tx, sub *ims.Subscriber) error {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM hss_tn_ranges WHERE impi = ?`), sub.IMPI); err != nil {
+		return fmt.Errorf("failed to clear telephone numbers: %w", err)
+	}
+	for _, r := range subscriberTNRanges(sub) {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO hss_tn_ranges (impi, digits, start_tn, end_tn) VALUES (?, ?, ?, ?)`),
+			sub.IMPI, len(r.start), r.start, r.end); err != nil {
+			return fmt.Errorf("failed to index telephone numbers: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexWildcards replaces the wildcarded identities indexed for sub
+func (s *SQLHSSStore) indexWildcards(ctx context.Context, tx *sql.Tx, sub *ims.Subscriber) error {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM hss_wildcards WHERE impi = ?`), sub.IMPI); err != nil {
+		return fmt.Errorf("failed to clear wildcards: %w", err)
+	}
+	for _, w := range subscriberWildcards(sub) {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO hss_wildcards (impi, impu, wildcard) VALUES (?, ?, ?)`),
+			w.IMPI, w.IMPU, w.Wildcard); err != nil {
+			return fmt.Errorf("failed to index wildcards: %w", err)
+		}
+	}
+	return nil
+}
+
+// backfillTNRanges indexes the telephone numbers of the stored subscribers
+func (s *SQLHSSStore) backfillTNRanges(ctx context.Context, tx *sql.Tx) error {
+	return s.backfillSubscribers(ctx, tx, s.indexTNRanges)
+}
+
+// backfillWildcards indexes the wildcarded identities of the stored subscribers
+func (s *SQLHSSStore) backfillWildcards(ctx context.Context, tx *sql.Tx) error {
+	return s.backfillSubscribers(ctx, tx, s.indexWildcards)
+}
+
+// backfillSubscribers calls index for every stored subscriber
+func (s *SQLHSSStore) backfillSubscribers(ctx context.Context, tx *sql.Tx,
+	index func(ctx context.Context, tx *sql.Tx, sub *ims.Subscriber) error) error {
+	rows, err := tx.QueryContext(ctx, `SELECT data FROM hss_subscribers`)
+	if err != nil {
+		return fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	var subs []*ims.Subscriber
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read subscriber: %w", err)
+		}
+		sub, err := decodeSubscriber(data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list subscribers: %w", err)
+	}
+
+	for _, sub := range subs {
+		if err := index(ctx, tx, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSubscriber deletes a subscriber, its public identities and registration
+func (s *SQLHSSStore) DeleteSubscriber(impi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	registered := false
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if registered, err = s.deleteRegistration(ctx, tx, impi); err != nil {
+			return err
+		}
+		for _, stmt := range []string{
+			`DELETE FROM hss_impus WHERE impi = ?`,
+			`DELETE FROM hss_tn_ranges WHERE impi = ?`,
+			`DELETE FROM hss_wildcards WHERE impi = ?`,
+			`DELETE FROM hss_subscribers WHERE impi = ?`,
+		} {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(stmt), impi); err != nil {
+				return fmt.Errorf("failed to delete subscriber: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if registered && !s.dialect.notify {
+		s.feed.notify(impi, nil)
+	}
+	s.log.WithField("impi", impi).Info("subscriber deleted")
+	return nil
+}
+
+// ListSubscribers lists all subscribers
+func (s *SQLHSSStore) ListSubscribers() ([]*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM hss_subscribers ORDER BY impi`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	return scanSubscribers(rows)
+}
+
+// ListSubscribersPage lists at most limit subscribers whose IMPI sorts
+// after after
+func (s *SQLHSSStore) ListSubscribersPage(after string, limit int) ([]*ims.Subscriber, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT data FROM hss_subscribers WHERE impi > ? ORDER BY impi LIMIT ?`), after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscribers: %w", err)
+	}
+	return scanSubscribers(rows)
+}
+
+// ListWildcardIdentities lists the wildcarded identities of all subscribers
+func (s *SQLHSSStore) ListWildcardIdentities() ([]WildcardIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT impi, impu, wildcard FROM hss_wildcards`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wildcards: %w", err)
+	}
+	defer rows.Close()
+
+	var wildcards []WildcardIdentity
+	for rows.Next() {
+		var w WildcardIdentity
+		if err := rows.Scan(&w.IMPI, &w.IMPU, &w.Wildcard); err != nil {
+			return nil, fmt.Errorf("failed to read wildcard: %w", err)
+		}
+		wildcards = append(wildcards, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list wildcards: %w", err)
+	}
+	// Sorted here rather than by the database collation
+	sortWildcards(wildcards)
+	return wildcards, nil
+}
+
+// scanSubscribers decodes and closes rows of subscriber data
+func scanSubscribers(rows *sql.Rows) ([]*ims.Subscriber, error) {
+	defer rows.Close()
+
+	subs := make([]*ims.Subscriber, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read subscriber: %w", err)
+		}
+		sub, err := decodeSubscriber(data)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// GetRegistration retrieves a registration by IMPI
+func (s *SQLHSSStore) GetRegistration(impi string) (*ims.Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	var data string
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT data FROM hss_registrations WHERE impi = ?`), impi).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("registration %w: %s", ErrNotFound, impi)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration: %w", err)
+	}
+
+	return decodeRegistration(data)
+}
+
+// UpsertRegistration creates or updates a registration
+func (s *SQLHSSStore) UpsertRegistration(reg *ims.Registration) error {
+	if reg.IMPI == "" {
+		return fmt.Errorf("IMPI is required")
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to encode registration: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO hss_registrations (impi, impu, scscf, data, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (impi) DO UPDATE SET impu = excluded.impu, scscf = excluded.scscf, data = excluded.data, updated_at = excluded.updated_at`),
+			reg.IMPI, reg.IMPU, reg.SCSCFName, string(data), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		return s.publishRegistration(ctx, tx, reg.IMPI)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upsert registration: %w", err)
+	}
+	if !s.dialect.notify {
+		s.feed.notify(reg.IMPI, reg)
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"impi":  reg.IMPI,
+		"impu":  reg.IMPU,
+		"state": reg.State,
+	}).Info("registration upserted")
+	return nil
+}
+
+// DeleteRegistration deletes a registration
+func (s *SQLHSSStore) DeleteRegistration(impi string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	registered := false
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		registered, err = s.deleteRegistration(ctx, tx, impi)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if registered && !s.dialect.notify {
+		s.feed.notify(impi, nil)
+	}
+	s.log.WithField("impi", impi).Info("registration deleted")
+	return nil
+}
+
+// deleteRegistration deletes the registration of impi in tx and reports
+// whether there was one
+func (s *SQLHSSStore) deleteRegistration(ctx context.Context, tx *sql.Tx, impi string) (bool, error) {
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM hss_registrations WHERE impi = ?`), impi)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete registration: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, nil
+	}
+	return true, s.publishRegistration(ctx, tx, impi)
+}
+
+// publishRegistration notifies the listeners of every client that the
+// registration of impi changed, once tx commits
+func (s *SQLHSSStore) publishRegistration(ctx context.Context, tx *sql.Tx, impi string) error {
+	if !s.dialect.notify {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`SELECT pg_notify(?, ?)`), sqlRegistrationChannel, impi); err != nil {
+		return fmt.Errorf("failed to publish registration change: %w", err)
+	}
+	return nil
+}
+
+// WatchRegistrations calls listener for every registration change until ctx
+// is done. On PostgreSQL a connection is reserved to LISTEN for the changes
+// of every client, and listener receives the registration as stored when the
+// notification arrives.
+func (s *SQLHSSStore) WatchRegistrations(ctx context.Context, listener RegistrationListener) error {
+	if !s.dialect.notify {
+		s.feed.watch(ctx, listener)
+		return nil
+	}
+	conn, err := s.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go s.dispatchNotifications(ctx, conn, listener)
+	return nil
+}
+
+// listen reserves a connection listening for registration changes
+func (s *SQLHSSStore) listen(ctx context.Context) (*sql.Conn, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve a connection: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "LISTEN "+sqlRegistrationChannel); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to listen for registration changes: %w", err)
+	}
+	return conn, nil
+}
+
+// dispatchNotifications calls listener for the registration changes notified
+// on conn until ctx is done, listening again when the connection fails.
+// Changes made while no connection listens are not reported.
+func (s *SQLHSSStore) dispatchNotifications(ctx context.Context, conn *sql.Conn, listener RegistrationListener) {
+	for {
+		err := conn.Raw(func(driverConn any) error {
+			pgConn, ok := driverConn.(*stdlib.Conn)
+			if !ok {
+				return fmt.Errorf("driver connection %T does not support notifications", driverConn)
+			}
+			for {
+				notification, err := pgConn.Conn().WaitForNotification(ctx)
+				if err != nil {
+					return err
+				}
+				s.dispatchRegistration(notification.Payload, listener)
+			}
+		})
+		conn.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		s.log.WithError(err).Warn("registration change feed interrupted")
+
+		for conn = nil; conn == nil; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sqlListenRetry):
+			}
+			if conn, err = s.listen(ctx); err != nil {
+				s.log.WithError(err).Warn("failed to resume registration change feed")
+			}
+		}
+	}
+}
+
+// dispatchRegistration calls listener with the stored registration of impi,
+// or nil if it was deleted
+func (s *SQLHSSStore) dispatchRegistration(impi string, listener RegistrationListener) {
+	reg, err := s.GetRegistration(impi)
+	if errors.Is(err, ErrNotFound) {
+		listener(impi, nil)
+		return
+	}
+	if err != nil {
+		s.log.WithError(err).WithField("impi", impi).Error("failed to read changed registration")
+		return
+	}
+	listener(impi, reg)
+}
+
+// ListRegistrations lists the registrations held by the S-CSCF scscfName,
+// ordered by IMPI
+func (s *SQLHSSStore) ListRegistrations(scscfName string) ([]*ims.Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT data FROM hss_registrations WHERE scscf = ? ORDER BY impi`), scscfName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list registrations: %w", err)
+	}
+	defer rows.Close()
+
+	regs := make([]*ims.Registration, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read registration: %w", err)
+		}
+		reg, err := decodeRegistration(data)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, reg)
+	}
+	return regs, rows.Err()
+}
+
+// backfillRegistrationSCSCFs records the serving S-CSCF of the stored
+// registrations
+func (s *SQLHSSStore) backfillRegistrationSCSCFs(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT data FROM hss_registrations`)
+	if err != nil {
+		return fmt.Errorf("failed to list registrations: %w", err)
+	}
+	var regs []*ims.Registration
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read registration: %w", err)
+		}
+		reg, err := decodeRegistration(data)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		regs = append(regs, reg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list registrations: %w", err)
+	}
+
+	for _, reg := range regs {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE hss_registrations SET scscf = ? WHERE impi = ?`), reg.SCSCFName, reg.IMPI); err != nil {
+			return fmt.Errorf("failed to index registration: %w", err)
+		}
+	}
+	return nil
+}
+
+// AssignSCSCF stores the S-CSCF chosen by selectSCSCF for a subscriber
+func (s *SQLHSSStore) AssignSCSCF(impi string, selectSCSCF SCSCFSelector) (string, error) {
+	var assigned string
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var data string
+		err := tx.QueryRowContext(ctx, s.dialect.rebind(
+			`SELECT data FROM hss_subscribers WHERE impi = ?`+s.dialect.forUpdate), impi).Scan(&data)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("subscriber %w: %s", ErrNotFound, impi)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read subscriber: %w", err)
+		}
+
+		sub, err := decodeSubscriber(data)
+		if err != nil {
+			return err
+		}
+		if assigned, err = selectSCSCF(sub.SCSCFName); err != nil || assigned == sub.SCSCFName {
+			return err
+		}
+		sub.SCSCFName = assigned
+		sub.Version++
+		updated, err := json.Marshal(sub)
+		if err != nil {
+			return fmt.Errorf("failed to encode subscriber: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE hss_subscribers SET data = ?, updated_at = ? WHERE impi = ?`),
+			string(updated), time.Now().UTC(), impi)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"impi":  impi,
+		"scscf": assigned,
+	}).Info("S-CSCF assigned")
+	return assigned, nil
+}
+
+// AdvanceSQN replaces the AKA sequence number of a subscriber with the one
+// returned by advance and returns it, holding the subscriber row locked
+func (s *SQLHSSStore) AdvanceSQN(impi string, advance SQNAdvancer) (uint64, error) {
+	var sqn uint64
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeOpTimeout)
+	defer cancel()
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		sub, err := s.lockedSubscriber(ctx, tx, impi)
+		if err != nil {
+			return err
+		}
+		sqn = advance(sub.AuthData.SQN)
+		sub.AuthData.SQN = sqn
+		sub.Version++
+		updated, err := json.Marshal(sub)
+		if err != nil {
+			return fmt.Errorf("failed to encode subscriber: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE hss_subscribers SET data = ?, updated_at = ? WHERE impi = ?`),
+			string(updated), time.Now().UTC(), impi)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sqn, nil
+}
+
+// GetSCSCFForSubscriber retrieves the assigned S-CSCF for a subscriber
+func (s *SQLHSSStore) GetSCSCFForSubscriber(impi string) (string, error) {
+	sub, err := s.GetSubscriber(impi)
+	if err != nil {
+		return "", err
+	}
+	if sub.SCSCFName == "" {
+		return "", fmt.Errorf("no S-CSCF assigned for subscriber: %s", impi)
+	}
+	return sub.SCSCFName, nil
+}
+
+// decodeSubscriber decodes a stored subscriber document
+func decodeSubscriber(data string) (*ims.Subscriber, error) {
+	sub := &ims.Subscriber{}
+	if err := json.Unmarshal([]byte(data), sub); err != nil {
+		return nil, fmt.Errorf("failed to decode subscriber: %w", err)
+	}
+	return sub, nil
+}
+
+// decodeRegistration decodes a stored registration document
+func decodeRegistration(data string) (*ims.Registration, error) {
+	reg := &ims.Registration{}
+	if err := json.Unmarshal([]byte(data), reg); err != nil {
+		return nil, fmt.Errorf("failed to decode registration: %w", err)
+	}
+	return reg, nil
+}
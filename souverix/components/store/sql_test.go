@@ -0,0 +1,95 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteHSSStore_Conformance(t *testing.T) {
+	testHSSStoreConformance(t, func(t *testing.T) (HSSStore, func() HSSStore) {
+		path := filepath.Join(t.TempDir(), "hss.db")
+		store, err := OpenSQLiteHSSStore(path, testLogger())
+		if err != nil {
+			t.Fatalf("OpenSQLiteHSSStore() error = %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		reopen := func() HSSStore {
+			reopened, err := OpenSQLiteHSSStore(path, testLogger())
+			if err != nil {
+				t.Fatalf("OpenSQLiteHSSStore() reopen error = %v", err)
+			}
+			t.Cleanup(func() { reopened.Close() })
+			return reopened
+		}
+		return store, reopen
+	})
+}
+
+func TestSQLiteHSSStore_InMemory(t *testing.T) {
+	store, err := OpenSQLiteHSSStore(":memory:", testLogger())
+	if err != nil {
+		t.Fatalf("OpenSQLiteHSSStore() error = %v", err)
+	}
+	defer store.Close()
+
+	subs, err := store.ListSubscribers()
+	if err != nil {
+		t.Fatalf("ListSubscribers() error = %v", err)
+	}
+	if len(subs) != 0 {
+		t.Errorf("ListSubscribers() on a new database returned %d subscribers", len(subs))
+	}
+}
+
+func TestSQLiteHSSStore_MigrationsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hss.db")
+
+	for i := 0; i < 2; i++ {
+		store, err := OpenSQLiteHSSStore(path, testLogger())
+		if err != nil {
+			t.Fatalf("OpenSQLiteHSSStore() attempt %d error = %v", i+1, err)
+		}
+
+		var applied int
+		if err := store.db.QueryRow("SELECT COUNT(*) FROM hss_schema_migrations").Scan(&applied); err != nil {
+			t.Fatalf("failed to read migrations: %v", err)
+		}
+		if applied != len(sqlMigrations) {
+			t.Errorf("attempt %d: %d migrations recorded, want %d", i+1, applied, len(sqlMigrations))
+		}
+		store.Close()
+	}
+}
+
+// TestPostgresHSSStore_Conformance runs against the database named by
+// HSS_TEST_POSTGRES_DSN. The HSS tables in that database are emptied.
+func TestPostgresHSSStore_Conformance(t *testing.T) {
+	dsn := os.Getenv("HSS_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("HSS_TEST_POSTGRES_DSN not set")
+	}
+
+	testHSSStoreConformance(t, func(t *testing.T) (HSSStore, func() HSSStore) {
+		store, err := OpenPostgresHSSStore(dsn, testLogger())
+		if err != nil {
+			t.Fatalf("OpenPostgresHSSStore() error = %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		if _, err := store.db.Exec("TRUNCATE hss_registrations, hss_impus, hss_tn_ranges, hss_subscribers"); err != nil {
+			t.Fatalf("failed to reset tables: %v", err)
+		}
+
+		reopen := func() HSSStore {
+			reopened, err := OpenPostgresHSSStore(dsn, testLogger())
+			if err != nil {
+				t.Fatalf("OpenPostgresHSSStore() reopen error = %v", err)
+			}
+			t.Cleanup(func() { reopened.Close() })
+			return reopened
+		}
+		return store, reopen
+	})
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+// tnRange is an inclusive block of telephone numbers of a subscriber,
+// normalized to digits. Start and end have the same number of digits.
+type tnRange struct {
+	impi       string
+	start, end string
+}
+
+// subscriberTNRanges returns the telephone numbers indexed for a subscriber:
+// each numeric public identity as a single number range, then its telephone
+// number ranges
+func subscriberTNRanges(sub *ims.Subscriber) []tnRange {
+	var ranges []tnRange
+	seen := make(map[tnRange]bool)
+	add := func(start, end string) {
+		r := tnRange{impi: sub.IMPI, start: start, end: end}
+		if start != "" && len(start) == len(end) && start <= end && !seen[r] {
+			seen[r] = true
+			ranges = append(ranges, r)
+		}
+	}
+
+	for _, identity := range append([]string{sub.IMPU}, sub.ServiceProfile.PublicIdentities...) {
+		tn := NormalizeTN(IdentityTN(identity))
+		add(tn, tn)
+	}
+	for _, r := range sub.ServiceProfile.TelephoneNumberRanges {
+		add(NormalizeTN(r.Start), NormalizeTN(r.End))
+	}
+	return ranges
+}
+
+// SubscriberOwnsTN reports whether tn is one of the subscriber's public
+// identities or falls in one of its telephone number ranges
+func SubscriberOwnsTN(sub *ims.Subscriber, tn string) bool {
+	tn = NormalizeTN(tn)
+	if tn == "" {
+		return false
+	}
+	for _, r := range subscriberTNRanges(sub) {
+		if r.covers(tn) {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityTN returns the telephone number of a tel URI or a SIP URI with a
+// numeric user part, or "" if the identity is not a number
+func IdentityTN(identity string) string {
+	identity = strings.Trim(strings.TrimSpace(identity), "<>")
+	switch {
+	case strings.HasPrefix(identity, "tel:"):
+		identity = strings.TrimPrefix(identity, "tel:")
+	case strings.HasPrefix(identity, "sip:"), strings.HasPrefix(identity, "sips:"):
+		_, identity, _ = strings.Cut(identity, ":")
+		user, _, ok := strings.Cut(identity, "@")
+		if !ok {
+			return ""
+		}
+		identity = user
+	default:
+		return ""
+	}
+	return strings.Split(identity, ";")[0]
+}
+
+// NormalizeTN strips visual separators and the leading + from a telephone number
+func NormalizeTN(tn string) string {
+	var b strings.Builder
+	for _, r := range tn {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' || r == '-' || r == '.' || r == ' ' || r == '(' || r == ')':
+			// visual separators
+		default:
+			return ""
+		}
+	}
+	return b.String()
+}
+
+// covers reports whether the normalized number tn is in r
+func (r tnRange) covers(tn string) bool {
+	return len(r.start) == len(tn) && r.start <= tn && tn <= r.end
+}
+
+// tnRangeLess orders ranges by end, then IMPI. Of the ranges covering a
+// number, the first in this order owns it, so that a number assigned to a
+// subscriber takes precedence over a block around it.
+func tnRangeLess(a, b tnRange) bool {
+	if a.end != b.end {
+		return a.end < b.end
+	}
+	return a.impi < b.impi
+}
+
+// findTNRange returns the owner of the normalized number tn in ranges of
+// its length sorted by tnRangeLess
+func findTNRange(ranges []tnRange, tn string) (tnRange, bool) {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].end >= tn })
+	for ; i < len(ranges); i++ {
+		if ranges[i].covers(tn) {
+			return ranges[i], true
+		}
+	}
+	return tnRange{}, false
+}
@@ -0,0 +1,36 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+func TestSubscriberOwnsTN(t *testing.T) {
+	sub := &ims.Subscriber{
+		ServiceProfile: ims.ServiceProfile{
+			PublicIdentities: []string{"sip:+15145559876@ims.local;user=phone"},
+			TelephoneNumberRanges: []ims.TNRange{
+				{Start: "+15145550100", End: "+15145550199"},
+			},
+		},
+	}
+
+	tests := []struct {
+		tn   string
+		want bool
+	}{
+		{"+15145559876", true},
+		{"15145550100", true},
+		{"+1 514 555 0199", true},
+		{"+15145550200", false},
+		{"+151455501000", false},
+		{"alice", false},
+	}
+
+	for _, tt := range tests {
+		if got := SubscriberOwnsTN(sub, tt.tn); got != tt.want {
+			t.Errorf("SubscriberOwnsTN(%q) = %v, want %v", tt.tn, got, tt.want)
+		}
+	}
+}
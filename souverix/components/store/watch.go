@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+// RegistrationListener is called after the registration of impi was stored,
+// or deleted when reg is nil
+type RegistrationListener func(impi string, reg *ims.Registration)
+
+// registrationFeed delivers the registration changes of a store that lives
+// in one process to its listeners
+type registrationFeed struct {
+	mu        sync.RWMutex
+	listeners map[int]RegistrationListener
+	next      int
+}
+
+// watch registers listener until ctx is done
+func (f *registrationFeed) watch(ctx context.Context, listener RegistrationListener) {
+	f.mu.Lock()
+	if f.listeners == nil {
+		f.listeners = make(map[int]RegistrationListener)
+	}
+	id := f.next
+	f.next++
+	f.listeners[id] = listener
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.listeners, id)
+		f.mu.Unlock()
+	}()
+}
+
+// notify calls every listener with its own copy of reg. It must be called
+// without store locks held, as listeners may read the store.
+func (f *registrationFeed) notify(impi string, reg *ims.Registration) {
+	f.mu.RLock()
+	listeners := make([]RegistrationListener, 0, len(f.listeners))
+	for _, listener := range f.listeners {
+		listeners = append(listeners, listener)
+	}
+	f.mu.RUnlock()
+
+	for _, listener := range listeners {
+		var regCopy *ims.Registration
+		if reg != nil {
+			copied := *reg
+			regCopy = &copied
+		}
+		listener(impi, regCopy)
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/dasmlab/ims/pkg/ims"
+)
+
+// WildcardIdentity is a wildcarded IMPU or PSI of a subscriber with its
+// wildcard (TS 23.003 section 13.5)
+type WildcardIdentity struct {
+	IMPI     string `json:"impi"`
+	IMPU     string `json:"impu"`
+	Wildcard string `json:"wildcard"`
+}
+
+// subscriberWildcards returns the wildcarded identities indexed for a
+// subscriber, ordered by IMPU
+func subscriberWildcards(sub *ims.Subscriber) []WildcardIdentity {
+	var wildcards []WildcardIdentity
+	seen := make(map[string]bool)
+	profiles := append([]ims.ServiceProfile{sub.ServiceProfile}, sub.AdditionalProfiles...)
+	for _, profile := range profiles {
+		for _, identity := range profile.PublicIdentities {
+			wildcard := profile.IdentityAttributes[identity].Wildcard
+			if wildcard != "" && !seen[identity] {
+				seen[identity] = true
+				wildcards = append(wildcards, WildcardIdentity{IMPI: sub.IMPI, IMPU: identity, Wildcard: wildcard})
+			}
+		}
+	}
+	sortWildcards(wildcards)
+	return wildcards
+}
+
+// sortWildcards orders wildcarded identities by IMPI, then IMPU
+func sortWildcards(wildcards []WildcardIdentity) {
+	sort.Slice(wildcards, func(i, j int) bool {
+		if wildcards[i].IMPI != wildcards[j].IMPI {
+			return wildcards[i].IMPI < wildcards[j].IMPI
+		}
+		return wildcards[i].IMPU < wildcards[j].IMPU
+	})
+}
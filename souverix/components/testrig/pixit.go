@@ -5,6 +5,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/dasmlab/ims/internal/config"
 	"gopkg.in/yaml.v3"
 )
 
@@ -219,6 +220,16 @@ func (p *PIXITConfig) MergePIXIT(other *PIXITConfig) {
 	// ... (merge other fields as needed)
 }
 
+// ApplyToConfig applies the PIXIT settings that drive runtime behaviour to cfg
+func (p *PIXITConfig) ApplyToConfig(cfg *config.Config) {
+	cfg.ApplyPIXIT(config.PIXITSettings{
+		AttestationPolicy:  p.STIR.AttestationPolicy,
+		SigningKeySource:   p.STIR.SigningKeySource,
+		ReSignTransitCalls: p.STIR.ReSignTransitCalls,
+		SessionTimer:       p.Timers.SessionTimer,
+	})
+}
+
 // ValidatePIXIT validates PIXIT configuration
 func (p *PIXITConfig) ValidatePIXIT() error {
 	if p.Timers.T1 < 100*time.Millisecond || p.Timers.T1 > 1000*time.Millisecond {
@@ -230,7 +241,7 @@ func (p *PIXITConfig) ValidatePIXIT() error {
 	}
 
 	if p.Chaos.PacketLoss < 0 || p.Chaos.PacketLoss > 20 {
-		return fmt.Errorf("packet loss must be between 0% and 20%")
+		return fmt.Errorf("packet loss must be between 0%% and 20%%")
 	}
 
 	return nil
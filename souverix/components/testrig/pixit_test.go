@@ -0,0 +1,72 @@
+package testrig
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dasmlab/ims/internal/config"
+)
+
+func TestPIXITConfig_ApplyToConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		stir          STIRConfig
+		transit       string
+		wantTransit   string
+		wantKeySource string
+	}{
+		{"re-sign transit calls", STIRConfig{ReSignTransitCalls: true, SigningKeySource: "File"}, "keep", "resign", "file"},
+		{"keep transit calls", STIRConfig{SigningKeySource: "HSM"}, "resign", "keep", "pkcs11"},
+		{"div policy kept", STIRConfig{SigningKeySource: "Vault"}, "div", "div", "vault"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.IMS.SBC.STIRTransitPolicy = tt.transit
+			p := &PIXITConfig{STIR: tt.stir}
+			p.ApplyToConfig(cfg)
+			if cfg.IMS.SBC.STIRTransitPolicy != tt.wantTransit {
+				t.Errorf("STIRTransitPolicy = %q, want %q", cfg.IMS.SBC.STIRTransitPolicy, tt.wantTransit)
+			}
+			if cfg.ZeroTrust.STIRKey.Source != tt.wantKeySource {
+				t.Errorf("STIRKey.Source = %q, want %q", cfg.ZeroTrust.STIRKey.Source, tt.wantKeySource)
+			}
+		})
+	}
+}
+
+func TestLoad_PIXIT(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pixit.yaml")
+	pixit := DefaultPIXIT()
+	pixit.STIR.ReSignTransitCalls = true
+	pixit.Timers.SessionTimer = 600 * time.Second
+	if err := pixit.SavePIXIT(path); err != nil {
+		t.Fatalf("SavePIXIT() error = %v", err)
+	}
+	t.Setenv("SBC_STIR_TRANSIT_POLICY", "keep")
+
+	t.Setenv("PIXIT_FILE", "")
+	if cfg := config.Load(); cfg.IMS.SBC.STIRTransitPolicy != "keep" {
+		t.Fatalf("Load() without PIXIT transit policy = %q, want keep", cfg.IMS.SBC.STIRTransitPolicy)
+	}
+
+	// The runtime configuration applies the PIXIT file
+	t.Setenv("PIXIT_FILE", path)
+	cfg := config.Load()
+	if cfg.IMS.SBC.STIRTransitPolicy != "resign" || cfg.IMS.SBC.STIRAttestation != "auto" {
+		t.Errorf("STIR transit %q, attestation %q, want the PIXIT ones", cfg.IMS.SBC.STIRTransitPolicy, cfg.IMS.SBC.STIRAttestation)
+	}
+	if cfg.IMS.SBC.SessionInterval != 600*time.Second {
+		t.Errorf("SessionInterval = %v, want the PIXIT session timer 10m0s", cfg.IMS.SBC.SessionInterval)
+	}
+
+	// A PIXIT file that cannot be read leaves the environment settings
+	t.Setenv("PIXIT_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	if cfg := config.Load(); cfg.IMS.SBC.STIRTransitPolicy != "keep" {
+		t.Errorf("Load() with a missing PIXIT file transit policy = %q, want keep", cfg.IMS.SBC.STIRTransitPolicy)
+	}
+	if _, err := config.LoadPIXIT(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadPIXIT() of a missing file error = nil")
+	}
+}